@@ -0,0 +1,114 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func printArchiveStats(verb string, stats libkbfs.TlfArchiveStats) {
+	fmt.Printf("%s TLF %s: %d revisions, %d key halves, %d block references\n",
+		verb, stats.TlfID, stats.MDs, stats.KeyHalves, stats.Blocks)
+	if stats.MissingBlocks > 0 {
+		fmt.Printf("%d blocks referenced by old revisions were already "+
+			"deleted, and are missing from the archive\n",
+			stats.MissingBlocks)
+	}
+}
+
+func exportArchiveHelper(ctx context.Context, config libkbfs.Config,
+	args []string) (err error) {
+	flags := flag.NewFlagSet("kbfs export", flag.ContinueOnError)
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("a TLF and an archive file must be specified")
+	}
+
+	tlfID, err := getTlfID(ctx, config, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	filename := flags.Arg(1)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			// Don't leave a partial archive behind.
+			os.Remove(filename)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	stats, err := libkbfs.ExportTlfArchive(ctx, config, tlfID, w)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	printArchiveStats("Exported", stats)
+	return nil
+}
+
+func exportArchive(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := exportArchiveHelper(ctx, config, args)
+	if err != nil {
+		printError("export", err)
+		return 1
+	}
+	return 0
+}
+
+func importArchiveHelper(ctx context.Context, config libkbfs.Config,
+	args []string) error {
+	flags := flag.NewFlagSet("kbfs import", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("exactly one archive file must be specified")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stats, err := libkbfs.ImportTlfArchive(ctx, config, bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	printArchiveStats("Imported", stats)
+	return nil
+}
+
+func importArchive(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := importArchiveHelper(ctx, config, args)
+	if err != nil {
+		printError("import", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// getTLFFolderBranch returns the folder-branch of the TLF containing
+// the given path.
+func getTLFFolderBranch(ctx context.Context, config libkbfs.Config,
+	pathStr string) (libkbfs.FolderBranch, fsrpc.Path, error) {
+	p, err := fsrpc.NewPath(pathStr)
+	if err != nil {
+		return libkbfs.FolderBranch{}, fsrpc.Path{}, err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return libkbfs.FolderBranch{}, fsrpc.Path{},
+			fmt.Errorf("%s is not in a top-level folder", p)
+	}
+	rootPath := fsrpc.Path{
+		PathType: fsrpc.TLFPathType,
+		Public:   p.Public,
+		TLFName:  p.TLFName,
+	}
+	rootNode, err := rootPath.GetDirNode(ctx, config)
+	if err != nil {
+		return libkbfs.FolderBranch{}, fsrpc.Path{}, err
+	}
+	return rootNode.GetFolderBranch(), p, nil
+}
+
+func conflictsHelper(ctx context.Context, config libkbfs.Config,
+	args []string) error {
+	flags := flag.NewFlagSet("kbfs conflicts", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errExactlyOnePath
+	}
+
+	fb, p, err := getTLFFolderBranch(ctx, config, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	changes, err := config.KBFSOps().GetUnmergedChanges(ctx, fb)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Printf("%s has no unmerged changes\n", p)
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Printf("/%s (%s):\n", change.Path, change.Choice)
+		for _, op := range change.Unmerged {
+			fmt.Printf("  mine:   %s\n", op)
+		}
+		for _, op := range change.Merged {
+			fmt.Printf("  theirs: %s\n", op)
+		}
+	}
+	return nil
+}
+
+func conflicts(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := conflictsHelper(ctx, config, args)
+	if err != nil {
+		printError("conflicts", err)
+		return 1
+	}
+	return 0
+}
+
+func resolveHelper(ctx context.Context, config libkbfs.Config,
+	args []string) error {
+	flags := flag.NewFlagSet("kbfs resolve", flag.ContinueOnError)
+	choiceStr := flags.String("choice", "both",
+		"Which version of each file to keep: mine, theirs, both or auto.")
+	noWait := flags.Bool("no-wait", false,
+		"Don't wait for conflict resolution to finish.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return errAtLeastOnePath
+	}
+	choice, err := libkbfs.ParseConflictChoice(*choiceStr)
+	if err != nil {
+		return err
+	}
+
+	var fbs []libkbfs.FolderBranch
+	seen := make(map[libkbfs.FolderBranch]bool)
+	for _, pathStr := range flags.Args() {
+		fb, p, err := getTLFFolderBranch(ctx, config, pathStr)
+		if err != nil {
+			return err
+		}
+		err = config.KBFSOps().SetConflictChoice(
+			ctx, fb, strings.Join(p.TLFComponents, "/"), choice)
+		if err != nil {
+			return err
+		}
+		if !seen[fb] {
+			seen[fb] = true
+			fbs = append(fbs, fb)
+		}
+	}
+
+	if *noWait {
+		return nil
+	}
+	// Wait for the resolutions using the new choices to finish.
+	for _, fb := range fbs {
+		err := config.KBFSOps().SyncFromServerForTesting(ctx, fb)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolve(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := resolveHelper(ctx, config, args)
+	if err != nil {
+		printError("resolve", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// copyFile copies the contents of the file at src to dst, replacing
+// any file that's already there.  Files copied within a TLF share
+// their blocks with the source, rather than being re-uploaded.
+func copyFile(ctx context.Context, src, dst fsPath, exec bool) (err error) {
+	same, err := sameTLF(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	if same {
+		return dst.(kbfsPath).copyFrom(ctx, src.(kbfsPath), exec)
+	}
+
+	r, err := src.openRead(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.create(ctx, exec)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := w.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// copySymlink makes dst a symlink with the same target as the symlink
+// at src, replacing any non-directory that's already there.
+func copySymlink(ctx context.Context, src, dst fsPath) error {
+	target, err := src.readlink(ctx)
+	if err != nil {
+		return err
+	}
+	dstEntry, exists, err := dst.stat(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if dstEntry.Type == libkbfs.Dir {
+			return fmt.Errorf("cannot overwrite directory %s with a symlink",
+				dst)
+		}
+		err = dst.remove(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return dst.symlink(ctx, target)
+}
+
+// isWithin returns true if p is the same entry as dir, or is
+// somewhere under it.  Entries are compared rather than path strings,
+// so that different names for the same directory are caught.
+func isWithin(ctx context.Context, p, dir fsPath) (bool, error) {
+	for {
+		same, err := dir.sameFile(ctx, p)
+		if err != nil || same {
+			return same, err
+		}
+		var ok bool
+		p, ok = p.parent()
+		if !ok {
+			return false, nil
+		}
+	}
+}
+
+// checkNotWithin returns an error if dst is the directory src, or is
+// somewhere under it, since copying src there would never finish.
+func checkNotWithin(ctx context.Context, src, dst fsPath) error {
+	within, err := isWithin(ctx, dst, src)
+	if err != nil {
+		return err
+	}
+	if within {
+		return fmt.Errorf("cannot copy directory %s into itself, %s",
+			src, dst)
+	}
+	return nil
+}
+
+// copyPath copies the entry at src, which has the given attributes,
+// to dst.  Directories are only copied if recursive is set, and are
+// merged into any directory already at dst.
+func copyPath(ctx context.Context, src, dst fsPath, srcEntry pathEntry,
+	recursive, verbose bool) error {
+	switch srcEntry.Type {
+	case libkbfs.Dir:
+		if !recursive {
+			return fmt.Errorf("%s is a directory (not copied)", src)
+		}
+		dstEntry, exists, err := dst.stat(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if verbose {
+				fmt.Fprintf(os.Stderr, "Creating directory %s\n", dst)
+			}
+			err = dst.mkdir(ctx)
+			if err != nil {
+				return err
+			}
+		} else if dstEntry.Type != libkbfs.Dir {
+			return fmt.Errorf("cannot overwrite non-directory %s with "+
+				"directory %s", dst, src)
+		}
+
+		names, err := src.readDir(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			childSrc, err := src.join(name)
+			if err != nil {
+				return err
+			}
+			childDst, err := dst.join(name)
+			if err != nil {
+				return err
+			}
+			childEntry, _, err := childSrc.stat(ctx)
+			if err != nil {
+				return err
+			}
+			err = copyPath(ctx, childSrc, childDst, childEntry,
+				recursive, verbose)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case libkbfs.Sym:
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Copying symlink %s to %s\n", src, dst)
+		}
+		return copySymlink(ctx, src, dst)
+
+	default:
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Copying %s (%d bytes) to %s\n",
+				src, srcEntry.Size, dst)
+		}
+		return copyFile(ctx, src, dst, srcEntry.Type == libkbfs.Exec)
+	}
+}
+
+// resolveSrcsAndDst parses the given source and destination paths
+// for cp and mv.  Like cp, if there are multiple sources, the
+// destination must be an existing directory, and each source is
+// copied into it; if there is only one source and the destination is
+// an existing directory, the source is also copied into it;
+// otherwise the source is copied to the destination path itself.
+// Also like cp, a source whose destination is the source itself, or
+// a directory source whose destination is under it, is an error.  The returned slices hold the source paths, their
+// attributes, and the final destination path for each.
+func resolveSrcsAndDst(ctx context.Context, config libkbfs.Config,
+	args []string) (srcs []fsPath, srcEntries []pathEntry,
+	dsts []fsPath, err error) {
+	if len(args) < 2 {
+		return nil, nil, nil, errSrcAndDst
+	}
+
+	dst := newFSPath(config, args[len(args)-1])
+	dstEntry, dstExists, err := dst.stat(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	intoDir := dstExists && dstEntry.Type == libkbfs.Dir
+	if len(args) > 2 && !intoDir {
+		return nil, nil, nil, fmt.Errorf("%s is not a directory", dst)
+	}
+
+	for _, arg := range args[:len(args)-1] {
+		src := newFSPath(config, arg)
+		srcEntry, exists, err := src.stat(ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !exists {
+			return nil, nil, nil, fmt.Errorf("%s does not exist", src)
+		}
+		_, srcIsLocal := src.(localPath)
+		_, dstIsLocal := dst.(localPath)
+		if srcIsLocal && dstIsLocal {
+			return nil, nil, nil, errNoKBFSPath
+		}
+
+		srcDst := dst
+		if intoDir {
+			name, err := src.basename()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			srcDst, err = dst.join(name)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		same, err := src.sameFile(ctx, srcDst)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if same {
+			return nil, nil, nil, fmt.Errorf(
+				"%s and %s are the same file", src, srcDst)
+		}
+		if srcEntry.Type == libkbfs.Dir {
+			err = checkNotWithin(ctx, src, srcDst)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		srcs = append(srcs, src)
+		srcEntries = append(srcEntries, srcEntry)
+		dsts = append(dsts, srcDst)
+	}
+	return srcs, srcEntries, dsts, nil
+}
+
+func cp(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs cp", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "Copy directories recursively.")
+	verbose := flags.Bool("v", false, "Print extra status output.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("cp", err)
+		return 1
+	}
+
+	srcs, srcEntries, dsts, err := resolveSrcsAndDst(ctx, config, flags.Args())
+	if err != nil {
+		printError("cp", err)
+		return 1
+	}
+
+	for i, src := range srcs {
+		err := copyPath(ctx, src, dsts[i], srcEntries[i], *recursive, *verbose)
+		if err != nil {
+			printError("cp", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
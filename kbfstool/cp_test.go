@@ -0,0 +1,96 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func writeTestFile(ctx context.Context, t *testing.T, config libkbfs.Config,
+	path, contents string) {
+	w, err := newFSPath(config, path).create(ctx, false)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func readTestFile(ctx context.Context, t *testing.T, config libkbfs.Config,
+	path string) string {
+	r, err := newFSPath(config, path).openRead(ctx)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// Tests that a file can't be copied onto itself, even through a
+// different name for its TLF.
+func TestCopyOntoItselfAcrossTLFNames(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	writeTestFile(ctx, t, config, "/keybase/private/alice,bob/f", "hello")
+
+	_, _, _, err := resolveSrcsAndDst(ctx, config, []string{
+		"/keybase/private/alice,bob/f", "/keybase/private/bob,alice/f"})
+	require.Error(t, err)
+	err = copyFile(ctx, newFSPath(config, "/keybase/private/alice,bob/f"),
+		newFSPath(config, "/keybase/private/bob,alice/f"), false)
+	require.Error(t, err)
+	require.Equal(t, "hello",
+		readTestFile(ctx, t, config, "/keybase/private/alice,bob/f"))
+
+	// A copy to another name in the same TLF still works.
+	err = copyFile(ctx, newFSPath(config, "/keybase/private/alice,bob/f"),
+		newFSPath(config, "/keybase/private/bob,alice/g"), false)
+	require.NoError(t, err)
+	require.Equal(t, "hello",
+		readTestFile(ctx, t, config, "/keybase/private/alice,bob/g"))
+}
+
+// Tests that a directory can't be copied or synced into itself.
+func TestCopyDirIntoItself(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	err := newFSPath(config, "/keybase/private/alice,bob/d").mkdir(ctx)
+	require.NoError(t, err)
+	writeTestFile(ctx, t, config, "/keybase/private/alice,bob/d/f", "hello")
+
+	for _, dst := range []string{
+		"/keybase/private/alice,bob/d/sub",
+		"/keybase/private/bob,alice/d/sub/subsub",
+	} {
+		_, _, _, err := resolveSrcsAndDst(ctx, config, []string{
+			"/keybase/private/alice,bob/d", dst})
+		require.Error(t, err, dst)
+		err = syncHelper(ctx, config, []string{
+			"/keybase/private/alice,bob/d", dst})
+		require.Error(t, err, dst)
+	}
+	err = syncHelper(ctx, config, []string{
+		"/keybase/private/alice,bob/d", "/keybase/private/alice,bob/d"})
+	require.Error(t, err)
+
+	// Copying into a sibling directory is fine.
+	srcs, srcEntries, dsts, err := resolveSrcsAndDst(ctx, config, []string{
+		"/keybase/private/alice,bob/d", "/keybase/private/alice,bob/e"})
+	require.NoError(t, err)
+	err = copyPath(ctx, srcs[0], dsts[0], srcEntries[0], true, false)
+	require.NoError(t, err)
+	require.Equal(t, "hello",
+		readTestFile(ctx, t, config, "/keybase/private/alice,bob/e/f"))
+}
@@ -11,6 +11,9 @@ import (
 
 var errExactlyOnePath = errors.New("exactly one path must be specified")
 var errAtLeastOnePath = errors.New("at least one path must be specified")
+var errExactlyTwoPaths = errors.New("exactly two paths must be specified")
+var errSrcAndDst = errors.New("at least one source path and a destination path must be specified")
+var errNoKBFSPath = errors.New("at least one of the paths must be in KBFS")
 
 type cannotWriteErr struct {
 	pathStr string
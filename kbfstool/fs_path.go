@@ -0,0 +1,509 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// pathEntry is the subset of an entry's attributes that the copying
+// commands care about.
+type pathEntry struct {
+	Type  libkbfs.EntryType
+	Size  uint64
+	Mtime time.Time
+}
+
+// fsPath is a path to an entry that's either in KBFS or on the local
+// file system, so that the copying commands can treat both the same
+// way.
+type fsPath interface {
+	String() string
+	// basename returns the last component of the path.
+	basename() (string, error)
+	// join returns the path of the given child of this path.
+	join(name string) (fsPath, error)
+	// parent returns the path of the directory containing this
+	// path, or false if this is a root.
+	parent() (fsPath, bool)
+	// stat returns the entry at this path, or false if there isn't
+	// one.  Symlinks are not followed.
+	stat(ctx context.Context) (pathEntry, bool, error)
+	// sameFile returns true if this path and other lead to the
+	// same existing entry.  Symlinks are not followed.
+	sameFile(ctx context.Context, other fsPath) (bool, error)
+	// readDir returns the sorted names of the children of the
+	// directory at this path.
+	readDir(ctx context.Context) ([]string, error)
+	mkdir(ctx context.Context) error
+	readlink(ctx context.Context) (string, error)
+	symlink(ctx context.Context, target string) error
+	openRead(ctx context.Context) (io.ReadCloser, error)
+	// create creates the file at this path, or truncates it if it
+	// already exists.  Closing the returned writer makes sure the
+	// data is durable.
+	create(ctx context.Context, exec bool) (io.WriteCloser, error)
+	setMtime(ctx context.Context, mtime time.Time) error
+	// remove removes the file, symlink or empty directory at this
+	// path.
+	remove(ctx context.Context) error
+}
+
+// newFSPath returns the fsPath for the given string.  Paths under
+// /keybase are in KBFS; all other paths are local.
+func newFSPath(config libkbfs.Config, pathStr string) fsPath {
+	p, err := fsrpc.NewPath(pathStr)
+	if err != nil {
+		return localPath(pathStr)
+	}
+	return kbfsPath{config, p}
+}
+
+type kbfsPath struct {
+	config libkbfs.Config
+	p      fsrpc.Path
+}
+
+var _ fsPath = kbfsPath{}
+
+func (kp kbfsPath) String() string {
+	return kp.p.String()
+}
+
+func (kp kbfsPath) basename() (string, error) {
+	_, name, err := kp.p.DirAndBasename()
+	return name, err
+}
+
+func (kp kbfsPath) join(name string) (fsPath, error) {
+	// Copy the components first, since fsrpc.Path.Join may append
+	// to them in place.
+	p := kp.p
+	p.TLFComponents = append([]string(nil), p.TLFComponents...)
+	childP, err := p.Join(name)
+	if err != nil {
+		return nil, err
+	}
+	return kbfsPath{kp.config, childP}, nil
+}
+
+func (kp kbfsPath) parent() (fsPath, bool) {
+	dir, _, err := kp.p.DirAndBasename()
+	if err != nil {
+		return nil, false
+	}
+	return kbfsPath{kp.config, dir}, true
+}
+
+// getParentNode returns the node of the directory containing this
+// path, and this path's basename.
+func (kp kbfsPath) getParentNode(ctx context.Context) (
+	libkbfs.Node, string, error) {
+	if kp.p.PathType != fsrpc.TLFPathType || len(kp.p.TLFComponents) == 0 {
+		return nil, "", cannotWriteErr{kp.p.String(), nil}
+	}
+	dir, name, err := kp.p.DirAndBasename()
+	if err != nil {
+		return nil, "", err
+	}
+	parentNode, err := dir.GetDirNode(ctx, kp.config)
+	if err != nil {
+		return nil, "", err
+	}
+	return parentNode, name, nil
+}
+
+func (kp kbfsPath) stat(ctx context.Context) (pathEntry, bool, error) {
+	node, de, err := kp.p.GetNode(ctx, kp.config)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return pathEntry{}, false, nil
+	} else if err != nil {
+		return pathEntry{}, false, err
+	}
+	if node != nil {
+		de, err = kp.config.KBFSOps().Stat(ctx, node)
+		if err != nil {
+			return pathEntry{}, false, err
+		}
+	}
+	return pathEntry{de.Type, de.Size, time.Unix(0, de.Mtime)}, true, nil
+}
+
+func (kp kbfsPath) sameFile(ctx context.Context, other fsPath) (
+	bool, error) {
+	otherKP, ok := other.(kbfsPath)
+	if !ok {
+		return false, nil
+	}
+	// Compare the nodes even for paths with different TLF names,
+	// since they may be different names for the same TLF.
+	node, _, err := kp.p.GetNode(ctx, kp.config)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	otherNode, _, err := otherKP.p.GetNode(ctx, kp.config)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if node == nil || otherNode == nil {
+		// Symlinks don't have their own nodes, so only the same
+		// path leads to the same one.
+		return kp.p.String() == otherKP.p.String(), nil
+	}
+	return node.GetID() == otherNode.GetID(), nil
+}
+
+func (kp kbfsPath) readDir(ctx context.Context) ([]string, error) {
+	if kp.p.PathType != fsrpc.TLFPathType {
+		return nil, fmt.Errorf("cannot list %s", kp.p)
+	}
+	dirNode, err := kp.p.GetDirNode(ctx, kp.config)
+	if err != nil {
+		return nil, err
+	}
+	children, err := kp.config.KBFSOps().GetDirChildren(ctx, dirNode)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (kp kbfsPath) mkdir(ctx context.Context) error {
+	if kp.p.PathType == fsrpc.TLFPathType && len(kp.p.TLFComponents) == 0 {
+		// Looking up a TLF root creates it.
+		_, err := kp.p.GetDirNode(ctx, kp.config)
+		return err
+	}
+	parentNode, name, err := kp.getParentNode(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, err = kp.config.KBFSOps().CreateDir(ctx, parentNode, name)
+	return err
+}
+
+func (kp kbfsPath) readlink(ctx context.Context) (string, error) {
+	_, de, err := kp.p.GetNode(ctx, kp.config)
+	if err != nil {
+		return "", err
+	}
+	if de.Type != libkbfs.Sym {
+		return "", fmt.Errorf("%s is not a symlink, but a %s", kp.p, de.Type)
+	}
+	return de.SymPath, nil
+}
+
+func (kp kbfsPath) symlink(ctx context.Context, target string) error {
+	parentNode, name, err := kp.getParentNode(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = kp.config.KBFSOps().CreateLink(ctx, parentNode, name, target)
+	return err
+}
+
+func (kp kbfsPath) openRead(ctx context.Context) (io.ReadCloser, error) {
+	fileNode, err := kp.p.GetFileNode(ctx, kp.config)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&nodeReader{
+		ctx:     ctx,
+		kbfsOps: kp.config.KBFSOps(),
+		node:    fileNode,
+	}), nil
+}
+
+// syncingNodeWriter is a nodeWriter that syncs the file when it's
+// closed.
+type syncingNodeWriter struct {
+	nodeWriter
+}
+
+func (snw *syncingNodeWriter) Close() error {
+	return snw.kbfsOps.Sync(snw.ctx, snw.node)
+}
+
+func (kp kbfsPath) create(ctx context.Context, exec bool) (
+	io.WriteCloser, error) {
+	parentNode, name, err := kp.getParentNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// As in write, the operations below are racy, but that is
+	// inherent to a distributed FS.
+	kbfsOps := kp.config.KBFSOps()
+	fileNode, de, err := kbfsOps.Lookup(ctx, parentNode, name)
+	switch err.(type) {
+	case nil:
+		if de.Type != libkbfs.File && de.Type != libkbfs.Exec {
+			return nil, fmt.Errorf(
+				"cannot overwrite %s, which is a %s", kp.p, de.Type)
+		}
+		err = kbfsOps.Truncate(ctx, fileNode, 0)
+		if err != nil {
+			return nil, err
+		}
+		if exec != (de.Type == libkbfs.Exec) {
+			err = kbfsOps.SetEx(ctx, fileNode, exec)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case libkbfs.NoSuchNameError:
+		fileNode, _, err = kbfsOps.CreateFile(
+			ctx, parentNode, name, exec, libkbfs.NoExcl)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	return &syncingNodeWriter{nodeWriter{
+		ctx:     ctx,
+		kbfsOps: kbfsOps,
+		node:    fileNode,
+	}}, nil
+}
+
+// copyFrom makes this path a copy of the file at src, which must be
+// in the same TLF, replacing any file that's already there.  The copy
+// shares src's blocks on the server, so no data is re-uploaded.
+func (kp kbfsPath) copyFrom(ctx context.Context, src kbfsPath, exec bool) error {
+	same, err := src.sameFile(ctx, kp)
+	if err != nil {
+		return err
+	}
+	if same {
+		return fmt.Errorf("%s and %s are the same file", src, kp)
+	}
+	srcNode, err := src.p.GetFileNode(ctx, kp.config)
+	if err != nil {
+		return err
+	}
+	parentNode, name, err := kp.getParentNode(ctx)
+	if err != nil {
+		return err
+	}
+
+	// As in create, the operations below are racy, but that is
+	// inherent to a distributed FS.
+	kbfsOps := kp.config.KBFSOps()
+	_, de, err := kbfsOps.Lookup(ctx, parentNode, name)
+	switch err.(type) {
+	case nil:
+		if de.Type != libkbfs.File && de.Type != libkbfs.Exec {
+			return fmt.Errorf(
+				"cannot overwrite %s, which is a %s", kp.p, de.Type)
+		}
+	case libkbfs.NoSuchNameError:
+	default:
+		return err
+	}
+
+	// Make the copy under a temporary name, and only then rename it
+	// over any file that's already there, so that a failed copy
+	// leaves that file alone.
+	tmpName := fmt.Sprintf(".%s.kbfstool-cp-%d", name, time.Now().UnixNano())
+	fileNode, ei, err := kbfsOps.CopyFile(ctx, srcNode, parentNode, tmpName)
+	if err != nil {
+		return err
+	}
+	if exec != (ei.Type == libkbfs.Exec) {
+		err = kbfsOps.SetEx(ctx, fileNode, exec)
+	}
+	if err == nil {
+		err = kbfsOps.Rename(ctx, parentNode, tmpName, parentNode, name)
+	}
+	if err != nil {
+		if rmErr := kbfsOps.RemoveEntry(
+			ctx, parentNode, tmpName); rmErr != nil {
+			printError("cp", rmErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (kp kbfsPath) setMtime(ctx context.Context, mtime time.Time) error {
+	node, _, err := kp.p.GetNode(ctx, kp.config)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		// Symlinks don't have their own nodes, and so have no
+		// settable mtime.
+		return nil
+	}
+	return kp.config.KBFSOps().SetMtime(ctx, node, &mtime)
+}
+
+func (kp kbfsPath) remove(ctx context.Context) error {
+	parentNode, name, err := kp.getParentNode(ctx)
+	if err != nil {
+		return err
+	}
+	kbfsOps := kp.config.KBFSOps()
+	_, de, err := kbfsOps.Lookup(ctx, parentNode, name)
+	if err != nil {
+		return err
+	}
+	if de.Type == libkbfs.Dir {
+		return kbfsOps.RemoveDir(ctx, parentNode, name)
+	}
+	return kbfsOps.RemoveEntry(ctx, parentNode, name)
+}
+
+type localPath string
+
+var _ fsPath = localPath("")
+
+func (lp localPath) String() string {
+	return string(lp)
+}
+
+func (lp localPath) basename() (string, error) {
+	return filepath.Base(string(lp)), nil
+}
+
+func (lp localPath) join(name string) (fsPath, error) {
+	return localPath(filepath.Join(string(lp), name)), nil
+}
+
+func (lp localPath) parent() (fsPath, bool) {
+	abs, err := filepath.Abs(string(lp))
+	if err != nil {
+		return nil, false
+	}
+	dir := filepath.Dir(abs)
+	if dir == abs {
+		return nil, false
+	}
+	return localPath(dir), true
+}
+
+func (lp localPath) stat(ctx context.Context) (pathEntry, bool, error) {
+	fi, err := os.Lstat(string(lp))
+	if os.IsNotExist(err) {
+		return pathEntry{}, false, nil
+	} else if err != nil {
+		return pathEntry{}, false, err
+	}
+
+	var entryType libkbfs.EntryType
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		entryType = libkbfs.Dir
+	case mode&os.ModeSymlink != 0:
+		entryType = libkbfs.Sym
+	case !mode.IsRegular():
+		return pathEntry{}, false, fmt.Errorf(
+			"%s has an unsupported file type", lp)
+	case mode&0100 != 0:
+		entryType = libkbfs.Exec
+	default:
+		entryType = libkbfs.File
+	}
+	return pathEntry{entryType, uint64(fi.Size()), fi.ModTime()}, true, nil
+}
+
+func (lp localPath) sameFile(ctx context.Context, other fsPath) (
+	bool, error) {
+	otherLP, ok := other.(localPath)
+	if !ok {
+		return false, nil
+	}
+	fi, err := os.Lstat(string(lp))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	otherFi, err := os.Lstat(string(otherLP))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, otherFi), nil
+}
+
+func (lp localPath) readDir(ctx context.Context) ([]string, error) {
+	fis, err := ioutil.ReadDir(string(lp))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, nil
+}
+
+func (lp localPath) mkdir(ctx context.Context) error {
+	return os.Mkdir(string(lp), 0755)
+}
+
+func (lp localPath) readlink(ctx context.Context) (string, error) {
+	return os.Readlink(string(lp))
+}
+
+func (lp localPath) symlink(ctx context.Context, target string) error {
+	return os.Symlink(target, string(lp))
+}
+
+func (lp localPath) openRead(ctx context.Context) (io.ReadCloser, error) {
+	return os.Open(string(lp))
+}
+
+func (lp localPath) create(ctx context.Context, exec bool) (
+	io.WriteCloser, error) {
+	var perm os.FileMode = 0644
+	if exec {
+		perm = 0755
+	}
+	f, err := os.OpenFile(
+		string(lp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	// The permissions passed to OpenFile are only used for new
+	// files.
+	err = f.Chmod(perm)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (lp localPath) setMtime(ctx context.Context, mtime time.Time) error {
+	return os.Chtimes(string(lp), mtime, mtime)
+}
+
+func (lp localPath) remove(ctx context.Context) error {
+	return os.Remove(string(lp))
+}
@@ -35,12 +35,23 @@ To run in a local testing environment:
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
     <command> [<args>]
 
+Paths under /keybase are in KBFS; cp, mv and sync also accept local
+paths for one side of the transfer.
+
 The possible commands are:
   stat		Display file status
   ls		List directory contents
   mkdir		Make directories
   read		Dump file to stdout
   write		Write stdin to file
+  cp		Copy files and directories
+  mv		Move files and directories
+  rm		Remove files and directories
+  sync		Copy only the files that differ between two directories
+  conflicts	List this device's unmerged changes to a folder
+  resolve	Choose how conflicting writes to files are resolved
+  export	Write the history of a folder to an archive file
+  import	Restore a folder from an archive file
   md            Operate on metadata objects
 
 `
@@ -97,7 +108,16 @@ func realMain() (exitStatus int) {
 	cmd := flag.Arg(0)
 	args := flag.Args()[1:]
 
-	ctx := context.Background()
+	// Writes need a context that can delay its cancellation while
+	// they're in a critical section.
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(context.Background(),
+			func(ctx context.Context) context.Context { return ctx }))
+	if err != nil {
+		printError("kbfs", err)
+		return 1
+	}
+	defer libkbfs.CleanupCancellationDelayer(ctx)
 
 	switch cmd {
 	case "stat":
@@ -110,6 +130,22 @@ func realMain() (exitStatus int) {
 		return read(ctx, config, args)
 	case "write":
 		return write(ctx, config, args)
+	case "cp":
+		return cp(ctx, config, args)
+	case "mv":
+		return mv(ctx, config, args)
+	case "rm":
+		return rm(ctx, config, args)
+	case "sync":
+		return sync(ctx, config, args)
+	case "conflicts":
+		return conflicts(ctx, config, args)
+	case "resolve":
+		return resolve(ctx, config, args)
+	case "export":
+		return exportArchive(ctx, config, args)
+	case "import":
+		return importArchive(ctx, config, args)
 	case "md":
 		return mdMain(ctx, config, args)
 	default:
@@ -69,7 +69,18 @@ func checkDirBlock(ctx context.Context, config libkbfs.Config,
 
 func checkFileBlock(ctx context.Context, config libkbfs.Config,
 	name string, kmd libkbfs.KeyMetadata, info libkbfs.BlockInfo,
-	verbose bool) (err error) {
+	verbose bool) error {
+	_, err := checkFileBlockAtOffset(ctx, config, name, kmd, info, 0, verbose)
+	return err
+}
+
+// checkFileBlockAtOffset checks the file block with the given info,
+// which should start at the given offset within its file, and all the
+// blocks under it.  It returns the number of levels of indirection
+// under the block.
+func checkFileBlockAtOffset(ctx context.Context, config libkbfs.Config,
+	name string, kmd libkbfs.KeyMetadata, info libkbfs.BlockInfo,
+	off int64, verbose bool) (depth int, err error) {
 	if verbose {
 		fmt.Printf("Checking %s (file block %v)...\n", name, info)
 	} else {
@@ -85,20 +96,58 @@ func checkFileBlock(ctx context.Context, config libkbfs.Config,
 	var fileBlock libkbfs.FileBlock
 	err = config.BlockOps().Get(ctx, kmd, info.BlockPointer, &fileBlock)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if fileBlock.IsInd {
-		// TODO: Check continuity of off+len if Holes is false
-		// for all blocks.
-		for _, iptr := range fileBlock.IPtrs {
-			_ = checkFileBlock(
-				ctx, config,
-				fmt.Sprintf("%s (off=%d)", name, iptr.Off),
-				kmd, iptr.BlockInfo, verbose)
+	if !fileBlock.IsInd {
+		return 0, nil
+	}
+
+	if len(fileBlock.IPtrs) == 0 {
+		return 0, fmt.Errorf("Indirect block has no pointers")
+	}
+	if fileBlock.IPtrs[0].Off != off {
+		return 0, fmt.Errorf("First pointer has offset %d, expected %d",
+			fileBlock.IPtrs[0].Off, off)
+	}
+
+	// TODO: Check continuity of off+len if Holes is false
+	// for all blocks.
+	depth = -1
+	var childErr error
+	for i, iptr := range fileBlock.IPtrs {
+		if i > 0 && iptr.Off <= fileBlock.IPtrs[i-1].Off {
+			return 0, fmt.Errorf("Pointer %d has offset %d, not past %d",
+				i, iptr.Off, fileBlock.IPtrs[i-1].Off)
+		}
+		childDepth, err := checkFileBlockAtOffset(
+			ctx, config,
+			fmt.Sprintf("%s (off=%d)", name, iptr.Off),
+			kmd, iptr.BlockInfo, iptr.Off, verbose)
+		if err != nil {
+			// Keep checking the other children, but remember
+			// that something was wrong.
+			if childErr == nil {
+				childErr = err
+			}
+			continue
 		}
+		if (childDepth > 0) != iptr.IsInd {
+			return 0, fmt.Errorf("Pointer %d is to a block with %d "+
+				"levels of indirection, but has IsInd=%t",
+				i, childDepth, iptr.IsInd)
+		}
+		if depth >= 0 && childDepth != depth {
+			return 0, fmt.Errorf("Pointer %d is to a block with %d "+
+				"levels of indirection, but an earlier one has %d",
+				i, childDepth, depth)
+		}
+		depth = childDepth
 	}
-	return nil
+	if childErr != nil {
+		return 0, childErr
+	}
+	return depth + 1, nil
 }
 
 // mdCheckChain checks that the given MD object is a valid successor
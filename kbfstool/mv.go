@@ -0,0 +1,101 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// sameTLF returns true if src and dst are both paths within the same
+// KBFS TLF, and so src can be renamed to dst directly.  The TLF names
+// are resolved first, so that different names for the same TLF (like
+// "alice,bob" and "bob,alice") match.
+func sameTLF(ctx context.Context, src, dst fsPath) (bool, error) {
+	srcKP, ok := src.(kbfsPath)
+	if !ok {
+		return false, nil
+	}
+	dstKP, ok := dst.(kbfsPath)
+	if !ok {
+		return false, nil
+	}
+	if len(srcKP.p.TLFComponents) == 0 ||
+		len(dstKP.p.TLFComponents) == 0 ||
+		srcKP.p.Public != dstKP.p.Public {
+		return false, nil
+	}
+	srcHandle, err := fsrpc.ParseTlfHandle(
+		ctx, srcKP.config.KBPKI(), srcKP.p.TLFName, srcKP.p.Public)
+	if err != nil {
+		return false, err
+	}
+	dstHandle, err := fsrpc.ParseTlfHandle(
+		ctx, dstKP.config.KBPKI(), dstKP.p.TLFName, dstKP.p.Public)
+	if err != nil {
+		return false, err
+	}
+	return srcHandle.GetCanonicalName() == dstHandle.GetCanonicalName(), nil
+}
+
+func mvOne(ctx context.Context, src, dst fsPath, srcEntry pathEntry,
+	verbose bool) error {
+	same, err := sameTLF(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	if same {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Renaming %s to %s\n", src, dst)
+		}
+		oldParent, oldName, err := src.(kbfsPath).getParentNode(ctx)
+		if err != nil {
+			return err
+		}
+		newParent, newName, err := dst.(kbfsPath).getParentNode(ctx)
+		if err != nil {
+			return err
+		}
+		return src.(kbfsPath).config.KBFSOps().Rename(
+			ctx, oldParent, oldName, newParent, newName)
+	}
+
+	// Otherwise, copy everything over and then remove the source.
+	err = copyPath(ctx, src, dst, srcEntry, true, verbose)
+	if err != nil {
+		return err
+	}
+	return removePath(ctx, src, srcEntry, true, verbose)
+}
+
+func mv(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs mv", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print extra status output.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("mv", err)
+		return 1
+	}
+
+	srcs, srcEntries, dsts, err := resolveSrcsAndDst(ctx, config, flags.Args())
+	if err != nil {
+		printError("mv", err)
+		return 1
+	}
+
+	for i, src := range srcs {
+		err := mvOne(ctx, src, dsts[i], srcEntries[i], *verbose)
+		if err != nil {
+			printError("mv", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// removePath removes the entry at p, which has the given attributes.
+// Directories are only removed if recursive is set, in which case
+// their contents are removed first.
+func removePath(ctx context.Context, p fsPath, entry pathEntry,
+	recursive, verbose bool) error {
+	if entry.Type == libkbfs.Dir {
+		if !recursive {
+			return fmt.Errorf("%s is a directory", p)
+		}
+		names, err := p.readDir(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			child, err := p.join(name)
+			if err != nil {
+				return err
+			}
+			childEntry, _, err := child.stat(ctx)
+			if err != nil {
+				return err
+			}
+			err = removePath(ctx, child, childEntry, recursive, verbose)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Removing %s\n", p)
+	}
+	return p.remove(ctx)
+}
+
+func rmOne(ctx context.Context, config libkbfs.Config, pathStr string,
+	recursive, force, verbose bool) error {
+	p := newFSPath(config, pathStr)
+	if _, ok := p.(kbfsPath); !ok {
+		return fmt.Errorf("%s is not a KBFS path", p)
+	}
+
+	entry, exists, err := p.stat(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if force {
+			return nil
+		}
+		return fmt.Errorf("%s does not exist", p)
+	}
+	return removePath(ctx, p, entry, recursive, verbose)
+}
+
+func rm(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs rm", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "Remove directories and their contents recursively.")
+	force := flags.Bool("f", false, "Ignore nonexistent paths.")
+	verbose := flags.Bool("v", false, "Print extra status output.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("rm", err)
+		return 1
+	}
+
+	nodePaths := flags.Args()
+	if len(nodePaths) == 0 {
+		printError("rm", errAtLeastOnePath)
+		return 1
+	}
+
+	for _, nodePath := range nodePaths {
+		err := rmOne(ctx, config, nodePath, *recursive, *force, *verbose)
+		if err != nil {
+			printError("rm", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+type syncOptions struct {
+	delete  bool
+	dryRun  bool
+	verbose bool
+}
+
+// fileUnchanged returns true if dstEntry looks like it already has
+// the same contents as srcEntry.  Like rsync, it only compares sizes
+// and modification times (to the second, since not every local file
+// system stores them more precisely).
+func fileUnchanged(srcEntry, dstEntry pathEntry) bool {
+	return srcEntry.Type == dstEntry.Type &&
+		srcEntry.Size == dstEntry.Size &&
+		srcEntry.Mtime.Unix() == dstEntry.Mtime.Unix()
+}
+
+// sameKind returns true if entries of the given types can replace
+// each other without removing the old one first.
+func sameKind(a, b libkbfs.EntryType) bool {
+	isFile := func(t libkbfs.EntryType) bool {
+		return t == libkbfs.File || t == libkbfs.Exec
+	}
+	return a == b || (isFile(a) && isFile(b))
+}
+
+func syncAction(opts syncOptions, format string, args ...interface{}) {
+	if opts.dryRun || opts.verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// syncPath makes dst match src, which has the given attributes, only
+// transferring the files that differ.
+func syncPath(ctx context.Context, src, dst fsPath, srcEntry pathEntry,
+	opts syncOptions) error {
+	dstEntry, dstExists, err := dst.stat(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Anything at dst of a different kind has to go first.
+	if dstExists && !sameKind(srcEntry.Type, dstEntry.Type) {
+		syncAction(opts, "Removing %s", dst)
+		if !opts.dryRun {
+			err = removePath(ctx, dst, dstEntry, true, false)
+			if err != nil {
+				return err
+			}
+		}
+		dstExists = false
+	}
+
+	switch srcEntry.Type {
+	case libkbfs.Dir:
+		if !dstExists {
+			syncAction(opts, "Creating directory %s", dst)
+			if opts.dryRun {
+				// Nothing in the new directory can be compared.
+				return copyPathDryRun(ctx, src, dst, opts)
+			}
+			err = dst.mkdir(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		names, err := src.readDir(ctx)
+		if err != nil {
+			return err
+		}
+		srcNames := make(map[string]bool, len(names))
+		for _, name := range names {
+			srcNames[name] = true
+			childSrc, err := src.join(name)
+			if err != nil {
+				return err
+			}
+			childDst, err := dst.join(name)
+			if err != nil {
+				return err
+			}
+			childEntry, _, err := childSrc.stat(ctx)
+			if err != nil {
+				return err
+			}
+			err = syncPath(ctx, childSrc, childDst, childEntry, opts)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !opts.delete || !dstExists {
+			return nil
+		}
+		dstNames, err := dst.readDir(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range dstNames {
+			if srcNames[name] {
+				continue
+			}
+			childDst, err := dst.join(name)
+			if err != nil {
+				return err
+			}
+			syncAction(opts, "Removing %s", childDst)
+			if opts.dryRun {
+				continue
+			}
+			childEntry, _, err := childDst.stat(ctx)
+			if err != nil {
+				return err
+			}
+			err = removePath(ctx, childDst, childEntry, true, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case libkbfs.Sym:
+		if dstExists && dstEntry.Type == libkbfs.Sym {
+			srcTarget, err := src.readlink(ctx)
+			if err != nil {
+				return err
+			}
+			dstTarget, err := dst.readlink(ctx)
+			if err != nil {
+				return err
+			}
+			if srcTarget == dstTarget {
+				return nil
+			}
+		}
+		syncAction(opts, "Copying symlink %s to %s", src, dst)
+		if opts.dryRun {
+			return nil
+		}
+		return copySymlink(ctx, src, dst)
+
+	default:
+		if dstExists && fileUnchanged(srcEntry, dstEntry) {
+			return nil
+		}
+		syncAction(opts, "Copying %s (%d bytes) to %s", src, srcEntry.Size,
+			dst)
+		if opts.dryRun {
+			return nil
+		}
+		err = copyFile(ctx, src, dst, srcEntry.Type == libkbfs.Exec)
+		if err != nil {
+			return err
+		}
+		// Keep the mtime, so the next sync can tell that this file
+		// is unchanged.
+		return dst.setMtime(ctx, srcEntry.Mtime)
+	}
+}
+
+// copyPathDryRun reports everything under src that a sync would copy
+// to the new directory dst.
+func copyPathDryRun(ctx context.Context, src, dst fsPath,
+	opts syncOptions) error {
+	names, err := src.readDir(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		childSrc, err := src.join(name)
+		if err != nil {
+			return err
+		}
+		childDst, err := dst.join(name)
+		if err != nil {
+			return err
+		}
+		childEntry, _, err := childSrc.stat(ctx)
+		if err != nil {
+			return err
+		}
+		switch childEntry.Type {
+		case libkbfs.Dir:
+			syncAction(opts, "Creating directory %s", childDst)
+			err = copyPathDryRun(ctx, childSrc, childDst, opts)
+			if err != nil {
+				return err
+			}
+		case libkbfs.Sym:
+			syncAction(opts, "Copying symlink %s to %s", childSrc, childDst)
+		default:
+			syncAction(opts, "Copying %s (%d bytes) to %s", childSrc,
+				childEntry.Size, childDst)
+		}
+	}
+	return nil
+}
+
+func syncHelper(ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs sync", flag.ContinueOnError)
+	deleteExtra := flags.Bool("delete", false, "Delete entries in the destination that aren't in the source.")
+	dryRun := flags.Bool("n", false, "Only print what would be transferred or deleted.")
+	verbose := flags.Bool("v", false, "Print extra status output.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		return errExactlyTwoPaths
+	}
+
+	src := newFSPath(config, flags.Arg(0))
+	dst := newFSPath(config, flags.Arg(1))
+	_, srcIsLocal := src.(localPath)
+	_, dstIsLocal := dst.(localPath)
+	if srcIsLocal && dstIsLocal {
+		return errNoKBFSPath
+	}
+
+	srcEntry, exists, err := src.stat(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s does not exist", src)
+	}
+	if srcEntry.Type == libkbfs.Dir {
+		err = checkNotWithin(ctx, src, dst)
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncPath(ctx, src, dst, srcEntry, syncOptions{
+		delete:  *deleteExtra,
+		dryRun:  *dryRun,
+		verbose: *verbose,
+	})
+}
+
+func sync(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := syncHelper(ctx, config, args)
+	if err != nil {
+		printError("sync", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system, served over WebDAV
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libwebdav"
+)
+
+var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "runtime directory")
+var label = flag.String("label", os.Getenv("KEYBASE_LABEL"), "label to help identify if running as a service")
+var listenAddr = flag.String("listen", libwebdav.DefaultListenAddr, "loopback address to serve WebDAV on")
+var secretFile = flag.String("secret-file", "", "file to write the WebDAV password to (default: kbfswebdav.secret in the data directory)")
+var version = flag.Bool("version", false, "Print version")
+
+const usageFormatStr = `Usage:
+  kbfswebdav -version
+
+To run against remote KBFS servers:
+  kbfswebdav [-debug] [-cpuprofile=path/to/dir]
+    [-bserver=%s] [-mdserver=%s]
+    [-runtime-dir=path/to/dir] [-label=label] [-listen=%s]
+    [-secret-file=path/to/file]
+    [-log-to-file] [-log-file=path/to/file] [-md-version=version]
+
+To run in a local testing environment:
+  kbfswebdav [-debug] [-cpuprofile=path/to/dir]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-runtime-dir=path/to/dir] [-label=label] [-listen=%s]
+    [-secret-file=path/to/file]
+    [-log-to-file] [-log-file=path/to/file] [-md-version=version]
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(
+		usageFormatStr, defaultBServer, defaultMDServer,
+		libwebdav.DefaultListenAddr, libwebdav.DefaultListenAddr)
+}
+
+func start() *libfs.Error {
+	ctx := env.NewContext()
+
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Print(getUsageStr(ctx))
+		return libfs.InitError("extra arguments specified (flags go before the first argument)")
+	}
+
+	options := libwebdav.StartOptions{
+		KbfsParams: *kbfsParams,
+		RuntimeDir: *runtimeDir,
+		Label:      *label,
+		ListenAddr: *listenAddr,
+		SecretFile: *secretFile,
+	}
+
+	return libwebdav.Start(options, ctx)
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfswebdav error: (%d) %s\n", err.Code, err.Message)
+
+		os.Exit(err.Code)
+	}
+	os.Exit(0)
+}
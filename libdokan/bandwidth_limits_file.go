@@ -0,0 +1,44 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BandwidthLimitsFile represents a file that shows the current
+// bandwidth limits when read, and changes them when JSON is written
+// to it.
+type BandwidthLimitsFile struct {
+	SpecialReadFile
+}
+
+// NewBandwidthLimitsFile returns a BandwidthLimitsFile.
+func NewBandwidthLimitsFile(fs *FS) *BandwidthLimitsFile {
+	return &BandwidthLimitsFile{SpecialReadFile{
+		read: libfs.GetEncodedBandwidthLimits(fs.config),
+		fs:   fs,
+	}}
+}
+
+// GetFileInformation does stats for dokan.
+func (f *BandwidthLimitsFile) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
+	a, err := f.SpecialReadFile.GetFileInformation(ctx, fi)
+	if err != nil {
+		return nil, err
+	}
+	a.FileAttributes &^= dokan.FileAttributeReadonly
+	return a, nil
+}
+
+// WriteFile implements writes for dokan.
+func (f *BandwidthLimitsFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "BandwidthLimitsFile WriteFile")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return libfs.SetBandwidthLimits(ctx, f.fs.log, f.fs.config, bs)
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ChangeFeedFile represents a read-only file listing the changes
+// made to a TLF after a given revision.  Each read fetches only as
+// many changes as it needs, including any newer ones, so the file
+// can be tailed.
+type ChangeFeedFile struct {
+	feed *libfs.ChangeFeed
+	fs   *FS
+	emptyFile
+}
+
+// NewChangeFeedFile returns a ChangeFeedFile for the changes made to
+// the given folder after the given revision.
+func NewChangeFeedFile(
+	folder *Folder, since libkbfs.MetadataRevision) *ChangeFeedFile {
+	return &ChangeFeedFile{
+		feed: libfs.NewChangeFeed(
+			folder.fs.config, folder.getFolderBranch(), since),
+		fs: folder.fs,
+	}
+}
+
+// GetFileInformation does stats for dokan.
+func (f *ChangeFeedFile) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
+	f.fs.logEnter(ctx, "ChangeFeedFile GetFileInformation")
+	size, err := f.feed.Size(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := defaultFileInformation()
+	if err != nil {
+		return nil, err
+	}
+	a.FileAttributes |= dokan.FileAttributeReadonly
+	a.FileSize = size
+	return a, nil
+}
+
+// ReadFile does reads for dokan.
+func (f *ChangeFeedFile) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (int, error) {
+	f.fs.logEnter(ctx, "ChangeFeedFile ReadFile")
+	return f.feed.ReadAt(ctx, bs, offset)
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NewUnmergedChangesFile returns a special read file that lists the
+// unmerged changes made to that TLF by this device.
+func NewUnmergedChangesFile(folder *Folder) *SpecialReadFile {
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedUnmergedChanges(
+				ctx, folder.fs.config, folder.getFolderBranch())
+		},
+		fs: folder.fs,
+	}
+}
+
+// ConflictChoiceFile represents a write-only file where each line
+// written sets how conflicting writes to a file are resolved.
+type ConflictChoiceFile struct {
+	folder *Folder
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *ConflictChoiceFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "ConflictChoiceFile WriteFile")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return libfs.SetConflictChoices(
+		ctx, f.folder.fs.log, f.folder.fs.config,
+		f.folder.getFolderBranch(), bs)
+}
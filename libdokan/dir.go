@@ -306,6 +306,23 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 			return &SpecialReadFile{read: fileInfo(nmd).read, fs: d.folder.fs}, false, nil
 		}
 
+		// Check if this is a file within a per-file history
+		// directory.
+		if len(path) == 2 && strings.HasPrefix(path[0], libfs.FileHistoryPrefix) {
+			if err := oc.ReturningFileAllowed(); err != nil {
+				return nil, false, err
+			}
+			node, _, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, path[0][len(libfs.FileHistoryPrefix):])
+			if err != nil {
+				return nil, false, err
+			}
+			f := newFileHistoryFile(d.folder, node, path[1])
+			if f == nil {
+				return nil, false, dokan.ErrObjectNameNotFound
+			}
+			return f, false, nil
+		}
+
 		newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, path[0])
 
 		// If we are in the final component, check if it is a creation.
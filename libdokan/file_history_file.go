@@ -0,0 +1,51 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// newFileHistoryFile returns the special file with the given name
+// within the history directory of the given file, or nil if there
+// is no such file.
+func newFileHistoryFile(
+	folder *Folder, file libkbfs.Node, name string) dokan.File {
+	switch name {
+	case libfs.FileHistoryVersionsFileName:
+		return &SpecialReadFile{
+			read: func(ctx context.Context) ([]byte, time.Time, error) {
+				return libfs.GetEncodedFileHistory(
+					ctx, folder.fs.config, file)
+			},
+			fs: folder.fs,
+		}
+	case libfs.FileHistoryRestoreFileName:
+		return &FileHistoryRestoreFile{folder: folder, file: file}
+	}
+	return nil
+}
+
+// FileHistoryRestoreFile represents a write-only file where any
+// write of a revision number restores the file to its contents as
+// of that revision.
+type FileHistoryRestoreFile struct {
+	folder *Folder
+	file   libkbfs.Node
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *FileHistoryRestoreFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "FileHistoryRestoreFile WriteFile")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return libfs.RestoreFileVersion(
+		ctx, f.folder.fs.log, f.folder.fs.config, f.file, bs)
+}
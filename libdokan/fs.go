@@ -284,6 +284,8 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 		return oc.returnFileNoCleanup(NewErrorFile(f))
 	case libfs.MetricsFileName == ps[psl-1]:
 		return oc.returnFileNoCleanup(NewMetricsFile(f))
+	case libfs.BandwidthLimitsFileName == ps[psl-1]:
+		return oc.returnFileNoCleanup(NewBandwidthLimitsFile(f))
 		// TODO: Make the two cases below available from any
 		// directory.
 	case libfs.ProfileListDirName == ps[0]:
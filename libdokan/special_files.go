@@ -7,6 +7,7 @@ package libdokan
 import (
 	"github.com/keybase/kbfs/dokan"
 	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
 )
 
 // handleTLFSpecialFile handles special files that are within a TLF.
@@ -27,6 +28,14 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 			folder: folder,
 		}
 
+	case libfs.UnmergedChangesFileName:
+		return NewUnmergedChangesFile(folder)
+
+	case libfs.ConflictChoiceFileName:
+		return &ConflictChoiceFile{
+			folder: folder,
+		}
+
 	case libfs.DisableUpdatesFileName:
 		return &UpdatesFile{
 			folder: folder,
@@ -84,5 +93,13 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 		}
 	}
 
+	if since, ok := libfs.ParseChangeFeedName(name); ok {
+		if folder.getFolderBranch() == (libkbfs.FolderBranch{}) {
+			// A folder that doesn't exist yet has no changes
+			// to list.
+			return nil
+		}
+		return NewChangeFeedFile(folder, since)
+	}
 	return nil
 }
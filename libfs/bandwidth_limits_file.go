@@ -0,0 +1,39 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedBandwidthLimits returns serialized JSON containing the
+// current bandwidth limits.
+func GetEncodedBandwidthLimits(config libkbfs.Config) func(
+	context.Context) ([]byte, time.Time, error) {
+	return func(context.Context) ([]byte, time.Time, error) {
+		data, err := PrettyJSON(config.BandwidthLimiter().Limits())
+		return data, time.Time{}, err
+	}
+}
+
+// SetBandwidthLimits changes the bandwidth limits given in data,
+// which is JSON in the same form as read from the bandwidth limits
+// file.  Limits missing from data are left unchanged.
+func SetBandwidthLimits(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, data []byte) (int, error) {
+	log.CDebugf(ctx, "SetBandwidthLimits(%q)", data)
+	limits := config.BandwidthLimiter().Limits()
+	err := json.Unmarshal(data, &limits)
+	if err != nil {
+		return 0, err
+	}
+	config.BandwidthLimiter().SetLimits(limits)
+	return len(data), nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ParseChangeFeedName returns the revision named by a change feed
+// file name (i.e., one starting with ChangeFeedPrefix), or false if
+// name isn't one.
+func ParseChangeFeedName(name string) (libkbfs.MetadataRevision, bool) {
+	if !strings.HasPrefix(name, ChangeFeedPrefix) {
+		return 0, false
+	}
+	rev, err := strconv.ParseInt(name[len(ChangeFeedPrefix):], 10, 64)
+	if err != nil || rev < 0 {
+		return 0, false
+	}
+	return libkbfs.MetadataRevision(rev), true
+}
+
+// changeFeedBufferBytes is about how many bytes of a change feed's
+// contents are kept in memory, beyond those needed by the current
+// read.
+const changeFeedBufferBytes = 1 << 20
+
+// ChangeFeed lists the changes made to a folder after a given
+// revision, each encoded as a line of JSON.  Its contents only ever
+// grow, so it can back a file that tools can tail.  Changes are
+// fetched a page of revisions at a time, only as far as reads need
+// them, and only the tail of the contents is kept in memory; a read
+// from before that tail starts the feed over.
+type ChangeFeed struct {
+	config libkbfs.Config
+	fb     libkbfs.FolderBranch
+	since  libkbfs.MetadataRevision
+
+	lock sync.Mutex
+	// rev is the latest revision whose changes are in the feed.
+	rev libkbfs.MetadataRevision
+	// start is the offset within the feed of data[0].
+	start int64
+	data  []byte
+}
+
+// NewChangeFeed returns a ChangeFeed for the changes made to the
+// given folder after the given revision.
+func NewChangeFeed(config libkbfs.Config, fb libkbfs.FolderBranch,
+	since libkbfs.MetadataRevision) *ChangeFeed {
+	return &ChangeFeed{config: config, fb: fb, since: since, rev: since}
+}
+
+// fetchPageLocked appends the changes made by the next page of
+// revisions to the feed, and returns false if there were none.  It
+// keeps at least the data from keepFrom onwards.
+func (cf *ChangeFeed) fetchPageLocked(
+	ctx context.Context, keepFrom int64) (bool, error) {
+	changes, latest, err := cf.config.KBFSOps().GetChanges(
+		ctx, cf.fb, cf.rev)
+	if err != nil {
+		return false, err
+	}
+	for _, change := range changes {
+		line, err := json.Marshal(change)
+		if err != nil {
+			return false, err
+		}
+		cf.data = append(cf.data, line...)
+		cf.data = append(cf.data, '\n')
+	}
+	if latest == cf.rev {
+		// Caught up.
+		return false, nil
+	}
+	cf.rev = latest
+
+	trim := int64(len(cf.data)) - changeFeedBufferBytes
+	if keep := keepFrom - cf.start; keep < trim {
+		trim = keep
+	}
+	if trim > 0 {
+		cf.data = append([]byte(nil), cf.data[trim:]...)
+		cf.start += trim
+	}
+	return true, nil
+}
+
+// Size fetches the next page of changes, if any, and returns the size
+// of the feed so far.  It doesn't fetch all the changes at once, so
+// the size keeps growing with each call until the feed catches up.
+func (cf *ChangeFeed) Size(ctx context.Context) (int64, error) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	end := cf.start + int64(len(cf.data))
+	if _, err := cf.fetchPageLocked(ctx, end); err != nil {
+		return 0, err
+	}
+	return cf.start + int64(len(cf.data)), nil
+}
+
+// ReadAt reads len(p) bytes of the feed from off, fetching only as
+// many changes as needed.  Like io.ReaderAt, it returns a short
+// count only at the end of the changes made so far, but with a nil
+// error, since more changes may arrive.
+func (cf *ChangeFeed) ReadAt(
+	ctx context.Context, p []byte, off int64) (int, error) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	if off < cf.start {
+		// The data has been dropped, so start over.
+		cf.rev = cf.since
+		cf.start = 0
+		cf.data = nil
+	}
+	for cf.start+int64(len(cf.data)) < off+int64(len(p)) {
+		more, err := cf.fetchPageLocked(ctx, off)
+		if err != nil {
+			return 0, err
+		}
+		if !more {
+			break
+		}
+	}
+	if off >= cf.start+int64(len(cf.data)) {
+		return 0, nil
+	}
+	return copy(p, cf.data[off-cf.start:]), nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedUnmergedChanges returns serialized JSON containing the
+// unmerged changes made to a folder by this device.
+func GetEncodedUnmergedChanges(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) (
+	data []byte, t time.Time, err error) {
+	changes, err := config.KBFSOps().GetUnmergedChanges(ctx, folderBranch)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if changes == nil {
+		changes = []libkbfs.UnmergedChange{}
+	}
+
+	data, err = PrettyJSON(changes)
+	return data, time.Time{}, err
+}
+
+// SetConflictChoices sets how conflict resolution treats the
+// conflicting writes to files in the given folder.  Each line of
+// data is a choice ("mine", "theirs", "both" or "auto") followed by
+// a space and the path of a file, relative to the root of the
+// folder.
+func SetConflictChoices(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, fb libkbfs.FolderBranch,
+	data []byte) (int, error) {
+	log.CDebugf(ctx, "SetConflictChoices(%v, %q)", fb, data)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte(" "), 2)
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("Expected \"<choice> <path>\", got %q",
+				line)
+		}
+		choice, err := libkbfs.ParseConflictChoice(string(fields[0]))
+		if err != nil {
+			return 0, err
+		}
+		err = config.KBFSOps().SetConflictChoice(
+			ctx, fb, string(bytes.TrimSpace(fields[1])), choice)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
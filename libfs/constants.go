@@ -28,6 +28,16 @@ const SyncFromServerFileName = ".kbfs_sync_from_server"
 // reached anywhere within a top-level folder.
 const UnstageFileName = ".kbfs_unstage"
 
+// UnmergedChangesFileName is the name of the KBFS file listing the
+// unmerged changes made by this device -- it can be reached anywhere
+// within a top-level folder.
+const UnmergedChangesFileName = ".kbfs_unmerged_changes"
+
+// ConflictChoiceFileName is the name of the KBFS file that sets how
+// conflicting writes to a file are resolved -- it can be reached
+// anywhere within a top-level folder.
+const ConflictChoiceFileName = ".kbfs_conflict_choice"
+
 // DisableUpdatesFileName is the name of the KBFS update-disabling
 // file -- it can be reached anywhere within a top-level folder.
 const DisableUpdatesFileName = ".kbfs_disable_updates"
@@ -76,3 +86,52 @@ const EditHistoryName = ".kbfs_edit_history"
 
 // FileInfoPrefix is the prefix of the per-file metadata files.
 const FileInfoPrefix = ".kbfs_fileinfo_"
+
+// FileHistoryPrefix is the prefix of the per-file history
+// directories.  Each one holds a FileHistoryVersionsFileName file
+// listing the past versions of the file, and a
+// FileHistoryRestoreFileName file that restores the version as of
+// the revision number written to it.
+const FileHistoryPrefix = ".kbfs_history_"
+
+// FileHistoryVersionsFileName is the name of the file listing the
+// past versions of a file, within its history directory.
+const FileHistoryVersionsFileName = "versions"
+
+// FileHistoryRestoreFileName is the name of the file that restores a
+// past version of a file, within its history directory.
+const FileHistoryRestoreFileName = "restore"
+
+// ChangeFeedPrefix is the prefix of the KBFS change feed files -- a
+// file named with this prefix followed by a revision number can be
+// reached anywhere within a top-level folder, and lists the changes
+// made to the folder after that revision, growing as new changes
+// arrive.
+const ChangeFeedPrefix = ".kbfs_changes_since_"
+
+// ArchivedRevDirName is the name of the KBFS directory of archived
+// revisions -- it can be reached from the root of a top-level folder,
+// and each revision number looked up in it is a read-only view of
+// the folder as of that revision.
+const ArchivedRevDirName = ".kbfs_archived"
+
+// BandwidthLimitsFileName is the name of the KBFS file holding the
+// upload and download rate limits, in bytes per second, as JSON.
+// Writing JSON to it changes the limits given in it.  It can be
+// reached from any KBFS directory.
+const BandwidthLimitsFileName = ".kbfs_bandwidth_limits"
+
+// TrashDirName is the name of the KBFS trash directory -- it can be
+// reached from the root of a top-level folder, and holds a
+// TrashEntriesFileName file listing the removed files and directories
+// in the folder, and a TrashRestoreFileName file that restores the
+// removed entry whose name is written to it.
+const TrashDirName = ".kbfs_trash"
+
+// TrashEntriesFileName is the name of the file listing the removed
+// entries of a folder, within its trash directory.
+const TrashEntriesFileName = "entries"
+
+// TrashRestoreFileName is the name of the file that restores a
+// removed entry, within the trash directory.
+const TrashRestoreFileName = "restore"
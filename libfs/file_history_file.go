@@ -0,0 +1,48 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedFileHistory returns serialized JSON containing the past
+// versions of the given file.
+func GetEncodedFileHistory(ctx context.Context, config libkbfs.Config,
+	file libkbfs.Node) (data []byte, t time.Time, err error) {
+	versions, err := config.KBFSOps().GetFileHistory(ctx, file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if versions == nil {
+		versions = []libkbfs.FileVersion{}
+	}
+
+	data, err = PrettyJSON(versions)
+	return data, time.Time{}, err
+}
+
+// RestoreFileVersion restores the given file to its contents as of
+// the revision number given in data.
+func RestoreFileVersion(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, file libkbfs.Node, data []byte) (int, error) {
+	log.CDebugf(ctx, "RestoreFileVersion(%s, %q)", file.GetBasename(), data)
+	rev, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	err = config.KBFSOps().RestoreFileVersion(
+		ctx, file, libkbfs.MetadataRevision(rev))
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
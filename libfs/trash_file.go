@@ -0,0 +1,44 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedTrash returns serialized JSON containing the removed
+// entries in the trash of the given folder.
+func GetEncodedTrash(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) (data []byte, t time.Time, err error) {
+	entries, err := config.KBFSOps().GetTrash(ctx, folderBranch)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if entries == nil {
+		entries = []libkbfs.TrashEntry{}
+	}
+
+	data, err = PrettyJSON(entries)
+	return data, time.Time{}, err
+}
+
+// RestoreTrashEntry moves the removed entry whose trash name is given
+// in data back to where it was removed from.
+func RestoreTrashEntry(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, folderBranch libkbfs.FolderBranch,
+	data []byte) (int, error) {
+	log.CDebugf(ctx, "RestoreTrashEntry(%q)", data)
+	err := config.KBFSOps().Restore(
+		ctx, folderBranch, strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
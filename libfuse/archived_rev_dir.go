@@ -0,0 +1,86 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"strconv"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ArchivedRevDir is the special directory at the root of a TLF that
+// holds read-only views of the TLF at past revisions.  Looking up a
+// revision number in it returns the TLF root directory as of that
+// revision.  It doesn't list any entries itself, since there could be
+// a huge number of revisions.
+type ArchivedRevDir struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*ArchivedRevDir)(nil)
+
+// Attr implements the fs.Node interface for ArchivedRevDir.
+func (ard *ArchivedRevDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0500
+	if ard.folder.list.public {
+		a.Mode |= 0055
+	}
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*ArchivedRevDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// ArchivedRevDir.
+func (ard *ArchivedRevDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (
+	node fs.Node, err error) {
+	ard.folder.fs.log.CDebugf(ctx, "ArchivedRevDir Lookup %s", req.Name)
+	defer func() { ard.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	rev, err := strconv.ParseInt(req.Name, 10, 64)
+	if err != nil || libkbfs.MetadataRevision(rev) <
+		libkbfs.MetadataRevisionInitial {
+		return nil, fuse.ENOENT
+	}
+
+	ard.folder.handleMu.RLock()
+	h := ard.folder.h
+	ard.folder.handleMu.RUnlock()
+
+	rootNode, _, err := ard.folder.fs.config.KBFSOps().GetRootNodeAtRevision(
+		ctx, h, libkbfs.MetadataRevision(rev))
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchMDError); ok {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+
+	// No libkbfs calls after this point!
+	ard.folder.nodesMu.Lock()
+	defer ard.folder.nodesMu.Unlock()
+	if n, ok := ard.folder.nodes[rootNode.GetID()]; ok {
+		return n, nil
+	}
+	child := newDir(ard.folder, rootNode)
+	ard.folder.nodes[rootNode.GetID()] = child
+	return child, nil
+}
+
+var _ fs.Handle = (*ArchivedRevDir)(nil)
+
+var _ fs.HandleReadDirAller = (*ArchivedRevDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// ArchivedRevDir.
+func (ard *ArchivedRevDir) ReadDirAll(ctx context.Context) (
+	[]fuse.Dirent, error) {
+	return nil, nil
+}
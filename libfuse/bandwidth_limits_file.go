@@ -0,0 +1,80 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BandwidthLimitsFile represents a file that shows the current
+// bandwidth limits when read, and changes them when JSON is written
+// to it.  It can be reached from any directory under the FUSE
+// mountpoint.
+type BandwidthLimitsFile struct {
+	fs *FS
+}
+
+func (f *BandwidthLimitsFile) read(ctx context.Context) ([]byte, error) {
+	data, _, err := libfs.GetEncodedBandwidthLimits(f.fs.config)(ctx)
+	return data, err
+}
+
+var _ fs.Node = (*BandwidthLimitsFile)(nil)
+
+// Attr implements the fs.Node interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	data, err := f.read(ctx)
+	if err != nil {
+		return err
+	}
+	a.Valid = 0
+	a.Size = uint64(len(data))
+	a.Mode = 0644
+	return nil
+}
+
+var _ fs.NodeOpener = (*BandwidthLimitsFile)(nil)
+
+// Open implements the fs.NodeOpener interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Open(ctx context.Context,
+	req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+var _ fs.Handle = (*BandwidthLimitsFile)(nil)
+
+var _ fs.HandleReader = (*BandwidthLimitsFile)(nil)
+
+// Read implements the fs.HandleReader interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Read(ctx context.Context,
+	req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	data, err := f.read(ctx)
+	if err != nil {
+		return err
+	}
+	fuseutil.HandleRead(req, resp, data)
+	return nil
+}
+
+var _ fs.HandleWriter = (*BandwidthLimitsFile)(nil)
+
+// Write implements the fs.HandleWriter interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	size, err := libfs.SetBandwidthLimits(
+		ctx, f.fs.log, f.fs.config, req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = size
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ChangeFeedFile represents a read-only file listing the changes
+// made to a TLF after a given revision.  Unlike a SpecialReadFile,
+// reads from an open handle see any changes that arrive after the
+// file was opened, so it can be tailed.
+type ChangeFeedFile struct {
+	feed *libfs.ChangeFeed
+}
+
+// NewChangeFeedFile returns a ChangeFeedFile for the changes made to
+// the given folder after the given revision.
+func NewChangeFeedFile(folder *Folder, since libkbfs.MetadataRevision,
+	entryValid *time.Duration) *ChangeFeedFile {
+	*entryValid = 0
+	return &ChangeFeedFile{
+		feed: libfs.NewChangeFeed(
+			folder.fs.config, folder.getFolderBranch(), since),
+	}
+}
+
+var _ fs.Node = (*ChangeFeedFile)(nil)
+
+// Attr implements the fs.Node interface for ChangeFeedFile.
+func (f *ChangeFeedFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	size, err := f.feed.Size(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Don't cache the size, so that tailers notice new changes.
+	a.Valid = 0
+	a.Size = uint64(size)
+	a.Mode = 0444
+	return nil
+}
+
+var _ fs.NodeOpener = (*ChangeFeedFile)(nil)
+
+// Open implements the fs.NodeOpener interface for ChangeFeedFile.
+func (f *ChangeFeedFile) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+var _ fs.Handle = (*ChangeFeedFile)(nil)
+
+var _ fs.HandleReader = (*ChangeFeedFile)(nil)
+
+// Read implements the fs.HandleReader interface for ChangeFeedFile.
+func (f *ChangeFeedFile) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := f.feed.ReadAt(ctx, buf, req.Offset)
+	if err != nil {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NewUnmergedChangesFile returns a special read file that lists the
+// unmerged changes made to that TLF by this device.
+func NewUnmergedChangesFile(
+	folder *Folder, entryValid *time.Duration) *SpecialReadFile {
+	*entryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedUnmergedChanges(
+				ctx, folder.fs.config, folder.getFolderBranch())
+		},
+	}
+}
+
+// ConflictChoiceFile represents a write-only file where each line
+// written sets how conflicting writes to a file are resolved.
+type ConflictChoiceFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*ConflictChoiceFile)(nil)
+
+// Attr implements the fs.Node interface for ConflictChoiceFile.
+func (f *ConflictChoiceFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*ConflictChoiceFile)(nil)
+
+var _ fs.HandleWriter = (*ConflictChoiceFile)(nil)
+
+// Write implements the fs.HandleWriter interface for ConflictChoiceFile.
+func (f *ConflictChoiceFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	size, err := libfs.SetConflictChoices(
+		ctx, f.folder.fs.log, f.folder.fs.config,
+		f.folder.getFolderBranch(), req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = size
+	return nil
+}
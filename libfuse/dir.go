@@ -132,6 +132,7 @@ func (f *Folder) forgetNode(node libkbfs.Node) {
 	if len(f.nodes) == 0 {
 		ctx := libkbfs.BackgroundContextWithCancellationDelayer()
 		defer libkbfs.CleanupCancellationDelayer(ctx)
+		f.fs.forgetFolderNodes(f.getFolderBranch())
 		f.unsetFolderBranch(ctx)
 		f.list.forgetFolder(string(f.name()))
 	}
@@ -345,6 +346,7 @@ type DirInterface interface {
 	fs.NodeCreater
 	fs.NodeMkdirer
 	fs.NodeSymlinker
+	fs.NodeLinker
 	fs.NodeRenamer
 	fs.NodeRemover
 	fs.Handle
@@ -399,6 +401,9 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	if d.folder.list.public {
 		a.Mode |= 0055
 	}
+	if d.node.GetFolderBranch().Branch.IsArchived() {
+		a.Mode &^= 0222
+	}
 	return nil
 }
 
@@ -406,6 +411,8 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (node fs.Node, err error) {
 	d.folder.fs.log.CDebugf(ctx, "Dir Lookup %s", req.Name)
 	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	d.folder.fs.noteFolderNode(
+		req.Header.Node, d, d.node.GetFolderBranch())
 
 	// This fits in situation 1 as described in libkbfs/delayed_cancellation.go
 	err = libkbfs.EnableDelayedCancellationWithGracePeriod(
@@ -434,6 +441,15 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return &SpecialReadFile{fileInfo(nmd).read}, nil
 	}
 
+	// Check if this is a per-file history directory.
+	if strings.HasPrefix(req.Name, libfs.FileHistoryPrefix) {
+		node, _, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, req.Name[len(libfs.FileHistoryPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		return &FileHistoryDir{folder: d.folder, file: node}, nil
+	}
+
 	newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, req.Name)
 	if err != nil {
 		if _, ok := err.(libkbfs.NoSuchNameError); ok {
@@ -580,6 +596,35 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return child, nil
 }
 
+// Link implements the fs.NodeLinker interface for Dir.
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (
+	node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Link %s", req.NewName)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	// Only regular files within the same TLF can be hard linked.
+	f, ok := old.(*File)
+	if !ok || f.folder != d.folder {
+		return nil, fuse.EPERM
+	}
+
+	// This fits in situation 1 as described in libkbfs/delayed_cancellation.go
+	err = libkbfs.EnableDelayedCancellationWithGracePeriod(
+		ctx, d.folder.fs.config.DelayedCancellationGracePeriod())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := d.folder.fs.config.KBFSOps().CreateHardLink(
+		ctx, f.node, d.node, req.NewName); err != nil {
+		return nil, err
+	}
+
+	// The link count changed, so don't serve cached attributes.
+	f.eiCache.destroy()
+	return f, nil
+}
+
 // Rename implements the fs.NodeRenamer interface for Dir.
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) (err error) {
@@ -684,6 +729,7 @@ func (d *Dir) ReadDirAll(ctx context.Context) (res []fuse.Dirent, err error) {
 
 // Forget kernel reference to this node.
 func (d *Dir) Forget() {
+	d.folder.fs.forgetFolderNode(d)
 	d.folder.forgetNode(d.node)
 }
 
@@ -691,6 +737,8 @@ func (d *Dir) Forget() {
 func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
 	d.folder.fs.log.CDebugf(ctx, "Dir SetAttr")
 	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	d.folder.fs.noteFolderNode(
+		req.Header.Node, d, d.node.GetFolderBranch())
 
 	valid := req.Valid
 
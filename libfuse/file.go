@@ -101,6 +101,9 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	}
 
 	fillAttrWithMode(&de, a)
+	if f.node.GetFolderBranch().Branch.IsArchived() {
+		a.Mode &^= 0222
+	}
 	return nil
 }
 
@@ -120,6 +123,7 @@ func (f *File) sync(ctx context.Context) error {
 func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
 	f.folder.fs.log.CDebugf(ctx, "File Fsync")
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	f.folder.fs.noteFolderNode(req.Header.Node, f, f.node.GetFolderBranch())
 
 	// This fits in situation 1 as described in libkbfs/delayed_cancellation.go
 	err = libkbfs.EnableDelayedCancellationWithGracePeriod(
@@ -167,6 +171,13 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest,
 	return nil
 }
 
+// TODO: implement copy_file_range with KBFSOps.CopyFile, so that
+// copies within a TLF through the mount share their blocks instead of
+// re-uploading them.  That needs FUSE protocol 7.28, but the vendored
+// bazil.org/fuse only negotiates up to 7.12 and has no request type
+// for it, so until it's upgraded, in-TLF copies through the mount
+// read and re-write the data; `kbfstool cp` uses CopyFile directly.
+
 var _ fs.HandleFlusher = (*File)(nil)
 
 // Flush implements the fs.HandleFlusher interface for File.
@@ -175,6 +186,7 @@ func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
 	// I'm not sure about the guarantees from KBFSOps, so we don't
 	// differentiate between Flush and Fsync.
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	f.folder.fs.noteFolderNode(req.Header.Node, f, f.node.GetFolderBranch())
 
 	// This fits in situation 1 as described in libkbfs/delayed_cancellation.go
 	err = libkbfs.EnableDelayedCancellationWithGracePeriod(
@@ -193,6 +205,7 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	resp *fuse.SetattrResponse) (err error) {
 	f.folder.fs.log.CDebugf(ctx, "File SetAttr")
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	f.folder.fs.noteFolderNode(req.Header.Node, f, f.node.GetFolderBranch())
 
 	f.eiCache.destroy()
 
@@ -270,6 +283,7 @@ var _ fs.NodeForgetter = (*File)(nil)
 
 // Forget kernel reference to this node.
 func (f *File) Forget() {
+	f.folder.fs.forgetFolderNode(f)
 	f.eiCache.destroy()
 	f.folder.forgetNode(f.node)
 }
@@ -0,0 +1,103 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FileHistoryDir is the special directory holding the version
+// history of a single file.  It contains a file listing the past
+// versions of the file, and a file that restores one of them.
+type FileHistoryDir struct {
+	folder *Folder
+	file   libkbfs.Node
+}
+
+var _ fs.Node = (*FileHistoryDir)(nil)
+
+// Attr implements the fs.Node interface for FileHistoryDir.
+func (fhd *FileHistoryDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0700
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*FileHistoryDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// FileHistoryDir.
+func (fhd *FileHistoryDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	switch req.Name {
+	case libfs.FileHistoryVersionsFileName:
+		resp.EntryValid = 0
+		return &SpecialReadFile{
+			read: func(ctx context.Context) ([]byte, time.Time, error) {
+				return libfs.GetEncodedFileHistory(
+					ctx, fhd.folder.fs.config, fhd.file)
+			},
+		}, nil
+	case libfs.FileHistoryRestoreFileName:
+		return &FileHistoryRestoreFile{folder: fhd.folder, file: fhd.file}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+var _ fs.Handle = (*FileHistoryDir)(nil)
+
+var _ fs.HandleReadDirAller = (*FileHistoryDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// FileHistoryDir.
+func (fhd *FileHistoryDir) ReadDirAll(ctx context.Context) (
+	[]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		{Type: fuse.DT_File, Name: libfs.FileHistoryVersionsFileName},
+		{Type: fuse.DT_File, Name: libfs.FileHistoryRestoreFileName},
+	}, nil
+}
+
+// FileHistoryRestoreFile represents a write-only file where any
+// write of a revision number restores the file to its contents as
+// of that revision.
+type FileHistoryRestoreFile struct {
+	folder *Folder
+	file   libkbfs.Node
+}
+
+var _ fs.Node = (*FileHistoryRestoreFile)(nil)
+
+// Attr implements the fs.Node interface for FileHistoryRestoreFile.
+func (f *FileHistoryRestoreFile) Attr(
+	ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*FileHistoryRestoreFile)(nil)
+
+var _ fs.HandleWriter = (*FileHistoryRestoreFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// FileHistoryRestoreFile.
+func (f *FileHistoryRestoreFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	size, err := libfs.RestoreFileVersion(
+		ctx, f.folder.fs.log, f.folder.fs.config, f.file, req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = size
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"bazil.org/fuse"
@@ -36,6 +37,21 @@ type FS struct {
 	// overridden to execute f without any delay.
 	execAfterDelay func(d time.Duration, f func())
 
+	// quotaUsage caches the current user's quota usage for Statfs.
+	quotaUsage *libkbfs.EventuallyConsistentQuotaUsage
+
+	// Protects folderNodes and folderNodeIDs.
+	folderNodesLock sync.Mutex
+	// folderNodes maps the FUSE node IDs of TLF nodes, as learned
+	// from the requests made on them, to their folder-branches, so
+	// that Statfs can report per-TLF usage.  The fuse library
+	// doesn't expose the node of a Statfs request itself.
+	folderNodes map[fuse.NodeID]libkbfs.FolderBranch
+	// folderNodeIDs maps each node recorded in folderNodes to its
+	// node ID, so the entry can be removed once the kernel forgets
+	// the node.
+	folderNodeIDs map[fs.Node]fuse.NodeID
+
 	root Root
 }
 
@@ -57,6 +73,10 @@ func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool) *FS {
 		log:           log,
 		errLog:        errLog,
 		notifications: libfs.NewFSNotifications(log),
+		quotaUsage: libkbfs.NewEventuallyConsistentQuotaUsage(
+			config, "fuse"),
+		folderNodes:   make(map[fuse.NodeID]libkbfs.FolderBranch),
+		folderNodeIDs: make(map[fs.Node]fuse.NodeID),
 	}
 	fs.root.private = &FolderList{
 		fs:      fs,
@@ -194,20 +214,115 @@ func (f *FS) Root() (fs.Node, error) {
 	return &f.root, nil
 }
 
+// noteFolderNode records that the node with the given FUSE node ID
+// belongs to folderBranch.  It does nothing if folderBranch is
+// unset.
+func (f *FS) noteFolderNode(id fuse.NodeID, node fs.Node,
+	folderBranch libkbfs.FolderBranch) {
+	if folderBranch == (libkbfs.FolderBranch{}) {
+		return
+	}
+	f.folderNodesLock.Lock()
+	defer f.folderNodesLock.Unlock()
+	f.folderNodes[id] = folderBranch
+	f.folderNodeIDs[node] = id
+}
+
+// forgetFolderNode forgets the node ID recorded for node, if any.
+func (f *FS) forgetFolderNode(node fs.Node) {
+	f.folderNodesLock.Lock()
+	defer f.folderNodesLock.Unlock()
+	id, ok := f.folderNodeIDs[node]
+	if !ok {
+		return
+	}
+	delete(f.folderNodeIDs, node)
+	delete(f.folderNodes, id)
+}
+
+// forgetFolderNodes forgets all the node IDs recorded for
+// folderBranch.
+func (f *FS) forgetFolderNodes(folderBranch libkbfs.FolderBranch) {
+	f.folderNodesLock.Lock()
+	defer f.folderNodesLock.Unlock()
+	for id, nodeFolderBranch := range f.folderNodes {
+		if nodeFolderBranch == folderBranch {
+			delete(f.folderNodes, id)
+		}
+	}
+	for node, id := range f.folderNodeIDs {
+		if _, ok := f.folderNodes[id]; !ok {
+			delete(f.folderNodeIDs, node)
+		}
+	}
+}
+
+func (f *FS) getFolderBranchForNode(
+	id fuse.NodeID) (libkbfs.FolderBranch, bool) {
+	f.folderNodesLock.Lock()
+	defer f.folderNodesLock.Unlock()
+	folderBranch, ok := f.folderNodes[id]
+	return folderBranch, ok
+}
+
+const (
+	// statfsBlockSize is the block size reported by Statfs.
+	statfsBlockSize = 32 * 1024
+	// quotaUsageStaleTolerance is how old the cached quota usage
+	// can get before Statfs fetches it from the server again.
+	quotaUsageStaleTolerance = 10 * time.Second
+)
+
 // Statfs implements the fs.FSStatfser interface for FS.
 func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
-	// TODO: Fill in real values for these.
-	var bsize uint32 = 32 * 1024
+	// Start with an "infinite" file system, in case the quota
+	// can't be determined.
 	*resp = fuse.StatfsResponse{
-		Blocks:  ^uint64(0) / uint64(bsize),
-		Bfree:   ^uint64(0) / uint64(bsize),
-		Bavail:  ^uint64(0) / uint64(bsize),
+		Blocks:  ^uint64(0) / statfsBlockSize,
+		Bfree:   ^uint64(0) / statfsBlockSize,
+		Bavail:  ^uint64(0) / statfsBlockSize,
 		Files:   0,
 		Ffree:   0,
-		Bsize:   bsize,
+		Bsize:   statfsBlockSize,
 		Namelen: ^uint32(0),
-		Frsize:  0,
+		Frsize:  statfsBlockSize,
+	}
+
+	usageBytes, limitBytes, err := f.quotaUsage.Get(
+		ctx, quotaUsageStaleTolerance)
+	if err != nil {
+		// Failing statfs would break tools like df entirely.
+		f.log.CDebugf(ctx, "Couldn't get quota usage: %v", err)
+		return nil
 	}
+
+	// Bytes still in the journal will count against the quota once
+	// they're flushed.
+	if jServer, err := libkbfs.GetJournalServer(f.config); err == nil {
+		jStatus, _ := jServer.Status(ctx)
+		usageBytes += jStatus.UnflushedBytes
+	}
+
+	var freeBytes uint64
+	if usageBytes < limitBytes {
+		freeBytes = uint64(limitBytes - usageBytes)
+	}
+	totalBytes := uint64(limitBytes)
+	if folderBranch, ok := f.getFolderBranchForNode(
+		req.Header.Node); ok {
+		// Inside a TLF, only count that TLF's usage as used.
+		status, _, err := f.config.KBFSOps().FolderStatus(ctx, folderBranch)
+		if err != nil {
+			f.log.CDebugf(ctx, "Couldn't get status for %s: %v",
+				folderBranch, err)
+		} else {
+			totalBytes = status.DiskUsage + freeBytes
+		}
+	}
+
+	resp.Blocks = totalBytes / statfsBlockSize
+	resp.Bfree = freeBytes / statfsBlockSize
+	resp.Bavail = resp.Bfree
 	return nil
 }
 
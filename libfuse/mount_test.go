@@ -42,6 +42,10 @@ func makeFS(t testing.TB, config *libkbfs.ConfigLocal) (
 		log:           log,
 		errLog:        log,
 		notifications: libfs.NewFSNotifications(log),
+		quotaUsage: libkbfs.NewEventuallyConsistentQuotaUsage(
+			config, "fuse"),
+		folderNodes:   make(map[fuse.NodeID]libkbfs.FolderBranch),
+		folderNodeIDs: make(map[fs.Node]fuse.NodeID),
 	}
 	filesys.root.private = &FolderList{
 		fs:      filesys,
@@ -211,6 +215,20 @@ func TestStatNonexistentFolder(t *testing.T) {
 	}
 }
 
+func TestChangeFeedNonexistentFolder(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "wsmith")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe,wsmith",
+		libfs.ChangeFeedPrefix+"0")
+	if _, err := os.Lstat(p); !os.IsNotExist(err) {
+		t.Fatalf("expected ENOENT: %v", err)
+	}
+}
+
 func TestStatAlias(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -3369,3 +3387,36 @@ func TestKbfsFileInfo(t *testing.T) {
 		t.Fatalf("Expected user1, %v raw %X", dst, bs)
 	}
 }
+
+func TestStatfs(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, fs, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	// The local block server has no usage and a huge limit.
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mnt.Dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks == 0 || st.Bfree != st.Blocks || st.Bavail != st.Bfree {
+		t.Fatalf("Unexpected root statfs: %+v", st)
+	}
+
+	myfile := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	data := make([]byte, 4*statfsBlockSize)
+	if err := ioutil.WriteFile(myfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFolderToServer(t, "jdoe", fs)
+
+	// Inside the TLF, its usage is reported as used.
+	tlfDir := path.Join(mnt.Dir, PrivateName, "jdoe")
+	if err := syscall.Statfs(tlfDir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks-st.Bfree < 4 {
+		t.Fatalf("Unexpected TLF statfs: %+v", st)
+	}
+}
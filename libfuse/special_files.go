@@ -25,6 +25,9 @@ func handleCommonSpecialFile(
 		return ProfileList{}
 	case libfs.ResetCachesFileName:
 		return &ResetCachesFile{fs}
+	case libfs.BandwidthLimitsFileName:
+		*entryValid = 0
+		return &BandwidthLimitsFile{fs}
 	}
 
 	return nil
@@ -83,6 +86,14 @@ func handleTLFSpecialFile(
 			folder: folder,
 		}
 
+	case libfs.UnmergedChangesFileName:
+		return NewUnmergedChangesFile(folder, entryValid)
+
+	case libfs.ConflictChoiceFileName:
+		return &ConflictChoiceFile{
+			folder: folder,
+		}
+
 	case libfs.DisableUpdatesFileName:
 		return &UpdatesFile{
 			folder: folder,
@@ -143,5 +154,14 @@ func handleTLFSpecialFile(
 			action: libfs.JournalDisable,
 		}
 	}
+
+	if since, ok := libfs.ParseChangeFeedName(name); ok {
+		if folder.getFolderBranch() == (libkbfs.FolderBranch{}) {
+			// A folder that doesn't exist yet has no changes
+			// to list.
+			return nil
+		}
+		return NewChangeFeedFile(folder, since, entryValid)
+	}
 	return nil
 }
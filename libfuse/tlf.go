@@ -154,6 +154,8 @@ func (tlf *TLF) Attr(ctx context.Context, a *fuse.Attr) error {
 
 // Lookup implements the fs.NodeRequestLookuper interface for TLF.
 func (tlf *TLF) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	tlf.folder.fs.noteFolderNode(
+		req.Header.Node, tlf, tlf.folder.getFolderBranch())
 	dir, exitEarly, err := tlf.loadDirAllowNonexistent(ctx)
 	if err != nil {
 		return nil, err
@@ -165,6 +167,12 @@ func (tlf *TLF) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 		}
 		return nil, fuse.ENOENT
 	}
+	if req.Name == libfs.ArchivedRevDirName {
+		return &ArchivedRevDir{folder: tlf.folder}, nil
+	}
+	if req.Name == libfs.TrashDirName {
+		return &TrashDir{folder: tlf.folder}, nil
+	}
 	return dir.Lookup(ctx, req, resp)
 }
 
@@ -196,6 +204,16 @@ func (tlf *TLF) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return dir.Symlink(ctx, req)
 }
 
+// Link implements the fs.NodeLinker interface for TLF.
+func (tlf *TLF) Link(ctx context.Context, req *fuse.LinkRequest,
+	old fs.Node) (fs.Node, error) {
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dir.Link(ctx, req, old)
+}
+
 // Rename implements the fs.NodeRenamer interface for TLF.
 func (tlf *TLF) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) error {
@@ -226,6 +244,7 @@ func (tlf *TLF) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 // Forget kernel reference to this node.
 func (tlf *TLF) Forget() {
+	tlf.folder.fs.forgetFolderNode(tlf)
 	dir := tlf.getStoredDir()
 	if dir != nil {
 		dir.Forget()
@@ -255,5 +274,7 @@ func (tlf *TLF) Open(ctx context.Context, req *fuse.OpenRequest,
 	if err != nil {
 		return nil, err
 	}
+	tlf.folder.fs.noteFolderNode(
+		req.Header.Node, tlf, tlf.folder.getFolderBranch())
 	return tlf, nil
 }
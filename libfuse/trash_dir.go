@@ -0,0 +1,100 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// TrashDir is the special directory at the root of a TLF that
+// exposes its trash.  It contains a file listing the removed entries
+// of the TLF, and a file that restores one of them.
+type TrashDir struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*TrashDir)(nil)
+
+// Attr implements the fs.Node interface for TrashDir.
+func (td *TrashDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0700
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*TrashDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// TrashDir.
+func (td *TrashDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	switch req.Name {
+	case libfs.TrashEntriesFileName:
+		resp.EntryValid = 0
+		return &SpecialReadFile{
+			read: func(ctx context.Context) ([]byte, time.Time, error) {
+				return libfs.GetEncodedTrash(ctx, td.folder.fs.config,
+					td.folder.getFolderBranch())
+			},
+		}, nil
+	case libfs.TrashRestoreFileName:
+		return &TrashRestoreFile{folder: td.folder}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+var _ fs.Handle = (*TrashDir)(nil)
+
+var _ fs.HandleReadDirAller = (*TrashDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// TrashDir.
+func (td *TrashDir) ReadDirAll(ctx context.Context) (
+	[]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		{Type: fuse.DT_File, Name: libfs.TrashEntriesFileName},
+		{Type: fuse.DT_File, Name: libfs.TrashRestoreFileName},
+	}, nil
+}
+
+// TrashRestoreFile represents a write-only file where any write of
+// the name of a removed entry, as listed in the trash, moves that
+// entry back to where it was removed from.
+type TrashRestoreFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*TrashRestoreFile)(nil)
+
+// Attr implements the fs.Node interface for TrashRestoreFile.
+func (f *TrashRestoreFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*TrashRestoreFile)(nil)
+
+var _ fs.HandleWriter = (*TrashRestoreFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// TrashRestoreFile.
+func (f *TrashRestoreFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	size, err := libfs.RestoreTrashEntry(ctx, f.folder.fs.log,
+		f.folder.fs.config, f.folder.getFolderBranch(), req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = size
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// xattrSetFlag converts the platform-specific flags of a setxattr
+// request into a libkbfs.XattrSetFlag.
+func xattrSetFlag(flags uint32) libkbfs.XattrSetFlag {
+	switch {
+	case flags&xattrCreate != 0:
+		return libkbfs.XattrCreate
+	case flags&xattrReplace != 0:
+		return libkbfs.XattrReplace
+	default:
+		return libkbfs.XattrSetAny
+	}
+}
+
+func getxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, err := folder.fs.config.KBFSOps().GetXattr(ctx, node, req.Name)
+	if err != nil {
+		return err
+	}
+	// A zero size means the caller only wants to know the size.
+	if req.Size != 0 && uint32(len(value)) > req.Size {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func listxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	names, err := folder.fs.config.KBFSOps().ListXattr(ctx, node)
+	if err != nil {
+		return err
+	}
+	resp.Append(names...)
+	// A zero size means the caller only wants to know the size.
+	if req.Size != 0 && uint32(len(resp.Xattr)) > req.Size {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
+
+func setxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.SetxattrRequest) error {
+	return folder.fs.config.KBFSOps().SetXattr(
+		ctx, node, req.Name, req.Xattr, xattrSetFlag(req.Flags))
+}
+
+func removexattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.RemovexattrRequest) error {
+	return folder.fs.config.KBFSOps().RemoveXattr(ctx, node, req.Name)
+}
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Getxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return getxattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Listxattr")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return listxattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for File.
+func (f *File) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Setxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	f.eiCache.destroy()
+	return setxattr(ctx, f.folder, f.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for File.
+func (f *File) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Removexattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	f.eiCache.destroy()
+	return removexattr(ctx, f.folder, f.node, req)
+}
+
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Getxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return getxattr(ctx, d.folder, d.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Listxattr")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return listxattr(ctx, d.folder, d.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for Dir.
+func (d *Dir) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Setxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	return setxattr(ctx, d.folder, d.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for Dir.
+func (d *Dir) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Removexattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	return removexattr(ctx, d.folder, d.node, req)
+}
@@ -0,0 +1,13 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build darwin
+
+package libfuse
+
+// The setxattr(2) flags from <sys/xattr.h>.
+const (
+	xattrCreate  = 0x2
+	xattrReplace = 0x4
+)
@@ -0,0 +1,275 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// BandwidthLimits holds the maximum rates, in bytes per second, of
+// block uploads to and downloads from the block server.  A rate that
+// isn't positive means there's no limit.
+type BandwidthLimits struct {
+	UploadBytesPerSec   int64 `json:"upload"`
+	DownloadBytesPerSec int64 `json:"download"`
+}
+
+type ctxBandwidthKeyType int
+
+const (
+	// ctxBackgroundBandwidthKey marks a context whose block
+	// transfers are background work, and should yield to any
+	// interactive transfers waiting on the same limit.
+	ctxBackgroundBandwidthKey ctxBandwidthKeyType = iota
+)
+
+// ctxWithBackgroundBandwidth returns a context whose block transfers
+// are treated as background work by the BandwidthLimiter.
+func ctxWithBackgroundBandwidth(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxBackgroundBandwidthKey, true)
+}
+
+func isBackgroundBandwidth(ctx context.Context) bool {
+	background, _ := ctx.Value(ctxBackgroundBandwidthKey).(bool)
+	return background
+}
+
+// bandwidthBucket is a token bucket limiting the rate of transfers
+// in one direction.  It holds at most one second's worth of tokens,
+// and may go into debt, so that a transfer bigger than the bucket
+// can still proceed; later transfers then wait for the debt to be
+// repaid.
+type bandwidthBucket struct {
+	clock Clock
+
+	waitTimer  metrics.Timer
+	bytesMeter metrics.Meter
+	limitGauge metrics.Gauge
+
+	lock sync.Mutex
+	// rate is in bytes per second; 0 means unlimited.
+	rate   int64
+	tokens float64
+	last   time.Time
+	// foregroundWaiting is the number of interactive transfers
+	// currently waiting for tokens.  Background transfers don't
+	// proceed while it's non-zero.
+	foregroundWaiting int
+	// changedCh is closed, and replaced, whenever a waiter might
+	// be able to proceed sooner than it expected.
+	changedCh chan struct{}
+}
+
+func newBandwidthBucket(clock Clock, name string,
+	registry metrics.Registry) *bandwidthBucket {
+	b := &bandwidthBucket{
+		clock:     clock,
+		changedCh: make(chan struct{}),
+	}
+	if registry != nil {
+		b.waitTimer = metrics.GetOrRegisterTimer(
+			"BandwidthLimiter."+name+".Wait", registry)
+		b.bytesMeter = metrics.GetOrRegisterMeter(
+			"BandwidthLimiter."+name+".Bytes", registry)
+		b.limitGauge = metrics.GetOrRegisterGauge(
+			"BandwidthLimiter."+name+".Limit", registry)
+	} else {
+		b.waitTimer = metrics.NilTimer{}
+		b.bytesMeter = metrics.NilMeter{}
+		b.limitGauge = metrics.NilGauge{}
+	}
+	return b
+}
+
+// notifyLocked wakes up all waiters so they can re-check the bucket.
+func (b *bandwidthBucket) notifyLocked() {
+	close(b.changedCh)
+	b.changedCh = make(chan struct{})
+}
+
+func (b *bandwidthBucket) refillLocked() {
+	now := b.clock.Now()
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+	}
+	b.last = now
+}
+
+func (b *bandwidthBucket) getLimit() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rate
+}
+
+func (b *bandwidthBucket) setLimit(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refillLocked()
+	if b.rate == 0 || b.tokens > float64(rate) {
+		// Start a new limit with a full bucket, but keep any
+		// debt from the old one.
+		b.tokens = float64(rate)
+	}
+	b.rate = rate
+	b.limitGauge.Update(rate)
+	b.notifyLocked()
+}
+
+// wait blocks until a transfer may start, and then takes size bytes'
+// worth of tokens for it.  Background transfers also wait until no
+// interactive ones are waiting.
+func (b *bandwidthBucket) wait(ctx context.Context, size int) error {
+	background := isBackgroundBandwidth(ctx)
+	start := b.clock.Now()
+	counted := false
+	defer func() {
+		if counted {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			b.foregroundWaiting--
+			b.notifyLocked()
+		}
+		b.waitTimer.UpdateSince(start)
+	}()
+
+	for {
+		b.lock.Lock()
+		b.refillLocked()
+		if b.rate == 0 {
+			b.lock.Unlock()
+			b.charge(size)
+			return nil
+		}
+		if !background && !counted {
+			b.foregroundWaiting++
+			counted = true
+		}
+		if b.tokens >= 0 && (!background || b.foregroundWaiting == 0) {
+			b.tokens -= float64(size)
+			b.lock.Unlock()
+			b.bytesMeter.Mark(int64(size))
+			return nil
+		}
+		// If there's no debt, this is a background transfer that
+		// only has to wait for the interactive ones.
+		var delay time.Duration
+		if b.tokens < 0 {
+			delay = time.Duration(
+				-b.tokens / float64(b.rate) * float64(time.Second))
+		}
+		changedCh := b.changedCh
+		b.lock.Unlock()
+
+		err := b.sleep(ctx, delay, changedCh)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits until the given delay has passed (or forever, if it's
+// zero), changedCh is closed, or ctx is done.
+func (b *bandwidthBucket) sleep(ctx context.Context, delay time.Duration,
+	changedCh <-chan struct{}) error {
+	var timerCh <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timerCh = timer.C
+	}
+	select {
+	case <-timerCh:
+		return nil
+	case <-changedCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// charge takes size bytes' worth of tokens without waiting, for
+// transfers whose size is only known once they're done.
+func (b *bandwidthBucket) charge(size int) {
+	b.bytesMeter.Mark(int64(size))
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate == 0 {
+		return
+	}
+	b.refillLocked()
+	b.tokens -= float64(size)
+}
+
+// BandwidthLimiter limits the rates of block uploads and downloads,
+// and lets interactive transfers go ahead of background ones (like
+// journal flushes and prefetches) when there's a limit.  The limits
+// can be changed at any time.
+type BandwidthLimiter struct {
+	upload   *bandwidthBucket
+	download *bandwidthBucket
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter with no limits,
+// which reports its limits and usage to the given registry, if it's
+// non-nil.
+func NewBandwidthLimiter(
+	clock Clock, registry metrics.Registry) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		upload:   newBandwidthBucket(clock, "Upload", registry),
+		download: newBandwidthBucket(clock, "Download", registry),
+	}
+}
+
+// Limits returns the current limits.
+func (bl *BandwidthLimiter) Limits() BandwidthLimits {
+	return BandwidthLimits{
+		UploadBytesPerSec:   bl.upload.getLimit(),
+		DownloadBytesPerSec: bl.download.getLimit(),
+	}
+}
+
+// SetLimits replaces the current limits.  Transfers that are already
+// waiting are re-evaluated against the new limits.
+func (bl *BandwidthLimiter) SetLimits(limits BandwidthLimits) {
+	bl.upload.setLimit(limits.UploadBytesPerSec)
+	bl.download.setLimit(limits.DownloadBytesPerSec)
+}
+
+// waitForUpload blocks until an upload of the given size may start.
+// A nil BandwidthLimiter never blocks.
+func (bl *BandwidthLimiter) waitForUpload(ctx context.Context, size int) error {
+	if bl == nil {
+		return nil
+	}
+	return bl.upload.wait(ctx, size)
+}
+
+// waitForDownload blocks until a download may start.  The size of a
+// download isn't known in advance, so it must be reported with
+// downloaded once it's done.
+func (bl *BandwidthLimiter) waitForDownload(ctx context.Context) error {
+	if bl == nil {
+		return nil
+	}
+	return bl.download.wait(ctx, 0)
+}
+
+// downloaded accounts for a finished download of the given size.
+func (bl *BandwidthLimiter) downloaded(size int) {
+	if bl == nil {
+		return
+	}
+	bl.download.charge(size)
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+const testBandwidthRate = 1000000
+
+func TestBandwidthLimiterUnlimited(t *testing.T) {
+	bl := NewBandwidthLimiter(wallClock{}, nil)
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		err := bl.waitForUpload(ctx, 10*testBandwidthRate)
+		require.NoError(t, err)
+	}
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestBandwidthLimiterRate(t *testing.T) {
+	registry := metrics.NewRegistry()
+	bl := NewBandwidthLimiter(wallClock{}, registry)
+	bl.SetLimits(BandwidthLimits{UploadBytesPerSec: testBandwidthRate})
+	require.Equal(t, BandwidthLimits{UploadBytesPerSec: testBandwidthRate},
+		bl.Limits())
+	require.Equal(t, int64(testBandwidthRate), metrics.GetOrRegisterGauge(
+		"BandwidthLimiter.Upload.Limit", registry).Value())
+
+	// The first upload uses up the full bucket, and goes a tenth of
+	// a second into debt, which the next one has to wait for.
+	ctx := context.Background()
+	err := bl.waitForUpload(ctx, testBandwidthRate+testBandwidthRate/10)
+	require.NoError(t, err)
+	start := time.Now()
+	err = bl.waitForUpload(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	// Downloads are unaffected.
+	start = time.Now()
+	err = bl.waitForDownload(ctx)
+	require.NoError(t, err)
+	bl.downloaded(10 * testBandwidthRate)
+	err = bl.waitForDownload(ctx)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) < 90*time.Millisecond)
+}
+
+func TestBandwidthLimiterCancelAndUnlimit(t *testing.T) {
+	bl := NewBandwidthLimiter(wallClock{}, nil)
+	bl.SetLimits(BandwidthLimits{DownloadBytesPerSec: testBandwidthRate})
+	bl.downloaded(100 * testBandwidthRate)
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := bl.waitForDownload(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// Removing the limit releases waiting transfers right away.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- bl.waitForDownload(context.Background())
+	}()
+	bl.SetLimits(BandwidthLimits{})
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the download")
+	}
+}
+
+func TestBandwidthLimiterForegroundFirst(t *testing.T) {
+	bl := NewBandwidthLimiter(wallClock{}, nil)
+	bl.SetLimits(BandwidthLimits{UploadBytesPerSec: testBandwidthRate})
+	ctx := context.Background()
+	err := bl.waitForUpload(ctx, testBandwidthRate+testBandwidthRate/10)
+	require.NoError(t, err)
+
+	// Start a background upload, and then an interactive one while
+	// it's still waiting; the interactive one should go first.
+	doneCh := make(chan string, 2)
+	go func() {
+		err := bl.waitForUpload(
+			ctxWithBackgroundBandwidth(ctx), testBandwidthRate/10)
+		require.NoError(t, err)
+		doneCh <- "background"
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		err := bl.waitForUpload(ctx, testBandwidthRate/10)
+		require.NoError(t, err)
+		doneCh <- "foreground"
+	}()
+
+	for _, expected := range []string{"foreground", "background"} {
+		select {
+		case who := <-doneCh:
+			require.Equal(t, expected, who)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for the %s upload", expected)
+		}
+	}
+}
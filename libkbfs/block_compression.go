@@ -0,0 +1,104 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// BlockCompressionType is the type of compression applied to the
+// encoded data of a block before it is padded and encrypted.
+type BlockCompressionType byte
+
+const (
+	// NoBlockCompression leaves the encoded data of blocks as it
+	// is.
+	NoBlockCompression BlockCompressionType = 0
+	// SnappyBlockCompression compresses the encoded data of
+	// blocks with snappy.
+	SnappyBlockCompression BlockCompressionType = 1
+)
+
+const (
+	// BlockCompressionNoneName selects NoBlockCompression in
+	// InitParams.
+	BlockCompressionNoneName = "none"
+	// BlockCompressionSnappyName selects SnappyBlockCompression
+	// in InitParams.
+	BlockCompressionSnappyName = "snappy"
+)
+
+// maxCompressibleBlockLen is the size past which block data is never
+// compressed, since the type of compression is kept in the top byte
+// of the length prefix of a padded block.  Blocks are never this
+// big anyway.
+const maxCompressibleBlockLen = 1 << padCompressionShift
+
+func (t BlockCompressionType) String() string {
+	switch t {
+	case NoBlockCompression:
+		return BlockCompressionNoneName
+	case SnappyBlockCompression:
+		return BlockCompressionSnappyName
+	default:
+		return fmt.Sprintf("BlockCompressionType(%d)", byte(t))
+	}
+}
+
+// ParseBlockCompressionType returns the type of compression with the
+// given name.
+func ParseBlockCompressionType(name string) (BlockCompressionType, error) {
+	switch name {
+	case "", BlockCompressionNoneName:
+		return NoBlockCompression, nil
+	case BlockCompressionSnappyName:
+		return SnappyBlockCompression, nil
+	default:
+		return NoBlockCompression,
+			fmt.Errorf("Unknown block compression %q", name)
+	}
+}
+
+// compressBlockData compresses data with the given type of
+// compression.  If that doesn't make the data smaller, it returns
+// data as it is, along with NoBlockCompression.
+func compressBlockData(data []byte, compression BlockCompressionType) (
+	[]byte, BlockCompressionType) {
+	if len(data) >= maxCompressibleBlockLen {
+		return data, NoBlockCompression
+	}
+
+	var compressed []byte
+	switch compression {
+	case SnappyBlockCompression:
+		compressed = snappy.Encode(nil, data)
+	default:
+		return data, NoBlockCompression
+	}
+
+	if len(compressed) >= len(data) {
+		return data, NoBlockCompression
+	}
+	return compressed, compression
+}
+
+// decompressBlockData undoes compressBlockData.
+func decompressBlockData(data []byte, compression BlockCompressionType) (
+	[]byte, error) {
+	switch compression {
+	case NoBlockCompression:
+		return data, nil
+	case SnappyBlockCompression:
+		decompressed, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, BlockDecodeError{err}
+		}
+		return decompressed, nil
+	default:
+		return nil, UnknownBlockCompressionError{compression}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlockCompressionType(t *testing.T) {
+	for _, compression := range []BlockCompressionType{
+		NoBlockCompression, SnappyBlockCompression} {
+		parsed, err := ParseBlockCompressionType(compression.String())
+		require.NoError(t, err)
+		require.Equal(t, compression, parsed)
+	}
+	_, err := ParseBlockCompressionType("zip")
+	require.Error(t, err)
+}
+
+func TestCompressBlockData(t *testing.T) {
+	data := bytes.Repeat([]byte("compress me "), 100)
+	compressed, compression := compressBlockData(
+		data, SnappyBlockCompression)
+	require.Equal(t, SnappyBlockCompression, compression)
+	require.True(t, len(compressed) < len(data))
+	decompressed, err := decompressBlockData(compressed, compression)
+	require.NoError(t, err)
+	require.Equal(t, data, decompressed)
+
+	// Random data doesn't compress, so it stays as it is.
+	data = make([]byte, 1000)
+	err = kbfscrypto.RandRead(data)
+	require.NoError(t, err)
+	compressed, compression = compressBlockData(
+		data, SnappyBlockCompression)
+	require.Equal(t, NoBlockCompression, compression)
+	require.Equal(t, data, compressed)
+
+	compressed, compression = compressBlockData(data, NoBlockCompression)
+	require.Equal(t, NoBlockCompression, compression)
+	require.Equal(t, data, compressed)
+
+	_, err = decompressBlockData(data, BlockCompressionType(0xff))
+	require.Equal(t, UnknownBlockCompressionError{0xff}, err)
+	_, err = decompressBlockData(data, SnappyBlockCompression)
+	require.IsType(t, BlockDecodeError{}, err)
+}
+
+func TestEncryptDecryptCompressedBlock(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = bytes.Repeat([]byte("a line of a log file\n"), 500)
+	plainSize, encryptedBlock, compressedSize, err := c.EncryptBlock(
+		block, cryptKey, SnappyBlockCompression)
+	require.NoError(t, err)
+	require.True(t, compressedSize < plainSize)
+	require.True(t, compressedSize <= len(encryptedBlock.EncryptedData))
+	require.True(t, len(encryptedBlock.EncryptedData) < plainSize)
+
+	// Older clients take the whole prefix for the length of the
+	// block data, which then can't fit in the padded block.
+	paddedBlock := checkSecretboxOpen(
+		t, encryptedData(encryptedBlock), cryptKey.Data())
+	oldBlockLen := binary.LittleEndian.Uint32(paddedBlock)
+	require.True(t, int(oldBlockLen) > len(paddedBlock))
+
+	decryptedBlock := NewFileBlock()
+	err = c.DecryptBlock(encryptedBlock, cryptKey, decryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, block.Contents, decryptedBlock.(*FileBlock).Contents)
+
+	// Blocks that compression wouldn't shrink aren't compressed.
+	smallBlock := TestBlock{50}
+	plainSize, encryptedBlock, compressedSize, err = c.EncryptBlock(
+		&smallBlock, cryptKey, SnappyBlockCompression)
+	require.NoError(t, err)
+	require.Equal(t, plainSize, compressedSize)
+	paddedBlock = checkSecretboxOpen(
+		t, encryptedData(encryptedBlock), cryptKey.Data())
+	_, compression, err := c.depadBlock(paddedBlock)
+	require.NoError(t, err)
+	require.Equal(t, NoBlockCompression, compression)
+}
+
+func TestKBFSOpsCompressedBlocks(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockCompression(SnappyBlockCompression)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), status.CompressionSavedBytes)
+
+	data := bytes.Repeat([]byte("all work and no play\n"), 1000)
+	fNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.CompressionSavedBytes > int64(len(data)/2))
+	md, err := kbfsOps.GetNodeMetadata(ctx, fNode)
+	require.NoError(t, err)
+	require.Equal(t, CompressedBlocksDataVer, md.BlockInfo.DataVer)
+
+	// The blocks of a multi-level file can be compressed, including
+	// the indirect ones.
+	config.SetBlockSplitter(&BlockSplitterSimple{256, 8 * 1024})
+	gData := bytes.Repeat([]byte("0123456789"), 1000)
+	gNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "g", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, gNode, gData, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, gNode)
+	require.NoError(t, err)
+	md, err = kbfsOps.GetNodeMetadata(ctx, gNode)
+	require.NoError(t, err)
+	require.Equal(t, CompressedBlocksDataVer, md.BlockInfo.DataVer)
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	gPath := ops.nodeCache.PathFromNode(gNode)
+	gBlock, err := ops.blocks.GetFileBlockForReading(ctx, lState,
+		ops.getHead(lState), gPath.tailPointer(), gPath.Branch, gPath)
+	require.NoError(t, err)
+	require.True(t, gBlock.IPtrs[0].IsInd)
+	require.Equal(t, CompressedBlocksDataVer, gBlock.IPtrs[0].DataVer)
+
+	// Another device reads the compressed blocks back, whether
+	// or not it compresses its own.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetBlockCompression(NoBlockCompression)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	fNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "f")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, fNode2, data)
+	gNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "g")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, gNode2, gData)
+}
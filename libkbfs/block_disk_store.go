@@ -233,6 +233,29 @@ func (s *blockDiskStore) getData(id BlockID) (
 	return data, serverHalf, nil
 }
 
+// putData writes the data and server half for the given ID, creating
+// the block directory if necessary.  It does not touch any references.
+func (s *blockDiskStore) putData(id BlockID, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	err := s.makeDir(id)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(s.dataPath(id), buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	// TODO: Add integrity-checking for key server half?
+
+	data, err := serverHalf.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.keyServerHalfPath(id), data, 0600)
+}
+
 // All functions below are public functions.
 
 func (s *blockDiskStore) hasAnyRef(id BlockID) (bool, error) {
@@ -292,31 +315,31 @@ func (s *blockDiskStore) getDataWithContext(id BlockID, context BlockContext) (
 	return s.getData(id)
 }
 
-func (s *blockDiskStore) getAllRefsForTest() (map[BlockID]blockRefMap, error) {
-	res := make(map[BlockID]blockRefMap)
-
+// forEachBlockID calls the given function for the ID of every block
+// directory in the store, stopping at the first error.
+func (s *blockDiskStore) forEachBlockID(fn func(id BlockID) error) error {
 	fileInfos, err := ioutil.ReadDir(s.dir)
 	if os.IsNotExist(err) {
-		return res, nil
+		return nil
 	} else if err != nil {
-		return nil, err
+		return err
 	}
 
 	for _, fi := range fileInfos {
 		name := fi.Name()
 		if !fi.IsDir() {
-			return nil, fmt.Errorf("Unexpected non-dir %q", name)
+			return fmt.Errorf("Unexpected non-dir %q", name)
 		}
 
 		subFileInfos, err := ioutil.ReadDir(filepath.Join(s.dir, name))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		for _, sfi := range subFileInfos {
 			subName := sfi.Name()
 			if !sfi.IsDir() {
-				return nil, fmt.Errorf("Unexpected non-dir %q",
+				return fmt.Errorf("Unexpected non-dir %q",
 					subName)
 			}
 
@@ -324,31 +347,46 @@ func (s *blockDiskStore) getAllRefsForTest() (map[BlockID]blockRefMap, error) {
 				s.dir, name, subName, idFilename)
 			idBytes, err := ioutil.ReadFile(idPath)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			id, err := BlockIDFromString(string(idBytes))
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			if !strings.HasPrefix(id.String(), name+subName) {
-				return nil, fmt.Errorf(
+				return fmt.Errorf(
 					"%q unexpectedly not a prefix of %q",
 					name+subName, id.String())
 			}
 
-			refInfo, err := s.getRefInfo(id)
+			err = fn(id)
 			if err != nil {
-				return nil, err
-			}
-
-			if len(refInfo.Refs) > 0 {
-				res[id] = refInfo.Refs
+				return err
 			}
 		}
 	}
 
+	return nil
+}
+
+func (s *blockDiskStore) getAllRefsForTest() (map[BlockID]blockRefMap, error) {
+	res := make(map[BlockID]blockRefMap)
+	err := s.forEachBlockID(func(id BlockID) error {
+		refInfo, err := s.getRefInfo(id)
+		if err != nil {
+			return err
+		}
+
+		if len(refInfo.Refs) > 0 {
+			res[id] = refInfo.Refs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return res, nil
 }
 
@@ -387,23 +425,7 @@ func (s *blockDiskStore) put(id BlockID, context BlockContext, buf []byte,
 				existingServerHalf, serverHalf)
 		}
 	} else {
-		err = s.makeDir(id)
-		if err != nil {
-			return err
-		}
-
-		err = ioutil.WriteFile(s.dataPath(id), buf, 0600)
-		if err != nil {
-			return err
-		}
-
-		// TODO: Add integrity-checking for key server half?
-
-		data, err := serverHalf.MarshalBinary()
-		if err != nil {
-			return err
-		}
-		err = ioutil.WriteFile(s.keyServerHalfPath(id), data, 0600)
+		err = s.putData(id, buf, serverHalf)
 		if err != nil {
 			return err
 		}
@@ -7,6 +7,8 @@ package libkbfs
 import (
 	"fmt"
 
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
 
@@ -20,11 +22,25 @@ type realBlockGetter struct {
 	config Config
 }
 
-// getBlock implements the interface for realBlockGetter.
-func (bg *realBlockGetter) getBlock(ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer, block Block) error {
+// getBlockData fetches the encrypted block data and server half for
+// the given pointer, first from the disk block cache (if there is
+// one), and then from the block server.  Blocks fetched from the
+// block server are added to the disk block cache.
+func (bg *realBlockGetter) getBlockData(ctx context.Context, tlfID tlf.ID,
+	blockPtr BlockPointer) ([]byte, kbfscrypto.BlockCryptKeyServerHalf,
+	error) {
+	dbc := bg.config.DiskBlockCache()
+	if dbc != nil {
+		buf, serverHalf, err := dbc.Get(ctx, tlfID, blockPtr.ID)
+		if err == nil {
+			return buf, serverHalf, nil
+		}
+		// On any error, fall back to the block server.
+	}
+
 	bserv := bg.config.BlockServer()
-	buf, blockServerHalf, err := bserv.Get(
-		ctx, kmd.TlfID(), blockPtr.ID, blockPtr.BlockContext)
+	buf, serverHalf, err := bserv.Get(
+		ctx, tlfID, blockPtr.ID, blockPtr.BlockContext)
 	if err != nil {
 		// Temporary code to track down bad block
 		// requests. Remove when not needed anymore.
@@ -33,9 +49,37 @@ func (bg *realBlockGetter) getBlock(ctx context.Context, kmd KeyMetadata, blockP
 				err, blockPtr))
 		}
 
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
+	if dbc != nil {
+		// Failing to cache the block isn't fatal, since we've
+		// already got the data.
+		if err := dbc.Put(
+			ctx, tlfID, blockPtr.ID, buf, serverHalf); err != nil {
+			if log := bg.config.MakeLogger(""); log != nil {
+				log.CDebugf(ctx, "Couldn't cache block %s on disk: %v",
+					blockPtr.ID, err)
+			}
+		}
+	}
+	return buf, serverHalf, nil
+}
+
+// getBlock implements the interface for realBlockGetter.
+func (bg *realBlockGetter) getBlock(ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer, block Block) error {
+	buf, blockServerHalf, err := bg.getBlockData(ctx, kmd.TlfID(), blockPtr)
+	if err != nil {
 		return err
 	}
+	return bg.assembleBlock(ctx, kmd, blockPtr, block, buf, blockServerHalf)
+}
 
+// assembleBlock verifies the given encrypted block data against
+// blockPtr, and decrypts it into block.
+func (bg *realBlockGetter) assembleBlock(ctx context.Context,
+	kmd KeyMetadata, blockPtr BlockPointer, block Block, buf []byte,
+	blockServerHalf kbfscrypto.BlockCryptKeyServerHalf) error {
 	crypto := bg.config.Crypto()
 	if err := crypto.VerifyBlockID(buf, blockPtr.ID); err != nil {
 		return err
@@ -217,8 +217,13 @@ func aggregateInfoPath(dir string) string {
 
 func (j *blockJournal) adjustUnflushedBytes(delta int64) error {
 	j.aggregateInfo.UnflushedBytes += delta
-	return kbfscodec.SerializeToFile(
+	err := kbfscodec.SerializeToFile(
 		j.codec, j.aggregateInfo, aggregateInfoPath(j.dir))
+	if err != nil {
+		j.aggregateInfo.UnflushedBytes -= delta
+		return err
+	}
+	return nil
 }
 
 // The functions below are for reading and writing journal entries.
@@ -323,6 +328,13 @@ func (j *blockJournal) putData(
 		Contexts: map[BlockID][]BlockContext{id: {context}},
 	})
 	if err != nil {
+		// There's no entry to flush or ignore, so undo the
+		// adjustment above.
+		if adjustErr := j.adjustUnflushedBytes(
+			-int64(len(buf))); adjustErr != nil {
+			j.log.CWarningf(ctx, "Couldn't undo the unflushed bytes "+
+				"of block %s: %+v", id, adjustErr)
+		}
 		return err
 	}
 
@@ -552,7 +564,7 @@ func (j *blockJournal) getNextEntriesToFlush(
 			entries.puts.addNewBlock(
 				BlockPointer{ID: id, BlockContext: bctx},
 				nil, /* only used by folderBranchOps */
-				ReadyBlockData{data, serverHalf}, nil)
+				ReadyBlockData{buf: data, serverHalf: serverHalf}, nil)
 
 		case addRefOp:
 			id, bctx, err := entry.getSingleContext()
@@ -12,9 +12,10 @@ import (
 // BlockOpsStandard implements the BlockOps interface by relaying
 // requests to the block server.
 type BlockOpsStandard struct {
-	config  Config
-	queue   *blockRetrievalQueue
-	workers []*blockRetrievalWorker
+	config     Config
+	queue      *blockRetrievalQueue
+	workers    []*blockRetrievalWorker
+	prefetcher *blockPrefetcher
 }
 
 var _ BlockOps = (*BlockOpsStandard)(nil)
@@ -26,6 +27,8 @@ func NewBlockOpsStandard(config Config, queueSize int) *BlockOpsStandard {
 		queue:   newBlockRetrievalQueue(queueSize, config.Codec()),
 		workers: make([]*blockRetrievalWorker, 0, queueSize),
 	}
+	bops.prefetcher = newBlockPrefetcher(bops.queue, config)
+	bops.queue.prefetcher = bops.prefetcher
 	bg := &realBlockGetter{config: config}
 	for i := 0; i < queueSize; i++ {
 		bops.workers = append(bops.workers, newBlockRetrievalWorker(bg, bops.queue))
@@ -71,7 +74,8 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 		return
 	}
 
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	plainSize, encryptedBlock, compressedSize, err := crypto.EncryptBlock(
+		block, blockKey, b.config.BlockCompression())
 	if err != nil {
 		return
 	}
@@ -82,14 +86,15 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	readyBlockData = ReadyBlockData{
-		buf:        buf,
-		serverHalf: serverHalf,
+		buf:                buf,
+		serverHalf:         serverHalf,
+		compressionSavings: plainSize - compressedSize,
 	}
 
 	encodedSize := readyBlockData.GetEncodedSize()
-	if encodedSize < plainSize {
+	if encodedSize < compressedSize {
 		err = TooLowByteCountError{
-			ExpectedMinByteCount: plainSize,
+			ExpectedMinByteCount: compressedSize,
 			ByteCount:            encodedSize,
 		}
 		return
@@ -127,8 +132,14 @@ func (b *BlockOpsStandard) Archive(ctx context.Context, tlfID tlf.ID,
 	return b.config.BlockServer().ArchiveBlockReferences(ctx, tlfID, contexts)
 }
 
+// Prefetcher implements the BlockOps interface for BlockOpsStandard.
+func (b *BlockOpsStandard) Prefetcher() Prefetcher {
+	return b.prefetcher
+}
+
 // Shutdown implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Shutdown() {
+	b.prefetcher.Shutdown()
 	b.queue.Shutdown()
 	for _, w := range b.workers {
 		w.Shutdown()
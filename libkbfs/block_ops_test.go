@@ -117,8 +117,8 @@ func expectBlockEncrypt(config *ConfigMock, kmd KeyMetadata, decData Block, plai
 		EncryptedData: encData,
 	}
 	config.mockCrypto.EXPECT().EncryptBlock(decData,
-		kbfscrypto.BlockCryptKey{}).
-		Return(plainSize, encryptedBlock, err)
+		kbfscrypto.BlockCryptKey{}, NoBlockCompression).
+		Return(plainSize, encryptedBlock, plainSize, err)
 	if err == nil {
 		config.mockCodec.EXPECT().Encode(encryptedBlock).Return(encData, nil)
 	}
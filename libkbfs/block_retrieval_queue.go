@@ -8,6 +8,7 @@ import (
 	"container/heap"
 	"errors"
 	"io"
+	"reflect"
 	"sync"
 
 	"github.com/keybase/kbfs/kbfscodec"
@@ -75,6 +76,8 @@ type blockRetrievalQueue struct {
 	// channel to be closed when we're done accepting requests
 	doneCh chan struct{}
 	codec  kbfscodec.Codec
+	// if non-nil, notified of every successful on-demand retrieval
+	prefetcher Prefetcher
 }
 
 // newBlockRetrievalQueue creates a new block retrieval queue. The numWorkers
@@ -195,9 +198,17 @@ func (brq *blockRetrievalQueue) FinalizeRequest(retrieval *blockRetrieval, block
 	// This might have already been removed if the context has been canceled.
 	// That's okay, because this will then be a no-op.
 	delete(brq.ptrs, retrieval.blockPtr)
+	priority := retrieval.priority
 	brq.mtx.Unlock()
 	retrieval.cancelFunc()
 
+	// Only on-demand retrievals trigger prefetches, so that we don't
+	// recursively prefetch an entire TLF.
+	if brq.prefetcher != nil && err == nil && block != nil &&
+		priority >= defaultOnDemandRequestPriority {
+		brq.prefetcher.PrefetchAfterBlockRetrieved(block, retrieval.kmd)
+	}
+
 	// This is a symbolic lock, since there shouldn't be any other goroutines
 	// accessing requests at this point. But requests had contentious access
 	// earlier, so we'll lock it here as well to maintain the integrity of the
@@ -206,15 +217,34 @@ func (brq *blockRetrievalQueue) FinalizeRequest(retrieval *blockRetrieval, block
 	defer retrieval.reqMtx.Unlock()
 	for _, r := range retrieval.requests {
 		req := r
+		reqErr := err
 		if block != nil {
 			// Copy the decrypted block to the caller
-			req.block.Set(block, brq.codec)
+			if reflect.TypeOf(req.block) == reflect.TypeOf(block) {
+				req.block.Set(block, brq.codec)
+			} else if convErr := brq.convertBlock(
+				req.block, block); reqErr == nil {
+				reqErr = convErr
+			}
 		}
 		// Since we created this channel with a buffer size of 1, this won't block.
-		req.doneCh <- err
+		req.doneCh <- reqErr
 	}
 }
 
+// convertBlock copies block into reqBlock, when the two are different
+// types of Block. This can happen when requests for the same pointer
+// but with different block types are coalesced, e.g. a prefetch for a
+// FileBlock and a generic read of a CommonBlock.
+func (brq *blockRetrievalQueue) convertBlock(reqBlock, block Block) error {
+	err := kbfscodec.Update(brq.codec, reqBlock, block)
+	if err != nil {
+		return err
+	}
+	reqBlock.SetEncodedSize(block.GetEncodedSize())
+	return nil
+}
+
 // Shutdown is called when we are no longer accepting requests
 func (brq *blockRetrievalQueue) Shutdown() {
 	select {
@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"io"
+
+	"golang.org/x/net/context"
 )
 
 // blockRetrievalWorker processes blockRetrievalQueue requests
@@ -77,7 +79,16 @@ func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 	default:
 	}
 
-	return brw.getBlock(retrieval.ctx, retrieval.kmd, retrieval.blockPtr, block)
+	// Prefetches that no one is waiting for yet go behind
+	// interactive block transfers.
+	ctx := context.Context(retrieval.ctx)
+	brw.queue.mtx.RLock()
+	priority := retrieval.priority
+	brw.queue.mtx.RUnlock()
+	if priority < defaultOnDemandRequestPriority {
+		ctx = ctxWithBackgroundBandwidth(ctx)
+	}
+	return brw.getBlock(ctx, retrieval.kmd, retrieval.blockPtr, block)
 }
 
 // Shutdown shuts down the blockRetrievalWorker once its current work is done.
@@ -220,6 +220,36 @@ func TestBlockRetrievalWorkerCancel(t *testing.T) {
 	require.EqualError(t, err, context.Canceled.Error())
 }
 
+func TestBlockRetrievalWorkerMixedBlockTypes(t *testing.T) {
+	t.Log("Test that coalesced requests for different block types " +
+		"each get the block.")
+	q := newBlockRetrievalQueue(1, kbfscodec.NewMsgpack())
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	bg := newFakeBlockGetter()
+	w := newBlockRetrievalWorker(bg, q)
+	require.NotNil(t, w)
+	defer w.Shutdown()
+
+	ptr1 := makeFakeBlockPointer(t)
+	block1 := makeFakeFileBlock(t)
+	block1.IsInd = true
+	ch1 := bg.setBlockToReturn(ptr1, block1)
+
+	fileBlock := &FileBlock{}
+	req1Ch := q.Request(context.Background(), 1, nil, ptr1, fileBlock)
+	commonBlock := &CommonBlock{}
+	req2Ch := q.Request(context.Background(), 1, nil, ptr1, commonBlock)
+	ch1 <- struct{}{}
+	err := <-req1Ch
+	require.NoError(t, err)
+	require.Equal(t, block1, fileBlock)
+	err = <-req2Ch
+	require.NoError(t, err)
+	require.True(t, commonBlock.IsInd)
+}
+
 func TestBlockRetrievalWorkerShutdown(t *testing.T) {
 	t.Log("Test that worker shutdown works.")
 	q := newBlockRetrievalQueue(1, kbfscodec.NewMsgpack())
@@ -17,6 +17,10 @@ type IndirectDirPtr struct {
 	// field is non-zero.
 	BlockInfo
 	Off string `codec:"o"`
+	// PlainSize is the encoded size of the child block before
+	// encryption, so that unchanged children don't need to be
+	// encoded again to split the directory.  Zero if unknown.
+	PlainSize int `codec:"p,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -30,10 +34,19 @@ type IndirectFilePtr struct {
 	Off int64 `codec:"o"`
 	// Marker for files with holes
 	Holes bool `codec:"h,omitempty"`
+	// IsInd marks pointers to other indirect blocks, rather than
+	// to leaf blocks, in files with multiple levels of indirection
+	IsInd bool `codec:"s,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
 
+// pointsToIndirectBlock returns true if iptr points to another
+// indirect block, rather than to a leaf block.
+func (iptr IndirectFilePtr) pointsToIndirectBlock() bool {
+	return iptr.IsInd
+}
+
 // CommonBlock holds block data that is common for both subdirectories
 // and files.
 type CommonBlock struct {
@@ -82,7 +95,15 @@ func NewCommonBlock() Block {
 	return &CommonBlock{}
 }
 
-// DirBlock is the contents of a directory
+// DirBlock is the contents of a directory.
+//
+// A large directory is split by name into several direct child
+// blocks, pointed to by the IPtrs of an indirect top block. When
+// folderBlockOps reads such a directory, it assembles all the child
+// entries into a single DirBlock, with IsInd unset and IPtrs still
+// listing the child blocks it was assembled from, so that callers
+// never have to care about the split.  An assembled DirBlock must be
+// split again before it's readied; see folderBranchOps.readyDirBlock.
 type DirBlock struct {
 	CommonBlock
 	// if not indirect, a map of path name to directory entry
@@ -103,6 +124,25 @@ func (db *DirBlock) NewEmpty() Block {
 	return NewDirBlock()
 }
 
+// DataVersion returns data version for this block.
+func (db *DirBlock) DataVersion() DataVer {
+	for _, de := range db.Children {
+		if de.isHardLink() {
+			return HardLinksDataVer
+		}
+	}
+	if db.IsInd || len(db.IPtrs) > 0 {
+		return IndirectDirsDataVer
+	}
+	return FirstValidDataVer
+}
+
+// isAssembled returns whether this is an assembled view of an
+// indirect directory.
+func (db *DirBlock) isAssembled() bool {
+	return !db.IsInd && len(db.IPtrs) > 0
+}
+
 // Set implements the Block interface for DirBlock
 func (db *DirBlock) Set(other Block, codec kbfscodec.Codec) {
 	otherDb := other.(*DirBlock)
@@ -154,12 +194,16 @@ func (fb *FileBlock) NewEmpty() Block {
 
 // DataVersion returns data version for this block.
 func (fb *FileBlock) DataVersion() DataVer {
+	ver := FirstValidDataVer
 	for i := range fb.IPtrs {
+		if fb.IPtrs[i].pointsToIndirectBlock() {
+			return MultiLevelFilesDataVer
+		}
 		if fb.IPtrs[i].Holes {
-			return FilesWithHolesDataVer
+			ver = FilesWithHolesDataVer
 		}
 	}
-	return FirstValidDataVer
+	return ver
 }
 
 // Set implements the Block interface for FileBlock
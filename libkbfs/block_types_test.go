@@ -63,6 +63,7 @@ func makeFakeIndirectDirPtrFuture(t *testing.T) indirectDirPtrFuture {
 		indirectDirPtrCurrent{
 			makeFakeBlockInfo(t),
 			"offset",
+			100,
 			codec.UnknownFieldSetHandler{},
 		},
 		kbfscodec.MakeExtraOrBust("IndirectDirPtr", t),
@@ -94,6 +95,7 @@ func makeFakeIndirectFilePtrFuture(t *testing.T) indirectFilePtrFuture {
 			makeFakeBlockInfo(t),
 			25,
 			false,
+			true,
 			codec.UnknownFieldSetHandler{},
 		},
 		kbfscodec.MakeExtraOrBust("IndirectFilePtr", t),
@@ -220,3 +222,27 @@ func makeFakeFileBlockFuture(t *testing.T) fileBlockFuture {
 func TestFileBlockUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakeFileBlockFuture(t))
 }
+
+func TestFileBlockDataVersion(t *testing.T) {
+	fblock := NewFileBlock().(*FileBlock)
+	require.Equal(t, FirstValidDataVer, fblock.DataVersion())
+
+	fblock.IsInd = true
+	fblock.IPtrs = []IndirectFilePtr{
+		{BlockInfo: makeFakeBlockInfo(t), Off: 0},
+		{BlockInfo: makeFakeBlockInfo(t), Off: 10},
+	}
+	fblock.IPtrs[0].DataVer = FirstValidDataVer
+	fblock.IPtrs[1].DataVer = FirstValidDataVer
+	require.Equal(t, FirstValidDataVer, fblock.DataVersion())
+
+	fblock.IPtrs[1].Holes = true
+	require.Equal(t, FilesWithHolesDataVer, fblock.DataVersion())
+
+	// The data version of a child block doesn't make the file
+	// multi-level, but a pointer to another indirect block does.
+	fblock.IPtrs[0].DataVer = MultiLevelFilesDataVer
+	require.Equal(t, FilesWithHolesDataVer, fblock.DataVersion())
+	fblock.IPtrs[0].IsInd = true
+	require.Equal(t, MultiLevelFilesDataVer, fblock.DataVersion())
+}
@@ -20,6 +20,16 @@ func isRecoverableBlockError(err error) bool {
 	return isArchiveError || isDeleteError || isRefError || isMaxExceededError
 }
 
+// isBlockGoneError returns true if err means a block was removed
+// from the server, e.g. by quota reclamation.
+func isBlockGoneError(err error) bool {
+	switch err.(type) {
+	case BServerErrorBlockDeleted, BServerErrorBlockNonExistent:
+		return true
+	}
+	return false
+}
+
 // putBlockToServer either puts the full block to the block server, or
 // just adds a reference, depending on the refnonce in blockPtr.
 func putBlockToServer(ctx context.Context, bserv BlockServer, tlfID tlf.ID,
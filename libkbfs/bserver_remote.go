@@ -307,12 +307,19 @@ func (b *BlockServerRemote) Get(ctx context.Context, tlfID tlf.ID, id BlockID,
 		Folder: tlfID.String(),
 	}
 
+	bwLimiter := b.config.BandwidthLimiter()
+	err = bwLimiter.waitForDownload(ctx)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
 	res, err := b.getClient.GetBlock(ctx, arg)
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
 
 	size = len(res.Buf)
+	bwLimiter.downloaded(size)
 	bk, err := kbfscrypto.ParseBlockCryptKeyServerHalf(res.BlockKey)
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
@@ -347,6 +354,11 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
 		Buf:      buf,
 	}
 
+	err = b.config.BandwidthLimiter().waitForUpload(ctx, size)
+	if err != nil {
+		return err
+	}
+
 	// Handle OverQuota errors at the caller
 	return b.putClient.PutBlock(ctx, arg)
 }
@@ -0,0 +1,182 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/kbfscodec"
+)
+
+const (
+	// cdcWindowSize is the number of bytes the rolling hash covers
+	// when deciding whether a block boundary falls at a given
+	// offset.  It must not be a multiple of 32, or the hash of a
+	// run of identical bytes (like a sparse region of a file)
+	// would always be zero and split at every opportunity.
+	cdcWindowSize = 48
+)
+
+// cdcHashTable maps each byte value to a random-looking 32-bit value
+// for the rolling hash.  It must never change, or files written by
+// different clients would stop sharing block boundaries (though they
+// would still be readable).
+var cdcHashTable = func() (table [256]uint32) {
+	// Fill the table using a fixed xorshift sequence.
+	x := uint32(0x9e3779b9)
+	for i := range table {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		table[i] = x
+	}
+	return table
+}()
+
+func rotl32(x uint32, n uint) uint32 {
+	n %= 32
+	return x<<n | x>>(32-n)
+}
+
+// BlockSplitterCDC implements the BlockSplitter interface using
+// content-defined chunking: block boundaries are placed wherever a
+// buzhash over the preceding cdcWindowSize bytes matches a mask, so
+// that the boundaries move along with the data when bytes are
+// inserted or removed.  That keeps most blocks of an edited file
+// identical to the old ones, so they can be deduplicated instead of
+// re-uploaded.
+//
+// Blocks are still plain file blocks, so files split by this
+// splitter and by BlockSplitterSimple can be read and written by
+// either one.  The first time a file split by a different splitter
+// is modified, the blocks after the first modified one will be
+// re-split along content-defined boundaries.
+type BlockSplitterCDC struct {
+	minSize                 int64
+	maxSize                 int64
+	mask                    uint32
+	blockChangeEmbedMaxSize uint64
+}
+
+// NewBlockSplitterCDC creates a new BlockSplitterCDC.  Blocks will
+// not be split until they are at least minSize bytes long, and
+// boundaries will come on average every avgSize bytes after that.
+// The max size is adjusted as for NewBlockSplitterSimple to try to
+// match the desired size for the largest encoded file blocks.
+func NewBlockSplitterCDC(minSize, avgSize, desiredMaxBlockSize int64,
+	blockChangeEmbedMaxSize uint64, codec kbfscodec.Codec) (
+	*BlockSplitterCDC, error) {
+	maxSize, err := maxContentsSizeForBlockSize(desiredMaxBlockSize, codec)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockSplitterCDC(
+		minSize, avgSize, maxSize, blockChangeEmbedMaxSize)
+}
+
+func newBlockSplitterCDC(minSize, avgSize, maxSize int64,
+	blockChangeEmbedMaxSize uint64) (*BlockSplitterCDC, error) {
+	if minSize < cdcWindowSize || avgSize <= 0 || minSize > maxSize {
+		return nil, fmt.Errorf("Invalid CDC block sizes: min=%d avg=%d "+
+			"max=%d", minSize, avgSize, maxSize)
+	}
+
+	// Round the average size up to a power of two, so a boundary
+	// can be detected by masking the hash.
+	mask := uint32(1)
+	for int64(mask) < avgSize {
+		mask <<= 1
+	}
+	return &BlockSplitterCDC{
+		minSize:                 minSize,
+		maxSize:                 maxSize,
+		mask:                    mask - 1,
+		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+	}, nil
+}
+
+// findSplit returns the first offset in data, no earlier than from
+// and minSize, at which a block should end.  If there is no such
+// offset, it returns maxSize if data is at least that long, and -1
+// otherwise.
+func (b *BlockSplitterCDC) findSplit(data []byte, from int64) int64 {
+	if from < b.minSize {
+		from = b.minSize
+	}
+	end := int64(len(data))
+	if end > b.maxSize {
+		end = b.maxSize
+	}
+	if from > end {
+		if end == b.maxSize {
+			return b.maxSize
+		}
+		return -1
+	}
+
+	var h uint32
+	for _, c := range data[from-cdcWindowSize : from] {
+		h = rotl32(h, 1) ^ cdcHashTable[c]
+	}
+	for i := from; ; i++ {
+		if h&b.mask == 0 {
+			return i
+		}
+		if i == end {
+			break
+		}
+		h = rotl32(h, 1) ^ rotl32(cdcHashTable[data[i-cdcWindowSize]],
+			cdcWindowSize) ^ cdcHashTable[data[i]]
+	}
+	if end == b.maxSize {
+		return b.maxSize
+	}
+	return -1
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	n := copyUpToMaxSize(block, data, off, b.maxSize)
+	if off != currLen {
+		// This is a write into the middle of the block; CheckSplit
+		// will fix up the boundaries later.
+		return n
+	}
+
+	// This is an append, so stop at the first boundary in the new
+	// bytes (or right away if the block already ends at one).
+	splitAt := b.findSplit(block.Contents, currLen)
+	if splitAt < currLen || splitAt >= currLen+n {
+		return n
+	}
+	block.Contents = block.Contents[:splitAt]
+	return splitAt - currLen
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CheckSplit(block *FileBlock) int64 {
+	splitAt := b.findSplit(block.Contents, 0)
+	if splitAt == int64(len(block.Contents)) {
+		return 0
+	}
+	return splitAt
+}
+
+// MaxPtrsPerBlock implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) MaxPtrsPerBlock() int {
+	return maxPtrsForMaxSize(b.maxSize)
+}
+
+// ShouldEmbedBlockChanges implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) ShouldEmbedBlockChanges(
+	bc *BlockChanges) bool {
+	return bc.SizeEstimate() <= b.blockChangeEmbedMaxSize
+}
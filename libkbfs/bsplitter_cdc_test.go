@@ -0,0 +1,135 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestCDCData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// cdcChunk splits data by appending it block by block, the same way
+// a sequential write of the data would.
+func cdcChunk(t *testing.T, bsplit *BlockSplitterCDC, data []byte) (
+	chunks [][]byte) {
+	for len(data) > 0 {
+		fblock := NewFileBlock().(*FileBlock)
+		n := bsplit.CopyUntilSplit(fblock, false, data, 0)
+		require.True(t, n > 0)
+		if n < int64(len(data)) {
+			require.Equal(t, int64(0), bsplit.CheckSplit(fblock))
+		}
+		chunks = append(chunks, fblock.Contents)
+		data = data[n:]
+	}
+	return chunks
+}
+
+func TestBsplitterCDCAppendStopsAtBoundary(t *testing.T) {
+	bsplit, err := newBlockSplitterCDC(64, 256, 1024, 10)
+	require.NoError(t, err)
+	data := makeTestCDCData(1, 4096)
+
+	fblock := NewFileBlock().(*FileBlock)
+	n := bsplit.CopyUntilSplit(fblock, false, data, 0)
+	require.True(t, n >= 64 && n <= 1024, "Bad block size %d", n)
+	require.Equal(t, data[:n], fblock.Contents)
+	require.Equal(t, n, bsplit.findSplit(data, 0))
+	require.Equal(t, int64(0), bsplit.CheckSplit(fblock))
+
+	// Appending to a block that already ends at a boundary
+	// shouldn't copy anything.
+	require.Equal(t, int64(0),
+		bsplit.CopyUntilSplit(fblock, false, data[n:], n))
+	require.Equal(t, data[:n], fblock.Contents)
+}
+
+func TestBsplitterCDCCheckSplit(t *testing.T) {
+	bsplit, err := newBlockSplitterCDC(64, 256, 1024, 10)
+	require.NoError(t, err)
+	data := makeTestCDCData(2, 4096)
+	boundary := bsplit.findSplit(data, 0)
+
+	// Too short to end at a boundary.
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = data[:10]
+	require.Equal(t, int64(-1), bsplit.CheckSplit(fblock))
+
+	// Ends exactly at a boundary.
+	fblock.Contents = data[:boundary]
+	require.Equal(t, int64(0), bsplit.CheckSplit(fblock))
+
+	// Goes past a boundary.
+	fblock.Contents = data
+	require.Equal(t, boundary, bsplit.CheckSplit(fblock))
+
+	// Runs of zeroes shouldn't look like boundaries.
+	fblock.Contents = make([]byte, 2048)
+	require.Equal(t, int64(1024), bsplit.CheckSplit(fblock))
+
+	// Too big, with no boundaries at all.
+	fblock.Contents = makeTestCDCData(5, 2048)
+	bsplit.mask = 0xffffffff
+	require.Equal(t, int64(1024), bsplit.CheckSplit(fblock))
+}
+
+func TestBsplitterCDCOverwriteCopiesAll(t *testing.T) {
+	bsplit, err := newBlockSplitterCDC(64, 256, 1024, 10)
+	require.NoError(t, err)
+	data := makeTestCDCData(3, 512)
+
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = make([]byte, 100)
+	if n := bsplit.CopyUntilSplit(fblock, false, data, 10); n != 512 {
+		t.Errorf("Did not copy expected number of bytes: %d", n)
+	} else if !bytes.Equal(fblock.Contents[10:], data) {
+		t.Errorf("Wrong file contents after copy: %v", fblock.Contents)
+	}
+}
+
+func TestBsplitterCDCInsertKeepsBoundaries(t *testing.T) {
+	bsplit, err := newBlockSplitterCDC(64, 256, 1024, 10)
+	require.NoError(t, err)
+	data := makeTestCDCData(4, 64*1024)
+	oldChunks := cdcChunk(t, bsplit, data)
+	newChunks := cdcChunk(t, bsplit, append([]byte{0xff}, data...))
+	require.Equal(t, append([]byte{0xff}, data...),
+		bytes.Join(newChunks, nil))
+
+	seen := make(map[string]bool)
+	for _, c := range oldChunks {
+		seen[string(c)] = true
+	}
+	shared := 0
+	for _, c := range newChunks {
+		if seen[string(c)] {
+			shared++
+		}
+	}
+	// Only the first block or two should differ.
+	require.True(t, shared >= len(oldChunks)-2,
+		"Only %d of %d chunks shared", shared, len(oldChunks))
+}
+
+func TestBsplitterCDCBadSizes(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	_, err := NewBlockSplitterCDC(10, 256, 1024, 10, codec)
+	require.Error(t, err)
+	_, err = NewBlockSplitterCDC(64, 0, 1024, 10, codec)
+	require.Error(t, err)
+	_, err = NewBlockSplitterCDC(2048, 4096, 1024, 10, codec)
+	require.Error(t, err)
+	_, err = NewBlockSplitterCDC(64, 256, 1024, 10, codec)
+	require.NoError(t, err)
+}
@@ -10,6 +10,11 @@ import (
 	"github.com/keybase/kbfs/kbfscodec"
 )
 
+// indirectFilePtrSizeEstimate is a generous estimate of the encoded
+// size of one IndirectFilePtr, used to decide how many of them fit
+// in an indirect file block.
+const indirectFilePtrSizeEstimate = 128
+
 // BlockSplitterSimple implements the BlockSplitter interface by using
 // a simple max-size algorithm to determine when to split blocks.
 type BlockSplitterSimple struct {
@@ -24,6 +29,21 @@ type BlockSplitterSimple struct {
 func NewBlockSplitterSimple(desiredBlockSize int64,
 	blockChangeEmbedMaxSize uint64, codec kbfscodec.Codec) (
 	*BlockSplitterSimple, error) {
+	maxSize, err := maxContentsSizeForBlockSize(desiredBlockSize, codec)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockSplitterSimple{
+		maxSize:                 maxSize,
+		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+	}, nil
+}
+
+// maxContentsSizeForBlockSize returns the number of bytes of file
+// contents that will make an encoded file block come out to the
+// desired block size.
+func maxContentsSizeForBlockSize(
+	desiredBlockSize int64, codec kbfscodec.Codec) (int64, error) {
 	// If the desired block size is exactly a power of 2, subtract one
 	// from it to account for the padding we will do, which rounds up
 	// when the encoded size is exactly a power of 2.
@@ -51,12 +71,12 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 		block.Contents = fullData[:maxSize]
 		encodedBlock, err := codec.Encode(block)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 
 		encodedLen = int64(len(encodedBlock))
 		if encodedLen >= 2*desiredBlockSize {
-			return nil, fmt.Errorf("Encoded block of %d bytes is more than "+
+			return 0, fmt.Errorf("Encoded block of %d bytes is more than "+
 				"twice as big as the desired block size %d",
 				encodedLen, desiredBlockSize)
 		}
@@ -69,38 +89,43 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 	}
 
 	if encodedLen != desiredBlockSize {
-		return nil, fmt.Errorf("Couldn't converge on a max block size for a "+
+		return 0, fmt.Errorf("Couldn't converge on a max block size for a "+
 			"desired size of %d", desiredBlockSize)
 	}
 
-	return &BlockSplitterSimple{
-		maxSize:                 maxSize,
-		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
-	}, nil
+	return maxSize, nil
 }
 
 // CopyUntilSplit implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) CopyUntilSplit(
 	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	// lastBlock is irrelevant since we only copy fixed sizes
+	return copyUpToMaxSize(block, data, off, b.maxSize)
+}
+
+// copyUpToMaxSize copies data into the block at the given offset,
+// growing the block as needed but never past maxSize.  It returns
+// how much was copied.
+func copyUpToMaxSize(
+	block *FileBlock, data []byte, off int64, maxSize int64) int64 {
 	n := int64(len(data))
 	currLen := int64(len(block.Contents))
-	// lastBlock is irrelevant since we only copy fixed sizes
 
 	toCopy := n
 	if currLen < (off + n) {
 		moreNeeded := (n + off) - currLen
 		// Reduce the number of additional bytes if it will take this block
 		// over maxSize.
-		if moreNeeded+currLen > b.maxSize {
-			moreNeeded = b.maxSize - currLen
+		if moreNeeded+currLen > maxSize {
+			moreNeeded = maxSize - currLen
 			if moreNeeded < 0 {
 				// If it is already over maxSize w/o any added bytes,
 				// just give up.
 				return 0
 			}
 			// only copy to the end of the block
-			toCopy = b.maxSize - off
+			toCopy = maxSize - off
 		}
 
 		if moreNeeded > 0 {
@@ -124,6 +149,23 @@ func (b *BlockSplitterSimple) CheckSplit(block *FileBlock) int64 {
 	return 0
 }
 
+// MaxPtrsPerBlock implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) MaxPtrsPerBlock() int {
+	return maxPtrsForMaxSize(b.maxSize)
+}
+
+// maxPtrsForMaxSize returns the number of indirect pointers that fit
+// in a block of maxSize bytes, but never fewer than 2 so that a tree
+// of indirect blocks can always grow.
+func maxPtrsForMaxSize(maxSize int64) int {
+	maxPtrs := int(maxSize / indirectFilePtrSizeEstimate)
+	if maxPtrs < 2 {
+		return 2
+	}
+	return maxPtrs
+}
+
 // ShouldEmbedBlockChanges implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) ShouldEmbedBlockChanges(
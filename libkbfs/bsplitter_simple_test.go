@@ -158,7 +158,7 @@ func TestBsplitterOverhead(t *testing.T) {
 		t.Fatalf("Encoding block failed: %v", err)
 	}
 	crypto := MakeCryptoCommon(codec)
-	paddedBlock, err := crypto.padBlock(encodedBlock)
+	paddedBlock, err := crypto.padBlock(encodedBlock, NoBlockCompression)
 	if err != nil {
 		t.Fatalf("Padding block failed: %v", err)
 	}
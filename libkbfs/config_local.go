@@ -20,15 +20,19 @@ import (
 )
 
 const (
-	// Max supported plaintext size of a file in KBFS.  TODO: increase
-	// this once we support multiple levels of indirection.
-	maxFileBytesDefault = 2 * 1024 * 1024 * 1024
+	// Max supported plaintext size of a file in KBFS.
+	maxFileBytesDefault = 1 << 40
 	// Max supported size of a directory entry name.
 	maxNameBytesDefault = 255
-	// Maximum supported plaintext size of a directory in KBFS. TODO:
-	// increase this once we support levels of indirection for
-	// directories.
-	maxDirBytesDefault = MaxBlockSizeBytesDefault
+	// Maximum supported plaintext size of a directory in KBFS.
+	// Only the changed blocks of a split directory are encoded and
+	// encrypted on each change, but the whole directory is still
+	// copied, so keep this to enough for tens of thousands of
+	// entries.
+	maxDirBytesDefault = 16 * MaxBlockSizeBytesDefault
+	// Maximum plaintext size of a single directory block, past
+	// which the directory is split into multiple blocks.
+	maxDirBlockBytesDefault = MaxBlockSizeBytesDefault
 	// Default time after setting the rekey bit before prompting for a
 	// paper key.
 	rekeyWithPromptWaitTimeDefault = 10 * time.Minute
@@ -55,6 +59,8 @@ type ConfigLocal struct {
 	kbcache     KeyBundleCache
 	bcache      BlockCache
 	dirtyBcache DirtyBlockCache
+	diskBcache  DiskBlockCache
+	merkleSrc   MerkleSource
 	codec       kbfscodec.Codec
 	mdops       MDOps
 	kops        KeyOps
@@ -70,6 +76,9 @@ type ConfigLocal struct {
 	clock       Clock
 	kbpki       KBPKI
 	renamer     ConflictRenamer
+	merger      ConflictFileMerger
+	bwLimiter   *BandwidthLimiter
+	tuning      TuningConfig
 	registry    metrics.Registry
 	loggerFn    func(prefix string) logger.Logger
 	noBGFlush   bool // logic opposite so the default value is the common setting
@@ -78,13 +87,20 @@ type ConfigLocal struct {
 	maxFileBytes uint64
 	maxNameBytes uint32
 	maxDirBytes  uint64
-	rekeyQueue   RekeyQueue
+	// maxDirBlockBytes is the size past which a directory block
+	// gets split.
+	maxDirBlockBytes uint64
+	rekeyQueue       RekeyQueue
 
 	qrPeriod                       time.Duration
 	qrUnrefAge                     time.Duration
 	qrMinHeadAge                   time.Duration
+	trashRetention                 time.Duration
+	conflictHoldTimeout            time.Duration
 	delayedCancellationGracePeriod time.Duration
 
+	blockCompression BlockCompressionType
+
 	// allKnownConfigsForTesting is used for testing, and contains all created
 	// Config objects in this test.
 	allKnownConfigsForTesting *[]Config
@@ -216,6 +232,7 @@ func NewConfigLocal() *ConfigLocal {
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
+	config.tuning = DefaultTuningConfig()
 	config.ResetCaches()
 	config.SetCodec(kbfscodec.NewMsgpack())
 	config.SetKeyOps(&KeyOpsStandard{config})
@@ -224,6 +241,7 @@ func NewConfigLocal() *ConfigLocal {
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxDirBlockBytes = maxDirBlockBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
 
 	config.delayedCancellationGracePeriod = delayedCancellationGracePeriodDefault
@@ -236,6 +254,8 @@ func NewConfigLocal() *ConfigLocal {
 		registry := metrics.NewRegistry()
 		config.SetMetricsRegistry(registry)
 	}
+	config.bwLimiter = NewBandwidthLimiter(
+		config.Clock(), config.MetricsRegistry())
 
 	config.tlfValidDuration = tlfValidDurationDefault
 	config.metadataVersion = defaultClientMetadataVer
@@ -355,6 +375,34 @@ func (c *ConfigLocal) SetDirtyBlockCache(d DirtyBlockCache) {
 	c.dirtyBcache = d
 }
 
+// DiskBlockCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskBlockCache() DiskBlockCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskBcache
+}
+
+// SetDiskBlockCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDiskBlockCache(d DiskBlockCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.diskBcache = d
+}
+
+// MerkleSource implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MerkleSource() MerkleSource {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merkleSrc
+}
+
+// SetMerkleSource implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMerkleSource(m MerkleSource) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.merkleSrc = m
+}
+
 // Crypto implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Crypto() Crypto {
 	c.lock.RLock()
@@ -552,6 +600,39 @@ func (c *ConfigLocal) SetConflictRenamer(cr ConflictRenamer) {
 	c.renamer = cr
 }
 
+// ConflictFileMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ConflictFileMerger() ConflictFileMerger {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merger
+}
+
+// SetConflictFileMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetConflictFileMerger(cfm ConflictFileMerger) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.merger = cfm
+}
+
+// BandwidthLimiter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BandwidthLimiter() *BandwidthLimiter {
+	return c.bwLimiter
+}
+
+// TuningConfig implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TuningConfig() TuningConfig {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tuning
+}
+
+// SetTuningConfig implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTuningConfig(tc TuningConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tuning = tc
+}
+
 // MetadataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetadataVersion() MetadataVer {
 	c.lock.RLock()
@@ -568,7 +649,7 @@ func (c *ConfigLocal) SetMetadataVersion(mdVer MetadataVer) {
 
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return FilesWithHolesDataVer
+	return CompressedBlocksDataVer
 }
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
@@ -616,6 +697,49 @@ func (c *ConfigLocal) QuotaReclamationMinHeadAge() time.Duration {
 	return c.qrMinHeadAge
 }
 
+// TrashRetention implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TrashRetention() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.trashRetention
+}
+
+// SetTrashRetention implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTrashRetention(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.trashRetention = d
+}
+
+// ConflictHoldTimeout implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ConflictHoldTimeout() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.conflictHoldTimeout
+}
+
+// SetConflictHoldTimeout implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetConflictHoldTimeout(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conflictHoldTimeout = d
+}
+
+// BlockCompression implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockCompression() BlockCompressionType {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.blockCompression
+}
+
+// SetBlockCompression implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockCompression(compression BlockCompressionType) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockCompression = compression
+}
+
 // ReqsBufSize implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) ReqsBufSize() int {
 	return 20
@@ -636,14 +760,20 @@ func (c *ConfigLocal) MaxDirBytes() uint64 {
 	return c.maxDirBytes
 }
 
+// MaxDirBlockBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxDirBlockBytes() uint64 {
+	return c.maxDirBlockBytes
+}
+
 func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.mdcache = NewMDCacheStandard(defaultMDCacheCapacity)
 	c.kcache = NewKeyCacheStandard(defaultMDCacheCapacity)
 	c.kbcache = NewKeyBundleCacheStandard(defaultMDCacheCapacity * 2)
-	// Limit the block cache to 10K entries or 1024 blocks (currently 512MiB)
-	c.bcache = NewBlockCacheStandard(10000, MaxBlockSizeBytesDefault*1024)
+	// Limit the block cache to 10K entries or 1024 blocks (512MiB
+	// with the default block size)
+	c.bcache = NewBlockCacheStandard(10000, uint64(c.tuning.MaxBlockSizeBytes*1024))
 	oldDirtyBcache := c.dirtyBcache
 
 	// TODO: we should probably fail or re-schedule this reset if
@@ -655,7 +785,7 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	// forced on us by the upper layer (19 seconds on OS X).  With the
 	// current default of a single block, this minimum works out to
 	// ~1MB, so we can support a connection speed as low as ~54 KB/s.
-	minSyncBufferSize := int64(MaxBlockSizeBytesDefault)
+	minSyncBufferSize := c.tuning.MaxBlockSizeBytes
 
 	// The maximum number of bytes we can try to sync at once (also
 	// limits the amount of memory used by dirty blocks).  We make it
@@ -664,15 +794,16 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	// finish.  This also limits the maxinim amount of memory used by
 	// the dirty block cache (to around 100MB with the current
 	// defaults).
-	maxSyncBufferSize :=
-		int64(MaxBlockSizeBytesDefault * maxParallelBlockPuts * 2)
+	maxSyncBufferSize := c.tuning.DirtyBytesThreshold * 2
 
 	// Start off conservatively to avoid getting immediate timeouts on
 	// slow connections.
 	startSyncBufferSize := minSyncBufferSize
 
-	c.dirtyBcache = NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
+	dirtyBcache := NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
 		minSyncBufferSize, maxSyncBufferSize, startSyncBufferSize)
+	dirtyBcache.backgroundTaskTimeout = c.tuning.BackgroundTaskTimeout
+	c.dirtyBcache = dirtyBcache
 	return oldDirtyBcache
 }
 
@@ -804,6 +935,9 @@ func (c *ConfigLocal) Shutdown() error {
 	if err != nil {
 		errors = append(errors, err)
 	}
+	if dbc := c.DiskBlockCache(); dbc != nil {
+		dbc.Shutdown()
+	}
 
 	if len(errors) == 1 {
 		return errors[0]
@@ -840,11 +974,12 @@ func (c *ConfigLocal) journalizeBcaches() error {
 	// server.  Since this doesn't rely directly on the network,
 	// there's no need for an adaptive sync buffer size, so we
 	// always set the min and max to the same thing.
-	maxSyncBufferSize :=
-		int64(MaxBlockSizeBytesDefault * maxParallelBlockPuts * 2)
+	tuning := c.TuningConfig()
+	maxSyncBufferSize := tuning.DirtyBytesThreshold * 2
 	journalCache := NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
 		maxSyncBufferSize, maxSyncBufferSize, maxSyncBufferSize)
 	journalCache.name = "journal"
+	journalCache.backgroundTaskTimeout = tuning.BackgroundTaskTimeout
 	c.SetDirtyBlockCache(jServer.dirtyBlockCache(journalCache))
 
 	jServer.delegateBlockCache = c.BlockCache()
@@ -854,9 +989,12 @@ func (c *ConfigLocal) journalizeBcaches() error {
 
 // EnableJournaling creates a JournalServer, but journaling may still
 // be enabled manually for individual folders, depending on whether
-// auto-enable is on.
+// auto-enable is on.  Block puts into the journals are slowed down,
+// and eventually fail, as the total number of unflushed bytes nears
+// diskLimitBytes; if that isn't positive, there is no limit.
 func (c *ConfigLocal) EnableJournaling(
-	journalRoot string, bws TLFJournalBackgroundWorkStatus) {
+	journalRoot string, bws TLFJournalBackgroundWorkStatus,
+	diskLimitBytes int64) {
 	jServer, err := GetJournalServer(c)
 	if err == nil {
 		// Journaling shouldn't be enabled twice for the same
@@ -870,9 +1008,11 @@ func (c *ConfigLocal) EnableJournaling(
 	log := c.MakeLogger("")
 	branchListener := c.KBFSOps().(branchChangeListener)
 	flushListener := c.KBFSOps().(mdFlushListener)
+	diskLimiter := makeJournalDiskLimiter(log, diskLimitBytes,
+		defaultJournalBackpressureMaxDelay)
 	jServer = makeJournalServer(c, log, journalRoot, c.BlockCache(),
 		c.DirtyBlockCache(), c.BlockServer(), c.MDOps(), branchListener,
-		flushListener)
+		flushListener, diskLimiter)
 	ctx := context.Background()
 	uid, key, err := getCurrentUIDAndVerifyingKey(ctx, c.KBPKI())
 	if err != nil {
@@ -55,6 +55,7 @@ type ConfigMock struct {
 	mockMdops       *MockMDOps
 	mockKops        *MockKeyOps
 	mockBops        *MockBlockOps
+	mockPrefetcher  *MockPrefetcher
 	mockMdserv      *MockMDServer
 	mockKserv       *MockKeyServer
 	mockBserv       *MockBlockServer
@@ -102,6 +103,13 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.SetKeyOps(config.mockKops)
 	config.mockBops = NewMockBlockOps(c)
 	config.SetBlockOps(config.mockBops)
+	config.mockPrefetcher = NewMockPrefetcher(c)
+	config.mockBops.EXPECT().Prefetcher().AnyTimes().
+		Return(config.mockPrefetcher)
+	config.mockPrefetcher.EXPECT().CancelTlfPrefetches(gomock.Any()).
+		AnyTimes().Return()
+	config.mockPrefetcher.EXPECT().PrefetchFileBlocks(
+		gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return()
 	config.mockMdserv = NewMockMDServer(c)
 	config.SetMDServer(config.mockMdserv)
 	config.mockKserv = NewMockKeyServer(c)
@@ -109,6 +117,8 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.mockBserv = NewMockBlockServer(c)
 	config.SetBlockServer(config.mockBserv)
 	config.mockBsplit = NewMockBlockSplitter(c)
+	config.mockBsplit.EXPECT().MaxPtrsPerBlock().AnyTimes().Return(
+		maxPtrsForMaxSize(MaxBlockSizeBytesDefault))
 	config.SetBlockSplitter(config.mockBsplit)
 	config.mockNotifier = NewMockNotifier(c)
 	config.SetNotifier(config.mockNotifier)
@@ -124,9 +134,11 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	// turn off background flushing by default during tests
 	config.noBGFlush = true
 
+	config.tuning = DefaultTuningConfig()
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxDirBlockBytes = maxDirBlockBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
 
 	config.qrPeriod = 0 * time.Second // no auto reclamation
@@ -0,0 +1,126 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+)
+
+// ConflictChoice says how conflict resolution should treat a file
+// that was changed both on this device and in the merged branch.
+type ConflictChoice int
+
+const (
+	// ConflictChoiceAuto lets the resolver decide: it merges the
+	// two versions if the configured ConflictFileMerger can, and
+	// otherwise keeps both.
+	ConflictChoiceAuto ConflictChoice = iota
+	// ConflictKeepMine replaces the merged version of the file with
+	// this device's version.
+	ConflictKeepMine
+	// ConflictKeepTheirs drops this device's changes to the file.
+	ConflictKeepTheirs
+	// ConflictKeepBoth renames this device's version of the file to
+	// a conflict name, without trying to merge it.
+	ConflictKeepBoth
+)
+
+func (c ConflictChoice) String() string {
+	switch c {
+	case ConflictChoiceAuto:
+		return "auto"
+	case ConflictKeepMine:
+		return "mine"
+	case ConflictKeepTheirs:
+		return "theirs"
+	case ConflictKeepBoth:
+		return "both"
+	default:
+		return "<invalid ConflictChoice>"
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// ConflictChoice.
+func (c ConflictChoice) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface for
+// ConflictChoice.
+func (c *ConflictChoice) UnmarshalText(text []byte) error {
+	choice, err := ParseConflictChoice(string(text))
+	if err != nil {
+		return err
+	}
+	*c = choice
+	return nil
+}
+
+// ParseConflictChoice returns the ConflictChoice with the given
+// name: "auto", "mine", "theirs" or "both".
+func ParseConflictChoice(s string) (ConflictChoice, error) {
+	for _, c := range []ConflictChoice{ConflictChoiceAuto,
+		ConflictKeepMine, ConflictKeepTheirs, ConflictKeepBoth} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return ConflictChoiceAuto, InvalidConflictChoiceError{s}
+}
+
+// UnmergedChange lists the operations made to one path on this
+// device's unmerged branch, along with those made to the same path
+// in the merged branch since the branches diverged.
+type UnmergedChange struct {
+	// Path is relative to the root of the TLF, and is empty for
+	// the root itself.
+	Path     string
+	Unmerged []string
+	Merged   []string `json:",omitempty"`
+	// Conflict is true if the path is a file that was written both
+	// on this device and in the merged branch, which is the only
+	// kind of change that can be given a Choice.
+	Conflict bool
+	Choice   ConflictChoice
+}
+
+// cleanConflictPath turns a user-supplied path into the form used
+// for UnmergedChange.Path.
+func cleanConflictPath(p string) string {
+	return strings.Trim(p, "/")
+}
+
+// tlfRelativePath returns the path of p's tail, relative to the root
+// of the TLF, in the form used for UnmergedChange.Path.
+func tlfRelativePath(p path) string {
+	if len(p.path) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(p.path)-1)
+	for _, pn := range p.path[1:] {
+		names = append(names, pn.Name)
+	}
+	return strings.Join(names, "/")
+}
+
+// unmergedChangesByPath implements sort.Interface to sort
+// UnmergedChanges by their paths.
+type unmergedChangesByPath []UnmergedChange
+
+// Len implements sort.Interface for unmergedChangesByPath
+func (u unmergedChangesByPath) Len() int {
+	return len(u)
+}
+
+// Less implements sort.Interface for unmergedChangesByPath
+func (u unmergedChangesByPath) Less(i, j int) bool {
+	return u[i].Path < u[j].Path
+}
+
+// Swap implements sort.Interface for unmergedChangesByPath
+func (u unmergedChangesByPath) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultConflictFileMergeMaxSize is the default size of the largest
+// file that LineConflictFileMerger will try to merge.
+const DefaultConflictFileMergeMaxSize = 64 * 1024
+
+// maxLineDiffEdits bounds the work done diffing two versions of a
+// file.  Versions that differ by more lines than this aren't merged.
+const maxLineDiffEdits = 1000
+
+// LineConflictFileMerger does a line-based three-way merge of text
+// files that were written in both branches of a conflict.  Binary
+// files, and files bigger than MaxSize, are left to be renamed.
+type LineConflictFileMerger struct {
+	MaxSize uint64
+}
+
+var _ ConflictFileMerger = LineConflictFileMerger{}
+
+// ShouldMerge implements the ConflictFileMerger interface for
+// LineConflictFileMerger.
+func (lcfm LineConflictFileMerger) ShouldMerge(
+	name string, size uint64) bool {
+	return size <= lcfm.MaxSize
+}
+
+// isMergeableText returns true if data looks like text: valid UTF-8
+// with no NUL bytes.
+func isMergeableText(data []byte) bool {
+	return bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
+
+// MergeFile implements the ConflictFileMerger interface for
+// LineConflictFileMerger.
+func (lcfm LineConflictFileMerger) MergeFile(ctx context.Context,
+	name string, base, unmerged, merged []byte) ([]byte, bool) {
+	for _, data := range [][]byte{base, unmerged, merged} {
+		if uint64(len(data)) > lcfm.MaxSize || !isMergeableText(data) {
+			return nil, false
+		}
+	}
+
+	lines, ok := mergeLines(
+		splitLines(base), splitLines(unmerged), splitLines(merged))
+	if !ok {
+		return nil, false
+	}
+	return bytes.Join(lines, nil), true
+}
+
+// splitLines splits data into lines, each keeping its trailing
+// newline.  The last line has no newline if data doesn't end in one.
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, data)
+			break
+		}
+		lines = append(lines, data[:i+1])
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// diffLines finds a longest common subsequence of the lines in a and
+// b, using Myers' algorithm.  It returns, for each line of a, the
+// index of the matching line of b, or -1 if the line isn't in the
+// subsequence.  It returns false if the two differ by more than
+// maxLineDiffEdits lines.
+func diffLines(a, b [][]byte) ([]int, bool) {
+	n, m := len(a), len(b)
+	maxEdits := n + m
+	if maxEdits > maxLineDiffEdits {
+		maxEdits = maxLineDiffEdits
+	}
+	offset := maxEdits + 1
+	v := make([]int, 2*maxEdits+3)
+	// trace[d] is a copy of v after d edits, used to backtrack.
+	var trace [][]int
+	found := false
+	for d := 0; d <= maxEdits && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v...))
+	}
+	if !found {
+		return nil, false
+	}
+
+	matches := make([]int, n)
+	for i := range matches {
+		matches[i] = -1
+	}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		var prevK int
+		if d == 0 {
+			prevK = 0
+		} else if k == -d || (k != d &&
+			trace[d-1][offset+k-1] < trace[d-1][offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = trace[d-1][offset+prevK]
+		}
+		prevY := prevX - prevK
+		// Walk back along the diagonal: these lines match.
+		for x > prevX && y > prevY {
+			x--
+			y--
+			matches[x] = y
+		}
+		x, y = prevX, prevY
+	}
+	return matches, true
+}
+
+func linesEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeLines does a three-way merge of two descendants of base, a and
+// b, in the style of diff3.  Lines of base that are unchanged in both
+// a and b divide the files into chunks; a chunk that was only changed
+// on one side takes that side's lines, and a chunk that was changed
+// differently on both sides is a conflict, in which case mergeLines
+// returns false.
+func mergeLines(base, a, b [][]byte) ([][]byte, bool) {
+	matchA, ok := diffLines(base, a)
+	if !ok {
+		return nil, false
+	}
+	matchB, ok := diffLines(base, b)
+	if !ok {
+		return nil, false
+	}
+
+	var result [][]byte
+	o, i, j := 0, 0, 0
+	for {
+		// Copy the lines that are unchanged on both sides.
+		for o < len(base) && matchA[o] == i && matchB[o] == j {
+			result = append(result, base[o])
+			o++
+			i++
+			j++
+		}
+
+		// Find the end of the next unstable chunk, which is the
+		// next base line that is still in both a and b.
+		endO, endI, endJ := len(base), len(a), len(b)
+		for next := o; next < len(base); next++ {
+			if matchA[next] >= 0 && matchB[next] >= 0 {
+				endO, endI, endJ = next, matchA[next], matchB[next]
+				break
+			}
+		}
+		if o == endO && i == endI && j == endJ {
+			break
+		}
+
+		chunkO, chunkA, chunkB := base[o:endO], a[i:endI], b[j:endJ]
+		switch {
+		case linesEqual(chunkA, chunkO):
+			result = append(result, chunkB...)
+		case linesEqual(chunkB, chunkO), linesEqual(chunkA, chunkB):
+			result = append(result, chunkA...)
+		default:
+			return nil, false
+		}
+		o, i, j = endO, endI, endJ
+	}
+	return result, true
+}
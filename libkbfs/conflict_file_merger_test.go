@@ -0,0 +1,86 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func testMergeFile(base, unmerged, merged string) (
+	string, bool) {
+	lcfm := LineConflictFileMerger{MaxSize: DefaultConflictFileMergeMaxSize}
+	result, ok := lcfm.MergeFile(context.Background(), "file",
+		[]byte(base), []byte(unmerged), []byte(merged))
+	return string(result), ok
+}
+
+func TestLineConflictFileMergerClean(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	for _, tc := range []struct {
+		unmerged, merged, expected string
+	}{
+		// Changes to different lines.
+		{"A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n"},
+		// Insertions and deletions.
+		{"a\nb\nx\nc\nd\ne\n", "a\nb\nc\ne\n", "a\nb\nx\nc\ne\n"},
+		// Both sides make the same change.
+		{"a\nB\nc\nd\ne\n", "a\nB\nc\nd\nE\n", "a\nB\nc\nd\nE\n"},
+		// Additions at both ends, and a missing final newline.
+		{"0\na\nb\nc\nd\ne\n", "a\nb\nc\nd\ne\nf", "0\na\nb\nc\nd\ne\nf"},
+		// Only one side changed.
+		{base, "", ""},
+	} {
+		result, ok := testMergeFile(base, tc.unmerged, tc.merged)
+		require.True(t, ok, "unmerged=%q merged=%q", tc.unmerged, tc.merged)
+		require.Equal(t, tc.expected, result)
+
+		// The merge is symmetric.
+		result, ok = testMergeFile(base, tc.merged, tc.unmerged)
+		require.True(t, ok)
+		require.Equal(t, tc.expected, result)
+	}
+}
+
+func TestLineConflictFileMergerConflict(t *testing.T) {
+	base := "a\nb\nc\n"
+	for _, tc := range []struct {
+		unmerged, merged string
+	}{
+		// Different changes to the same line.
+		{"a\nB\nc\n", "a\nX\nc\n"},
+		// Different insertions in the same place.
+		{"a\nx\nb\nc\n", "a\ny\nb\nc\n"},
+		// A deletion and a change of the same line.
+		{"a\nc\n", "a\nB\nc\n"},
+	} {
+		_, ok := testMergeFile(base, tc.unmerged, tc.merged)
+		require.False(t, ok, "unmerged=%q merged=%q", tc.unmerged, tc.merged)
+	}
+}
+
+func TestLineConflictFileMergerNotText(t *testing.T) {
+	_, ok := testMergeFile("a\x00\nb\n", "A\x00\nb\n", "a\x00\nB\n")
+	require.False(t, ok)
+	_, ok = testMergeFile("a\n\xff\n", "A\n\xff\n", "a\n\xfe\n")
+	require.False(t, ok)
+
+	lcfm := LineConflictFileMerger{MaxSize: 4}
+	require.True(t, lcfm.ShouldMerge("file", 4))
+	require.False(t, lcfm.ShouldMerge("file", 5))
+	_, ok = lcfm.MergeFile(context.Background(), "file",
+		[]byte("a\n"), []byte("a\nb\n"), []byte("c\na\nd\n"))
+	require.False(t, ok)
+}
+
+func TestLineConflictFileMergerTooManyEdits(t *testing.T) {
+	base := strings.Repeat("a\n", maxLineDiffEdits)
+	unmerged := strings.Repeat("b\n", maxLineDiffEdits)
+	_, ok := testMergeFile(base, unmerged, base)
+	require.False(t, ok)
+}
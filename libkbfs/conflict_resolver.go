@@ -66,6 +66,13 @@ type ConflictResolver struct {
 	inputLock    sync.Mutex
 	currInput    conflictInput
 	lockNextTime bool
+	// choices holds the user's choices for how to resolve conflicts
+	// in particular files, keyed by their path relative to the TLF
+	// root.  It's cleared after each successful resolution.
+	choices map[string]ConflictChoice
+	// holdStart is when resolution of the current unmerged branch
+	// was first held back to wait for choices, if it has been.
+	holdStart time.Time
 }
 
 // NewConflictResolver constructs a new ConflictResolver (and launches
@@ -235,6 +242,106 @@ func (cr *ConflictResolver) BeginNewBranch() {
 	cr.currInput = conflictInput{}
 }
 
+// setConflictChoice sets the choice for how to resolve a conflict in
+// the file with the given path, relative to the TLF root, for the
+// next resolution.
+func (cr *ConflictResolver) setConflictChoice(
+	p string, choice ConflictChoice) {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	if choice == ConflictChoiceAuto {
+		delete(cr.choices, p)
+		return
+	}
+	if cr.choices == nil {
+		cr.choices = make(map[string]ConflictChoice)
+	}
+	cr.choices[p] = choice
+}
+
+func (cr *ConflictResolver) getConflictChoice(p string) ConflictChoice {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	return cr.choices[p]
+}
+
+// clearConflictChoices forgets all the choices set by
+// setConflictChoice.
+func (cr *ConflictResolver) clearConflictChoices() {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	cr.choices = nil
+	cr.holdStart = time.Time{}
+}
+
+// waitForConflictChoices blocks while some file has conflicting
+// writes in both branches (see isWriteConflict) but no conflict
+// choice, until the configured ConflictHoldTimeout has passed since
+// the first resolution of this unmerged branch was held back.  It
+// doesn't block at all if there are no such conflicts.  Since
+// setting a choice restarts resolution, which cancels ctx, it
+// returns ctx.Err() in that case, and the next resolution checks
+// the remaining conflicts again.
+func (cr *ConflictResolver) waitForConflictChoices(
+	ctx context.Context) error {
+	timeout := cr.config.ConflictHoldTimeout()
+	if timeout <= 0 {
+		return nil
+	}
+
+	changes, err := cr.fbo.getUnmergedChanges(ctx, makeFBOLockState())
+	if err != nil {
+		// Let the resolution itself deal with the error.
+		cr.log.CDebugf(ctx, "Couldn't get the unmerged changes; "+
+			"not holding the unmerged branch: %v", err)
+		return nil
+	}
+	var conflicts []string
+	for _, change := range changes {
+		if change.Conflict {
+			conflicts = append(conflicts, change.Path)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	var missing []string
+	wait := func() time.Duration {
+		cr.inputLock.Lock()
+		defer cr.inputLock.Unlock()
+		for _, p := range conflicts {
+			if _, ok := cr.choices[p]; !ok {
+				missing = append(missing, p)
+			}
+		}
+		if len(missing) == 0 {
+			return 0
+		}
+		now := cr.config.Clock().Now()
+		if cr.holdStart.IsZero() {
+			cr.holdStart = now
+		}
+		return cr.holdStart.Add(timeout).Sub(now)
+	}()
+	if wait <= 0 {
+		return nil
+	}
+
+	cr.log.CDebugf(ctx, "Holding the unmerged branch for up to %s, "+
+		"until conflict choices are set for %v", wait, missing)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		cr.log.CDebugf(ctx, "No conflict choices were set for %v; "+
+			"resolving anyway", missing)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (cr *ConflictResolver) checkDone(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
@@ -582,8 +689,14 @@ func (cr *ConflictResolver) addChildBlocksIfIndirectFile(ctx context.Context,
 	if fblock.IsInd {
 		cr.log.CDebugf(ctx, "Adding child pointers for recreated "+
 			"file %s", currPath)
-		for _, ptr := range fblock.IPtrs {
-			op.AddRefBlock(ptr.BlockPointer)
+		infos, err := cr.fbo.blocks.GetIndirectFileBlockInfosWithTopBlock(
+			ctx, lState, unmergedChains.mostRecentChainMDInfo.kmd,
+			currPath, fblock)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			op.AddRefBlock(info.BlockPointer)
 		}
 	}
 	return nil
@@ -1871,8 +1984,9 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 
 		fileActions := actionMap[p.tailPointer()]
 
-		// If this is a directory with setAttr(mtime)-related actions,
-		// just those action should be collapsed into the parent.
+		// If this is a directory with setAttr(mtime or xattr)-related
+		// actions, just those action should be collapsed into the
+		// parent.
 		if !chain.isFile() {
 			var parentActions crActionList
 			var otherDirActions crActionList
@@ -1880,13 +1994,15 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 				moved := false
 				switch realAction := action.(type) {
 				case *copyUnmergedAttrAction:
-					if realAction.attr[0] == mtimeAttr && !realAction.moved {
+					if (realAction.attr[0] == mtimeAttr ||
+						realAction.attr[0] == xattrAttr) && !realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
 						moved = true
 					}
 				case *renameUnmergedAction:
-					if realAction.causedByAttr == mtimeAttr &&
+					if (realAction.causedByAttr == mtimeAttr ||
+						realAction.causedByAttr == xattrAttr) &&
 						!realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
@@ -2028,13 +2144,85 @@ func (cr *ConflictResolver) fetchDirBlockCopy(ctx context.Context,
 }
 
 // fileBlockMap maps latest merged block pointer to a map of final
-// merged name -> file block.
+// merged name -> file block.  Copies of file blocks below the top
+// level are stored under their own temporary pointers, with an empty
+// name.
 type fileBlockMap map[BlockPointer]map[string]*FileBlock
 
+// dupIndirectFileBlockChildren gives every pointer under the given
+// copied indirect file block a new reference, and copies any indirect
+// child blocks under new temporary pointers (storing the copies in
+// blocks), since each copy of a file needs its own references.  Leaf
+// blocks unreferenced by otherChains (if non-nil) are copied too,
+// since the other branch may have archived them already, and
+// archived blocks can't get new references.
+func (cr *ConflictResolver) dupIndirectFileBlockChildren(
+	ctx context.Context, lState *lockState, chains, otherChains *crChains,
+	file path, fblock *FileBlock, uid keybase1.UID, newlyCreated bool,
+	blocks fileBlockMap) error {
+	kmd := chains.mostRecentChainMDInfo.kmd
+	for i, iptr := range fblock.IPtrs {
+		if newlyCreated {
+			chains.toUnrefPointers[iptr.BlockPointer] = true
+		}
+
+		var child *FileBlock
+		if iptr.pointsToIndirectBlock() ||
+			(otherChains != nil && otherChains.isDeleted(iptr.BlockPointer)) {
+			var err error
+			child, err = cr.fbo.blocks.GetFileBlockForReading(
+				ctx, lState, kmd, iptr.BlockPointer, file.Branch, file)
+			if err != nil {
+				return err
+			}
+		}
+		if child != nil {
+			child, err := child.DeepCopy(cr.config.Codec())
+			if err != nil {
+				return err
+			}
+			if child.IsInd {
+				err = cr.dupIndirectFileBlockChildren(ctx, lState, chains,
+					otherChains, file, child, uid, newlyCreated, blocks)
+				if err != nil {
+					return err
+				}
+			}
+			newID, err := cr.config.Crypto().MakeTemporaryBlockID()
+			if err != nil {
+				return err
+			}
+			iptr.BlockInfo = BlockInfo{
+				BlockPointer: BlockPointer{
+					ID:      newID,
+					KeyGen:  kmd.LatestKeyGeneration(),
+					DataVer: DefaultNewBlockDataVersion(cr.config, false),
+					BlockContext: BlockContext{
+						Creator:  uid,
+						RefNonce: ZeroBlockRefNonce,
+					},
+				},
+			}
+			blocks[iptr.BlockPointer] = map[string]*FileBlock{"": child}
+		} else {
+			// Generate a new nonce for each one.
+			var err error
+			iptr.RefNonce, err = cr.config.Crypto().MakeBlockRefNonce()
+			if err != nil {
+				return err
+			}
+			iptr.SetWriter(uid)
+		}
+		fblock.IPtrs[i] = iptr
+		chains.createdOriginals[iptr.BlockPointer] = true
+	}
+	return nil
+}
+
 func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
-	lState *lockState, chains *crChains, mergedMostRecent BlockPointer, parentPath path,
-	name string, ptr BlockPointer, blocks fileBlockMap) (
-	BlockPointer, error) {
+	lState *lockState, chains, otherChains *crChains,
+	mergedMostRecent BlockPointer, parentPath path, name string,
+	ptr BlockPointer, blocks fileBlockMap) (BlockPointer, error) {
 	kmd := chains.mostRecentChainMDInfo.kmd
 	fblock, err := cr.fbo.blocks.GetFileBlockForReading(
 		ctx, lState, kmd, ptr, parentPath.Branch,
@@ -2092,27 +2280,439 @@ func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
 		blocks[mergedMostRecent] = make(map[string]*FileBlock)
 	}
 
-	// Dup all of the leaf blocks.
-	// TODO: deal with multiple levels of indirection.
+	// Dup all of the child blocks.
 	if fblock.IsInd {
-		for i, iptr := range fblock.IPtrs {
-			if newlyCreated {
-				chains.toUnrefPointers[iptr.BlockPointer] = true
+		err = cr.dupIndirectFileBlockChildren(ctx, lState, chains,
+			otherChains, parentPath.ChildPath(name, ptr), fblock, uid,
+			newlyCreated, blocks)
+		if err != nil {
+			return BlockPointer{}, err
+		}
+	}
+
+	blocks[mergedMostRecent][name] = fblock
+	return newPtr, nil
+}
+
+// copyUnmergedFileBlockChildren fixes up the children of the given
+// copied indirect block of the unmerged version of a file, so that
+// the copy can replace the merged version.  Blocks the unmerged
+// branch made for the file are kept as they are, along with their
+// references.  Leaf blocks from before the branches diverged get new
+// references, unless the merged branch unreferenced them, in which
+// case they are copied.  Indirect blocks with any changed children
+// are copied under new temporary pointers (storing the copies in
+// blocks).  It returns whether any child pointer changed, and the
+// pointers of blocks made by the unmerged branch that were replaced
+// by copies.
+func (cr *ConflictResolver) copyUnmergedFileBlockChildren(
+	ctx context.Context, lState *lockState,
+	unmergedChains, mergedChains *crChains, file path, fblock *FileBlock,
+	uid keybase1.UID, blocks fileBlockMap) (
+	changed bool, dropped []BlockPointer, err error) {
+	kmd := unmergedChains.mostRecentChainMDInfo.kmd
+	for i, iptr := range fblock.IPtrs {
+		created := unmergedChains.isCreated(iptr.BlockPointer)
+		var child *FileBlock
+		if iptr.pointsToIndirectBlock() ||
+			(!created && mergedChains.isDeleted(iptr.BlockPointer)) {
+			child, err = cr.fbo.blocks.GetFileBlockForReading(
+				ctx, lState, kmd, iptr.BlockPointer, file.Branch, file)
+			if err != nil {
+				return false, nil, err
+			}
+			child, err = child.DeepCopy(cr.config.Codec())
+			if err != nil {
+				return false, nil, err
 			}
+		}
 
-			// Generate a new nonce for each one.
+		switch {
+		case child != nil:
+			if child.IsInd {
+				childChanged, childDropped, err :=
+					cr.copyUnmergedFileBlockChildren(ctx, lState,
+						unmergedChains, mergedChains, file, child, uid,
+						blocks)
+				if err != nil {
+					return false, nil, err
+				}
+				dropped = append(dropped, childDropped...)
+				if created && !childChanged {
+					unmergedChains.keptPointers[iptr.BlockPointer] = true
+					continue
+				}
+			}
+			if created {
+				dropped = append(dropped, iptr.BlockPointer)
+			}
+			newID, err := cr.config.Crypto().MakeTemporaryBlockID()
+			if err != nil {
+				return false, nil, err
+			}
+			iptr.BlockInfo = BlockInfo{
+				BlockPointer: BlockPointer{
+					ID:      newID,
+					KeyGen:  kmd.LatestKeyGeneration(),
+					DataVer: DefaultNewBlockDataVersion(cr.config, false),
+					BlockContext: BlockContext{
+						Creator:  uid,
+						RefNonce: ZeroBlockRefNonce,
+					},
+				},
+			}
+			blocks[iptr.BlockPointer] = map[string]*FileBlock{"": child}
+		case created:
+			unmergedChains.keptPointers[iptr.BlockPointer] = true
+			continue
+		default:
 			iptr.RefNonce, err = cr.config.Crypto().MakeBlockRefNonce()
 			if err != nil {
-				return BlockPointer{}, err
+				return false, nil, err
 			}
 			iptr.SetWriter(uid)
-			fblock.IPtrs[i] = iptr
-			chains.createdOriginals[iptr.BlockPointer] = true
 		}
+		fblock.IPtrs[i] = iptr
+		unmergedChains.createdOriginals[iptr.BlockPointer] = true
+		changed = true
 	}
+	return changed, dropped, nil
+}
 
+// makeUnmergedFileBlockCopy copies the top block of the unmerged
+// version of the named file into blocks, under mergedMostRecent, so
+// that it replaces the merged version when synced.  See
+// copyUnmergedFileBlockChildren for how the blocks under it are
+// handled.  It returns the pointers of blocks made by the unmerged
+// branch that were replaced by copies.
+func (cr *ConflictResolver) makeUnmergedFileBlockCopy(ctx context.Context,
+	lState *lockState, unmergedChains, mergedChains *crChains,
+	mergedMostRecent BlockPointer, unmergedPath path, name string,
+	ptr BlockPointer, blocks fileBlockMap) ([]BlockPointer, error) {
+	kmd := unmergedChains.mostRecentChainMDInfo.kmd
+	file := unmergedPath.ChildPath(name, ptr)
+	fblock, err := cr.fbo.blocks.GetFileBlockForReading(
+		ctx, lState, kmd, ptr, unmergedPath.Branch, file)
+	if err != nil {
+		return nil, err
+	}
+	fblock, err = fblock.DeepCopy(cr.config.Codec())
+	if err != nil {
+		return nil, err
+	}
+
+	var dropped []BlockPointer
+	if fblock.IsInd {
+		_, uid, err := cr.config.KBPKI().GetCurrentUserInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, dropped, err = cr.copyUnmergedFileBlockChildren(ctx, lState,
+			unmergedChains, mergedChains, file, fblock, uid, blocks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ptr := range dropped {
+		unmergedChains.toUnrefPointers[ptr] = true
+	}
+
+	if _, ok := blocks[mergedMostRecent]; !ok {
+		blocks[mergedMostRecent] = make(map[string]*FileBlock)
+	}
 	blocks[mergedMostRecent][name] = fblock
-	return newPtr, nil
+	return dropped, nil
+}
+
+// getFileContentsForMerge returns the contents of the given file, or
+// false if the file is too big to be stored in a single block.
+func (cr *ConflictResolver) getFileContentsForMerge(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, parentPath path, name string,
+	ptr BlockPointer) ([]byte, bool, error) {
+	fblock, err := cr.fbo.blocks.GetFileBlockForReading(
+		ctx, lState, kmd, ptr, parentPath.Branch,
+		parentPath.ChildPath(name, ptr))
+	if err != nil {
+		return nil, false, err
+	}
+	if fblock.IsInd {
+		return nil, false, nil
+	}
+	return fblock.Contents, true, nil
+}
+
+// conflictingFile returns the entries for the file with the given
+// name, which was written in both branches, if it's the kind of
+// conflict that can be resolved by choosing between or merging the
+// two versions: the file existed before the branches diverged, its
+// contents changed in both branches, and it had nothing but writes
+// in the unmerged branch.  Otherwise it returns false.
+func conflictingFile(unmergedChains, mergedChains *crChains,
+	unmergedBlock, mergedBlock *DirBlock, name string) (
+	unmergedEntry, mergedEntry DirEntry, unmergedChain *crChain, ok bool) {
+	unmergedEntry, ok = unmergedBlock.Children[name]
+	if !ok {
+		return DirEntry{}, DirEntry{}, nil, false
+	}
+	mergedEntry, ok = mergedBlock.Children[name]
+	if !ok {
+		return DirEntry{}, DirEntry{}, nil, false
+	}
+	if (mergedEntry.Type != File && mergedEntry.Type != Exec) ||
+		unmergedEntry.Type != mergedEntry.Type {
+		return DirEntry{}, DirEntry{}, nil, false
+	}
+
+	unmergedChain, ok = unmergedChains.byMostRecent[unmergedEntry.BlockPointer]
+	if !ok || !isWriteConflict(unmergedChains, mergedChains, unmergedChain) {
+		return DirEntry{}, DirEntry{}, nil, false
+	}
+	mergedChain := mergedChains.byOriginal[unmergedChain.original]
+	if mergedChain.mostRecent != mergedEntry.BlockPointer {
+		return DirEntry{}, DirEntry{}, nil, false
+	}
+	return unmergedEntry, mergedEntry, unmergedChain, true
+}
+
+// isWriteConflict returns true if the given unmerged chain is for a
+// file that existed before the branches diverged, had nothing but
+// writes in the unmerged branch, and was also written in the merged
+// branch.
+func isWriteConflict(unmergedChains, mergedChains *crChains,
+	unmergedChain *crChain) bool {
+	if mergedChains == nil || !unmergedChain.isFile() ||
+		unmergedChains.isCreated(unmergedChain.original) {
+		return false
+	}
+	for _, op := range unmergedChain.ops {
+		if _, ok := op.(*syncOp); !ok {
+			return false
+		}
+	}
+	mergedChain, ok := mergedChains.byOriginal[unmergedChain.original]
+	if !ok {
+		return false
+	}
+	for _, op := range mergedChain.ops {
+		if _, ok := op.(*syncOp); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceMergedFile puts a block with the given contents into
+// newFileBlocks, and returns the action that replaces the merged
+// version of the named file with it.  It returns nil if the contents
+// don't fit in a single block.
+func (cr *ConflictResolver) replaceMergedFile(ctx context.Context,
+	mergedPath path, unmergedEntry, mergedEntry DirEntry, name string,
+	contents []byte, mtime int64,
+	newFileBlocks fileBlockMap) *mergeUnmergedFileAction {
+	fblock := NewFileBlock().(*FileBlock)
+	copied := cr.config.BlockSplitter().CopyUntilSplit(
+		fblock, true, contents, 0)
+	if copied < int64(len(contents)) {
+		cr.log.CDebugf(ctx, "New contents of %s are too big for one "+
+			"block (%d bytes)", name, len(contents))
+		return nil
+	}
+
+	mergedMostRecent := mergedPath.tailPointer()
+	if _, ok := newFileBlocks[mergedMostRecent]; !ok {
+		newFileBlocks[mergedMostRecent] = make(map[string]*FileBlock)
+	}
+	newFileBlocks[mergedMostRecent][name] = fblock
+	return &mergeUnmergedFileAction{
+		name:         name,
+		unmergedFile: unmergedEntry.BlockPointer,
+		mergedFile:   mergedEntry.BlockPointer,
+		unmergedSize: unmergedEntry.Size,
+		mergedSize:   mergedEntry.Size,
+		newSize:      uint64(len(contents)),
+		mtime:        mtime,
+	}
+}
+
+// mergeConflictingFile tries to merge the contents of the file with
+// the given name, which was written in both branches.  If the merge
+// is clean, it puts a block with the merged contents into
+// newFileBlocks and returns the action that replaces the merged file
+// with it.  Otherwise it returns nil.
+func (cr *ConflictResolver) mergeConflictingFile(ctx context.Context,
+	lState *lockState, merger ConflictFileMerger,
+	unmergedChains, mergedChains *crChains, mergedPath path,
+	unmergedEntry, mergedEntry DirEntry, unmergedChain *crChain,
+	name string, newFileBlocks fileBlockMap) (
+	*mergeUnmergedFileAction, error) {
+	if !merger.ShouldMerge(name, unmergedEntry.Size) ||
+		!merger.ShouldMerge(name, mergedEntry.Size) {
+		return nil, nil
+	}
+
+	unmergedData, ok, err := cr.getFileContentsForMerge(ctx, lState,
+		unmergedChains.mostRecentChainMDInfo.kmd, mergedPath, name,
+		unmergedEntry.BlockPointer)
+	if err != nil || !ok {
+		return nil, err
+	}
+	kmd := mergedChains.mostRecentChainMDInfo.kmd
+	mergedData, ok, err := cr.getFileContentsForMerge(
+		ctx, lState, kmd, mergedPath, name, mergedEntry.BlockPointer)
+	if err != nil || !ok {
+		return nil, err
+	}
+	baseData, ok, err := cr.getFileContentsForMerge(
+		ctx, lState, kmd, mergedPath, name, unmergedChain.original)
+	if err != nil {
+		// The common ancestor may have been garbage-collected
+		// already; fall back to renaming.
+		cr.log.CDebugf(ctx, "Couldn't get the common ancestor of %s "+
+			"(%v): %v", name, unmergedChain.original, err)
+		return nil, nil
+	} else if !ok {
+		return nil, nil
+	}
+
+	contents, ok := merger.MergeFile(
+		ctx, name, baseData, unmergedData, mergedData)
+	if !ok {
+		cr.log.CDebugf(ctx, "Couldn't merge the writes to %s", name)
+		return nil, nil
+	}
+
+	mufa := cr.replaceMergedFile(ctx, mergedPath, unmergedEntry,
+		mergedEntry, name, contents, cr.config.Clock().Now().UnixNano(),
+		newFileBlocks)
+	if mufa != nil {
+		cr.log.CDebugf(ctx, "Merged the writes to %s (%d bytes)",
+			name, len(contents))
+	}
+	return mufa, nil
+}
+
+// resolveConflictingFile returns the actions that should replace
+// the renameUnmergedAction for the file with the given name, which
+// was written in both branches, according to the given choice.  It
+// returns nil if the action should be kept, i.e. both versions of
+// the file should be kept.
+func (cr *ConflictResolver) resolveConflictingFile(ctx context.Context,
+	lState *lockState, choice ConflictChoice,
+	unmergedChains, mergedChains *crChains, unmergedPath, mergedPath path,
+	unmergedBlock, mergedBlock *DirBlock, name string,
+	newFileBlocks fileBlockMap) (crActionList, error) {
+	unmergedEntry, mergedEntry, unmergedChain, ok := conflictingFile(
+		unmergedChains, mergedChains, unmergedBlock, mergedBlock, name)
+	if !ok {
+		if choice != ConflictChoiceAuto {
+			// SetConflictChoice only accepts choices for files
+			// written in both branches, but the merged branch
+			// may have moved on since.
+			cr.log.CWarningf(ctx, "Can't apply choice %s to %s, "+
+				"since it's no longer a conflict between writes; "+
+				"keeping both", choice, name)
+		}
+		return nil, nil
+	}
+
+	var mufa *mergeUnmergedFileAction
+	switch choice {
+	case ConflictKeepBoth:
+		return nil, nil
+	case ConflictKeepTheirs:
+		cr.log.CDebugf(ctx, "Dropping the unmerged writes to %s", name)
+		actions := make(crActionList, 0, len(unmergedChain.ops))
+		for _, op := range unmergedChain.ops {
+			actions = append(actions, &dropUnmergedAction{op})
+		}
+		return actions, nil
+	case ConflictKeepMine:
+		dropped, err := cr.makeUnmergedFileBlockCopy(ctx, lState,
+			unmergedChains, mergedChains, mergedPath.tailPointer(),
+			unmergedPath, name, unmergedEntry.BlockPointer, newFileBlocks)
+		if err != nil {
+			return nil, err
+		}
+		// The merged version's child blocks are no longer
+		// referenced once it's replaced.
+		mergedInfos, err := cr.fbo.blocks.GetIndirectFileBlockInfos(ctx,
+			lState, mergedChains.mostRecentChainMDInfo.kmd,
+			mergedPath.ChildPath(name, mergedEntry.BlockPointer))
+		if err != nil {
+			return nil, err
+		}
+		mergedBlocks := make([]BlockPointer, 0, len(mergedInfos))
+		for _, info := range mergedInfos {
+			mergedBlocks = append(mergedBlocks, info.BlockPointer)
+		}
+		cr.log.CDebugf(ctx, "Keeping the unmerged version of %s", name)
+		return crActionList{&keepUnmergedFileAction{
+			name:          name,
+			unmergedFile:  unmergedEntry.BlockPointer,
+			mergedFile:    mergedEntry.BlockPointer,
+			unmergedSize:  unmergedEntry.Size,
+			mergedSize:    mergedEntry.Size,
+			mtime:         unmergedEntry.Mtime,
+			mergedBlocks:  mergedBlocks,
+			droppedBlocks: dropped,
+		}}, nil
+	default:
+		merger := cr.config.ConflictFileMerger()
+		if merger == nil {
+			return nil, nil
+		}
+		var err error
+		mufa, err = cr.mergeConflictingFile(ctx, lState, merger,
+			unmergedChains, mergedChains, mergedPath, unmergedEntry,
+			mergedEntry, unmergedChain, name, newFileBlocks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mufa == nil {
+		return nil, nil
+	}
+	return crActionList{mufa}, nil
+}
+
+// resolveConflictingFiles resolves the conflicts between writes to
+// the same file in the given merged directory, according to the
+// choice set for each one (see ConflictChoice).  The
+// renameUnmergedAction for each such file is replaced in the
+// returned action list by the actions implementing the choice, if
+// any.  unmergedPath is the path of the directory in the unmerged
+// branch.
+func (cr *ConflictResolver) resolveConflictingFiles(ctx context.Context,
+	lState *lockState, unmergedChains, mergedChains *crChains,
+	unmergedPath, mergedPath path, unmergedBlock, mergedBlock *DirBlock,
+	actions crActionList, newFileBlocks fileBlockMap) (
+	crActionList, error) {
+	newActions := make(crActionList, 0, len(actions))
+	for _, action := range actions {
+		rua, ok := action.(*renameUnmergedAction)
+		// Only conflicts between writes to the same file have
+		// the unmerged parent set.
+		if !ok || !rua.unmergedParentMostRecent.IsInitialized() ||
+			rua.symPath != "" || rua.fromName == rua.toName {
+			newActions = append(newActions, action)
+			continue
+		}
+		choice := cr.getConflictChoice(cleanConflictPath(
+			tlfRelativePath(unmergedPath) + "/" + rua.fromName))
+		replacement, err := cr.resolveConflictingFile(ctx, lState,
+			choice, unmergedChains, mergedChains, unmergedPath,
+			mergedPath, unmergedBlock, mergedBlock, rua.fromName,
+			newFileBlocks)
+		if err != nil {
+			return nil, err
+		}
+		if replacement == nil {
+			newActions = append(newActions, action)
+			continue
+		}
+		newActions = append(newActions, replacement...)
+	}
+	return newActions, nil
 }
 
 func (cr *ConflictResolver) doActions(ctx context.Context,
@@ -2189,18 +2789,29 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 			// Make sure we don't try to execute the same actions twice.
 			doneActions[mergedPath.tailPointer()] = true
 
+			// Resolve the conflicts between writes to the same
+			// file by merging them or keeping one side, if
+			// possible, instead of renaming them.
+			actions, err = cr.resolveConflictingFiles(ctx, lState,
+				unmergedChains, mergedChains, unmergedPath, mergedPath,
+				unmergedBlock, mergedBlock, actions, newFileBlocks)
+			if err != nil {
+				return err
+			}
+			actionMap[mergedPath.tailPointer()] = actions
+
 			// Any file block copies, keyed by their new temporary block
 			// IDs, and later we will ready them.
 			unmergedFetcher := func(ctx context.Context, name string,
 				ptr BlockPointer) (BlockPointer, error) {
 				return cr.makeFileBlockDeepCopy(ctx, lState, unmergedChains,
-					mergedPath.tailPointer(), unmergedPath, name, ptr,
-					newFileBlocks)
+					mergedChains, mergedPath.tailPointer(), unmergedPath,
+					name, ptr, newFileBlocks)
 			}
 			mergedFetcher := func(ctx context.Context, name string,
 				ptr BlockPointer) (BlockPointer, error) {
 				return cr.makeFileBlockDeepCopy(ctx, lState, mergedChains,
-					mergedPath.tailPointer(), mergedPath, name,
+					nil, mergedPath.tailPointer(), mergedPath, name,
 					ptr, newFileBlocks)
 			}
 
@@ -2299,11 +2910,17 @@ func (cr *ConflictResolver) makeRevertedOps(ctx context.Context,
 		}
 
 		for _, op := range chain.ops {
-			// Skip any rms that were part of a rename
+			// Skip any rms that were part of a rename (or an unlink)
 			if rop, ok := op.(*rmOp); ok && len(rop.Unrefs()) == 0 {
 				continue
 			}
 
+			// Skip the create half of a link; the linkOp itself is
+			// in the chain for the hard links directory.
+			if cop, ok := op.(*createOp); ok && cop.hardLink {
+				continue
+			}
+
 			// Turn the create half of a rename back into a full rename.
 			if cop, ok := op.(*createOp); ok && cop.renamed {
 				renameOriginal, ok := renames[crRenameHelperKey{
@@ -2457,11 +3074,18 @@ func (cr *ConflictResolver) createResolvedMD(ctx context.Context,
 					return nil, err
 				}
 				if fblock.IsInd {
+					infos, err := cr.fbo.blocks.
+						GetIndirectFileBlockInfosWithTopBlock(ctx, lState,
+							unmergedChains.mostRecentChainMDInfo.kmd, file,
+							fblock)
+					if err != nil {
+						return nil, err
+					}
 					newCreateOp.RefBlocks = make([]BlockPointer,
-						len(fblock.IPtrs)+1)
+						len(infos)+1)
 					newCreateOp.RefBlocks[0] = cop.Refs()[0]
-					for j, iptr := range fblock.IPtrs {
-						newCreateOp.RefBlocks[j+1] = iptr.BlockPointer
+					for j, info := range infos {
+						newCreateOp.RefBlocks[j+1] = info.BlockPointer
 					}
 				}
 			}
@@ -2557,6 +3181,11 @@ func crFixOpPointers(oldOps []op, updates map[BlockPointer]BlockPointer,
 			ptrsToFix = append(ptrsToFix, &realOp.File)
 			// The leading resolutionOp will take care of the updates.
 			realOp.Updates = nil
+		case *linkOp:
+			updatesToFix = append(updatesToFix, &realOp.Dir,
+				&realOp.TargetDir)
+			// The leading resolutionOp will take care of the updates.
+			realOp.Updates = nil
 		}
 
 		for _, update := range updatesToFix {
@@ -2794,39 +3423,11 @@ func (cr *ConflictResolver) syncTree(ctx context.Context, lState *lockState,
 		var childBps *blockPutState
 		if entryType != Dir && fblock.IsInd {
 			childBps = newBlockPutState(len(fblock.IPtrs))
-			// For an indirect file block, make sure a new
-			// reference is made for every child block.
-			for i, iptr := range fblock.IPtrs {
-				// If journaling is enabled, new references aren't
-				// supported.  We have to fetch each block and ready
-				// it.  TODO: remove this when KBFS-1149 is fixed.
-				//
-				// TODO: parallelize the block fetches.
-				if TLFJournalEnabled(cr.config, cr.fbo.id()) {
-					cr.log.CDebugf(ctx, "Duplicating data from child block %v",
-						iptr.BlockPointer)
-					childBlock, err := cr.fbo.blocks.GetFileBlockForReading(
-						ctx, lState,
-						unmergedChains.mostRecentChainMDInfo.kmd,
-						iptr.BlockPointer, node.mergedPath.Branch,
-						node.mergedPath)
-					if err != nil {
-						return nil, err
-					}
-					info, _, readyBlockData, err := ReadyBlock(
-						ctx, cr.config, newMD.ReadOnly(), childBlock, uid)
-					if err != nil {
-						return nil, err
-					}
-					fblock.IPtrs[i].BlockInfo = info
-					childBps.addNewBlock(info.BlockPointer, childBlock,
-						readyBlockData, nil)
-					newMD.AddRefBlock(info)
-				} else {
-					childBps.addNewBlock(iptr.BlockPointer, nil,
-						ReadyBlockData{}, nil)
-					newMD.AddRefBlock(iptr.BlockInfo)
-				}
+			err := cr.syncIndirectFileBlockChildren(ctx, lState,
+				unmergedChains, newMD, uid, node.mergedPath, fblock,
+				newFileBlocks, childBps)
+			if err != nil {
+				return nil, err
 			}
 		}
 
@@ -2867,6 +3468,76 @@ func (cr *ConflictResolver) syncTree(ctx context.Context, lState *lockState,
 	return bps, nil
 }
 
+// syncIndirectFileBlockChildren makes sure a new reference is made
+// for every child block of the given copied indirect file block
+// (except for those in unmergedChains.keptPointers), and readies any
+// copied child blocks (before their parents), adding them all to
+// childBps.
+func (cr *ConflictResolver) syncIndirectFileBlockChildren(
+	ctx context.Context, lState *lockState, unmergedChains *crChains,
+	newMD *RootMetadata, uid keybase1.UID, file path, fblock *FileBlock,
+	newFileBlocks fileBlockMap, childBps *blockPutState) error {
+	for i, iptr := range fblock.IPtrs {
+		if blocks, ok := newFileBlocks[iptr.BlockPointer]; ok {
+			childBlock := blocks[""]
+			if childBlock.IsInd {
+				err := cr.syncIndirectFileBlockChildren(ctx, lState,
+					unmergedChains, newMD, uid, file, childBlock,
+					newFileBlocks, childBps)
+				if err != nil {
+					return err
+				}
+			}
+			// Don't let a copied leaf turn back into a new
+			// reference to the block it was copied from.
+			info, _, readyBlockData, err := readyNewBlock(
+				ctx, cr.config, newMD.ReadOnly(), childBlock, uid)
+			if err != nil {
+				return err
+			}
+			fblock.IPtrs[i].BlockInfo = info
+			childBps.addNewBlock(info.BlockPointer, childBlock,
+				readyBlockData, nil)
+			newMD.AddRefBlock(info)
+			continue
+		}
+		if unmergedChains.keptPointers[iptr.BlockPointer] {
+			continue
+		}
+
+		// If journaling is enabled, new references aren't
+		// supported.  We have to fetch each block and ready
+		// it.  TODO: remove this when KBFS-1149 is fixed.
+		//
+		// TODO: parallelize the block fetches.
+		if TLFJournalEnabled(cr.config, cr.fbo.id()) {
+			cr.log.CDebugf(ctx, "Duplicating data from child block %v",
+				iptr.BlockPointer)
+			childBlock, err := cr.fbo.blocks.GetFileBlockForReading(
+				ctx, lState,
+				unmergedChains.mostRecentChainMDInfo.kmd,
+				iptr.BlockPointer, file.Branch, file)
+			if err != nil {
+				return err
+			}
+			info, _, readyBlockData, err := ReadyBlock(
+				ctx, cr.config, newMD.ReadOnly(), childBlock, uid)
+			if err != nil {
+				return err
+			}
+			fblock.IPtrs[i].BlockInfo = info
+			childBps.addNewBlock(info.BlockPointer, childBlock,
+				readyBlockData, nil)
+			newMD.AddRefBlock(info)
+		} else {
+			childBps.addNewBlock(iptr.BlockPointer, nil,
+				ReadyBlockData{}, nil)
+			newMD.AddRefBlock(iptr.BlockInfo)
+		}
+	}
+	return nil
+}
+
 // addUnrefToFinalResOp makes a resolutionOp at the end of opsList if
 // one doesn't exist yet, and then adds the given pointer as an unref
 // block to it.
@@ -2880,6 +3551,56 @@ func addUnrefToFinalResOp(ops opsList, ptr BlockPointer) opsList {
 	return ops
 }
 
+// getDroppedDirChildPointers returns the child blocks of indirect
+// directories that were created on the unmerged branch, but which
+// aren't part of any directory block that survives the resolution.
+// These are referenced by the unmerged ops (which may have been
+// copied into the resolution), but the resolution re-splits every
+// directory it touches, so they must be dropped.
+func (cr *ConflictResolver) getDroppedDirChildPointers(ctx context.Context,
+	lState *lockState, bps *blockPutState, unmergedChains *crChains,
+	refs, unrefs map[BlockPointer]bool) (map[BlockPointer]bool, error) {
+	surviving := make(map[BlockPointer]bool)
+	for _, bs := range bps.blockStates {
+		if dblock, ok := bs.block.(*DirBlock); ok {
+			for _, iptr := range dblock.IPtrs {
+				surviving[iptr.BlockPointer] = true
+			}
+		}
+	}
+
+	created := make(map[BlockPointer]bool)
+	for ptr, original := range unmergedChains.originals {
+		chain, ok := unmergedChains.byOriginal[original]
+		if !ok || chain.isFile() {
+			continue
+		}
+		dblock, err := cr.fbo.blocks.GetDirBlockForReading(ctx, lState,
+			unmergedChains.mostRecentChainMDInfo.kmd, ptr,
+			cr.fbo.branch(), path{})
+		if err != nil {
+			return nil, err
+		}
+		survives := refs[ptr] && !unrefs[ptr]
+		for _, iptr := range dblock.IPtrs {
+			if survives {
+				surviving[iptr.BlockPointer] = true
+			}
+			if unmergedChains.createdOriginals[iptr.BlockPointer] {
+				created[iptr.BlockPointer] = true
+			}
+		}
+	}
+
+	dropped := make(map[BlockPointer]bool)
+	for ptr := range created {
+		if !surviving[ptr] {
+			dropped[ptr] = true
+		}
+	}
+	return dropped, nil
+}
+
 // calculateResolutionBytes figured out how many bytes are referenced
 // and unreferenced in the merged branch by this resolution.  It
 // should be called before the block changes are unembedded in md.  It
@@ -2936,15 +3657,49 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 		}
 	}
 
+	// Don't count any dropped child blocks of unmerged indirect
+	// directories; they get unreferenced below.
+	droppedDirChildren, err := cr.getDroppedDirChildPointers(
+		ctx, lState, bps, unmergedChains, refs, unrefs)
+	if err != nil {
+		return nil, err
+	}
+	for ptr := range droppedDirChildren {
+		if !refs[ptr] {
+			continue
+		}
+		cr.log.CDebugf(ctx, "Ignoring dropped dir child ptr %v", ptr)
+		delete(refs, ptr)
+		for _, op := range md.data.Changes.Ops {
+			op.DelRefBlock(ptr)
+		}
+	}
+
 	localBlocks := make(map[BlockPointer]Block)
+	// The children of copied indirect file blocks get new
+	// references that don't exist on the server until the blocks
+	// are put, so take their sizes from their parents.
+	childSizes := make(map[BlockPointer]uint32)
 	for _, bs := range bps.blockStates {
 		if bs.block != nil {
 			localBlocks[bs.blockPtr] = bs.block
 		}
+		if fblock, ok := bs.block.(*FileBlock); ok && fblock.IsInd {
+			for _, iptr := range fblock.IPtrs {
+				childSizes[iptr.BlockPointer] = iptr.EncodedSize
+			}
+		}
 	}
 
 	// Add bytes for every ref'd block.
 	for ptr := range refs {
+		if size, ok := childSizes[ptr]; ok && localBlocks[ptr] == nil {
+			cr.log.CDebugf(ctx, "Ref'ing block %v", ptr)
+			md.AddRefBytes(uint64(size))
+			md.AddDiskUsage(uint64(size))
+			continue
+		}
+
 		block, ok := localBlocks[ptr]
 		if !ok {
 			// Look up the block to get its size.  Since we don't know
@@ -3026,6 +3781,9 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 	for ptr := range unmergedChains.toUnrefPointers {
 		toUnref[ptr] = true
 	}
+	for ptr := range droppedDirChildren {
+		toUnref[ptr] = true
+	}
 	for ptr := range toUnref {
 		isUnflushed, err := cr.config.BlockServer().IsUnflushed(
 			ctx, cr.fbo.id(), ptr.ID)
@@ -3665,6 +4423,12 @@ func (e CRWrapError) Error() string {
 }
 
 func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
+	if err := cr.waitForConflictChoices(ctx); err != nil {
+		cr.log.CDebugf(ctx, "Conflict resolution canceled while held: %v",
+			err)
+		return
+	}
+
 	cr.log.CDebugf(ctx, "Starting conflict resolution with input %v", ci)
 	var err error
 	lState := makeFBOLockState()
@@ -3676,10 +4440,13 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 				handle.GetCanonicalName(), handle.IsPublic(),
 				WriteMode, CRWrapError{err})
 		} else {
-			// We finished successfully, so no need to lock next time.
+			// We finished successfully, so no need to lock next
+			// time, and the conflict choices have been used up.
 			cr.inputLock.Lock()
 			defer cr.inputLock.Unlock()
 			cr.lockNextTime = false
+			cr.choices = nil
+			cr.holdStart = time.Time{}
 		}
 	}()
 
@@ -190,10 +190,19 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				unmergedEntry.Xattrs = cuea.unmergedEntry.Xattrs
 			}
 		}
 	}
 
+	// The merged branch (along with any hard link actions already
+	// applied to it) decides which hard links point to an existing
+	// entry.
+	if mergedEntry, ok := mergedBlock.Children[cuea.toName]; ok {
+		unmergedEntry.setHardLinks(mergedEntry.HardLinks)
+	}
+
 	mergedBlock.Children[cuea.toName] = unmergedEntry
 	return nil
 }
@@ -379,6 +388,8 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Type = unmergedEntry.Type
 		case mtimeAttr:
 			mergedEntry.Mtime = unmergedEntry.Mtime
+		case xattrAttr:
+			mergedEntry.Xattrs = unmergedEntry.Xattrs
 		case sizeAttr:
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
@@ -537,6 +548,15 @@ func (rua *renameUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
 			unmergedMostRecent)
 	}
 
+	if unmergedChain.isFile() {
+		// All the file chains in a directory share its actions; only
+		// the chain for the renamed file needs updating.
+		if e, ok := unmergedBlock.Children[rua.fromName]; ok &&
+			e.BlockPointer != unmergedMostRecent {
+			return nil
+		}
+	}
+
 	if rua.symPath != "" && !unmergedChain.isFile() {
 		err := crActionConvertSymlink(unmergedMostRecent, mergedMostRecent,
 			unmergedChain, mergedChains, rua.fromName, rua.toName)
@@ -677,6 +697,207 @@ func (rua *renameUnmergedAction) String() string {
 		rua.symPath)
 }
 
+// mergeUnmergedFileAction says that the writes to a file in both
+// branches were merged into new file contents, which replace the
+// merged copy of the file.  Unlike renameUnmergedAction, no copy of
+// the unmerged file is kept.  The new file block must already be in
+// the set of new file blocks that will be synced for the merged
+// directory.
+type mergeUnmergedFileAction struct {
+	name string
+	// The most recent unmerged and merged pointers of the file.
+	unmergedFile BlockPointer
+	mergedFile   BlockPointer
+	// The sizes of the unmerged and merged versions of the file,
+	// and of the new merged contents.
+	unmergedSize uint64
+	mergedSize   uint64
+	newSize      uint64
+	mtime        int64
+}
+
+func (mufa *mergeUnmergedFileAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (mufa *mergeUnmergedFileAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	mergedEntry, ok := mergedBlock.Children[mufa.name]
+	if !ok {
+		return NoSuchNameError{mufa.name}
+	}
+	// Leave the pointer alone; syncing the new file block will
+	// update it, and unreference the old merged one.
+	mergedEntry.Size = mufa.newSize
+	mergedEntry.Mtime = mufa.mtime
+	mergedEntry.Ctime = mufa.mtime
+	mergedBlock.Children[mufa.name] = mergedEntry
+	return nil
+}
+
+// setFullFileWrites replaces the writes in so with ones covering the
+// whole of a file that changed from oldSize bytes to newSize bytes.
+func setFullFileWrites(so *syncOp, oldSize uint64, newSize uint64) {
+	so.Writes = nil
+	so.addWrite(0, newSize)
+	if oldSize > newSize {
+		so.addTruncate(newSize)
+	}
+}
+
+func (mufa *mergeUnmergedFileAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	if unmergedMostRecent != mufa.unmergedFile {
+		// Only the file's own ops need updating.
+		return nil
+	}
+	unmergedChain, ok := unmergedChains.byMostRecent[unmergedMostRecent]
+	if !ok {
+		return fmt.Errorf("Couldn't find unmerged chain for %v",
+			unmergedMostRecent)
+	}
+
+	// The unmerged writes are replaced by the merged contents, so
+	// tell everyone on the merged branch that the whole file
+	// changed.  The unmerged file blocks are no longer referenced.
+	for i, op := range unmergedChain.ops {
+		so, ok := op.(*syncOp)
+		if !ok {
+			return fmt.Errorf("Unexpected op for merged file %s: %s",
+				mufa.name, op)
+		}
+		so.Writes = nil
+		so.RefBlocks = nil
+		if i == 0 {
+			setFullFileWrites(so, mufa.mergedSize, mufa.newSize)
+		}
+	}
+
+	// For local playback, the whole file changed from the unmerged
+	// point of view as well.
+	mergedChain, ok := mergedChains.byMostRecent[mufa.mergedFile]
+	if !ok {
+		return fmt.Errorf("Couldn't find merged chain for %v",
+			mufa.mergedFile)
+	}
+	so, err := newSyncOp(mergedChain.original)
+	if err != nil {
+		return err
+	}
+	setFullFileWrites(so, mufa.unmergedSize, mufa.newSize)
+	return prependOpsToChain(mufa.mergedFile, mergedChains, so)
+}
+
+func (mufa *mergeUnmergedFileAction) String() string {
+	return fmt.Sprintf("mergeUnmergedFile: %s", mufa.name)
+}
+
+// keepUnmergedFileAction says that the unmerged version of a file
+// written in both branches replaces the merged copy of the file.
+// Unlike mergeUnmergedFileAction, the blocks the unmerged branch
+// wrote for the file stay referenced, since the new version of the
+// file is built from them.  Its new top block must already be in the
+// set of new file blocks that will be synced for the merged
+// directory.
+type keepUnmergedFileAction struct {
+	name string
+	// The most recent unmerged and merged pointers of the file.
+	unmergedFile BlockPointer
+	mergedFile   BlockPointer
+	// The sizes of the unmerged and merged versions of the file.
+	unmergedSize uint64
+	mergedSize   uint64
+	mtime        int64
+	// The child blocks of the merged version of the file, which
+	// are no longer referenced.
+	mergedBlocks []BlockPointer
+	// The blocks the unmerged branch wrote for the file that were
+	// replaced by copies in the new version of the file.
+	droppedBlocks []BlockPointer
+}
+
+func (kufa *keepUnmergedFileAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (kufa *keepUnmergedFileAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	mergedEntry, ok := mergedBlock.Children[kufa.name]
+	if !ok {
+		return NoSuchNameError{kufa.name}
+	}
+	// Leave the pointer alone; syncing the new file block will
+	// update it, and unreference the old merged one.
+	mergedEntry.Size = kufa.unmergedSize
+	mergedEntry.Mtime = kufa.mtime
+	mergedEntry.Ctime = kufa.mtime
+	mergedBlock.Children[kufa.name] = mergedEntry
+	return nil
+}
+
+func (kufa *keepUnmergedFileAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	if unmergedMostRecent != kufa.unmergedFile {
+		// Only the file's own ops need updating.
+		return nil
+	}
+	unmergedChain, ok := unmergedChains.byMostRecent[unmergedMostRecent]
+	if !ok {
+		return fmt.Errorf("Couldn't find unmerged chain for %v",
+			unmergedMostRecent)
+	}
+
+	// The unmerged version replaces the merged one, so tell
+	// everyone on the merged branch that the whole file changed.
+	// The unmerged file blocks stay referenced, except for the ones
+	// that were copied, and the merged ones are unreferenced.
+	unrefs := make(map[BlockPointer]bool)
+	var first *syncOp
+	for _, op := range unmergedChain.ops {
+		so, ok := op.(*syncOp)
+		if !ok {
+			return fmt.Errorf("Unexpected op for kept file %s: %s",
+				kufa.name, op)
+		}
+		so.Writes = nil
+		for _, ptr := range kufa.droppedBlocks {
+			so.DelRefBlock(ptr)
+		}
+		for _, ptr := range so.Unrefs() {
+			unrefs[ptr] = true
+		}
+		if first == nil {
+			first = so
+			setFullFileWrites(so, kufa.mergedSize, kufa.unmergedSize)
+		}
+	}
+	if first == nil {
+		return fmt.Errorf("No ops found for kept file %s", kufa.name)
+	}
+	for _, ptr := range kufa.mergedBlocks {
+		if !unrefs[ptr] {
+			first.AddUnrefBlock(ptr)
+		}
+	}
+
+	// Nothing changes from the unmerged point of view.
+	return nil
+}
+
+func (kufa *keepUnmergedFileAction) String() string {
+	return fmt.Sprintf("keepUnmergedFile: %s", kufa.name)
+}
+
 // renameMergedAction says that the merged copy of a file needs to be
 // renamed, and the unmerged entry should be added to the merged block
 // under the old from name.  Merged file blocks do not have to be
@@ -864,6 +1085,177 @@ func (dua *dropUnmergedAction) String() string {
 	return fmt.Sprintf("dropUnmerged: %s", dua.op)
 }
 
+// updateHardLinksAction says that the given hard link ID should be
+// added to (or removed from) the set of hard links of the merged
+// target entry.  If the target no longer exists in the merged
+// branch, there is nothing to do.
+type updateHardLinksAction struct {
+	target  string
+	linkID  string
+	removed bool
+}
+
+func (uhla *updateHardLinksAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (uhla *updateHardLinksAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	mergedEntry, ok := mergedBlock.Children[uhla.target]
+	if !ok {
+		return nil
+	}
+	links := copyHardLinks(mergedEntry.HardLinks)
+	if uhla.removed {
+		delete(links, uhla.linkID)
+	} else {
+		links[uhla.linkID] = true
+	}
+	mergedEntry.setHardLinks(links)
+	mergedBlock.Children[uhla.target] = mergedEntry
+	return nil
+}
+
+func (uhla *updateHardLinksAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	return nil
+}
+
+func (uhla *updateHardLinksAction) String() string {
+	if uhla.removed {
+		return fmt.Sprintf("updateHardLinks: %s -%s",
+			uhla.target, uhla.linkID)
+	}
+	return fmt.Sprintf("updateHardLinks: %s +%s", uhla.target, uhla.linkID)
+}
+
+// recreateHardLinkTargetAction says that the target of an unmerged
+// hard link should be re-created in the merged branch, which removed
+// it along with all its other links, from the unmerged target.  The
+// re-created target only keeps the link of this action, and those of
+// any other such actions for it.
+type recreateHardLinkTargetAction struct {
+	target string
+	linkID string
+
+	// recreated is set by do() when this action brought back the
+	// target, so that updateOps can reference its block again.
+	recreated BlockPointer
+}
+
+func (rhlta *recreateHardLinkTargetAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (rhlta *recreateHardLinkTargetAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	unmergedEntry, ok := unmergedBlock.Children[rhlta.target]
+	if !ok || !unmergedEntry.HardLinks[rhlta.linkID] {
+		// The unmerged branch removed the link again.
+		return nil
+	}
+
+	mergedEntry, ok := mergedBlock.Children[rhlta.target]
+	var links map[string]bool
+	if ok {
+		// Another action already re-created it.
+		links = copyHardLinks(mergedEntry.HardLinks)
+	} else {
+		// Bring back the unmerged entry as it is, like
+		// copyUnmergedEntryAction does.  The merged branch removed
+		// all the links the unmerged entry knows about, other than
+		// the new unmerged ones.
+		mergedEntry = unmergedEntry
+		links = make(map[string]bool)
+		rhlta.recreated = unmergedEntry.BlockPointer
+	}
+	links[rhlta.linkID] = true
+	mergedEntry.setHardLinks(links)
+	mergedBlock.Children[rhlta.target] = mergedEntry
+	return nil
+}
+
+func (rhlta *recreateHardLinkTargetAction) updateOps(
+	unmergedMostRecent BlockPointer, mergedMostRecent BlockPointer,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock,
+	unmergedChains *crChains, mergedChains *crChains) error {
+	if rhlta.recreated == zeroPtr {
+		return nil
+	}
+	unmergedChain, ok := unmergedChains.byMostRecent[unmergedMostRecent]
+	if !ok {
+		return fmt.Errorf("Couldn't find unmerged chain for %v",
+			unmergedMostRecent)
+	}
+
+	// The merged branch unreferenced the target's block, so the
+	// link has to reference it again, like a re-created node.
+	for _, op := range unmergedChain.ops {
+		lo, ok := op.(*linkOp)
+		if ok && lo.LinkID == rhlta.linkID && !lo.Removed {
+			lo.AddRefBlock(rhlta.recreated)
+			break
+		}
+	}
+	return nil
+}
+
+func (rhlta *recreateHardLinkTargetAction) String() string {
+	return fmt.Sprintf("recreateHardLinkTarget: %s +%s",
+		rhlta.target, rhlta.linkID)
+}
+
+// rmHardLinkTargetAction says that the given unmerged removal of a
+// hard link target, to which the merged branch added links, should
+// only go through if none of the merged links are left once all the
+// other actions, including the unmerged link removals, are done.
+// Otherwise the removal is dropped.
+type rmHardLinkTargetAction struct {
+	op *rmOp
+}
+
+func (rhlta *rmHardLinkTargetAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (rhlta *rmHardLinkTargetAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	// The link removals come later, so wait for updateOps.
+	return nil
+}
+
+func (rhlta *rmHardLinkTargetAction) updateOps(
+	unmergedMostRecent BlockPointer, mergedMostRecent BlockPointer,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock,
+	unmergedChains *crChains, mergedChains *crChains) error {
+	mergedEntry, ok := mergedBlock.Children[rhlta.op.OldName]
+	if !ok {
+		return nil
+	}
+	if len(mergedEntry.HardLinks) == 0 {
+		delete(mergedBlock.Children, rhlta.op.OldName)
+		return nil
+	}
+	dua := &dropUnmergedAction{op: rhlta.op}
+	return dua.updateOps(unmergedMostRecent, mergedMostRecent,
+		unmergedBlock, mergedBlock, unmergedChains, mergedChains)
+}
+
+func (rhlta *rmHardLinkTargetAction) String() string {
+	return fmt.Sprintf("rmHardLinkTarget: %s", rhlta.op.OldName)
+}
+
 type collapseActionInfo struct {
 	topAction      crAction
 	topActionIndex int
@@ -190,9 +190,9 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 	}
 
 	// If any op is setAttr (ex or size) or sync, this is a file
-	// chain.  If it only has a setAttr/mtime, we don't know what it
-	// is, so fall through and fetch the block unless we come across
-	// another op that can determine the type.
+	// chain.  If it only has a setAttr/mtime or setAttr/xattr, we
+	// don't know what it is, so fall through and fetch the block
+	// unless we come across another op that can determine the type.
 	var parentDir BlockPointer
 	for _, op := range cc.ops {
 		switch realOp := op.(type) {
@@ -200,12 +200,13 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 			cc.file = true
 			return nil
 		case *setAttrOp:
-			if realOp.Attr != mtimeAttr {
+			if realOp.Attr != mtimeAttr && realOp.Attr != xattrAttr {
 				cc.file = true
 				return nil
 			}
-			// We can't tell the file type from an mtimeAttr, so we
-			// may have to actually fetch the block to figure it out.
+			// We can't tell the file type from an mtimeAttr or
+			// xattrAttr, so we may have to actually fetch the block
+			// to figure it out.
 			parentDir = realOp.Dir.Ref
 		default:
 			return nil
@@ -358,6 +359,10 @@ type crChains struct {
 	// Pointers that should be explicitly cleaned up in the resolution.
 	toUnrefPointers map[BlockPointer]bool
 
+	// Pointers under copied file blocks that keep the references
+	// made for them in this branch, so they need no new ones.
+	keptPointers map[BlockPointer]bool
+
 	// Also keep the info for the most recent chain MD used to
 	// build these chains.
 	mostRecentChainMDInfo mostRecentChainMetadataInfo
@@ -392,6 +397,12 @@ func (ccs *crChains) makeChainForOp(op op) error {
 	// First set the pointers for all updates, and track what's been
 	// created and destroyed.
 	for _, update := range op.allUpdates() {
+		if _, ok := ccs.byMostRecent[update.Ref]; ok {
+			// An earlier op in the same MD (e.g., the rename half
+			// of a hard link conversion) already applied this
+			// update.
+			continue
+		}
 		chain, ok := ccs.byMostRecent[update.Unref]
 		if !ok {
 			// No matching chain means it's time to start a new chain
@@ -493,6 +504,10 @@ func (ccs *crChains) makeChainForOp(op op) error {
 		co.setWriterInfo(realOp.getWriterInfo())
 		co.setLocalTimestamp(realOp.getLocalTimestamp())
 		co.renamed = true
+		if !realOp.Renamed.IsInitialized() && realOp.RenamedType != Sym {
+			// Only hard link entries have no pointer of their own.
+			co.hardLink = true
+		}
 		// ndr may be zero if this is a post-resolution chain,
 		// so set co.Dir.Ref manually.
 		co.Dir.Ref = ndr
@@ -562,6 +577,43 @@ func (ccs *crChains) makeChainForOp(op op) error {
 		// ignore rekey op
 	case *GCOp:
 		// ignore gc op
+	case *linkOp:
+		// Split the link op into two separate operations: a create
+		// (or rm) of the link entry in its directory, and the
+		// link op itself, which updates the target entry in the
+		// hard links directory.
+		if realOp.Removed {
+			ro, err := newRmOp(realOp.Name, realOp.Dir.Unref)
+			if err != nil {
+				return err
+			}
+			ro.setWriterInfo(realOp.getWriterInfo())
+			ro.setLocalTimestamp(realOp.getLocalTimestamp())
+			// realOp.Dir.Ref may be zero if this is a
+			// post-resolution chain, so set ro.Dir.Ref manually.
+			ro.Dir.Ref = realOp.Dir.Ref
+			err = ccs.addOp(realOp.Dir.Ref, ro)
+			if err != nil {
+				return err
+			}
+		} else {
+			co, err := newCreateOp(realOp.Name, realOp.Dir.Unref, File)
+			if err != nil {
+				return err
+			}
+			co.hardLink = true
+			co.setWriterInfo(realOp.getWriterInfo())
+			co.setLocalTimestamp(realOp.getLocalTimestamp())
+			co.Dir.Ref = realOp.Dir.Ref
+			err = ccs.addOp(realOp.Dir.Ref, co)
+			if err != nil {
+				return err
+			}
+		}
+		err := ccs.addOp(realOp.TargetDir.Ref, op)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -626,6 +678,11 @@ func (ccs *crChains) makeChainForNewOp(targetPtr BlockPointer, newOp op) error {
 		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.Dir)
 	case *syncOp:
 		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.File)
+	case *linkOp:
+		// Like with renames, don't split the link op; it will be
+		// placed only in the target directory chain.
+		return ccs.makeChainForNewOpWithUpdate(
+			targetPtr, newOp, &realOp.TargetDir)
 	default:
 		return fmt.Errorf("Couldn't make chain with unknown operation %s",
 			newOp)
@@ -702,6 +759,7 @@ func newCRChainsEmpty() *crChains {
 		renamedOriginals:    make(map[BlockPointer]renameInfo),
 		blockChangePointers: make(map[BlockPointer]bool),
 		toUnrefPointers:     make(map[BlockPointer]bool),
+		keptPointers:        make(map[BlockPointer]bool),
 		originals:           make(map[BlockPointer]BlockPointer),
 	}
 }
@@ -913,6 +971,11 @@ func (ccs *crChains) copyOpAndRevertUnrefsToOriginals(currOp op) op {
 	case *GCOp:
 		// No need to copy a GCOp, it won't be modified
 		newOp = realOp
+	case *linkOp:
+		newLinkOp := *realOp
+		unrefs = append(unrefs, &newLinkOp.Dir.Unref,
+			&newLinkOp.TargetDir.Unref)
+		newOp = &newLinkOp
 	}
 	for _, unref := range unrefs {
 		original, ok := ccs.originals[*unref]
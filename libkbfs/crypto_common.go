@@ -378,16 +378,27 @@ func nextPowerOfTwo(n uint32) uint32 {
 
 const padPrefixSize = 4
 
-// padBlock adds random padding to an encoded block.
-func (c CryptoCommon) padBlock(block []byte) ([]byte, error) {
+// padCompressionShift is the bit offset, within the length prefix of
+// a padded block, of the type of compression applied to the block
+// data.  Older clients read it as part of the length, which then
+// runs past the end of the padded block, so they fail to decode
+// compressed blocks with a PaddedBlockReadError.
+const padCompressionShift = 24
+
+// padBlock adds random padding to an encoded block, which has been
+// compressed with the given type of compression.
+func (c CryptoCommon) padBlock(block []byte,
+	compression BlockCompressionType) ([]byte, error) {
 	blockLen := uint32(len(block))
 	overallLen := nextPowerOfTwo(blockLen)
 	padLen := int64(overallLen - blockLen)
 
 	buf := bytes.NewBuffer(make([]byte, 0, overallLen+padPrefixSize))
 
-	// first 4 bytes contain the length of the block data
-	if err := binary.Write(buf, binary.LittleEndian, blockLen); err != nil {
+	// first 4 bytes contain the length of the block data, and the
+	// compression type in the top byte
+	prefix := blockLen | uint32(compression)<<padCompressionShift
+	if err := binary.Write(buf, binary.LittleEndian, prefix); err != nil {
 		return nil, err
 	}
 
@@ -406,31 +417,39 @@ func (c CryptoCommon) padBlock(block []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// depadBlock extracts the actual block data from a padded block.
-func (c CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
+// depadBlock extracts the actual block data from a padded block,
+// along with the type of compression applied to it.
+func (c CryptoCommon) depadBlock(paddedBlock []byte) (
+	[]byte, BlockCompressionType, error) {
 	buf := bytes.NewBuffer(paddedBlock)
 
-	var blockLen uint32
-	if err := binary.Read(buf, binary.LittleEndian, &blockLen); err != nil {
-		return nil, err
+	var prefix uint32
+	if err := binary.Read(buf, binary.LittleEndian, &prefix); err != nil {
+		return nil, NoBlockCompression, err
 	}
+	compression := BlockCompressionType(prefix >> padCompressionShift)
+	blockLen := prefix & (1<<padCompressionShift - 1)
 	blockEndPos := int(blockLen + padPrefixSize)
 
 	if len(paddedBlock) < blockEndPos {
-		return nil, PaddedBlockReadError{ActualLen: len(paddedBlock), ExpectedLen: blockEndPos}
+		return nil, NoBlockCompression, PaddedBlockReadError{
+			ActualLen: len(paddedBlock), ExpectedLen: blockEndPos}
 	}
-	return buf.Next(int(blockLen)), nil
+	return buf.Next(int(blockLen)), compression, nil
 }
 
 // EncryptBlock implements the Crypto interface for CryptoCommon.
-func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
-	plainSize int, encryptedBlock EncryptedBlock, err error) {
+func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey,
+	compression BlockCompressionType) (plainSize int,
+	encryptedBlock EncryptedBlock, compressedSize int, err error) {
 	encodedBlock, err := c.codec.Encode(block)
 	if err != nil {
 		return
 	}
 
-	paddedBlock, err := c.padBlock(encodedBlock)
+	compressedBlock, compression := compressBlockData(
+		encodedBlock, compression)
+	paddedBlock, err := c.padBlock(compressedBlock, compression)
 	if err != nil {
 		return
 	}
@@ -441,6 +460,7 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 	}
 
 	plainSize = len(encodedBlock)
+	compressedSize = len(compressedBlock)
 	encryptedBlock = EncryptedBlock(encryptedData)
 	return
 }
@@ -454,7 +474,12 @@ func (c CryptoCommon) DecryptBlock(
 		return err
 	}
 
-	encodedBlock, err := c.depadBlock(paddedBlock)
+	compressedBlock, compression, err := c.depadBlock(paddedBlock)
+	if err != nil {
+		return err
+	}
+
+	encodedBlock, err := decompressBlockData(compressedBlock, compression)
 	if err != nil {
 		return err
 	}
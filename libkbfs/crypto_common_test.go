@@ -251,7 +251,8 @@ func TestCryptoCommonEncryptDecryptBlock(t *testing.T) {
 	block := TestBlock{42}
 	key := kbfscrypto.BlockCryptKey{}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, key)
+	_, encryptedBlock, _, err := c.EncryptBlock(
+		&block, key, NoBlockCompression)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -663,7 +664,8 @@ func TestEncryptBlock(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	plainSize, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	plainSize, encryptedBlock, _, err := c.EncryptBlock(
+		&block, cryptKey, NoBlockCompression)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -673,7 +675,7 @@ func TestEncryptBlock(t *testing.T) {
 	}
 
 	paddedBlock := checkSecretboxOpen(t, encryptedData(encryptedBlock), cryptKey.Data())
-	encodedBlock, err := c.depadBlock(paddedBlock)
+	encodedBlock, _, err := c.depadBlock(paddedBlock)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -697,7 +699,7 @@ func TestDecryptBlockSecretboxSeal(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	paddedBlock, err := c.padBlock(encodedBlock)
+	paddedBlock, err := c.padBlock(encodedBlock, NoBlockCompression)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -724,7 +726,8 @@ func TestDecryptEncryptedBlock(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, _, err := c.EncryptBlock(
+		&block, cryptKey, NoBlockCompression)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -748,7 +751,8 @@ func TestDecryptBlockFailures(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, _, err := c.EncryptBlock(
+		&block, cryptKey, NoBlockCompression)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -775,7 +779,7 @@ func TestDecryptBlockFailures(t *testing.T) {
 func TestBlockPadding(t *testing.T) {
 	var c CryptoCommon
 	f := func(b []byte) bool {
-		padded, err := c.padBlock(b)
+		padded, err := c.padBlock(b, NoBlockCompression)
 		if err != nil {
 			t.Logf("padBlock err: %s", err)
 			return false
@@ -803,12 +807,12 @@ func TestBlockPadding(t *testing.T) {
 func TestBlockDepadding(t *testing.T) {
 	var c CryptoCommon
 	f := func(b []byte) bool {
-		padded, err := c.padBlock(b)
+		padded, err := c.padBlock(b, NoBlockCompression)
 		if err != nil {
 			t.Logf("padBlock err: %s", err)
 			return false
 		}
-		depadded, err := c.depadBlock(padded)
+		depadded, _, err := c.depadBlock(padded)
 		if err != nil {
 			t.Logf("depadBlock err: %s", err)
 			return false
@@ -832,7 +836,7 @@ func TestBlockPadMinimum(t *testing.T) {
 		if err := kbfscrypto.RandRead(b); err != nil {
 			t.Fatal(err)
 		}
-		padded, err := c.padBlock(b)
+		padded, err := c.padBlock(b, NoBlockCompression)
 		if err != nil {
 			t.Errorf("padBlock error: %s", err)
 		}
@@ -918,7 +922,8 @@ func TestBlockEncryptedLen(t *testing.T) {
 	var expectedLen int
 	for i := 1025; i < 2000; i++ {
 		data := randomData[:i]
-		_, encBlock, err := c.EncryptBlock(&data, cryptKey)
+		_, encBlock, _, err := c.EncryptBlock(
+			&data, cryptKey, NoBlockCompression)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -4,7 +4,10 @@
 
 package libkbfs
 
-import "github.com/rcrowley/go-metrics"
+import (
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/rcrowley/go-metrics"
+)
 
 // CryptoMeasured delegates to another Crypto instance but also keeps
 // track of (some) stats.
@@ -12,15 +15,26 @@ type CryptoMeasured struct {
 	Crypto
 	// Add timers for other Crypto functions as needed.
 	makeMdIDTimer metrics.Timer
+	// compressedBlockMeter counts the blocks that were compressed
+	// before being encrypted, and compressionSavedBytesCounter
+	// the bytes that saved.
+	compressedBlockMeter         metrics.Meter
+	compressionSavedBytesCounter metrics.Counter
 }
 
 // NewCryptoMeasured creates and returns a new CryptoMeasured instance
 // with the given delegate and registry.
 func NewCryptoMeasured(delegate Crypto, r metrics.Registry) CryptoMeasured {
 	makeMdIDTimer := metrics.GetOrRegisterTimer("Crypto.MakeMdID", r)
+	compressedBlockMeter := metrics.GetOrRegisterMeter(
+		"Crypto.CompressedBlocks", r)
+	compressionSavedBytesCounter := metrics.GetOrRegisterCounter(
+		"Crypto.CompressionSavedBytes", r)
 	return CryptoMeasured{
-		Crypto:        delegate,
-		makeMdIDTimer: makeMdIDTimer,
+		Crypto:                       delegate,
+		makeMdIDTimer:                makeMdIDTimer,
+		compressedBlockMeter:         compressedBlockMeter,
+		compressionSavedBytesCounter: compressionSavedBytesCounter,
 	}
 }
 
@@ -31,3 +45,17 @@ func (c CryptoMeasured) MakeMdID(md BareRootMetadata) (mdID MdID, err error) {
 	})
 	return mdID, err
 }
+
+// EncryptBlock implements the Crypto interface for CryptoMeasured.
+func (c CryptoMeasured) EncryptBlock(block Block,
+	key kbfscrypto.BlockCryptKey, compression BlockCompressionType) (
+	plainSize int, encryptedBlock EncryptedBlock, compressedSize int,
+	err error) {
+	plainSize, encryptedBlock, compressedSize, err =
+		c.Crypto.EncryptBlock(block, key, compression)
+	if err == nil && compressedSize < plainSize {
+		c.compressedBlockMeter.Mark(1)
+		c.compressionSavedBytesCounter.Inc(int64(plainSize - compressedSize))
+	}
+	return plainSize, encryptedBlock, compressedSize, err
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +33,16 @@ const (
 // user-created directory entry name.
 var disallowedPrefixes = [...]string{".kbfs"}
 
+// hardLinksDirName is the name of the hidden directory, at the root
+// of each TLF, that holds the targets of all the hard links in the
+// TLF.
+const hardLinksDirName = ".kbfs_links"
+
+// trashDirName is the name of the hidden directory, at the root of
+// each TLF, that holds removed entries until they are restored or
+// purged.
+const trashDirName = ".kbfs_trash"
+
 // UserInfo contains all the info about a keybase user that kbfs cares
 // about.
 type UserInfo struct {
@@ -154,6 +165,19 @@ const (
 	// FilesWithHolesDataVer is the data version for files
 	// with holes.
 	FilesWithHolesDataVer DataVer = 2
+	// IndirectDirsDataVer is the data version for directories
+	// split across multiple blocks.
+	IndirectDirsDataVer DataVer = 3
+	// HardLinksDataVer is the data version for directories
+	// containing hard links.
+	HardLinksDataVer DataVer = 4
+	// MultiLevelFilesDataVer is the data version for files whose
+	// indirect blocks point to other indirect blocks.
+	MultiLevelFilesDataVer DataVer = 5
+	// CompressedBlocksDataVer is the data version for blocks whose
+	// encoded data was compressed before being padded and
+	// encrypted.
+	CompressedBlocksDataVer DataVer = 6
 )
 
 // BlockRefNonce is a 64-bit unique sequence of bytes for identifying
@@ -329,6 +353,9 @@ type ReadyBlockData struct {
 	// These fields should not be used outside of putBlockToServer.
 	buf        []byte
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	// compressionSavings is the number of bytes by which
+	// compression shrank the encoded block, before padding.
+	compressionSavings int
 }
 
 // GetEncodedSize returns the size of the encoded (and encrypted)
@@ -381,8 +408,40 @@ const (
 	// folder.  Set to the empty string so that the default will be
 	// the master branch.
 	MasterBranch BranchName = ""
+
+	// branchRevPrefix is the prefix of branch names that specify an
+	// archived, read-only view of a top-level folder at a particular
+	// past revision.
+	branchRevPrefix = "rev="
 )
 
+// MakeRevBranchName returns the name of the archived branch that
+// views a top-level folder as of the given revision.
+func MakeRevBranchName(rev MetadataRevision) BranchName {
+	return BranchName(branchRevPrefix + strconv.FormatInt(int64(rev), 10))
+}
+
+// IsArchived returns true if the branch name specifies an archived,
+// read-only view of a past revision.
+func (bn BranchName) IsArchived() bool {
+	_, ok := bn.RevisionIfSpecified()
+	return ok
+}
+
+// RevisionIfSpecified returns the revision specified by an archived
+// branch name, and true, or false if bn isn't an archived branch
+// name.
+func (bn BranchName) RevisionIfSpecified() (MetadataRevision, bool) {
+	if !strings.HasPrefix(string(bn), branchRevPrefix) {
+		return MetadataRevisionUninitialized, false
+	}
+	rev, err := strconv.ParseInt(string(bn[len(branchRevPrefix):]), 10, 64)
+	if err != nil || MetadataRevision(rev) < MetadataRevisionInitial {
+		return MetadataRevisionUninitialized, false
+	}
+	return MetadataRevision(rev), true
+}
+
 // FolderBranch represents a unique pair of top-level folder and a
 // branch of that folder.
 type FolderBranch struct {
@@ -534,6 +593,33 @@ func (o Excl) String() string {
 	}
 }
 
+// XattrSetFlag indicates how SetXattr treats an existing extended
+// attribute, like the XATTR_CREATE and XATTR_REPLACE flags to
+// setxattr(2).
+type XattrSetFlag int
+
+const (
+	// XattrSetAny sets the attribute whether or not it already exists.
+	XattrSetAny XattrSetFlag = iota
+	// XattrCreate fails if the attribute already exists.
+	XattrCreate
+	// XattrReplace fails if the attribute doesn't already exist.
+	XattrReplace
+)
+
+func (f XattrSetFlag) String() string {
+	switch f {
+	case XattrSetAny:
+		return "any"
+	case XattrCreate:
+		return "create"
+	case XattrReplace:
+		return "replace"
+	default:
+		return "<invalid XattrSetFlag>"
+	}
+}
+
 // EntryInfo is the (non-block-related) info a directory knows about
 // its child.
 //
@@ -548,6 +634,9 @@ type EntryInfo struct {
 	Mtime int64
 	// Ctime is in unix nanoseconds
 	Ctime int64
+	// Nlink is the number of hard links to this entry, or 0 if
+	// it is not the target of any hard links.
+	Nlink uint32 `codec:",omitempty"`
 }
 
 // ReportedError represents an error reported by KBFS.
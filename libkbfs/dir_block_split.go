@@ -0,0 +1,184 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+
+	"github.com/keybase/kbfs/kbfscodec"
+)
+
+// dirBlockRange is a contiguous range of directory entries, by name,
+// that is stored in a single child block of an indirect directory.
+type dirBlockRange struct {
+	// off is the smallest name that belongs in this range.
+	off string
+	// names is the sorted list of entry names in this range.
+	names []string
+	// size is the encoded size of the child block for this range.
+	size int
+	// unchanged is true if this range holds exactly the entries of
+	// the existing child block starting at off, which can then be
+	// reused as is.
+	unchanged bool
+}
+
+// dirBlockUnchangedSizer returns the recorded encoded size of the
+// existing child block starting at off, and true, if that block
+// holds exactly the given entries, and false otherwise.
+type dirBlockUnchangedSizer func(off string, names []string) (
+	size int, unchanged bool, err error)
+
+// makeDirBlockChild returns a new direct DirBlock containing only the
+// given entries from children.
+func makeDirBlockChild(
+	children map[string]DirEntry, names []string) *DirBlock {
+	child := NewDirBlock().(*DirBlock)
+	for _, name := range names {
+		child.Children[name] = children[name]
+	}
+	return child
+}
+
+func encodedDirBlockChildSize(codec kbfscodec.Codec,
+	children map[string]DirEntry, names []string) (int, error) {
+	buf, err := codec.Encode(makeDirBlockChild(children, names))
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// splitDirBlockRange splits the given range in half, recursively,
+// until each piece fits within maxBytes or contains a single entry.
+// Empty ranges are dropped.
+func splitDirBlockRange(codec kbfscodec.Codec, children map[string]DirEntry,
+	r dirBlockRange, maxBytes int) ([]dirBlockRange, error) {
+	if len(r.names) == 0 {
+		return nil, nil
+	}
+	size, err := encodedDirBlockChildSize(codec, children, r.names)
+	if err != nil {
+		return nil, err
+	}
+	r.size = size
+	if size <= maxBytes || len(r.names) == 1 {
+		return []dirBlockRange{r}, nil
+	}
+
+	mid := len(r.names) / 2
+	left, err := splitDirBlockRange(codec, children,
+		dirBlockRange{off: r.off, names: r.names[:mid]}, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	right, err := splitDirBlockRange(codec, children,
+		dirBlockRange{off: r.names[mid], names: r.names[mid:]}, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// splitDirBlock divides the entries of the given direct or assembled
+// directory block into ranges, each of which encodes to at most
+// maxBytes (unless it holds a single larger entry).  The boundaries
+// of an assembled block are kept where possible, so that child blocks
+// whose entries haven't changed can be reused; ranges that become
+// too big are split in half, and neighboring ranges that become
+// small are merged.  The first range always starts at the empty
+// name.
+//
+// If unchangedSize is non-nil, it is consulted for each range of an
+// assembled block, and ranges it reports as unchanged are kept
+// without being encoded, so that the cost of a change is
+// proportional to the size of the changed child blocks rather than
+// the whole directory.
+func splitDirBlock(codec kbfscodec.Codec, dblock *DirBlock,
+	maxBytes int, unchangedSize dirBlockUnchangedSizer) (
+	[]dirBlockRange, error) {
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	offs := []string{""}
+	for i, iptr := range dblock.IPtrs {
+		if i > 0 {
+			offs = append(offs, iptr.Off)
+		}
+	}
+
+	var ranges []dirBlockRange
+	start := 0
+	for i, off := range offs {
+		end := len(names)
+		if i+1 < len(offs) {
+			end = start + sort.SearchStrings(names[start:], offs[i+1])
+		}
+		if unchangedSize != nil && end > start {
+			size, unchanged, err := unchangedSize(off, names[start:end])
+			if err != nil {
+				return nil, err
+			}
+			if unchanged && size <= maxBytes {
+				ranges = append(ranges, dirBlockRange{
+					off:       off,
+					names:     names[start:end],
+					size:      size,
+					unchanged: true,
+				})
+				start = end
+				continue
+			}
+		}
+		split, err := splitDirBlockRange(codec, dblock.Children,
+			dirBlockRange{off: off, names: names[start:end]}, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, split...)
+		start = end
+	}
+
+	var merged []dirBlockRange
+	for _, r := range ranges {
+		n := len(merged)
+		if n == 0 || merged[n-1].size+r.size > maxBytes/2 {
+			merged = append(merged, r)
+			continue
+		}
+		names := make([]string, 0, len(merged[n-1].names)+len(r.names))
+		names = append(names, merged[n-1].names...)
+		names = append(names, r.names...)
+		size, err := encodedDirBlockChildSize(codec, dblock.Children, names)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBytes/2 {
+			merged = append(merged, r)
+			continue
+		}
+		merged[n-1].names = names
+		merged[n-1].size = size
+		merged[n-1].unchanged = false
+	}
+
+	if len(merged) == 0 {
+		size, err := encodedDirBlockChildSize(codec, dblock.Children, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []dirBlockRange{{size: size}}, nil
+	}
+	if merged[0].off != "" {
+		// The first child block must start at the empty name, so
+		// it can't be reused under a different offset.
+		merged[0].off = ""
+		merged[0].unchanged = false
+	}
+	return merged, nil
+}
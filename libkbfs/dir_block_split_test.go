@@ -0,0 +1,183 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/require"
+)
+
+func makeDirBlockWithEntries(t *testing.T, n int) *DirBlock {
+	dblock := NewDirBlock().(*DirBlock)
+	for i := 0; i < n; i++ {
+		dblock.Children[fmt.Sprintf("entry%03d", i)] = DirEntry{
+			BlockInfo: BlockInfo{BlockPointer: makeFakeBlockPointer(t)},
+			EntryInfo: EntryInfo{Type: File, Size: uint64(i)},
+		}
+	}
+	return dblock
+}
+
+// checkDirBlockRanges checks that the given ranges are in order,
+// cover all the entries of dblock, and are each small enough.
+func checkDirBlockRanges(t *testing.T, codec kbfscodec.Codec,
+	dblock *DirBlock, ranges []dirBlockRange, maxBytes int) {
+	require.NotEmpty(t, ranges)
+	require.Equal(t, "", ranges[0].off)
+	var names []string
+	for i, r := range ranges {
+		require.NotEmpty(t, r.names)
+		if i > 0 {
+			require.True(t, ranges[i-1].off < r.off)
+			require.True(t, r.off <= r.names[0])
+		}
+		size, err := encodedDirBlockChildSize(codec, dblock.Children, r.names)
+		require.NoError(t, err)
+		require.Equal(t, size, r.size)
+		require.True(t, r.size <= maxBytes)
+		names = append(names, r.names...)
+	}
+	require.Len(t, names, len(dblock.Children))
+	for i, name := range names {
+		_, ok := dblock.Children[name]
+		require.True(t, ok)
+		if i > 0 {
+			require.True(t, names[i-1] < name)
+		}
+	}
+}
+
+func TestSplitDirBlockSmall(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	dblock := makeDirBlockWithEntries(t, 3)
+	ranges, err := splitDirBlock(codec, dblock, 4096, nil)
+	require.NoError(t, err)
+	require.Len(t, ranges, 1)
+	checkDirBlockRanges(t, codec, dblock, ranges, 4096)
+
+	// An empty directory still gets a single (empty) range.
+	ranges, err = splitDirBlock(codec, NewDirBlock().(*DirBlock), 4096, nil)
+	require.NoError(t, err)
+	require.Len(t, ranges, 1)
+	require.Equal(t, "", ranges[0].off)
+	require.Empty(t, ranges[0].names)
+}
+
+func TestSplitDirBlockLarge(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	dblock := makeDirBlockWithEntries(t, 100)
+	maxBytes := 1024
+	ranges, err := splitDirBlock(codec, dblock, maxBytes, nil)
+	require.NoError(t, err)
+	require.True(t, len(ranges) > 1)
+	checkDirBlockRanges(t, codec, dblock, ranges, maxBytes)
+}
+
+func TestSplitDirBlockKeepsBoundaries(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	dblock := makeDirBlockWithEntries(t, 100)
+	maxBytes := 1024
+	ranges, err := splitDirBlock(codec, dblock, maxBytes, nil)
+	require.NoError(t, err)
+	require.True(t, len(ranges) > 2)
+
+	// Make an assembled block out of the ranges, and add a new
+	// entry to the second range.
+	for _, r := range ranges {
+		dblock.IPtrs = append(dblock.IPtrs, IndirectDirPtr{
+			BlockInfo: BlockInfo{BlockPointer: makeFakeBlockPointer(t)},
+			Off:       r.off,
+		})
+	}
+	newName := ranges[1].names[0] + "a"
+	dblock.Children[newName] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: makeFakeBlockPointer(t)},
+		EntryInfo: EntryInfo{Type: File},
+	}
+
+	newRanges, err := splitDirBlock(codec, dblock, maxBytes, nil)
+	require.NoError(t, err)
+	checkDirBlockRanges(t, codec, dblock, newRanges, maxBytes)
+
+	// Every range other than the changed one (and any it was split
+	// into) should be exactly the same as before.
+	oldByOff := make(map[string]dirBlockRange)
+	for _, r := range ranges {
+		oldByOff[r.off] = r
+	}
+	unchanged := 0
+	for _, r := range newRanges {
+		old, ok := oldByOff[r.off]
+		if !ok || r.off == ranges[1].off {
+			continue
+		}
+		require.Equal(t, old.names, r.names)
+		unchanged++
+	}
+	require.Equal(t, len(ranges)-1, unchanged)
+}
+
+// countingCodec counts the number of directory entries encoded
+// through it.
+type countingCodec struct {
+	kbfscodec.Codec
+	entries int
+}
+
+func (c *countingCodec) Encode(obj interface{}) ([]byte, error) {
+	if dblock, ok := obj.(*DirBlock); ok {
+		c.entries += len(dblock.Children)
+	}
+	return c.Codec.Encode(obj)
+}
+
+func TestSplitDirBlockSkipsUnchanged(t *testing.T) {
+	codec := &countingCodec{Codec: kbfscodec.NewMsgpack()}
+	dblock := makeDirBlockWithEntries(t, 100)
+	maxBytes := 1024
+	ranges, err := splitDirBlock(codec, dblock, maxBytes, nil)
+	require.NoError(t, err)
+	require.True(t, len(ranges) > 2)
+
+	oldByOff := make(map[string]dirBlockRange)
+	for _, r := range ranges {
+		dblock.IPtrs = append(dblock.IPtrs, IndirectDirPtr{
+			BlockInfo: BlockInfo{BlockPointer: makeFakeBlockPointer(t)},
+			Off:       r.off,
+			PlainSize: r.size,
+		})
+		oldByOff[r.off] = r
+	}
+	newName := ranges[1].names[0] + "a"
+	dblock.Children[newName] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: makeFakeBlockPointer(t)},
+		EntryInfo: EntryInfo{Type: File},
+	}
+
+	// Only the second range has changed.
+	unchangedSize := func(off string, names []string) (int, bool, error) {
+		old := oldByOff[off]
+		if len(old.names) != len(names) {
+			return 0, false, nil
+		}
+		return old.size, true, nil
+	}
+	codec.entries = 0
+	newRanges, err := splitDirBlock(codec, dblock, maxBytes, unchangedSize)
+	require.NoError(t, err)
+	checkDirBlockRanges(t, codec.Codec, dblock, newRanges, maxBytes)
+
+	for _, r := range newRanges {
+		_, existed := oldByOff[r.off]
+		require.Equal(t, existed && r.off != ranges[1].off, r.unchanged)
+	}
+	// Only the changed range should have been encoded, at most a
+	// few times over while it was being split.
+	require.True(t, codec.entries <= 4*(len(ranges[1].names)+1),
+		"encoded %d entries", codec.entries)
+}
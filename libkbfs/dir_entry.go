@@ -4,13 +4,61 @@
 
 package libkbfs
 
-import "github.com/keybase/go-codec/codec"
+import (
+	"encoding/hex"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscrypto"
+)
+
+const (
+	// maxXattrNameBytes is the maximum length of the name of an
+	// extended attribute.
+	maxXattrNameBytes = 255
+	// maxXattrsBytes is the maximum total size of the names and
+	// values of all the extended attributes of a single entry.
+	maxXattrsBytes = 64 * 1024
+)
 
 // DirEntry is all the data info a directory know about its child.
 type DirEntry struct {
 	BlockInfo
 	EntryInfo
 
+	// Xattrs holds the extended attributes of this entry, by
+	// name.  Like the rest of the entry, they are encrypted along
+	// with the directory block that contains them.
+	Xattrs map[string][]byte `codec:"x,omitempty"`
+
+	// HardLinks holds the IDs of all the hard links to this
+	// entry, if it is the target of any.  Hard link targets only
+	// live in the hidden hard links directory at the root of the
+	// TLF.
+	HardLinks map[string]bool `codec:"hl,omitempty"`
+	// HardLinkTarget is set only for hard link entries, and names
+	// the target entry within the hard links directory.  Hard link
+	// entries have no blocks of their own.
+	HardLinkTarget string `codec:"ht,omitempty"`
+	// HardLinkID is the ID of this hard link within the
+	// HardLinks of its target.
+	HardLinkID string `codec:"hi,omitempty"`
+
+	// TrashPath is set only for entries in the hidden trash
+	// directory, and is the TLF-relative path the entry had
+	// before it was removed.
+	TrashPath string `codec:"tp,omitempty"`
+	// TrashTime is when the entry was removed, in Unix
+	// nanoseconds.
+	TrashTime int64 `codec:"tt,omitempty"`
+	// TrashWriter is the user that removed the entry.
+	TrashWriter keybase1.UID `codec:"tw,omitempty"`
+	// TrashExpiry is when the entry can be purged from the trash,
+	// in Unix nanoseconds.  It comes from the trash retention of
+	// the device that removed the entry, so that every writer
+	// purges it at the same time.
+	TrashExpiry int64 `codec:"te,omitempty"`
+
 	codec.UnknownFieldSetHandler
 }
 
@@ -18,3 +66,84 @@ type DirEntry struct {
 func (de *DirEntry) IsInitialized() bool {
 	return de.BlockPointer.IsInitialized()
 }
+
+// xattrsSize returns the total size of the names and values of the
+// given extended attributes.
+func xattrsSize(xattrs map[string][]byte) int {
+	size := 0
+	for name, value := range xattrs {
+		size += len(name) + len(value)
+	}
+	return size
+}
+
+// copyXattrs returns a copy of the given extended attributes, which
+// is safe to modify.
+func copyXattrs(xattrs map[string][]byte) map[string][]byte {
+	newXattrs := make(map[string][]byte, len(xattrs))
+	for name, value := range xattrs {
+		newXattrs[name] = value
+	}
+	return newXattrs
+}
+
+// isHardLink returns true if this DirEntry is a hard link to an
+// entry in the hard links directory.
+func (de *DirEntry) isHardLink() bool {
+	return de.HardLinkTarget != ""
+}
+
+// setHardLinks sets the IDs of the hard links to this entry, keeping
+// its link count in sync.
+func (de *DirEntry) setHardLinks(links map[string]bool) {
+	if len(links) == 0 {
+		de.HardLinks = nil
+		de.Nlink = 0
+		return
+	}
+	de.HardLinks = links
+	de.Nlink = uint32(len(links))
+}
+
+// copyHardLinks returns a copy of the given hard link IDs, which is
+// safe to modify.
+func copyHardLinks(links map[string]bool) map[string]bool {
+	newLinks := make(map[string]bool, len(links))
+	for id := range links {
+		newLinks[id] = true
+	}
+	return newLinks
+}
+
+// makeHardLinkID returns a new random ID, suitable for naming a hard
+// link, its target within the hard links directory, or a removed
+// entry within the trash directory.
+func makeHardLinkID() (string, error) {
+	var id [16]byte
+	err := kbfscrypto.RandRead(id[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// isTrashed returns true if this DirEntry is a removed entry in the
+// trash directory.
+func (de *DirEntry) isTrashed() bool {
+	return de.TrashPath != ""
+}
+
+// makeHardLinkEntry returns a new hard link entry, with the given
+// ID, pointing to the given target.
+func makeHardLinkEntry(target DirEntry, targetName, id string,
+	now int64) DirEntry {
+	return DirEntry{
+		EntryInfo: EntryInfo{
+			Type:  target.Type,
+			Mtime: now,
+			Ctime: now,
+		},
+		HardLinkTarget: targetName,
+		HardLinkID:     id,
+	}
+}
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"testing"
 
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfscodec"
 )
@@ -34,7 +35,16 @@ func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
 				"fake sym path",
 				101,
 				102,
+				0,
 			},
+			map[string][]byte{"user.fake": []byte("fake value")},
+			map[string]bool{"fake link id": true},
+			"",
+			"",
+			"fake/trash/path",
+			103,
+			keybase1.MakeTestUID(1),
+			104,
 			codec.UnknownFieldSetHandler{},
 		},
 		kbfscodec.MakeExtraOrBust("dirEntry", t),
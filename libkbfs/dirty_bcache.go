@@ -141,6 +141,10 @@ type DirtyBlockCacheStandard struct {
 	// to avoid keeping it too high as network conditions change?
 	resetBufferCapTime time.Duration
 
+	// The timeout for background tasks; write requests are never
+	// made to wait for more than half of it.
+	backgroundTaskTimeout time.Duration
+
 	shutdownLock sync.RWMutex
 	isShutdown   bool
 
@@ -175,6 +179,8 @@ func NewDirtyBlockCacheStandard(clock Clock,
 		maxSyncBufCap:      maxSyncBufCap,
 		syncBufferCap:      startSyncBufCap,
 		resetBufferCapTime: resetBufferCapTimeDefault,
+
+		backgroundTaskTimeout: backgroundTaskTimeoutDefault,
 	}
 	d.reqWg.Add(1)
 	go d.processPermission()
@@ -503,7 +509,7 @@ func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
 	c := make(chan struct{})
 	now := d.clock.Now()
 	deadline, ok := ctx.Deadline()
-	defaultDeadline := now.Add(backgroundTaskTimeout / 2)
+	defaultDeadline := now.Add(d.backgroundTaskTimeout / 2)
 	if !ok || deadline.After(defaultDeadline) {
 		// Use half of the background task timeout, to make sure we
 		// never get close to a timeout in a background task.
@@ -0,0 +1,442 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"container/list"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// diskBlockCacheConfig is the subset of the Config interface needed
+// by DiskBlockCacheStandard (for ease of testing).
+type diskBlockCacheConfig interface {
+	Codec() kbfscodec.Codec
+	cryptoPure() cryptoPure
+	Clock() Clock
+	MakeLogger(module string) logger.Logger
+}
+
+// diskBlockCacheConfigAdapter is an adapter for Config objects to the
+// diskBlockCacheConfig interface.
+type diskBlockCacheConfigAdapter struct {
+	Config
+}
+
+func (ca diskBlockCacheConfigAdapter) cryptoPure() cryptoPure {
+	return ca.Config.Crypto()
+}
+
+// diskBlockCacheEntryInfo is the per-block metadata that is stored
+// alongside the cached block data, so that the LRU ordering survives
+// restarts.
+type diskBlockCacheEntryInfo struct {
+	// TlfID is the TLF the block was fetched for.
+	TlfID tlf.ID
+	// LastUsed is the time (in UnixNano) at which the block was
+	// last put or fetched.
+	LastUsed int64
+
+	codec.UnknownFieldSetHandler
+}
+
+// diskBlockCacheEntry is an in-memory LRU element for a cached block.
+type diskBlockCacheEntry struct {
+	id   BlockID
+	size int64
+	info diskBlockCacheEntryInfo
+}
+
+// diskBlockCacheEntriesByLastUsed sorts entries with the most
+// recently used first.
+type diskBlockCacheEntriesByLastUsed []*diskBlockCacheEntry
+
+func (e diskBlockCacheEntriesByLastUsed) Len() int {
+	return len(e)
+}
+
+func (e diskBlockCacheEntriesByLastUsed) Less(i, j int) bool {
+	return e[i].info.LastUsed > e[j].info.LastUsed
+}
+
+func (e diskBlockCacheEntriesByLastUsed) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+const (
+	diskBlockCacheInfoFilename = "info"
+	// diskBlockCacheInfoFlushBatch is how many entries can have an
+	// out-of-date LastUsed on disk before Get writes them all out.
+	diskBlockCacheInfoFlushBatch = 100
+)
+
+// DiskBlockCacheStatus represents the status of the disk block cache,
+// suitable for encoding directly into JSON.
+type DiskBlockCacheStatus struct {
+	NumBlocks int
+	CurrBytes int64
+	MaxBytes  int64
+}
+
+var errDiskBlockCacheShutdown = errors.New("DiskBlockCache is shutdown")
+
+// DiskBlockCacheStandard implements the DiskBlockCache interface by
+// storing encrypted blocks in a blockDiskStore (without any
+// references), and evicting the least-recently-used blocks whenever
+// the total size of the cached data would exceed its byte limit.
+//
+// In addition to the files used by blockDiskStore, each block
+// directory contains an "info" file, which is a serialized
+// diskBlockCacheEntryInfo.
+type DiskBlockCacheStandard struct {
+	codec    kbfscodec.Codec
+	clock    Clock
+	log      logger.Logger
+	maxBytes int64
+
+	lock sync.Mutex
+	// store is nil after Shutdown() is called.
+	store     *blockDiskStore
+	entries   map[BlockID]*list.Element
+	lru       *list.List // front is most recently used
+	currBytes int64
+	// dirtyInfos holds the IDs of the entries whose LastUsed has
+	// changed since their info was last written to disk.
+	dirtyInfos map[BlockID]bool
+}
+
+var _ DiskBlockCache = (*DiskBlockCacheStandard)(nil)
+
+// newDiskBlockCacheStandard constructs a new DiskBlockCacheStandard
+// that stores its data in the given directory, and holds at most
+// maxBytes of block data.  It loads the index of any blocks already
+// stored in the directory.
+func newDiskBlockCacheStandard(config diskBlockCacheConfig, dirPath string,
+	maxBytes int64) (*DiskBlockCacheStandard, error) {
+	cache := &DiskBlockCacheStandard{
+		codec:    config.Codec(),
+		clock:    config.Clock(),
+		log:      config.MakeLogger("DBC"),
+		maxBytes: maxBytes,
+		store: makeBlockDiskStore(
+			config.Codec(), config.cryptoPure(), dirPath),
+		entries:    make(map[BlockID]*list.Element),
+		lru:        list.New(),
+		dirtyInfos: make(map[BlockID]bool),
+	}
+	err := cache.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// NewDiskBlockCacheStandard constructs a new DiskBlockCacheStandard
+// that stores its data in the given directory, and holds at most
+// maxBytes of block data.
+func NewDiskBlockCacheStandard(config Config, dirPath string,
+	maxBytes int64) (*DiskBlockCacheStandard, error) {
+	return newDiskBlockCacheStandard(
+		diskBlockCacheConfigAdapter{config}, dirPath, maxBytes)
+}
+
+func (cache *DiskBlockCacheStandard) infoPath(id BlockID) string {
+	return filepath.Join(
+		cache.store.blockPath(id), diskBlockCacheInfoFilename)
+}
+
+func (cache *DiskBlockCacheStandard) getInfo(id BlockID) (
+	diskBlockCacheEntryInfo, error) {
+	var info diskBlockCacheEntryInfo
+	err := kbfscodec.DeserializeFromFile(
+		cache.codec, cache.infoPath(id), &info)
+	if err != nil {
+		return diskBlockCacheEntryInfo{}, err
+	}
+	return info, nil
+}
+
+func (cache *DiskBlockCacheStandard) putInfo(
+	id BlockID, info diskBlockCacheEntryInfo) error {
+	return kbfscodec.SerializeToFile(cache.codec, info, cache.infoPath(id))
+}
+
+// loadIndex rebuilds the in-memory LRU index from the blocks stored
+// on disk.  Blocks without complete data or info are removed.
+func (cache *DiskBlockCacheStandard) loadIndex() error {
+	var entries []*diskBlockCacheEntry
+	var badIDs []BlockID
+	err := cache.store.forEachBlockID(func(id BlockID) error {
+		size, err := cache.store.getDataSize(id)
+		if err != nil {
+			return err
+		}
+		info, err := cache.getInfo(id)
+		if size == 0 || err != nil {
+			// Probably an interrupted put; just clean it up.
+			badIDs = append(badIDs, id)
+			return nil
+		}
+		entries = append(entries, &diskBlockCacheEntry{
+			id:   id,
+			size: size,
+			info: info,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range badIDs {
+		cache.log.Debug("Removing incomplete cached block %s", id)
+		if err := cache.store.remove(id); err != nil {
+			return err
+		}
+	}
+
+	sort.Sort(diskBlockCacheEntriesByLastUsed(entries))
+	for _, e := range entries {
+		cache.entries[e.id] = cache.lru.PushBack(e)
+		cache.currBytes += e.size
+	}
+	cache.log.Debug("Loaded %d cached blocks (%d bytes)",
+		len(entries), cache.currBytes)
+	return cache.evictLocked(0)
+}
+
+// removeLocked removes the given LRU element and its on-disk data.
+// cache.lock must be held.
+func (cache *DiskBlockCacheStandard) removeLocked(elem *list.Element) error {
+	e := elem.Value.(*diskBlockCacheEntry)
+	err := cache.store.remove(e.id)
+	if err != nil {
+		return err
+	}
+	cache.lru.Remove(elem)
+	delete(cache.entries, e.id)
+	delete(cache.dirtyInfos, e.id)
+	cache.currBytes -= e.size
+	return nil
+}
+
+// flushInfosLocked writes out the info of every entry whose LastUsed
+// has changed since it was last written.  cache.lock must be held.
+func (cache *DiskBlockCacheStandard) flushInfosLocked() error {
+	for id := range cache.dirtyInfos {
+		elem, ok := cache.entries[id]
+		if ok {
+			err := cache.putInfo(
+				id, elem.Value.(*diskBlockCacheEntry).info)
+			if err != nil {
+				return err
+			}
+		}
+		delete(cache.dirtyInfos, id)
+	}
+	return nil
+}
+
+// evictLocked evicts the least-recently-used blocks until there is
+// room for the given number of additional bytes.  cache.lock must be
+// held.
+func (cache *DiskBlockCacheStandard) evictLocked(newBytes int64) error {
+	for cache.currBytes+newBytes > cache.maxBytes {
+		elem := cache.lru.Back()
+		if elem == nil {
+			break
+		}
+		err := cache.removeLocked(elem)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Get(ctx context.Context, tlfID tlf.ID,
+	blockID BlockID) ([]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	cache.lock.Lock()
+	store := cache.store
+	if store == nil {
+		cache.lock.Unlock()
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			errDiskBlockCacheShutdown
+	}
+	elem, ok := cache.entries[blockID]
+	if ok && elem.Value.(*diskBlockCacheEntry).info.TlfID != tlfID {
+		// Only serve blocks to the TLF they were fetched for.
+		ok = false
+	}
+	cache.lock.Unlock()
+	if !ok {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			NoSuchBlockError{blockID}
+	}
+
+	// Read the data without holding the lock, so that Gets don't
+	// wait on each other's disk reads.  If the block is evicted in
+	// the meantime, the read just fails.
+	buf, serverHalf, err := store.getData(blockID)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.store == nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			errDiskBlockCacheShutdown
+	}
+	current := cache.entries[blockID] == elem
+	if err != nil {
+		// The cached data is missing or corrupt, so forget
+		// about it and let the caller fetch it again.
+		if current {
+			cache.log.CDebugf(ctx, "Removing unreadable cached "+
+				"block %s: %v", blockID, err)
+			if rmErr := cache.removeLocked(elem); rmErr != nil {
+				return nil, kbfscrypto.BlockCryptKeyServerHalf{}, rmErr
+			}
+		}
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			NoSuchBlockError{blockID}
+	}
+	if !current {
+		// Evicted after a successful read; the data is still good.
+		return buf, serverHalf, nil
+	}
+
+	// Only update LastUsed in memory, and write it out in batches,
+	// so that cache hits don't each cost a disk write.
+	e := elem.Value.(*diskBlockCacheEntry)
+	e.info.LastUsed = cache.clock.Now().UnixNano()
+	cache.lru.MoveToFront(elem)
+	cache.dirtyInfos[blockID] = true
+	if len(cache.dirtyInfos) >= diskBlockCacheInfoFlushBatch {
+		if err := cache.flushInfosLocked(); err != nil {
+			cache.log.CDebugf(ctx, "Couldn't write cached block "+
+				"infos: %v", err)
+		}
+	}
+	return buf, serverHalf, nil
+}
+
+// Put implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Put(ctx context.Context, tlfID tlf.ID,
+	blockID BlockID, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.store == nil {
+		return errDiskBlockCacheShutdown
+	}
+
+	size := int64(len(buf))
+	if size > cache.maxBytes {
+		// Never going to fit, so don't bother evicting anything.
+		return nil
+	}
+
+	info := diskBlockCacheEntryInfo{
+		TlfID:    tlfID,
+		LastUsed: cache.clock.Now().UnixNano(),
+	}
+
+	if elem, ok := cache.entries[blockID]; ok {
+		// Blocks are immutable, so just bump it in the LRU.
+		elem.Value.(*diskBlockCacheEntry).info = info
+		cache.lru.MoveToFront(elem)
+		delete(cache.dirtyInfos, blockID)
+		return cache.putInfo(blockID, info)
+	}
+
+	err := cache.store.crypto.VerifyBlockID(buf, blockID)
+	if err != nil {
+		return err
+	}
+
+	err = cache.evictLocked(size)
+	if err != nil {
+		return err
+	}
+
+	err = cache.store.putData(blockID, buf, serverHalf)
+	if err != nil {
+		return err
+	}
+	err = cache.putInfo(blockID, info)
+	if err != nil {
+		return err
+	}
+
+	cache.entries[blockID] = cache.lru.PushFront(&diskBlockCacheEntry{
+		id:   blockID,
+		size: size,
+		info: info,
+	})
+	cache.currBytes += size
+	return nil
+}
+
+// Delete implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Delete(
+	ctx context.Context, blockIDs []BlockID) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.store == nil {
+		return errDiskBlockCacheShutdown
+	}
+
+	for _, id := range blockIDs {
+		elem, ok := cache.entries[id]
+		if !ok {
+			continue
+		}
+		err := cache.removeLocked(elem)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Status() DiskBlockCacheStatus {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return DiskBlockCacheStatus{
+		NumBlocks: len(cache.entries),
+		CurrBytes: cache.currBytes,
+		MaxBytes:  cache.maxBytes,
+	}
+}
+
+// Shutdown implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) Shutdown() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.store == nil {
+		return
+	}
+	if err := cache.flushInfosLocked(); err != nil {
+		cache.log.Debug("Couldn't write cached block infos: %v", err)
+	}
+	cache.store = nil
+	cache.entries = nil
+	cache.lru = nil
+}
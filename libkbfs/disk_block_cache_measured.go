@@ -0,0 +1,95 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// DiskBlockCacheMeasured delegates to another DiskBlockCache instance
+// but also keeps track of stats.
+type DiskBlockCacheMeasured struct {
+	delegate       DiskBlockCache
+	getTimer       metrics.Timer
+	putTimer       metrics.Timer
+	deleteTimer    metrics.Timer
+	hitCountMeter  metrics.Meter
+	missCountMeter metrics.Meter
+}
+
+var _ DiskBlockCache = DiskBlockCacheMeasured{}
+
+// NewDiskBlockCacheMeasured creates and returns a new
+// DiskBlockCacheMeasured instance with the given delegate and
+// registry.
+func NewDiskBlockCacheMeasured(
+	delegate DiskBlockCache, r metrics.Registry) DiskBlockCacheMeasured {
+	getTimer := metrics.GetOrRegisterTimer("DiskBlockCache.Get", r)
+	putTimer := metrics.GetOrRegisterTimer("DiskBlockCache.Put", r)
+	deleteTimer := metrics.GetOrRegisterTimer("DiskBlockCache.Delete", r)
+	hitCountMeter := metrics.GetOrRegisterMeter("DiskBlockCache.HitCount", r)
+	missCountMeter := metrics.GetOrRegisterMeter(
+		"DiskBlockCache.MissCount", r)
+	return DiskBlockCacheMeasured{
+		delegate:       delegate,
+		getTimer:       getTimer,
+		putTimer:       putTimer,
+		deleteTimer:    deleteTimer,
+		hitCountMeter:  hitCountMeter,
+		missCountMeter: missCountMeter,
+	}
+}
+
+// Get implements the DiskBlockCache interface for
+// DiskBlockCacheMeasured.
+func (b DiskBlockCacheMeasured) Get(ctx context.Context, tlfID tlf.ID,
+	blockID BlockID) (buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf, err error) {
+	b.getTimer.Time(func() {
+		buf, serverHalf, err = b.delegate.Get(ctx, tlfID, blockID)
+	})
+	if err == nil {
+		b.hitCountMeter.Mark(1)
+	} else {
+		b.missCountMeter.Mark(1)
+	}
+	return buf, serverHalf, err
+}
+
+// Put implements the DiskBlockCache interface for
+// DiskBlockCacheMeasured.
+func (b DiskBlockCacheMeasured) Put(ctx context.Context, tlfID tlf.ID,
+	blockID BlockID, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) (err error) {
+	b.putTimer.Time(func() {
+		err = b.delegate.Put(ctx, tlfID, blockID, buf, serverHalf)
+	})
+	return err
+}
+
+// Delete implements the DiskBlockCache interface for
+// DiskBlockCacheMeasured.
+func (b DiskBlockCacheMeasured) Delete(
+	ctx context.Context, blockIDs []BlockID) (err error) {
+	b.deleteTimer.Time(func() {
+		err = b.delegate.Delete(ctx, blockIDs)
+	})
+	return err
+}
+
+// Status implements the DiskBlockCache interface for
+// DiskBlockCacheMeasured.
+func (b DiskBlockCacheMeasured) Status() DiskBlockCacheStatus {
+	return b.delegate.Status()
+}
+
+// Shutdown implements the DiskBlockCache interface for
+// DiskBlockCacheMeasured.
+func (b DiskBlockCacheMeasured) Shutdown() {
+	b.delegate.Shutdown()
+}
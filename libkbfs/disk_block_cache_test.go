@@ -0,0 +1,258 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testDiskBlockCacheConfig struct {
+	t      *testing.T
+	codec  kbfscodec.Codec
+	crypto cryptoPure
+	clock  *TestClock
+}
+
+func newTestDiskBlockCacheConfig(t *testing.T) testDiskBlockCacheConfig {
+	codec := kbfscodec.NewMsgpack()
+	return testDiskBlockCacheConfig{
+		t:      t,
+		codec:  codec,
+		crypto: MakeCryptoCommon(codec),
+		clock:  newTestClockNow(),
+	}
+}
+
+func (c testDiskBlockCacheConfig) Codec() kbfscodec.Codec {
+	return c.codec
+}
+
+func (c testDiskBlockCacheConfig) cryptoPure() cryptoPure {
+	return c.crypto
+}
+
+func (c testDiskBlockCacheConfig) Clock() Clock {
+	return c.clock
+}
+
+func (c testDiskBlockCacheConfig) MakeLogger(module string) logger.Logger {
+	return logger.NewTestLogger(c.t)
+}
+
+func setupDiskBlockCacheTest(t *testing.T, maxBytes int64) (
+	tempdir string, config testDiskBlockCacheConfig,
+	cache *DiskBlockCacheStandard) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_block_cache")
+	require.NoError(t, err)
+	config = newTestDiskBlockCacheConfig(t)
+	cache, err = newDiskBlockCacheStandard(config, tempdir, maxBytes)
+	require.NoError(t, err)
+	return tempdir, config, cache
+}
+
+func teardownDiskBlockCacheTest(
+	t *testing.T, tempdir string, cache *DiskBlockCacheStandard) {
+	cache.Shutdown()
+	err := os.RemoveAll(tempdir)
+	require.NoError(t, err)
+}
+
+func putDiskBlockCacheBlock(t *testing.T, config testDiskBlockCacheConfig,
+	cache *DiskBlockCacheStandard, data []byte) (
+	BlockID, kbfscrypto.BlockCryptKeyServerHalf) {
+	id, err := config.crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := config.crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = cache.Put(context.Background(), tlf.FakeID(1, false), id, data,
+		serverHalf)
+	require.NoError(t, err)
+	return id, serverHalf
+}
+
+func getAndCheckDiskBlockCacheBlock(t *testing.T,
+	cache *DiskBlockCacheStandard, id BlockID, expectedData []byte,
+	expectedServerHalf kbfscrypto.BlockCryptKeyServerHalf) {
+	data, serverHalf, err := cache.Get(
+		context.Background(), tlf.FakeID(1, false), id)
+	require.NoError(t, err)
+	require.Equal(t, expectedData, data)
+	require.Equal(t, expectedServerHalf, serverHalf)
+}
+
+func requireDiskBlockCacheMiss(
+	t *testing.T, cache *DiskBlockCacheStandard, id BlockID) {
+	_, _, err := cache.Get(context.Background(), tlf.FakeID(1, false), id)
+	require.Equal(t, NoSuchBlockError{id}, err)
+}
+
+func TestDiskBlockCachePutGet(t *testing.T) {
+	tempdir, config, cache := setupDiskBlockCacheTest(t, 100)
+	defer teardownDiskBlockCacheTest(t, tempdir, cache)
+
+	data := []byte{1, 2, 3, 4}
+	id, serverHalf := putDiskBlockCacheBlock(t, config, cache, data)
+	getAndCheckDiskBlockCacheBlock(t, cache, id, data, serverHalf)
+
+	// Putting the same block again shouldn't change the size.
+	err := cache.Put(context.Background(), tlf.FakeID(1, false), id, data,
+		serverHalf)
+	require.NoError(t, err)
+	require.Equal(t, DiskBlockCacheStatus{
+		NumBlocks: 1,
+		CurrBytes: int64(len(data)),
+		MaxBytes:  100,
+	}, cache.Status())
+
+	err = cache.Delete(context.Background(), []BlockID{id})
+	require.NoError(t, err)
+	requireDiskBlockCacheMiss(t, cache, id)
+	require.Equal(t, 0, cache.Status().NumBlocks)
+}
+
+func TestDiskBlockCachePutBadID(t *testing.T) {
+	tempdir, config, cache := setupDiskBlockCacheTest(t, 100)
+	defer teardownDiskBlockCacheTest(t, tempdir, cache)
+
+	id, err := config.crypto.MakePermanentBlockID([]byte{1, 2, 3, 4})
+	require.NoError(t, err)
+	err = cache.Put(context.Background(), tlf.FakeID(1, false), id,
+		[]byte{5, 6, 7, 8}, kbfscrypto.BlockCryptKeyServerHalf{})
+	require.Error(t, err)
+	requireDiskBlockCacheMiss(t, cache, id)
+}
+
+func TestDiskBlockCacheEvictLRU(t *testing.T) {
+	tempdir, config, cache := setupDiskBlockCacheTest(t, 10)
+	defer teardownDiskBlockCacheTest(t, tempdir, cache)
+
+	data1 := []byte{1, 2, 3, 4}
+	id1, serverHalf1 := putDiskBlockCacheBlock(t, config, cache, data1)
+	config.clock.Add(time.Second)
+	data2 := []byte{5, 6, 7, 8}
+	id2, _ := putDiskBlockCacheBlock(t, config, cache, data2)
+	config.clock.Add(time.Second)
+
+	// Touch the first block so that the second one is the LRU.
+	getAndCheckDiskBlockCacheBlock(t, cache, id1, data1, serverHalf1)
+	config.clock.Add(time.Second)
+
+	data3 := []byte{9, 10, 11, 12}
+	id3, serverHalf3 := putDiskBlockCacheBlock(t, config, cache, data3)
+	requireDiskBlockCacheMiss(t, cache, id2)
+	getAndCheckDiskBlockCacheBlock(t, cache, id1, data1, serverHalf1)
+	getAndCheckDiskBlockCacheBlock(t, cache, id3, data3, serverHalf3)
+	require.Equal(t, int64(8), cache.Status().CurrBytes)
+
+	// A block bigger than the whole cache is silently dropped.
+	data4 := make([]byte, 11)
+	id4, _ := putDiskBlockCacheBlock(t, config, cache, data4)
+	requireDiskBlockCacheMiss(t, cache, id4)
+	require.Equal(t, 2, cache.Status().NumBlocks)
+}
+
+func TestDiskBlockCacheRestart(t *testing.T) {
+	tempdir, config, cache := setupDiskBlockCacheTest(t, 100)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	data1 := []byte{1, 2, 3, 4}
+	id1, serverHalf1 := putDiskBlockCacheBlock(t, config, cache, data1)
+	config.clock.Add(time.Second)
+	data2 := []byte{5, 6, 7, 8}
+	id2, serverHalf2 := putDiskBlockCacheBlock(t, config, cache, data2)
+	config.clock.Add(time.Second)
+	getAndCheckDiskBlockCacheBlock(t, cache, id1, data1, serverHalf1)
+	cache.Shutdown()
+
+	_, _, err := cache.Get(context.Background(), tlf.FakeID(1, false), id1)
+	require.Equal(t, errDiskBlockCacheShutdown, err)
+
+	// Restart with the same size; both blocks should still be there.
+	cache, err = newDiskBlockCacheStandard(config, tempdir, 100)
+	require.NoError(t, err)
+	require.Equal(t, 2, cache.Status().NumBlocks)
+	getAndCheckDiskBlockCacheBlock(t, cache, id2, data2, serverHalf2)
+	config.clock.Add(time.Second)
+	getAndCheckDiskBlockCacheBlock(t, cache, id1, data1, serverHalf1)
+	cache.Shutdown()
+
+	// Restart with a smaller limit; the LRU block should be evicted.
+	cache, err = newDiskBlockCacheStandard(config, tempdir, 4)
+	require.NoError(t, err)
+	defer cache.Shutdown()
+	require.Equal(t, 1, cache.Status().NumBlocks)
+	requireDiskBlockCacheMiss(t, cache, id2)
+	getAndCheckDiskBlockCacheBlock(t, cache, id1, data1, serverHalf1)
+}
+
+func TestDiskBlockCacheCorruptEntry(t *testing.T) {
+	tempdir, config, cache := setupDiskBlockCacheTest(t, 100)
+	defer teardownDiskBlockCacheTest(t, tempdir, cache)
+
+	data := []byte{1, 2, 3, 4}
+	id, _ := putDiskBlockCacheBlock(t, config, cache, data)
+
+	// Overwrite the data so that it no longer matches the ID.
+	err := ioutil.WriteFile(
+		filepath.Join(cache.store.blockPath(id), "data"),
+		[]byte{5, 6, 7, 8}, 0600)
+	require.NoError(t, err)
+
+	requireDiskBlockCacheMiss(t, cache, id)
+	require.Equal(t, DiskBlockCacheStatus{MaxBytes: 100}, cache.Status())
+}
+
+func TestDiskBlockCacheGetWrongTLF(t *testing.T) {
+	tempdir, config, cache := setupDiskBlockCacheTest(t, 100)
+	defer teardownDiskBlockCacheTest(t, tempdir, cache)
+
+	data := []byte{1, 2, 3, 4}
+	id, serverHalf := putDiskBlockCacheBlock(t, config, cache, data)
+	_, _, err := cache.Get(context.Background(), tlf.FakeID(2, false), id)
+	require.Equal(t, NoSuchBlockError{id}, err)
+	getAndCheckDiskBlockCacheBlock(t, cache, id, data, serverHalf)
+}
+
+func TestDiskBlockCacheLastUsedWrittenLazily(t *testing.T) {
+	tempdir, config, cache := setupDiskBlockCacheTest(t, 100)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	data := []byte{1, 2, 3, 4}
+	id, serverHalf := putDiskBlockCacheBlock(t, config, cache, data)
+	info, err := cache.getInfo(id)
+	require.NoError(t, err)
+	putTime := info.LastUsed
+
+	// A hit doesn't rewrite the info right away...
+	config.clock.Add(time.Second)
+	getAndCheckDiskBlockCacheBlock(t, cache, id, data, serverHalf)
+	info, err = cache.getInfo(id)
+	require.NoError(t, err)
+	require.Equal(t, putTime, info.LastUsed)
+
+	// ...but it's written out on shutdown.
+	infoPath := cache.infoPath(id)
+	cache.Shutdown()
+	err = kbfscodec.DeserializeFromFile(config.codec, infoPath, &info)
+	require.NoError(t, err)
+	require.Equal(t, config.clock.Now().UnixNano(), info.LastUsed)
+}
@@ -612,6 +612,18 @@ func (e UnknownEncryptionVer) Error() string {
 	return fmt.Sprintf("Unknown encryption version %d", int(e.ver))
 }
 
+// UnknownBlockCompressionError indicates that we can't decode a
+// block because it was compressed with an unknown type of
+// compression.
+type UnknownBlockCompressionError struct {
+	Type BlockCompressionType
+}
+
+// Error implements the error interface for UnknownBlockCompressionError.
+func (e UnknownBlockCompressionError) Error() string {
+	return fmt.Sprintf("Unknown block compression %s", e.Type)
+}
+
 // InvalidNonceError indicates that an invalid cryptographic nonce was
 // detected.
 type InvalidNonceError struct {
@@ -1159,3 +1171,255 @@ func (e TLFCryptKeyNotPerDeviceEncrypted) Error() string {
 	return fmt.Sprintf("TLF crypt key for %s at generation %d is not per-device encrypted",
 		e.tlf, e.keyGen)
 }
+
+// NoSuchXattrError indicates that the user tried to access an
+// extended attribute that doesn't exist.
+type NoSuchXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("Extended attribute %s doesn't exist", e.Name)
+}
+
+// XattrExistsError indicates that the user tried to create an
+// extended attribute that already exists.
+type XattrExistsError struct {
+	Name string
+}
+
+// Error implements the error interface for XattrExistsError.
+func (e XattrExistsError) Error() string {
+	return fmt.Sprintf("Extended attribute %s already exists", e.Name)
+}
+
+// XattrNameTooLongError indicates that the user tried to set an
+// extended attribute with a name bigger than KBFS's supported size.
+type XattrNameTooLongError struct {
+	name            string
+	maxAllowedBytes uint32
+}
+
+// Error implements the error interface for XattrNameTooLongError.
+func (e XattrNameTooLongError) Error() string {
+	return fmt.Sprintf("Extended attribute name %s has more than the "+
+		"maximum allowed number of bytes (%d)", e.name, e.maxAllowedBytes)
+}
+
+// XattrsTooBigError indicates that the user tried to set extended
+// attributes on an entry that would be bigger than KBFS's supported
+// size, in total.
+type XattrsTooBigError struct {
+	p               path
+	size            int
+	maxAllowedBytes int
+}
+
+// Error implements the error interface for XattrsTooBigError.
+func (e XattrsTooBigError) Error() string {
+	return fmt.Sprintf("Extended attributes of %s would have increased to "+
+		"%d bytes, which is over the supported limit of %d bytes", e.p,
+		e.size, e.maxAllowedBytes)
+}
+
+// JournalDiskLimitExceededError indicates that a block put was
+// rejected because the write journals are using up all the disk
+// space they are allowed.
+type JournalDiskLimitExceededError struct {
+	LimitBytes int64
+	UsedBytes  int64
+	PutBytes   int64
+}
+
+// Error implements the error interface for
+// JournalDiskLimitExceededError.
+func (e JournalDiskLimitExceededError) Error() string {
+	return fmt.Sprintf("Putting %d more bytes into the journal would go "+
+		"over the limit of %d bytes (%d bytes already used)",
+		e.PutBytes, e.LimitBytes, e.UsedBytes)
+}
+
+// MDRollbackError indicates that the mdserver returned a merged head
+// for a TLF that is older than the revision recorded for it in the
+// KBFS Merkle tree, which means the server may be trying to roll
+// back the TLF.  MerkleRevision is MetadataRevisionUninitialized if
+// the recorded revision couldn't be decrypted with the keys of the
+// head's key generation or any earlier one.
+type MDRollbackError struct {
+	Tlf            tlf.ID
+	HeadRevision   MetadataRevision
+	MerkleRevision MetadataRevision
+}
+
+// Error implements the error interface for MDRollbackError.
+func (e MDRollbackError) Error() string {
+	if e.HeadRevision == MetadataRevisionUninitialized {
+		return fmt.Sprintf("The server has no MD for TLF %s, but the "+
+			"Merkle tree has a leaf for it", e.Tlf)
+	} else if e.MerkleRevision == MetadataRevisionUninitialized {
+		return fmt.Sprintf("The server returned revision %d for TLF %s, "+
+			"but its Merkle leaf can't be read with the keys of that "+
+			"revision or earlier ones", e.HeadRevision, e.Tlf)
+	}
+	return fmt.Sprintf("The server returned revision %d for TLF %s, "+
+		"but the Merkle tree says revision %d exists", e.HeadRevision,
+		e.Tlf, e.MerkleRevision)
+}
+
+// MDForkError indicates that the mdserver returned MD for a TLF
+// revision that doesn't match the hash recorded for it in the KBFS
+// Merkle tree, which means the server may be showing different
+// histories to different clients.
+type MDForkError struct {
+	Tlf        tlf.ID
+	Revision   MetadataRevision
+	MDHash     MerkleHash
+	MerkleHash MerkleHash
+}
+
+// Error implements the error interface for MDForkError.
+func (e MDForkError) Error() string {
+	return fmt.Sprintf("The server returned MD with hash %s for revision "+
+		"%d of TLF %s, but the Merkle tree has hash %s", e.MDHash,
+		e.Revision, e.Tlf, e.MerkleHash)
+}
+
+// MerkleRootForkError indicates that the mdserver returned a root
+// of a KBFS Merkle tree that doesn't descend from the latest root of
+// that tree it returned before, which means the server may be rolling
+// back the tree or showing different histories to different clients.
+type MerkleRootForkError struct {
+	TreeID       keybase1.MerkleTreeID
+	SeqNo        int64
+	TrustedSeqNo int64
+}
+
+// Error implements the error interface for MerkleRootForkError.
+func (e MerkleRootForkError) Error() string {
+	return fmt.Sprintf("The server returned root %d of Merkle tree %s, "+
+		"which doesn't descend from root %d", e.SeqNo, e.TreeID,
+		e.TrustedSeqNo)
+}
+
+// WriteToReadonlyNodeError indicates an error when trying to write a
+// node that belongs to an archived, read-only view of a TLF.
+type WriteToReadonlyNodeError struct {
+	Filename string
+}
+
+// Error implements the error interface for WriteToReadonlyNodeError.
+func (e WriteToReadonlyNodeError) Error() string {
+	return fmt.Sprintf("Can't write to %s, which belongs to an archived "+
+		"revision of its folder", e.Filename)
+}
+
+// RevGarbageCollectedError indicates that a block needed to read an
+// archived revision of a TLF has already been deleted by quota
+// reclamation, so that revision can no longer be read in full.
+type RevGarbageCollectedError struct {
+	Tlf tlf.ID
+	Rev MetadataRevision
+	ID  BlockID
+}
+
+// Error implements the error interface for RevGarbageCollectedError.
+func (e RevGarbageCollectedError) Error() string {
+	return fmt.Sprintf("Block %s of revision %d of TLF %s has already "+
+		"been garbage-collected", e.ID, e.Rev, e.Tlf)
+}
+
+// OfflineUnjournaledError indicates an error when trying to write to
+// a TLF without a journal while the MD server can't be reached.
+type OfflineUnjournaledError struct {
+	Tlf tlf.ID
+}
+
+// Error implements the error interface for OfflineUnjournaledError.
+func (e OfflineUnjournaledError) Error() string {
+	return fmt.Sprintf("Can't write to TLF %s while offline, since it "+
+		"doesn't have a journal", e.Tlf)
+}
+
+// InvalidConflictChoiceError indicates that the name of a
+// ConflictChoice wasn't recognized.
+type InvalidConflictChoiceError struct {
+	Choice string
+}
+
+// Error implements the error interface for InvalidConflictChoiceError.
+func (e InvalidConflictChoiceError) Error() string {
+	return fmt.Sprintf("Invalid conflict choice %q; must be one of "+
+		"auto, mine, theirs or both", e.Choice)
+}
+
+// NoSuchFileVersionError indicates that a file has no version as of
+// the requested revision, for example because it was created later.
+type NoSuchFileVersionError struct {
+	Name string
+	Rev  MetadataRevision
+}
+
+// Error implements the error interface for NoSuchFileVersionError.
+func (e NoSuchFileVersionError) Error() string {
+	return fmt.Sprintf("%s has no version as of revision %d", e.Name, e.Rev)
+}
+
+// InvalidTlfArchiveError indicates that a TLF archive is corrupt or
+// truncated.
+type InvalidTlfArchiveError struct {
+	Reason string
+}
+
+// Error implements the error interface for InvalidTlfArchiveError.
+func (e InvalidTlfArchiveError) Error() string {
+	return fmt.Sprintf("Invalid TLF archive: %s", e.Reason)
+}
+
+// InvalidTuningConfigError indicates that a TuningConfig setting is
+// out of range.
+type InvalidTuningConfigError struct {
+	Setting string
+	Reason  string
+}
+
+// Error implements the error interface for InvalidTuningConfigError.
+func (e InvalidTuningConfigError) Error() string {
+	return fmt.Sprintf("Invalid tuning config: %s %s", e.Setting, e.Reason)
+}
+
+// TransactionInProgressError indicates that an operation isn't
+// allowed while a transaction is open on the given folder-branch.
+type TransactionInProgressError struct {
+	FolderBranch FolderBranch
+}
+
+// Error implements the error interface for TransactionInProgressError.
+func (e TransactionInProgressError) Error() string {
+	return fmt.Sprintf("A transaction is already open on %v", e.FolderBranch)
+}
+
+// NoTransactionError indicates that there is no open transaction to
+// commit or abort on the given folder-branch.
+type NoTransactionError struct {
+	FolderBranch FolderBranch
+}
+
+// Error implements the error interface for NoTransactionError.
+func (e NoTransactionError) Error() string {
+	return fmt.Sprintf("No transaction is open on %v", e.FolderBranch)
+}
+
+// NoWriteConflictError indicates that a conflict choice was given
+// for a path that this device's unmerged branch didn't write in
+// conflict with the merged branch.
+type NoWriteConflictError struct {
+	Path   string
+	Choice ConflictChoice
+}
+
+// Error implements the error interface for NoWriteConflictError.
+func (e NoWriteConflictError) Error() string {
+	return fmt.Sprintf("Can't choose %s for %q, since it wasn't written "+
+		"both on this device and in the merged branch", e.Choice, e.Path)
+}
@@ -132,3 +132,67 @@ var _ fuse.ErrorNumber = NoSuchFolderListError{}
 func (e NoSuchFolderListError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
+
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchXattrError.
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = XattrExistsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrExistsError.
+func (e XattrExistsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EEXIST)
+}
+
+var _ fuse.ErrorNumber = XattrNameTooLongError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrNameTooLongError.
+func (e XattrNameTooLongError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ERANGE)
+}
+
+var _ fuse.ErrorNumber = XattrsTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrsTooBigError.
+func (e XattrsTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOSPC)
+}
+
+var _ fuse.ErrorNumber = JournalDiskLimitExceededError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// JournalDiskLimitExceededError.
+func (e JournalDiskLimitExceededError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOSPC)
+}
+
+var _ fuse.ErrorNumber = WriteToReadonlyNodeError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// WriteToReadonlyNodeError.
+func (e WriteToReadonlyNodeError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = NoSuchFileVersionError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchFileVersionError.
+func (e NoSuchFileVersionError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
+
+var _ fuse.ErrorNumber = NoWriteConflictError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoWriteConflictError.
+func (e NoWriteConflictError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EINVAL)
+}
@@ -0,0 +1,316 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// copyLeafFileBlockLocked returns the info for a new reference to the
+// direct file block described by info, adding it to md and bps.  The
+// block is read, if needed, with kmd.  If live is non-nil, blocks
+// missing from it may have been archived, which the block server
+// doesn't allow new references to, so their data is duplicated into
+// new blocks instead.  New references to journaled blocks go through
+// the journal, which handles them as described in
+// journalBlockServer.AddBlockReference.
+func (fbo *folderBranchOps) copyLeafFileBlockLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, file path,
+	kmd KeyMetadata, info BlockInfo, live map[BlockID]bool,
+	bps *blockPutState) (BlockInfo, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if live != nil && !live[info.ID] {
+		fbo.log.CDebugf(ctx, "Duplicating data from block %v",
+			info.BlockPointer)
+		block, err := fbo.blocks.GetFileBlockForReading(ctx, lState,
+			kmd, info.BlockPointer, file.Branch, file)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+		newInfo, _, readyBlockData, err :=
+			ReadyBlock(ctx, fbo.config, md.ReadOnly(), block, uid)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+		bps.addNewBlock(newInfo.BlockPointer, block, readyBlockData, nil)
+		md.AddRefBlock(newInfo)
+		return newInfo, nil
+	}
+
+	refNonce, err := fbo.config.Crypto().MakeBlockRefNonce()
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	info.RefNonce = refNonce
+	info.SetWriter(uid)
+	bps.addNewBlock(info.BlockPointer, nil, ReadyBlockData{}, nil)
+	md.AddRefBlock(info)
+	return info, nil
+}
+
+// copyIndirectFileBlockLocked returns a copy of the given indirect
+// file block, in which every leaf pointer is a new reference to the
+// same data, and every indirect child block has been copied in the
+// same way and readied.  All new blocks and references are added to
+// md and bps, except for the returned block itself.  kmd and live
+// are as for copyLeafFileBlockLocked.
+func (fbo *folderBranchOps) copyIndirectFileBlockLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	uid keybase1.UID, file path, kmd KeyMetadata, fblock *FileBlock,
+	live map[BlockID]bool, bps *blockPutState) (*FileBlock, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	fblock, err := fblock.DeepCopy(fbo.config.Codec())
+	if err != nil {
+		return nil, err
+	}
+	for i, iptr := range fblock.IPtrs {
+		var child *FileBlock
+		if iptr.pointsToIndirectBlock() {
+			child, err = fbo.blocks.GetFileBlockForReading(ctx, lState,
+				kmd, iptr.BlockPointer, file.Branch, file)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if child == nil || !child.IsInd {
+			fblock.IPtrs[i].BlockInfo, err = fbo.copyLeafFileBlockLocked(
+				ctx, lState, md, uid, file, kmd, iptr.BlockInfo, live, bps)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		child, err = fbo.copyIndirectFileBlockLocked(
+			ctx, lState, md, uid, file, kmd, child, live, bps)
+		if err != nil {
+			return nil, err
+		}
+		info, _, err := fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), child, uid, bps)
+		if err != nil {
+			return nil, err
+		}
+		fblock.IPtrs[i].BlockInfo = info
+		md.AddRefBlock(info)
+	}
+	return fblock, nil
+}
+
+// syncNodeLocked syncs all the dirty data of file.
+func (fbo *folderBranchOps) syncNodeLocked(
+	ctx context.Context, lState *lockState, file Node) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	for {
+		filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+		if err != nil {
+			return err
+		}
+		stillDirty, err := fbo.syncLocked(ctx, lState, filePath)
+		if err != nil {
+			return err
+		}
+		if !stillDirty {
+			fbo.status.rmDirtyNode(file)
+			return nil
+		}
+	}
+}
+
+func (fbo *folderBranchOps) copyFileLocked(
+	ctx context.Context, lState *lockState, file Node, dir Node,
+	name string) (de DirEntry, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return DirEntry{}, err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return DirEntry{},
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	// The copy can only share blocks that have made it to the
+	// server, so sync any dirty data in the source first.
+	if err := fbo.syncNodeLocked(ctx, lState, file); err != nil {
+		return DirEntry{}, err
+	}
+
+	filename, err := fbo.canonicalPath(ctx, dir, name)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, filename)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if !filePath.hasValidParent() {
+		return DirEntry{}, NotFileError{filePath}
+	}
+	srcDe, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), filePath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if srcDe.Type != File && srcDe.Type != Exec {
+		return DirEntry{}, NotFileError{filePath}
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// does name already exist?
+	if _, ok := dblock.Children[name]; ok {
+		return DirEntry{}, NameExistsError{name}
+	}
+
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		return DirEntry{}, err
+	}
+
+	co, err := newCreateOp(name, dirPath.tailPointer(), srcDe.Type)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	md.AddOp(co)
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// Only the indirect blocks of the source need to be rewritten;
+	// all the data blocks are shared via new references.
+	fblock, err := fbo.blocks.GetFileBlockForReading(ctx, lState,
+		md.ReadOnly(), srcDe.BlockPointer, filePath.Branch, filePath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	copyBps := newBlockPutState(1)
+	var info BlockInfo
+	if fblock.IsInd {
+		fblock, err = fbo.copyIndirectFileBlockLocked(ctx, lState, md,
+			uid, filePath, md.ReadOnly(), fblock, nil, copyBps)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		info, _, err = fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), fblock, uid, copyBps)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		md.AddRefBlock(info)
+	} else {
+		info, err = fbo.copyLeafFileBlockLocked(ctx, lState, md, uid,
+			filePath, md.ReadOnly(), srcDe.BlockInfo, nil, copyBps)
+		if err != nil {
+			return DirEntry{}, err
+		}
+	}
+
+	now := fbo.nowUnixNano()
+	dblock.Children[name] = DirEntry{
+		BlockInfo: info,
+		EntryInfo: EntryInfo{
+			Type:  srcDe.Type,
+			Size:  srcDe.Size,
+			Mtime: now,
+			Ctime: now,
+		},
+	}
+
+	_, _, bps, err := fbo.syncBlockAndCheckEmbedLocked(
+		ctx, lState, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, true, true, zeroPtr, nil)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	bps.mergeOtherBps(copyBps)
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	return dblock.Children[name], nil
+}
+
+// CopyFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CopyFile(
+	ctx context.Context, file Node, dir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CopyFile %p -> %p %s",
+		file.GetID(), dir.GetID(), name)
+	defer func() {
+		if err != nil {
+			fbo.deferLog.CDebugf(ctx, "Error: %v", err)
+		} else {
+			fbo.deferLog.CDebugf(ctx, "Done: %p", n.GetID())
+		}
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set node and ei directly, as that can cause a
+			// race when the copy is canceled.
+			de, err := fbo.copyFileLocked(ctx, lState, file, dir, name)
+			if err != nil {
+				return err
+			}
+			retNode, err = fbo.nodeCache.GetOrCreate(
+				de.BlockPointer, name, dir)
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return retNode, retEntryInfo, nil
+}
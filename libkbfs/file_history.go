@@ -0,0 +1,475 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/net/context"
+)
+
+// maxFileHistoryRevisions is the maximum number of merged revisions
+// getFileHistory will walk back through, starting from the head.
+const maxFileHistoryRevisions = 1000
+
+// FileVersion describes a past version of a file: the merged
+// revision that created it, and the file's attributes as of that
+// revision.
+type FileVersion struct {
+	Revision  MetadataRevision
+	Writer    libkb.NormalizedUsername
+	LocalTime time.Time // reflects difference between server and local clock
+	// Path is relative to the TLF root, and is the name the file
+	// had as of Revision.
+	Path  string
+	Mtime time.Time
+	Size  uint64
+}
+
+// renamedPath returns the path p had before the given rename, which
+// may have moved p itself or one of its parent directories, and
+// true, or false if the rename didn't affect p.
+func renamedPath(p string, rename TlfChange) (string, bool) {
+	if p == rename.Path {
+		return rename.OldPath, true
+	}
+	if strings.HasPrefix(p, rename.Path+"/") {
+		return rename.OldPath + p[len(rename.Path):], true
+	}
+	return "", false
+}
+
+// isSameOrParentPath returns true if parent is p or one of its
+// parent directories.
+func isSameOrParentPath(parent, p string) bool {
+	return parent == p || strings.HasPrefix(p, parent+"/")
+}
+
+// fileVersionForMD returns the version of the file at the given path
+// made by the given merged revision, if any, and the path the file had
+// before that revision.  It returns true if the file didn't exist
+// under that path before the revision, or if the revision's changes
+// have been reclaimed, in which case there are no older versions to
+// look for.
+func (fbo *folderBranchOps) fileVersionForMD(ctx context.Context,
+	rmd ImmutableRootMetadata, p string) (
+	version *FileVersion, oldPath string, born bool, err error) {
+	changes, err := fbo.getChangesForMD(ctx, rmd)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	// Walk the changes backwards, following the file back to the
+	// start of the revision.
+	endPath := p
+	changed := false
+	for i := len(changes) - 1; i >= 0 && !born; i-- {
+		c := changes[i]
+		switch c.Type {
+		case EntryCreated:
+			if isSameOrParentPath(c.Path, p) {
+				changed = c.Path == p
+				born = true
+			}
+		case EntryModified:
+			if c.Path == p {
+				changed = true
+			}
+		case EntryRenamed:
+			if oldP, ok := renamedPath(p, c); ok {
+				changed = changed || c.Path == p
+				p = oldP
+			} else if isSameOrParentPath(c.OldPath, p) {
+				// Something else was moved away from this path,
+				// so our file came from somewhere else.
+				born = true
+			}
+		case EntryRemoved:
+			if isSameOrParentPath(c.Path, p) {
+				born = true
+			}
+		case ChangesReclaimed:
+			// There's no telling what happened to the file
+			// before this.
+			born = true
+		}
+	}
+	if !changed {
+		return nil, p, born, nil
+	}
+	return &FileVersion{
+		Revision:  rmd.Revision(),
+		Writer:    changes[0].Writer,
+		LocalTime: rmd.LocalTimestamp(),
+		Path:      endPath,
+	}, p, born, nil
+}
+
+// getEntryAtRevision returns the full path and the entry of the
+// given TLF-relative path, as of the given merged revision.  Hard
+// links are resolved to their targets.
+func (fbo *folderBranchOps) getEntryAtRevision(ctx context.Context,
+	lState *lockState, rmd ImmutableRootMetadata, p string) (
+	path, DirEntry, error) {
+	fullPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			rmd.Data().Dir.BlockPointer,
+			string(rmd.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	de := rmd.Data().Dir
+	for _, name := range strings.Split(p, "/") {
+		if de.Type != Dir {
+			return path{}, DirEntry{}, NotDirError{fullPath}
+		}
+		dblock, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
+			rmd.ReadOnly(), fullPath.tailPointer(), fbo.branch(), fullPath)
+		if err != nil {
+			return path{}, DirEntry{}, err
+		}
+		var ok bool
+		de, ok = dblock.Children[name]
+		if !ok {
+			return path{}, DirEntry{}, NoSuchNameError{name}
+		}
+		fullPath = fullPath.ChildPath(name, de.BlockPointer)
+	}
+	if de.isHardLink() {
+		return fbo.getEntryAtRevision(ctx, lState, rmd,
+			hardLinksDirName+"/"+de.HardLinkTarget)
+	}
+	return fullPath, de, nil
+}
+
+// getFileHistory returns the versions of the given file made by
+// merged revisions, oldest first.  The history ends at the revision
+// that created the file, or earlier if it reaches revisions whose
+// blocks may have been reclaimed by the last gc op, or goes back
+// more than maxFileHistoryRevisions revisions.
+func (fbo *folderBranchOps) getFileHistory(ctx context.Context,
+	lState *lockState, file Node) ([]FileVersion, error) {
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return nil, err
+	}
+	if !filePath.hasValidParent() {
+		return nil, NotFileError{filePath}
+	}
+
+	head := md.Revision()
+	if md.MergedStatus() != Merged {
+		head = fbo.getLatestMergedRevision(lState)
+	}
+	oldest := head - maxFileHistoryRevisions + 1
+	if oldest < MetadataRevisionInitial {
+		oldest = MetadataRevisionInitial
+	}
+
+	// Walk back through the merged history until the revision that
+	// created the file, following it through any renames.
+	p := tlfRelativePath(filePath)
+	var versions []FileVersion
+	done := false
+	for end := head; end >= oldest && !done; {
+		start := end - maxMDsAtATime + 1
+		if start < oldest {
+			start = oldest
+		}
+		rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+			start, end, Merged)
+		if err != nil {
+			return nil, err
+		}
+		if len(rmds) == 0 {
+			return nil, NoSuchMDError{fbo.id(), end, NullBranchID}
+		}
+
+		for i := len(rmds) - 1; i >= 0 && !done; i-- {
+			rmd := rmds[i]
+			if rmd.Revision() < oldest {
+				done = true
+				break
+			}
+			if err := isReadableOrError(
+				ctx, fbo.config, rmd.ReadOnly()); err != nil {
+				return nil, err
+			}
+
+			// Blocks unreferenced as of the last gc op's latest
+			// revision may be gone, so don't look before it.
+			ops := rmd.Data().Changes.Ops
+			for j := len(ops) - 1; j >= 0; j-- {
+				if gcOp, ok := ops[j].(*GCOp); ok {
+					if gcOp.LatestRev > oldest {
+						oldest = gcOp.LatestRev
+					}
+					break
+				}
+			}
+
+			var version *FileVersion
+			var born bool
+			version, p, born, err = fbo.fileVersionForMD(ctx, rmd, p)
+			if err != nil {
+				return nil, err
+			}
+			done = born
+			if version == nil {
+				continue
+			}
+
+			_, de, err := fbo.getEntryAtRevision(
+				ctx, lState, rmd, version.Path)
+			if isBlockGoneError(err) {
+				fbo.log.CDebugf(ctx, "Revision %d of %s has been "+
+					"reclaimed: %v", rmd.Revision(), version.Path, err)
+				done = true
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			version.Mtime = time.Unix(0, de.Mtime)
+			version.Size = de.Size
+			versions = append(versions, *version)
+		}
+		end = rmds[0].Revision() - 1
+	}
+
+	// Return the oldest version first.
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+// GetFileHistory implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetFileHistory(
+	ctx context.Context, file Node) (versions []FileVersion, err error) {
+	fbo.log.CDebugf(ctx, "GetFileHistory %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		versions, err = fbo.getFileHistory(ctx, lState, file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// restoreFileVersionLocked makes the contents of file those of the
+// old version of it at oldPath as of rmd, whose entry was oldDe, in
+// a single revision with a single syncOp.  Blocks the old version
+// shares with the current one just get new references, but the rest
+// may have been archived since, so their data is duplicated into new
+// blocks.
+func (fbo *folderBranchOps) restoreFileVersionLocked(ctx context.Context,
+	lState *lockState, file Node, rmd ImmutableRootMetadata,
+	oldPath path, oldDe DirEntry) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// The restore replaces the current version's blocks, so they
+	// need to be on the server first.
+	if err := fbo.syncNodeLocked(ctx, lState, file); err != nil {
+		return err
+	}
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+	if !filePath.hasValidParent() {
+		return NotFileError{filePath}
+	}
+	parentPath := *filePath.parentPath()
+	name := filePath.tailName()
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), parentPath, blockWrite)
+	if err != nil {
+		return err
+	}
+	de, ok := dblock.Children[name]
+	if !ok {
+		return NoSuchNameError{name}
+	}
+	if de.Type != File && de.Type != Exec {
+		return NotFileError{filePath}
+	}
+
+	// The current version's blocks stay live until this revision
+	// unreferences them.
+	infos, err := fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, md.ReadOnly(), filePath)
+	if err != nil {
+		return err
+	}
+	live := map[BlockID]bool{de.ID: true}
+	for _, info := range infos {
+		live[info.ID] = true
+	}
+
+	so, err := newSyncOp(filePath.tailPointer())
+	if err != nil {
+		return err
+	}
+	md.AddOp(so)
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	fblock, err := fbo.blocks.GetFileBlockForReading(ctx, lState,
+		rmd.ReadOnly(), oldDe.BlockPointer, oldPath.Branch, oldPath)
+	if err != nil {
+		return err
+	}
+	copyBps := newBlockPutState(1)
+	var info BlockInfo
+	if fblock.IsInd {
+		fblock, err = fbo.copyIndirectFileBlockLocked(ctx, lState, md,
+			uid, oldPath, rmd.ReadOnly(), fblock, live, copyBps)
+		if err != nil {
+			return err
+		}
+		info, _, err = fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), fblock, uid, copyBps)
+		if err != nil {
+			return err
+		}
+		md.AddRefBlock(info)
+	} else {
+		info, err = fbo.copyLeafFileBlockLocked(ctx, lState, md, uid,
+			oldPath, rmd.ReadOnly(), oldDe.BlockInfo, live, copyBps)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fbo.unrefEntry(ctx, lState, md, parentPath, de, name)
+	if err != nil {
+		return err
+	}
+	err = so.File.setRef(info.BlockPointer)
+	if err != nil {
+		return err
+	}
+	setFullFileWrites(so, de.Size, oldDe.Size)
+
+	now := fbo.nowUnixNano()
+	de.BlockInfo = info
+	de.Size = oldDe.Size
+	de.Mtime = now
+	de.Ctime = now
+	dblock.Children[name] = de
+
+	_, _, bps, err := fbo.syncBlockAndCheckEmbedLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(),
+		parentPath.tailName(), Dir, false, false, zeroPtr, nil)
+	if err != nil {
+		return err
+	}
+	bps.mergeOtherBps(copyBps)
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return err
+	}
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+}
+
+// RestoreFileVersion implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) RestoreFileVersion(
+	ctx context.Context, file Node, rev MetadataRevision) (err error) {
+	fbo.log.CDebugf(ctx, "RestoreFileVersion %p %d", file.GetID(), rev)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return err
+	}
+
+	lState := makeFBOLockState()
+	var rmd ImmutableRootMetadata
+	var oldPath path
+	var oldDe DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		versions, err := fbo.getFileHistory(ctx, lState, file)
+		if err != nil {
+			return err
+		}
+
+		// The contents as of rev are those of the latest version
+		// made at or before rev.
+		var version *FileVersion
+		for i := range versions {
+			if versions[i].Revision <= rev {
+				version = &versions[i]
+			}
+		}
+		if version == nil {
+			return NoSuchFileVersionError{file.GetBasename(), rev}
+		}
+
+		// Look the file up under the name it had as of that
+		// version, which later revisions may have renamed.
+		rmd, err = getSingleMD(ctx, fbo.config, fbo.id(), NullBranchID,
+			version.Revision, Merged)
+		if err != nil {
+			return err
+		}
+		if err := isReadableOrError(
+			ctx, fbo.config, rmd.ReadOnly()); err != nil {
+			return err
+		}
+		oldPath, oldDe, err = fbo.getEntryAtRevision(
+			ctx, lState, rmd, version.Path)
+		if err != nil {
+			return err
+		}
+		if oldDe.Type == Dir || oldDe.Type == Sym {
+			return NotFileError{oldPath}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.restoreFileVersionLocked(
+				ctx, lState, file, rmd, oldPath, oldDe)
+		})
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileHistoryAndRestore(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+
+	// user 1 writes two versions of a/b
+	kbfsOps1 := config1.KBFSOps()
+	dirA, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps1.CreateFile(ctx, dirA, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileB, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileB, []byte(" world"), 5)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB)
+	require.NoError(t, err)
+
+	// user 2 moves it and overwrites it
+	kbfsOps2 := config2.KBFSOps()
+	fb2 := rootNode2.GetFolderBranch()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+	require.NoError(t, err)
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.Rename(ctx, dirA2, "b", rootNode2, "c")
+	require.NoError(t, err)
+	fileC2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "c")
+	require.NoError(t, err)
+	err = kbfsOps2.Truncate(ctx, fileC2, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileC2, []byte("bye"), 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileC2)
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	fileC, _, err := kbfsOps1.Lookup(ctx, rootNode1, "c")
+	require.NoError(t, err)
+
+	versions, err := kbfsOps1.GetFileHistory(ctx, fileC)
+	require.NoError(t, err)
+	expected := []FileVersion{
+		{Writer: userName1, Path: "a/b", Size: 0},
+		{Writer: userName1, Path: "a/b", Size: 5},
+		{Writer: userName1, Path: "a/b", Size: 11},
+		{Writer: userName2, Path: "c", Size: 11},
+		{Writer: userName2, Path: "c", Size: 3},
+	}
+	require.Len(t, versions, len(expected))
+	for i, v := range versions {
+		require.Equal(t, expected[i].Writer, v.Writer, "%d", i)
+		require.Equal(t, expected[i].Path, v.Path, "%d", i)
+		require.Equal(t, expected[i].Size, v.Size, "%d", i)
+		if i > 0 {
+			require.True(t, v.Revision > versions[i-1].Revision)
+		}
+	}
+
+	// Restoring a revision between versions restores the version
+	// current at that revision.
+	err = kbfsOps1.RestoreFileVersion(ctx, fileC, versions[2].Revision+1)
+	require.NoError(t, err)
+	buf := make([]byte, 20)
+	n, err := kbfsOps1.Read(ctx, fileC, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(buf[:n]))
+
+	versions2, err := kbfsOps1.GetFileHistory(ctx, fileC)
+	require.NoError(t, err)
+	require.Len(t, versions2, len(versions)+1)
+	last := versions2[len(versions2)-1]
+	require.Equal(t, userName1, last.Writer)
+	require.Equal(t, uint64(11), last.Size)
+
+	// There's nothing to restore from before the file was created.
+	err = kbfsOps1.RestoreFileVersion(ctx, fileC, versions[0].Revision-1)
+	require.IsType(t, NoSuchFileVersionError{}, err)
+}
+
+func TestRestoreFileVersionRenamedParent(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	// The old version spans several blocks.
+	tc := config.TuningConfig()
+	tc.MaxBlockSizeBytes = minTuningMaxBlockSizeBytes
+	config.SetTuningConfig(tc)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dirD, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileF, _, err := kbfsOps.CreateFile(ctx, dirD, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 3*minTuningMaxBlockSizeBytes+5)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileF, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileF)
+	require.NoError(t, err)
+
+	// Renaming the parent doesn't make a new version of the file.
+	err = kbfsOps.Rename(ctx, rootNode, "d", rootNode, "e")
+	require.NoError(t, err)
+	err = kbfsOps.Truncate(ctx, fileF, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileF, []byte("bye"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileF)
+	require.NoError(t, err)
+
+	versions, err := kbfsOps.GetFileHistory(ctx, fileF)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	require.Equal(t, "d/f", versions[1].Path)
+	require.Equal(t, "e/f", versions[2].Path)
+
+	// As of the rename, the file is under its new name, but its
+	// contents are those of the version under the old one.
+	err = kbfsOps.RestoreFileVersion(ctx, fileF, versions[2].Revision-1)
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps, fileF, data)
+}
+
+// Tests that restoring a file version makes a single revision with a
+// single syncOp, which shares the blocks the old version has in
+// common with the current one.
+func TestRestoreFileVersionSingleRevision(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	fileF, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileF, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileF)
+	require.NoError(t, err)
+
+	// Only the first block changes, and the file grows.
+	err = kbfsOps.Write(ctx, fileF, []byte("changed"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileF, []byte("more"), 100)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileF)
+	require.NoError(t, err)
+
+	versions, err := kbfsOps.GetFileHistory(ctx, fileF)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	rev := ops.getCurrMDRevision(lState)
+	err = kbfsOps.RestoreFileVersion(ctx, fileF, versions[1].Revision)
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps, fileF, data)
+
+	head := ops.getHead(lState)
+	require.Equal(t, rev+1, head.Revision())
+	require.Len(t, head.data.Changes.Ops, 1)
+	require.IsType(t, &syncOp{}, head.data.Changes.Ops[0])
+	var shared, copied int
+	for _, ptr := range head.data.Changes.Ops[0].Refs() {
+		if ptr.IsFirstRef() {
+			copied++
+		} else {
+			shared++
+		}
+	}
+	require.NotZero(t, shared)
+	require.NotZero(t, copied)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileF2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "f")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, fileF2, data)
+}
+
+// Tests that the history of a file stops at the revisions whose
+// blocks quota reclamation may have deleted.
+func TestFileHistoryAfterQuotaReclamation(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, dirA, "b", false, NoExcl)
+	require.NoError(t, err)
+	for _, s := range []string{"hello", " world"} {
+		info, err := kbfsOps.Stat(ctx, fileB)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileB, []byte(s), int64(info.Size))
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, fileB)
+		require.NoError(t, err)
+	}
+
+	versions, err := kbfsOps.GetFileHistory(ctx, fileB)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+
+	// Make the old revisions old enough to reclaim, and reclaim
+	// them.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "c")
+	require.NoError(t, err)
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Only the last version, which is still live, is left.
+	versions, err = kbfsOps.GetFileHistory(ctx, fileB)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, uint64(11), versions[0].Size)
+
+	err = kbfsOps.RestoreFileVersion(ctx, fileB, versions[0].Revision-1)
+	require.IsType(t, NoSuchFileVersionError{}, err)
+}
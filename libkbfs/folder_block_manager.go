@@ -21,6 +21,7 @@ type fbmHelper interface {
 	getMostRecentFullyMergedMD(ctx context.Context) (
 		ImmutableRootMetadata, error)
 	finalizeGCOp(ctx context.Context, gco *GCOp) error
+	purgeTrash(ctx context.Context, now time.Time) error
 }
 
 const (
@@ -296,6 +297,8 @@ func isArchivableOp(op op) bool {
 		return true
 	case *setAttrOp:
 		return true
+	case *linkOp:
+		return true
 	case *resolutionOp:
 		return true
 	default:
@@ -625,7 +628,8 @@ func (fbm *folderBlockManager) archiveBlocksInBackground() {
 				// block md writes due to the buffered channel.  So
 				// use the long timeout to make sure things get
 				// unblocked eventually, but no need for a short timeout.
-				ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+				ctx, cancel := context.WithTimeout(
+					ctx, fbm.config.TuningConfig().BackgroundTaskTimeout)
 				fbm.setArchiveCancel(cancel)
 				defer fbm.cancelArchive()
 
@@ -662,7 +666,8 @@ func (fbm *folderBlockManager) deleteBlocksInBackground() {
 		select {
 		case toDelete := <-fbm.blocksToDeleteChan:
 			fbm.runUnlessShutdown(func(ctx context.Context) (err error) {
-				ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+				ctx, cancel := context.WithTimeout(
+					ctx, fbm.config.TuningConfig().BackgroundTaskTimeout)
 				fbm.setBlocksToDeleteCancel(cancel)
 				defer fbm.cancelBlocksToDelete()
 
@@ -955,6 +960,21 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 		return NewWriteAccessError(head.GetTlfHandle(), username, head.GetTlfHandle().GetCanonicalPath())
 	}
 
+	// Purge the expired trash entries first, unless someone is
+	// actively writing.  Each entry records its own expiry, so this
+	// happens even if this device doesn't keep a trash itself.  The
+	// blocks they unreference are reclaimed by a later run, once
+	// they are old enough.
+	now := fbm.config.Clock().Now()
+	if now.Sub(head.localTimestamp) >=
+		fbm.config.QuotaReclamationMinHeadAge() {
+		err = runUnlessCanceled(ctx,
+			func() error { return fbm.helper.purgeTrash(ctx, now) })
+		if err != nil {
+			return err
+		}
+	}
+
 	if !fbm.isQRNecessary(head) {
 		// Nothing has changed since last time, or the current head is
 		// too new, so no need to do any QR.
@@ -307,6 +307,14 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 		err = bops.Get(ctx, kmd, ptr, block)
 	})
 	if err != nil {
+		if rev, ok := fbo.folderBranch.Branch.RevisionIfSpecified(); ok {
+			// Blocks of archived revisions may have been deleted
+			// by quota reclamation since they were written.
+			switch err.(type) {
+			case BServerErrorBlockDeleted, BServerErrorBlockNonExistent:
+				return nil, RevGarbageCollectedError{fbo.id(), rev, ptr.ID}
+			}
+		}
 		return nil, err
 	}
 
@@ -392,9 +400,63 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 		return nil, NotDirBlockError{ptr, branch, p}
 	}
 
+	if dblock.IsInd {
+		dblock, err = fbo.assembleIndirectDirBlockLocked(
+			ctx, lState, kmd, ptr, branch, p, dblock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return dblock, nil
 }
 
+// assembleIndirectDirBlockLocked fetches all the child blocks of the
+// given indirect directory block, and returns a single assembled
+// DirBlock containing all of their entries (see the DirBlock
+// documentation).  The assembled block replaces the indirect one in
+// the block cache, so this work only needs to be done once.
+func (fbo *folderBlockOps) assembleIndirectDirBlockLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	ptr BlockPointer, branch BranchName, p path, topBlock *DirBlock) (
+	*DirBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	assembled := NewDirBlock().(*DirBlock)
+	assembled.IPtrs = make([]IndirectDirPtr, len(topBlock.IPtrs))
+	copy(assembled.IPtrs, topBlock.IPtrs)
+	for i, iptr := range topBlock.IPtrs {
+		block, err := fbo.getBlockHelperLocked(ctx, lState, kmd,
+			iptr.BlockPointer, branch, NewDirBlock, true, path{})
+		if err != nil {
+			return nil, err
+		}
+		child, ok := block.(*DirBlock)
+		if !ok {
+			return nil, NotDirBlockError{iptr.BlockPointer, branch, p}
+		}
+		if child.IsInd || len(child.IPtrs) > 0 {
+			// Only one level of indirection is supported.
+			return nil, BadDataError{iptr.ID}
+		}
+		for name, de := range child.Children {
+			if name < iptr.Off || (i+1 < len(topBlock.IPtrs) &&
+				name >= topBlock.IPtrs[i+1].Off) {
+				// Every entry must be within its block's range.
+				return nil, BadDataError{iptr.ID}
+			}
+			assembled.Children[name] = de
+		}
+	}
+	assembled.SetEncodedSize(topBlock.GetEncodedSize())
+
+	if err := fbo.config.BlockCache().Put(
+		ptr, fbo.id(), assembled, TransientEntry); err != nil {
+		return nil, err
+	}
+	return assembled, nil
+}
+
 // GetFileBlockForReading retrieves the block pointed to by ptr, which
 // must be valid, either from the cache or from the server. An error
 // is returned if the retrieved block is not a file block.
@@ -500,33 +562,74 @@ func (fbo *folderBlockOps) getFileLocked(ctx context.Context,
 		ctx, lState, kmd, file.tailPointer(), file, rtype)
 }
 
+// getIndirectFileBlockInfosLocked returns the BlockInfos of all the
+// blocks under the given indirect file block, at every level of
+// indirection.  If it hits an error while fetching a child indirect
+// block, it also returns the BlockInfos found so far.
+func (fbo *folderBlockOps) getIndirectFileBlockInfosLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	pblock *FileBlock) ([]BlockInfo, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	blockInfos := make([]BlockInfo, 0, len(pblock.IPtrs))
+	for _, iptr := range pblock.IPtrs {
+		blockInfos = append(blockInfos, iptr.BlockInfo)
+		// Pointers to indirect blocks are marked as such, so
+		// there's no need to fetch anything else.
+		if !iptr.pointsToIndirectBlock() {
+			continue
+		}
+		block, err := fbo.getFileBlockHelperLocked(
+			ctx, lState, kmd, iptr.BlockPointer, file.Branch, file)
+		if err != nil {
+			return blockInfos, err
+		}
+		if !block.IsInd {
+			continue
+		}
+		childInfos, err := fbo.getIndirectFileBlockInfosLocked(
+			ctx, lState, kmd, file, block)
+		blockInfos = append(blockInfos, childInfos...)
+		if err != nil {
+			return blockInfos, err
+		}
+	}
+	return blockInfos, nil
+}
+
 // GetIndirectFileBlockInfos returns a list of BlockInfos for all
 // indirect blocks of the given file. If the returned error is a
 // recoverable one (as determined by
 // isRecoverableBlockErrorForRemoval), the returned list may still be
 // non-empty, and holds all the BlockInfos for all found indirect
-// blocks. (This will be relevant when we handle multiple levels of
-// indirection.)
+// blocks.
 func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path) ([]BlockInfo, error) {
-	// TODO: handle multiple levels of indirection.
-	fBlock, err := func() (*FileBlock, error) {
-		fbo.blockLock.RLock(lState)
-		defer fbo.blockLock.RUnlock(lState)
-		return fbo.getFileBlockLocked(
-			ctx, lState, kmd, file.tailPointer(), file, blockRead)
-	}()
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	fBlock, err := fbo.getFileBlockLocked(
+		ctx, lState, kmd, file.tailPointer(), file, blockRead)
 	if err != nil {
 		return nil, err
 	}
 	if !fBlock.IsInd {
 		return nil, nil
 	}
-	blockInfos := make([]BlockInfo, len(fBlock.IPtrs))
-	for i, ptr := range fBlock.IPtrs {
-		blockInfos[i] = ptr.BlockInfo
+	return fbo.getIndirectFileBlockInfosLocked(ctx, lState, kmd, file, fBlock)
+}
+
+// GetIndirectFileBlockInfosWithTopBlock is like
+// GetIndirectFileBlockInfos, but for a file whose top block the
+// caller has already fetched.
+func (fbo *folderBlockOps) GetIndirectFileBlockInfosWithTopBlock(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	topBlock *FileBlock) ([]BlockInfo, error) {
+	if !topBlock.IsInd {
+		return nil, nil
 	}
-	return blockInfos, nil
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	return fbo.getIndirectFileBlockInfosLocked(
+		ctx, lState, kmd, file, topBlock)
 }
 
 // getDirLocked retrieves the block pointed to by the tail pointer of
@@ -601,10 +704,70 @@ func (fbo *folderBlockOps) GetDir(
 	return fbo.getDirLocked(ctx, lState, kmd, dir, rtype)
 }
 
+// parentBlockAndChildIndex is a node on a path from the top block of
+// a file down to one of its leaf blocks: an indirect block, and the
+// index of the pointer in it that the path follows.
+type parentBlockAndChildIndex struct {
+	pblock     *FileBlock
+	childIndex int
+}
+
+func (pbci parentBlockAndChildIndex) childIFP() IndirectFilePtr {
+	return pbci.pblock.IPtrs[pbci.childIndex]
+}
+
+func (pbci parentBlockAndChildIndex) childBlockPtr() BlockPointer {
+	return pbci.childIFP().BlockPointer
+}
+
+// setChildOffset sets the offset of the pointer at the end of
+// parentBlocks, along with the offsets of the pointers to any of its
+// ancestors that it's the first child of.
+func setChildOffset(parentBlocks []parentBlockAndChildIndex, off int64) {
+	for i := len(parentBlocks) - 1; i >= 0; i-- {
+		pb := parentBlocks[i]
+		pb.pblock.IPtrs[pb.childIndex].Off = off
+		if pb.childIndex > 0 {
+			return
+		}
+	}
+}
+
+// removeChildPtr removes the pointer at the end of parentBlocks, along
+// with the pointers to any indirect blocks (other than the top block)
+// left empty as a result, and fixes up the offsets of the remaining
+// ancestors.  It returns the pointers to the removed indirect blocks.
+func removeChildPtr(
+	parentBlocks []parentBlockAndChildIndex) (removed []BlockPointer) {
+	for i := len(parentBlocks) - 1; i >= 0; i-- {
+		pb := parentBlocks[i]
+		pb.pblock.IPtrs = append(pb.pblock.IPtrs[:pb.childIndex],
+			pb.pblock.IPtrs[pb.childIndex+1:]...)
+		if i == 0 {
+			break
+		}
+		if len(pb.pblock.IPtrs) > 0 {
+			if pb.childIndex == 0 {
+				// The block now starts at its new first child.
+				setChildOffset(parentBlocks[:i], pb.pblock.IPtrs[0].Off)
+			}
+			break
+		}
+		removed = append(removed, parentBlocks[i-1].childBlockPtr())
+	}
+	return removed
+}
+
+// getFileBlockAtOffsetLocked returns the leaf block of the given file
+// that contains the given offset, and its pointer.  It also returns
+// the chain of indirect blocks leading to that leaf from topBlock (or
+// nil, if topBlock is itself a leaf), the offset of the next leaf
+// block in the file (or -1 if there isn't one), and the offset at
+// which the returned leaf block starts.
 func (fbo *folderBlockOps) getFileBlockAtOffsetLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, topBlock *FileBlock,
 	off int64, rtype blockReqType) (
-	ptr BlockPointer, parentBlock *FileBlock, indexInParent int,
+	ptr BlockPointer, parentBlocks []parentBlockAndChildIndex,
 	block *FileBlock, nextBlockStartOff, startOff int64, err error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
@@ -629,11 +792,12 @@ func (fbo *folderBlockOps) getFileBlockAtOffsetLocked(ctx context.Context,
 			}
 		}
 		nextPtr := block.IPtrs[nextIndex]
-		parentBlock = block
-		indexInParent = nextIndex
+		parentBlocks = append(parentBlocks,
+			parentBlockAndChildIndex{block, nextIndex})
 		startOff = nextPtr.Off
-		// there is more to read if we ever took a path through a
-		// ptr that wasn't the final ptr in its respective list
+		// There is more to read if we ever took a path through a
+		// ptr that wasn't the final ptr in its respective list.
+		// The deepest such ptr is the closest one.
 		if nextIndex != len(block.IPtrs)-1 {
 			nextBlockStartOff = block.IPtrs[nextIndex+1].Off
 		}
@@ -646,6 +810,76 @@ func (fbo *folderBlockOps) getFileBlockAtOffsetLocked(ctx context.Context,
 	return
 }
 
+// getNextDirtyFileBlockAtOffsetLocked returns the first dirty leaf
+// block under pblock that starts at or after the given offset, along
+// with its pointer, the chain of indirect blocks leading to it
+// (starting with the given parentBlocks), and the offset of the next
+// leaf block in the file (or -1 if there isn't one).  Only dirty
+// indirect blocks are searched, since a clean one can't have any
+// dirty children.  If there is no such leaf, the returned block is
+// nil.
+func (fbo *folderBlockOps) getNextDirtyFileBlockAtOffsetLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	pblock *FileBlock, off int64, rtype blockReqType,
+	parentBlocks []parentBlockAndChildIndex, nextBlockStartOff int64) (
+	ptr BlockPointer, newParentBlocks []parentBlockAndChildIndex,
+	block *FileBlock, nextBlockOff int64, err error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for i, iptr := range pblock.IPtrs {
+		nextOff := nextBlockStartOff
+		if i+1 < len(pblock.IPtrs) {
+			nextOff = pblock.IPtrs[i+1].Off
+			if nextOff <= off {
+				// Everything under this pointer is before off.
+				continue
+			}
+		}
+		if iptr.Off < off && !iptr.pointsToIndirectBlock() {
+			// This must be a leaf block (since pointers to
+			// indirect blocks are marked as such), and it starts
+			// before off.
+			continue
+		}
+		isDirty := dirtyBcache.IsDirty(fbo.id(), iptr.BlockPointer,
+			file.Branch)
+		if !isDirty {
+			continue
+		}
+		if iptr.EncodedSize > 0 {
+			return BlockPointer{}, nil, nil, -1,
+				InconsistentEncodedSizeError{iptr.BlockInfo}
+		}
+
+		block, err := fbo.getFileBlockLocked(
+			ctx, lState, kmd, iptr.BlockPointer, file, rtype)
+		if err != nil {
+			return BlockPointer{}, nil, nil, -1, err
+		}
+		childParentBlocks := make(
+			[]parentBlockAndChildIndex, len(parentBlocks), len(parentBlocks)+1)
+		copy(childParentBlocks, parentBlocks)
+		childParentBlocks = append(childParentBlocks,
+			parentBlockAndChildIndex{pblock, i})
+		if !block.IsInd {
+			if iptr.Off < off {
+				continue
+			}
+			return iptr.BlockPointer, childParentBlocks, block, nextOff, nil
+		}
+
+		ptr, newParentBlocks, block, nextBlockOff, err =
+			fbo.getNextDirtyFileBlockAtOffsetLocked(
+				ctx, lState, kmd, file, block, off, rtype,
+				childParentBlocks, nextOff)
+		if err != nil || block != nil {
+			return ptr, newParentBlocks, block, nextBlockOff, err
+		}
+	}
+	return BlockPointer{}, nil, nil, -1, nil
+}
+
 // updateWithDirtyEntriesLocked checks if the given DirBlock has any
 // entries that are in deCache (i.e., entries pointing to dirty
 // files). If so, it makes a copy with all such entries replaced with
@@ -726,11 +960,50 @@ func (fbo *folderBlockOps) GetDirtyDirChildren(
 
 	children := make(map[string]EntryInfo)
 	for k, de := range dblock.Children {
+		if de.isHardLink() {
+			_, target, err := fbo.GetHardLinkTarget(
+				ctx, lState, kmd, dir, de)
+			if err == nil {
+				children[k] = target.EntryInfo
+				continue
+			} else if _, ok := err.(NoSuchNameError); !ok {
+				return nil, err
+			}
+			// Fall back to the link entry itself if the target
+			// is gone.
+		}
 		children[k] = de.EntryInfo
 	}
 	return children, nil
 }
 
+// GetHardLinkTarget returns the path of the hard links directory, and
+// the (possibly dirty) target entry within it, for the given hard
+// link entry in dir.
+func (fbo *folderBlockOps) GetHardLinkTarget(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path,
+	de DirEntry) (linksDir path, target DirEntry, err error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	rootPath := path{
+		FolderBranch: dir.FolderBranch,
+		path:         dir.path[:1],
+	}
+	linksDe, err := fbo.getDirtyEntryLocked(
+		ctx, lState, kmd, rootPath.ChildPathNoPtr(hardLinksDirName))
+	if err != nil {
+		return path{}, DirEntry{}, err
+	}
+	linksDir = rootPath.ChildPath(hardLinksDirName, linksDe.BlockPointer)
+	target, err = fbo.getDirtyEntryLocked(
+		ctx, lState, kmd, linksDir.ChildPathNoPtr(de.HardLinkTarget))
+	if err != nil {
+		return path{}, DirEntry{}, err
+	}
+	return linksDir, target, nil
+}
+
 // file must have a valid parent.
 func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, rtype blockReqType) (
@@ -828,49 +1101,149 @@ func (fbo *folderBlockOps) cacheBlockIfNotYetDirtyLocked(
 	return nil
 }
 
-func (fbo *folderBlockOps) newRightBlockLocked(
-	ctx context.Context, lState *lockState, ptr BlockPointer,
-	file path, pblock *FileBlock,
-	off int64, kmd KeyMetadata) error {
+// markParentsDirtyLocked caches all the indirect blocks in
+// parentBlocks as dirty, and zeroes the encoded sizes of the pointers
+// between them, since they will all need new IDs on the next sync.
+// The pointer to the leaf block at the end of the chain is left
+// alone.  It returns the pointers it dirtied, and the infos of any
+// previously-synced blocks that are no longer referenced.
+func (fbo *folderBlockOps) markParentsDirtyLocked(lState *lockState,
+	file path, parentBlocks []parentBlockAndChildIndex) (
+	dirtyPtrs []BlockPointer, unrefs []BlockInfo, err error) {
 	fbo.blockLock.AssertLocked(lState)
+	parentPtr := file.tailPointer()
+	for i, pb := range parentBlocks {
+		if i < len(parentBlocks)-1 {
+			if info := pb.childIFP().BlockInfo; info.EncodedSize > 0 {
+				unrefs = append(unrefs, info)
+				pb.pblock.IPtrs[pb.childIndex].EncodedSize = 0
+			}
+		}
+		if err = fbo.cacheBlockIfNotYetDirtyLocked(
+			lState, parentPtr, file, pb.pblock); err != nil {
+			return nil, nil, err
+		}
+		dirtyPtrs = append(dirtyPtrs, parentPtr)
+		parentPtr = pb.childBlockPtr()
+	}
+	return dirtyPtrs, unrefs, nil
+}
 
-	newRID, err := fbo.config.Crypto().MakeTemporaryBlockID()
+func (fbo *folderBlockOps) newTempIndirectFilePtr(kmd KeyMetadata,
+	uid keybase1.UID, off int64, isInd bool) (IndirectFilePtr, error) {
+	newID, err := fbo.config.Crypto().MakeTemporaryBlockID()
 	if err != nil {
-		return err
+		return IndirectFilePtr{}, err
 	}
+	return IndirectFilePtr{
+		BlockInfo: BlockInfo{
+			BlockPointer: BlockPointer{
+				ID:      newID,
+				KeyGen:  kmd.LatestKeyGeneration(),
+				DataVer: DefaultNewBlockDataVersion(fbo.config, false),
+				BlockContext: BlockContext{
+					Creator:  uid,
+					RefNonce: ZeroBlockRefNonce,
+				},
+			},
+			EncodedSize: 0,
+		},
+		Off:   off,
+		IsInd: isInd,
+	}, nil
+}
+
+// newRightBlockLocked makes a new, empty leaf block starting at off,
+// and inserts a pointer to it just to the right of the leaf block at
+// the end of parentBlocks.  Any indirect block that would end up with
+// more than BlockSplitter.MaxPtrsPerBlock pointers is split in two,
+// and if topBlock itself is full, the tree grows by a level.  It
+// returns the pointers it dirtied, with the new leaf first, and the
+// infos of any previously-synced blocks that are no longer
+// referenced.  The caller must look up parentBlocks again afterward,
+// since they may have changed.
+func (fbo *folderBlockOps) newRightBlockLocked(
+	ctx context.Context, lState *lockState, file path, topBlock *FileBlock,
+	parentBlocks []parentBlockAndChildIndex, off int64, kmd KeyMetadata) (
+	dirtyPtrs []BlockPointer, unrefs []BlockInfo, err error) {
+	fbo.blockLock.AssertLocked(lState)
+
 	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	rblock := &FileBlock{}
-
-	newPtr := BlockPointer{
-		ID:      newRID,
-		KeyGen:  kmd.LatestKeyGeneration(),
-		DataVer: DefaultNewBlockDataVersion(fbo.config, false),
-		BlockContext: BlockContext{
-			Creator:  uid,
-			RefNonce: ZeroBlockRefNonce,
-		},
+	newIptr, err := fbo.newTempIndirectFilePtr(kmd, uid, off, false)
+	if err != nil {
+		return nil, nil, err
 	}
+	if err = fbo.cacheBlockIfNotYetDirtyLocked(
+		lState, newIptr.BlockPointer, file, &FileBlock{}); err != nil {
+		return nil, nil, err
+	}
+	dirtyPtrs = append(dirtyPtrs, newIptr.BlockPointer)
+
+	maxPtrs := fbo.config.BlockSplitter().MaxPtrsPerBlock()
+	for level := len(parentBlocks) - 1; level >= 0; level-- {
+		pb := parentBlocks[level]
+		i := pb.childIndex + 1
+		if len(pb.pblock.IPtrs) < maxPtrs {
+			iptrs := make([]IndirectFilePtr, 0, len(pb.pblock.IPtrs)+1)
+			iptrs = append(iptrs, pb.pblock.IPtrs[:i]...)
+			iptrs = append(iptrs, newIptr)
+			pb.pblock.IPtrs = append(iptrs, pb.pblock.IPtrs[i:]...)
+			break
+		}
 
-	pblock.IPtrs = append(pblock.IPtrs, IndirectFilePtr{
-		BlockInfo: BlockInfo{
-			BlockPointer: newPtr,
-			EncodedSize:  0,
-		},
-		Off: off,
-	})
+		if level == 0 {
+			// The top block is full, so move all its pointers down
+			// into a new child block, and split that one instead.
+			childIptr, err := fbo.newTempIndirectFilePtr(kmd, uid, 0, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			child := &FileBlock{
+				CommonBlock: CommonBlock{IsInd: true},
+				IPtrs:       topBlock.IPtrs,
+			}
+			if err = fbo.cacheBlockIfNotYetDirtyLocked(
+				lState, childIptr.BlockPointer, file, child); err != nil {
+				return nil, nil, err
+			}
+			dirtyPtrs = append(dirtyPtrs, childIptr.BlockPointer)
+			topBlock.IPtrs = []IndirectFilePtr{childIptr}
+			parentBlocks = append([]parentBlockAndChildIndex{
+				{topBlock, 0}, {child, pb.childIndex}}, parentBlocks[1:]...)
+			level = 2 // one more than the index of child
+			continue
+		}
 
-	if err = fbo.cacheBlockIfNotYetDirtyLocked(
-		lState, newPtr, file, rblock); err != nil {
-		return err
+		// Split the full block: the new pointer and everything to
+		// its right move to a new sibling block, which then needs a
+		// pointer of its own in the next level up.
+		sibling := &FileBlock{
+			CommonBlock: CommonBlock{IsInd: true},
+			IPtrs: append([]IndirectFilePtr{newIptr},
+				pb.pblock.IPtrs[i:]...),
+		}
+		pb.pblock.IPtrs = append(
+			[]IndirectFilePtr(nil), pb.pblock.IPtrs[:i]...)
+		newIptr, err = fbo.newTempIndirectFilePtr(kmd, uid, off, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = fbo.cacheBlockIfNotYetDirtyLocked(
+			lState, newIptr.BlockPointer, file, sibling); err != nil {
+			return nil, nil, err
+		}
+		dirtyPtrs = append(dirtyPtrs, newIptr.BlockPointer)
 	}
-	if err = fbo.cacheBlockIfNotYetDirtyLocked(
-		lState, ptr, file, pblock); err != nil {
-		return err
+
+	parentPtrs, unrefs, err := fbo.markParentsDirtyLocked(
+		lState, file, parentBlocks)
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+	return append(dirtyPtrs, parentPtrs...), unrefs, nil
 }
 
 func (fbo *folderBlockOps) getOrCreateSyncInfoLocked(
@@ -940,17 +1313,37 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 	// If a copy of the top indirect block was made, we need to
 	// redirty all the sync'd blocks under their new IDs, so that
 	// future syncs will know they failed.
-	for newPtr, oldPtr := range redirtyOnRecoverableError {
-		found := false
-		for i, iptr := range fblock.IPtrs {
-			if iptr.BlockPointer == newPtr {
-				found = true
-				fblock.IPtrs[i].EncodedSize = 0
+	fbo.redirtyChildBlocksLocked(
+		ctx, lState, file, fblock, redirtyOnRecoverableError)
+}
+
+// redirtyChildBlocksLocked re-dirties the children of the given dirty
+// indirect block, and their children in turn, that were sync'd under
+// new IDs during a failed sync.
+func (fbo *folderBlockOps) redirtyChildBlocksLocked(
+	ctx context.Context, lState *lockState, file path, pblock *FileBlock,
+	redirtyOnRecoverableError map[BlockPointer]BlockPointer) {
+	fbo.blockLock.AssertLocked(lState)
+
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for i, iptr := range pblock.IPtrs {
+		newPtr := iptr.BlockPointer
+		oldPtr, ok := redirtyOnRecoverableError[newPtr]
+		if !ok {
+			// An indirect block that wasn't part of the failed sync
+			// (e.g., one made by a concurrent write that added a
+			// level to the file) may still have children that were.
+			if !iptr.pointsToIndirectBlock() {
+				continue
+			}
+			b, err := dirtyBcache.Get(fbo.id(), newPtr, fbo.branch())
+			if fblock, ok := b.(*FileBlock); err == nil && ok && fblock.IsInd {
+				fbo.redirtyChildBlocksLocked(
+					ctx, lState, file, fblock, redirtyOnRecoverableError)
 			}
-		}
-		if !found {
 			continue
 		}
+		pblock.IPtrs[i].EncodedSize = 0
 
 		fbo.log.CDebugf(ctx, "Re-dirtying %v (and deleting dirty block %v)",
 			newPtr, oldPtr)
@@ -961,10 +1354,27 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 			fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
 			continue
 		}
+		fblock, isInd := b.(*FileBlock)
+		isInd = isInd && fblock.IsInd
+		if isInd {
+			// Its own children may need re-dirtying, so work on a
+			// copy.
+			if b, err = fblock.DeepCopy(fbo.config.Codec()); err != nil {
+				fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
+				continue
+			}
+		}
 		if err = fbo.cacheBlockIfNotYetDirtyLocked(
 			lState, newPtr, file, b); err != nil {
 			fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
 		}
+		if isInd {
+			b, err = dirtyBcache.Get(fbo.id(), newPtr, fbo.branch())
+			if fblock, ok := b.(*FileBlock); err == nil && ok {
+				fbo.redirtyChildBlocksLocked(
+					ctx, lState, file, fblock, redirtyOnRecoverableError)
+			}
+		}
 		fbo.log.CDebugf(ctx, "Deleting dirty ptr %v after recoverable error",
 			oldPtr)
 		err = dirtyBcache.Delete(fbo.id(), oldPtr, fbo.branch())
@@ -980,13 +1390,13 @@ func (fbo *folderBlockOps) nowUnixNano() int64 {
 
 // PrepRename prepares the given rename operation. It returns copies
 // of the old and new parent block (which may be the same), what is to
-// be the new DirEntry, and a local block cache. It also modifies md,
-// which must be a copy.
+// be the new DirEntry, the new rename op, and a local block cache. It
+// also modifies md, which must be a copy.
 func (fbo *folderBlockOps) PrepRename(
 	ctx context.Context, lState *lockState, md *RootMetadata,
 	oldParent path, oldName string, newParent path, newName string) (
-	oldPBlock, newPBlock *DirBlock, newDe DirEntry, lbc localBcache,
-	err error) {
+	oldPBlock, newPBlock *DirBlock, newDe DirEntry, ro *renameOp,
+	lbc localBcache, err error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 
@@ -994,18 +1404,18 @@ func (fbo *folderBlockOps) PrepRename(
 	oldPBlock, err = fbo.getDirLocked(
 		ctx, lState, md, oldParent, blockWrite)
 	if err != nil {
-		return nil, nil, DirEntry{}, nil, err
+		return nil, nil, DirEntry{}, nil, nil, err
 	}
 	newDe, ok := oldPBlock.Children[oldName]
 	// does the name exist?
 	if !ok {
-		return nil, nil, DirEntry{}, nil, NoSuchNameError{oldName}
+		return nil, nil, DirEntry{}, nil, nil, NoSuchNameError{oldName}
 	}
 
-	ro, err := newRenameOp(oldName, oldParent.tailPointer(), newName,
+	ro, err = newRenameOp(oldName, oldParent.tailPointer(), newName,
 		newParent.tailPointer(), newDe.BlockPointer, newDe.Type)
 	if err != nil {
-		return nil, nil, DirEntry{}, nil, err
+		return nil, nil, DirEntry{}, nil, nil, err
 	}
 	md.AddOp(ro)
 
@@ -1018,7 +1428,7 @@ func (fbo *folderBlockOps) PrepRename(
 		newPBlock, err = fbo.getDirLocked(
 			ctx, lState, md, newParent, blockWrite)
 		if err != nil {
-			return nil, nil, DirEntry{}, nil, err
+			return nil, nil, DirEntry{}, nil, nil, err
 		}
 		now := fbo.nowUnixNano()
 
@@ -1031,7 +1441,7 @@ func (fbo *folderBlockOps) PrepRename(
 			if oldGrandparent.tailPointer().ID != newParent.tailPointer().ID {
 				b, err := fbo.getDirLocked(ctx, lState, md, oldGrandparent, blockWrite)
 				if err != nil {
-					return nil, nil, DirEntry{}, nil, err
+					return nil, nil, DirEntry{}, nil, nil, err
 				}
 				if de, ok := b.Children[oldParent.tailName()]; ok {
 					de.Ctime = now
@@ -1046,7 +1456,7 @@ func (fbo *folderBlockOps) PrepRename(
 			md.data.Dir.Mtime = now
 		}
 	}
-	return oldPBlock, newPBlock, newDe, lbc, nil
+	return oldPBlock, newPBlock, newDe, ro, lbc, nil
 }
 
 // The amount that the read timeout is smaller than the global one.
@@ -1089,7 +1499,7 @@ func (fbo *folderBlockOps) Read(
 	for nRead < n {
 		nextByte := nRead + off
 		toRead := n - nRead
-		_, _, _, block, nextBlockOff, startOff, err := fbo.getFileBlockAtOffsetLocked(
+		_, parentBlocks, block, nextBlockOff, startOff, err := fbo.getFileBlockAtOffsetLocked(
 			ctx, lState, kmd, file, fblock, nextByte, blockRead)
 		if err != nil {
 			// If we hit a timeout while reading then return the bytes already read
@@ -1103,6 +1513,15 @@ func (fbo *folderBlockOps) Read(
 			}
 			return 0, err
 		}
+		if nRead == 0 && len(parentBlocks) > 0 &&
+			!fbo.config.DirtyBlockCache().IsDirty(
+				fbo.id(), file.tailPointer(), file.Branch) {
+			// Fetch the next few leaf blocks ahead of the reader.
+			// Dirty files may point to blocks that haven't been
+			// put yet, so those are left alone.
+			fbo.config.BlockOps().Prefetcher().PrefetchFileBlocks(
+				parentBlocks[len(parentBlocks)-1].pblock, nextByte, kmd)
+		}
 		blockLen := int64(len(block.Contents))
 		lastByteInBlock := startOff + blockLen
 
@@ -1328,7 +1747,7 @@ func (fbo *folderBlockOps) writeDataLocked(
 		return WriteRange{}, nil, 0, err
 	}
 	for nCopied < n {
-		ptr, parentBlock, indexInParent, block, nextBlockOff, startOff, err :=
+		ptr, parentBlocks, block, nextBlockOff, startOff, err :=
 			fbo.getFileBlockAtOffsetLocked(
 				ctx, lState, kmd, file, fblock,
 				off+nCopied, blockWrite)
@@ -1351,93 +1770,89 @@ func (fbo *folderBlockOps) writeDataLocked(
 		nCopied += bsplit.CopyUntilSplit(block, nextBlockOff < 0, data[nCopied:max],
 			off+nCopied-startOff)
 
-		// TODO: support multiple levels of indirection.  Right now the
-		// code only does one but it should be straightforward to
-		// generalize, just annoying
-
-		// if we need another block but there are no more, then make one
+		// If we need another block but there are no more, and the
+		// block doesn't already have a parent block, make one.
 		switchToIndirect := false
-		if nCopied < n && nextBlockOff < 0 {
-			// If the block doesn't already have a parent block, make one.
-			if ptr == file.tailPointer() {
-				fblock, err = fbo.createIndirectBlockLocked(lState, kmd, file,
-					uid, DefaultNewBlockDataVersion(fbo.config, false))
+		if nCopied < n && nextBlockOff < 0 && ptr == file.tailPointer() {
+			fblock, err = fbo.createIndirectBlockLocked(lState, kmd, file,
+				uid, DefaultNewBlockDataVersion(fbo.config, false))
+			if err != nil {
+				return WriteRange{}, nil, newlyDirtiedChildBytes, err
+			}
+			parentBlocks = []parentBlockAndChildIndex{{fblock, 0}}
+			ptr = fblock.IPtrs[0].BlockPointer
+			// The whole block needs to be re-uploaded as an
+			// indirect block, so track those dirty bytes and
+			// cache the block as dirty.
+			switchToIndirect = true
+		}
+
+		// Nothing needs to be dirtied if nothing was copied.  This
+		// can happen when trying to append to the contents of the
+		// file (i.e., either to the end of the file or right before
+		// the "hole"), and the last block is already full.
+		if nCopied != oldNCopied || switchToIndirect {
+			// Only in the last block does the file size grow.
+			if oldLen != len(block.Contents) && nextBlockOff < 0 {
+				de.EncodedSize = 0
+				// update the file info
+				de.Size += uint64(len(block.Contents) - oldLen)
+			}
+			// Put it in the `deCache` even if the size didn't
+			// change, since the `deCache` is used to determine
+			// whether there are any dirty files.  TODO: combine
+			// `deCache` with `dirtyFiles` and `unrefCache`.
+			fbo.deCache[file.tailPointer().Ref()] = de
+
+			// Calculate the amount of bytes we've newly-dirtied as
+			// part of this write.
+			newlyDirtiedChildBytes += int64(len(block.Contents))
+			if wasDirty {
+				newlyDirtiedChildBytes -= int64(oldLen)
+			}
+
+			if len(parentBlocks) > 0 {
+				parentPtrs, unrefs, err := fbo.markParentsDirtyLocked(
+					lState, file, parentBlocks)
 				if err != nil {
 					return WriteRange{}, nil, newlyDirtiedChildBytes, err
 				}
-				ptr = fblock.IPtrs[0].BlockPointer
-				// The whole block needs to be re-uploaded as an
-				// indirect block, so track those dirty bytes and
-				// cache the block as dirty.
-				switchToIndirect = true
+				dirtyPtrs = append(dirtyPtrs, parentPtrs...)
+				si.unrefs = append(si.unrefs, unrefs...)
+
+				// remember how many bytes it was
+				pb := parentBlocks[len(parentBlocks)-1]
+				si.unrefs = append(si.unrefs, pb.childIFP().BlockInfo)
+				pb.pblock.IPtrs[pb.childIndex].EncodedSize = 0
 			}
 
-			// Make a new right block and update the parent's
-			// indirect block list
-			err = fbo.newRightBlockLocked(ctx, lState, file.tailPointer(),
-				file, fblock, startOff+int64(len(block.Contents)), kmd)
-			if err != nil {
+			// keep the old block ID while it's dirty
+			if err = fbo.cacheBlockIfNotYetDirtyLocked(lState, ptr, file,
+				block); err != nil {
 				return WriteRange{}, nil, newlyDirtiedChildBytes, err
 			}
-		} else if nCopied < n && off+nCopied < nextBlockOff {
-			// We need a new block to be inserted here
-			err = fbo.newRightBlockLocked(ctx, lState, file.tailPointer(),
-				file, fblock, startOff+int64(len(block.Contents)), kmd)
+			dirtyPtrs = append(dirtyPtrs, ptr)
+		}
+
+		// Make a new right block if we need one, either at the end
+		// of the file or in the middle of a hole, and update the
+		// parents' indirect block lists.
+		if nCopied < n && (nextBlockOff < 0 || off+nCopied < nextBlockOff) {
+			newOff := startOff + int64(len(block.Contents))
+			newPtrs, unrefs, err := fbo.newRightBlockLocked(ctx, lState,
+				file, fblock, parentBlocks, newOff, kmd)
 			if err != nil {
 				return WriteRange{}, nil, newlyDirtiedChildBytes, err
 			}
-			// And push the indirect pointers to right
-			newb := fblock.IPtrs[len(fblock.IPtrs)-1]
-			copy(fblock.IPtrs[indexInParent+2:], fblock.IPtrs[indexInParent+1:])
-			fblock.IPtrs[indexInParent+1] = newb
-			if oldSizeWithoutHoles == de.Size {
+			dirtyPtrs = append(dirtyPtrs, newPtrs...)
+			si.unrefs = append(si.unrefs, unrefs...)
+			if nextBlockOff > 0 && oldSizeWithoutHoles == de.Size {
 				// For the purposes of calculating the newly-dirtied
 				// bytes for the deferral calculation, disregard the
 				// existing "hole" in the file.
-				oldSizeWithoutHoles = uint64(newb.Off)
+				oldSizeWithoutHoles = uint64(newOff)
 			}
 		}
-
-		// Nothing was copied, no need to dirty anything.  This can
-		// happen when trying to append to the contents of the file
-		// (i.e., either to the end of the file or right before the
-		// "hole"), and the last block is already full.
-		if nCopied == oldNCopied && !switchToIndirect {
-			continue
-		}
-
-		// Only in the last block does the file size grow.
-		if oldLen != len(block.Contents) && nextBlockOff < 0 {
-			de.EncodedSize = 0
-			// update the file info
-			de.Size += uint64(len(block.Contents) - oldLen)
-		}
-		// Put it in the `deCache` even if the size didn't change,
-		// since the `deCache` is used to determine whether there are
-		// any dirty files.  TODO: combine `deCache` with `dirtyFiles`
-		// and `unrefCache`.
-		fbo.deCache[file.tailPointer().Ref()] = de
-
-		// Calculate the amount of bytes we've newly-dirtied as part
-		// of this write.
-		newlyDirtiedChildBytes += int64(len(block.Contents))
-		if wasDirty {
-			newlyDirtiedChildBytes -= int64(oldLen)
-		}
-
-		if parentBlock != nil {
-			// remember how many bytes it was
-			si.unrefs = append(si.unrefs,
-				parentBlock.IPtrs[indexInParent].BlockInfo)
-			parentBlock.IPtrs[indexInParent].EncodedSize = 0
-		}
-
-		// keep the old block ID while it's dirty
-		if err = fbo.cacheBlockIfNotYetDirtyLocked(lState, ptr, file,
-			block); err != nil {
-			return WriteRange{}, nil, newlyDirtiedChildBytes, err
-		}
-		dirtyPtrs = append(dirtyPtrs, ptr)
 	}
 
 	if fblock.IsInd {
@@ -1574,28 +1989,31 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 		fbo.log.CDebugf(ctx, "truncateExtendLocked: new zero data block %v", fblock.IPtrs[0].BlockPointer)
 	}
 
-	// TODO: support multiple levels of indirection.  Right now the
-	// code only does one but it should be straightforward to
-	// generalize, just annoying
-
-	err = fbo.newRightBlockLocked(ctx, lState, file.tailPointer(),
-		file, fblock, int64(size), kmd)
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
 	if err != nil {
 		return WriteRange{}, nil, err
 	}
-	dirtyPtrs = append(dirtyPtrs, fblock.IPtrs[len(fblock.IPtrs)-1].BlockPointer)
-	fbo.log.CDebugf(ctx, "truncateExtendLocked: new right data block %v",
-		fblock.IPtrs[len(fblock.IPtrs)-1].BlockPointer)
 
-	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
 	if err != nil {
 		return WriteRange{}, nil, err
 	}
 
-	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	// Find the current last block, and put the new one after it.
+	_, parentBlocks, _, _, _, err := fbo.getFileBlockAtOffsetLocked(
+		ctx, lState, kmd, file, fblock, int64(size), blockWrite)
 	if err != nil {
 		return WriteRange{}, nil, err
 	}
+	newPtrs, unrefs, err := fbo.newRightBlockLocked(
+		ctx, lState, file, fblock, parentBlocks, int64(size), kmd)
+	if err != nil {
+		return WriteRange{}, nil, err
+	}
+	dirtyPtrs = append(dirtyPtrs, newPtrs...)
+	si.unrefs = append(si.unrefs, unrefs...)
+	fbo.log.CDebugf(ctx, "truncateExtendLocked: new right data block %v",
+		newPtrs[0])
 
 	de.EncodedSize = 0
 	// update the file info
@@ -1604,6 +2022,14 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 
 	// Mark all for presense of holes, one would be enough,
 	// but this is more robust and easy.
+	_, parentBlocks, _, _, _, err = fbo.getFileBlockAtOffsetLocked(
+		ctx, lState, kmd, file, fblock, int64(size), blockWrite)
+	if err != nil {
+		return WriteRange{}, nil, err
+	}
+	for _, pb := range parentBlocks {
+		pb.pblock.IPtrs[pb.childIndex].Holes = true
+	}
 	for i := range fblock.IPtrs {
 		fblock.IPtrs[i].Holes = true
 	}
@@ -1656,7 +2082,7 @@ func (fbo *folderBlockOps) truncateLocked(
 
 	// find the block where the file should now end
 	iSize := int64(size) // TODO: deal with overflow
-	ptr, parentBlock, indexInParent, block, nextBlockOff, startOff, err :=
+	ptr, parentBlocks, block, nextBlockOff, startOff, err :=
 		fbo.getFileBlockAtOffsetLocked(
 			ctx, lState, kmd, file, fblock, iSize, blockWrite)
 	if err != nil {
@@ -1710,38 +2136,54 @@ func (fbo *folderBlockOps) truncateLocked(
 		return nil, nil, 0, err
 	}
 	if nextBlockOff > 0 {
-		// TODO: if indexInParent == 0, we can remove the level of indirection
-		for _, ptr := range parentBlock.IPtrs[indexInParent+1:] {
-			si.unrefs = append(si.unrefs, ptr.BlockInfo)
-		}
-		parentBlock.IPtrs = parentBlock.IPtrs[:indexInParent+1]
-		// always make the parent block dirty, so we will sync it
-		if err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
-			file.tailPointer(), file, parentBlock); err != nil {
-			return nil, nil, newlyDirtiedChildBytes, err
+		// TODO: if the remaining blocks are all under the first
+		// pointer of the top block, we can remove levels of
+		// indirection.
+		for _, pb := range parentBlocks {
+			for _, iptr := range pb.pblock.IPtrs[pb.childIndex+1:] {
+				si.unrefs = append(si.unrefs, iptr.BlockInfo)
+				if !iptr.pointsToIndirectBlock() {
+					continue
+				}
+				// Unref everything under a removed indirect block.
+				childBlock, err := fbo.getFileBlockHelperLocked(
+					ctx, lState, kmd, iptr.BlockPointer, file.Branch, file)
+				if err != nil {
+					return nil, nil, newlyDirtiedChildBytes, err
+				}
+				if !childBlock.IsInd {
+					continue
+				}
+				infos, err := fbo.getIndirectFileBlockInfosLocked(
+					ctx, lState, kmd, file, childBlock)
+				if err != nil {
+					return nil, nil, newlyDirtiedChildBytes, err
+				}
+				si.unrefs = append(si.unrefs, infos...)
+			}
+			pb.pblock.IPtrs = pb.pblock.IPtrs[:pb.childIndex+1]
 		}
 	}
 
-	if fblock.IsInd {
-		// Always make the top block dirty, so we will sync its
-		// indirect blocks.  This has the added benefit of ensuring
-		// that any truncate to a file while it's being sync'd will be
-		// deferred, even if it's to a block that's not currently
-		// being sync'd, since this top-most block will always be in
-		// the dirtyFiles map.
-		if err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
-			file.tailPointer(), file, fblock); err != nil {
+	var dirtyPtrs []BlockPointer
+	if len(parentBlocks) > 0 {
+		// Always make the parent blocks dirty, including the top
+		// block, so we will sync their indirect blocks.  This has
+		// the added benefit of ensuring that any truncate to a file
+		// while it's being sync'd will be deferred, even if it's to
+		// a block that's not currently being sync'd, since this
+		// top-most block will always be in the dirtyFiles map.
+		parentPtrs, unrefs, err := fbo.markParentsDirtyLocked(
+			lState, file, parentBlocks)
+		if err != nil {
 			return nil, nil, newlyDirtiedChildBytes, err
 		}
-	}
+		dirtyPtrs = append(dirtyPtrs, parentPtrs...)
+		si.unrefs = append(si.unrefs, unrefs...)
 
-	if parentBlock != nil {
-		// TODO: When we implement more than one level of indirection,
-		// make sure that the pointer to parentBlock in the grandparent block
-		// has EncodedSize 0.
-		si.unrefs = append(si.unrefs,
-			parentBlock.IPtrs[indexInParent].BlockInfo)
-		parentBlock.IPtrs[indexInParent].EncodedSize = 0
+		pb := parentBlocks[len(parentBlocks)-1]
+		si.unrefs = append(si.unrefs, pb.childIFP().BlockInfo)
+		pb.pblock.IPtrs[pb.childIndex].EncodedSize = 0
 	}
 
 	latestWrite := si.op.addTruncate(size)
@@ -1755,8 +2197,9 @@ func (fbo *folderBlockOps) truncateLocked(
 		ptr, file, block); err != nil {
 		return nil, nil, newlyDirtiedChildBytes, err
 	}
+	dirtyPtrs = append(dirtyPtrs, ptr)
 
-	return &latestWrite, nil, newlyDirtiedChildBytes, nil
+	return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
 }
 
 // Truncate truncates or extends the given file to the given size.
@@ -1933,7 +2376,25 @@ func ReadyBlock(ctx context.Context, config Config, kmd KeyMetadata,
 			return
 		}
 	}
+	return readyBlockAs(ctx, config, kmd, block, uid, ptr)
+}
 
+// readyNewBlock is like ReadyBlock, but always readies the block
+// under a new ID, even if a known block has the same contents.  It's
+// for copies of blocks whose existing references may have been
+// archived, and so can't be referenced again.
+func readyNewBlock(ctx context.Context, config Config, kmd KeyMetadata,
+	block Block, uid keybase1.UID) (
+	info BlockInfo, plainSize int, readyBlockData ReadyBlockData, err error) {
+	return readyBlockAs(ctx, config, kmd, block, uid, BlockPointer{})
+}
+
+// readyBlockAs readies the given block, and returns a new reference
+// to ptr for it if ptr is initialized, or a pointer to a new block
+// otherwise.
+func readyBlockAs(ctx context.Context, config Config, kmd KeyMetadata,
+	block Block, uid keybase1.UID, ptr BlockPointer) (
+	info BlockInfo, plainSize int, readyBlockData ReadyBlockData, err error) {
 	// Ready the block, even in the case where we can reuse an
 	// existing block, just so that we know what the size of the
 	// encrypted data will be.
@@ -1959,6 +2420,10 @@ func ReadyBlock(ctx context.Context, config Config, kmd KeyMetadata,
 				RefNonce: ZeroBlockRefNonce,
 			},
 		}
+		if readyBlockData.compressionSavings > 0 {
+			// Older clients can't read compressed blocks.
+			ptr.DataVer = CompressedBlocksDataVer
+		}
 	}
 
 	info = BlockInfo{
@@ -2005,6 +2470,121 @@ type fileSyncState struct {
 	//
 	// TODO: This can be a list of IDs instead.
 	newIndirectFileBlockPtrs []BlockPointer
+
+	// indirectFblocks holds the (dirty, cached) indirect blocks
+	// below fblock, if any, which will be set to the corresponding
+	// savedIndirectFblocks on a recoverable error.
+	indirectFblocks, savedIndirectFblocks []*FileBlock
+}
+
+// saveDirtyIndirectFileBlocksLocked saves copies of all the dirty
+// indirect blocks under pblock in syncState, so they can be restored
+// after a recoverable error.
+func (fbo *folderBlockOps) saveDirtyIndirectFileBlocksLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	pblock *FileBlock, syncState *fileSyncState) error {
+	fbo.blockLock.AssertLocked(lState)
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for _, iptr := range pblock.IPtrs {
+		if !iptr.pointsToIndirectBlock() ||
+			!dirtyBcache.IsDirty(fbo.id(), iptr.BlockPointer, file.Branch) {
+			continue
+		}
+		block, err := fbo.getFileBlockLocked(
+			ctx, lState, kmd, iptr.BlockPointer, file, blockWrite)
+		if err != nil {
+			return err
+		}
+		if !block.IsInd {
+			continue
+		}
+		blockCopy, err := block.DeepCopy(fbo.config.Codec())
+		if err != nil {
+			return err
+		}
+		syncState.indirectFblocks = append(syncState.indirectFblocks, block)
+		syncState.savedIndirectFblocks = append(
+			syncState.savedIndirectFblocks, blockCopy)
+		err = fbo.saveDirtyIndirectFileBlocksLocked(
+			ctx, lState, kmd, file, block, syncState)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readyDirtyFileBlockChildrenLocked readies all the dirty blocks under
+// pblock, children before their parents, and updates the indirect
+// pointers to them with their new IDs.
+func (fbo *folderBlockOps) readyDirtyFileBlockChildrenLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	uid keybase1.UID, file path, pblock *FileBlock, si *syncInfo,
+	df *dirtyFile, syncState *fileSyncState) error {
+	fbo.blockLock.AssertLocked(lState)
+	bcache := fbo.config.BlockCache()
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for i, ptr := range pblock.IPtrs {
+		localPtr := ptr.BlockPointer
+		isDirty := dirtyBcache.IsDirty(fbo.id(), localPtr, file.Branch)
+		if (ptr.EncodedSize > 0) && isDirty {
+			return InconsistentEncodedSizeError{ptr.BlockInfo}
+		}
+		if !isDirty {
+			continue
+		}
+
+		block, err := fbo.getFileBlockLocked(
+			ctx, lState, md.ReadOnly(), localPtr, file, blockWrite)
+		if err != nil {
+			return err
+		}
+		if block.IsInd {
+			err = fbo.readyDirtyFileBlockChildrenLocked(
+				ctx, lState, md, uid, file, block, si, df, syncState)
+			if err != nil {
+				return err
+			}
+		}
+
+		newInfo, _, readyBlockData, err :=
+			ReadyBlock(ctx, fbo.config, md.ReadOnly(), block, uid)
+		if err != nil {
+			return err
+		}
+
+		syncState.newIndirectFileBlockPtrs = append(syncState.newIndirectFileBlockPtrs, newInfo.BlockPointer)
+		err = bcache.Put(newInfo.BlockPointer, fbo.id(), block, PermanentEntry)
+		if err != nil {
+			return err
+		}
+		df.setBlockOrphaned(localPtr, true)
+
+		// Defer the DirtyBlockCache.Delete until after the new path
+		// is ready, in case anyone tries to read the dirty file in
+		// the meantime.
+		syncState.oldFileBlockPtrs =
+			append(syncState.oldFileBlockPtrs, localPtr)
+
+		pblock.IPtrs[i].BlockInfo = newInfo
+		md.AddRefBlock(newInfo)
+
+		// If this block is replacing a block from a previous, failed
+		// Sync, we need to take that block out of the refs list, and
+		// avoid unrefing it as well.
+		si.removeReplacedBlock(ctx, fbo.log, localPtr)
+
+		si.bps.addNewBlock(newInfo.BlockPointer, block, readyBlockData,
+			func() error {
+				return df.setBlockSynced(localPtr)
+			})
+		err = df.setBlockSyncing(localPtr)
+		if err != nil {
+			return err
+		}
+		syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = localPtr
+	}
+	return nil
 }
 
 // startSyncWrite contains the portion of StartSync() that's done
@@ -2042,6 +2622,11 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 		syncState.fblock = fblock
 		syncState.savedFblock = fblockCopy
 		syncState.redirtyOnRecoverableError = make(map[BlockPointer]BlockPointer)
+		err = fbo.saveDirtyIndirectFileBlocksLocked(
+			ctx, lState, md.ReadOnly(), file, fblock, &syncState)
+		if err != nil {
+			return nil, nil, syncState, nil, err
+		}
 	}
 	syncState.si = si
 	syncState.savedSi, err = si.DeepCopy(fbo.config.Codec())
@@ -2065,8 +2650,6 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 		si.unrefBytes = md.UnrefBytes()
 	}()
 
-	bcache := fbo.config.BlockCache()
-	dirtyBcache := fbo.config.DirtyBlockCache()
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
 
 	// Note: below we add possibly updated file blocks as "unref" and
@@ -2088,151 +2671,121 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 		// TODO: Verify that any getFileBlock... calls here
 		// only use the dirty cache and not the network, since
 		// the blocks are be dirty.
-		for i := 0; i < len(fblock.IPtrs); i++ {
-			ptr := fblock.IPtrs[i]
-			isDirty := dirtyBcache.IsDirty(fbo.id(), ptr.BlockPointer,
-				file.Branch)
-			if (ptr.EncodedSize > 0) && isDirty {
-				return nil, nil, syncState, nil,
-					InconsistentEncodedSizeError{ptr.BlockInfo}
+		for off := int64(0); ; {
+			_, parentBlocks, block, nextBlockOff, err :=
+				fbo.getNextDirtyFileBlockAtOffsetLocked(
+					ctx, lState, md.ReadOnly(), file, fblock, off,
+					blockWrite, nil, -1)
+			if err != nil {
+				return nil, nil, syncState, nil, err
 			}
-			if isDirty {
-				_, _, _, block, nextBlockOff, _, err :=
-					fbo.getFileBlockAtOffsetLocked(
-						ctx, lState, md.ReadOnly(), file, fblock,
-						ptr.Off, blockWrite)
-				if err != nil {
-					return nil, nil, syncState, nil, err
-				}
-
-				splitAt := bsplit.CheckSplit(block)
-				switch {
-				case splitAt == 0:
-					continue
-				case splitAt > 0:
-					endOfBlock := ptr.Off + int64(len(block.Contents))
-					extraBytes := block.Contents[splitAt:]
-					block.Contents = block.Contents[:splitAt]
-					// put the extra bytes in front of the next block
-					if nextBlockOff < 0 {
-						// need to make a new block
-						if err := fbo.newRightBlockLocked(
-							ctx, lState, file.tailPointer(), file, fblock,
-							endOfBlock, md.ReadOnly()); err != nil {
-							return nil, nil, syncState, nil, err
-						}
-					}
-					rPtr, _, _, rblock, _, _, err :=
-						fbo.getFileBlockAtOffsetLocked(
-							ctx, lState, md.ReadOnly(), file, fblock,
-							endOfBlock, blockWrite)
-					if err != nil {
-						return nil, nil, syncState, nil, err
-					}
-					rblock.Contents = append(extraBytes, rblock.Contents...)
-					if err = fbo.cacheBlockIfNotYetDirtyLocked(
-						lState, rPtr, file, rblock); err != nil {
-						return nil, nil, syncState, nil, err
-					}
-					fblock.IPtrs[i+1].Off = ptr.Off + int64(len(block.Contents))
-					md.AddUnrefBlock(fblock.IPtrs[i+1].BlockInfo)
-					fblock.IPtrs[i+1].EncodedSize = 0
-				case splitAt < 0:
-					if nextBlockOff < 0 {
-						// end of the line
-						continue
-					}
+			if block == nil {
+				break
+			}
+			startOff := parentBlocks[len(parentBlocks)-1].childIFP().Off
+			off = startOff + 1
 
-					endOfBlock := ptr.Off + int64(len(block.Contents))
-					rPtr, _, _, rblock, _, _, err :=
-						fbo.getFileBlockAtOffsetLocked(
-							ctx, lState, md.ReadOnly(), file, fblock,
-							endOfBlock, blockWrite)
+			splitAt := bsplit.CheckSplit(block)
+			switch {
+			case splitAt == 0:
+				continue
+			case splitAt > 0:
+				endOfBlock := startOff + int64(len(block.Contents))
+				extraBytes := block.Contents[splitAt:]
+				block.Contents = block.Contents[:splitAt]
+				// put the extra bytes in front of the next block
+				if nextBlockOff < 0 {
+					// need to make a new block
+					_, unrefs, err := fbo.newRightBlockLocked(
+						ctx, lState, file, fblock, parentBlocks,
+						endOfBlock, md.ReadOnly())
 					if err != nil {
 						return nil, nil, syncState, nil, err
 					}
-					// copy some of that block's data into this block
-					nCopied := bsplit.CopyUntilSplit(block, false,
-						rblock.Contents, int64(len(block.Contents)))
-					rblock.Contents = rblock.Contents[nCopied:]
-					if len(rblock.Contents) > 0 {
-						if err = fbo.cacheBlockIfNotYetDirtyLocked(
-							lState, rPtr, file, rblock); err != nil {
-							return nil, nil, syncState, nil, err
-						}
-						fblock.IPtrs[i+1].Off =
-							ptr.Off + int64(len(block.Contents))
-						md.AddUnrefBlock(fblock.IPtrs[i+1].BlockInfo)
-						fblock.IPtrs[i+1].EncodedSize = 0
-					} else {
-						// TODO: delete the block, and if we're down
-						// to just one indirect block, remove the
-						// layer of indirection
-						//
-						// TODO: When we implement more than one level
-						// of indirection, make sure that the pointer
-						// to the parent block in the grandparent
-						// block has EncodedSize 0.
-						md.AddUnrefBlock(fblock.IPtrs[i+1].BlockInfo)
-						fblock.IPtrs =
-							append(fblock.IPtrs[:i+1], fblock.IPtrs[i+2:]...)
+					for _, unref := range unrefs {
+						md.AddUnrefBlock(unref)
 					}
 				}
-			}
-		}
-
-		for i, ptr := range fblock.IPtrs {
-			localPtr := ptr.BlockPointer
-			isDirty := dirtyBcache.IsDirty(fbo.id(), localPtr, file.Branch)
-			if (ptr.EncodedSize > 0) && isDirty {
-				return nil, nil, syncState, nil,
-					InconsistentEncodedSizeError{ptr.BlockInfo}
-			}
-			if isDirty {
-				_, _, _, block, _, _, err := fbo.getFileBlockAtOffsetLocked(
-					ctx, lState, md.ReadOnly(), file, fblock, ptr.Off, blockWrite)
+				rPtr, rParentBlocks, rblock, _, _, err :=
+					fbo.getFileBlockAtOffsetLocked(
+						ctx, lState, md.ReadOnly(), file, fblock,
+						endOfBlock, blockWrite)
 				if err != nil {
 					return nil, nil, syncState, nil, err
 				}
-
-				newInfo, _, readyBlockData, err :=
-					ReadyBlock(ctx, fbo.config, md.ReadOnly(), block, uid)
+				_, unrefs, err := fbo.markParentsDirtyLocked(
+					lState, file, rParentBlocks)
 				if err != nil {
 					return nil, nil, syncState, nil, err
 				}
+				for _, unref := range unrefs {
+					md.AddUnrefBlock(unref)
+				}
+				rblock.Contents = append(extraBytes, rblock.Contents...)
+				if err = fbo.cacheBlockIfNotYetDirtyLocked(
+					lState, rPtr, file, rblock); err != nil {
+					return nil, nil, syncState, nil, err
+				}
+				setChildOffset(
+					rParentBlocks, startOff+int64(len(block.Contents)))
+				rpb := rParentBlocks[len(rParentBlocks)-1]
+				md.AddUnrefBlock(rpb.childIFP().BlockInfo)
+				rpb.pblock.IPtrs[rpb.childIndex].EncodedSize = 0
+			case splitAt < 0:
+				if nextBlockOff < 0 {
+					// end of the line
+					continue
+				}
 
-				syncState.newIndirectFileBlockPtrs = append(syncState.newIndirectFileBlockPtrs, newInfo.BlockPointer)
-				err = bcache.Put(newInfo.BlockPointer, fbo.id(), block, PermanentEntry)
+				endOfBlock := startOff + int64(len(block.Contents))
+				rPtr, rParentBlocks, rblock, _, _, err :=
+					fbo.getFileBlockAtOffsetLocked(
+						ctx, lState, md.ReadOnly(), file, fblock,
+						endOfBlock, blockWrite)
 				if err != nil {
 					return nil, nil, syncState, nil, err
 				}
-				df.setBlockOrphaned(ptr.BlockPointer, true)
-
-				// Defer the DirtyBlockCache.Delete until after the
-				// new path is ready, in case anyone tries to read the
-				// dirty file in the meantime.
-				syncState.oldFileBlockPtrs =
-					append(syncState.oldFileBlockPtrs, localPtr)
-
-				fblock.IPtrs[i].BlockInfo = newInfo
-				md.AddRefBlock(newInfo)
-
-				// If this block is replacing a block from a previous,
-				// failed Sync, we need to take that block out of the
-				// refs list, and avoid unrefing it as well.
-				si.removeReplacedBlock(ctx, fbo.log, localPtr)
-
-				si.bps.addNewBlock(newInfo.BlockPointer, block, readyBlockData,
-					func() error {
-						return df.setBlockSynced(localPtr)
-					})
-				err = df.setBlockSyncing(localPtr)
+				_, unrefs, err := fbo.markParentsDirtyLocked(
+					lState, file, rParentBlocks)
 				if err != nil {
 					return nil, nil, syncState, nil, err
 				}
-				syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = localPtr
+				for _, unref := range unrefs {
+					md.AddUnrefBlock(unref)
+				}
+				// copy some of that block's data into this block
+				nCopied := bsplit.CopyUntilSplit(block, false,
+					rblock.Contents, int64(len(block.Contents)))
+				rblock.Contents = rblock.Contents[nCopied:]
+				rpb := rParentBlocks[len(rParentBlocks)-1]
+				md.AddUnrefBlock(rpb.childIFP().BlockInfo)
+				if len(rblock.Contents) > 0 {
+					if err = fbo.cacheBlockIfNotYetDirtyLocked(
+						lState, rPtr, file, rblock); err != nil {
+						return nil, nil, syncState, nil, err
+					}
+					setChildOffset(
+						rParentBlocks, startOff+int64(len(block.Contents)))
+					rpb.pblock.IPtrs[rpb.childIndex].EncodedSize = 0
+				} else {
+					// TODO: if we're down to just one indirect
+					// block, remove the layer of indirection.
+					//
+					// Any indirect blocks emptied by the removal
+					// are dirty, so clean them up along with the
+					// rest of the old blocks.
+					syncState.oldFileBlockPtrs = append(
+						syncState.oldFileBlockPtrs,
+						removeChildPtr(rParentBlocks)...)
+				}
 			}
 		}
+
+		err = fbo.readyDirtyFileBlockChildrenLocked(
+			ctx, lState, md, uid, file, fblock, si, df, &syncState)
+		if err != nil {
+			return nil, nil, syncState, nil, err
+		}
 	}
 
 	err = df.setBlockSyncing(file.tailPointer())
@@ -2363,6 +2916,9 @@ func (fbo *folderBlockOps) CleanupSyncState(
 		}
 		if result.fblock != nil {
 			*result.fblock = *result.savedFblock
+			for i, fblock := range result.indirectFblocks {
+				*fblock = *result.savedIndirectFblocks[i]
+			}
 			fbo.fixChildBlocksAfterRecoverableErrorLocked(
 				ctx, lState, file,
 				result.redirtyOnRecoverableError)
@@ -2885,11 +3441,38 @@ func (fbo *folderBlockOps) setCachedAttr(
 		fileEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.Xattrs = realEntry.Xattrs
 	}
 	fileEntry.Ctime = realEntry.Ctime
 	fbo.deCache[ref] = fileEntry
 }
 
+// UpdateCachedHardLinks updates any cached dirty entry for the given
+// hard link target in dir to match its set of hard links in the
+// (clean) directory block.  The node for the target is returned if
+// there is one.
+func (fbo *folderBlockOps) UpdateCachedHardLinks(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	dir path, name string) (Node, error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	dblock, err := fbo.getDirLocked(ctx, lState, kmd, dir, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	de, ok := dblock.Children[name]
+	if !ok {
+		return nil, nil
+	}
+	if fileEntry, ok := fbo.deCache[de.Ref()]; ok {
+		fileEntry.setHardLinks(de.HardLinks)
+		fbo.deCache[de.Ref()] = fileEntry
+	}
+	return fbo.nodeCache.Get(de.Ref()), nil
+}
+
 // UpdateCachedEntryAttributes updates any cached entry for the given
 // path according to the given op. The node for the path is returned
 // if there is one.
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -48,45 +50,17 @@ const (
 	archiveOffline                   // an offline, read-only branch
 )
 
-// Constants used in this file.  TODO: Make these configurable?
+// Constants used in this file.  The tunable ones are in
+// tuning_config.go.
 const (
-	// MaxBlockSizeBytesDefault is the default maximum block size for KBFS.
-	// 512K blocks by default, block changes embedded max == 8K.
-	// Block size was chosen somewhat arbitrarily by trying to
-	// minimize the overall size of the history written by a user when
-	// appending 1KB writes to a file, up to a 1GB total file.  Here
-	// is the output of a simple script that approximates that
-	// calculation:
-	//
-	// Total history size for 0065536-byte blocks: 1134341128192 bytes
-	// Total history size for 0131072-byte blocks: 618945052672 bytes
-	// Total history size for 0262144-byte blocks: 412786622464 bytes
-	// Total history size for 0524288-byte blocks: 412786622464 bytes
-	// Total history size for 1048576-byte blocks: 618945052672 bytes
-	// Total history size for 2097152-byte blocks: 1134341128192 bytes
-	// Total history size for 4194304-byte blocks: 2216672886784 bytes
-	MaxBlockSizeBytesDefault = 512 << 10
 	// Maximum number of blocks that can be sent in parallel
 	maxParallelBlockPuts = 100
 	// Maximum number of blocks that can be fetched in parallel
 	maxParallelBlockGets = 10
 	// Max response size for a single DynamoDB query is 1MB.
 	maxMDsAtATime = 10
-	// Time between checks for dirty files to flush, in case Sync is
-	// never called.
-	secondsBetweenBackgroundFlushes = 10
 	// Cap the number of times we retry after a recoverable error
 	maxRetriesOnRecoverableErrors = 10
-	// When the number of dirty bytes exceeds this level, force a sync.
-	dirtyBytesThreshold = maxParallelBlockPuts * MaxBlockSizeBytesDefault
-	// The timeout for any background task.
-	backgroundTaskTimeout = 1 * time.Minute
-	// If it's been more than this long since our last update, check
-	// the current head before downloading all of the new revisions.
-	fastForwardTimeThresh = 15 * time.Minute
-	// If there are more than this many new revisions, fast forward
-	// rather than downloading them all.
-	fastForwardRevThresh = 50
 )
 
 type fboMutexLevel mutexLevel
@@ -221,9 +195,13 @@ type folderBranchOps struct {
 	config       Config
 	folderBranch FolderBranch
 	bid          BranchID // protected by mdWriterLock
-	bType        branchType
 	observers    *observerList
 
+	// bType changes between its online and offline versions as the
+	// connection to the MD server comes and goes.
+	bTypeLock sync.RWMutex
+	bType     branchType
+
 	// these locks, when locked concurrently by the same goroutine,
 	// should only be taken in the following order to avoid deadlock:
 	mdWriterLock leveledMutex // taken by any method making MD modifications
@@ -231,9 +209,16 @@ type folderBranchOps struct {
 	// protects access to head and latestMergedRevision.
 	headLock leveledRWMutex
 	head     ImmutableRootMetadata
+	// txnHead is the local view of the writes made during the open
+	// transaction, if any, which reads see instead of head.
+	txnHead ImmutableRootMetadata
 	// latestMergedRevision tracks the latest heard merged revision on server
 	latestMergedRevision MetadataRevision
 
+	// txn is the open transaction, if any.  Only set with both
+	// mdWriterLock and headLock held, so it can be read with either.
+	txn *folderTxn
+
 	blocks folderBlockOps
 
 	// nodeCache itself is goroutine-safe, but this object's use
@@ -366,8 +351,9 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
 	fbo.editHistory = NewTlfEditHistory(config, fbo, log)
+	fbo.status.setOffline(fbo.isOffline())
 	if config.DoBackgroundFlushes() {
-		go fbo.backgroundFlusher(secondsBetweenBackgroundFlushes * time.Second)
+		go fbo.backgroundFlusher(config.TuningConfig().BackgroundFlushPeriod)
 	}
 
 	return fbo
@@ -387,12 +373,16 @@ func (fbo *folderBranchOps) markForReIdentifyIfNeeded(now time.Time, maxValid ti
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by folderBranchOps.
 func (fbo *folderBranchOps) Shutdown() error {
+	fbo.abortTransactionForShutdown(context.TODO())
+
 	if fbo.config.CheckStateOnShutdown() {
 		ctx := context.TODO()
 		lState := makeFBOLockState()
 
 		if fbo.blocks.GetState(lState) == dirtyState {
 			fbo.log.CDebugf(ctx, "Skipping state-checking due to dirty state")
+		} else if fbo.isArchived() {
+			fbo.log.CDebugf(ctx, "Skipping state-checking due to being archived")
 		} else if !fbo.isMasterBranch(lState) {
 			fbo.log.CDebugf(ctx, "Skipping state-checking due to being staged")
 		} else {
@@ -410,6 +400,7 @@ func (fbo *folderBranchOps) Shutdown() error {
 	}
 
 	close(fbo.shutdownChan)
+	fbo.config.BlockOps().Prefetcher().CancelTlfPrefetches(fbo.id())
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
 	fbo.editHistory.Shutdown()
@@ -429,6 +420,72 @@ func (fbo *folderBranchOps) branch() BranchName {
 	return fbo.folderBranch.Branch
 }
 
+func (fbo *folderBranchOps) getBranchType() branchType {
+	fbo.bTypeLock.RLock()
+	defer fbo.bTypeLock.RUnlock()
+	return fbo.bType
+}
+
+// isArchived returns true if this is a read-only view of the TLF at
+// a past revision.
+func (fbo *folderBranchOps) isArchived() bool {
+	bType := fbo.getBranchType()
+	return bType == archive || bType == archiveOffline
+}
+
+// hasNodes returns true if any nodes of this folder-branch may still
+// be in use.
+func (fbo *folderBranchOps) hasNodes() bool {
+	ncs, ok := fbo.nodeCache.(*nodeCacheStandard)
+	// Assume other kinds of caches are in use.
+	return !ok || ncs.numNodes() > 0
+}
+
+// isOffline returns true if the MD server can't currently be
+// reached.
+func (fbo *folderBranchOps) isOffline() bool {
+	bType := fbo.getBranchType()
+	return bType == offline || bType == archiveOffline
+}
+
+// setOffline moves this folder-branch between the online and offline
+// modes.  Journaled TLFs keep accepting writes while offline; when
+// coming back online, the journal is kicked so that those writes get
+// flushed (and resolved, if they conflict with anything that
+// happened in the meantime).
+func (fbo *folderBranchOps) setOffline(ctx context.Context, goOffline bool) {
+	changed := func() bool {
+		fbo.bTypeLock.Lock()
+		defer fbo.bTypeLock.Unlock()
+		oldType := fbo.bType
+		switch {
+		case goOffline && fbo.bType == standard:
+			fbo.bType = offline
+		case goOffline && fbo.bType == archive:
+			fbo.bType = archiveOffline
+		case !goOffline && fbo.bType == offline:
+			fbo.bType = standard
+		case !goOffline && fbo.bType == archiveOffline:
+			fbo.bType = archive
+		}
+		return fbo.bType != oldType
+	}()
+	if !changed {
+		return
+	}
+
+	fbo.status.setOffline(goOffline)
+	if goOffline {
+		fbo.log.CDebugf(ctx, "Going offline")
+		return
+	}
+
+	fbo.log.CDebugf(ctx, "Back online")
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		jServer.signalWork(fbo.id())
+	}
+}
+
 func (fbo *folderBranchOps) GetFavorites(ctx context.Context) (
 	[]Favorite, error) {
 	return nil, errors.New("GetFavorites is not supported by folderBranchOps")
@@ -494,6 +551,13 @@ func (fbo *folderBranchOps) getHead(lState *lockState) ImmutableRootMetadata {
 	return fbo.head
 }
 
+func (fbo *folderBranchOps) getTxnHead(
+	lState *lockState) ImmutableRootMetadata {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.txnHead
+}
+
 // isMasterBranch should not be called if mdWriterLock is already taken.
 func (fbo *folderBranchOps) isMasterBranch(lState *lockState) bool {
 	fbo.mdWriterLock.Lock(lState)
@@ -887,6 +951,13 @@ func (fbo *folderBranchOps) getMDLocked(
 		err = fbo.identifyOnce(ctx, md.ReadOnly())
 	}()
 
+	if rtype == mdReadNoIdentify || rtype == mdReadNeedIdentify {
+		md = fbo.getTxnHead(lState)
+		if md != (ImmutableRootMetadata{}) {
+			return md, nil
+		}
+	}
+
 	md = fbo.getHead(lState)
 	if md != (ImmutableRootMetadata{}) {
 		return md, nil
@@ -1036,6 +1107,15 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 		return nil, NewWriteAccessError(md.GetTlfHandle(), username, filename)
 	}
 
+	// Writes during a transaction build on the transaction's MD.
+	// Hand out a copy, so that a failed write leaves no trace.
+	if fbo.txn != nil {
+		if err := fbo.checkTxnWriterLocked(ctx); err != nil {
+			return nil, err
+		}
+		return fbo.txn.md.deepCopy(fbo.config.Codec())
+	}
+
 	// Make a new successor of the current MD to hold the coming
 	// writes.  The caller must pass this into
 	// syncBlockAndCheckEmbedLocked or the changes will be lost.
@@ -1284,6 +1364,20 @@ func (fbo *folderBranchOps) GetRootNode(
 	return nil, EntryInfo{}, errors.New("GetRootNode is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) GetRootNodeAtRevision(
+	ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+	node Node, ei EntryInfo, err error) {
+	return nil, EntryInfo{}, errors.New(
+		"GetRootNodeAtRevision is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) GetRootNodeAtTime(
+	ctx context.Context, h *TlfHandle, t time.Time) (
+	node Node, ei EntryInfo, err error) {
+	return nil, EntryInfo{}, errors.New(
+		"GetRootNodeAtTime is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) checkNode(node Node) error {
 	fb := node.GetFolderBranch()
 	if fb != fbo.folderBranch {
@@ -1292,6 +1386,24 @@ func (fbo *folderBranchOps) checkNode(node Node) error {
 	return nil
 }
 
+// checkNodeForWrite is like checkNode, but also makes sure this
+// branch can be modified.
+func (fbo *folderBranchOps) checkNodeForWrite(node Node) error {
+	err := fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+	if fbo.isArchived() {
+		return WriteToReadonlyNodeError{node.GetBasename()}
+	}
+	// Without a journal, there's nowhere to put writes while the
+	// MD server is unreachable.
+	if fbo.isOffline() && !TLFJournalEnabled(fbo.config, fbo.id()) {
+		return OfflineUnjournaledError{fbo.id()}
+	}
+	return nil
+}
+
 // SetInitialHeadFromServer sets the head to the given
 // ImmutableRootMetadata, which must be retrieved from the MD server.
 func (fbo *folderBranchOps) SetInitialHeadFromServer(
@@ -1321,6 +1433,10 @@ func (fbo *folderBranchOps) SetInitialHeadFromServer(
 
 	return runUnlessCanceled(ctx, func() error {
 		fb := FolderBranch{md.TlfID(), MasterBranch}
+		if fbo.isArchived() {
+			// Archived branches are pinned to a single revision.
+			fb.Branch = MakeRevBranchName(md.Revision())
+		}
 		if fb != fbo.folderBranch {
 			return WrongOpsError{fbo.folderBranch, fb}
 		}
@@ -1540,6 +1656,10 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 		if err != nil {
 			return err
 		}
+		if !dirPath.hasValidParent() {
+			delete(children, hardLinksDirName)
+			delete(children, trashDirName)
+		}
 		return nil
 	})
 	if err != nil {
@@ -1548,6 +1668,57 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 	return children, nil
 }
 
+// isHardLinksDir returns true if name, within dir, is the hidden
+// hard links directory of the TLF.
+func isHardLinksDir(dir path, name string) bool {
+	return !dir.hasValidParent() && name == hardLinksDirName
+}
+
+// isHiddenDir returns true if name, within dir, is one of the hidden
+// directories of the TLF, which users can't see or change directly.
+func isHiddenDir(dir path, name string) bool {
+	return isHardLinksDir(dir, name) || isTrashDir(dir, name)
+}
+
+// hardLinksDirNode returns the node for the given hard links
+// directory path.
+func (fbo *folderBranchOps) hardLinksDirNode(linksDir path) (Node, error) {
+	rootPtr := linksDir.path[0].BlockPointer
+	rootNode := fbo.nodeCache.Get(rootPtr.Ref())
+	if rootNode == nil {
+		return nil, NodeNotFoundError{rootPtr}
+	}
+	return fbo.nodeCache.GetOrCreate(
+		linksDir.tailPointer(), hardLinksDirName, rootNode)
+}
+
+// hardLinkTargetNode returns the node and entry of the target of the
+// given hard link entry within dir.
+func (fbo *folderBranchOps) hardLinkTargetNode(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, de DirEntry) (
+	Node, DirEntry, error) {
+	linksDir, target, err := fbo.blocks.GetHardLinkTarget(
+		ctx, lState, kmd, dir, de)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	linksDirNode, err := fbo.hardLinksDirNode(linksDir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	err = fbo.blocks.checkDataVersion(
+		linksDir.ChildPathNoPtr(de.HardLinkTarget), target.BlockPointer)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	node, err := fbo.nodeCache.GetOrCreate(
+		target.BlockPointer, de.HardLinkTarget, linksDirNode)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	return node, target, nil
+}
+
 func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	node Node, ei EntryInfo, err error) {
 	fbo.log.CDebugf(ctx, "Lookup %p %s", dir.GetID(), name)
@@ -1572,6 +1743,10 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 			return err
 		}
 
+		if isHiddenDir(dirPath, name) {
+			return NoSuchNameError{name}
+		}
+
 		childPath := dirPath.ChildPathNoPtr(name)
 
 		de, err = fbo.blocks.GetDirtyEntry(
@@ -1580,7 +1755,13 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 			return err
 		}
 
-		if de.Type == Sym {
+		if de.isHardLink() {
+			node, de, err = fbo.hardLinkTargetNode(
+				ctx, lState, md.ReadOnly(), dirPath, de)
+			if err != nil {
+				return err
+			}
+		} else if de.Type == Sym {
 			node = nil
 		} else {
 			err = fbo.blocks.checkDataVersion(childPath, de.BlockPointer)
@@ -1742,6 +1923,136 @@ func (fbo *folderBranchOps) readyBlockMultiple(ctx context.Context,
 	return
 }
 
+// readyDirBlock readies the given directory block, which may be an
+// assembled view of an indirect directory (see DirBlock).  If all of
+// the entries fit in a single block of at most MaxDirBlockBytes, a
+// direct block is readied, and any child blocks from an old indirect
+// version are unreferenced.  Otherwise, the entries are split by name
+// into new child blocks under an indirect top block.  Child blocks
+// whose contents haven't changed are reused; only the rest are
+// readied and referenced in md, and the old ones unreferenced.  The
+// returned info is for the top block, and the returned size is the
+// total plaintext size of all the entries.
+func (fbo *folderBranchOps) readyDirBlock(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock,
+	uid keybase1.UID, bps *blockPutState) (
+	info BlockInfo, plainSize int, err error) {
+	maxBytes := int(fbo.config.MaxDirBlockBytes())
+	if !dblock.isAssembled() {
+		// Most directories are small enough for a single block, so
+		// try that first.  This work is only wasted once, when the
+		// directory first grows too big.
+		info, plainSize, readyBlockData, err :=
+			ReadyBlock(ctx, fbo.config, md.ReadOnly(), dblock, uid)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		if plainSize <= maxBytes {
+			bps.addNewBlock(
+				info.BlockPointer, dblock, readyBlockData, nil)
+			return info, plainSize, nil
+		}
+	}
+
+	// Split before readying anything, so that an indirect directory
+	// only has its changed child blocks encrypted.
+	oldChildren := make(map[string]IndirectDirPtr, len(dblock.IPtrs))
+	for _, iptr := range dblock.IPtrs {
+		oldChildren[iptr.Off] = iptr
+	}
+	// A range whose entries all match the old child block at the
+	// same offset keeps that block and its recorded size, so that
+	// only the changed child blocks need to be encoded.
+	unchangedSize := func(off string, names []string) (int, bool, error) {
+		iptr, ok := oldChildren[off]
+		if !ok || iptr.PlainSize == 0 {
+			return 0, false, nil
+		}
+		oldChild, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
+			md.ReadOnly(), iptr.BlockPointer, fbo.branch(), path{})
+		if err != nil {
+			return 0, false, err
+		}
+		if len(oldChild.Children) != len(names) {
+			return 0, false, nil
+		}
+		for _, name := range names {
+			oldEntry, ok := oldChild.Children[name]
+			if !ok || !reflect.DeepEqual(oldEntry, dblock.Children[name]) {
+				return 0, false, nil
+			}
+		}
+		return iptr.PlainSize, true, nil
+	}
+	ranges, err := splitDirBlock(
+		fbo.config.Codec(), dblock, maxBytes, unchangedSize)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	totalSize := 0
+	for _, r := range ranges {
+		totalSize += r.size
+	}
+	if dblock.isAssembled() && totalSize <= maxBytes {
+		// The entries encode to no more than the sum of the
+		// sizes of the ranges, so they fit in a direct block.
+		direct := NewDirBlock().(*DirBlock)
+		direct.Children = dblock.Children
+		info, plainSize, readyBlockData, err :=
+			ReadyBlock(ctx, fbo.config, md.ReadOnly(), direct, uid)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		for _, iptr := range dblock.IPtrs {
+			md.AddUnrefBlock(iptr.BlockInfo)
+		}
+		bps.addNewBlock(info.BlockPointer, direct, readyBlockData, nil)
+		return info, plainSize, nil
+	}
+	topBlock := NewDirBlock().(*DirBlock)
+	topBlock.IsInd = true
+	topBlock.Children = nil
+	plainSize = 0
+	for _, r := range ranges {
+		plainSize += r.size
+		if r.unchanged {
+			topBlock.IPtrs = append(topBlock.IPtrs, oldChildren[r.off])
+			delete(oldChildren, r.off)
+			continue
+		}
+
+		child := makeDirBlockChild(dblock.Children, r.names)
+		childInfo, childSize, err := fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), child, uid, bps)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		md.AddRefBlock(childInfo)
+		topBlock.IPtrs = append(topBlock.IPtrs, IndirectDirPtr{
+			BlockInfo: childInfo,
+			Off:       r.off,
+			PlainSize: childSize,
+		})
+	}
+	for _, iptr := range oldChildren {
+		md.AddUnrefBlock(iptr.BlockInfo)
+	}
+
+	info, _, readyBlockData, err :=
+		ReadyBlock(ctx, fbo.config, md.ReadOnly(), topBlock, uid)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	// Keep the assembled view around for the block cache, so that
+	// the children don't have to be fetched again.
+	assembled := NewDirBlock().(*DirBlock)
+	assembled.Children = dblock.Children
+	assembled.IPtrs = topBlock.IPtrs
+	assembled.SetEncodedSize(uint32(readyBlockData.GetEncodedSize()))
+	bps.addNewBlock(info.BlockPointer, assembled, readyBlockData, nil)
+	return info, plainSize, nil
+}
+
 func (fbo *folderBranchOps) unembedBlockChanges(
 	ctx context.Context, bps *blockPutState, md *RootMetadata,
 	changes *BlockChanges, uid keybase1.UID) error {
@@ -1850,8 +2161,16 @@ func (fbo *folderBranchOps) syncBlock(
 	doSetTime := true
 	now := fbo.nowUnixNano()
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err := fbo.readyBlockMultiple(
-			ctx, md.ReadOnly(), currBlock, uid, bps)
+		var info BlockInfo
+		var plainSize int
+		var err error
+		if dblock, ok := currBlock.(*DirBlock); ok {
+			info, plainSize, err = fbo.readyDirBlock(
+				ctx, lState, md, dblock, uid, bps)
+		} else {
+			info, plainSize, err = fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), currBlock, uid, bps)
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
@@ -1928,9 +2247,8 @@ func (fbo *folderBranchOps) syncBlock(
 		}
 
 		if de.Type == Dir {
-			// TODO: When we use indirect dir blocks,
-			// we'll have to calculate the size some other
-			// way.
+			// For an indirect directory, this is the total
+			// size of all its child blocks.
 			de.Size = uint64(plainSize)
 		}
 
@@ -2030,8 +2348,9 @@ func (fbo *folderBranchOps) syncBlockAndCheckEmbedLocked(ctx context.Context,
 	}
 
 	// Do the block changes need their own blocks?  Unembed only if
-	// this is the final call to this function with this MD.
-	if stopAt == zeroPtr {
+	// this is the final call to this function with this MD.  An
+	// open transaction unembeds only when it commits.
+	if stopAt == zeroPtr && fbo.txn == nil {
 		bsplit := fbo.config.BlockSplitter()
 		if !bsplit.ShouldEmbedBlockChanges(&md.data.Changes) {
 			err = fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes,
@@ -2067,6 +2386,7 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 		return nil
 	}
 	bcache := fbo.config.BlockCache()
+	var compressionSavings int64
 	for _, blockState := range bps.blockStates {
 		newPtr := blockState.blockPtr
 		// only cache this block if we made a brand new block, not if
@@ -2078,6 +2398,13 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 			TransientEntry); err != nil {
 			return err
 		}
+		compressionSavings +=
+			int64(blockState.readyBlockData.compressionSavings)
+	}
+	// The blocks of an open transaction are finalized again when
+	// it commits, so only count them then.
+	if fbo.txn == nil || fbo.txn.committing {
+		fbo.status.addCompressionSavings(compressionSavings)
 	}
 	return nil
 }
@@ -2102,6 +2429,13 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, bps *blockPutState, excl Excl) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	// Writes during a transaction are only applied locally until
+	// the transaction commits, so exclusive creates can only be
+	// checked against the local state.
+	if fbo.txn != nil && !fbo.txn.committing {
+		return fbo.finalizeTxnWriteLocked(ctx, lState, md, bps)
+	}
+
 	// finally, write out the new metadata
 	mdops := fbo.config.MDOps()
 
@@ -2230,6 +2564,12 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 		fbo.fbm.archiveUnrefBlocks(irmd.ReadOnly())
 	}
 
+	if fbo.txn != nil {
+		// The ops of a transaction were already applied locally
+		// as they happened.
+		fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
+		return nil
+	}
 	fbo.notifyBatchLocked(ctx, lState, irmd)
 	return nil
 }
@@ -2341,6 +2681,12 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
 	fbo.mdWriterLock.Lock(lState)
 	defer fbo.mdWriterLock.Unlock(lState)
 
+	// Don't mix a GC op into a transaction; just wait for the next
+	// period.
+	if fbo.txn != nil {
+		return TransactionInProgressError{fbo.folderBranch}
+	}
+
 	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
 		return err
@@ -2492,6 +2838,18 @@ func (fbo *folderBranchOps) createEntryLocked(
 		return nil, DirEntry{}, err
 	}
 
+	return fbo.createEntryNoPrefixCheckLocked(
+		ctx, lState, dir, name, entryType, excl)
+}
+
+// createEntryNoPrefixCheckLocked is like createEntryLocked, but it
+// allows names with disallowed prefixes, for creating hidden
+// entries.  entryType must not by Sym.
+func (fbo *folderBranchOps) createEntryNoPrefixCheckLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType, excl Excl) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
 	if uint32(len(name)) > fbo.config.MaxNameBytes() {
 		return nil, DirEntry{},
 			NameTooLongError{name, fbo.config.MaxNameBytes()}
@@ -2642,7 +3000,7 @@ func (fbo *folderBranchOps) CreateDir(
 		}
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
@@ -2678,7 +3036,7 @@ func (fbo *folderBranchOps) CreateFile(
 		}
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
@@ -2798,7 +3156,7 @@ func (fbo *folderBranchOps) CreateLink(
 		dir.GetID(), fromName, toPath)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return EntryInfo{}, err
 	}
@@ -2818,137 +3176,591 @@ func (fbo *folderBranchOps) CreateLink(
 	return retEntryInfo, nil
 }
 
-// unrefEntry modifies md to unreference all relevant blocks for the
-// given entry.
-func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, de DirEntry,
-	name string) error {
-	md.AddUnrefBlock(de.BlockInfo)
-	// construct a path for the child so we can unlink with it.
-	childPath := dir.ChildPath(name, de.BlockPointer)
+// getOrCreateHiddenDirLocked returns the node for the given hidden
+// directory at the root of this TLF, like the hard links directory,
+// creating the directory in its own revision if it doesn't exist
+// yet.
+func (fbo *folderBranchOps) getOrCreateHiddenDirLocked(
+	ctx context.Context, lState *lockState, name string) (Node, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	// If this is an indirect block, we need to delete all of its
-	// children as well. NOTE: non-empty directories can't be
-	// removed, so no need to check for indirect directory blocks
-	// here.
-	if de.Type == File || de.Type == Exec {
-		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
-			ctx, lState, md.ReadOnly(), childPath)
-		if isRecoverableBlockErrorForRemoval(err) {
-			msg := fmt.Sprintf("Recoverable block error encountered for unrefEntry(%v); continuing", childPath)
-			fbo.log.CWarningf(ctx, "%s", msg)
-			fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
-		} else if err != nil {
-			return err
-		}
-		for _, blockInfo := range blockInfos {
-			md.AddUnrefBlock(blockInfo)
-		}
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	rootPtr := md.data.Dir.BlockPointer
+	rootNode := fbo.nodeCache.Get(rootPtr.Ref())
+	if rootNode == nil {
+		return nil, NodeNotFoundError{rootPtr}
+	}
+	rootPath, err := fbo.pathFromNodeForMDWriteLocked(lState, rootNode)
+	if err != nil {
+		return nil, err
+	}
+
+	de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md.ReadOnly(),
+		rootPath.ChildPathNoPtr(name))
+	switch err.(type) {
+	case nil:
+		return fbo.nodeCache.GetOrCreate(de.BlockPointer, name, rootNode)
+	case NoSuchNameError:
+		fbo.log.CDebugf(ctx, "Creating the %s directory", name)
+		node, _, err := fbo.createEntryNoPrefixCheckLocked(
+			ctx, lState, rootNode, name, Dir, NoExcl)
+		return node, err
+	default:
+		return nil, err
 	}
-	return nil
 }
 
-func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, name string) error {
+// prepHiddenDirLocked returns the node and path of the given hidden
+// directory at the root of this TLF, as of md.  If the directory
+// doesn't exist yet, it is created in md, as the first step of a
+// write that makes its changes to md in several steps (see
+// finishSyncStep).  The given paths, looked up before, are then
+// rebased onto the new root block, and the returned blocks must be
+// put along with md; otherwise there are no blocks to put.
+func (fbo *folderBranchOps) prepHiddenDirLocked(ctx context.Context,
+	lState *lockState, uid keybase1.UID, md *RootMetadata, name string,
+	paths ...*path) (Node, path, *blockPutState, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	pblock, err := fbo.blocks.GetDir(
-		ctx, lState, md.ReadOnly(), dir, blockWrite)
+	rootPtr := md.data.Dir.BlockPointer
+	rootNode := fbo.nodeCache.Get(rootPtr.Ref())
+	if rootNode == nil {
+		return nil, path{}, nil, NodeNotFoundError{rootPtr}
+	}
+	rootPath, err := fbo.pathFromNodeForMDWriteLocked(lState, rootNode)
 	if err != nil {
-		return err
+		return nil, path{}, nil, err
 	}
 
-	// make sure the entry exists
-	de, ok := pblock.Children[name]
-	if !ok {
-		return NoSuchNameError{name}
+	de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md.ReadOnly(),
+		rootPath.ChildPathNoPtr(name))
+	switch err.(type) {
+	case nil:
+		node, err := fbo.nodeCache.GetOrCreate(
+			de.BlockPointer, name, rootNode)
+		if err != nil {
+			return nil, path{}, nil, err
+		}
+		return node, rootPath.ChildPath(name, de.BlockPointer),
+			newBlockPutState(0), nil
+	case NoSuchNameError:
+	default:
+		return nil, path{}, nil, err
 	}
 
-	ro, err := newRmOp(name, dir.tailPointer())
+	fbo.log.CDebugf(ctx, "Creating the %s directory", name)
+	co, err := newCreateOp(name, rootPtr, Dir)
 	if err != nil {
-		return err
+		return nil, path{}, nil, err
 	}
-	md.AddOp(ro)
-	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
+	md.AddOp(co)
+	hiddenPath, _, bps, err := fbo.syncBlockLocked(ctx, lState, uid, md,
+		NewDirBlock(), rootPath, name, Dir, true, true, zeroPtr, nil)
 	if err != nil {
-		return err
+		return nil, path{}, nil, err
+	}
+	err = fbo.finishSyncStep(bps, co, paths...)
+	if err != nil {
+		return nil, path{}, nil, err
+	}
+	// The node is made now, so that the ops of the later steps
+	// that move things into the new directory find it when md is
+	// finalized.
+	node, err := fbo.nodeCache.GetOrCreate(
+		hiddenPath.tailPointer(), name, rootNode)
+	if err != nil {
+		return nil, path{}, nil, err
 	}
+	return node, hiddenPath, bps, nil
+}
 
-	// the actual unlink
-	delete(pblock.Children, name)
+// finishSyncStep finishes one step of a write that makes its changes
+// to md in several steps, each of which syncs its own blocks, like a
+// transaction does with whole writes.  It caches the blocks readied
+// by the step, in bps, so that the next steps can build on them.  o
+// is the last op of the step, which got all the pointer updates from
+// the sync; the given paths, looked up before the step, are rebased
+// onto the new pointers.
+func (fbo *folderBranchOps) finishSyncStep(
+	bps *blockPutState, o op, paths ...*path) error {
+	bcache := fbo.config.BlockCache()
+	for _, blockState := range bps.blockStates {
+		err := bcache.Put(blockState.blockPtr, fbo.id(), blockState.block,
+			TransientEntry)
+		if err != nil {
+			return err
+		}
+	}
 
-	// sync the parent directory
-	_, err = fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, pblock, *dir.parentPath(), dir.tailName(),
-		Dir, true, true, zeroPtr, NoExcl)
-	if err != nil {
-		return err
+	updates := make(map[BlockPointer]BlockPointer)
+	for _, update := range o.allUpdates() {
+		updates[update.Unref] = update.Ref
+	}
+	for _, p := range paths {
+		newPath := path{
+			FolderBranch: p.FolderBranch,
+			path:         make([]pathNode, len(p.path)),
+		}
+		for i, pn := range p.path {
+			if ref, ok := updates[pn.BlockPointer]; ok {
+				pn.BlockPointer = ref
+			}
+			newPath.path[i] = pn
+		}
+		*p = newPath
 	}
 	return nil
 }
 
-func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
-	lState *lockState, dir Node, dirName string) (err error) {
+// convertToHardLinkLocked moves the file at filePath into the hard
+// links directory under a new random name, and leaves a hard link to
+// it in its place.  This is a step of a write that makes its changes
+// to md in several steps (see finishSyncStep), so it returns the new
+// name of the file along with the blocks of the step, and rebases
+// the given paths.
+func (fbo *folderBranchOps) convertToHardLinkLocked(ctx context.Context,
+	lState *lockState, uid keybase1.UID, md *RootMetadata, filePath path,
+	linksPath path, paths ...*path) (string, *blockPutState, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	targetName, err := makeHardLinkID()
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	linkID, err := makeHardLinkID()
+	if err != nil {
+		return "", nil, err
 	}
 
-	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	parentPath := *filePath.parentPath()
+	name := filePath.tailName()
+	oldPBlock, newPBlock, newDe, ro, lbc, err := fbo.blocks.PrepRename(
+		ctx, lState, md, parentPath, name, linksPath, targetName)
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	if newDe.Type != File && newDe.Type != Exec {
+		return "", nil, NotFileError{filePath}
 	}
 
-	pblock, err := fbo.blocks.GetDir(
-		ctx, lState, md.ReadOnly(), dirPath, blockRead)
-	de, ok := pblock.Children[dirName]
-	if !ok {
-		return NoSuchNameError{dirName}
+	lo, err := newLinkOp(name, parentPath.tailPointer(), targetName,
+		linksPath.tailPointer(), linkID, false)
+	if err != nil {
+		return "", nil, err
 	}
+	md.AddOp(lo)
 
-	// construct a path for the child so we can check for an empty dir
-	childPath := dirPath.ChildPath(dirName, de.BlockPointer)
+	now := fbo.nowUnixNano()
+	newDe.setHardLinks(map[string]bool{linkID: true})
+	newDe.Ctime = now
+	newPBlock.Children[targetName] = newDe
+	oldPBlock.Children[name] = makeHardLinkEntry(
+		newDe, targetName, linkID, now)
 
-	childBlock, err := fbo.blocks.GetDir(
-		ctx, lState, md.ReadOnly(), childPath, blockRead)
-	if isRecoverableBlockErrorForRemoval(err) {
-		msg := fmt.Sprintf("Recoverable block error encountered for removeDirLocked(%v); continuing", childPath)
-		fbo.log.CWarningf(ctx, "%s", msg)
-		fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
-	} else if err != nil {
-		return err
-	} else if len(childBlock.Children) > 0 {
-		return DirNotEmptyError{dirName}
+	bps, err := fbo.syncTwoDirsLocked(ctx, lState, uid, md, parentPath,
+		oldPBlock, linksPath, newPBlock, lbc)
+	if err != nil {
+		return "", nil, err
 	}
-
-	return fbo.removeEntryLocked(ctx, lState, md, dirPath, dirName)
+	// The syncs only update the last op, so bring the rename up to
+	// date as well.
+	ro.AddUpdate(lo.Dir.Unref, lo.Dir.Ref)
+	ro.AddUpdate(lo.TargetDir.Unref, lo.TargetDir.Ref)
+	err = fbo.finishSyncStep(bps, lo, paths...)
+	if err != nil {
+		return "", nil, err
+	}
+	return targetName, bps, nil
 }
 
-func (fbo *folderBranchOps) RemoveDir(
-	ctx context.Context, dir Node, dirName string) (err error) {
-	fbo.log.CDebugf(ctx, "RemoveDir %p %s", dir.GetID(), dirName)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+// createHardLinkLocked makes a new hard link to file, named name in
+// dir.  Everything happens in a single revision: creating the hard
+// links directory if needed, moving the file into it if it isn't the
+// target of any hard links yet, and making the new link.
+func (fbo *folderBranchOps) createHardLinkLocked(
+	ctx context.Context, lState *lockState, file Node, dir Node,
+	name string) (DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	err = fbo.checkNode(dir)
-	if err != nil {
-		return
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return DirEntry{}, err
 	}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			return fbo.removeDirLocked(ctx, lState, dir, dirName)
-		})
-}
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return DirEntry{},
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if !filePath.hasValidParent() {
+		return DirEntry{}, InvalidParentPathError{filePath}
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	linksNode, linksPath, bps, err := fbo.prepHiddenDirLocked(
+		ctx, lState, uid, md, hardLinksDirName, &filePath, &dirPath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// If the file isn't yet the target of any hard links, it first
+	// needs to move into the hard links directory.
+	if filePath.parentPath().tailPointer() != linksPath.tailPointer() {
+		targetName, convertBps, err := fbo.convertToHardLinkLocked(
+			ctx, lState, uid, md, filePath, linksPath, &dirPath, &linksPath)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		bps.mergeOtherBps(convertBps)
+		filePath = linksPath.ChildPath(targetName, filePath.tailPointer())
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// does name already exist?
+	if _, ok := dblock.Children[name]; ok {
+		return DirEntry{}, NameExistsError{name}
+	}
+
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		return DirEntry{}, err
+	}
+
+	lblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), linksPath, blockWrite)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	targetName := filePath.tailName()
+	target, ok := lblock.Children[targetName]
+	if !ok {
+		return DirEntry{}, NoSuchNameError{targetName}
+	}
+	if target.Type != File && target.Type != Exec {
+		return DirEntry{}, NotFileError{filePath}
+	}
+
+	linkID, err := makeHardLinkID()
+	if err != nil {
+		return DirEntry{}, err
+	}
+	lo, err := newLinkOp(name, dirPath.tailPointer(), targetName,
+		linksPath.tailPointer(), linkID, false)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	md.AddOp(lo)
+
+	now := fbo.nowUnixNano()
+	links := copyHardLinks(target.HardLinks)
+	links[linkID] = true
+	target.setHardLinks(links)
+	target.Ctime = now
+	lblock.Children[targetName] = target
+	dblock.Children[name] = makeHardLinkEntry(
+		target, targetName, linkID, now)
+
+	linkBps, err := fbo.syncTwoDirsLocked(ctx, lState, uid, md, linksPath,
+		lblock, dirPath, dblock, make(localBcache))
+	if err != nil {
+		return DirEntry{}, err
+	}
+	bps.mergeOtherBps(linkBps)
+	err = fbo.putBlocksAndFinalizeLocked(ctx, lState, uid, md, bps)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	// The ops in md need the node of the hard links directory
+	// until they've been applied to the node cache.
+	runtime.KeepAlive(linksNode)
+	return target, nil
+}
+
+func (fbo *folderBranchOps) CreateHardLink(
+	ctx context.Context, file Node, dir Node, name string) (
+	ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateHardLink %p -> %p %s",
+		file.GetID(), dir.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set ei directly, as that can cause a race when
+			// the Create is canceled.
+			de, err := fbo.createHardLinkLocked(
+				ctx, lState, file, dir, name)
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return retEntryInfo, nil
+}
+
+// removeHardLinkLocked removes the given hard link entry from dir,
+// whose modifiable block is dblock.  The target of the link is only
+// removed, and its blocks unreferenced, when its last link goes
+// away.
+func (fbo *folderBranchOps) removeHardLinkLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, dblock *DirBlock,
+	name string, de DirEntry, linksPath path) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	lblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), linksPath, blockWrite)
+	if err != nil {
+		return err
+	}
+	targetName := de.HardLinkTarget
+	target, ok := lblock.Children[targetName]
+	if !ok {
+		return NoSuchNameError{targetName}
+	}
+
+	links := copyHardLinks(target.HardLinks)
+	delete(links, de.HardLinkID)
+	var ro *rmOp
+	if len(links) == 0 {
+		ro, err = newRmOp(targetName, linksPath.tailPointer())
+		if err != nil {
+			return err
+		}
+		md.AddOp(ro)
+		err = fbo.unrefEntry(ctx, lState, md, linksPath, target, targetName)
+		if err != nil {
+			return err
+		}
+		delete(lblock.Children, targetName)
+	} else {
+		target.setHardLinks(links)
+		target.Ctime = fbo.nowUnixNano()
+		lblock.Children[targetName] = target
+	}
+
+	lo, err := newLinkOp(name, dir.tailPointer(), targetName,
+		linksPath.tailPointer(), de.HardLinkID, true)
+	if err != nil {
+		return err
+	}
+	md.AddOp(lo)
+	delete(dblock.Children, name)
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	bps, err := fbo.syncTwoDirsLocked(ctx, lState, uid, md, linksPath,
+		lblock, dir, dblock, make(localBcache))
+	if err != nil {
+		return err
+	}
+	if ro != nil {
+		// The syncs only update the last op, so bring the rm up to
+		// date as well.
+		ro.AddUpdate(lo.TargetDir.Unref, lo.TargetDir.Ref)
+	}
+	return fbo.putBlocksAndFinalizeLocked(ctx, lState, uid, md, bps)
+}
+
+// unrefEntry modifies md to unreference all relevant blocks for the
+// given entry.
+func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, de DirEntry,
+	name string) error {
+	if de.isHardLink() {
+		// Hard links have no blocks of their own; the target is
+		// only unreferenced along with its last link.
+		return nil
+	}
+	md.AddUnrefBlock(de.BlockInfo)
+	// construct a path for the child so we can unlink with it.
+	childPath := dir.ChildPath(name, de.BlockPointer)
+
+	// If this is an indirect block, we need to delete all of its
+	// children as well. NOTE: non-empty directories can't be
+	// removed, and empty ones always fit in a single direct block, so
+	// no need to check for indirect directory blocks here.
+	if de.Type == File || de.Type == Exec {
+		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, md.ReadOnly(), childPath)
+		if isRecoverableBlockErrorForRemoval(err) {
+			msg := fmt.Sprintf("Recoverable block error encountered for unrefEntry(%v); continuing", childPath)
+			fbo.log.CWarningf(ctx, "%s", msg)
+			fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
+		} else if err != nil {
+			return err
+		}
+		for _, blockInfo := range blockInfos {
+			md.AddUnrefBlock(blockInfo)
+		}
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	pblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dir, blockWrite)
+	if err != nil {
+		return err
+	}
+
+	// make sure the entry exists
+	de, ok := pblock.Children[name]
+	if !ok {
+		return NoSuchNameError{name}
+	}
+
+	if de.isHardLink() {
+		linksPath, _, err := fbo.blocks.GetHardLinkTarget(
+			ctx, lState, md.ReadOnly(), dir, de)
+		switch err.(type) {
+		case nil:
+			return fbo.removeHardLinkLocked(
+				ctx, lState, md, dir, pblock, name, de, linksPath)
+		case NoSuchNameError:
+			// The target is already gone, so just remove the
+			// dangling link below.
+			fbo.log.CDebugf(ctx, "Removing dangling hard link %s", name)
+		default:
+			return err
+		}
+	}
+
+	ro, err := newRmOp(name, dir.tailPointer())
+	if err != nil {
+		return err
+	}
+	md.AddOp(ro)
+	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
+	if err != nil {
+		return err
+	}
+
+	// the actual unlink
+	delete(pblock.Children, name)
+
+	// sync the parent directory
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, pblock, *dir.parentPath(), dir.tailName(),
+		Dir, true, true, zeroPtr, NoExcl)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
+	lState *lockState, dir Node, dirName string) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
+
+	if isHiddenDir(dirPath, dirName) {
+		return NoSuchNameError{dirName}
+	}
+
+	pblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	de, ok := pblock.Children[dirName]
+	if !ok {
+		return NoSuchNameError{dirName}
+	}
+
+	// construct a path for the child so we can check for an empty dir
+	childPath := dirPath.ChildPath(dirName, de.BlockPointer)
+
+	childBlock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), childPath, blockRead)
+	if isRecoverableBlockErrorForRemoval(err) {
+		msg := fmt.Sprintf("Recoverable block error encountered for removeDirLocked(%v); continuing", childPath)
+		fbo.log.CWarningf(ctx, "%s", msg)
+		fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
+	} else if err != nil {
+		return err
+	} else if len(childBlock.Children) > 0 {
+		return DirNotEmptyError{dirName}
+	}
+
+	trashed, err := fbo.trashEntryLocked(ctx, lState, dir, dirName)
+	if err != nil || trashed {
+		return err
+	}
+
+	return fbo.removeEntryLocked(ctx, lState, md, dirPath, dirName)
+}
+
+func (fbo *folderBranchOps) RemoveDir(
+	ctx context.Context, dir Node, dirName string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveDir %p %s", dir.GetID(), dirName)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.removeDirLocked(ctx, lState, dir, dirName)
+		})
+}
 
 func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 	name string) (err error) {
 	fbo.log.CDebugf(ctx, "RemoveEntry %p %s", dir.GetID(), name)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return err
 	}
@@ -2966,6 +3778,15 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 				return err
 			}
 
+			if isHiddenDir(dirPath, name) {
+				return NoSuchNameError{name}
+			}
+
+			trashed, err := fbo.trashEntryLocked(ctx, lState, dir, name)
+			if err != nil || trashed {
+				return err
+			}
+
 			return fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
 		})
 }
@@ -2981,7 +3802,7 @@ func (fbo *folderBranchOps) renameLocked(
 		return err
 	}
 
-	oldPBlock, newPBlock, newDe, lbc, err := fbo.blocks.PrepRename(
+	oldPBlock, newPBlock, newDe, _, lbc, err := fbo.blocks.PrepRename(
 		ctx, lState, md, oldParent, oldName, newParent, newName)
 
 	if err != nil {
@@ -3024,6 +3845,30 @@ func (fbo *folderBranchOps) renameLocked(
 	newPBlock.Children[newName] = newDe
 	delete(oldPBlock.Children, oldName)
 
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	bps, err := fbo.syncTwoDirsLocked(ctx, lState, uid, md, oldParent,
+		oldPBlock, newParent, newPBlock, lbc)
+	if err != nil {
+		return err
+	}
+	return fbo.putBlocksAndFinalizeLocked(ctx, lState, uid, md, bps)
+}
+
+// syncTwoDirsLocked readies the given modified blocks of two
+// directories (which may be the same), along with all of their
+// ancestors up to the root, as part of a single MD update.  lbc may
+// hold other modified ancestor blocks.  The caller is responsible
+// for putting the returned blocks and finalizing md.
+func (fbo *folderBranchOps) syncTwoDirsLocked(ctx context.Context,
+	lState *lockState, uid keybase1.UID, md *RootMetadata,
+	oldParent path, oldPBlock *DirBlock, newParent path,
+	newPBlock *DirBlock, lbc localBcache) (*blockPutState, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
 	// find the common ancestor
 	var i int
 	found := false
@@ -3056,34 +3901,33 @@ func (fbo *folderBranchOps) renameLocked(
 			// nothing to do (syncBlock will take care of everything)
 		} else {
 			// If the old one is common and the new one is
-			// not, then the last
-			// syncBlockAndCheckEmbedLocked call will need
-			// to access the old one.
+			// not, then the last syncBlockLocked call will
+			// need to access the old one.
 			lbc[oldParent.tailPointer()] = oldPBlock
 		}
 	} else {
 		if newIsCommon {
 			// If the new one is common, then the first
-			// syncBlockAndCheckEmbedLocked call will need to access
-			// it.
+			// syncBlockLocked call will need to access it.
 			lbc[newParent.tailPointer()] = newPBlock
 		}
 
 		// The old one is not the common ancestor, so we need to sync it.
 		// TODO: optimize by pushing blocks from both paths in parallel
-		newOldPath, _, oldBps, err = fbo.syncBlockAndCheckEmbedLocked(
-			ctx, lState, md, oldPBlock, *oldParent.parentPath(), oldParent.tailName(),
-			Dir, true, true, commonAncestor, lbc)
+		var err error
+		newOldPath, _, oldBps, err = fbo.syncBlockLocked(
+			ctx, lState, uid, md, oldPBlock, *oldParent.parentPath(),
+			oldParent.tailName(), Dir, true, true, commonAncestor, lbc)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	newNewPath, _, newBps, err := fbo.syncBlockAndCheckEmbedLocked(
-		ctx, lState, md, newPBlock, *newParent.parentPath(), newParent.tailName(),
-		Dir, true, true, zeroPtr, lbc)
+	newNewPath, _, newBps, err := fbo.syncBlockLocked(
+		ctx, lState, uid, md, newPBlock, *newParent.parentPath(),
+		newParent.tailName(), Dir, true, true, zeroPtr, lbc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// newOldPath is really just a prefix now.  A copy is necessary as an
@@ -3091,26 +3935,77 @@ func (fbo *folderBranchOps) renameLocked(
 	newOldPath.path = append(make([]pathNode, i+1, i+1), newOldPath.path...)
 	copy(newOldPath.path[:i+1], newNewPath.path[:i+1])
 
-	// merge and finalize the blockPutStates
+	// merge the blockPutStates
 	if oldBps != nil {
 		newBps.mergeOtherBps(oldBps)
 	}
+	return newBps, nil
+}
+
+// putBlocksAndFinalizeLocked unembeds the block changes of md if
+// needed, puts all the blocks in bps, and finalizes md.
+func (fbo *folderBranchOps) putBlocksAndFinalizeLocked(ctx context.Context,
+	lState *lockState, uid keybase1.UID, md *RootMetadata,
+	bps *blockPutState) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
 	defer func() {
 		if err != nil {
 			fbo.fbm.cleanUpBlockState(
-				md.ReadOnly(), newBps, blockDeleteOnMDFail)
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
 		}
 	}()
 
+	// Do the block changes need their own blocks?  An open
+	// transaction unembeds only when it commits.
+	bsplit := fbo.config.BlockSplitter()
+	if fbo.txn == nil && !bsplit.ShouldEmbedBlockChanges(&md.data.Changes) {
+		err = fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes, uid)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = doBlockPuts(ctx, fbo.config.BlockServer(), fbo.config.BlockCache(),
 		fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *newBps)
+		md.GetTlfHandle().GetCanonicalName(), *bps)
 	if err != nil {
 		return err
 	}
 
-	return fbo.finalizeMDWriteLocked(ctx, lState, md, newBps, NoExcl)
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+}
+
+// removeReplacedHardLinkLocked removes the entry named name in dir,
+// if it is a hard link.  It returns true if it removed the entry.
+func (fbo *folderBranchOps) removeReplacedHardLinkLocked(
+	ctx context.Context, lState *lockState, dir path, name string) (
+	bool, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return false, err
+	}
+
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), dir.ChildPathNoPtr(name))
+	switch err.(type) {
+	case nil:
+	case NoSuchNameError:
+		return false, nil
+	default:
+		return false, err
+	}
+	if !de.isHardLink() {
+		return false, nil
+	}
+
+	err = fbo.removeEntryLocked(ctx, lState, md, dir, name)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (fbo *folderBranchOps) Rename(
@@ -3120,7 +4015,7 @@ func (fbo *folderBranchOps) Rename(
 		oldName, newParent.GetID(), newName)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(newParent)
+	err = fbo.checkNodeForWrite(newParent)
 	if err != nil {
 		return err
 	}
@@ -3142,6 +4037,37 @@ func (fbo *folderBranchOps) Rename(
 				return RenameAcrossDirsError{}
 			}
 
+			if isHiddenDir(oldParentPath, oldName) {
+				return NoSuchNameError{oldName}
+			}
+			if isHiddenDir(newParentPath, newName) {
+				return DisallowedPrefixError{newName, ".kbfs"}
+			}
+
+			// A hard link that is about to be replaced must first
+			// give up its reference to its target, in its own
+			// revision.
+			if oldParentPath.tailPointer() != newParentPath.tailPointer() ||
+				oldName != newName {
+				removed, err := fbo.removeReplacedHardLinkLocked(
+					ctx, lState, newParentPath, newName)
+				if err != nil {
+					return err
+				}
+				if removed {
+					oldParentPath, err = fbo.pathFromNodeForMDWriteLocked(
+						lState, oldParent)
+					if err != nil {
+						return err
+					}
+					newParentPath, err = fbo.pathFromNodeForMDWriteLocked(
+						lState, newParent)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
 			return fbo.renameLocked(ctx, lState, oldParentPath, oldName,
 				newParentPath, newName)
 		})
@@ -3213,7 +4139,7 @@ func (fbo *folderBranchOps) Write(
 	fbo.log.CDebugf(ctx, "Write %p %d %d", file.GetID(), len(data), off)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
 		return err
 	}
@@ -3224,6 +4150,11 @@ func (fbo *folderBranchOps) Write(
 		// Get the MD for reading.  We won't modify it; we'll track the
 		// unref changes on the side, and put them into the MD during the
 		// sync.
+		// Only the open transaction, if any, may dirty files.
+		if err := fbo.checkTxnWriter(ctx, lState); err != nil {
+			return err
+		}
+
 		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
 		if err != nil {
 			return err
@@ -3245,7 +4176,7 @@ func (fbo *folderBranchOps) Truncate(
 	fbo.log.CDebugf(ctx, "Truncate %p %d", file.GetID(), size)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
 		return err
 	}
@@ -3256,6 +4187,11 @@ func (fbo *folderBranchOps) Truncate(
 		// Get the MD for reading.  We won't modify it; we'll track the
 		// unref changes on the side, and put them into the MD during the
 		// sync.
+		// Only the open transaction, if any, may dirty files.
+		if err := fbo.checkTxnWriter(ctx, lState); err != nil {
+			return err
+		}
+
 		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
 		if err != nil {
 			return err
@@ -3342,7 +4278,7 @@ func (fbo *folderBranchOps) SetEx(
 	fbo.log.CDebugf(ctx, "SetEx %p %t", file.GetID(), ex)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
 		return
 	}
@@ -3416,7 +4352,7 @@ func (fbo *folderBranchOps) SetMtime(
 		return nil
 	}
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
 		return
 	}
@@ -3432,6 +4368,185 @@ func (fbo *folderBranchOps) SetMtime(
 		})
 }
 
+// GetXattr implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetXattr(
+	ctx context.Context, node Node, name string) (value []byte, err error) {
+	fbo.log.CDebugf(ctx, "GetXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := de.Xattrs[name]
+	if !ok {
+		return nil, NoSuchXattrError{name}
+	}
+	return value, nil
+}
+
+// ListXattr implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ListXattr(
+	ctx context.Context, node Node) (names []string, err error) {
+	fbo.log.CDebugf(ctx, "ListXattr %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	names = make([]string, 0, len(de.Xattrs))
+	for name := range de.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// updateXattrsLocked applies the given change to the extended
+// attributes of the given file, and syncs the result.  The change
+// function is given a copy of the existing attributes, which it may
+// modify freely.
+func (fbo *folderBranchOps) updateXattrsLocked(
+	ctx context.Context, lState *lockState, file path,
+	change func(xattrs map[string][]byte) error) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+
+	xattrs := copyXattrs(de.Xattrs)
+	err = change(xattrs)
+	if err != nil {
+		return err
+	}
+	if size := xattrsSize(xattrs); size > maxXattrsBytes {
+		return XattrsTooBigError{file, size, maxXattrsBytes}
+	}
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+	de.Xattrs = xattrs
+	// changing the xattrs counts as changing the file MD, so must
+	// set ctime too
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		xattrAttr, file.tailPointer())
+	if err != nil {
+		return err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this
+	// xattr change.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping xattr change for a removed file %v",
+			file.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	dblock.Children[file.tailName()] = de
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl)
+	return err
+}
+
+// SetXattr implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SetXattr(ctx context.Context, node Node,
+	name string, value []byte, flag XattrSetFlag) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %p %s (%d bytes, %s)",
+		node.GetID(), name, len(value), flag)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if len(name) > maxXattrNameBytes {
+		return XattrNameTooLongError{name, maxXattrNameBytes}
+	}
+
+	err = fbo.checkNodeForWrite(node)
+	if err != nil {
+		return err
+	}
+
+	// Copy the value, since the caller may reuse its buffer.
+	valueCopy := make([]byte, len(value))
+	copy(valueCopy, value)
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.updateXattrsLocked(ctx, lState, filePath,
+				func(xattrs map[string][]byte) error {
+					_, exists := xattrs[name]
+					switch {
+					case flag == XattrCreate && exists:
+						return XattrExistsError{name}
+					case flag == XattrReplace && !exists:
+						return NoSuchXattrError{name}
+					}
+					xattrs[name] = valueCopy
+					return nil
+				})
+		})
+}
+
+// RemoveXattr implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(node)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.updateXattrsLocked(ctx, lState, filePath,
+				func(xattrs map[string][]byte) error {
+					if _, ok := xattrs[name]; !ok {
+						return NoSuchXattrError{name}
+					}
+					delete(xattrs, name)
+					return nil
+				})
+		})
+}
+
 func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	lState *lockState, file path) (stillDirty bool, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -3595,14 +4710,16 @@ func (fbo *folderBranchOps) UnregisterFromChanges(obs Observer) error {
 	return nil
 }
 
-// notifyBatchLocked sends out a notification for the most recent op
-// in md.
+// notifyBatchLocked sends out notifications for the ops in md.  Most
+// local writes have a single op, but some (like hard link creation)
+// need several.
 func (fbo *folderBranchOps) notifyBatchLocked(
 	ctx context.Context, lState *lockState, md ImmutableRootMetadata) {
 	fbo.headLock.AssertLocked(lState)
 
-	lastOp := md.data.Changes.Ops[len(md.data.Changes.Ops)-1]
-	fbo.notifyOneOpLocked(ctx, lState, lastOp, md)
+	for _, op := range md.data.Changes.Ops {
+		fbo.notifyOneOpLocked(ctx, lState, op, md.ReadOnly())
+	}
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
 }
 
@@ -3661,7 +4778,7 @@ func (fbo *folderBranchOps) unlinkFromCache(op op, oldDir BlockPointer,
 }
 
 func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
-	lState *lockState, op op, md ImmutableRootMetadata) {
+	lState *lockState, op op, md ReadOnlyRootMetadata) {
 	fbo.headLock.AssertLocked(lState)
 
 	fbo.blocks.UpdatePointers(lState, op)
@@ -3746,7 +4863,7 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 					// the updates.
 					var err error
 					newNode, err =
-						fbo.searchForNode(ctx, realOp.NewDir.Ref, md.ReadOnly())
+						fbo.searchForNode(ctx, realOp.NewDir.Ref, md)
 					if newNode == nil {
 						fbo.log.CErrorf(ctx, "Couldn't find the new node: %v",
 							err)
@@ -3801,7 +4918,7 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 		}
 
 		childNode, err := fbo.blocks.UpdateCachedEntryAttributes(
-			ctx, lState, md.ReadOnly(), p, realOp)
+			ctx, lState, md, p, realOp)
 		if err != nil {
 			// TODO: Log error?
 			return
@@ -3813,6 +4930,39 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 		changes = append(changes, NodeChange{
 			Node: childNode,
 		})
+	case *linkOp:
+		if node := fbo.nodeCache.Get(realOp.Dir.Ref.Ref()); node != nil {
+			fbo.log.CDebugf(ctx, "notifyOneOp: link %s in node %p",
+				realOp.Name, node.GetID())
+			changes = append(changes, NodeChange{
+				Node:       node,
+				DirUpdated: []string{realOp.Name},
+			})
+		}
+
+		// The link count of the target changed, so update any
+		// cached entry for it.
+		linksNode := fbo.nodeCache.Get(realOp.TargetDir.Ref.Ref())
+		if linksNode == nil {
+			return
+		}
+		p, err := fbo.pathFromNodeForRead(linksNode)
+		if err != nil {
+			return
+		}
+		targetNode, err := fbo.blocks.UpdateCachedHardLinks(
+			ctx, lState, md, p, realOp.Target)
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't update cached hard links "+
+				"for %s: %v", realOp.Target, err)
+			return
+		}
+		if targetNode == nil {
+			return
+		}
+		changes = append(changes, NodeChange{
+			Node: targetNode,
+		})
 	case *GCOp:
 		// Unreferenced blocks in a GCOp mean that we shouldn't cache
 		// them anymore
@@ -3941,6 +5091,13 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 		return errors.New("Ignoring MD updates while writes are dirty")
 	}
 
+	// Likewise, the open transaction will be put as a whole, and
+	// will require conflict resolution if it's out of date.  If it
+	// ends without putting anything, the updates are applied then.
+	if fbo.txn != nil {
+		return errors.New("Ignoring MD updates during a transaction")
+	}
+
 	appliedRevs := make([]ImmutableRootMetadata, 0, len(rmds))
 	for _, rmd := range rmds {
 		// check that we're applying the expected MD revision
@@ -3961,7 +5118,7 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 			continue
 		}
 		for _, op := range rmd.data.Changes.Ops {
-			fbo.notifyOneOpLocked(ctx, lState, op, rmd)
+			fbo.notifyOneOpLocked(ctx, lState, op, rmd.ReadOnly())
 		}
 		appliedRevs = append(appliedRevs, rmd)
 	}
@@ -4024,7 +5181,7 @@ func (fbo *folderBranchOps) undoMDUpdatesLocked(ctx context.Context,
 					err, ops[j])
 				continue
 			}
-			fbo.notifyOneOpLocked(ctx, lState, io, rmd)
+			fbo.notifyOneOpLocked(ctx, lState, io, rmd.ReadOnly())
 		}
 	}
 	// TODO: update the edit history?
@@ -4214,6 +5371,10 @@ func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
 	lState *lockState) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	// Any conflict choices are moot once the unmerged changes are
+	// gone.
+	fbo.cr.clearConflictChoices()
+
 	// fetch all of my unstaged updates, and undo them one at a time
 	bid, wasMasterBranch := fbo.bid, fbo.isMasterBranchLocked(lState)
 	unmergedPtrs, err := fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
@@ -4303,6 +5464,131 @@ func (fbo *folderBranchOps) UnstageForTesting(
 	})
 }
 
+func (fbo *folderBranchOps) getUnmergedChanges(ctx context.Context,
+	lState *lockState) (changes []UnmergedChange, err error) {
+	if fbo.isMasterBranch(lState) {
+		return nil, nil
+	}
+
+	unmerged, merged, err := fbo.cr.getMDs(ctx, lState, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(unmerged) == 0 {
+		return nil, nil
+	}
+
+	unmergedChains, err := newCRChainsForIRMDs(
+		ctx, fbo.config.Codec(), unmerged, &fbo.blocks, true)
+	if err != nil {
+		return nil, err
+	}
+	unmergedPaths, err := unmergedChains.getPaths(
+		ctx, &fbo.blocks, fbo.log, fbo.nodeCache, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The merged ops for each path, if any.
+	mergedOps := make(map[string][]string)
+	var mergedChains *crChains
+	if len(merged) > 0 {
+		mergedChains, err = newCRChainsForIRMDs(
+			ctx, fbo.config.Codec(), merged, &fbo.blocks, true)
+		if err != nil {
+			return nil, err
+		}
+		// Use a throwaway node cache, since the main one only knows
+		// about the unmerged branch.
+		mergedPaths, err := mergedChains.getPaths(ctx, &fbo.blocks,
+			fbo.log, newNodeCacheStandard(fbo.folderBranch), true)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range mergedPaths {
+			chain := mergedChains.byMostRecent[p.tailPointer()]
+			for _, op := range chain.ops {
+				mergedOps[tlfRelativePath(p)] = append(
+					mergedOps[tlfRelativePath(p)], op.String())
+			}
+		}
+	}
+
+	for _, p := range unmergedPaths {
+		chain := unmergedChains.byMostRecent[p.tailPointer()]
+		change := UnmergedChange{
+			Path:   tlfRelativePath(p),
+			Merged: mergedOps[tlfRelativePath(p)],
+			Conflict: isWriteConflict(
+				unmergedChains, mergedChains, chain),
+		}
+		for _, op := range chain.ops {
+			change.Unmerged = append(change.Unmerged, op.String())
+		}
+		change.Choice = fbo.cr.getConflictChoice(change.Path)
+		changes = append(changes, change)
+	}
+	sort.Sort(unmergedChangesByPath(changes))
+	return changes, nil
+}
+
+// GetUnmergedChanges implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetUnmergedChanges(ctx context.Context,
+	folderBranch FolderBranch) (changes []UnmergedChange, err error) {
+	fbo.log.CDebugf(ctx, "GetUnmergedChanges")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	return fbo.getUnmergedChanges(ctx, lState)
+}
+
+// SetConflictChoice implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetConflictChoice(ctx context.Context,
+	folderBranch FolderBranch, p string, choice ConflictChoice) (err error) {
+	fbo.log.CDebugf(ctx, "SetConflictChoice %s: %s", p, choice)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	p = cleanConflictPath(p)
+	lState := makeFBOLockState()
+	if choice != ConflictChoiceAuto {
+		changes, err := fbo.getUnmergedChanges(ctx, lState)
+		if err != nil {
+			return err
+		}
+		conflict := false
+		for _, change := range changes {
+			if change.Path == p {
+				conflict = change.Conflict
+				break
+			}
+		}
+		if !conflict {
+			return NoWriteConflictError{p, choice}
+		}
+	}
+	fbo.cr.setConflictChoice(p, choice)
+
+	// Restart any resolution that's already under way, or that
+	// previously failed, so that it sees the new choice.  This does
+	// nothing if conflict resolution is paused.
+	if !fbo.isMasterBranch(lState) {
+		fbo.cr.BeginNewBranch()
+		fbo.cr.Resolve(fbo.getCurrMDRevision(lState),
+			MetadataRevisionUninitialized)
+	}
+	return nil
+}
+
 // mdWriterLock must be taken by the caller.
 func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 	lState *lockState, promptPaper bool) (err error) {
@@ -4312,6 +5598,11 @@ func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 		return errors.New("can't rekey while staged")
 	}
 
+	// A rekey can't be part of a transaction.
+	if fbo.txn != nil {
+		return TransactionInProgressError{fbo.folderBranch}
+	}
+
 	head := fbo.getHead(lState)
 	if head != (ImmutableRootMetadata{}) {
 		// If we already have a cached revision, make sure we're
@@ -4516,6 +5807,11 @@ func (fbo *folderBranchOps) SyncFromServerForTesting(
 		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
+	if fbo.isArchived() {
+		// Archived branches never change.
+		return nil
+	}
+
 	lState := makeFBOLockState()
 
 	// A journal flush before CR, if needed.
@@ -4645,7 +5941,8 @@ func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 	lState *lockState, lastUpdate time.Time, currUpdate time.Time) (
 	fastForwardDone bool, err error) {
 	// Has it been long enough to try fast-forwarding?
-	if currUpdate.Before(lastUpdate.Add(fastForwardTimeThresh)) ||
+	if currUpdate.Before(lastUpdate.Add(
+		fbo.config.TuningConfig().FastForwardTimeThreshold)) ||
 		!fbo.isMasterBranch(lState) {
 		return false, nil
 	}
@@ -4679,7 +5976,9 @@ func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
 
-	if currHead.Revision() < fbo.latestMergedRevision+fastForwardRevThresh {
+	revThresh := MetadataRevision(
+		fbo.config.TuningConfig().FastForwardRevThreshold)
+	if currHead.Revision() < fbo.latestMergedRevision+revThresh {
 		// Might as well fetch all the revisions.
 		return false, nil
 	}
@@ -4802,7 +6101,8 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 			}
 			// Getting and applying the updates requires holding
 			// locks, so make sure it doesn't take too long.
-			ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+			ctx, cancel := context.WithTimeout(
+				ctx, fbo.config.TuningConfig().BackgroundTaskTimeout)
 			defer cancel()
 
 			currUpdate := fbo.config.Clock().Now()
@@ -4893,8 +6193,8 @@ func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 				})
 			// Just in case network access or a bug gets stuck for a
 			// long time, time out the sync eventually.
-			longCtx, longCancel :=
-				context.WithTimeout(ctx, backgroundTaskTimeout)
+			longCtx, longCancel := context.WithTimeout(
+				ctx, fbo.config.TuningConfig().BackgroundTaskTimeout)
 			defer longCancel()
 
 			// Make sure this loop doesn't starve user requests for
@@ -5004,7 +6304,7 @@ func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 
 	// notifyOneOp for every fixed-up merged op.
 	for _, op := range newOps {
-		fbo.notifyOneOpLocked(ctx, lState, op, irmd)
+		fbo.notifyOneOpLocked(ctx, lState, op, irmd.ReadOnly())
 	}
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
 	return nil
@@ -25,6 +25,13 @@ type FolderBranchStatus struct {
 	LatestKeyGeneration KeyGen
 	FolderID            string
 	Revision            MetadataRevision
+	// IsOffline is true when the MD server can't be reached, and
+	// so any writes are only being saved locally.
+	IsOffline bool
+	// CompressionSavedBytes is how many bytes compression has
+	// saved, before padding, on the blocks written to this
+	// folder-branch since KBFS started.
+	CompressionSavedBytes int64
 
 	// DirtyPaths are files that have been written, but not flushed.
 	// They do not represent unstaged changes in your local instance.
@@ -48,6 +55,7 @@ type KBFSStatus struct {
 	LimitBytes      int64
 	FailingServices map[string]error
 	JournalServer   *JournalServerStatus `json:",omitempty"`
+	TuningConfig    TuningConfig
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -64,7 +72,11 @@ type folderBranchStatusKeeper struct {
 	dirtyNodes map[NodeID]Node
 	unmerged   []*crChainSummary
 	merged     []*crChainSummary
-	dataMutex  sync.Mutex
+	offline    bool
+	// compressionSavings is the total number of bytes saved by
+	// compressing the blocks written to this folder-branch.
+	compressionSavings int64
+	dataMutex          sync.Mutex
 
 	updateChan  chan StatusUpdate
 	updateMutex sync.Mutex
@@ -113,6 +125,30 @@ func (fbsk *folderBranchStatusKeeper) setCRSummary(unmerged []*crChainSummary,
 	fbsk.signalChangeLocked()
 }
 
+// setOffline sets whether the corresponding folder-branch is
+// currently in offline mode.
+func (fbsk *folderBranchStatusKeeper) setOffline(offline bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.offline == offline {
+		return
+	}
+	fbsk.offline = offline
+	fbsk.signalChangeLocked()
+}
+
+// addCompressionSavings records that compression saved the given
+// number of bytes on newly-written blocks.
+func (fbsk *folderBranchStatusKeeper) addCompressionSavings(n int64) {
+	if n == 0 {
+		return
+	}
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	fbsk.compressionSavings += n
+	fbsk.signalChangeLocked()
+}
+
 func (fbsk *folderBranchStatusKeeper) addNode(m map[NodeID]Node, n Node) {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
@@ -168,6 +204,8 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context,
 	defer fbsk.updateMutex.Unlock()
 
 	var fbs FolderBranchStatus
+	fbs.IsOffline = fbsk.offline
+	fbs.CompressionSavedBytes = fbsk.compressionSavings
 
 	if fbsk.md != (ImmutableRootMetadata{}) {
 		fbs.Staged = fbsk.md.IsUnmergedSet()
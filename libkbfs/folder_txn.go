@@ -0,0 +1,391 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// folderTxn holds the state of an open transaction on a
+// folder-branch.  Every write made with the transaction's context
+// adds its ops to md, which is only put to the server when the
+// transaction commits.  Until then, the writes are applied only
+// locally, and writes made with any other context are refused.
+type folderTxn struct {
+	// md is the successor of the head at the start of the
+	// transaction, with the changes of all the writes so far.
+	md *RootMetadata
+	// bps holds all the blocks put by the writes so far, so they
+	// can be cleaned up if the transaction is aborted.
+	bps *blockPutState
+	// committing is true while md is being put to the server.
+	committing bool
+}
+
+type ctxTxnKeyType int
+
+const (
+	// ctxTxnKey holds the transaction that the writes made with a
+	// context belong to.
+	ctxTxnKey ctxTxnKeyType = iota
+)
+
+// ctxWithTxn returns a context whose writes belong to txn.
+func ctxWithTxn(ctx context.Context, txn *folderTxn) context.Context {
+	return NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, ctxTxnKey, txn)
+	})
+}
+
+func txnFromContext(ctx context.Context) *folderTxn {
+	txn, _ := ctx.Value(ctxTxnKey).(*folderTxn)
+	return txn
+}
+
+// checkTxnWriterLocked returns TransactionInProgressError if a
+// transaction is open and the writes made with ctx don't belong to
+// it.  Syncs by the background flusher are let through, since only
+// the transaction can have dirtied files while it's open.  Either
+// mdWriterLock or headLock must be held.
+func (fbo *folderBranchOps) checkTxnWriterLocked(ctx context.Context) error {
+	if fbo.txn == nil || txnFromContext(ctx) == fbo.txn {
+		return nil
+	}
+	if ctx.Value(CtxBackgroundSyncKey) != nil {
+		return nil
+	}
+	return TransactionInProgressError{fbo.folderBranch}
+}
+
+// checkTxnWriter is like checkTxnWriterLocked, for writes that only
+// dirty files without holding mdWriterLock.
+func (fbo *folderBranchOps) checkTxnWriter(
+	ctx context.Context, lState *lockState) error {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.checkTxnWriterLocked(ctx)
+}
+
+// getTxnLocked returns the open transaction, if ctx belongs to it.
+func (fbo *folderBranchOps) getTxnLocked(
+	ctx context.Context, lState *lockState) (*folderTxn, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if fbo.txn == nil {
+		return nil, NoTransactionError{fbo.folderBranch}
+	}
+	if txnFromContext(ctx) != fbo.txn {
+		return nil, TransactionInProgressError{fbo.folderBranch}
+	}
+	return fbo.txn, nil
+}
+
+// finalizeTxnWriteLocked applies a write made during the open
+// transaction locally, instead of putting md to the server.  md
+// must have been derived from the transaction's MD.
+func (fbo *folderBranchOps) finalizeTxnWriteLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	err := fbo.finalizeBlocks(bps)
+	if err != nil {
+		return err
+	}
+
+	newOps := md.data.Changes.Ops[len(fbo.txn.md.data.Changes.Ops):]
+	fbo.txn.md = md
+	if bps != nil {
+		fbo.txn.bps.mergeOtherBps(bps)
+	}
+
+	// The head stays as it is until the commit, but the nodes need
+	// to see the new blocks for the next write to build on them.
+	// Reads get a view of the transaction's MD, which borrows the
+	// identity of the head since it hasn't been put anywhere.
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	fbo.txnHead = ImmutableRootMetadata{md.ReadOnly(), fbo.head.mdID,
+		fbo.head.lastWriterVerifyingKey, fbo.head.localTimestamp}
+	for _, op := range newOps {
+		fbo.notifyOneOpLocked(ctx, lState, op, md.ReadOnly())
+	}
+	return nil
+}
+
+// syncAllLocked syncs every dirty file in this folder-branch.
+func (fbo *folderBranchOps) syncAllLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		if err := fbo.syncNodeLocked(ctx, lState, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) endTransactionLocked(lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	fbo.txn = nil
+	fbo.txnHead = ImmutableRootMetadata{}
+}
+
+func (fbo *folderBranchOps) commitTransactionLocked(
+	ctx context.Context, lState *lockState) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if _, err := fbo.getTxnLocked(ctx, lState); err != nil {
+		return err
+	}
+
+	// Unsynced writes are part of the transaction too.
+	err = fbo.syncAllLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	if len(fbo.txn.md.data.Changes.Ops) == 0 {
+		fbo.log.CDebugf(ctx, "Nothing to commit")
+		fbo.endTransactionLocked(lState)
+		fbo.catchUpAfterTransactionLocked(ctx, lState)
+		return nil
+	}
+
+	// Put a copy, so the transaction can be committed again if
+	// this attempt fails.
+	md, err := fbo.txn.md.deepCopy(fbo.config.Codec())
+	if err != nil {
+		return err
+	}
+	bps := fbo.txn.bps.DeepCopy()
+
+	// Do the block changes need their own blocks?
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(
+		&md.data.Changes) {
+		var uid keybase1.UID
+		_, uid, err = fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+		if err != nil {
+			return err
+		}
+		changeBps := newBlockPutState(1)
+		err = fbo.unembedBlockChanges(
+			ctx, changeBps, md, &md.data.Changes, uid)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				fbo.fbm.cleanUpBlockState(
+					md.ReadOnly(), changeBps, blockDeleteOnMDFail)
+			}
+		}()
+		_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+			fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+			md.TlfID(), md.GetTlfHandle().GetCanonicalName(), *changeBps)
+		if err != nil {
+			return err
+		}
+		bps.mergeOtherBps(changeBps)
+	}
+
+	fbo.txn.committing = true
+	defer func() {
+		if fbo.txn != nil {
+			fbo.txn.committing = false
+		}
+	}()
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+	if err != nil {
+		return err
+	}
+	fbo.endTransactionLocked(lState)
+	return nil
+}
+
+func (fbo *folderBranchOps) abortTransactionLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if _, err := fbo.getTxnLocked(ctx, lState); err != nil {
+		return err
+	}
+
+	// Fold the unsynced writes into the transaction first, so that
+	// they are undone along with everything else.
+	err := fbo.syncAllLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	fbo.undoTransactionLocked(ctx, lState)
+	return nil
+}
+
+// undoTransactionLocked undoes the local effects of all the synced
+// writes of the open transaction, deletes its blocks, and ends it.
+func (fbo *folderBranchOps) undoTransactionLocked(
+	ctx context.Context, lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	func() {
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+
+		// Iterate the ops in reverse and invert each one, like
+		// undoMDUpdatesLocked, except that the head never moved.
+		ops := fbo.txn.md.data.Changes.Ops
+		for i := len(ops) - 1; i >= 0; i-- {
+			io, err := invertOpForLocalNotifications(ops[i])
+			if err != nil {
+				fbo.log.CWarningf(ctx,
+					"got error %v when invert op %v; skipping. Open "+
+						"file handles may now be in an invalid state, "+
+						"which can be fixed by either closing them all "+
+						"or restarting KBFS.", err, ops[i])
+				continue
+			}
+			fbo.notifyOneOpLocked(ctx, lState, io, fbo.head.ReadOnly())
+		}
+	}()
+
+	// The transaction's MD never made it to the server, so its
+	// blocks can go right away.
+	fbo.fbm.cleanUpBlockState(
+		fbo.txn.md.ReadOnly(), fbo.txn.bps, blockDeleteAlways)
+	fbo.endTransactionLocked(lState)
+}
+
+// abortTransactionForShutdown undoes the open transaction, if any,
+// since it can't be committed once the folder-branch shuts down.
+// Unsynced writes are dropped along with the rest of the dirty state.
+func (fbo *folderBranchOps) abortTransactionForShutdown(ctx context.Context) {
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	if fbo.txn == nil {
+		return
+	}
+	fbo.log.CDebugf(ctx, "Aborting the open transaction for shutdown")
+	fbo.undoTransactionLocked(ctx, lState)
+}
+
+// catchUpAfterTransactionLocked applies the remote updates that
+// were ignored while the transaction was open, now that it has
+// ended without putting anything.  Failures are only logged, since
+// the next update notification will try again.
+func (fbo *folderBranchOps) catchUpAfterTransactionLocked(
+	ctx context.Context, lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	err := fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdatesLocked)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't catch up after the transaction: %v",
+			err)
+	}
+}
+
+// BeginTransaction implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) BeginTransaction(ctx context.Context,
+	folderBranch FolderBranch) (txnCtx context.Context, err error) {
+	fbo.log.CDebugf(ctx, "BeginTransaction")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if fbo.isArchived() {
+		return nil, WriteToReadonlyNodeError{folderBranch.Tlf.String()}
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+
+		if fbo.txn != nil {
+			return TransactionInProgressError{fbo.folderBranch}
+		}
+
+		// Conflict resolution rewrites the local state, so it
+		// can't be running underneath a transaction.
+		if !fbo.isMasterBranchLocked(lState) {
+			return UnmergedError{}
+		}
+
+		// Writes made before the transaction aren't part of it,
+		// so put them first.
+		err := fbo.syncAllLocked(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		md, err := fbo.getMDForWriteLocked(ctx, lState)
+		if err != nil {
+			return err
+		}
+		txn := &folderTxn{
+			md:  md,
+			bps: newBlockPutState(1),
+		}
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		fbo.txn = txn
+		txnCtx = ctxWithTxn(ctx, txn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txnCtx, nil
+}
+
+// CommitTransaction implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) CommitTransaction(ctx context.Context,
+	folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "CommitTransaction")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.commitTransactionLocked(ctx, lState)
+		})
+}
+
+// AbortTransaction implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) AbortTransaction(ctx context.Context,
+	folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "AbortTransaction")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			err := fbo.abortTransactionLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			fbo.catchUpAfterTransactionLocked(ctx, lState)
+			return nil
+		})
+}
@@ -0,0 +1,284 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func txnTestCheckData(ctx context.Context, t *testing.T, kbfsOps KBFSOps,
+	node Node, expected []byte) {
+	buf := make([]byte, len(expected)+10)
+	n, err := kbfsOps.Read(ctx, node, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf[:n])
+}
+
+func txnTestCheckChildren(ctx context.Context, t *testing.T,
+	kbfsOps KBFSOps, dir Node, expected ...string) {
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	require.NoError(t, err)
+	require.Len(t, children, len(expected))
+	for _, name := range expected {
+		require.Contains(t, children, name)
+	}
+}
+
+func TestFolderTxnCommit(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte("aaa"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, aNode)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "old", false, NoExcl)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+
+	rev := ops.getCurrMDRevision(makeFBOLockState())
+	txnCtx, err := kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	_, err = kbfsOps.BeginTransaction(ctx, fb)
+	require.IsType(t, TransactionInProgressError{}, err)
+
+	bNode, _, err := kbfsOps.CreateFile(txnCtx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(txnCtx, bNode, []byte("bbb"), 0)
+	require.NoError(t, err)
+	dNode, _, err := kbfsOps.CreateDir(txnCtx, rootNode, "d")
+	require.NoError(t, err)
+	err = kbfsOps.Rename(txnCtx, rootNode, "a", dNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(txnCtx, rootNode, "old")
+	require.NoError(t, err)
+
+	// The writes are visible locally, but nothing has been put yet.
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode, "b", "d")
+	txnTestCheckData(ctx, t, kbfsOps, aNode, []byte("aaa"))
+	require.Equal(t, rev, ops.getCurrMDRevision(makeFBOLockState()))
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	txnTestCheckChildren(ctx, t, kbfsOps2, rootNode2, "a", "old")
+
+	err = kbfsOps.CommitTransaction(txnCtx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.CommitTransaction(txnCtx, fb)
+	require.IsType(t, NoTransactionError{}, err)
+
+	// Everything went into a single revision.
+	head := ops.getHead(makeFBOLockState())
+	require.Equal(t, rev+1, head.Revision())
+	require.True(t, len(head.data.Changes.Ops) >= 5)
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	txnTestCheckChildren(ctx, t, kbfsOps2, rootNode2, "b", "d")
+	bNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, bNode2, []byte("bbb"))
+	dNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	aNode2, _, err := kbfsOps2.Lookup(ctx, dNode2, "a")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, aNode2, []byte("aaa"))
+}
+
+func TestFolderTxnAbort(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte("aaa"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, aNode)
+	require.NoError(t, err)
+
+	err = kbfsOps.AbortTransaction(ctx, fb)
+	require.IsType(t, NoTransactionError{}, err)
+
+	rev := ops.getCurrMDRevision(makeFBOLockState())
+	txnCtx, err := kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(txnCtx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.Write(txnCtx, aNode, []byte("xyz"), 1)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(txnCtx, rootNode, "a", rootNode, "c")
+	require.NoError(t, err)
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode, "b", "c")
+
+	err = kbfsOps.AbortTransaction(txnCtx, fb)
+	require.NoError(t, err)
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode, "a")
+	txnTestCheckData(ctx, t, kbfsOps, aNode, []byte("aaa"))
+	require.Equal(t, rev, ops.getCurrMDRevision(makeFBOLockState()))
+
+	// Normal writes go straight to the server again.
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, rev+1, ops.getCurrMDRevision(makeFBOLockState()))
+	err = ops.fbm.waitForDeletingBlocks(ctx)
+	require.NoError(t, err)
+}
+
+func TestFolderTxnConflict(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+
+	txnCtx, err := kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(txnCtx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(txnCtx, bNode, []byte("bbb"), 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(txnCtx, rootNode, "d")
+	require.NoError(t, err)
+
+	// Another device writes in the meantime.
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "c", false, NoExcl)
+	require.NoError(t, err)
+
+	// The commit conflicts, and the whole transaction gets resolved.
+	err = kbfsOps.CommitTransaction(txnCtx, fb)
+	require.NoError(t, err)
+	err = ops.cr.Wait(ctx)
+	require.NoError(t, err)
+	require.True(t, ops.isMasterBranch(makeFBOLockState()))
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode, "b", "c", "d")
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	txnTestCheckChildren(ctx, t, kbfsOps2, rootNode2, "b", "c", "d")
+	bNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, bNode2, []byte("bbb"))
+}
+
+func TestFolderTxnOutsideWriters(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Unsynced writes from before the transaction are put on
+	// their own, and survive an abort.
+	err = kbfsOps.Write(ctx, aNode, []byte("aaa"), 0)
+	require.NoError(t, err)
+	rev := ops.getCurrMDRevision(makeFBOLockState())
+	txnCtx, err := kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, rev+1, ops.getCurrMDRevision(makeFBOLockState()))
+
+	// Writes made with any other context are refused.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.IsType(t, TransactionInProgressError{}, err)
+	err = kbfsOps.Write(ctx, aNode, []byte("xyz"), 0)
+	require.IsType(t, TransactionInProgressError{}, err)
+	err = kbfsOps.Truncate(ctx, aNode, 1)
+	require.IsType(t, TransactionInProgressError{}, err)
+	err = kbfsOps.CommitTransaction(ctx, fb)
+	require.IsType(t, TransactionInProgressError{}, err)
+	err = kbfsOps.AbortTransaction(ctx, fb)
+	require.IsType(t, TransactionInProgressError{}, err)
+
+	_, _, err = kbfsOps.CreateDir(txnCtx, rootNode, "c")
+	require.NoError(t, err)
+	err = kbfsOps.AbortTransaction(txnCtx, fb)
+	require.NoError(t, err)
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode, "a")
+	txnTestCheckData(ctx, t, kbfsOps, aNode, []byte("aaa"))
+	err = ops.fbm.waitForDeletingBlocks(ctx)
+	require.NoError(t, err)
+}
+
+func TestFolderTxnAbortCatchesUp(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+
+	txnCtx, err := kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(txnCtx, rootNode, "a")
+	require.NoError(t, err)
+
+	// The other device's write is held back until the transaction
+	// ends, and then applied right away.
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	rev2 := getOps(config2, fb.Tlf).getCurrMDRevision(makeFBOLockState())
+	err = kbfsOps.AbortTransaction(txnCtx, fb)
+	require.NoError(t, err)
+	require.Equal(t, rev2, ops.getCurrMDRevision(makeFBOLockState()))
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode, "b")
+	err = ops.fbm.waitForDeletingBlocks(ctx)
+	require.NoError(t, err)
+}
+
+func TestFolderTxnAbortOnShutdown(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+
+	config2 := ConfigAsUser(config, "test_user")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	txnCtx, err := kbfsOps2.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateDir(txnCtx, rootNode2, "a")
+	require.NoError(t, err)
+	ops2 := getOps(config2, fb.Tlf)
+	CheckConfigAndShutdown(t, config2)
+	require.Nil(t, ops2.txn)
+
+	err = kbfsOps.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode)
+}
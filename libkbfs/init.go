@@ -16,6 +16,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscodec"
 )
 
 // InitParams contains the initialization parameters for Init(). It is
@@ -72,8 +73,88 @@ type InitParams struct {
 	// directory to put write journals in. If non-empty, enables
 	// write journaling to be turned on for TLFs.
 	WriteJournalRoot string
+
+	// JournalDiskLimitBytes is the maximum number of unflushed
+	// block bytes the write journals may hold.  Puts are slowed
+	// down as it's approached, and fail once it would be
+	// exceeded.  If not positive, there is no limit.
+	JournalDiskLimitBytes int64
+
+	// DiskBlockCacheRoot, if non-empty, points to a path to a
+	// local directory to cache encrypted blocks in. Only has an
+	// effect when DiskBlockCacheMaxBytes is positive.
+	DiskBlockCacheRoot string
+
+	// DiskBlockCacheMaxBytes is the maximum number of bytes of
+	// block data to keep in the disk block cache. If zero, the
+	// disk block cache is disabled.
+	DiskBlockCacheMaxBytes int64
+
+	// BlockSplitter names the algorithm used to split files into
+	// blocks: either "simple" (fixed-size blocks) or "cdc"
+	// (content-defined blocks, which dedup better across edits).
+	// Files written with either one can be read by both.
+	BlockSplitter string
+	// CDCMinBlockSize and CDCAvgBlockSize are the minimum and
+	// average sizes of the blocks made by the "cdc" block
+	// splitter.  Blocks are never bigger than the tuning config's
+	// MaxBlockSizeBytes.
+	CDCMinBlockSize int64
+	CDCAvgBlockSize int64
+
+	// ConflictFileMergeMaxBytes, if positive, makes conflict
+	// resolution try a line-based three-way merge of text files
+	// no bigger than this that were written on both sides of a
+	// conflict, instead of always renaming one of the versions.
+	ConflictFileMergeMaxBytes int64
+
+	// ConflictHoldTimeout, if positive, makes conflict resolution
+	// wait up to this long for a conflict choice to be set for
+	// every file with conflicting writes before resolving an
+	// unmerged branch.
+	ConflictHoldTimeout time.Duration
+
+	// TrashRetention, if positive, makes removed files and
+	// directories move into a hidden trash directory in their
+	// TLF, from which they can be restored until quota
+	// reclamation purges them after this long.
+	TrashRetention time.Duration
+
+	// BlockCompression names the compression applied to new
+	// blocks before they are encrypted, for the blocks it makes
+	// smaller: "none" or "snappy".  Compressed blocks can be
+	// read whatever this is set to, but not by older clients.
+	BlockCompression string
+
+	// VerifyMerkle, if true, checks the merged MD fetched from a
+	// remote mdserver against the mdserver's KBFS Merkle trees,
+	// and fails reads that look like rollbacks or forks.
+	VerifyMerkle bool
+
+	// UploadBytesPerSec and DownloadBytesPerSec, if positive,
+	// limit the rates of block uploads to and downloads from the
+	// block server.  They can be changed later through the
+	// config's BandwidthLimiter.
+	UploadBytesPerSec   int64
+	DownloadBytesPerSec int64
+
+	// TuningConfigFile, if non-empty, is the path to a JSON file
+	// with TuningConfig settings to use instead of the defaults.
+	TuningConfigFile string
+	// Tuning holds TuningConfig settings that override the
+	// defaults and the ones in TuningConfigFile.  Only its
+	// non-zero settings are used.
+	Tuning TuningConfig
 }
 
+const (
+	// BlockSplitterSimpleName selects BlockSplitterSimple in
+	// InitParams.
+	BlockSplitterSimpleName = "simple"
+	// BlockSplitterCDCName selects BlockSplitterCDC in InitParams.
+	BlockSplitterCDCName = "cdc"
+)
+
 // GetDefaultBServer returns the default value for the -bserver flag.
 func GetDefaultBServer(ctx Context) string {
 	switch ctx.GetRunMode() {
@@ -129,6 +210,12 @@ func DefaultInitParams(ctx Context) InitParams {
 		},
 		TLFJournalBackgroundWorkStatus: TLFJournalBackgroundWorkEnabled,
 		WriteJournalRoot:               filepath.Join(ctx.GetDataDir(), "kbfs_journal"),
+		JournalDiskLimitBytes:          DefaultJournalDiskLimitBytes,
+		DiskBlockCacheRoot:             filepath.Join(ctx.GetDataDir(), "kbfs_block_cache"),
+		BlockSplitter:                  BlockSplitterSimpleName,
+		BlockCompression:               BlockCompressionNoneName,
+		CDCMinBlockSize:                MaxBlockSizeBytesDefault / 8,
+		CDCAvgBlockSize:                MaxBlockSizeBytesDefault / 4,
 	}
 }
 
@@ -158,6 +245,30 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	// The default is to *DELETE* old log files for kbfs.
 	flags.IntVar(&params.LogFileConfig.MaxKeepFiles, "log-file-max-keep-files", defaultParams.LogFileConfig.MaxKeepFiles, "Maximum number of log files for this service, older ones are deleted. 0 for infinite.")
 	flags.StringVar(&params.WriteJournalRoot, "write-journal-root", defaultParams.WriteJournalRoot, "(EXPERIMENTAL) If non-empty, permits write journals to be turned on for TLFs which will be put in the given directory")
+	params.JournalDiskLimitBytes = defaultParams.JournalDiskLimitBytes
+	flags.Var(SizeFlag{&params.JournalDiskLimitBytes}, "journal-disk-limit", "(EXPERIMENTAL) Maximum number of unflushed bytes the write journals may hold; 0 for no limit")
+	flags.StringVar(&params.DiskBlockCacheRoot, "disk-block-cache-root", defaultParams.DiskBlockCacheRoot, "(EXPERIMENTAL) Directory in which to cache encrypted blocks on disk")
+	params.DiskBlockCacheMaxBytes = defaultParams.DiskBlockCacheMaxBytes
+	flags.Var(SizeFlag{&params.DiskBlockCacheMaxBytes}, "disk-block-cache-max-bytes", "(EXPERIMENTAL) Maximum size of the disk block cache; 0 disables it")
+	flags.StringVar(&params.BlockSplitter, "block-splitter", defaultParams.BlockSplitter, fmt.Sprintf("(EXPERIMENTAL) How to split files into blocks: %q or %q (content-defined)", BlockSplitterSimpleName, BlockSplitterCDCName))
+	params.CDCMinBlockSize = defaultParams.CDCMinBlockSize
+	flags.Var(SizeFlag{&params.CDCMinBlockSize}, "cdc-min-block-size", "(EXPERIMENTAL) Minimum block size for the cdc block splitter")
+	params.CDCAvgBlockSize = defaultParams.CDCAvgBlockSize
+	flags.Var(SizeFlag{&params.CDCAvgBlockSize}, "cdc-avg-block-size", "(EXPERIMENTAL) Average block size for the cdc block splitter")
+	flags.Var(SizeFlag{&params.UploadBytesPerSec}, "upload-limit", "Maximum rate, in bytes per second, of block uploads to the block server; 0 for no limit")
+	flags.Var(SizeFlag{&params.DownloadBytesPerSec}, "download-limit", "Maximum rate, in bytes per second, of block downloads from the block server; 0 for no limit")
+	flags.StringVar(&params.TuningConfigFile, "tuning-config", "", "(EXPERIMENTAL) JSON file with tuning settings; the flags below override it")
+	flags.Var(SizeFlag{&params.Tuning.MaxBlockSizeBytes}, "max-block-size", fmt.Sprintf("(EXPERIMENTAL) Maximum size of new file blocks (default %d)", MaxBlockSizeBytesDefault))
+	flags.DurationVar(&params.Tuning.BackgroundFlushPeriod, "background-flush-period", 0, fmt.Sprintf("(EXPERIMENTAL) How often to flush dirty files that haven't been synced (default %s)", backgroundFlushPeriodDefault))
+	flags.Var(SizeFlag{&params.Tuning.DirtyBytesThreshold}, "dirty-bytes-threshold", fmt.Sprintf("(EXPERIMENTAL) Number of dirty bytes past which writes force a sync (default %d)", dirtyBytesThresholdDefault))
+	flags.DurationVar(&params.Tuning.BackgroundTaskTimeout, "background-task-timeout", 0, fmt.Sprintf("(EXPERIMENTAL) Timeout for background tasks (default %s)", backgroundTaskTimeoutDefault))
+	flags.DurationVar(&params.Tuning.FastForwardTimeThreshold, "fast-forward-time", 0, fmt.Sprintf("(EXPERIMENTAL) Time without updates after which a TLF may fast forward to the current head (default %s)", fastForwardTimeThreshDefault))
+	flags.Int64Var(&params.Tuning.FastForwardRevThreshold, "fast-forward-revs", 0, fmt.Sprintf("(EXPERIMENTAL) Number of new revisions past which a TLF fast forwards to the current head (default %d)", fastForwardRevThreshDefault))
+	flags.Var(SizeFlag{&params.ConflictFileMergeMaxBytes}, "cr-merge-max-size", fmt.Sprintf("(EXPERIMENTAL) Merge conflicting writes to text files up to this size instead of renaming them (e.g. %d); 0 disables merging", DefaultConflictFileMergeMaxSize))
+	flags.DurationVar(&params.ConflictHoldTimeout, "cr-hold", 0, "(EXPERIMENTAL) How long to leave conflicting changes unmerged, waiting for a choice of how to resolve them, before resolving them anyway (e.g. 1h); 0 resolves them right away")
+	flags.DurationVar(&params.TrashRetention, "trash-retention", 0, "(EXPERIMENTAL) How long entries removed by this device stay restorable in each TLF's trash before they are purged (e.g. 168h); 0 removes them right away")
+	flags.BoolVar(&params.VerifyMerkle, "verify-merkle", false, "(EXPERIMENTAL) Check fetched metadata against the mdserver's Merkle trees; needs a remote mdserver")
+	flags.StringVar(&params.BlockCompression, "block-compression", defaultParams.BlockCompression, fmt.Sprintf("(EXPERIMENTAL) How to compress new blocks before encrypting them: %q or %q; blocks written with %q can't be read by older clients", BlockCompressionNoneName, BlockCompressionSnappyName, BlockCompressionSnappyName))
 
 	// No real need to enable setting
 	// params.TLFJournalBackgroundWorkStatus via a flag.
@@ -167,6 +278,39 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	return &params
 }
 
+// makeTuningConfig returns the defaults, overridden first by the
+// settings in params.TuningConfigFile and then by params.Tuning.
+func makeTuningConfig(params InitParams) (TuningConfig, error) {
+	tuning := DefaultTuningConfig()
+	if params.TuningConfigFile != "" {
+		var err error
+		tuning, err = LoadTuningConfig(params.TuningConfigFile)
+		if err != nil {
+			return TuningConfig{}, err
+		}
+	}
+	tuning = tuning.withOverrides(params.Tuning)
+	err := tuning.Validate()
+	if err != nil {
+		return TuningConfig{}, err
+	}
+	return tuning, nil
+}
+
+func makeBlockSplitter(params InitParams, maxBlockSize int64,
+	codec kbfscodec.Codec) (BlockSplitter, error) {
+	switch params.BlockSplitter {
+	case "", BlockSplitterSimpleName:
+		return NewBlockSplitterSimple(maxBlockSize, 8*1024, codec)
+	case BlockSplitterCDCName:
+		return NewBlockSplitterCDC(params.CDCMinBlockSize,
+			params.CDCAvgBlockSize, maxBlockSize, 8*1024, codec)
+	default:
+		return nil, fmt.Errorf("Unknown block splitter %q",
+			params.BlockSplitter)
+	}
+}
+
 func makeMDServer(config Config, serverInMemory bool, serverRootDir, mdserverAddr string, ctx Context) (
 	MDServer, error) {
 	if serverInMemory {
@@ -303,17 +447,51 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 		os.Exit(1)
 	}()
 
+	tuning, err := makeTuningConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
 	config := NewConfigLocal()
+	config.SetTuningConfig(tuning)
+	// Re-size the caches for the new settings.
+	config.ResetCaches()
 
 	config.SetBlockOps(NewBlockOpsStandard(config, defaultBlockRetrievalWorkerQueueSize))
 
-	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
-		config.Codec())
+	bsplitter, err := makeBlockSplitter(
+		params, tuning.MaxBlockSizeBytes, config.Codec())
 	if err != nil {
 		return nil, err
 	}
 	config.SetBlockSplitter(bsplitter)
 
+	if params.ConflictFileMergeMaxBytes > 0 {
+		config.SetConflictFileMerger(LineConflictFileMerger{
+			MaxSize: uint64(params.ConflictFileMergeMaxBytes),
+		})
+	}
+
+	if params.ConflictHoldTimeout > 0 {
+		config.SetConflictHoldTimeout(params.ConflictHoldTimeout)
+	}
+
+	if params.TrashRetention > 0 {
+		config.SetTrashRetention(params.TrashRetention)
+	}
+
+	blockCompression, err := ParseBlockCompressionType(
+		params.BlockCompression)
+	if err != nil {
+		return nil, err
+	}
+	config.SetBlockCompression(blockCompression)
+
+	config.BandwidthLimiter().SetLimits(BandwidthLimits{
+		UploadBytesPerSec:   params.UploadBytesPerSec,
+		DownloadBytesPerSec: params.DownloadBytesPerSec,
+	})
+
 	if registry := config.MetricsRegistry(); registry != nil {
 		keyCache := config.KeyCache()
 		keyCache = NewKeyCacheMeasured(keyCache, registry)
@@ -389,6 +567,15 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 	}
 	config.SetMDServer(mdServer)
 
+	if params.VerifyMerkle {
+		merkleSrc, ok := mdServer.(MerkleSource)
+		if !ok {
+			return nil, errors.New(
+				"Merkle verification needs a remote MD server")
+		}
+		config.SetMerkleSource(merkleSrc)
+	}
+
 	// note: the mdserver is the keyserver at the moment.
 	keyServer, err := makeKeyServer(
 		config, params.ServerInMemory || params.MDServerInMemory, params.ServerRootDir, params.MDServerAddr)
@@ -413,12 +600,30 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 
 	config.SetBlockServer(bserv)
 
+	if params.DiskBlockCacheMaxBytes > 0 &&
+		len(params.DiskBlockCacheRoot) > 0 {
+		var dbc DiskBlockCache
+		dbc, err = NewDiskBlockCacheStandard(config,
+			params.DiskBlockCacheRoot, params.DiskBlockCacheMaxBytes)
+		if err != nil {
+			// The disk cache is only an optimization, so just
+			// run without it.
+			log.Warning("Could not initialize disk block cache: %v", err)
+		} else {
+			if registry := config.MetricsRegistry(); registry != nil {
+				dbc = NewDiskBlockCacheMeasured(dbc, registry)
+			}
+			config.SetDiskBlockCache(dbc)
+		}
+	}
+
 	// TODO: Don't turn on journaling if -server-in-memory is
 	// used.
 
 	if len(params.WriteJournalRoot) > 0 {
 		config.EnableJournaling(params.WriteJournalRoot,
-			params.TLFJournalBackgroundWorkStatus)
+			params.TLFJournalBackgroundWorkStatus,
+			params.JournalDiskLimitBytes)
 	}
 
 	return config, nil
@@ -131,6 +131,23 @@ type KBFSOps interface {
 	GetRootNode(
 		ctx context.Context, h *TlfHandle, branch BranchName) (
 		node Node, ei EntryInfo, err error)
+	// GetRootNodeAtRevision returns the root node and root entry
+	// info of a read-only view of the given TLF as of the given
+	// merged revision, if the logged-in user has read permissions
+	// to the top-level folder.  Any attempt to modify the returned
+	// node or its descendants fails with a WriteToReadonlyNodeError,
+	// and reading data that has since been deleted by quota
+	// reclamation fails with a RevGarbageCollectedError.  This is
+	// a remote-access operation.
+	GetRootNodeAtRevision(
+		ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+		node Node, ei EntryInfo, err error)
+	// GetRootNodeAtTime is like GetRootNodeAtRevision, but uses the
+	// latest merged revision made at or before the given time,
+	// according to the server's timestamps.
+	GetRootNodeAtTime(
+		ctx context.Context, h *TlfHandle, t time.Time) (
+		node Node, ei EntryInfo, err error)
 	// GetDirChildren returns a map of children in the directory,
 	// mapped to their EntryInfo, if the logged-in user has read
 	// permission for the top-level folder.  This is a remote-access
@@ -167,6 +184,23 @@ type KBFSOps interface {
 	// is a remote-sync operation.
 	CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (
 		EntryInfo, error)
+	// CreateHardLink creates a new hard link named name under dir,
+	// pointing to the given file, if the logged-in user has write
+	// permission to the top-level folder.  Both names then share
+	// the same file contents and attributes.  Returns the entry
+	// info of the shared file.  This is a remote-sync operation.
+	CreateHardLink(ctx context.Context, file Node, dir Node, name string) (
+		EntryInfo, error)
+	// CopyFile creates a new file named name under dir, with the
+	// same contents and type as the given file, if the logged-in
+	// user has write permission to the top-level folder.  The two
+	// files must be in the same top-level folder.  The copy shares
+	// the source's data blocks by adding new references to them on
+	// the block server, so no file data needs to be re-uploaded.
+	// Returns the new Node for the copy, and its new entry info.
+	// This is a remote-sync operation.
+	CopyFile(ctx context.Context, file Node, dir Node, name string) (
+		Node, EntryInfo, error)
 	// RemoveDir removes the subdirectory represented by the given
 	// node, if the logged-in user has write permission to the
 	// top-level folder.  Will return an error if the subdirectory is
@@ -226,6 +260,26 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// GetXattr returns the value of the named extended attribute of
+	// the entry represented by the given node, or NoSuchXattrError
+	// if it isn't set.  This is a remote-access operation.
+	GetXattr(ctx context.Context, node Node, name string) ([]byte, error)
+	// ListXattr returns the sorted names of all the extended
+	// attributes of the entry represented by the given node.  This
+	// is a remote-access operation.
+	ListXattr(ctx context.Context, node Node) ([]string, error)
+	// SetXattr sets the named extended attribute of the entry
+	// represented by the given node, if the logged-in user has write
+	// permissions to the top-level folder.  The flag controls
+	// whether the attribute must or must not already exist.  This is
+	// a remote-sync operation.
+	SetXattr(ctx context.Context, node Node, name string, value []byte,
+		flag XattrSetFlag) error
+	// RemoveXattr removes the named extended attribute from the
+	// entry represented by the given node, if the logged-in user has
+	// write permissions to the top-level folder.  This is a
+	// remote-sync operation.
+	RemoveXattr(ctx context.Context, node Node, name string) error
 	// Sync flushes all outstanding writes and truncates for the given
 	// file to the KBFS servers, if the logged-in user has write
 	// permissions to the top-level folder.  If done through a file
@@ -247,6 +301,49 @@ type KBFSOps interface {
 	// any, and fast-forwards to the current head of this
 	// folder-branch.
 	UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error
+	// GetUnmergedChanges returns the operations made to each path
+	// in the given folder-branch by this device's unmerged
+	// branch, along with those made to the same path in the merged
+	// branch and the conflict choice set for the path, if any.  It
+	// returns nil if the folder-branch isn't staged.
+	GetUnmergedChanges(ctx context.Context, folderBranch FolderBranch) (
+		[]UnmergedChange, error)
+	// SetConflictChoice sets how conflict resolution should treat
+	// the file at the given path (relative to the root of the
+	// folder-branch), if it was written both by this device and in
+	// the merged branch.  Choices other than ConflictChoiceAuto
+	// return a NoWriteConflictError for any other path.  Choices
+	// only last until the next successful resolution, or until the
+	// folder-branch is unstaged.  Any resolution in progress, or
+	// held back waiting for a choice (see
+	// Config.ConflictHoldTimeout), is restarted.
+	SetConflictChoice(ctx context.Context, folderBranch FolderBranch,
+		path string, choice ConflictChoice) error
+	// BeginTransaction syncs any dirty files in the given
+	// folder-branch, and then starts grouping all the writes made
+	// with the returned context into a single MD revision.  The
+	// writes are visible locally right away, but other devices see
+	// none of them until CommitTransaction is called with that
+	// context.  Only one transaction may be open per folder-branch,
+	// and while it is, writes to the folder-branch made with any
+	// other context fail with TransactionInProgressError, and
+	// updates from other devices are held back until it ends.  A
+	// transaction still open at shutdown is aborted.
+	BeginTransaction(ctx context.Context, folderBranch FolderBranch) (
+		context.Context, error)
+	// CommitTransaction syncs any dirty files in the given
+	// folder-branch, and then puts all the writes made since
+	// BeginTransaction as a single MD revision.  ctx must be the
+	// context returned by BeginTransaction.  If another device
+	// wrote in the meantime, the whole revision goes through
+	// conflict resolution as a unit.  On error, the transaction
+	// stays open and may be committed again or aborted.
+	CommitTransaction(ctx context.Context, folderBranch FolderBranch) error
+	// AbortTransaction undoes all the writes made to the given
+	// folder-branch since BeginTransaction, including any unsynced
+	// writes to files, and ends the transaction.  ctx must be the
+	// context returned by BeginTransaction.
+	AbortTransaction(ctx context.Context, folderBranch FolderBranch) error
 	// Rekey rekeys this folder.
 	Rekey(ctx context.Context, id tlf.ID) error
 	// SyncFromServerForTesting blocks until the local client has
@@ -270,9 +367,47 @@ type KBFSOps interface {
 	// for the folder.
 	GetEditHistory(ctx context.Context, folderBranch FolderBranch) (
 		edits TlfWriterEdits, err error)
+	// GetChanges returns the changes made to each path in the
+	// given folder by the merged revisions after since, in order,
+	// along with the last revision it looked at.  It looks at a
+	// limited number of revisions per call, so callers should keep
+	// calling it with the returned revision until that stops
+	// changing.  A revision whose changes were reclaimed is reported
+	// as a single ChangesReclaimed change.  Changes made through
+	// the hidden trash and hard links directories are reported
+	// under the paths users see.  Note that the changes don't
+	// include any unmerged changes or outstanding writes from the
+	// local device.
+	GetChanges(ctx context.Context, folderBranch FolderBranch,
+		since MetadataRevision) (
+		changes []TlfChange, latest MetadataRevision, err error)
 
 	// GetNodeMetadata gets metadata associated with a Node.
 	GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error)
+	// GetFileHistory returns the past versions of the given file,
+	// oldest first, each one made by a merged revision that created,
+	// wrote, renamed or changed the attributes of the file.  This is
+	// an expensive operation, since it walks back through the merged
+	// history until the revision that created the file.
+	GetFileHistory(ctx context.Context, file Node) (
+		versions []FileVersion, err error)
+	// RestoreFileVersion makes the contents of the given file those
+	// it had as of the given merged revision, in a single new
+	// revision.
+	RestoreFileVersion(ctx context.Context, file Node,
+		rev MetadataRevision) error
+	// GetTrash returns the removed files and directories in the
+	// trash of the given folder, oldest first.  Entries are only
+	// moved into the trash if the config's TrashRetention is
+	// positive.
+	GetTrash(ctx context.Context, folderBranch FolderBranch) (
+		[]TrashEntry, error)
+	// Restore moves the entry with the given name in the trash of
+	// the given folder back to where it was removed from.  Its old
+	// parent directory must still exist, and must not have a new
+	// entry of the same name.
+	Restore(ctx context.Context, folderBranch FolderBranch,
+		name string) error
 
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
@@ -658,6 +793,52 @@ type BlockCache interface {
 	DeleteKnownPtr(tlf tlf.ID, block *FileBlock) error
 }
 
+// MerkleSource provides the current root of the global KBFS Merkle
+// tree, and the leaves within it for individual TLFs.  The leaves
+// record the latest merged MD revision of each TLF, so that the MD
+// fetched from an MDServer can be checked against them.
+type MerkleSource interface {
+	// GetCurrentMerkleRoot returns the latest root of the Merkle
+	// tree with the given ID, which is either the tree for public
+	// TLFs or the one for private TLFs.
+	GetCurrentMerkleRoot(ctx context.Context,
+		treeID keybase1.MerkleTreeID) (MerkleRoot, error)
+	// GetMerkleLeaf returns the encoded leaf for the given TLF in
+	// the tree with the given root, or nil if the TLF has no leaf
+	// in that tree.  The leaf is an encoded MerkleLeaf for public
+	// TLFs, and an encoded EncryptedMerkleLeaf for private TLFs,
+	// encrypted with the TLF's public key and the ephemeral key
+	// and nonce of the root.
+	GetMerkleLeaf(ctx context.Context, id tlf.ID, root MerkleRoot) (
+		[]byte, error)
+}
+
+// DiskBlockCache caches encrypted blocks on local disk, so that they
+// don't need to be fetched from the block server again, even across
+// restarts.  Blocks are identified by their (content-addressable)
+// block ID.
+type DiskBlockCache interface {
+	// Get gets the (encrypted) block data and server half
+	// associated with the given block ID.  It returns a
+	// NoSuchBlockError if the block is not cached, or was cached
+	// for a different TLF.
+	Get(ctx context.Context, tlfID tlf.ID, blockID BlockID) (
+		[]byte, kbfscrypto.BlockCryptKeyServerHalf, error)
+	// Put stores the (encrypted) block data and server half for
+	// the given block ID, which belongs to the given TLF.  It may
+	// evict other blocks in order to make room.
+	Put(ctx context.Context, tlfID tlf.ID, blockID BlockID, buf []byte,
+		serverHalf kbfscrypto.BlockCryptKeyServerHalf) error
+	// Delete removes the given blocks from the cache, if they
+	// exist.
+	Delete(ctx context.Context, blockIDs []BlockID) error
+	// Status returns the current status of the cache.
+	Status() DiskBlockCacheStatus
+	// Shutdown cleanly shuts down the cache.  No other methods
+	// may be called after this is called.
+	Shutdown()
+}
+
 // DirtyPermChan is a channel that gets closed when the holder has
 // permission to write.  We are forced to define it as a type due to a
 // bug in mockgen that can't handle return values with a chan
@@ -824,11 +1005,16 @@ type cryptoPure interface {
 		encryptedPMD EncryptedPrivateMetadata,
 		key kbfscrypto.TLFCryptKey) (PrivateMetadata, error)
 
-	// EncryptBlocks encrypts a block. plainSize is the size of the encoded
-	// block; EncryptBlock() must guarantee that plainSize <=
-	// len(encryptedBlock).
-	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
-		plainSize int, encryptedBlock EncryptedBlock, err error)
+	// EncryptBlocks encrypts a block, first compressing it with
+	// the given type of compression if that makes it smaller.
+	// plainSize is the size of the encoded block, and
+	// compressedSize is the size of the data that was actually
+	// padded and encrypted, which is less than plainSize only if
+	// the block was compressed; EncryptBlock() must guarantee that
+	// compressedSize <= len(encryptedBlock).
+	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey,
+		compression BlockCompressionType) (plainSize int,
+		encryptedBlock EncryptedBlock, compressedSize int, err error)
 
 	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
 	// DecryptBlock() must guarantee that (size of the decrypted
@@ -1006,7 +1192,9 @@ type BlockOps interface {
 	// the given key metadata) into encoded (and encrypted) data,
 	// and calculates its ID and size, so that we can do a bunch
 	// of block puts in parallel for every write. Ready() must
-	// guarantee that plainSize <= readyBlockData.QuotaSize().
+	// guarantee that plainSize <= readyBlockData.QuotaSize(),
+	// unless the block was compressed, in which case
+	// readyBlockData records how much compression saved.
 	Ready(ctx context.Context, kmd KeyMetadata, block Block) (
 		id BlockID, plainSize int, readyBlockData ReadyBlockData, err error)
 
@@ -1022,10 +1210,37 @@ type BlockOps interface {
 	// than folder writers.
 	Archive(ctx context.Context, tlfID tlf.ID, ptrs []BlockPointer) error
 
+	// Prefetcher returns the prefetcher used for speculatively
+	// fetching the children of retrieved blocks.
+	Prefetcher() Prefetcher
+
 	// Shutdown shuts down all the workers performing Get operations
 	Shutdown()
 }
 
+// Prefetcher speculatively fetches blocks that are likely to be
+// needed soon, at a lower priority than on-demand requests, and puts
+// them in the block cache.
+type Prefetcher interface {
+	// PrefetchAfterBlockRetrieved prefetches the children of the
+	// given block (which belongs to the TLF with the given key
+	// metadata), if it is a directory block.
+	PrefetchAfterBlockRetrieved(b Block, kmd KeyMetadata)
+	// PrefetchFileBlocks prefetches the children of the given
+	// indirect file block (which belongs to the TLF with the given
+	// key metadata), ahead of a sequential read starting at the
+	// given offset: the child containing off, and the ones after
+	// it.
+	PrefetchFileBlocks(b *FileBlock, off int64, kmd KeyMetadata)
+	// CancelTlfPrefetches cancels all outstanding prefetches for
+	// the given TLF.
+	CancelTlfPrefetches(tlfID tlf.ID)
+	// Shutdown cancels all outstanding prefetches and stops
+	// accepting new ones. It returns a channel that is closed
+	// once all outstanding prefetches have finished.
+	Shutdown() <-chan struct{}
+}
+
 // Duplicate kbfscrypto.AuthTokenRefreshHandler here to work around
 // gomock's limitations.
 type authTokenRefreshHandler interface {
@@ -1145,6 +1360,12 @@ type mdServerLocal interface {
 		rev MetadataRevision, err error)
 	isShutdown() bool
 	copy(config mdServerLocalConfig) mdServerLocal
+	// importMD stores the given merged MD, which may have been
+	// written by another device, without checking that the
+	// current user may write to its TLF, and maps the MD's handle
+	// to its TLF ID.  It's used to restore TLF archives.
+	importMD(ctx context.Context, rmds *RootMetadataSigned,
+		extra ExtraMetadata) error
 }
 
 // BlockServer gets and puts opaque data blocks.  The instantiation
@@ -1254,6 +1475,10 @@ type BlockSplitter interface {
 	// bytes from the next block should be appended.
 	CheckSplit(block *FileBlock) int64
 
+	// MaxPtrsPerBlock describes the number of indirect pointers we
+	// can fit into one indirect file block.
+	MaxPtrsPerBlock() int
+
 	// ShouldEmbedBlockChanges decides whether we should keep the
 	// block changes embedded in the MD or not.
 	ShouldEmbedBlockChanges(bc *BlockChanges) bool
@@ -1340,6 +1565,23 @@ type ConflictRenamer interface {
 		string, error)
 }
 
+// ConflictFileMerger merges the contents of a file that was written
+// in both branches of a conflict, so that conflict resolution doesn't
+// need to keep a renamed copy of the unmerged version.
+type ConflictFileMerger interface {
+	// ShouldMerge returns true if a merge should be attempted for a
+	// file with the given name, one of whose versions has the
+	// given size.  It's called before any file contents are
+	// fetched.
+	ShouldMerge(name string, size uint64) bool
+	// MergeFile returns the merged contents of the unmerged and
+	// merged versions of a file, given the contents of their common
+	// ancestor.  It returns false if the changes conflict, in
+	// which case the unmerged version is renamed as usual.
+	MergeFile(ctx context.Context, name string,
+		base, unmerged, merged []byte) ([]byte, bool)
+}
+
 // Config collects all the singleton instance instantiations needed to
 // run KBFS in one place.  The methods below are self-explanatory and
 // do not require comments.
@@ -1362,6 +1604,12 @@ type Config interface {
 	SetBlockCache(BlockCache)
 	DirtyBlockCache() DirtyBlockCache
 	SetDirtyBlockCache(DirtyBlockCache)
+	DiskBlockCache() DiskBlockCache
+	SetDiskBlockCache(DiskBlockCache)
+	// MerkleSource returns the source used to verify fetched MD
+	// against the Merkle tree, or nil if verification is off.
+	MerkleSource() MerkleSource
+	SetMerkleSource(MerkleSource)
 	Crypto() Crypto
 	SetCrypto(Crypto)
 	Codec() kbfscodec.Codec
@@ -1388,6 +1636,16 @@ type Config interface {
 	SetClock(Clock)
 	ConflictRenamer() ConflictRenamer
 	SetConflictRenamer(ConflictRenamer)
+	ConflictFileMerger() ConflictFileMerger
+	SetConflictFileMerger(ConflictFileMerger)
+	// BandwidthLimiter limits the rates of block uploads and
+	// downloads to and from a remote block server.
+	BandwidthLimiter() *BandwidthLimiter
+	// TuningConfig holds the settings that trade off performance
+	// against resource usage.  Changes to the cache sizes only
+	// take effect at the next ResetCaches.
+	TuningConfig() TuningConfig
+	SetTuningConfig(TuningConfig)
 	MetadataVersion() MetadataVer
 	SetMetadataVersion(MetadataVer)
 	DataVersion() DataVer
@@ -1405,6 +1663,10 @@ type Config interface {
 	// MaxDirBytes indicates the maximum supported plaintext size of a
 	// directory in bytes.
 	MaxDirBytes() uint64
+	// MaxDirBlockBytes indicates the maximum plaintext size of a
+	// single directory block; larger directories are split across
+	// multiple blocks.
+	MaxDirBlockBytes() uint64
 	// DoBackgroundFlushes says whether we should periodically try to
 	// flush dirty files, even without a sync from the user.  Should
 	// be true except for during some testing.
@@ -1441,6 +1703,27 @@ type Config interface {
 	// most recently merged MD update before we can run reclamation,
 	// to avoid conflicting with a currently active writer.
 	QuotaReclamationMinHeadAge() time.Duration
+	// TrashRetention is how long entries removed by this device
+	// stay in the hidden trash directory of their TLF, where they
+	// can be restored from, before quota reclamation purges them.
+	// The resulting expiry is recorded on each entry, so all
+	// writers of the TLF honor it.  If it is 0, entries removed by
+	// this device are unreferenced right away instead.
+	TrashRetention() time.Duration
+	SetTrashRetention(time.Duration)
+	// ConflictHoldTimeout is how long conflict resolution leaves
+	// an unmerged branch with conflicting file writes alone,
+	// waiting for a conflict choice to be set for each of those
+	// files (see KBFSOps.SetConflictChoice), before resolving it
+	// anyway.  If it is 0, conflicts are resolved right away.
+	ConflictHoldTimeout() time.Duration
+	SetConflictHoldTimeout(time.Duration)
+	// BlockCompression is the type of compression applied to new
+	// blocks before they are encrypted, for the blocks it makes
+	// smaller.  Compressed blocks can be read whatever it is set
+	// to.
+	BlockCompression() BlockCompressionType
+	SetBlockCompression(BlockCompressionType)
 
 	// ResetCaches clears and re-initializes all data and key caches.
 	ResetCaches()
@@ -63,21 +63,32 @@ func (j journalBlockServer) AddBlockReference(
 	ctx context.Context, tlfID tlf.ID, id BlockID,
 	context BlockContext) (err error) {
 	if tlfJournal, ok := j.jServer.getTLFJournal(tlfID); ok {
-		if !j.enableAddBlockReference {
-			// TODO: Temporarily return an error until KBFS-1149 is
-			// fixed. This is needed despite
-			// journalBlockCache.CheckForBlockPtr, since
-			// CheckForBlockPtr may be called before journaling is
-			// turned on for a TLF.
-			return BServerErrorBlockNonExistent{}
-		}
-
 		defer func() {
 			err = translateToBlockServerError(err)
 		}()
-		err := tlfJournal.addBlockReference(ctx, id, context)
-		if err != errTLFJournalDisabled {
-			return err
+		if j.enableAddBlockReference {
+			err := tlfJournal.addBlockReference(ctx, id, context)
+			if err != errTLFJournalDisabled {
+				return err
+			}
+		} else {
+			// A journaled reference to a block whose data has
+			// already been flushed couldn't be read until the
+			// reference itself is flushed (KBFS-1149), so only
+			// journal references to blocks whose data the journal
+			// still holds, and add the rest straight to the
+			// server, which has the data.
+			err := tlfJournal.addHeldBlockReference(ctx, id, context)
+			switch err.(type) {
+			case nil:
+				return nil
+			case blockNonExistentError:
+				break
+			default:
+				if err != errTLFJournalDisabled {
+					return err
+				}
+			}
 		}
 	}
 
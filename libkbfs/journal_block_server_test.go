@@ -39,7 +39,8 @@ func setupJournalBlockServerTest(t *testing.T) (
 		}
 	}()
 
-	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled)
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled,
+		DefaultJournalDiskLimitBytes)
 	jServer, err = GetJournalServer(config)
 	require.NoError(t, err)
 	blockServer := jServer.blockServer()
@@ -0,0 +1,173 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultJournalDiskLimitBytes is the default maximum number of
+	// unflushed block bytes that all the TLF journals of a
+	// JournalServer may hold together.
+	DefaultJournalDiskLimitBytes = 20 * 1024 * 1024 * 1024
+	// defaultJournalBackpressureMaxDelay is the longest a single
+	// block put will be delayed when the journals are nearly full.
+	defaultJournalBackpressureMaxDelay = 10 * time.Second
+)
+
+// journalDiskLimiter tracks the total number of unflushed block bytes
+// across all the TLF journals of a JournalServer, and applies
+// backpressure to new block puts as that total approaches the limit.
+// Once more than half of the limit is in use, each put is delayed by
+// an amount that grows linearly up to maxDelay; a put that would go
+// over the limit fails with a JournalDiskLimitExceededError.
+//
+// Bytes are reserved before a put is written to a journal, and are
+// released when they're flushed (or ignored) by the journal, or when
+// the journal is shut down.
+type journalDiskLimiter struct {
+	log        logger.Logger
+	limitBytes int64
+	maxDelay   time.Duration
+	// delayFn is called to apply backpressure; it's overridden by
+	// tests.
+	delayFn func(context.Context, time.Duration) error
+
+	// Protects journalBytes.
+	lock         sync.Mutex
+	journalBytes int64
+}
+
+// makeJournalDiskLimiter returns a journalDiskLimiter with the given
+// limit.  If limitBytes is not positive, puts are never delayed or
+// failed, but usage is still tracked.
+func makeJournalDiskLimiter(log logger.Logger, limitBytes int64,
+	maxDelay time.Duration) *journalDiskLimiter {
+	return &journalDiskLimiter{
+		log:        log,
+		limitBytes: limitBytes,
+		maxDelay:   maxDelay,
+		delayFn:    defaultJournalDiskLimiterDelay,
+	}
+}
+
+func defaultJournalDiskLimiterDelay(
+	ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	}
+}
+
+// getDelayLocked returns how long to delay a put that would bring the
+// journals up to usedBytes.
+func (jdl *journalDiskLimiter) getDelayLocked(usedBytes int64) time.Duration {
+	minBytes := jdl.limitBytes / 2
+	if usedBytes <= minBytes {
+		return 0
+	}
+	frac := float64(usedBytes-minBytes) / float64(jdl.limitBytes-minBytes)
+	if frac > 1 {
+		frac = 1
+	}
+	return time.Duration(frac * float64(jdl.maxDelay))
+}
+
+// beforeBlockPut reserves space for a block put of the given size,
+// possibly after a delay.  If this returns nil, afterBlockPut must be
+// called once the put is done.
+func (jdl *journalDiskLimiter) beforeBlockPut(
+	ctx context.Context, blockBytes int64) error {
+	delay, err := func() (time.Duration, error) {
+		jdl.lock.Lock()
+		defer jdl.lock.Unlock()
+		usedBytes := jdl.journalBytes + blockBytes
+		if jdl.limitBytes <= 0 {
+			jdl.journalBytes = usedBytes
+			return 0, nil
+		}
+		if usedBytes > jdl.limitBytes {
+			return 0, JournalDiskLimitExceededError{
+				LimitBytes: jdl.limitBytes,
+				UsedBytes:  jdl.journalBytes,
+				PutBytes:   blockBytes,
+			}
+		}
+		jdl.journalBytes = usedBytes
+		return jdl.getDelayLocked(usedBytes), nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if delay > 0 {
+		jdl.log.CDebugf(ctx, "Delaying block put of %d bytes by %s",
+			blockBytes, delay)
+		err := jdl.delayFn(ctx, delay)
+		if err != nil {
+			jdl.release(blockBytes)
+			return err
+		}
+	}
+	return nil
+}
+
+// afterBlockPut must be called after every successful call to
+// beforeBlockPut, with the number of bytes that were reserved and the
+// number of unflushed bytes the put actually added to the journal.
+// Any difference is released, so that the reservation always ends up
+// matching the journal's own accounting, even if the put failed
+// partway through.
+func (jdl *journalDiskLimiter) afterBlockPut(
+	reservedBytes, putBytes int64) {
+	jdl.release(reservedBytes - putBytes)
+}
+
+// onBlocksFlush releases the given number of bytes, after they have
+// been flushed or ignored by a journal.
+func (jdl *journalDiskLimiter) onBlocksFlush(blockBytes int64) {
+	jdl.release(blockBytes)
+}
+
+// onJournalEnable accounts for the unflushed bytes of a journal that
+// is being enabled.  It never fails, even if the limit is exceeded.
+func (jdl *journalDiskLimiter) onJournalEnable(journalBytes int64) {
+	jdl.lock.Lock()
+	defer jdl.lock.Unlock()
+	jdl.journalBytes += journalBytes
+}
+
+// onJournalShutdown releases the unflushed bytes of a journal that
+// is being shut down.
+func (jdl *journalDiskLimiter) onJournalShutdown(journalBytes int64) {
+	jdl.release(journalBytes)
+}
+
+func (jdl *journalDiskLimiter) release(bytes int64) {
+	jdl.lock.Lock()
+	defer jdl.lock.Unlock()
+	jdl.journalBytes -= bytes
+	if jdl.journalBytes < 0 {
+		jdl.log.CWarningf(context.TODO(),
+			"Journal disk usage went negative: %d", jdl.journalBytes)
+		jdl.journalBytes = 0
+	}
+}
+
+// getStatus returns the limit and the current usage, in bytes.
+func (jdl *journalDiskLimiter) getStatus() (limitBytes, usedBytes int64) {
+	jdl.lock.Lock()
+	defer jdl.lock.Unlock()
+	return jdl.limitBytes, jdl.journalBytes
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestJournalDiskLimiterNoLimit(t *testing.T) {
+	jdl := makeJournalDiskLimiter(logger.NewTestLogger(t), 0, time.Second)
+	jdl.delayFn = func(context.Context, time.Duration) error {
+		t.Fatal("Unexpected delay")
+		return nil
+	}
+
+	ctx := context.Background()
+	err := jdl.beforeBlockPut(ctx, 1<<40)
+	require.NoError(t, err)
+	jdl.afterBlockPut(1<<40, 1<<40)
+	jdl.onJournalEnable(10)
+	limitBytes, usedBytes := jdl.getStatus()
+	require.Equal(t, int64(0), limitBytes)
+	require.Equal(t, int64(1<<40+10), usedBytes)
+
+	jdl.onBlocksFlush(1 << 40)
+	jdl.onJournalShutdown(10)
+	_, usedBytes = jdl.getStatus()
+	require.Equal(t, int64(0), usedBytes)
+}
+
+func TestJournalDiskLimiterBackpressure(t *testing.T) {
+	jdl := makeJournalDiskLimiter(logger.NewTestLogger(t), 100, time.Second)
+	var delays []time.Duration
+	jdl.delayFn = func(_ context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+
+	ctx := context.Background()
+	for _, putBytes := range []int64{50, 25, 25} {
+		err := jdl.beforeBlockPut(ctx, putBytes)
+		require.NoError(t, err)
+		jdl.afterBlockPut(putBytes, putBytes)
+	}
+	require.Equal(t,
+		[]time.Duration{500 * time.Millisecond, time.Second}, delays)
+
+	err := jdl.beforeBlockPut(ctx, 1)
+	require.IsType(t, JournalDiskLimitExceededError{}, err)
+
+	// A put that doesn't write any data gives its bytes back.
+	jdl.onBlocksFlush(10)
+	err = jdl.beforeBlockPut(ctx, 10)
+	require.NoError(t, err)
+	jdl.afterBlockPut(10, 0)
+	_, usedBytes := jdl.getStatus()
+	require.Equal(t, int64(90), usedBytes)
+
+	// A put that adds fewer bytes to the journal than it reserved
+	// only keeps what it added.
+	err = jdl.beforeBlockPut(ctx, 10)
+	require.NoError(t, err)
+	jdl.afterBlockPut(10, 4)
+	_, usedBytes = jdl.getStatus()
+	require.Equal(t, int64(94), usedBytes)
+}
+
+func TestJournalDiskLimiterCanceledDelay(t *testing.T) {
+	jdl := makeJournalDiskLimiter(logger.NewTestLogger(t), 100, time.Hour)
+	jdl.onJournalEnable(60)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := jdl.beforeBlockPut(ctx, 10)
+	require.Equal(t, context.Canceled, err)
+	_, usedBytes := jdl.getStatus()
+	require.Equal(t, int64(60), usedBytes)
+}
@@ -42,7 +42,8 @@ func setupJournalMDOpsTest(t *testing.T) (
 	}()
 
 	oldMDOps = config.MDOps()
-	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled)
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled,
+		DefaultJournalDiskLimitBytes)
 	jServer, err = GetJournalServer(config)
 	// Turn off listeners to avoid background MD pushes for CR.
 	jServer.onBranchChange = nil
@@ -37,6 +37,12 @@ type JournalServerStatus struct {
 	JournalCount        int
 	UnflushedBytes      int64 // (signed because os.FileInfo.Size() is signed)
 	UnflushedPaths      []string
+	// DiskLimitBytes is the maximum number of unflushed bytes
+	// allowed across all journals; if not positive, there is no
+	// limit.  DiskUsedBytes is the number of bytes currently
+	// counted against it, including puts in progress.
+	DiskLimitBytes int64
+	DiskUsedBytes  int64
 }
 
 // branchChangeListener describes a caller that will get updates via
@@ -87,6 +93,7 @@ type JournalServer struct {
 	delegateMDOps           MDOps
 	onBranchChange          branchChangeListener
 	onMDFlush               mdFlushListener
+	diskLimiter             *journalDiskLimiter
 
 	// Protects all fields below.
 	lock                sync.RWMutex
@@ -102,7 +109,8 @@ func makeJournalServer(
 	config Config, log logger.Logger, dir string,
 	bcache BlockCache, dirtyBcache DirtyBlockCache, bserver BlockServer,
 	mdOps MDOps, onBranchChange branchChangeListener,
-	onMDFlush mdFlushListener) *JournalServer {
+	onMDFlush mdFlushListener,
+	diskLimiter *journalDiskLimiter) *JournalServer {
 	jServer := JournalServer{
 		config:                  config,
 		log:                     log,
@@ -114,6 +122,7 @@ func makeJournalServer(
 		delegateMDOps:           mdOps,
 		onBranchChange:          onBranchChange,
 		onMDFlush:               onMDFlush,
+		diskLimiter:             diskLimiter,
 		tlfJournals:             make(map[tlf.ID]*tlfJournal),
 	}
 	jServer.dirtyOpsDone = sync.NewCond(&jServer.lock)
@@ -386,7 +395,7 @@ func (j *JournalServer) enableLocked(
 	tlfJournal, err := makeTLFJournal(
 		ctx, j.currentUID, j.currentVerifyingKey, tlfDir,
 		tlfID, tlfJournalConfigAdapter{j.config}, j.delegateBlockServer,
-		bws, nil, j.onBranchChange, j.onMDFlush)
+		j.diskLimiter, bws, nil, j.onBranchChange, j.onMDFlush)
 	if err != nil {
 		return err
 	}
@@ -480,6 +489,17 @@ func (j *JournalServer) ResumeBackgroundWork(ctx context.Context, tlfID tlf.ID)
 		tlfID)
 }
 
+// signalWork kicks off background work for the journal of the
+// given TLF, if it has one, e.g. to retry flushing right away after
+// the servers become reachable again.
+func (j *JournalServer) signalWork(tlfID tlf.ID) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	if tlfJournal, ok := j.tlfJournals[tlfID]; ok {
+		tlfJournal.signalWork()
+	}
+}
+
 // Flush flushes the write journal for the given TLF.
 func (j *JournalServer) Flush(ctx context.Context, tlfID tlf.ID) (err error) {
 	j.log.CDebugf(ctx, "Flushing journal for %s", tlfID)
@@ -585,6 +605,7 @@ func (j *JournalServer) Status(
 		totalUnflushedBytes += unflushedBytes
 		tlfIDs = append(tlfIDs, tlfJournal.tlfID)
 	}
+	diskLimitBytes, diskUsedBytes := j.diskLimiter.getStatus()
 	return JournalServerStatus{
 		RootDir:             j.rootPath(),
 		Version:             1,
@@ -593,6 +614,8 @@ func (j *JournalServer) Status(
 		EnableAuto:          j.serverConfig.EnableAuto,
 		JournalCount:        len(tlfIDs),
 		UnflushedBytes:      totalUnflushedBytes,
+		DiskLimitBytes:      diskLimitBytes,
+		DiskUsedBytes:       diskUsedBytes,
 	}, tlfIDs
 }
 
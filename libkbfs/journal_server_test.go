@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/assert"
@@ -38,7 +39,8 @@ func setupJournalServerTest(t *testing.T) (
 		}
 	}()
 
-	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled)
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled,
+		DefaultJournalDiskLimitBytes)
 	jServer, err = GetJournalServer(config)
 	require.NoError(t, err)
 
@@ -102,7 +104,8 @@ func TestJournalServerRestart(t *testing.T) {
 	jServer = makeJournalServer(
 		config, jServer.log, tempdir, jServer.delegateBlockCache,
 		jServer.delegateDirtyBlockCache,
-		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil)
+		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil,
+		jServer.diskLimiter)
 	uid, verifyingKey, err :=
 		getCurrentUIDAndVerifyingKey(ctx, config.KBPKI())
 	require.NoError(t, err)
@@ -435,7 +438,8 @@ func TestJournalServerEnableAuto(t *testing.T) {
 	jServer = makeJournalServer(
 		config, jServer.log, tempdir, jServer.delegateBlockCache,
 		jServer.delegateDirtyBlockCache,
-		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil)
+		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil,
+		jServer.diskLimiter)
 	uid, verifyingKey, err :=
 		getCurrentUIDAndVerifyingKey(ctx, config.KBPKI())
 	require.NoError(t, err)
@@ -447,3 +451,76 @@ func TestJournalServerEnableAuto(t *testing.T) {
 	require.Equal(t, 1, status.JournalCount)
 	require.Len(t, tlfIDs, 1)
 }
+
+func TestJournalServerDiskLimit(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	// Replace the limiter before any journals are enabled, and
+	// record delays instead of sleeping.
+	jServer.diskLimiter = makeJournalDiskLimiter(
+		config.MakeLogger(""), 10, time.Second)
+	var delays []time.Duration
+	jServer.diskLimiter.delayFn = func(
+		_ context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+
+	ctx := context.Background()
+
+	tlfID := tlf.FakeID(2, false)
+	err := jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	blockServer := config.BlockServer()
+	crypto := config.Crypto()
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	uid := h.ResolvedWriters()[0]
+
+	putBlock := func(data []byte) error {
+		bCtx := BlockContext{uid, "", ZeroBlockRefNonce}
+		bID, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		return blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	}
+
+	// The first put is under the backpressure threshold, the
+	// second gets delayed, and the third would go over the limit.
+	err = putBlock([]byte{1, 2, 3, 4})
+	require.NoError(t, err)
+	require.Len(t, delays, 0)
+	err = putBlock([]byte{5, 6, 7, 8})
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{600 * time.Millisecond}, delays)
+	err = putBlock([]byte{9, 10, 11, 12})
+	require.Equal(t, JournalDiskLimitExceededError{
+		LimitBytes: 10, UsedBytes: 8, PutBytes: 4}, err)
+
+	status, _ := jServer.Status(ctx)
+	require.Equal(t, int64(10), status.DiskLimitBytes)
+	require.Equal(t, int64(8), status.DiskUsedBytes)
+	require.Equal(t, int64(8), status.UnflushedBytes)
+
+	// Logging out releases the journal's bytes, and logging back
+	// in counts them again.
+	serviceLoggedOut(ctx, config)
+	status, _ = jServer.Status(ctx)
+	require.Equal(t, int64(0), status.DiskUsedBytes)
+	serviceLoggedIn(
+		ctx, config, "test_user1", TLFJournalBackgroundWorkPaused)
+	status, _ = jServer.Status(ctx)
+	require.Equal(t, int64(8), status.DiskUsedBytes)
+
+	// Flushing releases them for good.
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	status, _ = jServer.Status(ctx)
+	require.Equal(t, int64(0), status.DiskUsedBytes)
+	err = putBlock([]byte{9, 10, 11, 12})
+	require.NoError(t, err)
+}
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"fmt"
 	"reflect"
 	"sync"
 	"testing"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -816,6 +818,552 @@ func TestBasicCRFileConflict(t *testing.T) {
 	}
 }
 
+// Tests that when a ConflictFileMerger is configured, conflicting
+// writes to a text file are merged if they touch different lines,
+// and the unmerged file is still renamed if they don't.
+func TestBasicCRFileConflictMerged(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetConflictFileMerger(LineConflictFileMerger{
+		MaxSize: DefaultConflictFileMergeMaxSize,
+	})
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates two files in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	base := []byte("one\ntwo\nthree\n")
+	for _, file := range []string{"b", "c"} {
+		fileNode, _, err := kbfsOps1.CreateFile(
+			ctx, dirA1, file, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps1.Write(ctx, fileNode, base, 0)
+		require.NoError(t, err)
+		err = kbfsOps1.Sync(ctx, fileNode)
+		require.NoError(t, err)
+	}
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	write := func(kbfsOps KBFSOps, dir Node, file string, data string,
+		off int64) {
+		fileNode, _, err := kbfsOps.Lookup(ctx, dir, file)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, []byte(data), off)
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, fileNode)
+		require.NoError(t, err)
+	}
+
+	// Both users change different lines of b, and the same line
+	// of c.
+	write(kbfsOps1, dirA1, "b", "ONE", 0)
+	write(kbfsOps1, dirA1, "c", "TWO", 4)
+	write(kbfsOps2, dirA2, "b", "THREE", 8)
+	write(kbfsOps2, dirA2, "c", "2", 4)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	cre := WriterDeviceDateConflictRenamer{}
+	conflictName := cre.ConflictRenameHelper(now, "u2", "dev1", "c")
+	expected := map[string]string{
+		"b":          "ONE\ntwo\nTHREE\n",
+		"c":          "one\nTWO\nthree\n",
+		conflictName: "one\n2wo\nthree\n",
+	}
+	for _, u := range []struct {
+		kbfsOps KBFSOps
+		dir     Node
+	}{{kbfsOps1, dirA1}, {kbfsOps2, dirA2}} {
+		children, err := u.kbfsOps.GetDirChildren(ctx, u.dir)
+		require.NoError(t, err)
+		require.Len(t, children, len(expected))
+		for file, data := range expected {
+			ei, ok := children[file]
+			require.True(t, ok, "Missing child %s", file)
+			require.Equal(t, uint64(len(data)), ei.Size)
+			fileNode, _, err := u.kbfsOps.Lookup(ctx, u.dir, file)
+			require.NoError(t, err)
+			buf := make([]byte, len(data)+1)
+			n, err := u.kbfsOps.Read(ctx, fileNode, buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, data, string(buf[:n]))
+		}
+	}
+}
+
+// Tests that the unmerged user can list its unmerged changes, and
+// choose how the conflicting writes to each file are resolved.
+func TestBasicCRFileConflictChoices(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetConflictFileMerger(LineConflictFileMerger{
+		MaxSize: DefaultConflictFileMergeMaxSize,
+	})
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates three files in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	base := []byte("one\ntwo\nthree\n")
+	for _, file := range []string{"b", "c", "d"} {
+		fileNode, _, err := kbfsOps1.CreateFile(
+			ctx, dirA1, file, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps1.Write(ctx, fileNode, base, 0)
+		require.NoError(t, err)
+		err = kbfsOps1.Sync(ctx, fileNode)
+		require.NoError(t, err)
+	}
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fb2 := rootNode2.GetFolderBranch()
+
+	// Nothing is unmerged yet.
+	changes, err := kbfsOps2.GetUnmergedChanges(ctx, fb2)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, fb2)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb2)
+	require.NoError(t, err)
+
+	write := func(kbfsOps KBFSOps, dir Node, file string, data string,
+		off int64) {
+		fileNode, _, err := kbfsOps.Lookup(ctx, dir, file)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, []byte(data), off)
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, fileNode)
+		require.NoError(t, err)
+	}
+
+	// Both users change different lines of b and d, and the same
+	// line of c.
+	write(kbfsOps1, dirA1, "b", "ONE", 0)
+	write(kbfsOps1, dirA1, "c", "TWO", 4)
+	write(kbfsOps1, dirA1, "d", "ONE", 0)
+	write(kbfsOps2, dirA2, "b", "THREE", 8)
+	write(kbfsOps2, dirA2, "c", "2", 4)
+	write(kbfsOps2, dirA2, "d", "THREE", 8)
+
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "a/b", ConflictKeepTheirs)
+	require.NoError(t, err)
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "/a/c", ConflictKeepMine)
+	require.NoError(t, err)
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "a/d", ConflictKeepBoth)
+	require.NoError(t, err)
+
+	// Only files written on both sides can be given a choice.
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "a/x", ConflictKeepMine)
+	require.Equal(t, NoWriteConflictError{"a/x", ConflictKeepMine}, err)
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "a/x", ConflictChoiceAuto)
+	require.NoError(t, err)
+
+	changes, err = kbfsOps2.GetUnmergedChanges(ctx, fb2)
+	require.NoError(t, err)
+	choices := make(map[string]ConflictChoice)
+	for _, change := range changes {
+		choices[change.Path] = change.Choice
+		require.Len(t, change.Unmerged, 1, change.Path)
+		require.Len(t, change.Merged, 1, change.Path)
+		require.True(t, change.Conflict, change.Path)
+	}
+	require.Equal(t, map[string]ConflictChoice{
+		"a/b": ConflictKeepTheirs,
+		"a/c": ConflictKeepMine,
+		"a/d": ConflictKeepBoth,
+	}, choices)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb2)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	changes, err = kbfsOps2.GetUnmergedChanges(ctx, fb2)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+
+	cre := WriterDeviceDateConflictRenamer{}
+	conflictName := cre.ConflictRenameHelper(now, "u2", "dev1", "d")
+	expected := map[string]string{
+		"b":          "ONE\ntwo\nthree\n",
+		"c":          "one\n2wo\nthree\n",
+		"d":          "ONE\ntwo\nthree\n",
+		conflictName: "one\ntwo\nTHREE\n",
+	}
+	for _, u := range []struct {
+		kbfsOps KBFSOps
+		dir     Node
+	}{{kbfsOps1, dirA1}, {kbfsOps2, dirA2}} {
+		children, err := u.kbfsOps.GetDirChildren(ctx, u.dir)
+		require.NoError(t, err)
+		require.Len(t, children, len(expected))
+		for file, data := range expected {
+			ei, ok := children[file]
+			require.True(t, ok, "Missing child %s", file)
+			require.Equal(t, uint64(len(data)), ei.Size)
+			fileNode, _, err := u.kbfsOps.Lookup(ctx, u.dir, file)
+			require.NoError(t, err)
+			buf := make([]byte, len(data)+1)
+			n, err := u.kbfsOps.Read(ctx, fileNode, buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, data, string(buf[:n]))
+		}
+	}
+}
+
+// crConflictChoiceTestInit sets up a file "a" written by two users
+// in conflict, with user 2's conflict resolution disabled.  It
+// returns the configs and root nodes of both users, and a function
+// that re-enables user 2's conflict resolution.
+func crConflictChoiceTestInit(ctx context.Context, t *testing.T,
+	config1 *ConfigLocal, config2 *ConfigLocal, name string,
+	base, data1, data2 []byte, off1, off2 int64) (
+	rootNode1, rootNode2 Node, restart func()) {
+	rootNode1 = GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, base, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	rootNode2 = GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fb2 := rootNode2.GetFolderBranch()
+	c, err := DisableUpdatesForTesting(config2, fb2)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb2)
+	require.NoError(t, err)
+
+	err = kbfsOps1.Write(ctx, fileNode1, data1, off1)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, data2, off2)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	require.NoError(t, err)
+
+	return rootNode1, rootNode2, func() {
+		c <- struct{}{}
+		err := RestartCRForTesting(
+			BackgroundContextWithCancellationDelayer(), config2, fb2)
+		require.NoError(t, err)
+	}
+}
+
+// Tests that the unmerged user can keep its own version of a file
+// that spans several blocks.
+func TestCRFileConflictKeepMineMultiBlock(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	// Tiny blocks, so the file needs several levels of them.
+	config1.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+
+	name := userName1.String() + "," + userName2.String()
+	base := make([]byte, 100)
+	for i := range base {
+		base[i] = byte(i)
+	}
+	data1 := []byte("theirs")
+	data2 := []byte("mine")
+	rootNode1, rootNode2, restart := crConflictChoiceTestInit(
+		ctx, t, config1, config2, name, base, data1, data2, 10, 50)
+
+	kbfsOps2 := config2.KBFSOps()
+	fb2 := rootNode2.GetFolderBranch()
+	err := kbfsOps2.SetConflictChoice(ctx, fb2, "a", ConflictKeepMine)
+	require.NoError(t, err)
+
+	restart()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+	require.NoError(t, err)
+	kbfsOps1 := config1.KBFSOps()
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	expected := append([]byte(nil), base...)
+	copy(expected[50:], data2)
+	for _, u := range []struct {
+		kbfsOps  KBFSOps
+		rootNode Node
+	}{{kbfsOps1, rootNode1}, {kbfsOps2, rootNode2}} {
+		children, err := u.kbfsOps.GetDirChildren(ctx, u.rootNode)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		fileNode, _, err := u.kbfsOps.Lookup(ctx, u.rootNode, "a")
+		require.NoError(t, err)
+		txnTestCheckData(ctx, t, u.kbfsOps, fileNode, expected)
+	}
+}
+
+// Tests that conflict resolution holds an unmerged branch until a
+// conflict choice is set, or until the hold times out.
+func TestCRFileConflictHold(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetConflictHoldTimeout(time.Hour)
+
+	name := userName1.String() + "," + userName2.String()
+	base := []byte("one\ntwo\nthree\n")
+	rootNode1, rootNode2, restart := crConflictChoiceTestInit(
+		ctx, t, config1, config2, name, base, []byte("ONE"),
+		[]byte("TWO"), 0, 4)
+	restart()
+
+	// Nothing gets resolved while the branch is held.
+	kbfsOps2 := config2.KBFSOps()
+	fb2 := rootNode2.GetFolderBranch()
+	func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		err := kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+		require.Equal(t, context.DeadlineExceeded, err)
+	}()
+	changes, err := kbfsOps2.GetUnmergedChanges(ctx, fb2)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+
+	// Setting a choice releases it.
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "a", ConflictKeepTheirs)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, fileNode2,
+		[]byte("ONE\ntwo\nthree\n"))
+
+	// Without a choice, the hold times out and both versions are
+	// kept.
+	config2.SetConflictHoldTimeout(100 * time.Millisecond)
+	kbfsOps1 := config1.KBFSOps()
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	c, err := DisableUpdatesForTesting(config2, fb2)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb2)
+	require.NoError(t, err)
+	fileNode1, _, err := kbfsOps1.Lookup(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte("3"), 8)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, []byte("4"), 8)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	require.NoError(t, err)
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb2)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+	require.NoError(t, err)
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+}
+
+// Tests that conflict resolution doesn't hold an unmerged branch
+// that has no conflicting file writes.
+func TestCRFileConflictHoldNoConflict(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetConflictHoldTimeout(time.Hour)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb2 := rootNode2.GetFolderBranch()
+	c, err := DisableUpdatesForTesting(config2, fb2)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb2)
+	require.NoError(t, err)
+
+	// Both users change the folder, but not the same file.
+	err = kbfsOps1.Write(ctx, fileNode1, []byte("one"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.CreateFile(
+		ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, []byte("two"), 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb2)
+	require.NoError(t, err)
+	func() {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		err := kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+		require.NoError(t, err)
+	}()
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+}
+
+// Tests that conflict resolution keeps holding an unmerged branch
+// until every file with conflicting writes has a conflict choice.
+func TestCRFileConflictHoldUntilAllChosen(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetConflictHoldTimeout(time.Hour)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	names := []string{"a", "b"}
+	var fileNodes1 []Node
+	for _, n := range names {
+		fileNode, _, err := kbfsOps1.CreateFile(
+			ctx, rootNode1, n, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps1.Write(ctx, fileNode, []byte("base"), 0)
+		require.NoError(t, err)
+		err = kbfsOps1.Sync(ctx, fileNode)
+		require.NoError(t, err)
+		fileNodes1 = append(fileNodes1, fileNode)
+	}
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb2 := rootNode2.GetFolderBranch()
+	c, err := DisableUpdatesForTesting(config2, fb2)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb2)
+	require.NoError(t, err)
+
+	for i, n := range names {
+		err = kbfsOps1.Write(ctx, fileNodes1[i], []byte("THEIRS"), 0)
+		require.NoError(t, err)
+		err = kbfsOps1.Sync(ctx, fileNodes1[i])
+		require.NoError(t, err)
+		fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, n)
+		require.NoError(t, err)
+		err = kbfsOps2.Write(ctx, fileNode2, []byte("MINE"), 0)
+		require.NoError(t, err)
+		err = kbfsOps2.Sync(ctx, fileNode2)
+		require.NoError(t, err)
+	}
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb2)
+	require.NoError(t, err)
+
+	// A choice for only one of the files doesn't release the
+	// branch.
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "a", ConflictKeepTheirs)
+	require.NoError(t, err)
+	func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		err := kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+		require.Equal(t, context.DeadlineExceeded, err)
+	}()
+
+	err = kbfsOps2.SetConflictChoice(ctx, fb2, "b", ConflictKeepMine)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+	require.NoError(t, err)
+	for n, expected := range map[string]string{
+		"a": "THEIRS", "b": "MINE"} {
+		fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, n)
+		require.NoError(t, err)
+		txnTestCheckData(ctx, t, kbfsOps2, fileNode2, []byte(expected))
+	}
+}
+
 // Tests that two users can create the same file simultaneously, and
 // the unmerged user can write to it, and they will be merged into a
 // single file.
@@ -2058,3 +2606,532 @@ func TestUnmergedPutAfterCanceledUnmergedPut(t *testing.T) {
 		}
 	}
 }
+
+// Tests that two users can make independent changes to a directory
+// that's split across multiple blocks, and conflict resolution will
+// merge them correctly.
+func TestBasicCRNoConflictIndirectDir(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	config1.maxDirBlockBytes = 1024
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.maxDirBlockBytes = 1024
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 makes a big directory in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	const numEntries = 40
+	for i := 0; i < numEntries; i++ {
+		_, _, err = kbfsOps1.CreateFile(
+			ctx, dirA1, fmt.Sprintf("file%03d", i), false, NoExcl)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup dir: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 removes some entries and adds a new one
+	for i := 0; i < 10; i++ {
+		err = kbfsOps1.RemoveEntry(ctx, dirA1, fmt.Sprintf("file%03d", i))
+		if err != nil {
+			t.Fatalf("Couldn't remove file: %v", err)
+		}
+	}
+	_, _, err = kbfsOps1.CreateFile(ctx, dirA1, "new1", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// User 2 adds different entries at the end
+	for i := numEntries; i < numEntries+10; i++ {
+		_, _, err = kbfsOps2.CreateFile(
+			ctx, dirA2, fmt.Sprintf("file%03d", i), false, NoExcl)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Make sure they both see the same set of children
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirA1)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if g, e := len(children1), numEntries+1; g != e {
+		t.Errorf("Wrong number of children: %d vs %d", g, e)
+	}
+	if _, ok := children1["new1"]; !ok {
+		t.Errorf("Couldn't find child new1")
+	}
+	if !reflect.DeepEqual(children1, children2) {
+		t.Fatalf("Users 1 and 2 see different children: %v vs %v",
+			children1, children2)
+	}
+}
+
+// Tests that extended attributes set on the unmerged branch are
+// resolved correctly, both when the merged branch changed the same
+// file and when it set conflicting attributes on the same directory.
+func TestBasicCRUnmergedXattrs(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file and a dir in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirB1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	dirB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 writes the file and sets an xattr on the dir
+	err = kbfsOps1.Write(ctx, fileA1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileA1)
+	require.NoError(t, err)
+	err = kbfsOps1.SetXattr(ctx, dirB1, "user.merged", []byte("m"),
+		XattrSetAny)
+	require.NoError(t, err)
+
+	// User 2 sets xattrs on both
+	err = kbfsOps2.SetXattr(ctx, fileA2, "user.unmerged", []byte("u"),
+		XattrSetAny)
+	require.NoError(t, err)
+	err = kbfsOps2.SetXattr(ctx, dirB2, "user.unmerged", []byte("u"),
+		XattrSetAny)
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	for _, config := range []*ConfigLocal{config1, config2} {
+		kbfsOps := config.KBFSOps()
+		rootNode := GetRootNodeOrBust(ctx, t, config, name, false)
+		fileA, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		require.NoError(t, err)
+		value, err := kbfsOps.GetXattr(ctx, fileA, "user.unmerged")
+		require.NoError(t, err)
+		require.Equal(t, []byte("u"), value)
+		ei, err := kbfsOps.Stat(ctx, fileA)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), ei.Size)
+
+		// Like with mtimes, the merged change to the directory wins,
+		// and the unmerged one is left as a conflict symlink.
+		dirB, _, err := kbfsOps.Lookup(ctx, rootNode, "b")
+		require.NoError(t, err)
+		value, err = kbfsOps.GetXattr(ctx, dirB, "user.merged")
+		require.NoError(t, err)
+		require.Equal(t, []byte("m"), value)
+		_, err = kbfsOps.GetXattr(ctx, dirB, "user.unmerged")
+		require.Equal(t, NoSuchXattrError{"user.unmerged"}, err)
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		require.NoError(t, err)
+		require.Len(t, children, 3)
+	}
+}
+
+// Tests that an unmerged hard link creation survives conflict
+// resolution.
+func TestBasicCRUnmergedHardLink(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file and a dir in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileA1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileA1)
+	require.NoError(t, err)
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	dirB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 makes an unrelated change
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "c", false, NoExcl)
+	require.NoError(t, err)
+
+	// User 2 links the file into the dir
+	_, err = kbfsOps2.CreateHardLink(ctx, fileA2, dirB2, "l")
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	for _, config := range []*ConfigLocal{config1, config2} {
+		kbfsOps := config.KBFSOps()
+		rootNode := GetRootNodeOrBust(ctx, t, config, name, false)
+		fileA, ei, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		require.NoError(t, err)
+		require.Equal(t, uint32(2), ei.Nlink)
+		dirB, _, err := kbfsOps.Lookup(ctx, rootNode, "b")
+		require.NoError(t, err)
+		link, ei, err := kbfsOps.Lookup(ctx, dirB, "l")
+		require.NoError(t, err)
+		require.Equal(t, fileA, link)
+		require.Equal(t, uint64(3), ei.Size)
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		require.NoError(t, err)
+		require.Len(t, children, 3)
+	}
+}
+
+// Tests that the target of an unmerged hard link is re-created when
+// the merged branch removes all of its other links.
+func TestBasicCRUnmergedHardLinkMergedRemove(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file with a hard link
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirB1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps1.Write(ctx, fileA1, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileA1)
+	require.NoError(t, err)
+	_, err = kbfsOps1.CreateHardLink(ctx, fileA1, dirB1, "l")
+	require.NoError(t, err)
+
+	// look up the file on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 removes both links, and with them the target
+	err = kbfsOps1.RemoveEntry(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.RemoveEntry(ctx, dirB1, "l")
+	require.NoError(t, err)
+
+	// User 2 makes a new link to the file
+	_, err = kbfsOps2.CreateHardLink(ctx, fileA2, rootNode2, "m")
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	for _, config := range []*ConfigLocal{config1, config2} {
+		kbfsOps := config.KBFSOps()
+		rootNode := GetRootNodeOrBust(ctx, t, config, name, false)
+		_, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		require.Equal(t, NoSuchNameError{"a"}, err)
+		link, ei, err := kbfsOps.Lookup(ctx, rootNode, "m")
+		require.NoError(t, err)
+		require.Equal(t, uint32(1), ei.Nlink)
+		require.Equal(t, uint64(len(data)), ei.Size)
+		buf := make([]byte, len(data))
+		_, err = kbfsOps.Read(ctx, link, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+}
+
+// testCRMergedHardLinkUnmergedRemove tests what happens to a hard
+// link target, all of whose links were removed in the unmerged
+// branch, when the merged branch added a link to it, and then
+// possibly removed that link too.
+func testCRMergedHardLinkUnmergedRemove(t *testing.T, removeMerged bool) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file with a hard link
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirB1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	_, err = kbfsOps1.CreateHardLink(ctx, fileA1, dirB1, "l")
+	require.NoError(t, err)
+
+	// look up the links on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 makes a new link to the file
+	_, err = kbfsOps1.CreateHardLink(ctx, fileA1, rootNode1, "m")
+	require.NoError(t, err)
+	if removeMerged {
+		err = kbfsOps1.RemoveEntry(ctx, rootNode1, "m")
+		require.NoError(t, err)
+	}
+
+	// User 2 removes both of the old links
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.RemoveEntry(ctx, dirB2, "l")
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	for _, config := range []*ConfigLocal{config1, config2} {
+		kbfsOps := config.KBFSOps()
+		rootNode := GetRootNodeOrBust(ctx, t, config, name, false)
+		_, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		require.Equal(t, NoSuchNameError{"a"}, err)
+		_, ei, err := kbfsOps.Lookup(ctx, rootNode, "m")
+		if removeMerged {
+			require.Equal(t, NoSuchNameError{"m"}, err)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), ei.Nlink)
+		}
+
+		// The target only stays as long as it has links.
+		ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+		lState := makeFBOLockState()
+		rootPath := ops.nodeCache.PathFromNode(rootNode)
+		linksDe, err := ops.blocks.GetDirtyEntry(ctx, lState,
+			ops.getHead(lState), rootPath.ChildPathNoPtr(hardLinksDirName))
+		require.NoError(t, err)
+		linksBlock, err := ops.blocks.GetDirBlockForReading(ctx, lState,
+			ops.getHead(lState), linksDe.BlockPointer, rootPath.Branch,
+			rootPath.ChildPathNoPtr(hardLinksDirName))
+		require.NoError(t, err)
+		if removeMerged {
+			require.Len(t, linksBlock.Children, 0)
+		} else {
+			require.Len(t, linksBlock.Children, 1)
+		}
+	}
+}
+
+func TestCRMergedHardLinkUnmergedRemove(t *testing.T) {
+	testCRMergedHardLinkUnmergedRemove(t, false)
+}
+
+func TestCRMergedHardLinkRemovedUnmergedRemove(t *testing.T) {
+	testCRMergedHardLinkUnmergedRemove(t, true)
+}
+
+// Tests that unmerged writes to a file follow it after it becomes
+// the target of a merged hard link.
+func TestBasicCRMergedHardLinkUnmergedWrite(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file and a dir in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirB1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+
+	// look up the file on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 links the file into the dir
+	_, err = kbfsOps1.CreateHardLink(ctx, fileA1, dirB1, "l")
+	require.NoError(t, err)
+
+	// User 2 writes the file
+	data := []byte{1, 2, 3}
+	err = kbfsOps2.Write(ctx, fileA2, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileA2)
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	for _, config := range []*ConfigLocal{config1, config2} {
+		kbfsOps := config.KBFSOps()
+		rootNode := GetRootNodeOrBust(ctx, t, config, name, false)
+		fileA, ei, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		require.NoError(t, err)
+		require.Equal(t, uint32(2), ei.Nlink)
+		require.Equal(t, uint64(len(data)), ei.Size)
+		dirB, _, err := kbfsOps.Lookup(ctx, rootNode, "b")
+		require.NoError(t, err)
+		link, _, err := kbfsOps.Lookup(ctx, dirB, "l")
+		require.NoError(t, err)
+		require.Equal(t, fileA, link)
+		buf := make([]byte, len(data))
+		_, err = kbfsOps.Read(ctx, link, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+}
@@ -27,6 +27,18 @@ type KBFSOpsStandard struct {
 	ops      map[FolderBranch]*folderBranchOps
 	opsByFav map[Favorite]*folderBranchOps
 	opsLock  sync.RWMutex
+	// mdOffline is true when the MD server can't be reached, and
+	// all the ops are in offline mode.  Protected by opsLock.
+	mdOffline bool
+	// mdStatusLock serializes MD server connection changes, so that
+	// the ops are moved between modes in the same order as the
+	// changes, without holding opsLock while they are.
+	mdStatusLock sync.Mutex
+	// archivedOps tracks the use of each archived folder-branch in
+	// ops, so the least recently opened ones can be shut down.
+	// Protected by opsLock.
+	archivedOps      map[FolderBranch]*archivedOpsEntry
+	archivedOpsOpens uint64
 	// reIdentifyControlChan controls reidentification.
 	// Sending a value to this channel forces all fbos
 	// to be marked for revalidation.
@@ -41,6 +53,19 @@ type KBFSOpsStandard struct {
 
 var _ KBFSOps = (*KBFSOpsStandard)(nil)
 
+// maxArchivedFolderBranches is the number of archived folder-branches
+// past which the least recently opened ones are shut down, once none
+// of their nodes are in use.
+const maxArchivedFolderBranches = 16
+
+type archivedOpsEntry struct {
+	// lastOpen orders the archived folder-branches by when their
+	// root node was last asked for.
+	lastOpen uint64
+	// opening is the number of root node lookups in progress.
+	opening int
+}
+
 // NewKBFSOpsStandard constructs a new KBFSOpsStandard object.
 func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 	log := config.MakeLogger("")
@@ -50,6 +75,7 @@ func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 		deferLog:              log.CloneWithAddedDepth(1),
 		ops:                   make(map[FolderBranch]*folderBranchOps),
 		opsByFav:              make(map[Favorite]*folderBranchOps),
+		archivedOps:           make(map[FolderBranch]*archivedOpsEntry),
 		reIdentifyControlChan: make(chan chan<- struct{}),
 		favs: NewFavorites(config),
 	}
@@ -127,6 +153,39 @@ func (fs *KBFSOpsStandard) Shutdown() error {
 func (fs *KBFSOpsStandard) PushConnectionStatusChange(
 	service string, newStatus error) {
 	fs.currentStatus.PushConnectionStatusChange(service, newStatus)
+	if service != MDServiceName {
+		return
+	}
+
+	// Move all the folder-branches between the online and offline
+	// modes along with the MD server connection.
+	goOffline := newStatus != nil
+	fs.mdStatusLock.Lock()
+	defer fs.mdStatusLock.Unlock()
+	// Any ops made after the snapshot pick up the new mode
+	// themselves (see getOpsNoAddLocked).
+	opses := func() []*folderBranchOps {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		if fs.mdOffline == goOffline {
+			return nil
+		}
+		fs.mdOffline = goOffline
+		opses := make([]*folderBranchOps, 0, len(fs.ops))
+		for _, ops := range fs.ops {
+			opses = append(opses, ops)
+		}
+		return opses
+	}()
+	if opses == nil {
+		return
+	}
+	ctx := context.Background()
+	fs.log.CDebugf(ctx, "MD server connection changed (offline=%t): %v",
+		goOffline, newStatus)
+	for _, ops := range opses {
+		ops.setOffline(ctx, goOffline)
+	}
 }
 
 // PushStatusChange forces a new status be fetched by status listeners.
@@ -215,16 +274,97 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 	fs.opsLock.Lock()
 	defer fs.opsLock.Unlock()
 	// look it up again in case someone else got the lock
+	return fs.getOpsNoAddLocked(fb)
+}
+
+// opsLock must be held for writing by the caller.
+func (fs *KBFSOpsStandard) getOpsNoAddLocked(
+	fb FolderBranch) *folderBranchOps {
 	ops, ok := fs.ops[fb]
 	if !ok {
 		// TODO: add some interface for specifying the type of the
-		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(fs.config, fb, standard)
+		// branch; for now assume online, and read-write unless it's
+		// an archived revision.
+		bType := standard
+		switch {
+		case fb.Branch.IsArchived() && fs.mdOffline:
+			bType = archiveOffline
+		case fb.Branch.IsArchived():
+			bType = archive
+		case fs.mdOffline:
+			bType = offline
+		}
+		ops = newFolderBranchOps(fs.config, fb, bType)
 		fs.ops[fb] = ops
 	}
 	return ops
 }
 
+// startOpeningArchivedOps returns the ops for the given archived
+// folder-branch, marking it as the most recently opened one, and
+// shuts down the least recently opened ones past
+// maxArchivedFolderBranches that have no nodes in use.  The caller
+// must call doneOpeningArchivedOps once it has the root node, so
+// the returned ops can't be shut down before then.
+func (fs *KBFSOpsStandard) startOpeningArchivedOps(
+	ctx context.Context, fb FolderBranch) *folderBranchOps {
+	var ops *folderBranchOps
+	var evicted []*folderBranchOps
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		ops = fs.getOpsNoAddLocked(fb)
+		entry, ok := fs.archivedOps[fb]
+		if !ok {
+			entry = &archivedOpsEntry{}
+			fs.archivedOps[fb] = entry
+		}
+		fs.archivedOpsOpens++
+		entry.lastOpen = fs.archivedOpsOpens
+		entry.opening++
+
+		for len(fs.archivedOps) > maxArchivedFolderBranches {
+			var oldest FolderBranch
+			var oldestEntry *archivedOpsEntry
+			for archivedFB, e := range fs.archivedOps {
+				if e.opening > 0 || fs.ops[archivedFB].hasNodes() {
+					continue
+				}
+				if oldestEntry == nil || e.lastOpen < oldestEntry.lastOpen {
+					oldest, oldestEntry = archivedFB, e
+				}
+			}
+			if oldestEntry == nil {
+				// They're all in use.
+				break
+			}
+			evicted = append(evicted, fs.ops[oldest])
+			delete(fs.ops, oldest)
+			delete(fs.archivedOps, oldest)
+		}
+	}()
+
+	for _, oldOps := range evicted {
+		fs.log.CDebugf(ctx, "Shutting down archived folder-branch %s",
+			oldOps.folderBranch)
+		if err := oldOps.Shutdown(); err != nil {
+			fs.log.CDebugf(ctx, "Couldn't shut down %s: %v",
+				oldOps.folderBranch, err)
+		}
+	}
+	return ops
+}
+
+// doneOpeningArchivedOps undoes the in-progress mark set by
+// startOpeningArchivedOps.
+func (fs *KBFSOpsStandard) doneOpeningArchivedOps(fb FolderBranch) {
+	fs.opsLock.Lock()
+	defer fs.opsLock.Unlock()
+	if entry, ok := fs.archivedOps[fb]; ok {
+		entry.opening--
+	}
+}
+
 func (fs *KBFSOpsStandard) getOps(
 	ctx context.Context, fb FolderBranch) *folderBranchOps {
 	ops := fs.getOpsNoAdd(fb)
@@ -363,6 +503,34 @@ func (fs *KBFSOpsStandard) GetTLFID(ctx context.Context,
 	return rmd.TlfID(), err
 }
 
+// getLoadedRootNodeIfOffline returns the root node of the given
+// folder-branch, if the MD server is unreachable and the folder
+// already has a head loaded locally (e.g., from its journal).
+func (fs *KBFSOpsStandard) getLoadedRootNodeIfOffline(
+	ctx context.Context, h *TlfHandle, branch BranchName) (
+	node Node, ei EntryInfo, ok bool) {
+	ops := func() *folderBranchOps {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		if !fs.mdOffline {
+			return nil
+		}
+		return fs.opsByFav[h.ToFavorite()]
+	}()
+	if ops == nil || ops.branch() != branch ||
+		ops.getHead(makeFBOLockState()) == (ImmutableRootMetadata{}) {
+		return nil, EntryInfo{}, false
+	}
+
+	node, ei, _, err := ops.getRootNode(ctx)
+	if err != nil {
+		fs.log.CDebugf(ctx, "Couldn't get loaded root node while "+
+			"offline: %v", err)
+		return nil, EntryInfo{}, false
+	}
+	return node, ei, true
+}
+
 // getMaybeCreateRootNode is called for GetOrCreateRootNode and GetRootNode.
 func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 	ctx context.Context, h *TlfHandle, branch BranchName, create bool) (
@@ -371,6 +539,12 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 		h.GetCanonicalPath(), branch, create)
 	defer func() { fs.deferLog.CDebugf(ctx, "Done: %#v", err) }()
 
+	// While offline, a folder that's already loaded can be served
+	// from its local state without asking the server.
+	if node, ei, ok := fs.getLoadedRootNodeIfOffline(ctx, h, branch); ok {
+		return node, ei, nil
+	}
+
 	// Do GetForHandle() unlocked -- no cache lookups, should be fine
 	mdops := fs.config.MDOps()
 	// TODO: only do this the first time, cache the folder ID after that
@@ -476,6 +650,117 @@ func (fs *KBFSOpsStandard) GetRootNode(
 	return fs.getMaybeCreateRootNode(ctx, h, branch, false)
 }
 
+// getMergedHeadForArchive returns the current merged head for the
+// given TLF, which must exist and be readable.
+func (fs *KBFSOpsStandard) getMergedHeadForArchive(
+	ctx context.Context, h *TlfHandle) (ImmutableRootMetadata, error) {
+	id, md, err := fs.config.MDOps().GetForHandle(ctx, h, Merged)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	if md == (ImmutableRootMetadata{}) {
+		return ImmutableRootMetadata{}, NoSuchMDError{
+			id, MetadataRevisionUninitialized, NullBranchID}
+	}
+	if err := isReadableOrError(ctx, fs.config, md.ReadOnly()); err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	return md, nil
+}
+
+// getRootNodeAtRevision returns the root node of an archived,
+// read-only view of the TLF at the given revision, which must not be
+// after the given merged head.
+func (fs *KBFSOpsStandard) getRootNodeAtRevision(ctx context.Context,
+	head ImmutableRootMetadata, rev MetadataRevision) (
+	node Node, ei EntryInfo, err error) {
+	id := head.TlfID()
+	if rev < MetadataRevisionInitial || rev > head.Revision() {
+		return nil, EntryInfo{}, NoSuchMDError{id, rev, NullBranchID}
+	}
+
+	md := head
+	if rev != head.Revision() {
+		md, err = getSingleMD(ctx, fs.config, id, NullBranchID, rev, Merged)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+
+	// Archived branches are deliberately not added to the favorites.
+	fb := FolderBranch{id, MakeRevBranchName(rev)}
+	ops := fs.startOpeningArchivedOps(ctx, fb)
+	defer fs.doneOpeningArchivedOps(fb)
+	err = ops.SetInitialHeadFromServer(ctx, md)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	node, ei, _, err = ops.getRootNode(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return node, ei, nil
+}
+
+// GetRootNodeAtRevision implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetRootNodeAtRevision(
+	ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+	node Node, ei EntryInfo, err error) {
+	fs.log.CDebugf(ctx, "GetRootNodeAtRevision(%s, %d)",
+		h.GetCanonicalPath(), rev)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	head, err := fs.getMergedHeadForArchive(ctx, h)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return fs.getRootNodeAtRevision(ctx, head, rev)
+}
+
+// GetRootNodeAtTime implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetRootNodeAtTime(
+	ctx context.Context, h *TlfHandle, t time.Time) (
+	node Node, ei EntryInfo, err error) {
+	fs.log.CDebugf(ctx, "GetRootNodeAtTime(%s, %s)",
+		h.GetCanonicalPath(), t)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	head, err := fs.getMergedHeadForArchive(ctx, h)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	// Binary search for the first revision written after t; the
+	// revision before that one is the one that was current at t.
+	// The MD timestamps come from the server, but they're only used
+	// to pick a revision, so trusting them is fine.
+	lo, hi := MetadataRevisionInitial, head.Revision()+1
+	if !head.localTimestamp.After(t) {
+		lo = hi
+	}
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		md, err := getSingleMD(
+			ctx, fs.config, head.TlfID(), NullBranchID, mid, Merged)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		if md.localTimestamp.After(t) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if lo == MetadataRevisionInitial {
+		return nil, EntryInfo{}, NoSuchMDError{
+			head.TlfID(), MetadataRevisionUninitialized, NullBranchID}
+	}
+	return fs.getRootNodeAtRevision(ctx, head, lo-1)
+}
+
 // GetDirChildren implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
 	map[string]EntryInfo, error) {
@@ -520,6 +805,22 @@ func (fs *KBFSOpsStandard) CreateLink(
 	return ops.CreateLink(ctx, dir, fromName, toPath)
 }
 
+// CreateHardLink implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateHardLink(
+	ctx context.Context, file Node, dir Node, name string) (
+	EntryInfo, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreateHardLink(ctx, file, dir, name)
+}
+
+// CopyFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFile(
+	ctx context.Context, file Node, dir Node, name string) (
+	Node, EntryInfo, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CopyFile(ctx, file, dir, name)
+}
+
 // RemoveDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveDir(
 	ctx context.Context, dir Node, name string) error {
@@ -586,6 +887,34 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// GetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetXattr(
+	ctx context.Context, node Node, name string) ([]byte, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetXattr(ctx, node, name)
+}
+
+// ListXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ListXattr(
+	ctx context.Context, node Node) ([]string, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.ListXattr(ctx, node)
+}
+
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(ctx context.Context, node Node,
+	name string, value []byte, flag XattrSetFlag) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetXattr(ctx, node, name, value, flag)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.RemoveXattr(ctx, node, name)
+}
+
 // Sync implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) error {
 	ops := fs.getOpsByNode(ctx, file)
@@ -641,6 +970,7 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		LimitBytes:      limitBytes,
 		FailingServices: failures,
 		JournalServer:   jServerStatus,
+		TuningConfig:    fs.config.TuningConfig(),
 	}, ch, err
 }
 
@@ -652,6 +982,46 @@ func (fs *KBFSOpsStandard) UnstageForTesting(
 	return ops.UnstageForTesting(ctx, folderBranch)
 }
 
+// GetUnmergedChanges implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetUnmergedChanges(ctx context.Context,
+	folderBranch FolderBranch) ([]UnmergedChange, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetUnmergedChanges(ctx, folderBranch)
+}
+
+// SetConflictChoice implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetConflictChoice(ctx context.Context,
+	folderBranch FolderBranch, path string, choice ConflictChoice) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.SetConflictChoice(ctx, folderBranch, path, choice)
+}
+
+// BeginTransaction implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) BeginTransaction(ctx context.Context,
+	folderBranch FolderBranch) (context.Context, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.BeginTransaction(ctx, folderBranch)
+}
+
+// CommitTransaction implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) CommitTransaction(ctx context.Context,
+	folderBranch FolderBranch) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.CommitTransaction(ctx, folderBranch)
+}
+
+// AbortTransaction implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) AbortTransaction(ctx context.Context,
+	folderBranch FolderBranch) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.AbortTransaction(ctx, folderBranch)
+}
+
 // Rekey implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Rekey(ctx context.Context, id tlf.ID) error {
 	// We currently only support rekeys of master branches.
@@ -680,6 +1050,14 @@ func (fs *KBFSOpsStandard) GetEditHistory(ctx context.Context,
 	return ops.GetEditHistory(ctx, folderBranch)
 }
 
+// GetChanges implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetChanges(ctx context.Context,
+	folderBranch FolderBranch, since MetadataRevision) (
+	changes []TlfChange, latest MetadataRevision, err error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetChanges(ctx, folderBranch, since)
+}
+
 // GetNodeMetadata implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetNodeMetadata(ctx context.Context, node Node) (
 	NodeMetadata, error) {
@@ -687,6 +1065,35 @@ func (fs *KBFSOpsStandard) GetNodeMetadata(ctx context.Context, node Node) (
 	return ops.GetNodeMetadata(ctx, node)
 }
 
+// GetFileHistory implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetFileHistory(ctx context.Context, file Node) (
+	versions []FileVersion, err error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetFileHistory(ctx, file)
+}
+
+// RestoreFileVersion implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RestoreFileVersion(
+	ctx context.Context, file Node, rev MetadataRevision) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.RestoreFileVersion(ctx, file, rev)
+}
+
+// GetTrash implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetTrash(ctx context.Context,
+	folderBranch FolderBranch) ([]TrashEntry, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetTrash(ctx, folderBranch)
+}
+
+// Restore implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Restore(ctx context.Context,
+	folderBranch FolderBranch, name string) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.Restore(ctx, folderBranch, name)
+}
+
 // Notifier:
 var _ Notifier = (*KBFSOpsStandard)(nil)
 
@@ -245,13 +245,15 @@ func testKBFSOpsConcurWritesDuringSync(t *testing.T,
 
 	// there should be 4+n clean blocks at this point: the original
 	// root block + 2 modifications (create + write), the empty file
-	// block, the n initial modification blocks plus top block (if
-	// applicable).
+	// block, the n initial modification blocks plus the indirect
+	// blocks above them (if applicable).
 	bcs := config.BlockCache().(*BlockCacheStandard)
 	numCleanBlocks := bcs.cleanTransient.Len()
 	nFileBlocks := 1 + len(data)/int(bsplitter.maxSize)
-	if nFileBlocks > 1 {
-		nFileBlocks++ // top indirect block
+	maxPtrs := bsplitter.MaxPtrsPerBlock()
+	for n := nFileBlocks; n > 1; {
+		n = (n + maxPtrs - 1) / maxPtrs // the next level of indirection
+		nFileBlocks += n
 	}
 	if g, e := numCleanBlocks, 4+nFileBlocks; g != e {
 		t.Errorf("Unexpected number of cached clean blocks: %d vs %d (%d vs %d)\n", g, e, totalSize, bsplitter.maxSize)
@@ -1263,7 +1265,7 @@ func TestKBFSOpsMultiBlockWriteWithRetryAndError(t *testing.T) {
 	oldBServer := config.BlockServer()
 	defer config.SetBlockServer(oldBServer)
 	onSyncStalledCh, syncUnstallCh, ctxStallSync :=
-		StallBlockOp(ctx, config, StallableBlockPut, 7)
+		StallBlockOp(ctx, config, StallableBlockPut, 8)
 	ctxStallSync, cancel2 := context.WithCancel(ctxStallSync)
 
 	// create and write to a file
@@ -1335,7 +1337,7 @@ func TestKBFSOpsMultiBlockWriteWithRetryAndError(t *testing.T) {
 	syncUnstallCh <- struct{}{}
 
 	// Wait for the rest of the first set of  block to finish (before the retry)
-	for i := 0; i < 5; i++ {
+	for i := 0; i < 6; i++ {
 		<-onSyncStalledCh
 		syncUnstallCh <- struct{}{}
 	}
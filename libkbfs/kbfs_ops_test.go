@@ -9,6 +9,8 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,6 +24,7 @@ import (
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/net/context"
 )
 
@@ -620,6 +623,7 @@ func makeIFP(id BlockID, kmd KeyMetadata, config Config,
 		},
 		off,
 		false,
+		false,
 		codec.UnknownFieldSetHandler{},
 	}
 }
@@ -5604,3 +5608,1041 @@ func TestKBFSOpsMaliciousMDServerRange(t *testing.T) {
 	// have MDOps do the handle check, that'll trigger first.
 	require.IsType(t, MDPrevRootMismatch{}, err)
 }
+
+func TestKBFSOpsIndirectDir(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.maxDirBlockBytes = 1024
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+
+	// Make enough entries that the directory is split.
+	const numEntries = 50
+	for i := 0; i < numEntries; i++ {
+		_, _, err := kbfsOps.CreateFile(
+			ctx, dirNode, fmt.Sprintf("file%03d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	ei, err := kbfsOps.Stat(ctx, dirNode)
+	require.NoError(t, err)
+	require.True(t, ei.Size > 1024)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	dirPtr := ops.nodeCache.PathFromNode(dirNode).tailPointer()
+	require.Equal(t, IndirectDirsDataVer, dirPtr.DataVer)
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, numEntries)
+
+	// A new entry only makes a new child block for its own range,
+	// besides the block of the new file.
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "file999", false, NoExcl)
+	require.NoError(t, err)
+	head := ops.getHead(makeFBOLockState())
+	require.Len(t, head.data.Changes.Ops[0].Refs(), 2)
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "file999")
+	require.NoError(t, err)
+
+	// Another device should see all the entries.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.maxDirBlockBytes = 1024
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	children, err = kbfsOps2.GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children, numEntries)
+	_, _, err = kbfsOps2.Lookup(ctx, dirNode2, "file042")
+	require.NoError(t, err)
+
+	// Removing most of the entries collapses it back to a single
+	// block.
+	for i := 1; i < numEntries; i++ {
+		err := kbfsOps.RemoveEntry(ctx, dirNode, fmt.Sprintf("file%03d", i))
+		require.NoError(t, err)
+	}
+	dirPtr = ops.nodeCache.PathFromNode(dirNode).tailPointer()
+	require.Equal(t, FirstValidDataVer, dirPtr.DataVer)
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	children, err = kbfsOps2.GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+}
+
+func TestKBFSOpsXattrs(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+
+	names, err := kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, names, 0)
+	_, err = kbfsOps.GetXattr(ctx, fileNode, "user.x")
+	require.Equal(t, NoSuchXattrError{"user.x"}, err)
+
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.x", []byte("1"), XattrSetAny)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.a", []byte("2"), XattrCreate)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, dirNode, "user.d", []byte("3"), XattrSetAny)
+	require.NoError(t, err)
+
+	// Check the create and replace flags.
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.a", []byte("4"), XattrCreate)
+	require.Equal(t, XattrExistsError{"user.a"}, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.b", []byte("4"), XattrReplace)
+	require.Equal(t, NoSuchXattrError{"user.b"}, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.a", []byte("5"), XattrReplace)
+	require.NoError(t, err)
+
+	// Check the limits.
+	longName := strings.Repeat("n", maxXattrNameBytes+1)
+	err = kbfsOps.SetXattr(ctx, fileNode, longName, nil, XattrSetAny)
+	require.IsType(t, XattrNameTooLongError{}, err)
+	bigValue := make([]byte, maxXattrsBytes)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.big", bigValue, XattrSetAny)
+	require.IsType(t, XattrsTooBigError{}, err)
+
+	names, err = kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.a", "user.x"}, names)
+	value, err := kbfsOps.GetXattr(ctx, fileNode, "user.a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("5"), value)
+
+	// Another device should see the same attributes.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	value, err = kbfsOps2.GetXattr(ctx, fileNode2, "user.x")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	value, err = kbfsOps2.GetXattr(ctx, dirNode2, "user.d")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.x")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.x")
+	require.Equal(t, NoSuchXattrError{"user.x"}, err)
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	names, err = kbfsOps2.ListXattr(ctx, fileNode2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.a"}, names)
+}
+
+func TestKBFSOpsHardLinks(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// The first link makes the hard links directory and moves the
+	// file into it, all in the same revision as the link itself.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	rev := ops.getCurrMDRevision(lState)
+	ei, err := kbfsOps.CreateHardLink(ctx, fileNode, dirNode, "c")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), ei.Nlink)
+	require.Equal(t, rev+1, ops.getCurrMDRevision(lState))
+	_, err = kbfsOps.CreateHardLink(ctx, fileNode, dirNode, "c")
+	require.Equal(t, NameExistsError{"c"}, err)
+	_, err = kbfsOps.CreateHardLink(ctx, dirNode, rootNode, "d")
+	require.IsType(t, NotFileError{}, err)
+
+	// Both names lead to the same node and contents.
+	linkNode, ei, err := kbfsOps.Lookup(ctx, dirNode, "c")
+	require.NoError(t, err)
+	require.Equal(t, fileNode, linkNode)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	require.Equal(t, uint32(2), ei.Nlink)
+	origNode, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	require.Equal(t, fileNode, origNode)
+
+	// The hard links directory stays hidden.
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, hardLinksDirName)
+	require.Equal(t, NoSuchNameError{hardLinksDirName}, err)
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Equal(t, File, children["c"].Type)
+	require.Equal(t, uint64(len(data)), children["c"].Size)
+
+	// Writes through one name are visible through the other, even
+	// from another device.
+	data2 := []byte{4, 5, 6, 7}
+	err = kbfsOps.Write(ctx, linkNode, data2, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, linkNode)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	linkNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "c")
+	require.NoError(t, err)
+	require.Equal(t, fileNode2, linkNode2)
+	buf := make([]byte, len(data2))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data2)), n)
+	require.Equal(t, data2, buf)
+
+	// Removing one name leaves the file reachable through the other.
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, ei, err = kbfsOps.Lookup(ctx, dirNode, "c")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), ei.Nlink)
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.Equal(t, NoSuchNameError{"a"}, err)
+	n, err = kbfsOps2.Read(ctx, linkNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+
+	// Removing the last name removes the target too.
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "c")
+	require.NoError(t, err)
+	rootPath := ops.nodeCache.PathFromNode(rootNode)
+	linksDe, err := ops.blocks.GetDirtyEntry(ctx, lState, ops.getHead(lState),
+		rootPath.ChildPathNoPtr(hardLinksDirName))
+	require.NoError(t, err)
+	linksBlock, err := ops.blocks.GetDirBlockForReading(ctx, lState,
+		ops.getHead(lState), linksDe.BlockPointer, rootPath.Branch,
+		rootPath.ChildPathNoPtr(hardLinksDirName))
+	require.NoError(t, err)
+	require.Len(t, linksBlock.Children, 0)
+}
+
+func TestKBFSOpsCDCBlockSplitterInterop(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Start with a file split into small fixed-size blocks.
+	config.SetBlockSplitter(&BlockSplitterSimple{1024, 8 * 1024})
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := makeTestCDCData(1, 16*1024)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	checkContents := func(expected []byte) {
+		err := config2.KBFSOps().SyncFromServerForTesting(
+			ctx, rootNode2.GetFolderBranch())
+		require.NoError(t, err)
+		buf := make([]byte, len(expected)+1)
+		n, err := config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:n])
+	}
+
+	// Switch to content-defined blocks and shift the whole file
+	// over by one byte.
+	bsplit, err := newBlockSplitterCDC(64, 256, 1024, 8*1024)
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+	data = append([]byte{0xff}, data...)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	checkContents(data)
+
+	// Then back again, overwriting the middle of the file.
+	config.SetBlockSplitter(&BlockSplitterSimple{1024, 8 * 1024})
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 5000)
+	require.NoError(t, err)
+	copy(data[5000:], []byte{1, 2, 3})
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	checkContents(data)
+}
+
+func TestKBFSOpsMerkleVerification(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	src := NewMerkleSourceMemory(config.Codec(), config.Crypto())
+	config.SetMerkleSource(src)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	id := rootNode.GetFolderBranch().Tlf
+
+	// Make a leaf out of the current head.
+	setLeafToHead := func() MerkleLeaf {
+		rmds, err := config.MDServer().GetForTLF(
+			ctx, id, NullBranchID, Merged)
+		require.NoError(t, err)
+		hash, err := config.Crypto().MakeMerkleHash(rmds)
+		require.NoError(t, err)
+		head, err := config.MDOps().GetForTLF(ctx, id)
+		require.NoError(t, err)
+		// The TLF public key is the curve25519 public half of
+		// the head's TLF private key.
+		privKeyData := head.data.TLFPrivateKey.Data()
+		var pubKeyData [32]byte
+		curve25519.ScalarBaseMult(&pubKeyData, &privKeyData)
+		pubKey := kbfscrypto.MakeTLFPublicKey(pubKeyData)
+		leaf := MerkleLeaf{
+			Revision: rmds.MD.RevisionNumber(),
+			Hash:     hash,
+		}
+		err = src.SetLeaf(id, leaf, pubKey)
+		require.NoError(t, err)
+		return leaf
+	}
+	leaf := setLeafToHead()
+
+	// Another device can read the verified head.  Its background
+	// updates are turned off, so that only the fetches below are
+	// verified against the leaves they're meant for.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	_, err = DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// A head newer than the leaf is verified through the leaf's
+	// revision.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	_, err = config2.MDOps().GetForTLF(ctx, id)
+	require.NoError(t, err)
+
+	// A head older than the leaf is a rollback.
+	newLeaf := setLeafToHead()
+	headRev := newLeaf.Revision
+	pubKey := src.leaves[id].pubKey
+	err = src.SetLeaf(id, MerkleLeaf{
+		Revision: headRev + 1,
+		Hash:     newLeaf.Hash,
+	}, pubKey)
+	require.NoError(t, err)
+	_, err = config2.MDOps().GetForTLF(ctx, id)
+	require.Equal(t, MDRollbackError{id, headRev, headRev + 1}, err)
+
+	// A head with the wrong hash is a fork.
+	err = src.SetLeaf(id, MerkleLeaf{
+		Revision: headRev,
+		Hash:     leaf.Hash,
+	}, pubKey)
+	require.NoError(t, err)
+	_, err = config2.MDOps().GetForTLF(ctx, id)
+	require.IsType(t, MDForkError{}, err)
+
+	// A leaf that the head's keys can't decrypt isn't trusted
+	// either.
+	otherPubKey, _, _, _, _, err := config.Crypto().MakeRandomTLFKeys()
+	require.NoError(t, err)
+	err = src.SetLeaf(id, newLeaf, otherPubKey)
+	require.NoError(t, err)
+	_, err = config2.MDOps().GetForTLF(ctx, id)
+	require.Equal(t, MDRollbackError{
+		id, headRev, MetadataRevisionUninitialized}, err)
+
+	// All the errors were reported.
+	reported := config2.Reporter().AllKnownErrors()
+	require.Len(t, reported, 3)
+	require.IsType(t, MDRollbackError{}, reported[0].Error)
+	require.IsType(t, MDForkError{}, reported[1].Error)
+	require.IsType(t, MDRollbackError{}, reported[2].Error)
+}
+
+func TestKBFSOpsMerkleVerificationPublicMissingHead(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	src := NewMerkleSourceMemory(config.Codec(), config.Crypto())
+	config.SetMerkleSource(src)
+
+	// Get the ID the server assigned to a new public TLF, and pretend
+	// the Merkle tree has seen MD for it.
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", true)
+	require.NoError(t, err)
+	bh, err := h.ToBareHandle()
+	require.NoError(t, err)
+	id, _, err := config.MDServer().GetForHandle(ctx, bh, Merged)
+	require.NoError(t, err)
+	err = src.SetLeaf(id, MerkleLeaf{Revision: MetadataRevisionInitial},
+		kbfscrypto.TLFPublicKey{})
+	require.NoError(t, err)
+
+	_, _, err = config.MDOps().GetForHandle(ctx, h, Merged)
+	require.Equal(t, MDRollbackError{
+		id, MetadataRevisionUninitialized, MetadataRevisionUninitialized},
+		err)
+}
+
+// Tests that a leaf encrypted with the key of an older key
+// generation than the head's can still be read.
+func TestKBFSOpsMerkleVerificationOldKeyGen(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	src := NewMerkleSourceMemory(config.Codec(), config.Crypto())
+	config.SetMerkleSource(src)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	id := rootNode.GetFolderBranch().Tlf
+
+	rmds, err := config.MDServer().GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	hash, err := config.Crypto().MakeMerkleHash(rmds)
+	require.NoError(t, err)
+	head, err := config.MDOps().GetForTLF(ctx, id)
+	require.NoError(t, err)
+	oldKeyGen := head.LatestKeyGeneration()
+	privKeyData := head.data.TLFPrivateKey.Data()
+	var pubKeyData [32]byte
+	curve25519.ScalarBaseMult(&pubKeyData, &privKeyData)
+	leaf := MerkleLeaf{
+		Revision: rmds.MD.RevisionNumber(),
+		Hash:     hash,
+	}
+	err = src.SetLeaf(id, leaf, kbfscrypto.MakeTLFPublicKey(pubKeyData))
+	require.NoError(t, err)
+
+	// Make a new key generation by adding a device and then
+	// revoking it.
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	devIndex := AddDeviceForLocalUserOrBust(t, config, uid)
+	err = kbfsOps.Rekey(ctx, id)
+	require.NoError(t, err)
+	RevokeDeviceForLocalUserOrBust(t, config, uid, devIndex)
+	err = kbfsOps.Rekey(ctx, id)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	head, err = config.MDOps().GetForTLF(ctx, id)
+	require.NoError(t, err)
+	require.True(t, head.LatestKeyGeneration() > oldKeyGen)
+	require.True(t, head.Revision() > leaf.Revision)
+
+	// The old key was remembered, so the history doesn't have to be
+	// walked again next time.
+	keys := config.MDOps().(*MDOpsStandard).getMerkleLeafKeys(id)
+	require.Contains(t, keys, oldKeyGen)
+}
+
+// Tests that a TLF the server has no MD for is checked for a Merkle
+// leaf when looked up by ID.
+func TestKBFSOpsMerkleVerificationMissingHeadByID(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	src := NewMerkleSourceMemory(config.Codec(), config.Crypto())
+	config.SetMerkleSource(src)
+
+	id := tlf.FakeID(1, true)
+	head, err := config.MDOps().GetForTLF(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, ImmutableRootMetadata{}, head)
+
+	err = src.SetLeaf(id, MerkleLeaf{Revision: MetadataRevisionInitial},
+		kbfscrypto.TLFPublicKey{})
+	require.NoError(t, err)
+	_, err = config.MDOps().GetForTLF(ctx, id)
+	require.Equal(t, MDRollbackError{
+		id, MetadataRevisionUninitialized, MetadataRevisionUninitialized},
+		err)
+}
+
+func TestKBFSOpsGetRootNodeAtRevision(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("old"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	oldRev := ops.getCurrMDRevision(makeFBOLockState())
+	oldTime := clock.Now()
+
+	clock.Add(time.Minute)
+	err = kbfsOps.Write(ctx, fileNode, []byte("new"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	headRev := ops.getCurrMDRevision(makeFBOLockState())
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	oldRoot, _, err := kbfsOps.GetRootNodeAtRevision(ctx, h, oldRev)
+	require.NoError(t, err)
+	require.Equal(t, MakeRevBranchName(oldRev),
+		oldRoot.GetFolderBranch().Branch)
+
+	children, err := kbfsOps.GetDirChildren(ctx, oldRoot)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	oldFileNode, _, err := kbfsOps.Lookup(ctx, oldRoot, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	n, err := kbfsOps.Read(ctx, oldFileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(buf[:n]))
+
+	// The archived view can't be modified.
+	err = kbfsOps.Write(ctx, oldFileNode, []byte("bad"), 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, err)
+	_, _, err = kbfsOps.CreateDir(ctx, oldRoot, "c")
+	require.IsType(t, WriteToReadonlyNodeError{}, err)
+	err = kbfsOps.RemoveEntry(ctx, oldRoot, "a")
+	require.IsType(t, WriteToReadonlyNodeError{}, err)
+
+	// The master branch is unaffected.
+	n, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(buf[:n]))
+
+	// Looking up by time finds the same revision.
+	timeRoot, _, err := kbfsOps.GetRootNodeAtTime(ctx, h, oldTime)
+	require.NoError(t, err)
+	require.Equal(t, oldRoot.GetFolderBranch(), timeRoot.GetFolderBranch())
+	timeRoot, _, err = kbfsOps.GetRootNodeAtTime(
+		ctx, h, oldTime.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, MakeRevBranchName(headRev),
+		timeRoot.GetFolderBranch().Branch)
+
+	_, _, err = kbfsOps.GetRootNodeAtTime(ctx, h, now.Add(-time.Minute))
+	require.IsType(t, NoSuchMDError{}, err)
+	_, _, err = kbfsOps.GetRootNodeAtRevision(ctx, h, headRev+1)
+	require.IsType(t, NoSuchMDError{}, err)
+}
+
+func TestKBFSOpsGetRootNodeAtRevisionGarbageCollected(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	oldRev := ops.getCurrMDRevision(makeFBOLockState())
+
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+
+	// Use another device, so that none of the deleted blocks are
+	// cached.
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	h, err := ParseTlfHandle(ctx, config2.KBPKI(), u1.String(), false)
+	require.NoError(t, err)
+	oldRoot, _, err := kbfsOps2.GetRootNodeAtRevision(ctx, h, oldRev)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.Lookup(ctx, oldRoot, "a")
+	require.Equal(t, RevGarbageCollectedError{
+		rootNode.GetFolderBranch().Tlf, oldRev,
+		oldRoot.(*nodeStandard).core.pathNode.ID}, err)
+}
+
+// Tests that archived folder-branches are shut down once there are
+// too many of them, least recently opened first, but only when none
+// of their nodes are in use.
+func TestKBFSOpsArchivedOpsEviction(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	for i := 0; i < maxArchivedFolderBranches+1; i++ {
+		_, _, err := kbfsOps.CreateDir(ctx, rootNode, fmt.Sprintf("d%d", i))
+		require.NoError(t, err)
+	}
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	id := rootNode.GetFolderBranch().Tlf
+
+	// Simulate the finalizer of a node that's no longer in use.
+	release := func(n Node) {
+		ns := n.(*nodeStandard)
+		runtime.SetFinalizer(ns, nil)
+		ns.core.cache.forget(ns.core)
+	}
+	archived := func() map[FolderBranch]bool {
+		kops := kbfsOps.(*KBFSOpsStandard)
+		kops.opsLock.RLock()
+		defer kops.opsLock.RUnlock()
+		fbs := make(map[FolderBranch]bool)
+		for fb := range kops.ops {
+			if fb.Branch.IsArchived() {
+				fbs[fb] = true
+			}
+		}
+		return fbs
+	}
+
+	var roots []Node
+	for i := 0; i < maxArchivedFolderBranches; i++ {
+		root, _, err := kbfsOps.GetRootNodeAtRevision(
+			ctx, h, MetadataRevisionInitial+MetadataRevision(i))
+		require.NoError(t, err)
+		roots = append(roots, root)
+	}
+	require.Len(t, archived(), maxArchivedFolderBranches)
+
+	// While all their nodes are in use, none are shut down.
+	newest := MetadataRevisionInitial +
+		MetadataRevision(maxArchivedFolderBranches)
+	root, _, err := kbfsOps.GetRootNodeAtRevision(ctx, h, newest)
+	require.NoError(t, err)
+	roots = append(roots, root)
+	require.Len(t, archived(), maxArchivedFolderBranches+1)
+
+	// Once they're released, the least recently opened one goes.
+	for _, root := range roots[:2] {
+		release(root)
+	}
+	_, _, err = kbfsOps.GetRootNodeAtRevision(ctx, h, newest)
+	require.NoError(t, err)
+	fbs := archived()
+	require.Len(t, fbs, maxArchivedFolderBranches)
+	require.False(t, fbs[FolderBranch{
+		id, MakeRevBranchName(MetadataRevisionInitial)}])
+	require.True(t, fbs[FolderBranch{
+		id, MakeRevBranchName(MetadataRevisionInitial + 1)}])
+
+	// A released one can be opened again.
+	root, _, err = kbfsOps.GetRootNodeAtRevision(
+		ctx, h, MetadataRevisionInitial)
+	require.NoError(t, err)
+	children, err := kbfsOps.GetDirChildren(ctx, root)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+	require.Len(t, archived(), maxArchivedFolderBranches)
+}
+
+func TestKBFSOpsOfflineMode(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	kbfsOps := config.KBFSOps()
+
+	// Only the first TLF gets a journal.
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user1", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	err := jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	sharedRootNode := GetRootNodeOrBust(
+		ctx, t, config, "test_user1,test_user2", false)
+
+	kbfsOps.PushConnectionStatusChange(MDServiceName, errDisconnected{})
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, status.IsOffline)
+
+	// The journaled TLF keeps accepting writes, and can still be
+	// looked up.
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("offline"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config, "test_user1", false)
+	require.Equal(t, rootNode.GetID(), rootNode2.GetID())
+
+	// The unjournaled one can't be written.
+	_, _, err = kbfsOps.CreateFile(ctx, sharedRootNode, "b", false, NoExcl)
+	require.IsType(t, OfflineUnjournaledError{}, err)
+
+	// Coming back online flushes the journal.
+	kbfsOps.PushConnectionStatusChange(MDServiceName, nil)
+	status, _, err = kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.False(t, status.IsOffline)
+	err = jServer.Wait(ctx, tlfID)
+	require.NoError(t, err)
+	jStatus, err := jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, jStatus.RevisionStart)
+
+	_, _, err = kbfsOps.CreateFile(ctx, sharedRootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsMultiLevelFile(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// With tiny blocks, each indirect block only holds two pointers,
+	// so even a small file needs several levels of them.
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+	require.Equal(t, 2, config.BlockSplitter().MaxPtrsPerBlock())
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	checkData := func(expected []byte) {
+		buf := make([]byte, len(expected)+10)
+		n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:n])
+	}
+	checkLevels := func(expectedLevels int) {
+		ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+		lState := makeFBOLockState()
+		filePath := ops.nodeCache.PathFromNode(fileNode)
+		ptr := filePath.tailPointer()
+		levels := 0
+		for {
+			block, err := ops.blocks.GetFileBlockForReading(ctx, lState,
+				ops.getHead(lState), ptr, filePath.Branch, filePath)
+			require.NoError(t, err)
+			if !block.IsInd {
+				break
+			}
+			levels++
+			for _, iptr := range block.IPtrs {
+				require.Equal(t, levels < expectedLevels, iptr.IsInd)
+			}
+			ptr = block.IPtrs[0].BlockPointer
+		}
+		require.Equal(t, expectedLevels, levels)
+		if levels > 1 {
+			require.Equal(t, MultiLevelFilesDataVer,
+				filePath.tailPointer().DataVer)
+		}
+	}
+
+	// 20 leaf blocks need five levels of indirect blocks.
+	var data []byte
+	for i := 0; i < 200; i++ {
+		data = append(data, byte(i))
+	}
+	for off := 0; off < len(data); off += 30 {
+		end := off + 30
+		if end > len(data) {
+			end = len(data)
+		}
+		err = kbfsOps.Write(ctx, fileNode, data[off:end], int64(off))
+		require.NoError(t, err)
+	}
+	checkData(data)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	checkData(data)
+	checkLevels(5)
+
+	// Overwrite some of the middle, and extend the file with a hole
+	// before writing to its new end.
+	for i := 95; i < 125; i++ {
+		data[i] = 0xff
+	}
+	err = kbfsOps.Write(ctx, fileNode, data[95:125], 95)
+	require.NoError(t, err)
+	tail := []byte("the end")
+	err = kbfsOps.Truncate(ctx, fileNode, uint64(400+len(tail)))
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, tail, 400)
+	require.NoError(t, err)
+	data = append(data, make([]byte, 200)...)
+	data = append(data, tail...)
+	checkData(data)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	checkData(data)
+	checkLevels(6)
+
+	// Truncating the file down to a few blocks doesn't take away any
+	// levels.
+	err = kbfsOps.Truncate(ctx, fileNode, 25)
+	require.NoError(t, err)
+	data = data[:25]
+	checkData(data)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	checkData(data)
+	checkLevels(6)
+	_, ei, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(25), ei.Size)
+}
+
+func TestKBFSOpsCopyFile(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use tiny blocks, so the source has several levels of indirect
+	// blocks.
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", true, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+
+	var data []byte
+	for i := 0; i < 100; i++ {
+		data = append(data, byte(i))
+	}
+	// Leave the source dirty; the copy should sync it first.
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+
+	checkData := func(kbfsOps KBFSOps, node Node, expected []byte) {
+		buf := make([]byte, len(expected)+10)
+		n, err := kbfsOps.Read(ctx, node, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:n])
+	}
+	getLeaves := func(node Node) (leaves []BlockPointer) {
+		lState := makeFBOLockState()
+		p := ops.nodeCache.PathFromNode(node)
+		var walk func(ptr BlockPointer)
+		walk = func(ptr BlockPointer) {
+			block, err := ops.blocks.GetFileBlockForReading(ctx, lState,
+				ops.getHead(lState), ptr, p.Branch, p)
+			require.NoError(t, err)
+			if !block.IsInd {
+				leaves = append(leaves, ptr)
+				return
+			}
+			for _, iptr := range block.IPtrs {
+				walk(iptr.BlockPointer)
+			}
+		}
+		walk(p.tailPointer())
+		return leaves
+	}
+
+	copyNode, ei, err := kbfsOps.CopyFile(ctx, srcNode, dirNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	require.False(t, ops.blocks.IsDirty(
+		makeFBOLockState(), ops.nodeCache.PathFromNode(srcNode)))
+	checkData(kbfsOps, copyNode, data)
+
+	// The copy's data blocks are new references to the source's.
+	srcLeaves := getLeaves(srcNode)
+	copyLeaves := getLeaves(copyNode)
+	require.Len(t, copyLeaves, len(srcLeaves))
+	for i := range srcLeaves {
+		require.Equal(t, srcLeaves[i].ID, copyLeaves[i].ID)
+		require.NotEqual(t, srcLeaves[i].RefNonce, copyLeaves[i].RefNonce)
+	}
+	require.NotEqual(t, ops.nodeCache.PathFromNode(srcNode).tailPointer().ID,
+		ops.nodeCache.PathFromNode(copyNode).tailPointer().ID)
+
+	_, _, err = kbfsOps.CopyFile(ctx, srcNode, dirNode, "b")
+	require.IsType(t, NameExistsError{}, err)
+	_, _, err = kbfsOps.CopyFile(ctx, dirNode, rootNode, "c")
+	require.IsType(t, NotFileError{}, err)
+
+	// A file small enough for a single block is copied by reference
+	// too.
+	smallNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "small", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, smallNode, data[:5], 0)
+	require.NoError(t, err)
+	smallCopyNode, _, err := kbfsOps.CopyFile(
+		ctx, smallNode, rootNode, "small2")
+	require.NoError(t, err)
+	checkData(kbfsOps, smallCopyNode, data[:5])
+	smallPtr := ops.nodeCache.PathFromNode(smallNode).tailPointer()
+	smallCopyPtr := ops.nodeCache.PathFromNode(smallCopyNode).tailPointer()
+	require.Equal(t, smallPtr.ID, smallCopyPtr.ID)
+	require.NotEqual(t, smallPtr.RefNonce, smallCopyPtr.RefNonce)
+
+	// Writing to the copy leaves the source alone.
+	err = kbfsOps.Write(ctx, copyNode, []byte("new"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, copyNode)
+	require.NoError(t, err)
+	checkData(kbfsOps, srcNode, data)
+	copyData := append([]byte("new"), data[3:]...)
+	checkData(kbfsOps, copyNode, copyData)
+
+	// Once the sources are removed and their blocks deleted, another
+	// device can still read the copies from the server.
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "small")
+	require.NoError(t, err)
+	err = ops.fbm.waitForDeletingBlocks(ctx)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	copyNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "b")
+	require.NoError(t, err)
+	checkData(kbfsOps2, copyNode2, copyData)
+	smallCopyNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "small2")
+	require.NoError(t, err)
+	checkData(kbfsOps2, smallCopyNode2, data[:5])
+}
+
+func TestKBFSOpsCopyFileJournaled(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+	kbfsOps := config.KBFSOps()
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user1", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	err := jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+
+	countRefs := func() (shared, copied int) {
+		head := getOps(config, tlfID).getHead(makeFBOLockState())
+		for _, op := range head.data.Changes.Ops {
+			for _, ptr := range op.Refs() {
+				if ptr.IsFirstRef() {
+					copied++
+				} else {
+					shared++
+				}
+			}
+		}
+		return shared, copied
+	}
+
+	// The copy of unflushed data references the journaled leaf
+	// blocks, and only copies the indirect ones.
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte("journaled data spread over a few blocks")
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	copyNode, _, err := kbfsOps.CopyFile(ctx, srcNode, rootNode, "b")
+	require.NoError(t, err)
+	shared, copied := countRefs()
+	require.Equal(t, 4, shared)
+	require.Equal(t, 3, copied)
+
+	buf := make([]byte, len(data)+10)
+	n, err := kbfsOps.Read(ctx, copyNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+	err = jServer.Wait(ctx, tlfID)
+	require.NoError(t, err)
+
+	// The copy of flushed data references the blocks on the server.
+	copyNode2, _, err := kbfsOps.CopyFile(ctx, srcNode, rootNode, "c")
+	require.NoError(t, err)
+	shared, copied = countRefs()
+	require.Equal(t, 4, shared)
+	require.Equal(t, 3, copied)
+	n, err = kbfsOps.Read(ctx, copyNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+	err = jServer.Wait(ctx, tlfID)
+	require.NoError(t, err)
+
+	// Another device can read both copies.
+	config2 := ConfigAsUser(config, "test_user1")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user1", false)
+	kbfsOps2 := config2.KBFSOps()
+	for _, name := range []string{"b", "c"} {
+		node, _, err := kbfsOps2.Lookup(ctx, rootNode2, name)
+		require.NoError(t, err)
+		n, err := kbfsOps2.Read(ctx, node, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, buf[:n])
+	}
+}
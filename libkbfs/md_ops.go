@@ -13,6 +13,7 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
@@ -23,11 +24,24 @@ import (
 type MDOpsStandard struct {
 	config Config
 	log    logger.Logger
+
+	// Protects merkleLeafKeys.
+	merkleLeafKeysLock sync.Mutex
+	// merkleLeafKeys holds the TLF private key of each key
+	// generation that has been seen while decrypting Merkle
+	// leaves, so that the merged history only has to be walked
+	// once per TLF.
+	merkleLeafKeys map[tlf.ID]map[KeyGen]kbfscrypto.TLFPrivateKey
 }
 
 // NewMDOpsStandard returns a new MDOpsStandard
 func NewMDOpsStandard(config Config) *MDOpsStandard {
-	return &MDOpsStandard{config, config.MakeLogger("")}
+	return &MDOpsStandard{
+		config: config,
+		log:    config.MakeLogger(""),
+		merkleLeafKeys: make(
+			map[tlf.ID]map[KeyGen]kbfscrypto.TLFPrivateKey),
+	}
 }
 
 // convertVerifyingKeyError gives a better error when the TLF was
@@ -241,6 +255,333 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 	return MakeImmutableRootMetadata(rmd, key, mdID, localTimestamp), nil
 }
 
+// getMerkleRoot returns the current root of the Merkle tree for
+// public or private TLFs, or nil if Merkle verification is off or
+// mStatus isn't Merged.  The root must be fetched before the MD it
+// will be checked against, so that an MD put that races with the
+// fetch can't look like a rollback.
+func (md *MDOpsStandard) getMerkleRoot(ctx context.Context,
+	mStatus MergeStatus, public bool) (*MerkleRoot, error) {
+	src := md.config.MerkleSource()
+	if src == nil || mStatus != Merged {
+		return nil, nil
+	}
+	treeID := keybase1.MerkleTreeID_KBFS_PRIVATE
+	if public {
+		treeID = keybase1.MerkleTreeID_KBFS_PUBLIC
+	}
+	root, err := src.GetCurrentMerkleRoot(ctx, treeID)
+	if err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// decodeMerkleLeaf decodes, and if necessary decrypts, the leaf for
+// the TLF of the given head.
+func (md *MDOpsStandard) decodeMerkleLeaf(ctx context.Context,
+	root MerkleRoot, head ImmutableRootMetadata, leafBytes []byte) (
+	*MerkleLeaf, error) {
+	if head.TlfID().IsPublic() {
+		var leaf MerkleLeaf
+		err := md.config.Codec().Decode(leafBytes, &leaf)
+		if err != nil {
+			return nil, err
+		}
+		return &leaf, nil
+	}
+
+	if root.EPubKey == nil || root.Nonce == nil {
+		return nil, fmt.Errorf("Merkle root %d has no ephemeral key "+
+			"for private leaves", root.SeqNo)
+	}
+	var encryptedLeaf EncryptedMerkleLeaf
+	err := md.config.Codec().Decode(leafBytes, &encryptedLeaf)
+	if err != nil {
+		return nil, err
+	}
+	return md.decryptMerkleLeaf(ctx, root, head, encryptedLeaf)
+}
+
+func (md *MDOpsStandard) putMerkleLeafKey(
+	id tlf.ID, keyGen KeyGen, key kbfscrypto.TLFPrivateKey) {
+	md.merkleLeafKeysLock.Lock()
+	defer md.merkleLeafKeysLock.Unlock()
+	keys := md.merkleLeafKeys[id]
+	if keys == nil {
+		keys = make(map[KeyGen]kbfscrypto.TLFPrivateKey)
+		md.merkleLeafKeys[id] = keys
+	}
+	keys[keyGen] = key
+}
+
+func (md *MDOpsStandard) getMerkleLeafKeys(
+	id tlf.ID) map[KeyGen]kbfscrypto.TLFPrivateKey {
+	md.merkleLeafKeysLock.Lock()
+	defer md.merkleLeafKeysLock.Unlock()
+	keys := make(map[KeyGen]kbfscrypto.TLFPrivateKey)
+	for keyGen, key := range md.merkleLeafKeys[id] {
+		keys[keyGen] = key
+	}
+	return keys
+}
+
+// decryptMerkleLeaf decrypts the given leaf for the TLF of the given
+// head.  The leaf is encrypted with the TLF key pair of the key
+// generation of the revision it records, which is older than the
+// head's if the TLF was rekeyed after the root was made.  The private
+// key of each key generation is only in the MDs made under it, so
+// the keys already seen for the TLF are tried first, and only if one
+// is missing does this walk back from the head to find it.
+func (md *MDOpsStandard) decryptMerkleLeaf(ctx context.Context,
+	root MerkleRoot, head ImmutableRootMetadata,
+	encryptedLeaf EncryptedMerkleLeaf) (*MerkleLeaf, error) {
+	crypto := md.config.Crypto()
+	id := head.TlfID()
+	headKeyGen := head.LatestKeyGeneration()
+	if head.IsReadable() {
+		md.putMerkleLeafKey(id, headKeyGen, head.data.TLFPrivateKey)
+	}
+	leaf, err := crypto.DecryptMerkleLeaf(
+		encryptedLeaf, head.data.TLFPrivateKey, root.Nonce, *root.EPubKey)
+	if _, ok := err.(libkb.DecryptionError); !ok {
+		return leaf, err
+	}
+
+	tried := map[KeyGen]bool{headKeyGen: true}
+	for keyGen, key := range md.getMerkleLeafKeys(id) {
+		if keyGen >= headKeyGen {
+			continue
+		}
+		tried[keyGen] = true
+		leaf, err = crypto.DecryptMerkleLeaf(
+			encryptedLeaf, key, root.Nonce, *root.EPubKey)
+		if _, ok := err.(libkb.DecryptionError); !ok {
+			return leaf, err
+		}
+	}
+	allTried := func() bool {
+		return len(tried) >= int(headKeyGen-FirstValidKeyGen)+1
+	}
+
+	keyGen := headKeyGen
+	for end := head.Revision() - 1; end >= MetadataRevisionInitial &&
+		keyGen > FirstValidKeyGen && !allTried(); {
+		start := end - maxMDsAtATime + 1
+		if start < MetadataRevisionInitial {
+			start = MetadataRevisionInitial
+		}
+		rmds, rangeErr := getMDRange(ctx, md.config, id,
+			NullBranchID, start, end, Merged)
+		if rangeErr != nil {
+			return nil, rangeErr
+		}
+		if len(rmds) == 0 {
+			break
+		}
+		for i := len(rmds) - 1; i >= 0; i-- {
+			rmd := rmds[i]
+			if rmd.LatestKeyGeneration() >= keyGen || !rmd.IsReadable() {
+				continue
+			}
+			keyGen = rmd.LatestKeyGeneration()
+			md.putMerkleLeafKey(id, keyGen, rmd.data.TLFPrivateKey)
+			if tried[keyGen] {
+				continue
+			}
+			tried[keyGen] = true
+			md.log.CDebugf(ctx, "Trying key generation %d from revision "+
+				"%d to decrypt the Merkle leaf", keyGen, rmd.Revision())
+			leaf, err = crypto.DecryptMerkleLeaf(encryptedLeaf,
+				rmd.data.TLFPrivateKey, root.Nonce, *root.EPubKey)
+			if _, ok := err.(libkb.DecryptionError); !ok {
+				return leaf, err
+			}
+		}
+		end = rmds[0].Revision() - 1
+	}
+	return nil, err
+}
+
+// verifyMerkleLeafAncestor checks that the MD the server has for the
+// leaf's revision matches the leaf, and that the given head descends
+// from it, by following the PrevRoot chain back from the head.  It
+// returns a non-nil verifyErr if either check fails.
+func (md *MDOpsStandard) verifyMerkleLeafAncestor(ctx context.Context,
+	leaf *MerkleLeaf, head ImmutableRootMetadata) (
+	verifyErr error, err error) {
+	id := head.TlfID()
+	var next BareRootMetadata = head.bareMd
+	var leafRMDS *RootMetadataSigned
+	for end := head.Revision() - 1; end >= leaf.Revision; {
+		start := end - maxMDsAtATime + 1
+		if start < leaf.Revision {
+			start = leaf.Revision
+		}
+		rmdses, err := md.config.MDServer().GetRange(
+			ctx, id, NullBranchID, Merged, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if len(rmdses) != int(end-start)+1 {
+			return MDForkError{id, leaf.Revision, MerkleHash{}, leaf.Hash}, nil
+		}
+		for i := len(rmdses) - 1; i >= 0; i-- {
+			rmds := rmdses[i]
+			mdID, err := md.config.Crypto().MakeMdID(rmds.MD)
+			if err != nil {
+				return nil, err
+			}
+			err = rmds.MD.CheckValidSuccessor(mdID, next)
+			if err != nil {
+				md.log.CDebugf(ctx, "Revision %d of %s isn't a valid "+
+					"successor of revision %d: %v", next.RevisionNumber(),
+					id, rmds.MD.RevisionNumber(), err)
+				return MDForkError{
+					id, leaf.Revision, MerkleHash{}, leaf.Hash}, nil
+			}
+			next = rmds.MD
+			leafRMDS = rmds
+		}
+		end = start - 1
+	}
+
+	mdHash, err := md.config.Crypto().MakeMerkleHash(leafRMDS)
+	if err != nil {
+		return nil, err
+	}
+	if mdHash != leaf.Hash {
+		return MDForkError{id, leaf.Revision, mdHash, leaf.Hash}, nil
+	}
+	return nil, nil
+}
+
+// verifyMerkleLeaf checks the given merged head, whose signed form
+// hashes to headHash, against the TLF's leaf in the given Merkle
+// root.  If the head is older than the leaf, or either of them
+// doesn't match the MD the server has for the leaf's revision, the
+// error is also sent to the reporter.  It does nothing if root is
+// nil.
+func (md *MDOpsStandard) verifyMerkleLeaf(ctx context.Context,
+	root *MerkleRoot, head ImmutableRootMetadata, headHash MerkleHash) error {
+	if root == nil {
+		return nil
+	}
+
+	id := head.TlfID()
+	leafBytes, err := md.config.MerkleSource().GetMerkleLeaf(ctx, id, *root)
+	if err != nil {
+		return err
+	}
+	if leafBytes == nil {
+		// The TLF was created after the root was made.
+		md.log.CDebugf(ctx, "No Merkle leaf for %s in root %d",
+			id, root.SeqNo)
+		return nil
+	}
+	leaf, err := md.decodeMerkleLeaf(ctx, *root, head, leafBytes)
+	if _, ok := err.(libkb.DecryptionError); ok {
+		// Since the root was fetched before the head, the leaf
+		// must have been encrypted with the key of the head's key
+		// generation or an earlier one.  If it wasn't, the head
+		// can't be trusted to be the latest one.
+		md.log.CWarningf(ctx, "Couldn't decrypt Merkle leaf for %s "+
+			"in root %d: %v", id, root.SeqNo, err)
+		leaf = nil
+	} else if err != nil {
+		return err
+	}
+
+	var verifyErr error
+	switch {
+	case leaf == nil:
+		verifyErr = MDRollbackError{
+			id, head.Revision(), MetadataRevisionUninitialized}
+	case leaf.Revision > head.Revision():
+		verifyErr = MDRollbackError{id, head.Revision(), leaf.Revision}
+	case leaf.Revision == head.Revision():
+		if headHash != leaf.Hash {
+			verifyErr = MDForkError{id, leaf.Revision, headHash, leaf.Hash}
+		}
+	default:
+		// The head has moved on since the root was made, so check
+		// the revision the leaf points to instead, and that the
+		// head descends from it.
+		verifyErr, err = md.verifyMerkleLeafAncestor(ctx, leaf, head)
+		if err != nil {
+			return err
+		}
+	}
+	if verifyErr != nil {
+		md.config.Reporter().ReportErr(ctx,
+			head.GetTlfHandle().GetCanonicalName(), id.IsPublic(),
+			ReadMode, verifyErr)
+		return verifyErr
+	}
+
+	md.log.CDebugf(ctx, "Verified revision %d of %s against Merkle "+
+		"root %d (leaf revision %d)", head.Revision(), id, root.SeqNo,
+		leaf.Revision)
+	return nil
+}
+
+// verifyNoMerkleLeaf checks that the TLF with the given ID, for
+// which the server has no MD, doesn't have a leaf in the given
+// Merkle root either.  The error is only sent to the reporter if
+// handle is non-nil.  It does nothing if root is nil.
+func (md *MDOpsStandard) verifyNoMerkleLeaf(ctx context.Context,
+	root *MerkleRoot, id tlf.ID, handle *TlfHandle) error {
+	if root == nil {
+		return nil
+	}
+	leafBytes, err := md.config.MerkleSource().GetMerkleLeaf(ctx, id, *root)
+	if err != nil {
+		return err
+	}
+	if leafBytes == nil {
+		return nil
+	}
+	// There's no need to decode the leaf; the server has lost the
+	// whole history of the TLF.
+	verifyErr := MDRollbackError{
+		id, MetadataRevisionUninitialized, MetadataRevisionUninitialized}
+	if handle != nil {
+		md.config.Reporter().ReportErr(ctx, handle.GetCanonicalName(),
+			handle.IsPublic(), ReadMode, verifyErr)
+	}
+	return verifyErr
+}
+
+// processMerkleVerifiedMetadata is like processMetadata, except that
+// the result is also checked against the given Merkle root, if it's
+// non-nil.
+func (md *MDOpsStandard) processMerkleVerifiedMetadata(ctx context.Context,
+	root *MerkleRoot, id tlf.ID, bid BranchID, handle *TlfHandle,
+	rmds *RootMetadataSigned, extra ExtraMetadata) (
+	ImmutableRootMetadata, error) {
+	var headHash MerkleHash
+	if root != nil {
+		// Hash now, since processing consumes rmds.
+		var err error
+		headHash, err = md.config.Crypto().MakeMerkleHash(rmds)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+	}
+
+	rmd, err := md.processMetadataWithID(
+		ctx, id, bid, handle, rmds, extra, nil)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+
+	err = md.verifyMerkleLeaf(ctx, root, rmd, headHash)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	return rmd, nil
+}
+
 // GetForHandle implements the MDOps interface for MDOpsStandard.
 func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 	mStatus MergeStatus) (tlf.ID, ImmutableRootMetadata, error) {
@@ -250,6 +591,11 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
+	root, err := md.getMerkleRoot(ctx, mStatus, handle.IsPublic())
+	if err != nil {
+		return tlf.ID{}, ImmutableRootMetadata{}, err
+	}
+
 	id, rmds, err := mdserv.GetForHandle(ctx, bh, mStatus)
 	if err != nil {
 		return tlf.ID{}, ImmutableRootMetadata{}, err
@@ -261,6 +607,10 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 			// mStatus == Unmerged.
 			return tlf.ID{}, ImmutableRootMetadata{}, nil
 		}
+		err := md.verifyNoMerkleLeaf(ctx, root, id, handle)
+		if err != nil {
+			return tlf.ID{}, ImmutableRootMetadata{}, err
+		}
 		return id, ImmutableRootMetadata{}, nil
 	}
 
@@ -290,7 +640,8 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 	// consistency. In the future, we'd want to eventually notify
 	// the upper layers of the new name, either directly, or
 	// through a rekey.
-	rmd, err := md.processMetadata(ctx, mdHandle, rmds, extra, nil)
+	rmd, err := md.processMerkleVerifiedMetadata(
+		ctx, root, rmds.MD.TlfID(), NullBranchID, mdHandle, rmds, extra)
 	if err != nil {
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
@@ -323,12 +674,22 @@ func (md *MDOpsStandard) processMetadataWithID(ctx context.Context,
 
 func (md *MDOpsStandard) getForTLF(ctx context.Context, id tlf.ID,
 	bid BranchID, mStatus MergeStatus) (ImmutableRootMetadata, error) {
+	root, err := md.getMerkleRoot(ctx, mStatus, id.IsPublic())
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	rmds, err := md.config.MDServer().GetForTLF(ctx, id, bid, mStatus)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
 	if rmds == nil {
-		// Possible if mStatus is Unmerged
+		// Possible if mStatus is Unmerged, or if the TLF has no
+		// MD yet, in which case it mustn't have a Merkle leaf
+		// either.
+		err := md.verifyNoMerkleLeaf(ctx, root, id, nil)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
 		return ImmutableRootMetadata{}, nil
 	}
 	extra, err := md.getExtraMD(ctx, rmds.MD)
@@ -343,7 +704,8 @@ func (md *MDOpsStandard) getForTLF(ctx context.Context, id tlf.ID,
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
-	rmd, err := md.processMetadataWithID(ctx, id, bid, handle, rmds, extra, nil)
+	rmd, err := md.processMerkleVerifiedMetadata(
+		ctx, root, id, bid, handle, rmds, extra)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -400,6 +401,75 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned,
 	return nil
 }
 
+// importMD implements the mdServerLocal interface for MDServerDisk.
+func (md *MDServerDisk) importMD(ctx context.Context,
+	rmds *RootMetadataSigned, extra ExtraMetadata) error {
+	if rmds.MD.MergedStatus() != Merged {
+		return MDServerErrorBadRequest{
+			Reason: "Only merged MDs can be imported"}
+	}
+
+	handle, err := rmds.MD.MakeBareTlfHandle(extra)
+	if err != nil {
+		return MDServerError{err}
+	}
+	id := rmds.MD.TlfID()
+	err = md.putHandleID(handle, id)
+	if err != nil {
+		return err
+	}
+
+	tlfStorage, err := md.getStorage(id)
+	if err != nil {
+		return err
+	}
+	err = tlfStorage.importMD(rmds, extra)
+	if err != nil {
+		return err
+	}
+
+	md.updateManager.setHead(id, md)
+	return nil
+}
+
+// putHandleID records that the given handle refers to the TLF with
+// the given ID, unless it already refers to another TLF.
+func (md *MDServerDisk) putHandleID(handle tlf.Handle, id tlf.ID) error {
+	handleBytes, err := md.config.Codec().Encode(handle)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.handleDb == nil {
+		return errMDServerDiskShutdown
+	}
+
+	buf, err := md.handleDb.Get(handleBytes, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return MDServerError{err}
+	}
+	if err == nil {
+		var oldID tlf.ID
+		err := oldID.UnmarshalBinary(buf)
+		if err != nil {
+			return MDServerError{err}
+		}
+		if oldID != id {
+			return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+				"Handle is already used by TLF %s", oldID)}
+		}
+		return nil
+	}
+
+	err = md.handleDb.Put(handleBytes, id.Bytes(), nil)
+	if err != nil {
+		return MDServerError{err}
+	}
+	return nil
+}
+
 // PruneBranch implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) PruneBranch(ctx context.Context, id tlf.ID, bid BranchID) error {
 	if bid == NullBranchID {
@@ -354,7 +354,53 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id tlf.ID,
 // Put implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 	extra ExtraMetadata) error {
+	return md.put(ctx, rmds, extra, false)
+}
+
+// importMD implements the mdServerLocal interface for MDServerMemory.
+func (md *MDServerMemory) importMD(ctx context.Context,
+	rmds *RootMetadataSigned, extra ExtraMetadata) error {
+	if rmds.MD.MergedStatus() != Merged {
+		return MDServerErrorBadRequest{
+			Reason: "Only merged MDs can be imported"}
+	}
+
+	handle, err := rmds.MD.MakeBareTlfHandle(extra)
+	if err != nil {
+		return MDServerError{err}
+	}
+	handleBytes, err := md.config.Codec().Encode(handle)
+	if err != nil {
+		return MDServerError{err}
+	}
+	id := rmds.MD.TlfID()
+	err = func() error {
+		md.lock.Lock()
+		defer md.lock.Unlock()
+		if md.handleDb == nil {
+			return errMDServerMemoryShutdown
+		}
+		if oldID, ok := md.handleDb[mdHandleKey(handleBytes)]; ok &&
+			oldID != id {
+			return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+				"Handle is already used by TLF %s", oldID)}
+		}
+		md.handleDb[mdHandleKey(handleBytes)] = id
+		md.latestHandleDb[id] = handle
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	return md.put(ctx, rmds, extra, true)
+}
 
+// put stores the given MD.  If isImport is true, the MD is being
+// restored from elsewhere, so it isn't checked against the current
+// user and device.
+func (md *MDServerMemory) put(ctx context.Context, rmds *RootMetadataSigned,
+	extra ExtraMetadata, isImport bool) error {
 	currentUID, currentVerifyingKey, err :=
 		getCurrentUIDAndVerifyingKey(ctx, md.config.currentInfoGetter())
 	if err != nil {
@@ -376,39 +422,41 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		return MDServerErrorBadRequest{Reason: err.Error()}
 	}
 
-	err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
-	if err != nil {
-		return MDServerErrorBadRequest{Reason: err.Error()}
-	}
-
 	id := rmds.MD.TlfID()
 
-	// Check permissions
-
-	mergedMasterHead, err :=
-		md.getHeadForTLF(ctx, id, NullBranchID, Merged)
-	if err != nil {
-		return MDServerError{err}
-	}
-
-	// TODO: Figure out nil case.
-	if mergedMasterHead != nil {
-		prevExtra, err := md.getExtraMetadata(
-			mergedMasterHead.MD.TlfID(),
-			mergedMasterHead.MD.GetTLFWriterKeyBundleID(),
-			mergedMasterHead.MD.GetTLFReaderKeyBundleID())
+	if !isImport {
+		err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
 		if err != nil {
-			return MDServerError{err}
+			return MDServerErrorBadRequest{Reason: err.Error()}
 		}
-		ok, err := isWriterOrValidRekey(
-			md.config.Codec(), currentUID,
-			mergedMasterHead.MD, rmds.MD,
-			prevExtra, extra)
+
+		// Check permissions
+
+		mergedMasterHead, err :=
+			md.getHeadForTLF(ctx, id, NullBranchID, Merged)
 		if err != nil {
 			return MDServerError{err}
 		}
-		if !ok {
-			return MDServerErrorUnauthorized{}
+
+		// TODO: Figure out nil case.
+		if mergedMasterHead != nil {
+			prevExtra, err := md.getExtraMetadata(
+				mergedMasterHead.MD.TlfID(),
+				mergedMasterHead.MD.GetTLFWriterKeyBundleID(),
+				mergedMasterHead.MD.GetTLFReaderKeyBundleID())
+			if err != nil {
+				return MDServerError{err}
+			}
+			ok, err := isWriterOrValidRekey(
+				md.config.Codec(), currentUID,
+				mergedMasterHead.MD, rmds.MD,
+				prevExtra, extra)
+			if err != nil {
+				return MDServerError{err}
+			}
+			if !ok {
+				return MDServerErrorUnauthorized{}
+			}
 		}
 	}
 
@@ -5,6 +5,9 @@
 package libkbfs
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -13,6 +16,7 @@ import (
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
@@ -30,6 +34,10 @@ const (
 	// MdServerDefaultPingIntervalSeconds is the default interval on which the
 	// client should contact the MD Server
 	MdServerDefaultPingIntervalSeconds = 10
+	// maxMerkleRootChainGap is the most Merkle roots that will be
+	// fetched to check that a new root descends from the last
+	// checked one.
+	maxMerkleRootChainGap = 1000
 )
 
 // MDServerRemote is an implementation of the MDServer interface.
@@ -57,6 +65,11 @@ type MDServerRemote struct {
 	serverOffsetMu    sync.RWMutex
 	serverOffsetKnown bool
 	serverOffset      time.Duration
+
+	merkleRootsLock sync.Mutex
+	// The latest root of each KBFS Merkle tree that has been
+	// checked against the earlier ones.
+	merkleRoots map[keybase1.MerkleTreeID]MerkleRoot
 }
 
 // Test that MDServerRemote fully implements the MDServer interface.
@@ -660,6 +673,192 @@ func (md *MDServerRemote) GetLatestHandleForTLF(ctx context.Context, id tlf.ID)
 	return handle, nil
 }
 
+var _ MerkleSource = (*MDServerRemote)(nil)
+
+func (md *MDServerRemote) decodeMerkleRoot(res keybase1.MerkleRoot,
+	treeID keybase1.MerkleTreeID) (MerkleRoot, error) {
+	if res.Version != MerkleRootVersion {
+		return MerkleRoot{}, fmt.Errorf(
+			"Unknown Merkle root version %d", res.Version)
+	}
+	var root MerkleRoot
+	if err := md.config.Codec().Decode(res.Root, &root); err != nil {
+		return MerkleRoot{}, err
+	}
+	if root.TreeID != treeID {
+		return MerkleRoot{}, fmt.Errorf(
+			"Asked for Merkle tree %s, got a root for %s", treeID, root.TreeID)
+	}
+	return root, nil
+}
+
+// checkMerkleRootDescends checks that the given root descends from
+// last, by following the PrevRoot hashes of the roots in between.
+// If they are more than maxMerkleRootChainGap apart, the new root is
+// trusted as it is, with a warning, as if it were the first one.
+func (md *MDServerRemote) checkMerkleRootDescends(
+	ctx context.Context, root, last MerkleRoot) error {
+	switch {
+	case root.SeqNo < last.SeqNo:
+		return MerkleRootForkError{root.TreeID, root.SeqNo, last.SeqNo}
+	case root.SeqNo == last.SeqNo:
+		if !bytes.Equal(root.Hash, last.Hash) {
+			return MerkleRootForkError{root.TreeID, root.SeqNo, last.SeqNo}
+		}
+		return nil
+	case root.SeqNo-last.SeqNo > maxMerkleRootChainGap:
+		md.log.CWarningf(ctx, "Merkle root %d of %s is too far past the "+
+			"last checked root %d to check the chain; trusting it",
+			root.SeqNo, root.TreeID, last.SeqNo)
+		return nil
+	}
+
+	curr := root
+	for curr.SeqNo > last.SeqNo+1 {
+		res, err := md.client.GetMerkleRoot(ctx, keybase1.GetMerkleRootArg{
+			TreeID: root.TreeID,
+			SeqNo:  curr.SeqNo - 1,
+		})
+		if err != nil {
+			return err
+		}
+		prev, err := md.decodeMerkleRoot(res, root.TreeID)
+		if err != nil {
+			return err
+		}
+		if prev.SeqNo != curr.SeqNo-1 ||
+			!bytes.Equal(curr.PrevRoot, prev.Hash) {
+			return MerkleRootForkError{root.TreeID, root.SeqNo, last.SeqNo}
+		}
+		curr = prev
+	}
+	if !bytes.Equal(curr.PrevRoot, last.Hash) {
+		return MerkleRootForkError{root.TreeID, root.SeqNo, last.SeqNo}
+	}
+	return nil
+}
+
+// checkMerkleRootChain checks that the given root descends from the
+// latest root of its tree that this client has already checked (see
+// checkMerkleRootDescends), and then remembers it as the latest one.
+// This keeps the mdserver from rolling back the tree or showing this
+// client more than one history of it.  The roots in between are
+// fetched without holding merkleRootsLock; if another root was
+// checked in the meantime, the new root is checked against that one
+// instead.
+func (md *MDServerRemote) checkMerkleRootChain(
+	ctx context.Context, root MerkleRoot) error {
+	for {
+		md.merkleRootsLock.Lock()
+		last, ok := md.merkleRoots[root.TreeID]
+		md.merkleRootsLock.Unlock()
+
+		if ok {
+			err := md.checkMerkleRootDescends(ctx, root, last)
+			if err != nil {
+				return err
+			}
+		} else {
+			md.log.CDebugf(ctx, "Trusting first Merkle root %d of %s",
+				root.SeqNo, root.TreeID)
+		}
+
+		stored := func() bool {
+			md.merkleRootsLock.Lock()
+			defer md.merkleRootsLock.Unlock()
+			curr, currOK := md.merkleRoots[root.TreeID]
+			if currOK != ok || (ok && (curr.SeqNo != last.SeqNo ||
+				!bytes.Equal(curr.Hash, last.Hash))) {
+				return false
+			}
+			if md.merkleRoots == nil {
+				md.merkleRoots =
+					make(map[keybase1.MerkleTreeID]MerkleRoot)
+			}
+			md.merkleRoots[root.TreeID] = root
+			return true
+		}()
+		if stored {
+			return nil
+		}
+	}
+}
+
+// GetCurrentMerkleRoot implements the MerkleSource interface for
+// MDServerRemote.  The roots carry no signature, and the protocol
+// has no way to check them against the global Keybase Merkle tree,
+// so the first root fetched for each tree is trusted; every later
+// one has to descend from it (see checkMerkleRootChain).
+func (md *MDServerRemote) GetCurrentMerkleRoot(ctx context.Context,
+	treeID keybase1.MerkleTreeID) (MerkleRoot, error) {
+	res, err := md.client.GetMerkleRootLatest(ctx, treeID)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	root, err := md.decodeMerkleRoot(res, treeID)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	err = md.checkMerkleRootChain(ctx, root)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	return root, nil
+}
+
+// mdServerMerkleEngine is a read-only merkle.StorageEngine that
+// fetches the nodes of the tree under a given root from the mdserver.
+type mdServerMerkleEngine struct {
+	ctx    context.Context
+	client keybase1.MetadataClient
+	root   merkle.Hash
+}
+
+var _ merkle.StorageEngine = mdServerMerkleEngine{}
+
+func (e mdServerMerkleEngine) StoreNode(merkle.Hash, []byte) error {
+	return errors.New("Can't store nodes in the mdserver's Merkle tree")
+}
+
+func (e mdServerMerkleEngine) CommitRoot(
+	merkle.Hash, merkle.Hash, merkle.TxInfo) error {
+	return errors.New("Can't commit roots to the mdserver's Merkle tree")
+}
+
+func (e mdServerMerkleEngine) LookupNode(h merkle.Hash) ([]byte, error) {
+	return e.client.GetMerkleNode(e.ctx, hex.EncodeToString(h))
+}
+
+func (e mdServerMerkleEngine) LookupRoot() (merkle.Hash, error) {
+	return e.root, nil
+}
+
+// GetMerkleLeaf implements the MerkleSource interface for
+// MDServerRemote.  It walks down the tree from the given root,
+// checking the hash of every node on the way.
+func (md *MDServerRemote) GetMerkleLeaf(ctx context.Context, id tlf.ID,
+	root MerkleRoot) ([]byte, error) {
+	tree := merkle.NewTree(
+		mdServerMerkleEngine{ctx, md.client, root.Hash},
+		merkle.NewConfig(merkle.SHA512Hasher{}, merkleTreeChildrenPerNode,
+			merkleTreeMaxLeafEntries, MerkleLeaf{}))
+	val, _, err := tree.Find(merkle.Hash(id.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	switch leaf := val.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return leaf, nil
+	case string:
+		return []byte(leaf), nil
+	default:
+		return nil, fmt.Errorf("Unexpected Merkle leaf type %T for %s",
+			val, id)
+	}
+}
+
 // OffsetFromServerTime implements the MDServer interface for
 // MDServerRemote.
 func (md *MDServerRemote) OffsetFromServerTime() (time.Duration, bool) {
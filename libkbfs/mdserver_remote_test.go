@@ -0,0 +1,190 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeMerkleClient serves the Merkle RPCs of the mdserver from an
+// in-memory tree.  roots[i] is the encoded root with sequence number
+// i+1, and the last one is the latest.
+type fakeMerkleClient struct {
+	eng   *merkle.MemEngine
+	roots [][]byte
+}
+
+func (c *fakeMerkleClient) Call(ctx context.Context, s string,
+	args interface{}, res interface{}) error {
+	switch s {
+	case "keybase.1.metadata.getMerkleRootLatest":
+		*res.(*keybase1.MerkleRoot) = keybase1.MerkleRoot{
+			Version: MerkleRootVersion,
+			Root:    c.roots[len(c.roots)-1],
+		}
+		return nil
+
+	case "keybase.1.metadata.getMerkleRoot":
+		arg := args.([]interface{})[0].(keybase1.GetMerkleRootArg)
+		if arg.SeqNo < 1 || arg.SeqNo > int64(len(c.roots)) {
+			return fmt.Errorf("No root %d", arg.SeqNo)
+		}
+		*res.(*keybase1.MerkleRoot) = keybase1.MerkleRoot{
+			Version: MerkleRootVersion,
+			Root:    c.roots[arg.SeqNo-1],
+		}
+		return nil
+
+	case "keybase.1.metadata.getMerkleNode":
+		arg := args.([]interface{})[0].(keybase1.GetMerkleNodeArg)
+		h, err := hex.DecodeString(arg.Hash)
+		if err != nil {
+			return err
+		}
+		node, err := c.eng.LookupNode(h)
+		if err != nil {
+			return err
+		}
+		*res.(*[]byte) = node
+		return nil
+
+	default:
+		return fmt.Errorf("Unknown call: %s %v %v", s, args, res)
+	}
+}
+
+func (c *fakeMerkleClient) Notify(_ context.Context, s string,
+	args interface{}) error {
+	return errors.New("Notify not implemented")
+}
+
+func TestMDServerRemoteMerkleSource(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	id := tlf.FakeID(1, false)
+	leaf := EncryptedMerkleLeaf{
+		Version:       EncryptionSecretbox,
+		EncryptedData: []byte{1, 2, 3},
+	}
+	leafBytes, err := config.Codec().Encode(leaf)
+	require.NoError(t, err)
+
+	eng := merkle.NewMemEngine()
+	tree := merkle.NewTree(eng, merkle.NewConfig(merkle.SHA512Hasher{},
+		merkleTreeChildrenPerNode, merkleTreeMaxLeafEntries, MerkleLeaf{}))
+	err = tree.Build(merkle.NewSortedMapFromList([]merkle.KeyValuePair{{
+		Key:   merkle.Hash(id.Bytes()),
+		Value: leafBytes,
+	}}), nil)
+	require.NoError(t, err)
+	rootHash, err := eng.LookupRoot()
+	require.NoError(t, err)
+	rootBytes, err := config.Codec().Encode(MerkleRoot{
+		Version: MerkleRootVersion,
+		TreeID:  keybase1.MerkleTreeID_KBFS_PRIVATE,
+		SeqNo:   1,
+		Hash:    rootHash,
+	})
+	require.NoError(t, err)
+
+	md := &MDServerRemote{
+		config: config,
+		log:    config.MakeLogger(""),
+		client: keybase1.MetadataClient{
+			Cli: &fakeMerkleClient{eng, [][]byte{rootBytes}}},
+	}
+	root, err := md.GetCurrentMerkleRoot(
+		ctx, keybase1.MerkleTreeID_KBFS_PRIVATE)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), root.SeqNo)
+	_, err = md.GetCurrentMerkleRoot(ctx, keybase1.MerkleTreeID_KBFS_PUBLIC)
+	require.Error(t, err)
+
+	gotLeafBytes, err := md.GetMerkleLeaf(ctx, id, root)
+	require.NoError(t, err)
+	require.Equal(t, leafBytes, gotLeafBytes)
+
+	// A TLF without a leaf.
+	gotLeafBytes, err = md.GetMerkleLeaf(ctx, tlf.FakeID(2, false), root)
+	require.NoError(t, err)
+	require.Nil(t, gotLeafBytes)
+
+	// A root that doesn't match the tree.
+	root.Hash = merkle.SHA512Hasher{}.Hash([]byte("bad"))
+	_, err = md.GetMerkleLeaf(ctx, id, root)
+	require.Error(t, err)
+}
+
+func TestMDServerRemoteMerkleRootChain(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	treeID := keybase1.MerkleTreeID_KBFS_PRIVATE
+	hasher := merkle.SHA512Hasher{}
+	makeRoot := func(seqNo int64, hash, prevHash string) []byte {
+		root := MerkleRoot{
+			Version: MerkleRootVersion,
+			TreeID:  treeID,
+			SeqNo:   seqNo,
+			Hash:    hasher.Hash([]byte(hash)),
+		}
+		if prevHash != "" {
+			root.PrevRoot = hasher.Hash([]byte(prevHash))
+		}
+		rootBytes, err := config.Codec().Encode(root)
+		require.NoError(t, err)
+		return rootBytes
+	}
+
+	client := &fakeMerkleClient{roots: [][]byte{makeRoot(1, "1", "")}}
+	md := &MDServerRemote{
+		config: config,
+		log:    config.MakeLogger(""),
+		client: keybase1.MetadataClient{Cli: client},
+	}
+	root, err := md.GetCurrentMerkleRoot(ctx, treeID)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), root.SeqNo)
+
+	// Later roots that descend from the first one are fine, even
+	// if some were skipped.
+	client.roots = append(client.roots,
+		makeRoot(2, "2", "1"), makeRoot(3, "3", "2"))
+	root, err = md.GetCurrentMerkleRoot(ctx, treeID)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), root.SeqNo)
+
+	// A root on another branch isn't.
+	client.roots = append(client.roots, makeRoot(4, "4", "other"))
+	_, err = md.GetCurrentMerkleRoot(ctx, treeID)
+	require.Equal(t, MerkleRootForkError{treeID, 4, 3}, err)
+
+	// Neither is a different root 3, or an older root.
+	client.roots = client.roots[:2]
+	_, err = md.GetCurrentMerkleRoot(ctx, treeID)
+	require.Equal(t, MerkleRootForkError{treeID, 2, 3}, err)
+	client.roots = append(client.roots, makeRoot(3, "other", "2"))
+	_, err = md.GetCurrentMerkleRoot(ctx, treeID)
+	require.Equal(t, MerkleRootForkError{treeID, 3, 3}, err)
+
+	// A root too far ahead to check the chain for is trusted as is.
+	farSeqNo := int64(3 + maxMerkleRootChainGap + 1)
+	client.roots = [][]byte{makeRoot(farSeqNo, "far", "other")}
+	root, err = md.GetCurrentMerkleRoot(ctx, treeID)
+	require.NoError(t, err)
+	require.Equal(t, farSeqNo, root.SeqNo)
+}
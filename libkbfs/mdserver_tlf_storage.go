@@ -469,6 +469,23 @@ func (s *mdServerTlfStorage) put(
 	currentUID keybase1.UID, currentVerifyingKey kbfscrypto.VerifyingKey,
 	rmds *RootMetadataSigned, extra ExtraMetadata) (
 	recordBranchID bool, err error) {
+	return s.putHelper(currentUID, currentVerifyingKey, rmds, extra, false)
+}
+
+// importMD is like put, but for a merged MD restored from elsewhere:
+// it skips the checks that rmds was written by the current device,
+// and that the current user may write to the TLF.
+func (s *mdServerTlfStorage) importMD(
+	rmds *RootMetadataSigned, extra ExtraMetadata) error {
+	_, err := s.putHelper(
+		keybase1.UID(""), kbfscrypto.VerifyingKey{}, rmds, extra, true)
+	return err
+}
+
+func (s *mdServerTlfStorage) putHelper(
+	currentUID keybase1.UID, currentVerifyingKey kbfscrypto.VerifyingKey,
+	rmds *RootMetadataSigned, extra ExtraMetadata, isImport bool) (
+	recordBranchID bool, err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -491,35 +508,37 @@ func (s *mdServerTlfStorage) put(
 		return false, MDServerErrorBadRequest{Reason: err.Error()}
 	}
 
-	err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
-	if err != nil {
-		return false, MDServerErrorBadRequest{Reason: err.Error()}
-	}
-
-	// Check permissions
-
-	mergedMasterHead, err := s.getHeadForTLFReadLocked(NullBranchID)
-	if err != nil {
-		return false, MDServerError{err}
-	}
-
-	// TODO: Figure out nil case.
-	if mergedMasterHead != nil {
-		prevExtra, err := s.getExtraMetadataReadLocked(
-			mergedMasterHead.MD.GetTLFWriterKeyBundleID(),
-			mergedMasterHead.MD.GetTLFReaderKeyBundleID())
+	if !isImport {
+		err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
 		if err != nil {
-			return false, MDServerError{err}
+			return false, MDServerErrorBadRequest{Reason: err.Error()}
 		}
-		ok, err := isWriterOrValidRekey(
-			s.codec, currentUID,
-			mergedMasterHead.MD, rmds.MD,
-			prevExtra, extra)
+
+		// Check permissions
+
+		mergedMasterHead, err := s.getHeadForTLFReadLocked(NullBranchID)
 		if err != nil {
 			return false, MDServerError{err}
 		}
-		if !ok {
-			return false, MDServerErrorUnauthorized{}
+
+		// TODO: Figure out nil case.
+		if mergedMasterHead != nil {
+			prevExtra, err := s.getExtraMetadataReadLocked(
+				mergedMasterHead.MD.GetTLFWriterKeyBundleID(),
+				mergedMasterHead.MD.GetTLFReaderKeyBundleID())
+			if err != nil {
+				return false, MDServerError{err}
+			}
+			ok, err := isWriterOrValidRekey(
+				s.codec, currentUID,
+				mergedMasterHead.MD, rmds.MD,
+				prevExtra, extra)
+			if err != nil {
+				return false, MDServerError{err}
+			}
+			if !ok {
+				return false, MDServerErrorUnauthorized{}
+			}
 		}
 	}
 
@@ -16,6 +16,15 @@ import (
 // MerkleRootVersion is the current Merkle root version.
 const MerkleRootVersion = 1
 
+const (
+	// merkleTreeChildrenPerNode is the number of children of each
+	// interior node of the KBFS Merkle trees.
+	merkleTreeChildrenPerNode = 256
+	// merkleTreeMaxLeafEntries is the number of leaves past which
+	// a node of the KBFS Merkle trees is split.
+	merkleTreeMaxLeafEntries = 512
+)
+
 // MerkleRoot represents a signed Merkle tree root.
 type MerkleRoot struct {
 	Version   int                               `codec:"v"`
@@ -0,0 +1,115 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+type merkleMemLeaf struct {
+	leaf   MerkleLeaf
+	pubKey kbfscrypto.TLFPublicKey
+}
+
+// MerkleSourceMemory implements the MerkleSource interface by just
+// storing leaves in memory, and is meant for testing.  It doesn't
+// build a real tree: every time a leaf is set, a new root is made
+// with a fresh ephemeral key, and the root hashes are left empty.
+type MerkleSourceMemory struct {
+	codec  kbfscodec.Codec
+	crypto cryptoPure
+
+	lock     sync.Mutex
+	root     MerkleRoot
+	ePrivKey kbfscrypto.TLFEphemeralPrivateKey
+	leaves   map[tlf.ID]merkleMemLeaf
+}
+
+var _ MerkleSource = (*MerkleSourceMemory)(nil)
+
+// NewMerkleSourceMemory constructs a new, empty MerkleSourceMemory.
+func NewMerkleSourceMemory(
+	codec kbfscodec.Codec, crypto cryptoPure) *MerkleSourceMemory {
+	return &MerkleSourceMemory{
+		codec:  codec,
+		crypto: crypto,
+		root: MerkleRoot{
+			Version: MerkleRootVersion,
+		},
+		leaves: make(map[tlf.ID]merkleMemLeaf),
+	}
+}
+
+// SetLeaf sets the leaf for the given TLF, and publishes a new root.
+// For private TLFs, pubKey is the TLF public key to encrypt the leaf
+// with; it's ignored for public TLFs.
+func (m *MerkleSourceMemory) SetLeaf(id tlf.ID, leaf MerkleLeaf,
+	pubKey kbfscrypto.TLFPublicKey) error {
+	_, _, ePubKey, ePrivKey, _, err := m.crypto.MakeRandomTLFKeys()
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	err = kbfscrypto.RandRead(nonce[:])
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.leaves[id] = merkleMemLeaf{leaf, pubKey}
+	m.root.SeqNo++
+	m.root.Timestamp = time.Now().Unix()
+	m.root.EPubKey = &ePubKey
+	m.root.Nonce = &nonce
+	m.ePrivKey = ePrivKey
+	return nil
+}
+
+// GetCurrentMerkleRoot implements the MerkleSource interface for
+// MerkleSourceMemory.  The public and private trees share a single
+// sequence of roots.
+func (m *MerkleSourceMemory) GetCurrentMerkleRoot(
+	ctx context.Context, treeID keybase1.MerkleTreeID) (MerkleRoot, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	root := m.root
+	root.TreeID = treeID
+	return root, nil
+}
+
+// GetMerkleLeaf implements the MerkleSource interface for
+// MerkleSourceMemory.
+func (m *MerkleSourceMemory) GetMerkleLeaf(
+	ctx context.Context, id tlf.ID, root MerkleRoot) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if root.SeqNo != m.root.SeqNo {
+		return nil, fmt.Errorf("Only the current root (%d) is available, "+
+			"not %d", m.root.SeqNo, root.SeqNo)
+	}
+
+	l, ok := m.leaves[id]
+	if !ok {
+		return nil, nil
+	}
+	if id.IsPublic() {
+		return m.codec.Encode(l.leaf)
+	}
+	encryptedLeaf, err := m.crypto.EncryptMerkleLeaf(
+		l.leaf, l.pubKey, m.root.Nonce, m.ePrivKey)
+	if err != nil {
+		return nil, err
+	}
+	return m.codec.Encode(encryptedLeaf)
+}
@@ -272,6 +272,30 @@ func (_mr *_MockKBFSOpsRecorder) GetRootNode(arg0, arg1, arg2 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRootNode", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetRootNodeAtRevision(ctx context.Context, h *TlfHandle, rev MetadataRevision) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetRootNodeAtRevision", ctx, h, rev)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRootNodeAtRevision(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRootNodeAtRevision", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetRootNodeAtTime(ctx context.Context, h *TlfHandle, t time.Time) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetRootNodeAtTime", ctx, h, t)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRootNodeAtTime(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRootNodeAtTime", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error) {
 	ret := _m.ctrl.Call(_m, "GetDirChildren", ctx, dir)
 	ret0, _ := ret[0].(map[string]EntryInfo)
@@ -341,6 +365,29 @@ func (_mr *_MockKBFSOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) CreateHardLink(ctx context.Context, file Node, dir Node, name string) (EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateHardLink", ctx, file, dir, name)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CreateHardLink(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateHardLink", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) CopyFile(ctx context.Context, file Node, dir Node, name string) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CopyFile", ctx, file, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) CopyFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CopyFile", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
 	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
 	ret0, _ := ret[0].(error)
@@ -422,6 +469,48 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetXattr(ctx context.Context, node Node, name string) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetXattr", ctx, node, name)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ListXattr(ctx context.Context, node Node) ([]string, error) {
+	ret := _m.ctrl.Call(_m, "ListXattr", ctx, node)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ListXattr(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListXattr", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetXattr(ctx context.Context, node Node, name string, value []byte, flag XattrSetFlag) error {
+	ret := _m.ctrl.Call(_m, "SetXattr", ctx, node, name, value, flag)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetXattr(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetXattr", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockKBFSOps) RemoveXattr(ctx context.Context, node Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveXattr", ctx, node, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveXattr", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Sync(ctx context.Context, file Node) error {
 	ret := _m.ctrl.Call(_m, "Sync", ctx, file)
 	ret0, _ := ret[0].(error)
@@ -466,6 +555,58 @@ func (_mr *_MockKBFSOpsRecorder) UnstageForTesting(arg0, arg1 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnstageForTesting", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetUnmergedChanges(ctx context.Context, folderBranch FolderBranch) ([]UnmergedChange, error) {
+	ret := _m.ctrl.Call(_m, "GetUnmergedChanges", ctx, folderBranch)
+	ret0, _ := ret[0].([]UnmergedChange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetUnmergedChanges(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUnmergedChanges", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetConflictChoice(ctx context.Context, folderBranch FolderBranch, path string, choice ConflictChoice) error {
+	ret := _m.ctrl.Call(_m, "SetConflictChoice", ctx, folderBranch, path, choice)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetConflictChoice(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictChoice", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) BeginTransaction(ctx context.Context, folderBranch FolderBranch) (context.Context, error) {
+	ret := _m.ctrl.Call(_m, "BeginTransaction", ctx, folderBranch)
+	ret0, _ := ret[0].(context.Context)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) BeginTransaction(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginTransaction", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) CommitTransaction(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "CommitTransaction", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) CommitTransaction(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CommitTransaction", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) AbortTransaction(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "AbortTransaction", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) AbortTransaction(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AbortTransaction", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) Rekey(ctx context.Context, id tlf.ID) error {
 	ret := _m.ctrl.Call(_m, "Rekey", ctx, id)
 	ret0, _ := ret[0].(error)
@@ -508,6 +649,18 @@ func (_mr *_MockKBFSOpsRecorder) GetEditHistory(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetEditHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetChanges(ctx context.Context, folderBranch FolderBranch, since MetadataRevision) ([]TlfChange, MetadataRevision, error) {
+	ret := _m.ctrl.Call(_m, "GetChanges", ctx, folderBranch, since)
+	ret0, _ := ret[0].([]TlfChange)
+	ret1, _ := ret[1].(MetadataRevision)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetChanges(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetChanges", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error) {
 	ret := _m.ctrl.Call(_m, "GetNodeMetadata", ctx, node)
 	ret0, _ := ret[0].(NodeMetadata)
@@ -519,6 +672,48 @@ func (_mr *_MockKBFSOpsRecorder) GetNodeMetadata(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetNodeMetadata", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetFileHistory(ctx context.Context, file Node) ([]FileVersion, error) {
+	ret := _m.ctrl.Call(_m, "GetFileHistory", ctx, file)
+	ret0, _ := ret[0].([]FileVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFileHistory(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFileHistory", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) RestoreFileVersion(ctx context.Context, file Node, rev MetadataRevision) error {
+	ret := _m.ctrl.Call(_m, "RestoreFileVersion", ctx, file, rev)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RestoreFileVersion(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RestoreFileVersion", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetTrash(ctx context.Context, folderBranch FolderBranch) ([]TrashEntry, error) {
+	ret := _m.ctrl.Call(_m, "GetTrash", ctx, folderBranch)
+	ret0, _ := ret[0].([]TrashEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetTrash(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTrash", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) Restore(ctx context.Context, folderBranch FolderBranch, name string) error {
+	ret := _m.ctrl.Call(_m, "Restore", ctx, folderBranch, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Restore(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Restore", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -1571,6 +1766,120 @@ func (_mr *_MockBlockCacheRecorder) DeleteKnownPtr(arg0, arg1 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteKnownPtr", arg0, arg1)
 }
 
+// Mock of MerkleSource interface
+type MockMerkleSource struct {
+	ctrl     *gomock.Controller
+	recorder *_MockMerkleSourceRecorder
+}
+
+// Recorder for MockMerkleSource (not exported)
+type _MockMerkleSourceRecorder struct {
+	mock *MockMerkleSource
+}
+
+func NewMockMerkleSource(ctrl *gomock.Controller) *MockMerkleSource {
+	mock := &MockMerkleSource{ctrl: ctrl}
+	mock.recorder = &_MockMerkleSourceRecorder{mock}
+	return mock
+}
+
+func (_m *MockMerkleSource) EXPECT() *_MockMerkleSourceRecorder {
+	return _m.recorder
+}
+
+func (_m *MockMerkleSource) GetCurrentMerkleRoot(ctx context.Context, treeID keybase1.MerkleTreeID) (MerkleRoot, error) {
+	ret := _m.ctrl.Call(_m, "GetCurrentMerkleRoot", ctx, treeID)
+	ret0, _ := ret[0].(MerkleRoot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMerkleSourceRecorder) GetCurrentMerkleRoot(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetCurrentMerkleRoot", arg0, arg1)
+}
+
+func (_m *MockMerkleSource) GetMerkleLeaf(ctx context.Context, id tlf.ID, root MerkleRoot) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetMerkleLeaf", ctx, id, root)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMerkleSourceRecorder) GetMerkleLeaf(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMerkleLeaf", arg0, arg1, arg2)
+}
+
+// Mock of DiskBlockCache interface
+type MockDiskBlockCache struct {
+	ctrl     *gomock.Controller
+	recorder *_MockDiskBlockCacheRecorder
+}
+
+// Recorder for MockDiskBlockCache (not exported)
+type _MockDiskBlockCacheRecorder struct {
+	mock *MockDiskBlockCache
+}
+
+func NewMockDiskBlockCache(ctrl *gomock.Controller) *MockDiskBlockCache {
+	mock := &MockDiskBlockCache{ctrl: ctrl}
+	mock.recorder = &_MockDiskBlockCacheRecorder{mock}
+	return mock
+}
+
+func (_m *MockDiskBlockCache) EXPECT() *_MockDiskBlockCacheRecorder {
+	return _m.recorder
+}
+
+func (_m *MockDiskBlockCache) Get(ctx context.Context, tlfID tlf.ID, blockID BlockID) ([]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	ret := _m.ctrl.Call(_m, "Get", ctx, tlfID, blockID)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(kbfscrypto.BlockCryptKeyServerHalf)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Get(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0, arg1, arg2)
+}
+
+func (_m *MockDiskBlockCache) Put(ctx context.Context, tlfID tlf.ID, blockID BlockID, buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	ret := _m.ctrl.Call(_m, "Put", ctx, tlfID, blockID, buf, serverHalf)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Put(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockDiskBlockCache) Delete(ctx context.Context, blockIDs []BlockID) error {
+	ret := _m.ctrl.Call(_m, "Delete", ctx, blockIDs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Delete", arg0, arg1)
+}
+
+func (_m *MockDiskBlockCache) Status() DiskBlockCacheStatus {
+	ret := _m.ctrl.Call(_m, "Status")
+	ret0, _ := ret[0].(DiskBlockCacheStatus)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Status() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Status")
+}
+
+func (_m *MockDiskBlockCache) Shutdown() {
+	_m.ctrl.Call(_m, "Shutdown")
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Shutdown() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
+}
+
 // Mock of DirtyBlockCache interface
 type MockDirtyBlockCache struct {
 	ctrl     *gomock.Controller
@@ -1927,16 +2236,17 @@ func (_mr *_MockcryptoPureRecorder) DecryptPrivateMetadata(arg0, arg1 interface{
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptPrivateMetadata", arg0, arg1)
 }
 
-func (_m *MockcryptoPure) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
-	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key)
+func (_m *MockcryptoPure) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey, compression BlockCompressionType) (int, EncryptedBlock, int, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key, compression)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(EncryptedBlock)
-	ret2, _ := ret[2].(error)
-	return ret0, ret1, ret2
+	ret2, _ := ret[2].(int)
+	ret3, _ := ret[3].(error)
+	return ret0, ret1, ret2, ret3
 }
 
-func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
+func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1, arg2)
 }
 
 func (_m *MockcryptoPure) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
@@ -2257,16 +2567,17 @@ func (_mr *_MockCryptoRecorder) DecryptPrivateMetadata(arg0, arg1 interface{}) *
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptPrivateMetadata", arg0, arg1)
 }
 
-func (_m *MockCrypto) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
-	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key)
+func (_m *MockCrypto) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey, compression BlockCompressionType) (int, EncryptedBlock, int, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key, compression)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(EncryptedBlock)
-	ret2, _ := ret[2].(error)
-	return ret0, ret1, ret2
+	ret2, _ := ret[2].(int)
+	ret3, _ := ret[3].(error)
+	return ret0, ret1, ret2, ret3
 }
 
-func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
+func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1, arg2)
 }
 
 func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
@@ -2678,6 +2989,16 @@ func (_mr *_MockBlockOpsRecorder) Archive(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Archive", arg0, arg1, arg2)
 }
 
+func (_m *MockBlockOps) Prefetcher() Prefetcher {
+	ret := _m.ctrl.Call(_m, "Prefetcher")
+	ret0, _ := ret[0].(Prefetcher)
+	return ret0
+}
+
+func (_mr *_MockBlockOpsRecorder) Prefetcher() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Prefetcher")
+}
+
 func (_m *MockBlockOps) Shutdown() {
 	_m.ctrl.Call(_m, "Shutdown")
 }
@@ -2686,6 +3007,61 @@ func (_mr *_MockBlockOpsRecorder) Shutdown() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
 }
 
+// Mock of Prefetcher interface
+type MockPrefetcher struct {
+	ctrl     *gomock.Controller
+	recorder *_MockPrefetcherRecorder
+}
+
+// Recorder for MockPrefetcher (not exported)
+type _MockPrefetcherRecorder struct {
+	mock *MockPrefetcher
+}
+
+func NewMockPrefetcher(ctrl *gomock.Controller) *MockPrefetcher {
+	mock := &MockPrefetcher{ctrl: ctrl}
+	mock.recorder = &_MockPrefetcherRecorder{mock}
+	return mock
+}
+
+func (_m *MockPrefetcher) EXPECT() *_MockPrefetcherRecorder {
+	return _m.recorder
+}
+
+func (_m *MockPrefetcher) PrefetchAfterBlockRetrieved(b Block, kmd KeyMetadata) {
+	_m.ctrl.Call(_m, "PrefetchAfterBlockRetrieved", b, kmd)
+}
+
+func (_mr *_MockPrefetcherRecorder) PrefetchAfterBlockRetrieved(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PrefetchAfterBlockRetrieved", arg0, arg1)
+}
+
+func (_m *MockPrefetcher) PrefetchFileBlocks(b *FileBlock, off int64, kmd KeyMetadata) {
+	_m.ctrl.Call(_m, "PrefetchFileBlocks", b, off, kmd)
+}
+
+func (_mr *_MockPrefetcherRecorder) PrefetchFileBlocks(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PrefetchFileBlocks", arg0, arg1, arg2)
+}
+
+func (_m *MockPrefetcher) CancelTlfPrefetches(tlfID tlf.ID) {
+	_m.ctrl.Call(_m, "CancelTlfPrefetches", tlfID)
+}
+
+func (_mr *_MockPrefetcherRecorder) CancelTlfPrefetches(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CancelTlfPrefetches", arg0)
+}
+
+func (_m *MockPrefetcher) Shutdown() <-chan struct{} {
+	ret := _m.ctrl.Call(_m, "Shutdown")
+	ret0, _ := ret[0].(<-chan struct{})
+	return ret0
+}
+
+func (_mr *_MockPrefetcherRecorder) Shutdown() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
+}
+
 // Mock of authTokenRefreshHandler interface
 type MockauthTokenRefreshHandler struct {
 	ctrl     *gomock.Controller
@@ -3128,6 +3504,16 @@ func (_mr *_MockmdServerLocalRecorder) copy(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "copy", arg0)
 }
 
+func (_m *MockmdServerLocal) importMD(ctx context.Context, rmds *RootMetadataSigned, extra ExtraMetadata) error {
+	ret := _m.ctrl.Call(_m, "importMD", ctx, rmds, extra)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockmdServerLocalRecorder) importMD(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "importMD", arg0, arg1, arg2)
+}
+
 // Mock of BlockServer interface
 type MockBlockServer struct {
 	ctrl     *gomock.Controller
@@ -3352,15 +3738,15 @@ func (_mr *_MockblockServerLocalRecorder) GetUserQuotaInfo(arg0 interface{}) *go
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUserQuotaInfo", arg0)
 }
 
-func (_m *MockblockServerLocal) getAllRefs(ctx context.Context, tlfID tlf.ID) (map[BlockID]blockRefMap, error) {
-	ret := _m.ctrl.Call(_m, "getAllRefs", ctx, tlfID)
+func (_m *MockblockServerLocal) getAllRefsForTest(ctx context.Context, tlfID tlf.ID) (map[BlockID]blockRefMap, error) {
+	ret := _m.ctrl.Call(_m, "getAllRefsForTest", ctx, tlfID)
 	ret0, _ := ret[0].(map[BlockID]blockRefMap)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockblockServerLocalRecorder) getAllRefs(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "getAllRefs", arg0, arg1)
+func (_mr *_MockblockServerLocalRecorder) getAllRefsForTest(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "getAllRefsForTest", arg0, arg1)
 }
 
 // Mock of BlockSplitter interface
@@ -3404,6 +3790,16 @@ func (_mr *_MockBlockSplitterRecorder) CheckSplit(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CheckSplit", arg0)
 }
 
+func (_m *MockBlockSplitter) MaxPtrsPerBlock() int {
+	ret := _m.ctrl.Call(_m, "MaxPtrsPerBlock")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) MaxPtrsPerBlock() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxPtrsPerBlock")
+}
+
 func (_m *MockBlockSplitter) ShouldEmbedBlockChanges(bc *BlockChanges) bool {
 	ret := _m.ctrl.Call(_m, "ShouldEmbedBlockChanges", bc)
 	ret0, _ := ret[0].(bool)
@@ -3623,6 +4019,48 @@ func (_mr *_MockConflictRenamerRecorder) ConflictRename(arg0, arg1, arg2 interfa
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictRename", arg0, arg1, arg2)
 }
 
+// Mock of ConflictFileMerger interface
+type MockConflictFileMerger struct {
+	ctrl     *gomock.Controller
+	recorder *_MockConflictFileMergerRecorder
+}
+
+// Recorder for MockConflictFileMerger (not exported)
+type _MockConflictFileMergerRecorder struct {
+	mock *MockConflictFileMerger
+}
+
+func NewMockConflictFileMerger(ctrl *gomock.Controller) *MockConflictFileMerger {
+	mock := &MockConflictFileMerger{ctrl: ctrl}
+	mock.recorder = &_MockConflictFileMergerRecorder{mock}
+	return mock
+}
+
+func (_m *MockConflictFileMerger) EXPECT() *_MockConflictFileMergerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockConflictFileMerger) ShouldMerge(name string, size uint64) bool {
+	ret := _m.ctrl.Call(_m, "ShouldMerge", name, size)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConflictFileMergerRecorder) ShouldMerge(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ShouldMerge", arg0, arg1)
+}
+
+func (_m *MockConflictFileMerger) MergeFile(ctx context.Context, name string, base []byte, unmerged []byte, merged []byte) ([]byte, bool) {
+	ret := _m.ctrl.Call(_m, "MergeFile", ctx, name, base, unmerged, merged)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+func (_mr *_MockConflictFileMergerRecorder) MergeFile(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MergeFile", arg0, arg1, arg2, arg3, arg4)
+}
+
 // Mock of Config interface
 type MockConfig struct {
 	ctrl     *gomock.Controller
@@ -3806,6 +4244,42 @@ func (_mr *_MockConfigRecorder) SetDirtyBlockCache(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDirtyBlockCache", arg0)
 }
 
+func (_m *MockConfig) DiskBlockCache() DiskBlockCache {
+	ret := _m.ctrl.Call(_m, "DiskBlockCache")
+	ret0, _ := ret[0].(DiskBlockCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DiskBlockCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskBlockCache")
+}
+
+func (_m *MockConfig) SetDiskBlockCache(_param0 DiskBlockCache) {
+	_m.ctrl.Call(_m, "SetDiskBlockCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDiskBlockCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskBlockCache", arg0)
+}
+
+func (_m *MockConfig) MerkleSource() MerkleSource {
+	ret := _m.ctrl.Call(_m, "MerkleSource")
+	ret0, _ := ret[0].(MerkleSource)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MerkleSource() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MerkleSource")
+}
+
+func (_m *MockConfig) SetMerkleSource(_param0 MerkleSource) {
+	_m.ctrl.Call(_m, "SetMerkleSource", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMerkleSource(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMerkleSource", arg0)
+}
+
 func (_m *MockConfig) Crypto() Crypto {
 	ret := _m.ctrl.Call(_m, "Crypto")
 	ret0, _ := ret[0].(Crypto)
@@ -4040,6 +4514,52 @@ func (_mr *_MockConfigRecorder) SetConflictRenamer(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictRenamer", arg0)
 }
 
+func (_m *MockConfig) ConflictFileMerger() ConflictFileMerger {
+	ret := _m.ctrl.Call(_m, "ConflictFileMerger")
+	ret0, _ := ret[0].(ConflictFileMerger)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ConflictFileMerger() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictFileMerger")
+}
+
+func (_m *MockConfig) SetConflictFileMerger(_param0 ConflictFileMerger) {
+	_m.ctrl.Call(_m, "SetConflictFileMerger", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetConflictFileMerger(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictFileMerger", arg0)
+}
+
+func (_m *MockConfig) BandwidthLimiter() *BandwidthLimiter {
+	ret := _m.ctrl.Call(_m, "BandwidthLimiter")
+	ret0, _ := ret[0].(*BandwidthLimiter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BandwidthLimiter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BandwidthLimiter")
+}
+
+func (_m *MockConfig) TuningConfig() TuningConfig {
+	ret := _m.ctrl.Call(_m, "TuningConfig")
+	ret0, _ := ret[0].(TuningConfig)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) TuningConfig() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TuningConfig")
+}
+
+func (_m *MockConfig) SetTuningConfig(_param0 TuningConfig) {
+	_m.ctrl.Call(_m, "SetTuningConfig", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetTuningConfig(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTuningConfig", arg0)
+}
+
 func (_m *MockConfig) MetadataVersion() MetadataVer {
 	ret := _m.ctrl.Call(_m, "MetadataVersion")
 	ret0, _ := ret[0].(MetadataVer)
@@ -4126,6 +4646,16 @@ func (_mr *_MockConfigRecorder) MaxDirBytes() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirBytes")
 }
 
+func (_m *MockConfig) MaxDirBlockBytes() uint64 {
+	ret := _m.ctrl.Call(_m, "MaxDirBlockBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxDirBlockBytes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirBlockBytes")
+}
+
 func (_m *MockConfig) DoBackgroundFlushes() bool {
 	ret := _m.ctrl.Call(_m, "DoBackgroundFlushes")
 	ret0, _ := ret[0].(bool)
@@ -4202,6 +4732,60 @@ func (_mr *_MockConfigRecorder) QuotaReclamationMinHeadAge() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "QuotaReclamationMinHeadAge")
 }
 
+func (_m *MockConfig) TrashRetention() time.Duration {
+	ret := _m.ctrl.Call(_m, "TrashRetention")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) TrashRetention() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TrashRetention")
+}
+
+func (_m *MockConfig) SetTrashRetention(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetTrashRetention", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetTrashRetention(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTrashRetention", arg0)
+}
+
+func (_m *MockConfig) ConflictHoldTimeout() time.Duration {
+	ret := _m.ctrl.Call(_m, "ConflictHoldTimeout")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ConflictHoldTimeout() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictHoldTimeout")
+}
+
+func (_m *MockConfig) SetConflictHoldTimeout(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetConflictHoldTimeout", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetConflictHoldTimeout(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictHoldTimeout", arg0)
+}
+
+func (_m *MockConfig) BlockCompression() BlockCompressionType {
+	ret := _m.ctrl.Call(_m, "BlockCompression")
+	ret0, _ := ret[0].(BlockCompressionType)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockCompression() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCompression")
+}
+
+func (_m *MockConfig) SetBlockCompression(_param0 BlockCompressionType) {
+	_m.ctrl.Call(_m, "SetBlockCompression", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockCompression(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockCompression", arg0)
+}
+
 func (_m *MockConfig) ResetCaches() {
 	_m.ctrl.Call(_m, "ResetCaches")
 }
@@ -280,6 +280,14 @@ func (ncs *nodeCacheStandard) PathFromNode(node Node) (p path) {
 	return
 }
 
+// numNodes returns the number of nodes in the cache that are still
+// referenced.
+func (ncs *nodeCacheStandard) numNodes() int {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+	return len(ncs.nodes)
+}
+
 // AllNodes implements the NodeCache interface for nodeCacheStandard.
 func (ncs *nodeCacheStandard) AllNodes() []Node {
 	ncs.lock.Lock()
@@ -61,6 +61,7 @@ const (
 	resolutionOpCode
 	rekeyOpCode
 	gcOpCode // for deleting old blocks during an MD history truncation
+	linkOpCode
 )
 
 // blockUpdate represents a block that was updated to have a new
@@ -263,6 +264,11 @@ type createOp struct {
 	// be copied.
 	forceCopy bool
 
+	// If true, this create op represents the link half of a linkOp,
+	// and the created entry is a hard link without blocks of its
+	// own.  This op should never be persisted.
+	hardLink bool
+
 	// If this is set, ths create op needs to be turned has been
 	// turned into a symlink creation locally to avoid a cycle during
 	// conflict resolution, and the following field represents the
@@ -331,6 +337,9 @@ func (co *createOp) String() string {
 	if co.renamed {
 		res += " (renamed)"
 	}
+	if co.hardLink {
+		res += " (hard link)"
+	}
 	return res
 }
 
@@ -373,6 +382,15 @@ func (co *createOp) checkConflict(
 			if err != nil {
 				return nil, err
 			}
+			if co.hardLink {
+				// A hard link has no blocks to copy, so just
+				// move the link entry out of the way.
+				return &copyUnmergedEntryAction{
+					fromName: co.NewName,
+					toName:   toName,
+					unique:   true,
+				}, nil
+			}
 			return &renameUnmergedAction{
 				fromName: co.NewName,
 				toName:   toName,
@@ -502,6 +520,15 @@ func (ro *rmOp) checkConflict(
 			// Both removed the same file.
 			return &dropUnmergedAction{op: ro}, nil
 		}
+	case *linkOp:
+		if !realMergedOp.Removed && realMergedOp.Target == ro.OldName {
+			// The merged branch added a new hard link to a target
+			// whose last link was removed by the unmerged branch.
+			// Whether the target stays depends on whether any of
+			// the merged links are left once the unmerged link
+			// removals are applied.
+			return &rmHardLinkTargetAction{op: ro}, nil
+		}
 	}
 	return nil, nil
 }
@@ -766,9 +793,9 @@ func (so *syncOp) checkConflict(
 	isFile bool) (crAction, error) {
 	switch mergedOp.(type) {
 	case *syncOp:
-		// Any sync on the same file is a conflict.  (TODO: add
-		// type-specific intelligent conflict resolvers for file
-		// contents?)
+		// Any sync on the same file is a conflict.  If a
+		// ConflictFileMerger is configured, it may still be able
+		// to merge the contents during doActions.
 		toName, err := renamer.ConflictRename(
 			ctx, so, mergedOp.getFinalPath().tailName())
 		if err != nil {
@@ -924,6 +951,7 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	xattrAttr
 )
 
 func (ac attrChange) String() string {
@@ -934,6 +962,8 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
 	}
 	return "<invalid attrChange>"
 }
@@ -1019,7 +1049,8 @@ func (sao *setAttrOp) checkConflict(
 			var symPath string
 			var causedByAttr attrChange
 			if !isFile {
-				// A directory has a conflict on an mtime attribute.
+				// A directory has a conflict on an mtime or xattr
+				// attribute.
 				// Create a symlink entry with the unmerged mtime
 				// pointing to the merged entry.
 				symPath = mergedOp.getFinalPath().tailName()
@@ -1203,6 +1234,126 @@ func (gco *GCOp) getDefaultAction(mergedPath path) crAction {
 	return nil
 }
 
+// linkOp is an op representing the creation or removal of a hard
+// link.  It affects two directories: the one containing the link
+// entry, and the hidden hard links directory that contains the
+// target entry (which tracks the IDs of all the links to it).
+type linkOp struct {
+	OpCommon
+	Name      string      `codec:"n"`
+	Dir       blockUpdate `codec:"d"`
+	Target    string      `codec:"t"`
+	TargetDir blockUpdate `codec:"td"`
+	LinkID    string      `codec:"i"`
+	Removed   bool        `codec:"rm,omitempty"`
+}
+
+func newLinkOp(name string, oldDir BlockPointer, target string,
+	oldTargetDir BlockPointer, linkID string, removed bool) (
+	*linkOp, error) {
+	lo := &linkOp{
+		Name:    name,
+		Target:  target,
+		LinkID:  linkID,
+		Removed: removed,
+	}
+	err := lo.Dir.setUnref(oldDir)
+	if err != nil {
+		return nil, err
+	}
+	err = lo.TargetDir.setUnref(oldTargetDir)
+	if err != nil {
+		return nil, err
+	}
+	return lo, nil
+}
+
+func (lo *linkOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
+	if oldPtr == lo.Dir.Unref {
+		err := lo.Dir.setRef(newPtr)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	if oldPtr == lo.TargetDir.Unref {
+		err := lo.TargetDir.setRef(newPtr)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	lo.OpCommon.AddUpdate(oldPtr, newPtr)
+}
+
+func (lo *linkOp) SizeExceptUpdates() uint64 {
+	return uint64(len(lo.Name) + len(lo.Target) + len(lo.LinkID))
+}
+
+func (lo *linkOp) allUpdates() []blockUpdate {
+	updates := make([]blockUpdate, len(lo.Updates))
+	copy(updates, lo.Updates)
+	return append(updates, lo.TargetDir, lo.Dir)
+}
+
+func (lo *linkOp) checkValid() error {
+	err := lo.Dir.checkValid()
+	if err != nil {
+		return fmt.Errorf("linkOp.Dir=%v got error: %v", lo.Dir, err)
+	}
+	err = lo.TargetDir.checkValid()
+	if err != nil {
+		return fmt.Errorf("linkOp.TargetDir=%v got error: %v",
+			lo.TargetDir, err)
+	}
+	return lo.checkUpdatesValid()
+}
+
+func (lo *linkOp) String() string {
+	if lo.Removed {
+		return fmt.Sprintf("unlink %s -> %s", lo.Name, lo.Target)
+	}
+	return fmt.Sprintf("link %s -> %s", lo.Name, lo.Target)
+}
+
+func (lo *linkOp) StringWithRefs(numRefIndents int) string {
+	res := lo.String() + "\n"
+	indent := strings.Repeat("\t", numRefIndents)
+	res += indent + fmt.Sprintf("Dir: %v -> %v\n", lo.Dir.Unref, lo.Dir.Ref)
+	res += indent + fmt.Sprintf("TargetDir: %v -> %v\n",
+		lo.TargetDir.Unref, lo.TargetDir.Ref)
+	res += indent + fmt.Sprintf("LinkID: %s\n", lo.LinkID)
+	res += lo.stringWithRefs(numRefIndents)
+	return res
+}
+
+func (lo *linkOp) checkConflict(
+	ctx context.Context, renamer ConflictRenamer, mergedOp op,
+	isFile bool) (crAction, error) {
+	// Link IDs are unique, and the default action only adds or
+	// removes this op's ID, so the only conflict is with the
+	// removal of the target itself.
+	if ro, ok := mergedOp.(*rmOp); ok && ro.OldName == lo.Target &&
+		!lo.Removed {
+		// The merged branch removed the last link to the target,
+		// so it needs to be re-created for this link not to
+		// dangle.
+		return &recreateHardLinkTargetAction{
+			target: lo.Target,
+			linkID: lo.LinkID,
+		}, nil
+	}
+	return nil, nil
+}
+
+func (lo *linkOp) getDefaultAction(mergedPath path) crAction {
+	return &updateHardLinksAction{
+		target:  lo.Target,
+		linkID:  lo.LinkID,
+		removed: lo.Removed,
+	}
+}
+
 // invertOpForLocalNotifications returns an operation that represents
 // an undoing of the effect of the given op.  These are intended to be
 // used for local notifications only, and would not be useful for
@@ -1252,6 +1403,12 @@ func invertOpForLocalNotifications(oldOp op) (newOp op, err error) {
 		}
 	case *GCOp:
 		newOp = op
+	case *linkOp:
+		newOp, err = newLinkOp(op.Name, op.Dir.Ref, op.Target,
+			op.TargetDir.Ref, op.LinkID, !op.Removed)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Now reverse all the block updates.  Don't bother with bare Refs
@@ -1291,6 +1448,8 @@ func opPointerizer(iface interface{}) reflect.Value {
 		return reflect.ValueOf(&op)
 	case GCOp:
 		return reflect.ValueOf(&op)
+	case linkOp:
+		return reflect.ValueOf(&op)
 	}
 }
 
@@ -1304,6 +1463,7 @@ func RegisterOps(codec kbfscodec.Codec) {
 	codec.RegisterType(reflect.TypeOf(resolutionOp{}), resolutionOpCode)
 	codec.RegisterType(reflect.TypeOf(rekeyOp{}), rekeyOpCode)
 	codec.RegisterType(reflect.TypeOf(GCOp{}), gcOpCode)
+	codec.RegisterType(reflect.TypeOf(linkOp{}), linkOpCode)
 	codec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
 		opPointerizer)
 }
@@ -178,6 +178,8 @@ func opPointerizerFuture(iface interface{}) reflect.Value {
 		return reflect.ValueOf(&op)
 	case gcOpFuture:
 		return reflect.ValueOf(&op)
+	case linkOpFuture:
+		return reflect.ValueOf(&op)
 	}
 }
 
@@ -190,6 +192,7 @@ func registerOpsFuture(codec kbfscodec.Codec) {
 	codec.RegisterType(reflect.TypeOf(resolutionOpFuture{}), resolutionOpCode)
 	codec.RegisterType(reflect.TypeOf(rekeyOpFuture{}), rekeyOpCode)
 	codec.RegisterType(reflect.TypeOf(gcOpFuture{}), gcOpCode)
+	codec.RegisterType(reflect.TypeOf(linkOpFuture{}), linkOpCode)
 	codec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
 		opPointerizerFuture)
 }
@@ -240,6 +243,7 @@ func makeFakeCreateOpFuture(t *testing.T) createOpFuture {
 			Exec,
 			false,
 			false,
+			false,
 			"",
 		},
 		kbfscodec.MakeExtraOrBust("createOp", t),
@@ -469,6 +473,39 @@ func TestGcOpUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakeGcOpFuture(t))
 }
 
+type linkOpFuture struct {
+	linkOp
+	kbfscodec.Extra
+}
+
+func (lof linkOpFuture) toCurrent() linkOp {
+	return lof.linkOp
+}
+
+func (lof linkOpFuture) ToCurrentStruct() kbfscodec.CurrentStruct {
+	return lof.toCurrent()
+}
+
+func makeFakeLinkOpFuture(t *testing.T) linkOpFuture {
+	lof := linkOpFuture{
+		linkOp{
+			makeFakeOpCommon(t, false),
+			"link name",
+			makeFakeBlockUpdate(t),
+			"target name",
+			makeFakeBlockUpdate(t),
+			"link id",
+			false,
+		},
+		kbfscodec.MakeExtraOrBust("linkOp", t),
+	}
+	return lof
+}
+
+func TestLinkOpUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeLinkOpFuture(t))
+}
+
 type testOps struct {
 	Ops []interface{}
 }
@@ -0,0 +1,283 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultIndirectPointerPrefetchCount is the number of child
+	// blocks of an indirect file block to prefetch ahead of a
+	// read.
+	defaultIndirectPointerPrefetchCount int = 20
+	// defaultMaxOutstandingPrefetches is the number of prefetches
+	// that may be in flight at once; further prefetches are
+	// dropped until some of those complete.
+	defaultMaxOutstandingPrefetches int = 50
+	// fileIndirectBlockPrefetchPriority is the priority of
+	// prefetches for the child blocks of an indirect file block.
+	fileIndirectBlockPrefetchPriority int = -100
+	// dirEntryPrefetchPriority is the priority of prefetches for
+	// the child directories of a directory block.
+	dirEntryPrefetchPriority int = -200
+)
+
+// blockRetriever is the subset of blockRetrievalQueue needed by the
+// prefetcher (for ease of testing).
+type blockRetriever interface {
+	Request(ctx context.Context, priority int, kmd KeyMetadata,
+		ptr BlockPointer, block Block) <-chan error
+}
+
+// blockPrefetcherConfig is the subset of the Config interface needed
+// by blockPrefetcher (for ease of testing).
+type blockPrefetcherConfig interface {
+	BlockCache() BlockCache
+	MetricsRegistry() metrics.Registry
+	MakeLogger(module string) logger.Logger
+}
+
+// blockPrefetcher implements the Prefetcher interface by issuing
+// low-priority requests to a blockRetriever, and putting the
+// retrieved blocks into the block cache.
+type blockPrefetcher struct {
+	config         blockPrefetcherConfig
+	retriever      blockRetriever
+	indirectCount  int
+	outstandingSem chan struct{}
+
+	requestedMeter metrics.Meter
+	completedMeter metrics.Meter
+	failedMeter    metrics.Meter
+	canceledMeter  metrics.Meter
+	droppedMeter   metrics.Meter
+
+	// protects everything below
+	lock sync.Mutex
+	// ctx is the parent of all the per-TLF contexts, and is
+	// canceled on shutdown.
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	tlfCtxs    map[tlf.ID]context.Context
+	tlfCancels map[tlf.ID]context.CancelFunc
+	isShutdown bool
+	inFlight   sync.WaitGroup
+}
+
+var _ Prefetcher = (*blockPrefetcher)(nil)
+
+func newBlockPrefetcher(retriever blockRetriever,
+	config blockPrefetcherConfig) *blockPrefetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &blockPrefetcher{
+		config:        config,
+		retriever:     retriever,
+		indirectCount: defaultIndirectPointerPrefetchCount,
+		outstandingSem: make(
+			chan struct{}, defaultMaxOutstandingPrefetches),
+		ctx:        ctx,
+		cancelFunc: cancel,
+		tlfCtxs:    make(map[tlf.ID]context.Context),
+		tlfCancels: make(map[tlf.ID]context.CancelFunc),
+	}
+	if r := config.MetricsRegistry(); r != nil {
+		p.requestedMeter = metrics.GetOrRegisterMeter(
+			"BlockPrefetcher.Requested", r)
+		p.completedMeter = metrics.GetOrRegisterMeter(
+			"BlockPrefetcher.Completed", r)
+		p.failedMeter = metrics.GetOrRegisterMeter(
+			"BlockPrefetcher.Failed", r)
+		p.canceledMeter = metrics.GetOrRegisterMeter(
+			"BlockPrefetcher.Canceled", r)
+		p.droppedMeter = metrics.GetOrRegisterMeter(
+			"BlockPrefetcher.Dropped", r)
+	} else {
+		p.requestedMeter = metrics.NilMeter{}
+		p.completedMeter = metrics.NilMeter{}
+		p.failedMeter = metrics.NilMeter{}
+		p.canceledMeter = metrics.NilMeter{}
+		p.droppedMeter = metrics.NilMeter{}
+	}
+	return p
+}
+
+// debugf logs a debug message, if the config has a logger.  The
+// logger can't be made along with the prefetcher, since block ops
+// are usually created before the config's logger maker is set.
+func (p *blockPrefetcher) debugf(
+	ctx context.Context, format string, args ...interface{}) {
+	if log := p.config.MakeLogger("PRE"); log != nil {
+		log.CDebugf(ctx, format, args...)
+	}
+}
+
+// getTlfContext returns the context under which all prefetches for
+// the given TLF are made, or nil if the prefetcher has been shut
+// down.
+func (p *blockPrefetcher) getTlfContext(tlfID tlf.ID) context.Context {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isShutdown {
+		return nil
+	}
+	ctx, ok := p.tlfCtxs[tlfID]
+	if !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(p.ctx)
+		p.tlfCtxs[tlfID] = ctx
+		p.tlfCancels[tlfID] = cancel
+	}
+	// Count this prefetch while still holding the lock, so that
+	// Shutdown can't miss it.
+	p.inFlight.Add(1)
+	return ctx
+}
+
+// request prefetches the given block pointer into the block cache, if
+// it isn't already cached and there's room for another outstanding
+// prefetch.
+func (p *blockPrefetcher) request(priority int, kmd KeyMetadata,
+	ptr BlockPointer, block Block) {
+	if _, err := p.config.BlockCache().Get(ptr); err == nil {
+		// Already cached, nothing to do.
+		return
+	}
+
+	select {
+	case p.outstandingSem <- struct{}{}:
+	default:
+		p.droppedMeter.Mark(1)
+		return
+	}
+
+	tlfID := kmd.TlfID()
+	ctx := p.getTlfContext(tlfID)
+	if ctx == nil {
+		<-p.outstandingSem
+		return
+	}
+	p.requestedMeter.Mark(1)
+	errCh := p.retriever.Request(ctx, priority, kmd, ptr, block)
+	go func() {
+		defer p.inFlight.Done()
+		defer func() { <-p.outstandingSem }()
+		err := <-errCh
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			p.canceledMeter.Mark(1)
+			return
+		default:
+			p.debugf(ctx, "Prefetch of %v failed: %v", ptr, err)
+			p.failedMeter.Mark(1)
+			return
+		}
+		err = p.config.BlockCache().Put(ptr, tlfID, block, TransientEntry)
+		if err != nil {
+			p.debugf(ctx, "Couldn't cache prefetched block %v: %v",
+				ptr, err)
+			p.failedMeter.Mark(1)
+			return
+		}
+		p.completedMeter.Mark(1)
+	}()
+}
+
+func (p *blockPrefetcher) prefetchIndirectDirBlock(
+	b *DirBlock, kmd KeyMetadata) {
+	// All the children are needed to assemble the directory, so
+	// prefetch them all, just below the priority of an on-demand
+	// request (which keeps them from triggering more prefetches).
+	for _, ptr := range b.IPtrs {
+		p.request(defaultOnDemandRequestPriority-1, kmd,
+			ptr.BlockPointer, NewDirBlock())
+	}
+}
+
+func (p *blockPrefetcher) prefetchDirBlock(b *DirBlock, kmd KeyMetadata) {
+	for _, entry := range b.Children {
+		if entry.Type != Dir {
+			continue
+		}
+		p.request(dirEntryPrefetchPriority, kmd, entry.BlockPointer,
+			NewDirBlock())
+	}
+}
+
+// PrefetchAfterBlockRetrieved implements the Prefetcher interface for
+// blockPrefetcher.
+func (p *blockPrefetcher) PrefetchAfterBlockRetrieved(
+	b Block, kmd KeyMetadata) {
+	// Which children of an indirect file block are worth
+	// prefetching depends on where the file is being read, so
+	// that's left to PrefetchFileBlocks.
+	if b, ok := b.(*DirBlock); ok {
+		if b.IsInd {
+			p.prefetchIndirectDirBlock(b, kmd)
+		} else {
+			p.prefetchDirBlock(b, kmd)
+		}
+	}
+}
+
+// PrefetchFileBlocks implements the Prefetcher interface for
+// blockPrefetcher.
+func (p *blockPrefetcher) PrefetchFileBlocks(
+	b *FileBlock, off int64, kmd KeyMetadata) {
+	if !b.IsInd {
+		return
+	}
+	// Find the child containing off; the first child always
+	// starts at the beginning of b's range.
+	start := 0
+	for i, ptr := range b.IPtrs {
+		if ptr.Off > off {
+			break
+		}
+		start = i
+	}
+	end := start + p.indirectCount
+	if end > len(b.IPtrs) {
+		end = len(b.IPtrs)
+	}
+	for _, ptr := range b.IPtrs[start:end] {
+		p.request(fileIndirectBlockPrefetchPriority, kmd,
+			ptr.BlockPointer, NewFileBlock())
+	}
+}
+
+// CancelTlfPrefetches implements the Prefetcher interface for
+// blockPrefetcher.
+func (p *blockPrefetcher) CancelTlfPrefetches(tlfID tlf.ID) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if cancel, ok := p.tlfCancels[tlfID]; ok {
+		cancel()
+		delete(p.tlfCtxs, tlfID)
+		delete(p.tlfCancels, tlfID)
+	}
+}
+
+// Shutdown implements the Prefetcher interface for blockPrefetcher.
+func (p *blockPrefetcher) Shutdown() <-chan struct{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.isShutdown {
+		p.isShutdown = true
+		p.cancelFunc()
+	}
+	doneCh := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(doneCh)
+	}()
+	return doneCh
+}
@@ -0,0 +1,214 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscodec"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testPrefetcherConfig struct {
+	t        *testing.T
+	bcache   BlockCache
+	registry metrics.Registry
+}
+
+func (c testPrefetcherConfig) BlockCache() BlockCache {
+	return c.bcache
+}
+
+func (c testPrefetcherConfig) MetricsRegistry() metrics.Registry {
+	return c.registry
+}
+
+func (c testPrefetcherConfig) MakeLogger(module string) logger.Logger {
+	return logger.NewTestLogger(c.t)
+}
+
+func initPrefetcherTest(t *testing.T) (*blockRetrievalQueue,
+	*fakeBlockGetter, *blockRetrievalWorker, *blockPrefetcher,
+	testPrefetcherConfig) {
+	config := testPrefetcherConfig{
+		t:        t,
+		bcache:   NewBlockCacheStandard(10, 1<<20),
+		registry: metrics.NewRegistry(),
+	}
+	q := newBlockRetrievalQueue(1, kbfscodec.NewMsgpack())
+	require.NotNil(t, q)
+	p := newBlockPrefetcher(q, config)
+	q.prefetcher = p
+	bg := newFakeBlockGetter()
+	w := newBlockRetrievalWorker(bg, q)
+	require.NotNil(t, w)
+	return q, bg, w, p, config
+}
+
+func shutdownPrefetcherTest(q *blockRetrievalQueue, w *blockRetrievalWorker,
+	p *blockPrefetcher) {
+	<-p.Shutdown()
+	q.Shutdown()
+	w.Shutdown()
+}
+
+func prefetcherMeterCount(config testPrefetcherConfig, name string) int64 {
+	return metrics.GetOrRegisterMeter(
+		"BlockPrefetcher."+name, config.registry).Count()
+}
+
+func TestPrefetcherDirBlock(t *testing.T) {
+	t.Log("Test that child directories of a dir block are prefetched.")
+	q, bg, w, p, config := initPrefetcherTest(t)
+	defer shutdownPrefetcherTest(q, w, p)
+
+	dirPtr := makeFakeBlockPointer(t)
+	subdirPtr := makeFakeBlockPointer(t)
+	filePtr := makeFakeBlockPointer(t)
+	dir := NewDirBlock().(*DirBlock)
+	dir.Children["a"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: subdirPtr},
+		EntryInfo: EntryInfo{Type: Dir},
+	}
+	dir.Children["b"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: filePtr},
+		EntryInfo: EntryInfo{Type: File},
+	}
+	subdir := NewDirBlock().(*DirBlock)
+	subdir.Children["c"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: makeFakeBlockPointer(t)},
+		EntryInfo: EntryInfo{Type: Dir},
+	}
+	dirCh := bg.setBlockToReturn(dirPtr, dir)
+	subdirCh := bg.setBlockToReturn(subdirPtr, subdir)
+	bg.setBlockToReturn(filePtr, makeFakeFileBlock(t))
+
+	block := NewDirBlock()
+	ch := q.Request(context.Background(), defaultOnDemandRequestPriority,
+		makeKMD(), dirPtr, block)
+	dirCh <- struct{}{}
+	require.NoError(t, <-ch)
+	require.Equal(t, dir, block)
+
+	// The worker now picks up the prefetch of the subdirectory.
+	subdirCh <- struct{}{}
+	<-p.Shutdown()
+
+	cached, err := config.bcache.Get(subdirPtr)
+	require.NoError(t, err)
+	require.Equal(t, subdir, cached)
+	_, err = config.bcache.Get(filePtr)
+	require.Error(t, err)
+	require.Equal(t, int64(1), prefetcherMeterCount(config, "Requested"))
+	require.Equal(t, int64(1), prefetcherMeterCount(config, "Completed"))
+}
+
+func TestPrefetcherIndirectFileBlock(t *testing.T) {
+	t.Log("Test that the children of an indirect file block are " +
+		"prefetched starting at the read offset, and not on retrieval.")
+	q, bg, w, p, config := initPrefetcherTest(t)
+	defer shutdownPrefetcherTest(q, w, p)
+	p.indirectCount = 2
+
+	topPtr := makeFakeBlockPointer(t)
+	top := NewFileBlock().(*FileBlock)
+	top.IsInd = true
+	var childPtrs []BlockPointer
+	var childChs []chan<- struct{}
+	var children []*FileBlock
+	for i := 0; i < 4; i++ {
+		ptr := makeFakeBlockPointer(t)
+		child := makeFakeFileBlock(t)
+		childPtrs = append(childPtrs, ptr)
+		children = append(children, child)
+		childChs = append(childChs, bg.setBlockToReturn(ptr, child))
+		top.IPtrs = append(top.IPtrs, IndirectFilePtr{
+			BlockInfo: BlockInfo{BlockPointer: ptr},
+			Off:       int64(i * 16),
+		})
+	}
+	topCh := bg.setBlockToReturn(topPtr, top)
+
+	kmd := makeKMD()
+	block := NewFileBlock()
+	ch := q.Request(context.Background(), defaultOnDemandRequestPriority,
+		kmd, topPtr, block)
+	topCh <- struct{}{}
+	require.NoError(t, <-ch)
+	require.Equal(t, int64(0), prefetcherMeterCount(config, "Requested"))
+
+	// A read in the middle of the second child prefetches it and
+	// the one after it.
+	p.PrefetchFileBlocks(top, 20, kmd)
+	childChs[1] <- struct{}{}
+	childChs[2] <- struct{}{}
+	<-p.Shutdown()
+
+	for i := 1; i < 3; i++ {
+		cached, err := config.bcache.Get(childPtrs[i])
+		require.NoError(t, err)
+		require.Equal(t, children[i].Contents, cached.(*FileBlock).Contents)
+	}
+	for _, i := range []int{0, 3} {
+		_, err := config.bcache.Get(childPtrs[i])
+		require.Error(t, err)
+	}
+	require.Equal(t, int64(2), prefetcherMeterCount(config, "Completed"))
+}
+
+func TestPrefetcherNoPrefetchForLowPriority(t *testing.T) {
+	t.Log("Test that prefetched blocks don't trigger more prefetches.")
+	q, bg, w, p, config := initPrefetcherTest(t)
+	defer shutdownPrefetcherTest(q, w, p)
+
+	dirPtr := makeFakeBlockPointer(t)
+	dir := NewDirBlock().(*DirBlock)
+	dir.Children["a"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: makeFakeBlockPointer(t)},
+		EntryInfo: EntryInfo{Type: Dir},
+	}
+	dirCh := bg.setBlockToReturn(dirPtr, dir)
+
+	ch := q.Request(context.Background(), dirEntryPrefetchPriority,
+		makeKMD(), dirPtr, NewDirBlock())
+	dirCh <- struct{}{}
+	require.NoError(t, <-ch)
+	<-p.Shutdown()
+	require.Equal(t, int64(0), prefetcherMeterCount(config, "Requested"))
+}
+
+func TestPrefetcherCancelTlf(t *testing.T) {
+	t.Log("Test that canceling a TLF's prefetches stops them.")
+	q, bg, w, p, config := initPrefetcherTest(t)
+	defer shutdownPrefetcherTest(q, w, p)
+
+	dirPtr := makeFakeBlockPointer(t)
+	subdirPtr := makeFakeBlockPointer(t)
+	dir := NewDirBlock().(*DirBlock)
+	dir.Children["a"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: subdirPtr},
+		EntryInfo: EntryInfo{Type: Dir},
+	}
+	dirCh := bg.setBlockToReturn(dirPtr, dir)
+	// Never unblock the subdir fetch.
+	bg.setBlockToReturn(subdirPtr, NewDirBlock())
+
+	kmd := makeKMD()
+	ch := q.Request(context.Background(), defaultOnDemandRequestPriority,
+		kmd, dirPtr, NewDirBlock())
+	dirCh <- struct{}{}
+	require.NoError(t, <-ch)
+
+	p.CancelTlfPrefetches(kmd.TlfID())
+	<-p.Shutdown()
+
+	_, err := config.bcache.Get(subdirPtr)
+	require.Error(t, err)
+	require.Equal(t, int64(1), prefetcherMeterCount(config, "Requested"))
+	require.Equal(t, int64(1), prefetcherMeterCount(config, "Canceled"))
+}
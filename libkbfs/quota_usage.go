@@ -0,0 +1,110 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// EventuallyConsistentQuotaUsage keeps track of the current user's
+// quota usage, in a way that lets callers accept slightly stale
+// data in exchange for fewer calls to the block server.  This is
+// useful for things like file system statistics, which can be
+// requested very frequently by the OS.
+type EventuallyConsistentQuotaUsage struct {
+	config Config
+	log    logger.Logger
+
+	// fetchLock makes sure only one caller fetches from the block
+	// server at a time; everyone else waiting on it can use the
+	// result.
+	fetchLock sync.Mutex
+
+	lock        sync.RWMutex
+	usageBytes  int64
+	limitBytes  int64
+	lastUpdated time.Time
+}
+
+// NewEventuallyConsistentQuotaUsage creates a new
+// EventuallyConsistentQuotaUsage object.
+func NewEventuallyConsistentQuotaUsage(
+	config Config, loggerSuffix string) *EventuallyConsistentQuotaUsage {
+	return &EventuallyConsistentQuotaUsage{
+		config: config,
+		log:    config.MakeLogger("ECQU-" + loggerSuffix),
+	}
+}
+
+func (q *EventuallyConsistentQuotaUsage) getCached(
+	staleTolerance time.Duration) (
+	usageBytes, limitBytes int64, ok bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.lastUpdated.IsZero() ||
+		q.config.Clock().Now().Sub(q.lastUpdated) > staleTolerance {
+		return 0, 0, false
+	}
+	return q.usageBytes, q.limitBytes, true
+}
+
+func (q *EventuallyConsistentQuotaUsage) fetch(ctx context.Context) (
+	usageBytes, limitBytes int64, err error) {
+	quotaInfo, err := q.config.BlockServer().GetUserQuotaInfo(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	limitBytes = quotaInfo.Limit
+	if quotaInfo.Total != nil {
+		usageBytes = quotaInfo.Total.Bytes[UsageWrite]
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.usageBytes = usageBytes
+	q.limitBytes = limitBytes
+	q.lastUpdated = q.config.Clock().Now()
+	return usageBytes, limitBytes, nil
+}
+
+// Get returns the current user's quota usage and limit, in bytes.
+// If the cached values were fetched within staleTolerance, they are
+// returned right away; otherwise they are fetched from the block
+// server first.  If the fetch fails but there are older cached
+// values, those are returned instead of an error.
+func (q *EventuallyConsistentQuotaUsage) Get(
+	ctx context.Context, staleTolerance time.Duration) (
+	usageBytes, limitBytes int64, err error) {
+	usageBytes, limitBytes, ok := q.getCached(staleTolerance)
+	if ok {
+		return usageBytes, limitBytes, nil
+	}
+
+	q.fetchLock.Lock()
+	defer q.fetchLock.Unlock()
+	// Someone else might have fetched while we were waiting.
+	usageBytes, limitBytes, ok = q.getCached(staleTolerance)
+	if ok {
+		return usageBytes, limitBytes, nil
+	}
+
+	usageBytes, limitBytes, err = q.fetch(ctx)
+	if err == nil {
+		return usageBytes, limitBytes, nil
+	}
+
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.lastUpdated.IsZero() {
+		return 0, 0, err
+	}
+	q.log.CDebugf(ctx, "Couldn't refresh quota usage, using values "+
+		"from %s: %v", q.lastUpdated, err)
+	return q.usageBytes, q.limitBytes, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestEventuallyConsistentQuotaUsageGet(t *testing.T) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl := gomock.NewController(ctr)
+	config := NewConfigMock(mockCtrl, ctr)
+	defer mockCtrl.Finish()
+	defer config.ctr.CheckForFailures()
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	ctx := context.Background()
+
+	q := NewEventuallyConsistentQuotaUsage(config, "test")
+
+	// The first call has to fetch.
+	info := NewUserQuotaInfo()
+	info.Limit = 100
+	info.Total.Bytes[UsageWrite] = 10
+	config.mockBserv.EXPECT().GetUserQuotaInfo(gomock.Any()).Return(info, nil)
+	usage, limit, err := q.Get(ctx, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), usage)
+	require.Equal(t, int64(100), limit)
+
+	// Within the tolerance, the cached values are used.
+	clock.Add(30 * time.Second)
+	usage, limit, err = q.Get(ctx, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), usage)
+	require.Equal(t, int64(100), limit)
+
+	// A smaller tolerance forces a refresh.
+	info2 := NewUserQuotaInfo()
+	info2.Limit = 100
+	info2.Total.Bytes[UsageWrite] = 20
+	config.mockBserv.EXPECT().GetUserQuotaInfo(gomock.Any()).Return(info2, nil)
+	usage, _, err = q.Get(ctx, 10*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), usage)
+
+	// A failed refresh falls back to the stale values.
+	clock.Add(2 * time.Minute)
+	config.mockBserv.EXPECT().GetUserQuotaInfo(gomock.Any()).Return(
+		nil, errors.New("fake error"))
+	usage, limit, err = q.Get(ctx, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), usage)
+	require.Equal(t, int64(100), limit)
+}
+
+func TestEventuallyConsistentQuotaUsageGetError(t *testing.T) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl := gomock.NewController(ctr)
+	config := NewConfigMock(mockCtrl, ctr)
+	defer mockCtrl.Finish()
+	defer config.ctr.CheckForFailures()
+	config.SetClock(newTestClockNow())
+	ctx := context.Background()
+
+	q := NewEventuallyConsistentQuotaUsage(config, "test")
+
+	// With nothing cached, errors are returned.
+	expectedErr := errors.New("fake error")
+	config.mockBserv.EXPECT().GetUserQuotaInfo(gomock.Any()).Return(
+		nil, expectedErr)
+	_, _, err := q.Get(ctx, time.Minute)
+	require.Equal(t, expectedErr, err)
+}
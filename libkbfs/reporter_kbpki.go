@@ -151,6 +151,8 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 	case NoSigChainError:
 		code = keybase1.FSErrorType_NO_SIG_CHAIN
 		params[errorParamUsername] = e.User.String()
+	case MDRollbackError, MDForkError:
+		code = keybase1.FSErrorType_BAD_FOLDER
 	case MDServerErrorTooManyFoldersCreated:
 		code = keybase1.FSErrorType_TOO_MANY_FOLDERS
 		params[errorParamFolderLimit] = strconv.FormatUint(e.Limit, 10)
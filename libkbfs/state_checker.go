@@ -48,6 +48,20 @@ func (sc *StateChecker) findAllFileBlocks(ctx context.Context,
 	for _, childPtr := range fblock.IPtrs {
 		blockSizes[childPtr.BlockPointer] = childPtr.EncodedSize
 		p := parentPath.ChildPath(file.tailName(), childPtr.BlockPointer)
+		if !childPtr.pointsToIndirectBlock() {
+			// This must be a direct block.
+			child, err := ops.blocks.GetFileBlockForReading(ctx, lState,
+				kmd, childPtr.BlockPointer, file.Branch, p)
+			if err != nil {
+				return err
+			}
+			if child.IsInd {
+				return fmt.Errorf("Indirect child block %v of %v "+
+					"isn't marked as indirect", childPtr.BlockPointer,
+					file.tailPointer())
+			}
+			continue
+		}
 		err := sc.findAllFileBlocks(ctx, lState, ops, kmd, p, blockSizes)
 		if err != nil {
 			return err
@@ -68,8 +82,15 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 		return err
 	}
 
+	// An indirect directory also references its child blocks.
+	for _, iptr := range dblock.IPtrs {
+		blockSizes[iptr.BlockPointer] = iptr.EncodedSize
+	}
+
 	for name, de := range dblock.Children {
-		if de.Type == Sym {
+		if de.Type == Sym || de.isHardLink() {
+			// Hard links share the blocks of their target, which
+			// is found under the hard links directory.
 			continue
 		}
 
@@ -239,6 +239,9 @@ func ConfigAsUser(config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *C
 	crypto := NewCryptoLocal(config.Codec(), signingKey, cryptPrivateKey)
 	c.SetCrypto(crypto)
 	c.noBGFlush = config.noBGFlush
+	c.SetTrashRetention(config.TrashRetention())
+	c.SetConflictHoldTimeout(config.ConflictHoldTimeout())
+	c.SetBlockCompression(config.BlockCompression())
 
 	if s, ok := config.BlockServer().(*BlockServerRemote); ok {
 		blockServer := NewBlockServerRemote(c, s.RemoteAddress(), env.NewContext())
@@ -267,6 +270,8 @@ func ConfigAsUser(config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *C
 	}
 	c.SetMDServer(mdServer)
 	c.SetKeyServer(keyServer)
+	// The Merkle tree is global, so share it too.
+	c.SetMerkleSource(config.MerkleSource())
 
 	// Keep track of all the other configs in a shared slice.
 	c.allKnownConfigsForTesting = config.allKnownConfigsForTesting
@@ -0,0 +1,720 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// A TLF archive is a portable copy of the merged history of a TLF:
+// its signed MD revisions, the key bundles they refer to, and the
+// encrypted blocks reachable from them.  Nothing in it is decrypted,
+// so it's as safe to store as the data on the servers.  It also
+// holds the exporting device's server halves of the TLF crypt keys,
+// since the key server won't hand out anyone else's; other devices
+// will need to be rekeyed after an import.
+//
+// An archive starts with tlfArchiveMagic, followed by a sequence of
+// records, each encoded with the config's codec and prefixed by its
+// length as a big-endian uint32.  The first record is a header, the
+// last is a trailer, and in between are all the MD revisions in
+// order (each followed by any new key halves), then the blocks.
+const tlfArchiveMagic = "KBFS TLF archive\n"
+
+// tlfArchiveVersion is the version of the archive format written by
+// ExportTlfArchive.
+const tlfArchiveVersion = 1
+
+// maxTlfArchiveRecordSize bounds the size of a single record, to
+// catch corrupt archives before allocating a huge buffer.
+const maxTlfArchiveRecordSize = 64 << 20
+
+// tlfArchiveHeader is the first record of a TLF archive.
+type tlfArchiveHeader struct {
+	Version int    `codec:"v"`
+	TlfID   tlf.ID `codec:"t"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// tlfArchiveMD is a single signed MD revision.  The key bundles are
+// only included when they differ from those of the previous revision.
+type tlfArchiveMD struct {
+	Version         MetadataVer           `codec:"v"`
+	Encoded         []byte                `codec:"m"`
+	WriterKeyBundle *TLFWriterKeyBundleV3 `codec:"w,omitempty"`
+	ReaderKeyBundle *TLFReaderKeyBundleV3 `codec:"r,omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// tlfArchiveKeyHalf is the server half of a TLF crypt key for a
+// single device.
+type tlfArchiveKeyHalf struct {
+	UID        keybase1.UID                     `codec:"u"`
+	KID        keybase1.KID                     `codec:"k"`
+	ServerHalf kbfscrypto.TLFCryptKeyServerHalf `codec:"s"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// tlfArchiveBlock is a single reference to a block.  The encrypted
+// block data is only included in the first reference to each block.
+// References that aren't reachable from the latest revision are
+// marked as archived.
+type tlfArchiveBlock struct {
+	ID         BlockID                            `codec:"i"`
+	Context    BlockContext                       `codec:"c"`
+	Archived   bool                               `codec:"a,omitempty"`
+	Buf        []byte                             `codec:"b,omitempty"`
+	ServerHalf kbfscrypto.BlockCryptKeyServerHalf `codec:"s"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// tlfArchiveTrailer is the last record of a TLF archive, and is used
+// to detect truncated archives.
+type tlfArchiveTrailer struct {
+	MDs       int `codec:"m"`
+	KeyHalves int `codec:"k"`
+	Blocks    int `codec:"b"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// tlfArchiveRecord holds exactly one of its fields.
+type tlfArchiveRecord struct {
+	Header  *tlfArchiveHeader  `codec:"h,omitempty"`
+	MD      *tlfArchiveMD      `codec:"m,omitempty"`
+	KeyHalf *tlfArchiveKeyHalf `codec:"k,omitempty"`
+	Block   *tlfArchiveBlock   `codec:"b,omitempty"`
+	Trailer *tlfArchiveTrailer `codec:"t,omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// TlfArchiveStats summarizes the contents of a TLF archive.
+type TlfArchiveStats struct {
+	TlfID     tlf.ID
+	MDs       int
+	KeyHalves int
+	// Blocks counts block references; each block's data is only
+	// stored once, no matter how many references it has.
+	Blocks int
+	// MissingBlocks counts blocks that were referenced by old
+	// revisions, but had already been garbage-collected by the time
+	// of the export.  Those revisions can't be fully read back.
+	MissingBlocks int
+}
+
+func writeTlfArchiveRecord(
+	config Config, w io.Writer, record tlfArchiveRecord) error {
+	buf, err := config.Codec().Encode(record)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(buf)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func readTlfArchiveRecord(config Config, r io.Reader) (
+	record tlfArchiveRecord, err error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		if err == io.EOF {
+			return tlfArchiveRecord{}, InvalidTlfArchiveError{
+				"archive is truncated"}
+		}
+		return tlfArchiveRecord{}, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxTlfArchiveRecordSize {
+		return tlfArchiveRecord{}, InvalidTlfArchiveError{
+			fmt.Sprintf("record of %d bytes is too big", n)}
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return tlfArchiveRecord{}, InvalidTlfArchiveError{
+				"archive is truncated"}
+		}
+		return tlfArchiveRecord{}, err
+	}
+	err = config.Codec().Decode(buf, &record)
+	if err != nil {
+		return tlfArchiveRecord{}, err
+	}
+	return record, nil
+}
+
+// isGarbageCollectedBlockError returns true if err means that the
+// requested block reference no longer exists on the block server.
+func isGarbageCollectedBlockError(err error) bool {
+	switch err.(type) {
+	case BServerErrorBlockNonExistent, BServerErrorBlockDeleted,
+		BServerErrorNonceNonExistent:
+		return true
+	}
+	return false
+}
+
+// tlfArchiveExporter holds the state of a single export.
+type tlfArchiveExporter struct {
+	config Config
+	w      io.Writer
+	bg     *realBlockGetter
+	stats  TlfArchiveStats
+
+	// exportedIDs is the set of blocks whose data has already
+	// been written.
+	exportedIDs map[BlockID]bool
+	// exportedKeyGens is the set of key generations whose server
+	// halves have already been written.
+	exportedKeyGens map[KeyGen]bool
+	// seenRefs is the set of block references that have already
+	// been written (or found to be missing).
+	seenRefs map[BlockRef]bool
+}
+
+// exportKeyHalf writes the current device's server half of the
+// latest TLF crypt key of the given revision, if it hasn't been
+// written yet.  Each key generation is the latest one of some
+// revision, so this covers all of them.
+func (e *tlfArchiveExporter) exportKeyHalf(ctx context.Context,
+	rmds *RootMetadataSigned, extra ExtraMetadata) error {
+	if e.stats.TlfID.IsPublic() {
+		return nil
+	}
+	keyGen := rmds.MD.LatestKeyGeneration()
+	if keyGen < FirstValidKeyGen || e.exportedKeyGens[keyGen] {
+		return nil
+	}
+	e.exportedKeyGens[keyGen] = true
+
+	_, uid, err := e.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := e.config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, serverHalfID, found, err := rmds.MD.GetTLFCryptKeyParams(
+		keyGen, uid, key, extra)
+	if err != nil {
+		return err
+	} else if !found {
+		// This device can't read this key generation, so
+		// there's nothing to export.
+		return nil
+	}
+	serverHalf, err := e.config.KeyOps().GetTLFCryptKeyServerHalf(
+		ctx, serverHalfID, key)
+	if err != nil {
+		return err
+	}
+	err = writeTlfArchiveRecord(e.config, e.w, tlfArchiveRecord{
+		KeyHalf: &tlfArchiveKeyHalf{
+			UID:        uid,
+			KID:        key.KID(),
+			ServerHalf: serverHalf,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	e.stats.KeyHalves++
+	return nil
+}
+
+// exportMDs writes all the merged MD revisions of the TLF, and
+// returns the latest one.
+func (e *tlfArchiveExporter) exportMDs(ctx context.Context) (
+	head MetadataRevision, err error) {
+	var wkbID TLFWriterKeyBundleID
+	var rkbID TLFReaderKeyBundleID
+	var extra ExtraMetadata
+	for start := MetadataRevisionInitial; ; start += maxMDsAtATime {
+		rmdses, err := e.config.MDServer().GetRange(ctx, e.stats.TlfID,
+			NullBranchID, Merged, start, start+maxMDsAtATime-1)
+		if err != nil {
+			return MetadataRevisionUninitialized, err
+		}
+		for _, rmds := range rmdses {
+			encoded, err := EncodeRootMetadataSigned(e.config.Codec(), rmds)
+			if err != nil {
+				return MetadataRevisionUninitialized, err
+			}
+			amd := &tlfArchiveMD{Version: rmds.Version(), Encoded: encoded}
+
+			newWkbID := rmds.MD.GetTLFWriterKeyBundleID()
+			newRkbID := rmds.MD.GetTLFReaderKeyBundleID()
+			// Pre-v3 metadata embeds its key bundles.
+			if (newWkbID != TLFWriterKeyBundleID{}) &&
+				(newWkbID != wkbID || newRkbID != rkbID) {
+				amd.WriterKeyBundle, amd.ReaderKeyBundle, err =
+					e.config.MDServer().GetKeyBundles(
+						ctx, e.stats.TlfID, newWkbID, newRkbID)
+				if err != nil {
+					return MetadataRevisionUninitialized, err
+				}
+				extra, err = NewExtraMetadataV3(
+					amd.WriterKeyBundle, amd.ReaderKeyBundle)
+				if err != nil {
+					return MetadataRevisionUninitialized, err
+				}
+				wkbID, rkbID = newWkbID, newRkbID
+			}
+
+			err = writeTlfArchiveRecord(
+				e.config, e.w, tlfArchiveRecord{MD: amd})
+			if err != nil {
+				return MetadataRevisionUninitialized, err
+			}
+			e.stats.MDs++
+			head = rmds.MD.RevisionNumber()
+
+			if err := e.exportKeyHalf(ctx, rmds, extra); err != nil {
+				return MetadataRevisionUninitialized, err
+			}
+		}
+		if len(rmdses) < maxMDsAtATime {
+			break
+		}
+	}
+	if head == MetadataRevisionUninitialized {
+		return MetadataRevisionUninitialized, NoSuchMDError{
+			e.stats.TlfID, MetadataRevisionInitial, NullBranchID}
+	}
+	return head, nil
+}
+
+// exportBlock writes the given block reference, and then all the
+// references reachable from it that haven't been written yet.
+func (e *tlfArchiveExporter) exportBlock(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer, isDir, archived bool) error {
+	if e.seenRefs[ptr.Ref()] {
+		// The whole subtree has already been written.
+		return nil
+	}
+	e.seenRefs[ptr.Ref()] = true
+
+	buf, serverHalf, err := e.bg.getBlockData(ctx, e.stats.TlfID, ptr)
+	if isGarbageCollectedBlockError(err) {
+		e.stats.MissingBlocks++
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var block Block
+	if isDir {
+		block = NewDirBlock()
+	} else {
+		block = NewFileBlock()
+	}
+	err = e.bg.assembleBlock(ctx, kmd, ptr, block, buf, serverHalf)
+	if err != nil {
+		return err
+	}
+
+	ab := &tlfArchiveBlock{
+		ID:         ptr.ID,
+		Context:    ptr.BlockContext,
+		Archived:   archived,
+		ServerHalf: serverHalf,
+	}
+	if !e.exportedIDs[ptr.ID] {
+		ab.Buf = buf
+		e.exportedIDs[ptr.ID] = true
+	}
+	err = writeTlfArchiveRecord(e.config, e.w, tlfArchiveRecord{Block: ab})
+	if err != nil {
+		return err
+	}
+	e.stats.Blocks++
+
+	switch b := block.(type) {
+	case *DirBlock:
+		for _, iptr := range b.IPtrs {
+			err := e.exportBlock(ctx, kmd, iptr.BlockPointer, true, archived)
+			if err != nil {
+				return err
+			}
+		}
+		for _, de := range b.Children {
+			if de.Type == Sym || !de.BlockPointer.IsValid() {
+				// Symlinks and hard links have no blocks of
+				// their own.
+				continue
+			}
+			err := e.exportBlock(
+				ctx, kmd, de.BlockPointer, de.Type == Dir, archived)
+			if err != nil {
+				return err
+			}
+		}
+	case *FileBlock:
+		for _, iptr := range b.IPtrs {
+			err := e.exportBlock(
+				ctx, kmd, iptr.BlockPointer, false, archived)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportBlocks writes all the blocks reachable from the merged
+// revisions up to head.  It walks the revisions backwards, so that
+// the references reachable from head are written first, and the
+// rest can be marked as archived.
+func (e *tlfArchiveExporter) exportBlocks(
+	ctx context.Context, head MetadataRevision) error {
+	archived := false
+	for end := head; end >= MetadataRevisionInitial; end -= maxMDsAtATime {
+		start := end - maxMDsAtATime + 1
+		if start < MetadataRevisionInitial {
+			start = MetadataRevisionInitial
+		}
+		irmds, err := getMDRange(ctx, e.config, e.stats.TlfID,
+			NullBranchID, start, end, Merged)
+		if err != nil {
+			return err
+		}
+		for i := len(irmds) - 1; i >= 0; i-- {
+			irmd := irmds[i]
+			rootPtr := irmd.Data().Dir.BlockPointer
+			if rootPtr.IsValid() {
+				err := e.exportBlock(ctx, irmd, rootPtr, true, archived)
+				if err != nil {
+					return err
+				}
+			}
+			// Unembedded block changes are referenced by the MD
+			// itself, so they're always live.
+			if infoPtr := irmd.data.cachedChanges.Info.BlockPointer; infoPtr.IsValid() {
+				err := e.exportBlock(ctx, irmd, infoPtr, false, false)
+				if err != nil {
+					return err
+				}
+			}
+			archived = true
+		}
+	}
+	return nil
+}
+
+// ExportTlfArchive writes an archive of the merged history of the
+// given TLF to w, reading everything directly from the MD and block
+// servers.  The archive can be restored into other servers with
+// ImportTlfArchive.
+func ExportTlfArchive(ctx context.Context, config Config, tlfID tlf.ID,
+	w io.Writer) (stats TlfArchiveStats, err error) {
+	e := &tlfArchiveExporter{
+		config:          config,
+		w:               w,
+		bg:              &realBlockGetter{config: config},
+		stats:           TlfArchiveStats{TlfID: tlfID},
+		exportedIDs:     make(map[BlockID]bool),
+		exportedKeyGens: make(map[KeyGen]bool),
+		seenRefs:        make(map[BlockRef]bool),
+	}
+
+	if _, err := io.WriteString(w, tlfArchiveMagic); err != nil {
+		return TlfArchiveStats{}, err
+	}
+	err = writeTlfArchiveRecord(config, w, tlfArchiveRecord{
+		Header: &tlfArchiveHeader{Version: tlfArchiveVersion, TlfID: tlfID},
+	})
+	if err != nil {
+		return TlfArchiveStats{}, err
+	}
+
+	head, err := e.exportMDs(ctx)
+	if err != nil {
+		return TlfArchiveStats{}, err
+	}
+	err = e.exportBlocks(ctx, head)
+	if err != nil {
+		return TlfArchiveStats{}, err
+	}
+
+	err = writeTlfArchiveRecord(config, w, tlfArchiveRecord{
+		Trailer: &tlfArchiveTrailer{
+			MDs:       e.stats.MDs,
+			KeyHalves: e.stats.KeyHalves,
+			Blocks:    e.stats.Blocks,
+		},
+	})
+	if err != nil {
+		return TlfArchiveStats{}, err
+	}
+	return e.stats, nil
+}
+
+// pendingArchiveBlock is a block whose data has been read from an
+// archive, but which can't be put yet because its initial reference
+// hasn't been seen.
+type pendingArchiveBlock struct {
+	buf        []byte
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	refs       []*tlfArchiveBlock
+}
+
+// tlfArchiveImporter holds the state of a single import.
+type tlfArchiveImporter struct {
+	config Config
+	stats  TlfArchiveStats
+
+	wkb *TLFWriterKeyBundleV3
+	rkb *TLFReaderKeyBundleV3
+
+	putIDs   map[BlockID]bool
+	pending  map[BlockID]*pendingArchiveBlock
+	archived map[BlockID][]BlockContext
+}
+
+func (i *tlfArchiveImporter) importMD(
+	ctx context.Context, amd *tlfArchiveMD) error {
+	rmds, err := DecodeRootMetadataSigned(i.config.Codec(), i.stats.TlfID,
+		amd.Version, i.config.MetadataVersion(), amd.Encoded, time.Time{})
+	if err != nil {
+		return err
+	}
+	if rmds.MD.TlfID() != i.stats.TlfID {
+		return InvalidTlfArchiveError{fmt.Sprintf(
+			"revision %d belongs to TLF %s",
+			rmds.MD.RevisionNumber(), rmds.MD.TlfID())}
+	}
+
+	if amd.WriterKeyBundle != nil {
+		i.wkb, i.rkb = amd.WriterKeyBundle, amd.ReaderKeyBundle
+	}
+	var extra ExtraMetadata
+	if rmds.Version() >= SegregatedKeyBundlesVer {
+		extra, err = NewExtraMetadataV3(i.wkb, i.rkb)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The servers check this too, but checking here gives a better
+	// error for a corrupt archive.
+	err = rmds.IsValidAndSigned(i.config.Codec(), i.config.Crypto(), extra)
+	if err != nil {
+		return err
+	}
+
+	// Local servers can take revisions written by other devices
+	// directly, but remote servers will only accept revisions
+	// written by the current device.
+	if md, ok := i.config.MDServer().(mdServerLocal); ok {
+		err = md.importMD(ctx, rmds, extra)
+	} else {
+		err = i.config.MDServer().Put(ctx, rmds, extra)
+	}
+	if err != nil {
+		return err
+	}
+	i.stats.MDs++
+	return nil
+}
+
+func (i *tlfArchiveImporter) importKeyHalf(
+	ctx context.Context, akh *tlfArchiveKeyHalf) error {
+	err := i.config.KeyOps().PutTLFCryptKeyServerHalves(ctx,
+		map[keybase1.UID]map[keybase1.KID]kbfscrypto.TLFCryptKeyServerHalf{
+			akh.UID: {akh.KID: akh.ServerHalf},
+		})
+	if err != nil {
+		return err
+	}
+	i.stats.KeyHalves++
+	return nil
+}
+
+// addRef adds the given reference to a block that's already been
+// put.
+func (i *tlfArchiveImporter) addRef(
+	ctx context.Context, ab *tlfArchiveBlock) error {
+	err := i.config.BlockServer().AddBlockReference(
+		ctx, i.stats.TlfID, ab.ID, ab.Context)
+	if err != nil {
+		return err
+	}
+	if ab.Archived {
+		i.archived[ab.ID] = append(i.archived[ab.ID], ab.Context)
+	}
+	return nil
+}
+
+// putBlock puts the given block data with the given initial
+// reference, followed by any other pending references to it.
+func (i *tlfArchiveImporter) putBlock(ctx context.Context, id BlockID,
+	initial *tlfArchiveBlock, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	err := i.config.BlockServer().Put(
+		ctx, i.stats.TlfID, id, initial.Context, buf, serverHalf)
+	if err != nil {
+		return err
+	}
+	i.putIDs[id] = true
+	if initial.Archived {
+		i.archived[id] = append(i.archived[id], initial.Context)
+	}
+
+	if p, ok := i.pending[id]; ok {
+		delete(i.pending, id)
+		for _, ab := range p.refs {
+			if err := i.addRef(ctx, ab); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *tlfArchiveImporter) importBlock(
+	ctx context.Context, ab *tlfArchiveBlock) error {
+	if ab.Buf != nil {
+		err := i.config.Crypto().VerifyBlockID(ab.Buf, ab.ID)
+		if err != nil {
+			return err
+		}
+	}
+	i.stats.Blocks++
+
+	if i.putIDs[ab.ID] {
+		return i.addRef(ctx, ab)
+	}
+
+	p := i.pending[ab.ID]
+	if p == nil {
+		if ab.Buf == nil {
+			return InvalidTlfArchiveError{fmt.Sprintf(
+				"no data for block %s", ab.ID)}
+		}
+		p = &pendingArchiveBlock{buf: ab.Buf, serverHalf: ab.ServerHalf}
+	}
+
+	if ab.Context.GetRefNonce() == ZeroBlockRefNonce {
+		// Keep any references that arrived first.
+		i.pending[ab.ID] = p
+		return i.putBlock(ctx, ab.ID, ab, p.buf, p.serverHalf)
+	}
+	p.refs = append(p.refs, ab)
+	i.pending[ab.ID] = p
+	return nil
+}
+
+// flushPending puts the blocks whose initial references weren't in
+// the archive, because they'd already been removed from the source
+// server.  Each one gets a new initial reference, which is archived
+// since nothing refers to it.
+func (i *tlfArchiveImporter) flushPending(ctx context.Context) error {
+	for id, p := range i.pending {
+		initial := &tlfArchiveBlock{
+			ID:       id,
+			Context:  BlockContext{Creator: p.refs[0].Context.Creator},
+			Archived: true,
+		}
+		err := i.putBlock(ctx, id, initial, p.buf, p.serverHalf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportTlfArchive restores a TLF archive written by
+// ExportTlfArchive into the config's MD and block servers.  The TLF
+// keeps its ID, and the servers must not already have any revisions
+// of it.  Only local servers can import revisions written by devices
+// other than the current one, and only the exporting device will be
+// able to read the TLF until it's rekeyed.
+func ImportTlfArchive(ctx context.Context, config Config, r io.Reader) (
+	stats TlfArchiveStats, err error) {
+	magic := make([]byte, len(tlfArchiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic) != tlfArchiveMagic {
+		return TlfArchiveStats{}, InvalidTlfArchiveError{
+			"not a TLF archive"}
+	}
+
+	record, err := readTlfArchiveRecord(config, r)
+	if err != nil {
+		return TlfArchiveStats{}, err
+	}
+	if record.Header == nil {
+		return TlfArchiveStats{}, InvalidTlfArchiveError{"missing header"}
+	}
+	if record.Header.Version != tlfArchiveVersion {
+		return TlfArchiveStats{}, InvalidTlfArchiveError{fmt.Sprintf(
+			"unsupported version %d", record.Header.Version)}
+	}
+
+	i := &tlfArchiveImporter{
+		config:   config,
+		stats:    TlfArchiveStats{TlfID: record.Header.TlfID},
+		putIDs:   make(map[BlockID]bool),
+		pending:  make(map[BlockID]*pendingArchiveBlock),
+		archived: make(map[BlockID][]BlockContext),
+	}
+	for {
+		record, err := readTlfArchiveRecord(config, r)
+		if err != nil {
+			return TlfArchiveStats{}, err
+		}
+		switch {
+		case record.MD != nil:
+			err = i.importMD(ctx, record.MD)
+		case record.KeyHalf != nil:
+			err = i.importKeyHalf(ctx, record.KeyHalf)
+		case record.Block != nil:
+			err = i.importBlock(ctx, record.Block)
+		case record.Trailer != nil:
+			if record.Trailer.MDs != i.stats.MDs ||
+				record.Trailer.KeyHalves != i.stats.KeyHalves ||
+				record.Trailer.Blocks != i.stats.Blocks {
+				return TlfArchiveStats{}, InvalidTlfArchiveError{fmt.Sprintf(
+					"expected %d revisions, %d key halves and %d blocks, "+
+						"got %d, %d and %d", record.Trailer.MDs,
+					record.Trailer.KeyHalves, record.Trailer.Blocks,
+					i.stats.MDs, i.stats.KeyHalves, i.stats.Blocks)}
+			}
+			if err := i.flushPending(ctx); err != nil {
+				return TlfArchiveStats{}, err
+			}
+			if len(i.archived) > 0 {
+				err := config.BlockServer().ArchiveBlockReferences(
+					ctx, i.stats.TlfID, i.archived)
+				if err != nil {
+					return TlfArchiveStats{}, err
+				}
+			}
+			return i.stats, nil
+		default:
+			err = InvalidTlfArchiveError{"unknown record"}
+		}
+		if err != nil {
+			return TlfArchiveStats{}, err
+		}
+	}
+}
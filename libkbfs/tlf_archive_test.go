@@ -0,0 +1,110 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTlfArchiveExportImport(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// Both users write, so that the archive has revisions from more
+	// than one device, and user 2 removes a file so that some of
+	// the blocks are only referenced by old revisions.
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps1.CreateFile(ctx, dirA, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileB, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB)
+	require.NoError(t, err)
+	fileC, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileC, []byte("doomed"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileC)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "c")
+	require.NoError(t, err)
+	fileD, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "d", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileD, []byte("world"), 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileD)
+	require.NoError(t, err)
+
+	tlfID := rootNode2.GetFolderBranch().Tlf
+	var buf bytes.Buffer
+	exported, err := ExportTlfArchive(ctx, config1, tlfID, &buf)
+	require.NoError(t, err)
+	require.Equal(t, tlfID, exported.TlfID)
+	require.Equal(t, 0, exported.MissingBlocks)
+	require.Equal(t, 1, exported.KeyHalves)
+	head, err := config1.MDOps().GetForTLF(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, int(head.Revision()), exported.MDs)
+
+	// A truncated archive is rejected.
+	configTrunc := MakeTestConfigOrBust(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, configTrunc)
+	_, err = ImportTlfArchive(
+		ctx, configTrunc, bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	require.IsType(t, InvalidTlfArchiveError{}, err)
+
+	// Import into a fresh set of servers, and read it all back.
+	configImport := MakeTestConfigOrBust(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, configImport)
+	imported, err := ImportTlfArchive(
+		ctx, configImport, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, exported, imported)
+
+	rootNode := GetRootNodeOrBust(ctx, t, configImport, name, false)
+	require.Equal(t, tlfID, rootNode.GetFolderBranch().Tlf)
+	kbfsOps := configImport.KBFSOps()
+	for _, f := range []struct {
+		dir      string
+		name     string
+		contents string
+	}{{"a", "b", "hello"}, {"", "d", "world"}} {
+		dir := rootNode
+		if f.dir != "" {
+			dir, _, err = kbfsOps.Lookup(ctx, rootNode, f.dir)
+			require.NoError(t, err)
+		}
+		n, _, err := kbfsOps.Lookup(ctx, dir, f.name)
+		require.NoError(t, err)
+		data := make([]byte, len(f.contents)+1)
+		nr, err := kbfsOps.Read(ctx, n, data, 0)
+		require.NoError(t, err)
+		require.Equal(t, f.contents, string(data[:nr]))
+	}
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "c")
+	require.IsType(t, NoSuchNameError{}, err)
+
+	// The imported TLF is still writable.
+	fileE, _, err := kbfsOps.CreateFile(ctx, rootNode, "e", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileE)
+	require.NoError(t, err)
+}
@@ -0,0 +1,424 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/net/context"
+)
+
+// TlfChangeType indicates what happened to an entry in a TLF.
+type TlfChangeType int
+
+const (
+	// EntryCreated indicates a new file, directory, symlink or hard
+	// link.
+	EntryCreated TlfChangeType = iota
+	// EntryModified indicates an existing entry whose contents or
+	// attributes changed.
+	EntryModified
+	// EntryRemoved indicates an entry that was removed.
+	EntryRemoved
+	// EntryRenamed indicates an entry that was moved from OldPath to
+	// Path.
+	EntryRenamed
+	// ChangesReclaimed indicates a revision whose changes can't be
+	// determined anymore, because quota reclamation has deleted the
+	// blocks needed to find the paths it changed.  Its Path is empty.
+	ChangesReclaimed
+)
+
+func (t TlfChangeType) String() string {
+	switch t {
+	case EntryCreated:
+		return "created"
+	case EntryModified:
+		return "modified"
+	case EntryRemoved:
+		return "removed"
+	case EntryRenamed:
+		return "renamed"
+	case ChangesReclaimed:
+		return "reclaimed"
+	default:
+		return "<invalid TlfChangeType>"
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// TlfChangeType.
+func (t TlfChangeType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+// for TlfChangeType.
+func (t *TlfChangeType) UnmarshalText(text []byte) error {
+	for _, ct := range []TlfChangeType{
+		EntryCreated, EntryModified, EntryRemoved, EntryRenamed,
+		ChangesReclaimed} {
+		if string(text) == ct.String() {
+			*t = ct
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown TlfChangeType %q", text)
+}
+
+// TlfChange is a change to a single path in a TLF, made by a merged
+// revision.
+type TlfChange struct {
+	Revision  MetadataRevision
+	Writer    libkb.NormalizedUsername
+	LocalTime time.Time // reflects difference between server and local clock
+	Type      TlfChangeType
+	// Path and OldPath are relative to the TLF root.  OldPath is
+	// only set for renames.
+	Path    string
+	OldPath string `json:",omitempty"`
+}
+
+// opChangePaths returns the type of change made by the given op,
+// and the pointer of the directory (or, for writes, the file)
+// containing each path it changed, along with the name of each path
+// within that directory.  The second pointer and name are only set
+// for renames.  It returns false for ops that don't change any path.
+func opChangePaths(o op) (t TlfChangeType, dir BlockPointer, name string,
+	oldDir BlockPointer, oldName string, ok bool) {
+	switch realOp := o.(type) {
+	case *createOp:
+		return EntryCreated, realOp.Dir.Ref, realOp.NewName,
+			zeroPtr, "", true
+	case *rmOp:
+		return EntryRemoved, realOp.Dir.Ref, realOp.OldName,
+			zeroPtr, "", true
+	case *renameOp:
+		newDir := realOp.NewDir.Ref
+		if newDir == zeroPtr {
+			// A rename within a single directory.
+			newDir = realOp.OldDir.Ref
+		}
+		return EntryRenamed, newDir, realOp.NewName,
+			realOp.OldDir.Ref, realOp.OldName, true
+	case *syncOp:
+		return EntryModified, realOp.File.Ref, "", zeroPtr, "", true
+	case *setAttrOp:
+		return EntryModified, realOp.Dir.Ref, realOp.Name, zeroPtr, "", true
+	case *linkOp:
+		if realOp.Removed {
+			return EntryRemoved, realOp.Dir.Ref, realOp.Name,
+				zeroPtr, "", true
+		}
+		return EntryCreated, realOp.Dir.Ref, realOp.Name, zeroPtr, "", true
+	}
+	return 0, zeroPtr, "", zeroPtr, "", false
+}
+
+// joinChangePath returns the path of name within the directory at
+// p, relative to the TLF root.
+func joinChangePath(p path, name string) string {
+	dir := tlfRelativePath(p)
+	if name == "" {
+		return dir
+	} else if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// getChangesForMD returns the changes made by the given merged
+// revision, in the order they were made.  If quota reclamation has
+// deleted the blocks needed to find the changed paths, it returns a
+// single ChangesReclaimed change instead.
+func (fbo *folderBranchOps) getChangesForMD(ctx context.Context,
+	rmd ImmutableRootMetadata) ([]TlfChange, error) {
+	// No new operations in these.
+	if rmd.IsWriterMetadataCopiedSet() {
+		return nil, nil
+	}
+
+	ops := rmd.Data().Changes.Ops
+	rootPtr := rmd.Data().Dir.BlockPointer
+	newPtrs := map[BlockPointer]bool{rootPtr: true}
+	var ptrs []BlockPointer
+	// The first hard link to a file renames it into the hard links
+	// directory and makes a link in its old place, which isn't a
+	// new entry.  Since the rename is an earlier step of the
+	// revision, its pointers may not be found in the final tree, so
+	// match the two by name instead.
+	convertedNames := make(map[string]string)
+	for _, o := range ops {
+		for _, update := range o.allUpdates() {
+			newPtrs[update.Ref] = true
+		}
+		if ro, ok := o.(*renameOp); ok {
+			convertedNames[ro.NewName] = ro.OldName
+		}
+		_, dir, _, oldDir, _, ok := opChangePaths(o)
+		if !ok {
+			continue
+		}
+		for _, ptr := range []BlockPointer{dir, oldDir} {
+			if ptr.IsInitialized() {
+				ptrs = append(ptrs, ptr)
+			}
+		}
+	}
+	if len(ptrs) == 0 {
+		return nil, nil
+	}
+
+	writer, err := fbo.config.KBPKI().GetNormalizedUsername(
+		ctx, rmd.LastModifyingWriter())
+	if err != nil {
+		return nil, err
+	}
+
+	reclaimed := func(err error) []TlfChange {
+		fbo.log.CDebugf(ctx, "Revision %d has been reclaimed: %v",
+			rmd.Revision(), err)
+		return []TlfChange{{
+			Revision:  rmd.Revision(),
+			Writer:    writer,
+			LocalTime: rmd.LocalTimestamp(),
+			Type:      ChangesReclaimed,
+		}}
+	}
+
+	// Use a throwaway node cache, since the main one only knows
+	// about the current head.
+	paths, err := fbo.blocks.SearchForPaths(ctx,
+		newNodeCacheStandard(fbo.folderBranch), ptrs, newPtrs, rmd, rootPtr)
+	if isBlockGoneError(err) {
+		return reclaimed(err), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Changes to hard link targets are reported under the paths of
+	// their links, which are only known once all the ops are seen.
+	type pendingChange struct {
+		TlfChange
+		linkTarget string
+	}
+	var pending []pendingChange
+	linkTargets := make(map[string]bool)
+	for _, o := range ops {
+		t, dir, name, oldDir, oldName, ok := opChangePaths(o)
+		if !ok || !dir.IsInitialized() {
+			continue
+		}
+		if lo, ok := o.(*linkOp); ok && !lo.Removed {
+			if oldName, ok := convertedNames[lo.Target]; ok &&
+				oldName == lo.Name {
+				continue
+			}
+		}
+		p, ok := paths[dir]
+		if !ok || len(p.path) == 0 {
+			fbo.log.CDebugf(ctx, "Couldn't find the path of %v for op %s "+
+				"in revision %d", dir, o, rmd.Revision())
+			continue
+		}
+		change := TlfChange{
+			Revision:  rmd.Revision(),
+			Writer:    writer,
+			LocalTime: rmd.LocalTimestamp(),
+			Type:      t,
+			Path:      joinChangePath(p, name),
+		}
+		hidden, oldHidden := hiddenDirOf(p, name), ""
+		if t == EntryRenamed {
+			oldP, ok := paths[oldDir]
+			if !ok || len(oldP.path) == 0 {
+				fbo.log.CDebugf(ctx, "Couldn't find the path of %v for "+
+					"op %s in revision %d", oldDir, o, rmd.Revision())
+				continue
+			}
+			change.OldPath = joinChangePath(oldP, oldName)
+			oldHidden = hiddenDirOf(oldP, oldName)
+		}
+
+		switch {
+		case t == EntryRenamed && hidden == trashDirName && oldHidden == "":
+			// Moving an entry into the trash is how it's removed.
+			change.Type = EntryRemoved
+			change.Path, change.OldPath = change.OldPath, ""
+		case t == EntryRenamed && oldHidden == trashDirName && hidden == "":
+			// Restoring it brings it back.
+			change.Type = EntryCreated
+			change.OldPath = ""
+		case t == EntryModified && hidden == hardLinksDirName:
+			target := hardLinkTargetName(p, name)
+			if target == "" {
+				continue
+			}
+			linkTargets[target] = true
+			pending = append(pending, pendingChange{change, target})
+			continue
+		case hidden != "" || oldHidden != "":
+			// Nothing else done within the hidden directories,
+			// like purging the trash or moving a file into the
+			// hard links directory, is visible to users.
+			continue
+		}
+		pending = append(pending, pendingChange{TlfChange: change})
+	}
+
+	var linkPaths map[string][]string
+	if len(linkTargets) > 0 {
+		linkPaths, err = fbo.findHardLinkPaths(ctx, rmd, linkTargets)
+		if isBlockGoneError(err) {
+			return reclaimed(err), nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []TlfChange
+	modified := make(map[string]bool)
+	for _, pc := range pending {
+		changePaths := []string{pc.Path}
+		if pc.linkTarget != "" {
+			changePaths = linkPaths[pc.linkTarget]
+		}
+		for _, changePath := range changePaths {
+			change := pc.TlfChange
+			change.Path = changePath
+			if change.Type == EntryModified {
+				// Report each modified path only once per revision.
+				if modified[change.Path] {
+					continue
+				}
+				modified[change.Path] = true
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// hiddenDirOf returns the name of the hidden directory (see
+// isHiddenDir) that holds, or is, the entry named name within dir,
+// or "" if there isn't one.  An empty name stands for dir itself.
+func hiddenDirOf(dir path, name string) string {
+	var top string
+	if len(dir.path) > 1 {
+		top = dir.path[1].Name
+	} else {
+		top = name
+	}
+	if top == hardLinksDirName || top == trashDirName {
+		return top
+	}
+	return ""
+}
+
+// hardLinkTargetName returns the name of the hard link target that
+// is, or is named name within, the given path in the hard links
+// directory, or "" if it's the directory itself.
+func hardLinkTargetName(dir path, name string) string {
+	switch {
+	case len(dir.path) == 2 && name != "":
+		return name
+	case len(dir.path) == 3 && name == "":
+		return dir.path[2].Name
+	default:
+		return ""
+	}
+}
+
+// findHardLinkPaths returns the TLF-relative paths, as of rmd, of
+// all the hard links to each of the given targets in the hard links
+// directory.  Links don't record where they are, so this walks the
+// whole TLF; it's only needed for revisions that change link
+// targets.
+func (fbo *folderBranchOps) findHardLinkPaths(ctx context.Context,
+	rmd ImmutableRootMetadata, targets map[string]bool) (
+	map[string][]string, error) {
+	lState := makeFBOLockState()
+	rootPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			rmd.Data().Dir.BlockPointer,
+			string(rmd.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	linkPaths := make(map[string][]string)
+	dirs := []path{rootPath}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		dblock, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
+			rmd.ReadOnly(), dir.tailPointer(), fbo.branch(), dir)
+		if err != nil {
+			return nil, err
+		}
+		for name, de := range dblock.Children {
+			switch {
+			case isHiddenDir(dir, name):
+			case de.isHardLink():
+				if targets[de.HardLinkTarget] {
+					linkPaths[de.HardLinkTarget] = append(
+						linkPaths[de.HardLinkTarget],
+						joinChangePath(dir, name))
+				}
+			case de.Type == Dir:
+				dirs = append(dirs, dir.ChildPath(name, de.BlockPointer))
+			}
+		}
+	}
+	for _, p := range linkPaths {
+		sort.Strings(p)
+	}
+	return linkPaths, nil
+}
+
+// GetChanges implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetChanges(ctx context.Context,
+	folderBranch FolderBranch, since MetadataRevision) (
+	changes []TlfChange, latest MetadataRevision, err error) {
+	fbo.log.CDebugf(ctx, "GetChanges since %d", since)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, since, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	_, err = fbo.getMDForReadHelper(ctx, lState, mdReadNeedIdentify)
+	if err != nil {
+		return nil, since, err
+	}
+
+	start := since + 1
+	if start < MetadataRevisionInitial {
+		start = MetadataRevisionInitial
+	}
+	rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+		start, start+maxMDsAtATime-1, Merged)
+	if err != nil {
+		return nil, since, err
+	}
+
+	latest = since
+	for _, rmd := range rmds {
+		if err := isReadableOrError(
+			ctx, fbo.config, rmd.ReadOnly()); err != nil {
+			return nil, since, err
+		}
+		mdChanges, err := fbo.getChangesForMD(ctx, rmd)
+		if err != nil {
+			return nil, since, err
+		}
+		changes = append(changes, mdChanges...)
+		latest = rmd.Revision()
+	}
+	return changes, latest, nil
+}
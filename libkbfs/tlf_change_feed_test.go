@@ -0,0 +1,246 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestTlfChangeFeed(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	fb1 := rootNode1.GetFolderBranch()
+
+	// user 1 makes a directory with a file in it
+	kbfsOps1 := config1.KBFSOps()
+	dirA, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps1.CreateFile(ctx, dirA, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileB, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB)
+	require.NoError(t, err)
+
+	changes, latest, err := kbfsOps1.GetChanges(ctx, fb1, 0)
+	require.NoError(t, err)
+	startRev := latest
+
+	// user 2 moves the file, changes it and removes the directory
+	kbfsOps2 := config2.KBFSOps()
+	fb2 := rootNode2.GetFolderBranch()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb2)
+	require.NoError(t, err)
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.Rename(ctx, dirA2, "b", rootNode2, "c")
+	require.NoError(t, err)
+	fileC2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "c")
+	require.NoError(t, err)
+	err = kbfsOps2.SetEx(ctx, fileC2, true)
+	require.NoError(t, err)
+	err = kbfsOps2.RemoveDir(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb1)
+	require.NoError(t, err)
+
+	check := func(changes []TlfChange, expected []TlfChange) {
+		require.Len(t, changes, len(expected))
+		for i, change := range changes {
+			require.Equal(t, expected[i].Writer, change.Writer, "%d", i)
+			require.Equal(t, expected[i].Type, change.Type, "%d", i)
+			require.Equal(t, expected[i].Path, change.Path, "%d", i)
+			require.Equal(t, expected[i].OldPath, change.OldPath, "%d", i)
+		}
+	}
+	check(changes, []TlfChange{
+		{Writer: userName1, Type: EntryCreated, Path: "a"},
+		{Writer: userName1, Type: EntryCreated, Path: "a/b"},
+		{Writer: userName1, Type: EntryModified, Path: "a/b"},
+	})
+
+	// Resuming from the earlier revision only returns the new
+	// changes.
+	changes, latest, err = kbfsOps1.GetChanges(ctx, fb1, startRev)
+	require.NoError(t, err)
+	check(changes, []TlfChange{
+		{Writer: userName2, Type: EntryRenamed, Path: "c", OldPath: "a/b"},
+		{Writer: userName2, Type: EntryModified, Path: "c"},
+		{Writer: userName2, Type: EntryRemoved, Path: "a"},
+	})
+	for _, change := range changes {
+		require.True(t, change.Revision > startRev)
+		require.True(t, change.Revision <= latest)
+	}
+
+	// And there's nothing after that.
+	changes, latest2, err := kbfsOps1.GetChanges(ctx, fb1, latest)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+	require.Equal(t, latest, latest2)
+}
+
+// Tests that revisions whose blocks have been reclaimed are reported
+// as such, rather than making the feed fail.
+func TestTlfChangeFeedAfterQuotaReclamation(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, userName.String(), false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, dirA, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, dirA, "c")
+	require.NoError(t, err)
+
+	// Make the old revisions old enough to reclaim, and reclaim
+	// them.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	var changes []TlfChange
+	since := MetadataRevisionUninitialized
+	for {
+		c, latest, err := kbfsOps.GetChanges(ctx, fb, since)
+		require.NoError(t, err)
+		changes = append(changes, c...)
+		if latest == since {
+			break
+		}
+		since = latest
+	}
+
+	var types []TlfChangeType
+	var paths []string
+	for _, change := range changes {
+		types = append(types, change.Type)
+		paths = append(paths, change.Path)
+	}
+	// Changes in the root directory can still be found, since its
+	// pointer is in the MD itself, but not ones under a/ until the
+	// last reclaimed revision.
+	require.Equal(t, []TlfChangeType{
+		EntryCreated, ChangesReclaimed, EntryCreated, EntryCreated,
+	}, types)
+	require.Equal(t, []string{"a", "", "a/c", "d"}, paths)
+}
+
+// Tests that changes made through the hidden trash and hard links
+// directories are reported as changes to the paths users see.
+func TestTlfChangeFeedHiddenDirs(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, _ := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	config.SetTrashRetention(time.Hour)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	_, latest, err := kbfsOps.GetChanges(ctx, fb, 0)
+	require.NoError(t, err)
+	startRev := latest
+
+	// Link, write through a link, and unlink.
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, dirA, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileB)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateHardLink(ctx, fileB, rootNode, "c")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileB, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileB)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "c")
+	require.NoError(t, err)
+
+	// Trash, restore, trash again and purge.
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	entries, err := kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	err = kbfsOps.Restore(ctx, fb, entries[0].Name)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	// Purge directly, so that quota reclamation doesn't reclaim
+	// the earlier revisions.
+	err = ops.purgeTrash(
+		ops.fbm.ctxWithFBMID(context.Background()),
+		clock.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	entries, err = kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+
+	var changes []TlfChange
+	since := startRev
+	for {
+		c, latest, err := kbfsOps.GetChanges(ctx, fb, since)
+		require.NoError(t, err)
+		changes = append(changes, c...)
+		if latest == since {
+			break
+		}
+		since = latest
+	}
+
+	var types []TlfChangeType
+	var paths []string
+	for _, change := range changes {
+		types = append(types, change.Type)
+		paths = append(paths, change.Path)
+		require.Equal(t, "", change.OldPath)
+	}
+	require.Equal(t, []TlfChangeType{
+		EntryCreated, EntryCreated,
+		EntryCreated,
+		EntryModified, EntryModified,
+		EntryRemoved,
+		EntryCreated, EntryRemoved, EntryCreated, EntryRemoved,
+	}, types)
+	require.Equal(t, []string{
+		"a", "a/b",
+		"c",
+		"a/b", "c",
+		"c",
+		"d", "d", "d", "d",
+	}, paths)
+}
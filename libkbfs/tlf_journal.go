@@ -156,6 +156,7 @@ type tlfJournal struct {
 	dir                 string
 	config              tlfJournalConfig
 	delegateBlockServer BlockServer
+	diskLimiter         *journalDiskLimiter
 	log                 logger.Logger
 	deferLog            logger.Logger
 	onBranchChange      branchChangeListener
@@ -241,9 +242,10 @@ func writeTLFJournalInfoFile(dir string, uid keybase1.UID,
 func makeTLFJournal(
 	ctx context.Context, uid keybase1.UID, key kbfscrypto.VerifyingKey,
 	dir string, tlfID tlf.ID, config tlfJournalConfig,
-	delegateBlockServer BlockServer, bws TLFJournalBackgroundWorkStatus,
-	bwDelegate tlfJournalBWDelegate, onBranchChange branchChangeListener,
-	onMDFlush mdFlushListener) (*tlfJournal, error) {
+	delegateBlockServer BlockServer, diskLimiter *journalDiskLimiter,
+	bws TLFJournalBackgroundWorkStatus, bwDelegate tlfJournalBWDelegate,
+	onBranchChange branchChangeListener, onMDFlush mdFlushListener) (
+	*tlfJournal, error) {
 	if uid == keybase1.UID("") {
 		return nil, errors.New("Empty user")
 	}
@@ -308,6 +310,7 @@ func makeTLFJournal(
 		dir:                  dir,
 		config:               config,
 		delegateBlockServer:  delegateBlockServer,
+		diskLimiter:          diskLimiter,
 		log:                  log,
 		deferLog:             log.CloneWithAddedDepth(1),
 		onBranchChange:       onBranchChange,
@@ -322,6 +325,10 @@ func makeTLFJournal(
 		bwDelegate:           bwDelegate,
 	}
 
+	// Count any existing unflushed bytes against the disk limit;
+	// they're released again on shutdown.
+	diskLimiter.onJournalEnable(blockJournal.getUnflushedBytes())
+
 	go j.doBackgroundWorkLoop(bws, backoff.NewExponentialBackOff())
 
 	// Signal work to pick up any existing journal entries.
@@ -535,6 +542,8 @@ func (j *tlfJournal) doBackgroundWorkLoop(
 //
 // TODO: Handle garbage collection too.
 func (j *tlfJournal) doBackgroundWork(ctx context.Context) <-chan error {
+	// Let interactive block transfers go first.
+	ctx = ctxWithBackgroundBandwidth(ctx)
 	errCh := make(chan error, 1)
 	// TODO: Handle panics.
 	go func() {
@@ -701,6 +710,11 @@ func (j *tlfJournal) removeFlushedBlockEntries(ctx context.Context,
 		return err
 	}
 
+	unflushedBytesBefore := j.blockJournal.getUnflushedBytes()
+	defer func() {
+		j.diskLimiter.onBlocksFlush(
+			unflushedBytesBefore - j.blockJournal.getUnflushedBytes())
+	}()
 	return j.blockJournal.removeFlushedEntries(ctx, entries, j.tlfID,
 		j.config.Reporter())
 }
@@ -1136,6 +1150,8 @@ func (j *tlfJournal) shutdown() {
 		return
 	}
 
+	j.diskLimiter.onJournalShutdown(j.blockJournal.getUnflushedBytes())
+
 	// Make further accesses error out.
 	j.blockJournal = nil
 	j.mdJournal = nil
@@ -1207,14 +1223,39 @@ func (j *tlfJournal) getBlockDataWithContext(
 
 func (j *tlfJournal) putBlockData(
 	ctx context.Context, id BlockID, context BlockContext, buf []byte,
-	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) (err error) {
+	err = func() error {
+		j.journalLock.RLock()
+		defer j.journalLock.RUnlock()
+		return j.checkEnabledLocked()
+	}()
+	if err != nil {
+		return err
+	}
+
+	// Apply backpressure before taking the write lock, so that a
+	// delayed put doesn't hold up flushes.
+	bufLen := int64(len(buf))
+	err = j.diskLimiter.beforeBlockPut(ctx, bufLen)
+	if err != nil {
+		return err
+	}
+	// Settle the reservation with however many bytes the journal
+	// actually accounted for, whether or not the put succeeded.
+	var putBytes int64
+	defer func() {
+		j.diskLimiter.afterBlockPut(bufLen, putBytes)
+	}()
+
 	j.journalLock.Lock()
 	defer j.journalLock.Unlock()
 	if err := j.checkEnabledLocked(); err != nil {
 		return err
 	}
 
-	err := j.blockJournal.putData(ctx, id, context, buf, serverHalf)
+	unflushedBytesBefore := j.blockJournal.getUnflushedBytes()
+	err = j.blockJournal.putData(ctx, id, context, buf, serverHalf)
+	putBytes = j.blockJournal.getUnflushedBytes() - unflushedBytesBefore
 	if err != nil {
 		return err
 	}
@@ -1251,6 +1292,35 @@ func (j *tlfJournal) addBlockReference(
 	return nil
 }
 
+// addHeldBlockReference is like addBlockReference, but only adds the
+// reference if the journal still holds the data for the block, so
+// that the new reference can be read before it's flushed.  Otherwise
+// it returns blockNonExistentError.
+func (j *tlfJournal) addHeldBlockReference(
+	ctx context.Context, id BlockID, context BlockContext) error {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+
+	err := j.blockJournal.hasData(id)
+	if os.IsNotExist(err) {
+		return blockNonExistentError{id}
+	} else if err != nil {
+		return err
+	}
+
+	err = j.blockJournal.addReference(ctx, id, context)
+	if err != nil {
+		return err
+	}
+
+	j.signalWork()
+
+	return nil
+}
+
 func (j *tlfJournal) removeBlockReferences(
 	ctx context.Context, contexts map[BlockID][]BlockContext) (
 	liveCounts map[BlockID]int, err error) {
@@ -1476,8 +1546,13 @@ func (j *tlfJournal) doResolveBranch(ctx context.Context,
 		return MdID{}, false, err
 	}
 
-	// Then go through and mark blocks and md rev markers for ignoring.
+	// Then go through and mark blocks and md rev markers for
+	// ignoring.  Ignored blocks no longer count against the disk
+	// limit.
+	unflushedBytesBefore := j.blockJournal.getUnflushedBytes()
 	err = j.blockJournal.ignoreBlocksAndMDRevMarkers(ctx, blocksToDelete)
+	j.diskLimiter.onBlocksFlush(
+		unflushedBytesBefore - j.blockJournal.getUnflushedBytes())
 	if err != nil {
 		return MdID{}, false, err
 	}
@@ -250,6 +250,7 @@ func setupTLFJournalTest(
 
 	tlfJournal, err = makeTLFJournal(ctx, uid, verifyingKey,
 		tempdir, config.tlfID, config, delegateBlockServer,
+		makeJournalDiskLimiter(config.MakeLogger(""), 0, 0),
 		bwStatus, delegate, nil, nil)
 	require.NoError(t, err)
 
@@ -0,0 +1,430 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/net/context"
+)
+
+// TrashEntry describes a removed file or directory that is still in
+// the trash of its TLF.
+type TrashEntry struct {
+	// Name identifies the entry within the trash, and is what
+	// Restore takes.
+	Name string
+	// Path is relative to the TLF root, and is where the entry
+	// was before it was removed, and where Restore puts it back.
+	Path string
+	Time time.Time
+	// Expiry is when the entry will be purged from the trash.
+	Expiry time.Time
+	Writer libkb.NormalizedUsername
+	EntryInfo
+}
+
+// trashEntriesByTime implements sort.Interface to sort TrashEntries
+// by the time they were removed, oldest first, and then by path.
+type trashEntriesByTime []TrashEntry
+
+// Len implements sort.Interface for trashEntriesByTime
+func (t trashEntriesByTime) Len() int {
+	return len(t)
+}
+
+// Less implements sort.Interface for trashEntriesByTime
+func (t trashEntriesByTime) Less(i, j int) bool {
+	if !t[i].Time.Equal(t[j].Time) {
+		return t[i].Time.Before(t[j].Time)
+	}
+	return t[i].Path < t[j].Path
+}
+
+// Swap implements sort.Interface for trashEntriesByTime
+func (t trashEntriesByTime) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// isTrashDir returns true if name, within dir, is the hidden trash
+// directory of the TLF.
+func isTrashDir(dir path, name string) bool {
+	return !dir.hasValidParent() && name == trashDirName
+}
+
+// isInTrash returns true if p is within the trash directory.
+func isInTrash(p path) bool {
+	return len(p.path) > 1 && p.path[1].Name == trashDirName
+}
+
+// getTrashDir returns the path of the trash directory as of
+// md, or false if there isn't one yet.
+func (fbo *folderBranchOps) getTrashDir(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata) (path, bool, error) {
+	rootPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			md.Data().Dir.BlockPointer,
+			string(md.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, rootPath.ChildPathNoPtr(trashDirName))
+	switch err.(type) {
+	case nil:
+		return rootPath.ChildPath(trashDirName, de.BlockPointer), true, nil
+	case NoSuchNameError:
+		return path{}, false, nil
+	default:
+		return path{}, false, err
+	}
+}
+
+// trashEntryLocked moves the entry named name in dir into the trash
+// directory, under a new random name, instead of removing it.  It
+// returns false without doing anything if the entry should really
+// be removed instead: when the trash is turned off, and for hard
+// links and entries that are already in the trash.
+func (fbo *folderBranchOps) trashEntryLocked(ctx context.Context,
+	lState *lockState, dir Node, name string) (bool, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	retention := fbo.config.TrashRetention()
+	if retention <= 0 {
+		return false, nil
+	}
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return false, err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return false, err
+	}
+	if isInTrash(dirPath) {
+		return false, nil
+	}
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), dirPath.ChildPathNoPtr(name))
+	if err != nil {
+		return false, err
+	}
+	if de.isHardLink() {
+		return false, nil
+	}
+
+	trashDir, err := fbo.getOrCreateHiddenDirLocked(
+		ctx, lState, trashDirName)
+	if err != nil {
+		return false, err
+	}
+
+	// Creating the trash directory may have made a new revision.
+	md, err = fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return false, err
+	}
+	dirPath, err = fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return false, err
+	}
+	trashPath, err := fbo.pathFromNodeForMDWriteLocked(lState, trashDir)
+	if err != nil {
+		return false, err
+	}
+
+	trashName, err := makeHardLinkID()
+	if err != nil {
+		return false, err
+	}
+	oldPBlock, newPBlock, newDe, _, lbc, err := fbo.blocks.PrepRename(
+		ctx, lState, md, dirPath, name, trashPath, trashName)
+	if err != nil {
+		return false, err
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	fbo.log.CDebugf(ctx, "Moving %s into the trash as %s", name, trashName)
+	now := fbo.nowUnixNano()
+	newDe.TrashPath = tlfRelativePath(dirPath.ChildPathNoPtr(name))
+	newDe.TrashTime = now
+	newDe.TrashWriter = uid
+	newDe.TrashExpiry = now + int64(retention)
+	newDe.Ctime = now
+	newPBlock.Children[trashName] = newDe
+	delete(oldPBlock.Children, name)
+
+	bps, err := fbo.syncTwoDirsLocked(ctx, lState, uid, md, dirPath,
+		oldPBlock, trashPath, newPBlock, lbc)
+	if err != nil {
+		return false, err
+	}
+	err = fbo.putBlocksAndFinalizeLocked(ctx, lState, uid, md, bps)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (fbo *folderBranchOps) restoreLocked(
+	ctx context.Context, lState *lockState, name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	trashPath, ok, err := fbo.getTrashDir(ctx, lState, md.ReadOnly())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return NoSuchNameError{name}
+	}
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), trashPath.ChildPathNoPtr(name))
+	if err != nil {
+		return err
+	}
+	if !de.isTrashed() {
+		return NoSuchNameError{name}
+	}
+
+	// The parent directory must still exist, so restore removed
+	// parents first.
+	names := strings.Split(de.TrashPath, "/")
+	parentPath := *trashPath.parentPath()
+	for _, n := range names[:len(names)-1] {
+		childPath := parentPath.ChildPathNoPtr(n)
+		pde, err := fbo.blocks.GetDirtyEntry(
+			ctx, lState, md.ReadOnly(), childPath)
+		if err != nil {
+			return err
+		}
+		if pde.Type != Dir {
+			return NotDirError{childPath}
+		}
+		parentPath = parentPath.ChildPath(n, pde.BlockPointer)
+	}
+	newName := names[len(names)-1]
+	_, err = fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), parentPath.ChildPathNoPtr(newName))
+	switch err.(type) {
+	case nil:
+		return NameExistsError{newName}
+	case NoSuchNameError:
+	default:
+		return err
+	}
+
+	oldPBlock, newPBlock, newDe, _, lbc, err := fbo.blocks.PrepRename(
+		ctx, lState, md, trashPath, name, parentPath, newName)
+	if err != nil {
+		return err
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	fbo.log.CDebugf(ctx, "Restoring %s to %s", name, de.TrashPath)
+	newDe.TrashPath = ""
+	newDe.TrashTime = 0
+	newDe.TrashWriter = ""
+	newDe.TrashExpiry = 0
+	newDe.Ctime = fbo.nowUnixNano()
+	newPBlock.Children[newName] = newDe
+	delete(oldPBlock.Children, name)
+
+	bps, err := fbo.syncTwoDirsLocked(ctx, lState, uid, md, trashPath,
+		oldPBlock, parentPath, newPBlock, lbc)
+	if err != nil {
+		return err
+	}
+	return fbo.putBlocksAndFinalizeLocked(ctx, lState, uid, md, bps)
+}
+
+// purgeTrash removes, for real, all the entries in the trash
+// directory that expired before the given time, in a single
+// revision.
+func (fbo *folderBranchOps) purgeTrash(
+	ctx context.Context, now time.Time) error {
+	// Unlike GC ops, purges go through the usual MD write path,
+	// which needs delayed cancellation.
+	ctx, err := NewContextWithCancellationDelayer(ctx)
+	if err != nil {
+		return err
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	// Like GC ops, purges wait for the next period instead of
+	// joining a transaction.
+	if fbo.txn != nil {
+		return TransactionInProgressError{fbo.folderBranch}
+	}
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.MergedStatus() == Unmerged {
+		return UnexpectedUnmergedPutError{}
+	}
+
+	trashPath, ok, err := fbo.getTrashDir(ctx, lState, md.ReadOnly())
+	if err != nil || !ok {
+		return err
+	}
+	pblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), trashPath, blockWrite)
+	if err != nil {
+		return err
+	}
+
+	var ros []*rmOp
+	for name, de := range pblock.Children {
+		if !de.isTrashed() || de.TrashExpiry > now.UnixNano() {
+			continue
+		}
+		if de.Type == Dir {
+			// Files may have been made in a removed directory
+			// through an open handle; leave those for a
+			// later purge of the directory's contents.
+			childBlock, err := fbo.blocks.GetDir(ctx, lState,
+				md.ReadOnly(), trashPath.ChildPath(name, de.BlockPointer),
+				blockRead)
+			if err != nil {
+				return err
+			}
+			if len(childBlock.Children) > 0 {
+				fbo.log.CDebugf(ctx, "Not purging non-empty directory "+
+					"%s from the trash", name)
+				continue
+			}
+		}
+
+		ro, err := newRmOp(name, trashPath.tailPointer())
+		if err != nil {
+			return err
+		}
+		md.AddOp(ro)
+		err = fbo.unrefEntry(ctx, lState, md, trashPath, de, name)
+		if err != nil {
+			return err
+		}
+		delete(pblock.Children, name)
+		ros = append(ros, ro)
+	}
+	if len(ros) == 0 {
+		return nil
+	}
+	fbo.log.CDebugf(ctx, "Purging %d entries from the trash", len(ros))
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, bps, err := fbo.syncBlockLocked(ctx, lState, uid, md, pblock,
+		*trashPath.parentPath(), trashPath.tailName(), Dir, true, true,
+		zeroPtr, nil)
+	if err != nil {
+		return err
+	}
+	// The sync only updates the last op, so bring the other
+	// removals up to date as well.
+	last := ros[len(ros)-1]
+	for _, ro := range ros[:len(ros)-1] {
+		ro.AddUpdate(last.Dir.Unref, last.Dir.Ref)
+	}
+	return fbo.putBlocksAndFinalizeLocked(ctx, lState, uid, md, bps)
+}
+
+// GetTrash implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetTrash(ctx context.Context,
+	folderBranch FolderBranch) (entries []TrashEntry, err error) {
+	fbo.log.CDebugf(ctx, "GetTrash")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		trashPath, ok, err := fbo.getTrashDir(
+			ctx, lState, md.ReadOnly())
+		if err != nil || !ok {
+			return err
+		}
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, md.ReadOnly(), trashPath, blockRead)
+		if err != nil {
+			return err
+		}
+
+		entries = make([]TrashEntry, 0, len(dblock.Children))
+		for name, de := range dblock.Children {
+			if !de.isTrashed() {
+				continue
+			}
+			writer, err := fbo.config.KBPKI().GetNormalizedUsername(
+				ctx, de.TrashWriter)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, TrashEntry{
+				Name:      name,
+				Path:      de.TrashPath,
+				Time:      time.Unix(0, de.TrashTime),
+				Expiry:    time.Unix(0, de.TrashExpiry),
+				Writer:    writer,
+				EntryInfo: de.EntryInfo,
+			})
+		}
+		sort.Sort(trashEntriesByTime(entries))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Restore implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) Restore(ctx context.Context,
+	folderBranch FolderBranch, name string) (err error) {
+	fbo.log.CDebugf(ctx, "Restore %s", name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if fbo.isArchived() {
+		return WriteToReadonlyNodeError{folderBranch.Tlf.String()}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.restoreLocked(ctx, lState, name)
+		})
+}
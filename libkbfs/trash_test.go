@@ -0,0 +1,228 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashRemoveAndRestore(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	config.SetTrashRetention(time.Hour)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	dNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fNode, _, err := kbfsOps.CreateFile(ctx, dNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, []byte("fff"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fNode)
+	require.NoError(t, err)
+
+	entries, err := kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+
+	err = kbfsOps.RemoveEntry(ctx, dNode, "f")
+	require.NoError(t, err)
+	clock.Add(time.Minute)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+
+	// The trash itself is hidden.
+	txnTestCheckChildren(ctx, t, kbfsOps, rootNode)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, trashDirName)
+	require.IsType(t, NoSuchNameError{}, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, trashDirName)
+	require.IsType(t, NoSuchNameError{}, err)
+
+	entries, err = kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "d/f", entries[0].Path)
+	require.Equal(t, File, entries[0].Type)
+	require.Equal(t, uint64(3), entries[0].Size)
+	require.Equal(t, libkb.NormalizedUsername("test_user"), entries[0].Writer)
+	require.True(t, entries[0].Time.Equal(now))
+	require.Equal(t, "d", entries[1].Path)
+	require.Equal(t, Dir, entries[1].Type)
+
+	// The file's parent has to come back first.
+	err = kbfsOps.Restore(ctx, fb, entries[0].Name)
+	require.IsType(t, NoSuchNameError{}, err)
+	err = kbfsOps.Restore(ctx, fb, "nope")
+	require.IsType(t, NoSuchNameError{}, err)
+	err = kbfsOps.Restore(ctx, fb, entries[1].Name)
+	require.NoError(t, err)
+	err = kbfsOps.Restore(ctx, fb, entries[0].Name)
+	require.NoError(t, err)
+
+	entries, err = kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	txnTestCheckChildren(ctx, t, kbfsOps2, rootNode2, "d")
+	dNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	fNode2, _, err := kbfsOps2.Lookup(ctx, dNode2, "f")
+	require.NoError(t, err)
+	txnTestCheckData(ctx, t, kbfsOps2, fNode2, []byte("fff"))
+}
+
+func TestTrashRestoreOverExistingName(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetTrashRetention(time.Hour)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	entries, err := kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	err = kbfsOps.Restore(ctx, fb, entries[0].Name)
+	require.IsType(t, NameExistsError{}, err)
+}
+
+func TestTrashPurge(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, _ := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	config.SetTrashRetention(time.Hour)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	clock.Add(30 * time.Minute)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+
+	// Nothing is old enough yet.
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	entries, err := kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// Only the first removal expires.
+	clock.Add(45 * time.Minute)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	entries, err = kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "b", entries[0].Path)
+
+	clock.Add(time.Hour)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	entries, err = kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+	err = ops.fbm.waitForDeletingBlocks(ctx)
+	require.NoError(t, err)
+}
+
+// Tests that each trash entry is purged according to the retention
+// in effect when it was removed, not the purging device's.
+func TestTrashPurgeUsesEntryRetention(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, _ := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	config.SetTrashRetention(3 * time.Hour)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	config.SetTrashRetention(time.Hour)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+
+	entries, err := kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, entries[0].Time.Add(3*time.Hour), entries[0].Expiry)
+
+	// Only the entry removed with the shorter retention expires.
+	clock.Add(90 * time.Minute)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	entries, err = kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "a", entries[0].Path)
+
+	// A device without a trash of its own still purges it.
+	config.SetTrashRetention(0)
+	clock.Add(2 * time.Hour)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	entries, err = kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+	err = ops.fbm.waitForDeletingBlocks(ctx)
+	require.NoError(t, err)
+}
+
+func TestTrashDisabled(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	entries, err := kbfsOps.GetTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+	head := getOps(config, fb.Tlf).getHead(makeFBOLockState())
+	require.IsType(t, &rmOp{}, head.data.Changes.Ops[0])
+}
@@ -0,0 +1,228 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Defaults for the TuningConfig settings.
+const (
+	// MaxBlockSizeBytesDefault is the default maximum block size for KBFS.
+	// 512K blocks by default, block changes embedded max == 8K.
+	// Block size was chosen somewhat arbitrarily by trying to
+	// minimize the overall size of the history written by a user when
+	// appending 1KB writes to a file, up to a 1GB total file.  Here
+	// is the output of a simple script that approximates that
+	// calculation:
+	//
+	// Total history size for 0065536-byte blocks: 1134341128192 bytes
+	// Total history size for 0131072-byte blocks: 618945052672 bytes
+	// Total history size for 0262144-byte blocks: 412786622464 bytes
+	// Total history size for 0524288-byte blocks: 412786622464 bytes
+	// Total history size for 1048576-byte blocks: 618945052672 bytes
+	// Total history size for 2097152-byte blocks: 1134341128192 bytes
+	// Total history size for 4194304-byte blocks: 2216672886784 bytes
+	MaxBlockSizeBytesDefault = 512 << 10
+	// Time between checks for dirty files to flush, in case Sync is
+	// never called.
+	backgroundFlushPeriodDefault = 10 * time.Second
+	// When the number of dirty bytes exceeds this level, force a sync.
+	dirtyBytesThresholdDefault = maxParallelBlockPuts * MaxBlockSizeBytesDefault
+	// The timeout for any background task.
+	backgroundTaskTimeoutDefault = 1 * time.Minute
+	// If it's been more than this long since our last update, check
+	// the current head before downloading all of the new revisions.
+	fastForwardTimeThreshDefault = 15 * time.Minute
+	// If there are more than this many new revisions, fast forward
+	// rather than downloading them all.
+	fastForwardRevThreshDefault = 50
+
+	// The range of block sizes covered by the measurements above;
+	// anything outside it costs far more in history size.
+	minTuningMaxBlockSizeBytes = 64 << 10
+	maxTuningMaxBlockSizeBytes = 4 << 20
+)
+
+// TuningConfig holds the settings that trade off KBFS performance
+// against resource usage, and that might need adjusting for unusual
+// workloads or networks (e.g., bigger blocks for big files, or longer
+// timeouts for high-latency links).  It's set once at startup; use
+// DefaultTuningConfig for the defaults, and Validate before using a
+// modified one.
+type TuningConfig struct {
+	// MaxBlockSizeBytes is the maximum plaintext size of a file
+	// block.  Changing it doesn't affect existing blocks.
+	MaxBlockSizeBytes int64
+	// BackgroundFlushPeriod is how often dirty files are checked
+	// for flushing, in case they're never synced explicitly.
+	BackgroundFlushPeriod time.Duration
+	// DirtyBytesThreshold is the number of dirty bytes past which
+	// writes force a sync.  The dirty block cache holds up to twice
+	// this many bytes.
+	DirtyBytesThreshold int64
+	// BackgroundTaskTimeout bounds the time of any single
+	// background task, like archiving or deleting blocks.
+	BackgroundTaskTimeout time.Duration
+	// FastForwardTimeThreshold is how long a TLF has to go without
+	// updates before it checks whether to fast forward to the
+	// current head, instead of fetching every new revision.
+	FastForwardTimeThreshold time.Duration
+	// FastForwardRevThreshold is the number of new revisions past
+	// which a TLF fast forwards to the current head.
+	FastForwardRevThreshold int64
+}
+
+// DefaultTuningConfig returns the default tuning settings.
+func DefaultTuningConfig() TuningConfig {
+	return TuningConfig{
+		MaxBlockSizeBytes:        MaxBlockSizeBytesDefault,
+		BackgroundFlushPeriod:    backgroundFlushPeriodDefault,
+		DirtyBytesThreshold:      dirtyBytesThresholdDefault,
+		BackgroundTaskTimeout:    backgroundTaskTimeoutDefault,
+		FastForwardTimeThreshold: fastForwardTimeThreshDefault,
+		FastForwardRevThreshold:  fastForwardRevThreshDefault,
+	}
+}
+
+// Validate returns an InvalidTuningConfigError if any of the settings
+// are out of range.
+func (tc TuningConfig) Validate() error {
+	if tc.MaxBlockSizeBytes < minTuningMaxBlockSizeBytes ||
+		tc.MaxBlockSizeBytes > maxTuningMaxBlockSizeBytes {
+		return InvalidTuningConfigError{"MaxBlockSizeBytes",
+			fmt.Sprintf("must be between %d and %d",
+				minTuningMaxBlockSizeBytes, maxTuningMaxBlockSizeBytes)}
+	}
+	if tc.BackgroundFlushPeriod <= 0 {
+		return InvalidTuningConfigError{
+			"BackgroundFlushPeriod", "must be positive"}
+	}
+	if tc.DirtyBytesThreshold < tc.MaxBlockSizeBytes {
+		return InvalidTuningConfigError{"DirtyBytesThreshold",
+			"must be at least MaxBlockSizeBytes"}
+	}
+	if tc.BackgroundTaskTimeout <= 0 {
+		return InvalidTuningConfigError{
+			"BackgroundTaskTimeout", "must be positive"}
+	}
+	if tc.FastForwardTimeThreshold <= 0 {
+		return InvalidTuningConfigError{
+			"FastForwardTimeThreshold", "must be positive"}
+	}
+	if tc.FastForwardRevThreshold <= 0 {
+		return InvalidTuningConfigError{
+			"FastForwardRevThreshold", "must be positive"}
+	}
+	return nil
+}
+
+// withOverrides returns a copy of tc with every non-zero setting in
+// overrides replacing the corresponding one.
+func (tc TuningConfig) withOverrides(overrides TuningConfig) TuningConfig {
+	if overrides.MaxBlockSizeBytes != 0 {
+		tc.MaxBlockSizeBytes = overrides.MaxBlockSizeBytes
+	}
+	if overrides.BackgroundFlushPeriod != 0 {
+		tc.BackgroundFlushPeriod = overrides.BackgroundFlushPeriod
+	}
+	if overrides.DirtyBytesThreshold != 0 {
+		tc.DirtyBytesThreshold = overrides.DirtyBytesThreshold
+	}
+	if overrides.BackgroundTaskTimeout != 0 {
+		tc.BackgroundTaskTimeout = overrides.BackgroundTaskTimeout
+	}
+	if overrides.FastForwardTimeThreshold != 0 {
+		tc.FastForwardTimeThreshold = overrides.FastForwardTimeThreshold
+	}
+	if overrides.FastForwardRevThreshold != 0 {
+		tc.FastForwardRevThreshold = overrides.FastForwardRevThreshold
+	}
+	return tc
+}
+
+// tuningConfigJSON is the JSON form of TuningConfig, with durations
+// written as strings like "1m30s".
+type tuningConfigJSON struct {
+	MaxBlockSizeBytes        int64  `json:"maxBlockSizeBytes"`
+	BackgroundFlushPeriod    string `json:"backgroundFlushPeriod"`
+	DirtyBytesThreshold      int64  `json:"dirtyBytesThreshold"`
+	BackgroundTaskTimeout    string `json:"backgroundTaskTimeout"`
+	FastForwardTimeThreshold string `json:"fastForwardTimeThreshold"`
+	FastForwardRevThreshold  int64  `json:"fastForwardRevThreshold"`
+}
+
+func (tc TuningConfig) toJSON() tuningConfigJSON {
+	return tuningConfigJSON{
+		MaxBlockSizeBytes:        tc.MaxBlockSizeBytes,
+		BackgroundFlushPeriod:    tc.BackgroundFlushPeriod.String(),
+		DirtyBytesThreshold:      tc.DirtyBytesThreshold,
+		BackgroundTaskTimeout:    tc.BackgroundTaskTimeout.String(),
+		FastForwardTimeThreshold: tc.FastForwardTimeThreshold.String(),
+		FastForwardRevThreshold:  tc.FastForwardRevThreshold,
+	}
+}
+
+// MarshalJSON implements the json.Marshaler interface for
+// TuningConfig.
+func (tc TuningConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tc.toJSON())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface for
+// TuningConfig.  Settings missing from the JSON object keep their
+// current values.
+func (tc *TuningConfig) UnmarshalJSON(data []byte) error {
+	j := tc.toJSON()
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	newTC := TuningConfig{
+		MaxBlockSizeBytes:       j.MaxBlockSizeBytes,
+		DirtyBytesThreshold:     j.DirtyBytesThreshold,
+		FastForwardRevThreshold: j.FastForwardRevThreshold,
+	}
+	durations := []struct {
+		name string
+		s    string
+		d    *time.Duration
+	}{
+		{"backgroundFlushPeriod", j.BackgroundFlushPeriod,
+			&newTC.BackgroundFlushPeriod},
+		{"backgroundTaskTimeout", j.BackgroundTaskTimeout,
+			&newTC.BackgroundTaskTimeout},
+		{"fastForwardTimeThreshold", j.FastForwardTimeThreshold,
+			&newTC.FastForwardTimeThreshold},
+	}
+	for _, d := range durations {
+		*d.d, err = time.ParseDuration(d.s)
+		if err != nil {
+			return fmt.Errorf("Bad %s: %v", d.name, err)
+		}
+	}
+	*tc = newTC
+	return nil
+}
+
+// LoadTuningConfig reads a JSON-encoded TuningConfig from the given
+// file.  Settings missing from the file get their default values.
+// The result isn't validated.
+func LoadTuningConfig(path string) (TuningConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TuningConfig{}, err
+	}
+	tc := DefaultTuningConfig()
+	err = json.Unmarshal(data, &tc)
+	if err != nil {
+		return TuningConfig{}, fmt.Errorf(
+			"Couldn't parse tuning config %s: %v", path, err)
+	}
+	return tc, nil
+}
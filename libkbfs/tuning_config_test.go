@@ -0,0 +1,113 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestTuningConfigValidate(t *testing.T) {
+	require.NoError(t, DefaultTuningConfig().Validate())
+
+	tc := DefaultTuningConfig()
+	tc.MaxBlockSizeBytes = 1024
+	require.Equal(t, "MaxBlockSizeBytes",
+		tc.Validate().(InvalidTuningConfigError).Setting)
+
+	tc = DefaultTuningConfig()
+	tc.MaxBlockSizeBytes = maxTuningMaxBlockSizeBytes
+	tc.DirtyBytesThreshold = maxTuningMaxBlockSizeBytes - 1
+	require.Equal(t, "DirtyBytesThreshold",
+		tc.Validate().(InvalidTuningConfigError).Setting)
+
+	tc = DefaultTuningConfig()
+	tc.BackgroundTaskTimeout = 0
+	require.Equal(t, "BackgroundTaskTimeout",
+		tc.Validate().(InvalidTuningConfigError).Setting)
+
+	tc = DefaultTuningConfig()
+	tc.FastForwardRevThreshold = -1
+	require.Equal(t, "FastForwardRevThreshold",
+		tc.Validate().(InvalidTuningConfigError).Setting)
+}
+
+func TestTuningConfigJSON(t *testing.T) {
+	tc := DefaultTuningConfig()
+	tc.BackgroundTaskTimeout = 5 * time.Minute
+	data, err := json.Marshal(tc)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"backgroundTaskTimeout":"5m0s"`)
+
+	var decoded TuningConfig
+	err = json.Unmarshal(data, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, tc, decoded)
+
+	err = json.Unmarshal(
+		[]byte(`{"backgroundFlushPeriod": "soon"}`), &decoded)
+	require.Error(t, err)
+}
+
+func TestTuningConfigFileAndOverrides(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "tuning_config")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	// Settings missing from the file keep their defaults.
+	path := filepath.Join(tempdir, "tuning.json")
+	err = ioutil.WriteFile(path, []byte(`{
+  "maxBlockSizeBytes": 1048576,
+  "backgroundTaskTimeout": "3m"
+}`), 0600)
+	require.NoError(t, err)
+
+	expected := DefaultTuningConfig()
+	expected.MaxBlockSizeBytes = 1 << 20
+	expected.BackgroundTaskTimeout = 3 * time.Minute
+	tc, err := LoadTuningConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, expected, tc)
+
+	// Non-zero flag settings override the file.
+	params := InitParams{
+		TuningConfigFile: path,
+		Tuning: TuningConfig{
+			BackgroundTaskTimeout:   2 * time.Minute,
+			FastForwardRevThreshold: 100,
+		},
+	}
+	expected.BackgroundTaskTimeout = 2 * time.Minute
+	expected.FastForwardRevThreshold = 100
+	tc, err = makeTuningConfig(params)
+	require.NoError(t, err)
+	require.Equal(t, expected, tc)
+
+	params.Tuning.MaxBlockSizeBytes = 1
+	_, err = makeTuningConfig(params)
+	require.IsType(t, InvalidTuningConfigError{}, err)
+}
+
+func TestTuningConfigStatus(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	tc := DefaultTuningConfig()
+	tc.FastForwardTimeThreshold = time.Hour
+	config.SetTuningConfig(tc)
+	status, _, err := config.KBFSOps().Status(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, tc, status.TuningConfig)
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"net/http"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const (
+	// PublicName is the name of the parent of all public top-level folders.
+	PublicName = "public"
+
+	// PrivateName is the name of the parent of all private top-level folders.
+	PrivateName = "private"
+
+	// CtxOpID is the display name for the unique operation WebDAV ID tag.
+	CtxOpID = "WID"
+)
+
+// CtxTagKey is the type used for unique context tags
+type CtxTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxTagKey = iota
+)
+
+// statusError is an error that maps directly onto an HTTP status
+// code, for failures detected by the WebDAV layer itself.
+type statusError struct {
+	code int
+	msg  string
+}
+
+// Error implements the error interface for statusError.
+func (e statusError) Error() string {
+	return e.msg
+}
+
+func newStatusError(code int, msg string) error {
+	return statusError{code, msg}
+}
+
+// errToHTTPStatus returns the HTTP status code that best describes
+// the given error.
+func errToHTTPStatus(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return http.StatusOK
+	case statusError:
+		return e.code
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.NoSuchFolderListError, libkbfs.BadTLFNameError,
+		libfs.TlfDoesNotExist:
+		return http.StatusNotFound
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.WriteUnsupportedError, libkbfs.WriteToReadonlyNodeError,
+		libkbfs.OfflineUnjournaledError, libkbfs.NeedSelfRekeyError,
+		libkbfs.NeedOtherRekeyError, libkbfs.MDServerErrorUnauthorized,
+		libkbfs.MDServerErrorWriteAccess, libkbfs.BServerErrorUnauthorized:
+		return http.StatusForbidden
+	case libkbfs.NameExistsError, libkbfs.DirNotEmptyError,
+		libkbfs.NotDirError, libkbfs.NotFileError,
+		libkbfs.NoWriteConflictError:
+		return http.StatusConflict
+	case libkbfs.FileTooBigError, libkbfs.DirTooBigError:
+		return http.StatusRequestEntityTooLarge
+	case libkbfs.NameTooLongError, libkbfs.DisallowedPrefixError:
+		return http.StatusBadRequest
+	case libkbfs.BServerErrorOverQuota, libkbfs.JournalDiskLimitExceededError:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,6 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package libwebdav is an interface between libkbfs and WebDAV.
+package libwebdav
@@ -0,0 +1,201 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FS serves the KBFS namespace over WebDAV.  It implements
+// http.Handler, and is meant to only be served on a loopback
+// address.  Since any local user can connect to a loopback address,
+// every request must also carry the server's secret as the password
+// of HTTP Basic authentication (the user name is ignored).
+type FS struct {
+	config libkbfs.Config
+	log    logger.Logger
+	errLog logger.Logger
+	secret string
+
+	// remoteStatus is the current status of remote connections.
+	remoteStatus libfs.RemoteStatus
+
+	// updatesLock protects updateChans.
+	updatesLock sync.Mutex
+	// updateChans holds, for each folder that has had its updates
+	// disabled via the special file, the channel that re-enables
+	// them.
+	updateChans map[libkbfs.FolderBranch]chan<- struct{}
+}
+
+var _ http.Handler = (*FS)(nil)
+
+// NewFS creates an FS that only serves requests authenticated with
+// the given secret.
+func NewFS(config libkbfs.Config, debug bool, secret string) *FS {
+	log := config.MakeLogger("kbfswebdav")
+	// We need extra depth for errors, so that we can report the line
+	// number for the caller of reportErr, not reportErr itself.
+	errLog := log.CloneWithAddedDepth(1)
+	if debug {
+		// Turn on debugging.  TODO: allow a proper log file and
+		// style to be specified.
+		log.Configure("", true, "")
+		errLog.Configure("", true, "")
+	}
+	return &FS{
+		config:      config,
+		log:         log,
+		errLog:      errLog,
+		secret:      secret,
+		updateChans: make(map[libkbfs.FolderBranch]chan<- struct{}),
+	}
+}
+
+// Init starts tracking the status of remote connections, which is
+// needed for the human-readable error files in the root.
+func (f *FS) Init(ctx context.Context) {
+	f.remoteStatus.Init(ctx, f.log, f.config, f)
+}
+
+// UserChanged is called from libfs.
+func (f *FS) UserChanged(ctx context.Context, oldName, newName libkb.NormalizedUsername) {
+	// Nothing is cached per-user, since every request resolves its
+	// path from scratch.
+	f.log.CDebugf(ctx, "User changed: %q -> %q", oldName, newName)
+}
+
+var _ libfs.RemoteStatusUpdater = (*FS)(nil)
+
+// WithContext adds app- and request-specific values to the context.
+// libkbfs.NewContextWithCancellationDelayer is called before returning the
+// context to ensure the cancellation is controllable.
+func (f *FS) WithContext(ctx context.Context) context.Context {
+	id, errRandomReqID := libkbfs.MakeRandomRequestID()
+	if errRandomReqID != nil {
+		f.log.Errorf("Couldn't make request ID: %v", errRandomReqID)
+	}
+
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+			ctx = context.WithValue(ctx, libfs.CtxAppIDKey, f)
+			logTags := make(logger.CtxLogTags)
+			logTags[CtxIDKey] = CtxOpID
+			ctx = logger.NewContextWithLogTags(ctx, logTags)
+
+			if errRandomReqID == nil {
+				// Add a unique ID to this context, identifying a particular
+				// request.
+				ctx = context.WithValue(ctx, CtxIDKey, id)
+			}
+			return ctx
+		}))
+
+	if err != nil {
+		panic(err) // this should never happen
+	}
+
+	return ctx
+}
+
+func (f *FS) reportErr(ctx context.Context,
+	mode libkbfs.ErrorModeType, err error) {
+	if err == nil {
+		f.errLog.CDebugf(ctx, "Request complete")
+		return
+	}
+
+	f.config.Reporter().ReportErr(ctx, "", false, mode, err)
+	// We just log the error as debug, rather than error, because it
+	// might just indicate an expected error such as a 404.
+	f.errLog.CDebugf(ctx, err.Error())
+}
+
+// isLocalHost returns true if the given Host header names the
+// loopback interface.  Requests for any other host are refused, so
+// that web pages can't use DNS rebinding to reach the server.
+func isLocalHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isAuthorized returns true if the given request carries the
+// server's secret as its Basic authentication password.
+func (f *FS) isAuthorized(r *http.Request) bool {
+	_, password, ok := r.BasicAuth()
+	return ok && f.secret != "" &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(f.secret)) == 1
+}
+
+// ServeHTTP implements the http.Handler interface for FS.
+func (f *FS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLocalHost(r.Host) {
+		http.Error(w, "Only local requests are allowed", http.StatusForbidden)
+		return
+	}
+	if !f.isAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="KBFS"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := f.WithContext(r.Context())
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	f.log.CDebugf(ctx, "%s %s", r.Method, r.URL.Path)
+
+	mode := libkbfs.WriteMode
+	var err error
+	switch r.Method {
+	case "OPTIONS":
+		mode = libkbfs.ReadMode
+		err = f.handleOptions(ctx, w, r)
+	case "GET", "HEAD":
+		mode = libkbfs.ReadMode
+		err = f.handleGet(ctx, w, r)
+	case "PROPFIND":
+		mode = libkbfs.ReadMode
+		err = f.handlePropfind(ctx, w, r)
+	case "PUT":
+		err = f.handlePut(ctx, w, r)
+	case "DELETE":
+		err = f.handleDelete(ctx, w, r)
+	case "MKCOL":
+		err = f.handleMkcol(ctx, w, r)
+	case "COPY":
+		err = f.handleCopyMove(ctx, w, r, false)
+	case "MOVE":
+		err = f.handleCopyMove(ctx, w, r, true)
+	case "PROPPATCH":
+		err = f.handleProppatch(ctx, w, r)
+	case "LOCK":
+		err = f.handleLock(ctx, w, r)
+	case "UNLOCK":
+		err = f.handleUnlock(ctx, w, r)
+	default:
+		err = newStatusError(http.StatusMethodNotAllowed,
+			"Unsupported method "+r.Method)
+	}
+	f.reportErr(ctx, mode, err)
+	if err != nil {
+		http.Error(w, err.Error(), errToHTTPStatus(err))
+	}
+}
@@ -0,0 +1,698 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// copyBufferSize is the size of the chunks in which file
+	// contents are read and written.
+	copyBufferSize = 512 * 1024
+	// maxSpecialFileWriteSize limits how much data can be written
+	// to a special file.
+	maxSpecialFileWriteSize = 64 * 1024
+)
+
+// nodeReader is an io.ReadSeeker over the contents of a KBFS file.
+type nodeReader struct {
+	ctx  context.Context
+	ops  libkbfs.KBFSOps
+	node libkbfs.Node
+	size int64
+	off  int64
+}
+
+var _ io.ReadSeeker = (*nodeReader)(nil)
+
+func (r *nodeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := r.ops.Read(r.ctx, r.node, p, r.off)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	r.off += n
+	return int(n), nil
+}
+
+func (r *nodeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative offset %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func etag(ei libkbfs.EntryInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, ei.Mtime, ei.Size)
+}
+
+func (f *FS) handleOptions(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, "+
+		"COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// listDir returns the entries in the given directory resource, not
+// including special files.
+func (f *FS) listDir(ctx context.Context, dir *resource) (
+	[]*resource, error) {
+	switch dir.typ {
+	case rootResource:
+		return []*resource{
+			{typ: folderListResource, name: PrivateName},
+			{typ: folderListResource, name: PublicName, public: true},
+		}, nil
+
+	case folderListResource:
+		cuser, _, err := f.config.KBPKI().GetCurrentUserInfo(ctx)
+		if err != nil {
+			// Not logged in, so there are no favorites.
+			return nil, nil
+		}
+		favs, err := f.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var res []*resource
+		for _, fav := range favs {
+			if fav.Public != dir.public {
+				continue
+			}
+			pname, err := libkbfs.FavoriteNameToPreferredTLFNameFormatAs(
+				cuser, libkbfs.CanonicalTlfName(fav.Name))
+			if err != nil {
+				f.log.CDebugf(ctx, "FavoriteNameToPreferredTLFNameFormatAs: "+
+					"%q %v", fav.Name, err)
+				continue
+			}
+			res = append(res, &resource{typ: tlfResource,
+				name: string(pname), public: dir.public,
+				ei: libkbfs.EntryInfo{Type: libkbfs.Dir}})
+		}
+		return res, nil
+	}
+
+	if dir.node == nil {
+		// A TLF that doesn't exist yet.
+		return nil, nil
+	}
+	children, err := f.config.KBFSOps().GetDirChildren(ctx, dir.node)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*resource, 0, len(children))
+	for name, ei := range children {
+		res = append(res, &resource{typ: nodeResource, name: name,
+			public: dir.public, parent: dir.node, ei: ei})
+	}
+	return res, nil
+}
+
+type resourcesByName []*resource
+
+func (r resourcesByName) Len() int           { return len(r) }
+func (r resourcesByName) Less(i, j int) bool { return r[i].name < r[j].name }
+func (r resourcesByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// hrefFor returns the escaped URL path for the given unescaped path.
+func hrefFor(p string, isDir bool) string {
+	href := (&url.URL{Path: "/" + strings.Join(splitPath(p), "/")}).
+		EscapedPath()
+	if isDir && href != "/" {
+		href += "/"
+	}
+	return href
+}
+
+func (f *FS) handleGet(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	res, err := f.resolve(ctx, r.URL.Path, true, false)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case res.typ == specialResource:
+		if res.special.readAt != nil {
+			return f.streamSpecial(ctx, w, r, res.special)
+		}
+		if res.special.read == nil {
+			return newStatusError(http.StatusMethodNotAllowed,
+				res.name+" can't be read")
+		}
+		data, t, err := res.special.read(ctx)
+		if err != nil {
+			return err
+		}
+		http.ServeContent(w, r, res.name, t, bytes.NewReader(data))
+		return nil
+
+	case res.isDir():
+		entries, err := f.listDir(ctx, res)
+		if err != nil {
+			return err
+		}
+		sort.Sort(resourcesByName(entries))
+		var buf bytes.Buffer
+		buf.WriteString("<!DOCTYPE html>\n<html><body><ul>\n")
+		for _, e := range entries {
+			name := e.name
+			if e.isDir() {
+				name += "/"
+			}
+			fmt.Fprintf(&buf, "<li><a href=\"%s\">%s</a></li>\n",
+				html.EscapeString(hrefFor(path.Join(r.URL.Path, e.name),
+					e.isDir())),
+				html.EscapeString(name))
+		}
+		buf.WriteString("</ul></body></html>\n")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, r, "", time.Unix(0, res.ei.Mtime),
+			bytes.NewReader(buf.Bytes()))
+		return nil
+	}
+
+	w.Header().Set("ETag", etag(res.ei))
+	http.ServeContent(w, r, res.name, time.Unix(0, res.ei.Mtime),
+		&nodeReader{
+			ctx:  ctx,
+			ops:  f.config.KBFSOps(),
+			node: res.node,
+			size: int64(res.ei.Size),
+		})
+	return nil
+}
+
+// streamSpecial writes the contents of a special file with readAt to
+// w, a piece at a time, until it runs out.  Once some of it is
+// written, an error can only cut the response short.
+func (f *FS) streamSpecial(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, special *specialFile) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == "HEAD" {
+		return nil
+	}
+	buf := make([]byte, copyBufferSize)
+	var off int64
+	for {
+		n, err := special.readAt(ctx, buf, off)
+		if err != nil {
+			if off == 0 {
+				return err
+			}
+			f.log.CDebugf(ctx, "Couldn't read past %d bytes: %v", off, err)
+			return nil
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			f.log.CDebugf(ctx, "Couldn't write past %d bytes: %v", off, err)
+			return nil
+		}
+		off += int64(n)
+	}
+}
+
+// writeNode copies everything from src into file, starting at
+// offset 0, and syncs it.
+func (f *FS) writeNode(ctx context.Context, file libkbfs.Node,
+	src io.Reader) error {
+	buf := make([]byte, copyBufferSize)
+	var off int64
+	for {
+		// Only io.EOF ends the copy; a request body that's cut
+		// short fails with io.ErrUnexpectedEOF, which must not be
+		// mistaken for the end of the data.
+		n, err := src.Read(buf)
+		if n > 0 {
+			werr := f.config.KBFSOps().Write(ctx, file, buf[:n], off)
+			if werr != nil {
+				return werr
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return f.config.KBFSOps().Sync(ctx, file)
+}
+
+// writeFileAtomically writes everything from src into a new file
+// under a temporary name in dir, and only then renames it over name,
+// so that a failed or interrupted upload leaves any file that's
+// already there alone.
+func (f *FS) writeFileAtomically(ctx context.Context, dir libkbfs.Node,
+	name string, isExec bool, src io.Reader) error {
+	kbfsOps := f.config.KBFSOps()
+	tmpName := fmt.Sprintf(".%s.kbfswebdav-put-%d", name, time.Now().UnixNano())
+	file, _, err := kbfsOps.CreateFile(
+		ctx, dir, tmpName, isExec, libkbfs.WithExcl)
+	if err != nil {
+		return err
+	}
+	err = f.writeNode(ctx, file, src)
+	if err == nil {
+		err = kbfsOps.Rename(ctx, dir, tmpName, dir, name)
+	}
+	if err != nil {
+		// Sync whatever was written before removing the file, so
+		// that its dirty bytes don't stay charged against the
+		// write buffer.
+		if syncErr := kbfsOps.Sync(ctx, file); syncErr != nil {
+			f.log.CDebugf(ctx, "Couldn't sync %s: %v", tmpName, syncErr)
+		}
+		if rmErr := kbfsOps.RemoveEntry(ctx, dir, tmpName); rmErr != nil {
+			f.log.CDebugf(ctx, "Couldn't remove %s: %v", tmpName, rmErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FS) writeSpecial(ctx context.Context, special *specialFile,
+	name string, body io.Reader) error {
+	if special.write == nil {
+		return newStatusError(http.StatusMethodNotAllowed,
+			name+" can't be written")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxSpecialFileWriteSize))
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return special.write(ctx, data)
+}
+
+func (f *FS) handlePut(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	parent, name, err := f.resolveParent(ctx, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	existing, err := f.lookupMaybe(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil && existing.typ == specialResource {
+		err = f.writeSpecial(ctx, existing.special, name, r.Body)
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	dir, err := writableDir(parent, name)
+	if err != nil {
+		return err
+	}
+
+	status := http.StatusCreated
+	isExec := false
+	if existing != nil {
+		if existing.isDir() {
+			return newStatusError(http.StatusMethodNotAllowed,
+				name+" is a directory")
+		}
+		if existing.ei.Type == libkbfs.Sym {
+			// Write through the symlink.
+			existing, err = f.resolve(ctx, r.URL.Path, true, true)
+			if err != nil {
+				return err
+			}
+			if existing.typ != nodeResource || existing.isDir() {
+				return newStatusError(http.StatusConflict,
+					name+" doesn't point to a file")
+			}
+			dir, name = existing.parent, existing.name
+		}
+		isExec = existing.ei.Type == libkbfs.Exec
+		status = http.StatusNoContent
+	}
+
+	err = f.writeFileAtomically(ctx, dir, name, isExec, r.Body)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(status)
+	return nil
+}
+
+// removeResource removes the given node resource, including all of
+// its contents if it's a directory.
+func (f *FS) removeResource(ctx context.Context, res *resource) error {
+	if res.typ != nodeResource {
+		return newStatusError(http.StatusForbidden,
+			"Can't remove "+res.name)
+	}
+	if !res.isDir() {
+		return f.config.KBFSOps().RemoveEntry(ctx, res.parent, res.name)
+	}
+
+	children, err := f.listDir(ctx, res)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		child.node, child.ei, err = f.config.KBFSOps().Lookup(
+			ctx, res.node, child.name)
+		if err != nil {
+			return err
+		}
+		err = f.removeResource(ctx, child)
+		if err != nil {
+			return err
+		}
+	}
+	return f.config.KBFSOps().RemoveDir(ctx, res.parent, res.name)
+}
+
+func (f *FS) handleDelete(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	res, err := f.resolve(ctx, r.URL.Path, false, false)
+	if err != nil {
+		return err
+	}
+
+	switch res.typ {
+	case tlfResource:
+		// Removing a TLF just removes it from the favorites.
+		err = f.config.KBFSOps().DeleteFavorite(ctx, res.handle.ToFavorite())
+	case nodeResource:
+		err = f.removeResource(ctx, res)
+	default:
+		err = newStatusError(http.StatusForbidden, "Can't remove "+res.name)
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (f *FS) handleMkcol(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	if r.ContentLength > 0 {
+		return newStatusError(http.StatusUnsupportedMediaType,
+			"MKCOL bodies are not supported")
+	}
+
+	parent, name, err := f.resolveParent(ctx, r.URL.Path)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return newStatusError(http.StatusConflict,
+			"Parent directory does not exist")
+	} else if err != nil {
+		return err
+	}
+	existing, err := f.lookupMaybe(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return newStatusError(http.StatusMethodNotAllowed,
+			name+" already exists")
+	}
+	dir, err := writableDir(parent, name)
+	if err != nil {
+		return err
+	}
+	_, _, err = f.config.KBFSOps().CreateDir(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// copyResource recursively copies the given node resource to a new
+// entry called name in dir.  If shallow is set, the contents of
+// directories aren't copied.
+func (f *FS) copyResource(ctx context.Context, src *resource,
+	dir libkbfs.Node, name string, shallow bool) error {
+	ops := f.config.KBFSOps()
+	switch src.ei.Type {
+	case libkbfs.Sym:
+		_, err := ops.CreateLink(ctx, dir, name, src.ei.SymPath)
+		return err
+
+	case libkbfs.Dir:
+		newDir, _, err := ops.CreateDir(ctx, dir, name)
+		if err != nil {
+			return err
+		}
+		if shallow {
+			return nil
+		}
+		children, err := f.listDir(ctx, src)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			child.node, child.ei, err = ops.Lookup(ctx, src.node, child.name)
+			if err != nil {
+				return err
+			}
+			err = f.copyResource(ctx, child, newDir, child.name, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, _, err := ops.CreateFile(
+		ctx, dir, name, src.ei.Type == libkbfs.Exec, libkbfs.WithExcl)
+	if err != nil {
+		return err
+	}
+	return f.writeNode(ctx, file, &nodeReader{
+		ctx:  ctx,
+		ops:  ops,
+		node: src.node,
+		size: int64(src.ei.Size),
+	})
+}
+
+// destinationPath returns the unescaped path of the Destination
+// header for a COPY or MOVE.
+func destinationPath(r *http.Request) (string, error) {
+	dest := r.Header.Get("Destination")
+	if dest == "" {
+		return "", newStatusError(http.StatusBadRequest,
+			"Missing Destination header")
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", newStatusError(http.StatusBadRequest,
+			"Bad Destination header: "+err.Error())
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", newStatusError(http.StatusBadGateway,
+			"Destination is on a different server")
+	}
+	return u.Path, nil
+}
+
+func (f *FS) handleCopyMove(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, move bool) error {
+	dst, err := destinationPath(r)
+	if err != nil {
+		return err
+	}
+	srcPath := path.Clean("/" + r.URL.Path)
+	dstPath := path.Clean("/" + dst)
+	if srcPath == dstPath || strings.HasPrefix(dstPath, srcPath+"/") {
+		return newStatusError(http.StatusForbidden,
+			"Source and destination overlap")
+	}
+	shallow := false
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		if move {
+			return newStatusError(http.StatusBadRequest,
+				"MOVE requires infinite depth")
+		}
+		shallow = true
+	default:
+		return newStatusError(http.StatusBadRequest, "Bad Depth header")
+	}
+	overwrite := r.Header.Get("Overwrite") != "F"
+
+	src, err := f.resolve(ctx, srcPath, false, false)
+	if err != nil {
+		return err
+	}
+	if src.typ != nodeResource {
+		return newStatusError(http.StatusForbidden,
+			"Can't copy or move "+src.name)
+	}
+
+	dstParent, dstName, err := f.resolveParent(ctx, dstPath)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return newStatusError(http.StatusConflict,
+			"Destination directory does not exist")
+	} else if err != nil {
+		return err
+	}
+	dstDir, err := writableDir(dstParent, dstName)
+	if err != nil {
+		return err
+	}
+	existing, err := f.lookupMaybe(ctx, dstParent, dstName)
+	if err != nil {
+		return err
+	}
+	status := http.StatusCreated
+	if existing != nil {
+		if !overwrite {
+			return newStatusError(http.StatusPreconditionFailed,
+				dstName+" already exists")
+		}
+		err = f.removeResource(ctx, existing)
+		if err != nil {
+			return err
+		}
+		status = http.StatusNoContent
+	}
+
+	if move && src.parent.GetFolderBranch() == dstDir.GetFolderBranch() {
+		err = f.config.KBFSOps().Rename(
+			ctx, src.parent, src.name, dstDir, dstName)
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(status)
+		return nil
+	}
+
+	// Moves between TLFs have to copy everything over, and then
+	// remove the source.
+	err = f.copyResource(ctx, src, dstDir, dstName, shallow)
+	if err != nil {
+		return err
+	}
+	if move {
+		err = f.removeResource(ctx, src)
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(status)
+	return nil
+}
+
+// lockTimeout is the timeout reported for all locks.
+const lockTimeout = "Second-3600"
+
+func newLockToken() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	h := hex.EncodeToString(buf[:])
+	return fmt.Sprintf("opaquelocktoken:%s-%s-%s-%s-%s",
+		h[:8], h[8:12], h[12:16], h[16:20], h[20:]), nil
+}
+
+// handleLock pretends to lock the requested resource.  KBFS has no
+// notion of locks, but many WebDAV clients refuse to write to a
+// server that doesn't support them, so every lock request succeeds
+// and nothing is enforced.
+func (f *FS) handleLock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	status := http.StatusOK
+	_, err := f.resolve(ctx, r.URL.Path, true, false)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		// Locking an unmapped URL creates an empty file there.
+		parent, name, err := f.resolveParent(ctx, r.URL.Path)
+		if err != nil {
+			return err
+		}
+		dir, err := writableDir(parent, name)
+		if err != nil {
+			return err
+		}
+		_, _, err = f.config.KBFSOps().CreateFile(
+			ctx, dir, name, false, libkbfs.NoExcl)
+		if err != nil {
+			return err
+		}
+		status = http.StatusCreated
+	} else if err != nil {
+		return err
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return err
+	}
+	depth := r.Header.Get("Depth")
+	if depth == "" {
+		depth = "infinity"
+	}
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<D:prop xmlns:D=\"DAV:\"><D:lockdiscovery>"+
+		"<D:activelock><D:locktype><D:write/></D:locktype>"+
+		"<D:lockscope><D:exclusive/></D:lockscope>"+
+		"<D:depth>%s</D:depth><D:timeout>%s</D:timeout>"+
+		"<D:locktoken><D:href>%s</D:href></D:locktoken>"+
+		"<D:lockroot><D:href>%s</D:href></D:lockroot>"+
+		"</D:activelock></D:lockdiscovery></D:prop>\n",
+		xmlHeader, xmlEscape(depth), lockTimeout, xmlEscape(token),
+		xmlEscape(hrefFor(r.URL.Path, false)))
+	return nil
+}
+
+func (f *FS) handleUnlock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
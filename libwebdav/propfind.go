@@ -0,0 +1,359 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const xmlHeader = `<?xml version="1.0" encoding="utf-8"?>` + "\n"
+
+// davNS is the XML namespace of all the properties defined by WebDAV.
+const davNS = "DAV:"
+
+// liveProps lists the names of the properties that are reported for
+// allprop and propname requests.
+var liveProps = []string{
+	"displayname",
+	"resourcetype",
+	"getcontentlength",
+	"getcontenttype",
+	"getlastmodified",
+	"creationdate",
+	"getetag",
+	"supportedlock",
+	"lockdiscovery",
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	// Writing to a bytes.Buffer never fails.
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// propNames is the contents of a DAV:prop element in a request.
+type propNames struct {
+	Props []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name   `xml:"DAV: propfind"`
+	AllProp  *struct{}  `xml:"DAV: allprop"`
+	PropName *struct{}  `xml:"DAV: propname"`
+	Prop     *propNames `xml:"DAV: prop"`
+}
+
+type propertyUpdateAction struct {
+	Prop propNames `xml:"DAV: prop"`
+}
+
+type propertyUpdateRequest struct {
+	XMLName xml.Name               `xml:"DAV: propertyupdate"`
+	Set     []propertyUpdateAction `xml:"DAV: set"`
+	Remove  []propertyUpdateAction `xml:"DAV: remove"`
+}
+
+// decodeBody decodes the XML request body into v.  It returns false
+// if the body is empty.
+func decodeBody(r *http.Request, v interface{}) (bool, error) {
+	err := xml.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, newStatusError(http.StatusBadRequest,
+			"Bad XML body: "+err.Error())
+	}
+	return true, nil
+}
+
+// propValue returns the XML contents of the given live property for
+// res, or false if res doesn't have that property.
+func (f *FS) propValue(ctx context.Context, res *resource, name string) (
+	string, bool, error) {
+	var size int64 = -1
+	var mtime time.Time
+	switch res.typ {
+	case nodeResource, tlfResource:
+		if res.ei.Mtime != 0 {
+			mtime = time.Unix(0, res.ei.Mtime)
+		}
+		if !res.isDir() {
+			size = int64(res.ei.Size)
+		}
+	case specialResource:
+		if res.special.readAt != nil {
+			if name == "getcontentlength" {
+				var err error
+				size, err = res.special.size(ctx)
+				if err != nil {
+					return "", false, err
+				}
+			}
+		} else if res.special.read == nil {
+			size = 0
+		} else if name == "getcontentlength" || name == "getlastmodified" {
+			data, t, err := res.special.read(ctx)
+			if err != nil {
+				return "", false, err
+			}
+			size, mtime = int64(len(data)), t
+		}
+	}
+
+	switch name {
+	case "displayname":
+		return xmlEscape(res.name), true, nil
+	case "resourcetype":
+		if res.isDir() {
+			return "<D:collection/>", true, nil
+		}
+		return "", true, nil
+	case "getcontentlength":
+		if res.isDir() {
+			return "", false, nil
+		}
+		if size < 0 {
+			size = 0
+		}
+		return fmt.Sprintf("%d", size), true, nil
+	case "getcontenttype":
+		if res.isDir() {
+			return "", false, nil
+		}
+		ctype := mime.TypeByExtension(path.Ext(res.name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		return xmlEscape(ctype), true, nil
+	case "getlastmodified":
+		if mtime.IsZero() {
+			return "", false, nil
+		}
+		return mtime.UTC().Format(http.TimeFormat), true, nil
+	case "creationdate":
+		if res.typ != nodeResource && res.typ != tlfResource ||
+			res.ei.Ctime == 0 {
+			return "", false, nil
+		}
+		return time.Unix(0, res.ei.Ctime).UTC().Format(time.RFC3339), true, nil
+	case "getetag":
+		if res.typ != nodeResource || res.isDir() {
+			return "", false, nil
+		}
+		return xmlEscape(etag(res.ei)), true, nil
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope>" +
+			"<D:locktype><D:write/></D:locktype></D:lockentry>", true, nil
+	case "lockdiscovery":
+		return "", true, nil
+	}
+	return "", false, nil
+}
+
+// writeResponse writes the multistatus response element for one
+// resource to buf.
+func (f *FS) writeResponse(ctx context.Context, buf *bytes.Buffer,
+	res *resource, p string, req propfindRequest) error {
+	fmt.Fprintf(buf, "<D:response><D:href>%s</D:href>",
+		xmlEscape(hrefFor(p, res.isDir())))
+
+	if req.PropName != nil {
+		buf.WriteString("<D:propstat><D:prop>")
+		for _, name := range liveProps {
+			if _, ok, err := f.propValue(ctx, res, name); err != nil {
+				return err
+			} else if ok {
+				fmt.Fprintf(buf, "<D:%s/>", name)
+			}
+		}
+		buf.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status>" +
+			"</D:propstat></D:response>\n")
+		return nil
+	}
+
+	var names []xml.Name
+	if req.Prop != nil {
+		for _, p := range req.Prop.Props {
+			names = append(names, p.XMLName)
+		}
+	} else {
+		for _, name := range liveProps {
+			names = append(names, xml.Name{Space: davNS, Local: name})
+		}
+	}
+
+	var found, missing bytes.Buffer
+	for _, name := range names {
+		if name.Space == davNS {
+			value, ok, err := f.propValue(ctx, res, name.Local)
+			if err != nil {
+				return err
+			}
+			if ok {
+				fmt.Fprintf(&found, "<D:%s>%s</D:%s>",
+					name.Local, value, name.Local)
+				continue
+			}
+			if req.Prop == nil {
+				// allprop only reports the properties that exist.
+				continue
+			}
+		}
+		writeEmptyProp(&missing, name)
+	}
+
+	if found.Len() > 0 {
+		fmt.Fprintf(buf, "<D:propstat><D:prop>%s</D:prop>"+
+			"<D:status>HTTP/1.1 200 OK</D:status></D:propstat>",
+			found.String())
+	}
+	if missing.Len() > 0 {
+		fmt.Fprintf(buf, "<D:propstat><D:prop>%s</D:prop>"+
+			"<D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>",
+			missing.String())
+	}
+	buf.WriteString("</D:response>\n")
+	return nil
+}
+
+// writeEmptyProp writes an empty element with the given name to buf.
+func writeEmptyProp(buf *bytes.Buffer, name xml.Name) {
+	if name.Space == davNS {
+		fmt.Fprintf(buf, "<D:%s/>", name.Local)
+		return
+	}
+	fmt.Fprintf(buf, "<R:%s xmlns:R=\"%s\"/>", name.Local,
+		xmlEscape(name.Space))
+}
+
+// propfindWalk writes responses for res and, up to the given depth,
+// everything under it.  A negative depth means infinity.
+func (f *FS) propfindWalk(ctx context.Context, buf *bytes.Buffer,
+	res *resource, p string, depth int, req propfindRequest) error {
+	err := f.writeResponse(ctx, buf, res, p, req)
+	if err != nil {
+		return err
+	}
+	if depth == 0 || !res.isDir() {
+		return nil
+	}
+
+	children, err := f.listDir(ctx, res)
+	if err != nil {
+		return err
+	}
+	sort.Sort(resourcesByName(children))
+	for _, child := range children {
+		childPath := path.Join(p, child.name)
+		if depth != 1 && child.isDir() {
+			// Walking deeper needs the nodes of the directories
+			// under this one.
+			child, err = f.resolve(ctx, childPath, false, false)
+			if err != nil {
+				f.log.CDebugf(ctx, "Skipping %s: %v", childPath, err)
+				continue
+			}
+		}
+		err = f.propfindWalk(ctx, buf, child, childPath, depth-1, req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FS) handlePropfind(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	depth := -1
+	switch r.Header.Get("Depth") {
+	case "0":
+		depth = 0
+	case "1":
+		depth = 1
+	case "", "infinity":
+	default:
+		return newStatusError(http.StatusBadRequest, "Bad Depth header")
+	}
+
+	var req propfindRequest
+	hasBody, err := decodeBody(r, &req)
+	if err != nil {
+		return err
+	}
+	if !hasBody {
+		// An empty body means allprop.
+		req.AllProp = &struct{}{}
+	}
+
+	res, err := f.resolve(ctx, r.URL.Path, true, false)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xmlHeader)
+	buf.WriteString("<D:multistatus xmlns:D=\"DAV:\">\n")
+	err = f.propfindWalk(ctx, &buf, res, r.URL.Path, depth, req)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("</D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		// The status has already been sent, so just log it.
+		f.log.CDebugf(ctx, "Couldn't write PROPFIND response: %v", err)
+	}
+	return nil
+}
+
+// handleProppatch refuses to change any properties, since KBFS has
+// nowhere to store them.
+func (f *FS) handleProppatch(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	_, err := f.resolve(ctx, r.URL.Path, true, false)
+	if err != nil {
+		return err
+	}
+
+	var req propertyUpdateRequest
+	_, err = decodeBody(r, &req)
+	if err != nil {
+		return err
+	}
+
+	var props bytes.Buffer
+	for _, actions := range [][]propertyUpdateAction{req.Set, req.Remove} {
+		for _, action := range actions {
+			for _, p := range action.Prop.Props {
+				writeEmptyProp(&props, p.XMLName)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprintf(w, "%s<D:multistatus xmlns:D=\"DAV:\"><D:response>"+
+		"<D:href>%s</D:href><D:propstat><D:prop>%s</D:prop>"+
+		"<D:status>HTTP/1.1 403 Forbidden</D:status></D:propstat>"+
+		"</D:response></D:multistatus>\n", xmlHeader,
+		xmlEscape(hrefFor(r.URL.Path, false)), props.String())
+	return nil
+}
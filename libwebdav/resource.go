@@ -0,0 +1,307 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// maxLinkFollows is the most symlinks and TLF aliases that will be
+// followed while resolving a single path.
+const maxLinkFollows = 40
+
+type resourceType int
+
+const (
+	rootResource resourceType = iota
+	folderListResource
+	tlfResource
+	nodeResource
+	specialResource
+	aliasResource
+)
+
+// resource is anything that can be named by a WebDAV path.  Since
+// WebDAV is stateless, resources are resolved from scratch for every
+// request.
+type resource struct {
+	typ  resourceType
+	name string
+
+	// public is set for the public folder list and everything
+	// under it.
+	public bool
+
+	// node is the KBFS node for TLFs and everything under them.
+	// It's nil for a TLF that hasn't been created yet, which is
+	// shown as an empty directory.
+	node libkbfs.Node
+	// parent is the directory containing node, or nil for a TLF.
+	parent libkbfs.Node
+	ei     libkbfs.EntryInfo
+
+	// handle is set for TLFs.
+	handle *libkbfs.TlfHandle
+
+	// special is set for special files.
+	special *specialFile
+
+	// canon is the canonical name that an alias points to.
+	canon string
+}
+
+func (r *resource) isDir() bool {
+	switch r.typ {
+	case rootResource, folderListResource, tlfResource:
+		return true
+	case nodeResource:
+		return r.ei.Type == libkbfs.Dir
+	}
+	return false
+}
+
+// splitPath returns the non-empty components of the given URL path.
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// lookupRoot looks up name in the root directory.
+func (f *FS) lookupRoot(name string) (*resource, error) {
+	switch name {
+	case PrivateName:
+		return &resource{typ: folderListResource, name: name}, nil
+	case PublicName:
+		return &resource{typ: folderListResource, name: name, public: true},
+			nil
+	}
+	if special := handleNonTLFSpecialFile(name, f); special != nil {
+		return &resource{typ: specialResource, name: name, special: special},
+			nil
+	}
+	return nil, libkbfs.NoSuchNameError{Name: name}
+}
+
+// lookupTLF looks up the TLF with the given name.  If create is
+// set, the TLF is created if it doesn't exist yet.
+func (f *FS) lookupTLF(ctx context.Context, name string, public bool,
+	create bool) (*resource, error) {
+	if special := handleNonTLFSpecialFile(name, f); special != nil {
+		return &resource{typ: specialResource, name: name, special: special},
+			nil
+	}
+
+	h, err := libkbfs.ParseTlfHandlePreferred(
+		ctx, f.config.KBPKI(), name, public)
+	switch err := err.(type) {
+	case nil:
+		// no error
+
+	case libkbfs.TlfNameNotCanonical:
+		// Only permit aliases to targets that contain no errors.
+		if libkbfs.CheckTlfHandleOffline(ctx, err.NameToTry, public) != nil {
+			f.log.CDebugf(ctx, "Refusing alias to non-valid target %q",
+				err.NameToTry)
+			return nil, libkbfs.NoSuchNameError{Name: name}
+		}
+		return &resource{typ: aliasResource, name: name,
+			public: public, canon: err.NameToTry}, nil
+
+	case libkbfs.NoSuchNameError, libkbfs.BadTLFNameError:
+		// Invalid public TLF.
+		return nil, libkbfs.NoSuchNameError{Name: name}
+
+	default:
+		// Some other error.
+		return nil, err
+	}
+
+	res := &resource{typ: tlfResource, name: name, public: public, handle: h}
+	if create {
+		res.node, res.ei, err = f.config.KBFSOps().GetOrCreateRootNode(
+			ctx, h, libkbfs.MasterBranch)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	res.node, res.ei, err = f.config.KBFSOps().GetRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	if err == nil && res.node == nil {
+		err = libfs.TlfDoesNotExist{}
+	}
+	exitEarly, err := libfs.FilterTLFEarlyExitError(
+		ctx, err, f.log, h.GetCanonicalName())
+	if err != nil {
+		return nil, err
+	}
+	if exitEarly {
+		// Pretend it's an empty directory.
+		res.node = nil
+		res.ei = libkbfs.EntryInfo{Type: libkbfs.Dir}
+	}
+	return res, nil
+}
+
+// lookupInDir looks up name in the given TLF or directory.
+func (f *FS) lookupInDir(ctx context.Context, dir *resource, name string) (
+	*resource, error) {
+	if dir.node == nil {
+		// This TLF doesn't exist yet, so only the common special
+		// files can be in it.
+		if special := handleCommonSpecialFile(name, f); special != nil {
+			return &resource{typ: specialResource, name: name,
+				special: special}, nil
+		}
+		return nil, libkbfs.NoSuchNameError{Name: name}
+	}
+
+	if special := handleTLFSpecialFile(
+		name, f, dir.node.GetFolderBranch()); special != nil {
+		return &resource{typ: specialResource, name: name, special: special},
+			nil
+	}
+
+	node, ei, err := f.config.KBFSOps().Lookup(ctx, dir.node, name)
+	if err != nil {
+		return nil, err
+	}
+	return &resource{typ: nodeResource, name: name, public: dir.public,
+		node: node, parent: dir.node, ei: ei}, nil
+}
+
+// lookup looks up name within dir.  If create is set, any TLF that
+// is looked up is created if needed.
+func (f *FS) lookup(ctx context.Context, dir *resource, name string,
+	create bool) (*resource, error) {
+	switch dir.typ {
+	case rootResource:
+		return f.lookupRoot(name)
+	case folderListResource:
+		return f.lookupTLF(ctx, name, dir.public, create)
+	}
+	if !dir.isDir() {
+		return nil, newStatusError(http.StatusConflict,
+			dir.name+" is not a directory")
+	}
+	return f.lookupInDir(ctx, dir, name)
+}
+
+// resolve returns the resource named by the given URL path.  If
+// followFinal is set and the path names a symlink, its target is
+// returned instead.  If create is set, any TLF along the path is
+// created if it doesn't exist yet.
+func (f *FS) resolve(ctx context.Context, p string, followFinal bool,
+	create bool) (*resource, error) {
+	comps := splitPath(p)
+	follows := 0
+outer:
+	for {
+		res := &resource{typ: rootResource}
+		for i, name := range comps {
+			next, err := f.lookup(ctx, res, name, create)
+			if err != nil {
+				return nil, err
+			}
+
+			var target []string
+			switch {
+			case next.typ == aliasResource:
+				// Aliases are always followed, since they can't be
+				// operated on themselves.
+				target = append([]string{}, comps[:i]...)
+				target = append(target, next.canon)
+			case next.typ == nodeResource &&
+				next.ei.Type == libkbfs.Sym &&
+				(i < len(comps)-1 || followFinal):
+				if path.IsAbs(next.ei.SymPath) {
+					return nil, newStatusError(http.StatusNotFound,
+						"Can't follow absolute symlink "+name)
+				}
+				target = splitPath(path.Join(
+					append(append([]string{}, comps[:i]...),
+						next.ei.SymPath)...))
+			default:
+				res = next
+				continue
+			}
+
+			follows++
+			if follows > maxLinkFollows {
+				return nil, newStatusError(http.StatusLoopDetected,
+					"Too many levels of symbolic links")
+			}
+			comps = append(target, comps[i+1:]...)
+			continue outer
+		}
+		return res, nil
+	}
+}
+
+// resolveParent returns the directory containing the given URL path,
+// and the name of the final path component.  Any TLF along the path
+// is created if it doesn't exist yet.
+func (f *FS) resolveParent(ctx context.Context, p string) (
+	parent *resource, name string, err error) {
+	comps := splitPath(p)
+	if len(comps) == 0 {
+		return nil, "", newStatusError(http.StatusForbidden,
+			"Can't modify the root")
+	}
+	parent, err = f.resolve(
+		ctx, strings.Join(comps[:len(comps)-1], "/"), true, true)
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, comps[len(comps)-1], nil
+}
+
+// lookupMaybe looks up name within parent, returning a nil resource
+// if it doesn't exist.  TLF aliases are resolved.
+func (f *FS) lookupMaybe(ctx context.Context, parent *resource, name string) (
+	*resource, error) {
+	res, err := f.lookup(ctx, parent, name, true)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if res.typ == aliasResource {
+		return f.lookup(ctx, parent, res.canon, true)
+	}
+	return res, nil
+}
+
+// writableDir returns the KBFS node for the given directory
+// resource, or an error if new entries can't be made in it.
+func writableDir(dir *resource, name string) (libkbfs.Node, error) {
+	switch dir.typ {
+	case rootResource:
+		return nil, newStatusError(http.StatusForbidden,
+			"Can't create entries in the root")
+	case folderListResource:
+		pathType := libkbfs.PrivatePathType
+		if dir.public {
+			pathType = libkbfs.PublicPathType
+		}
+		return nil, libkbfs.NewWriteUnsupportedError(
+			libkbfs.BuildCanonicalPath(pathType, name))
+	}
+	if !dir.isDir() || dir.node == nil {
+		return nil, newStatusError(http.StatusConflict,
+			dir.name+" is not a directory")
+	}
+	return dir.node, nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"errors"
+	"time"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// specialFile is a file that isn't stored in KBFS, and instead
+// reports some state or triggers an action when written to.
+type specialFile struct {
+	// read returns the contents of the file, or is nil if the file
+	// can't be read.
+	read func(ctx context.Context) ([]byte, time.Time, error)
+	// readAt, if set instead of read, reads the contents of a file
+	// that may be too big to hold in memory a piece at a time, and
+	// size returns how big it is so far.
+	readAt func(ctx context.Context, p []byte, off int64) (int, error)
+	size   func(ctx context.Context) (int64, error)
+	// write performs the file's action, or is nil if the file
+	// can't be written.  It's only called with non-empty data.
+	write func(ctx context.Context, data []byte) error
+}
+
+func newSpecialReadFile(
+	read func(ctx context.Context) ([]byte, time.Time, error)) *specialFile {
+	return &specialFile{read: read}
+}
+
+func newSpecialStreamFile(
+	readAt func(ctx context.Context, p []byte, off int64) (int, error),
+	size func(ctx context.Context) (int64, error)) *specialFile {
+	return &specialFile{readAt: readAt, size: size}
+}
+
+func newSpecialWriteFile(
+	write func(ctx context.Context, data []byte) error) *specialFile {
+	return &specialFile{write: write}
+}
+
+func (f *FS) journalControlFile(
+	action libfs.JournalAction, fb libkbfs.FolderBranch) *specialFile {
+	return newSpecialWriteFile(func(ctx context.Context, _ []byte) error {
+		jServer, err := libkbfs.GetJournalServer(f.config)
+		if err != nil {
+			return err
+		}
+		return action.Execute(ctx, jServer, fb.Tlf)
+	})
+}
+
+func (f *FS) updatesFile(enable bool, fb libkbfs.FolderBranch) *specialFile {
+	return newSpecialWriteFile(func(ctx context.Context, _ []byte) error {
+		f.updatesLock.Lock()
+		defer f.updatesLock.Unlock()
+		updateChan := f.updateChans[fb]
+		if enable {
+			if updateChan == nil {
+				return errors.New("Updates are already enabled")
+			}
+			err := libkbfs.RestartCRForTesting(
+				libkbfs.BackgroundContextWithCancellationDelayer(),
+				f.config, fb)
+			if err != nil {
+				return err
+			}
+			updateChan <- struct{}{}
+			close(updateChan)
+			delete(f.updateChans, fb)
+			return nil
+		}
+
+		if updateChan != nil {
+			return errors.New("Updates are already disabled")
+		}
+		updateChan, err := libkbfs.DisableUpdatesForTesting(f.config, fb)
+		if err != nil {
+			return err
+		}
+		f.updateChans[fb] = updateChan
+		return libkbfs.DisableCRForTesting(f.config, fb)
+	})
+}
+
+// handleCommonSpecialFile handles special files that are present both
+// within a TLF and outside a TLF.
+func handleCommonSpecialFile(name string, f *FS) *specialFile {
+	switch name {
+	case libkbfs.ErrorFile:
+		return newSpecialReadFile(libfs.GetEncodedErrors(f.config))
+	case libfs.MetricsFileName:
+		return newSpecialReadFile(libfs.GetEncodedMetrics(f.config))
+	case libfs.ResetCachesFileName:
+		return newSpecialWriteFile(func(context.Context, []byte) error {
+			f.config.ResetCaches()
+			return nil
+		})
+	case libfs.BandwidthLimitsFileName:
+		return &specialFile{
+			read: libfs.GetEncodedBandwidthLimits(f.config),
+			write: func(ctx context.Context, data []byte) error {
+				_, err := libfs.SetBandwidthLimits(
+					ctx, f.log, f.config, data)
+				return err
+			},
+		}
+	}
+
+	return nil
+}
+
+// handleNonTLFSpecialFile handles special files that are outside a
+// TLF, i.e. /, /private, and /public.
+func handleNonTLFSpecialFile(name string, f *FS) *specialFile {
+	special := handleCommonSpecialFile(name, f)
+	if special != nil {
+		return special
+	}
+
+	switch name {
+	case libfs.StatusFileName:
+		return newSpecialReadFile(func(ctx context.Context) (
+			[]byte, time.Time, error) {
+			return libfs.GetEncodedStatus(ctx, f.config)
+		})
+	case libfs.HumanErrorFileName, libfs.HumanNoLoginFileName:
+		return newSpecialReadFile(f.remoteStatus.NewSpecialReadFunc)
+	case libfs.EnableAutoJournalsFileName:
+		return f.journalControlFile(
+			libfs.JournalEnableAuto, libkbfs.FolderBranch{})
+	case libfs.DisableAutoJournalsFileName:
+		return f.journalControlFile(
+			libfs.JournalDisableAuto, libkbfs.FolderBranch{})
+	}
+
+	return nil
+}
+
+// handleTLFSpecialFile handles special files that are within a TLF.
+func handleTLFSpecialFile(
+	name string, f *FS, fb libkbfs.FolderBranch) *specialFile {
+	special := handleCommonSpecialFile(name, f)
+	if special != nil {
+		return special
+	}
+
+	switch name {
+	case libfs.StatusFileName:
+		return newSpecialReadFile(func(ctx context.Context) (
+			[]byte, time.Time, error) {
+			return libfs.GetEncodedFolderStatus(ctx, f.config, fb)
+		})
+
+	case libfs.EditHistoryName:
+		return newSpecialReadFile(func(ctx context.Context) (
+			[]byte, time.Time, error) {
+			return libfs.GetEncodedTlfEditHistory(ctx, f.config, fb)
+		})
+
+	case libfs.UnstageFileName:
+		return newSpecialWriteFile(func(ctx context.Context,
+			data []byte) error {
+			_, err := libfs.UnstageForTesting(
+				ctx, f.log, f.config, fb, data)
+			return err
+		})
+
+	case libfs.UnmergedChangesFileName:
+		return newSpecialReadFile(func(ctx context.Context) (
+			[]byte, time.Time, error) {
+			return libfs.GetEncodedUnmergedChanges(ctx, f.config, fb)
+		})
+
+	case libfs.ConflictChoiceFileName:
+		return newSpecialWriteFile(func(ctx context.Context,
+			data []byte) error {
+			_, err := libfs.SetConflictChoices(
+				ctx, f.log, f.config, fb, data)
+			return err
+		})
+
+	case libfs.DisableUpdatesFileName:
+		return f.updatesFile(false, fb)
+
+	case libfs.EnableUpdatesFileName:
+		return f.updatesFile(true, fb)
+
+	case libfs.RekeyFileName:
+		return newSpecialWriteFile(func(ctx context.Context, _ []byte) error {
+			return f.config.KBFSOps().Rekey(ctx, fb.Tlf)
+		})
+
+	case libfs.ReclaimQuotaFileName:
+		return newSpecialWriteFile(func(context.Context, []byte) error {
+			return libkbfs.ForceQuotaReclamationForTesting(f.config, fb)
+		})
+
+	case libfs.SyncFromServerFileName:
+		return newSpecialWriteFile(func(ctx context.Context, _ []byte) error {
+			// Use a context with a nil CtxAppIDKey value so that
+			// notifications generated from this sync won't be
+			// discarded.
+			syncCtx := context.WithValue(ctx, libfs.CtxAppIDKey, nil)
+			return f.config.KBFSOps().SyncFromServerForTesting(syncCtx, fb)
+		})
+
+	case libfs.EnableJournalFileName:
+		return f.journalControlFile(libfs.JournalEnable, fb)
+
+	case libfs.FlushJournalFileName:
+		return f.journalControlFile(libfs.JournalFlush, fb)
+
+	case libfs.PauseJournalBackgroundWorkFileName:
+		return f.journalControlFile(libfs.JournalPauseBackgroundWork, fb)
+
+	case libfs.ResumeJournalBackgroundWorkFileName:
+		return f.journalControlFile(libfs.JournalResumeBackgroundWork, fb)
+
+	case libfs.DisableJournalFileName:
+		return f.journalControlFile(libfs.JournalDisable, fb)
+	}
+
+	if since, ok := libfs.ParseChangeFeedName(name); ok {
+		feed := libfs.NewChangeFeed(f.config, fb, since)
+		return newSpecialStreamFile(feed.ReadAt, feed.Size)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// DefaultListenAddr is the default address for the WebDAV server.
+const DefaultListenAddr = "127.0.0.1:16723"
+
+// defaultSecretFileName is the name of the file, in the data
+// directory, that holds the server's secret by default.
+const defaultSecretFileName = "kbfswebdav.secret"
+
+// StartOptions are options for starting up
+type StartOptions struct {
+	KbfsParams libkbfs.InitParams
+	RuntimeDir string
+	Label      string
+	// ListenAddr is the address to serve WebDAV on.  It must be a
+	// loopback address.
+	ListenAddr string
+	// SecretFile is where to write the secret that clients must
+	// use as their password.  If empty, it is written to the data
+	// directory.
+	SecretFile string
+}
+
+// checkListenAddr returns an error if addr isn't on a loopback
+// interface; KBFS must never be served to other machines.
+func checkListenAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLocalHost(host) {
+		return fmt.Errorf("refusing to listen on non-loopback address %s",
+			addr)
+	}
+	return nil
+}
+
+// writeSecretFile makes a new random secret, and writes it to a file
+// at the given path that only the current user can read.  Any
+// existing file there is replaced rather than written through.
+func writeSecretFile(secretFile string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(buf)
+
+	err := os.MkdirAll(filepath.Dir(secretFile), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = os.Remove(secretFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	f, err := os.OpenFile(
+		secretFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(secret)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Start the WebDAV server
+func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
+	// InitLog errors are non-fatal and are ignored.
+	log, err := libkbfs.InitLog(options.KbfsParams, kbCtx)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	if options.RuntimeDir != "" {
+		info := libkb.NewServiceInfo(libkbfs.Version, libkbfs.PrereleaseBuild, options.Label, os.Getpid())
+		err := info.WriteFile(path.Join(options.RuntimeDir, "kbfs.info"))
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+	}
+
+	err = checkListenAddr(options.ListenAddr)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	secretFile := options.SecretFile
+	if secretFile == "" {
+		secretFile = filepath.Join(kbCtx.GetDataDir(), defaultSecretFileName)
+	}
+	secret, err := writeSecretFile(secretFile)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+	log.Debug("Wrote the WebDAV secret to %s", secretFile)
+
+	log.Debug("Listening on %s", options.ListenAddr)
+	listener, err := net.Listen("tcp", options.ListenAddr)
+	if err != nil {
+		return libfs.MountError(err.Error())
+	}
+	defer listener.Close()
+
+	// On an interrupt, stop accepting connections so that Serve
+	// returns.
+	onInterruptFn := func() {
+		listener.Close()
+		libkbfs.Shutdown()
+	}
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(kbCtx, options.KbfsParams, nil, onInterruptFn, log)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	defer libkbfs.Shutdown()
+
+	log.Debug("Creating filesystem")
+	fs := NewFS(config, options.KbfsParams.Debug, secret)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs.Init(ctx)
+
+	log.Debug("Serving WebDAV on http://%s/", listener.Addr())
+	err = http.Serve(listener, fs)
+	if err != nil {
+		log.Debug("Serve ended: %v", err)
+	}
+
+	log.Debug("Ending")
+	return nil
+}
@@ -0,0 +1,493 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+const testSecret = "test secret"
+
+func makeTestServer(t *testing.T, users ...string) (
+	*libkbfs.ConfigLocal, *httptest.Server) {
+	var names []libkb.NormalizedUsername
+	for _, u := range users {
+		names = append(names, libkb.NormalizedUsername(u))
+	}
+	config := libkbfs.MakeTestConfigOrBust(t, names...)
+	srv := httptest.NewServer(NewFS(config, false, testSecret))
+	return config, srv
+}
+
+func shutdownTestServer(t *testing.T, config *libkbfs.ConfigLocal,
+	srv *httptest.Server) {
+	srv.Close()
+	libkbfs.CheckConfigAndShutdown(t, config)
+}
+
+func doRequest(t *testing.T, srv *httptest.Server, method, p string,
+	body io.Reader, headers map[string]string) (int, string) {
+	req, err := http.NewRequest(method, srv.URL+p, body)
+	require.NoError(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBasicAuth("", testSecret)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func putFile(t *testing.T, srv *httptest.Server, p, contents string) int {
+	code, _ := doRequest(t, srv, "PUT", p, strings.NewReader(contents), nil)
+	return code
+}
+
+func getFile(t *testing.T, srv *httptest.Server, p string) (int, string) {
+	return doRequest(t, srv, "GET", p, nil, nil)
+}
+
+type testMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				DisplayName   string `xml:"DAV: displayname"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func propfind(t *testing.T, srv *httptest.Server, p, depth string) (
+	hrefs []string, ms testMultistatus) {
+	code, body := doRequest(t, srv, "PROPFIND", p, nil,
+		map[string]string{"Depth": depth})
+	require.Equal(t, http.StatusMultiStatus, code, body)
+	require.NoError(t, xml.Unmarshal([]byte(body), &ms))
+	for _, r := range ms.Responses {
+		hrefs = append(hrefs, r.Href)
+	}
+	sort.Strings(hrefs)
+	return hrefs, ms
+}
+
+func TestPutAndGet(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	require.Equal(t, http.StatusCreated,
+		putFile(t, srv, "/private/jdoe/myfile", "hello"))
+	code, body := getFile(t, srv, "/private/jdoe/myfile")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "hello", body)
+
+	// Overwriting truncates the old contents.
+	require.Equal(t, http.StatusNoContent,
+		putFile(t, srv, "/private/jdoe/myfile", "bye"))
+	code, body = getFile(t, srv, "/private/jdoe/myfile")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "bye", body)
+
+	// Ranges are supported.
+	code, body = doRequest(t, srv, "GET", "/private/jdoe/myfile", nil,
+		map[string]string{"Range": "bytes=1-"})
+	require.Equal(t, http.StatusPartialContent, code)
+	require.Equal(t, "ye", body)
+
+	code, _ = getFile(t, srv, "/private/jdoe/nope")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestMkcolPropfindDelete(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	code, _ := doRequest(t, srv, "MKCOL", "/private/jdoe/a", nil, nil)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = doRequest(t, srv, "MKCOL", "/private/jdoe/a", nil, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = doRequest(t, srv, "MKCOL", "/private/jdoe/x/y", nil, nil)
+	require.Equal(t, http.StatusConflict, code)
+	require.Equal(t, http.StatusCreated,
+		putFile(t, srv, "/private/jdoe/a/b", "hello"))
+
+	hrefs, ms := propfind(t, srv, "/private/jdoe/a", "1")
+	require.Equal(t, []string{"/private/jdoe/a/", "/private/jdoe/a/b"}, hrefs)
+	for _, r := range ms.Responses {
+		prop := r.Propstat[0].Prop
+		if r.Href == "/private/jdoe/a/b" {
+			require.Equal(t, "b", prop.DisplayName)
+			require.Equal(t, "5", prop.ContentLength)
+			require.Nil(t, prop.ResourceType.Collection)
+		} else {
+			require.NotNil(t, prop.ResourceType.Collection)
+		}
+	}
+
+	hrefs, _ = propfind(t, srv, "/", "1")
+	require.Equal(t, []string{"/", "/private/", "/public/"}, hrefs)
+	hrefs, _ = propfind(t, srv, "/private", "1")
+	require.Equal(t, []string{"/private/", "/private/jdoe/"}, hrefs)
+
+	// Deleting a directory removes everything in it.
+	code, _ = doRequest(t, srv, "DELETE", "/private/jdoe/a", nil, nil)
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = getFile(t, srv, "/private/jdoe/a/b")
+	require.Equal(t, http.StatusNotFound, code)
+	hrefs, _ = propfind(t, srv, "/private/jdoe", "1")
+	require.Equal(t, []string{"/private/jdoe/"}, hrefs)
+}
+
+func TestCopyAndMove(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	require.Equal(t, http.StatusCreated,
+		putFile(t, srv, "/private/jdoe/a/../a", "hello"))
+	code, _ := doRequest(t, srv, "MKCOL", "/private/jdoe/d", nil, nil)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, _ = doRequest(t, srv, "COPY", "/private/jdoe/a", nil,
+		map[string]string{"Destination": srv.URL + "/private/jdoe/d/b"})
+	require.Equal(t, http.StatusCreated, code)
+	code, body := getFile(t, srv, "/private/jdoe/d/b")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "hello", body)
+
+	// Moving onto an existing file without overwriting fails.
+	code, _ = doRequest(t, srv, "MOVE", "/private/jdoe/a", nil,
+		map[string]string{
+			"Destination": "/private/jdoe/d/b",
+			"Overwrite":   "F",
+		})
+	require.Equal(t, http.StatusPreconditionFailed, code)
+
+	require.Equal(t, http.StatusNoContent,
+		putFile(t, srv, "/private/jdoe/a", "new"))
+	code, _ = doRequest(t, srv, "MOVE", "/private/jdoe/a", nil,
+		map[string]string{"Destination": "/private/jdoe/d/b"})
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = getFile(t, srv, "/private/jdoe/a")
+	require.Equal(t, http.StatusNotFound, code)
+	code, body = getFile(t, srv, "/private/jdoe/d/b")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "new", body)
+
+	// Moves across TLFs copy the data.
+	code, _ = doRequest(t, srv, "MOVE", "/private/jdoe/d", nil,
+		map[string]string{"Destination": "/public/jdoe/d"})
+	require.Equal(t, http.StatusCreated, code)
+	code, body = getFile(t, srv, "/public/jdoe/d/b")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "new", body)
+	code, _ = getFile(t, srv, "/private/jdoe/d")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestSpecialFiles(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	code, body := getFile(t, srv, "/"+libfs.StatusFileName)
+	require.Equal(t, http.StatusOK, code)
+	var status libkbfs.KBFSStatus
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	require.Equal(t, "jdoe", status.CurrentUser)
+
+	require.Equal(t, http.StatusCreated,
+		putFile(t, srv, "/private/jdoe/myfile", "hello"))
+	code, body = getFile(t, srv, "/private/jdoe/"+libfs.StatusFileName)
+	require.Equal(t, http.StatusOK, code)
+	var folderStatus libkbfs.FolderBranchStatus
+	require.NoError(t, json.Unmarshal([]byte(body), &folderStatus))
+	// The PUT creates, writes and then renames a temporary file.
+	require.Equal(t, libkbfs.MetadataRevision(4), folderStatus.Revision)
+	require.False(t, folderStatus.Staged)
+
+	// Special files aren't listed.
+	hrefs, _ := propfind(t, srv, "/private/jdoe", "1")
+	require.Equal(t, []string{"/private/jdoe/", "/private/jdoe/myfile"},
+		hrefs)
+
+	// Writing to a read-only special file fails, but writing to an
+	// action file triggers it.
+	require.Equal(t, http.StatusMethodNotAllowed,
+		putFile(t, srv, "/private/jdoe/"+libfs.StatusFileName, "x"))
+	require.Equal(t, http.StatusNoContent,
+		putFile(t, srv, "/private/jdoe/"+libfs.SyncFromServerFileName, "x"))
+	code, _ = getFile(t, srv, "/private/jdoe/"+libfs.SyncFromServerFileName)
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// Nothing is unmerged, so the only conflict choice that can be
+	// set is "auto".
+	code, body = getFile(t, srv,
+		"/private/jdoe/"+libfs.UnmergedChangesFileName)
+	require.Equal(t, http.StatusOK, code)
+	var changes []libkbfs.UnmergedChange
+	require.NoError(t, json.Unmarshal([]byte(body), &changes))
+	require.Len(t, changes, 0)
+	require.Equal(t, http.StatusConflict, putFile(t, srv,
+		"/private/jdoe/"+libfs.ConflictChoiceFileName, "mine myfile\n"))
+	require.Equal(t, http.StatusNoContent, putFile(t, srv,
+		"/private/jdoe/"+libfs.ConflictChoiceFileName, "auto myfile\n"))
+	require.NotEqual(t, http.StatusNoContent, putFile(t, srv,
+		"/private/jdoe/"+libfs.ConflictChoiceFileName, "yours myfile\n"))
+
+	// The change feed lists the upload of myfile, one JSON object
+	// per line, ending with its temporary file being renamed into
+	// place.
+	code, body = getFile(t, srv, "/private/jdoe/"+libfs.ChangeFeedPrefix+"0")
+	require.Equal(t, http.StatusOK, code)
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	var change libkbfs.TlfChange
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &change))
+	require.Equal(t, libkbfs.EntryRenamed, change.Type)
+	require.Equal(t, "myfile", change.Path)
+	require.Equal(t, libkb.NormalizedUsername("jdoe"), change.Writer)
+
+	// Bandwidth limits can be changed one at a time, from anywhere.
+	require.Equal(t, http.StatusNoContent, putFile(t, srv,
+		"/private/jdoe/"+libfs.BandwidthLimitsFileName, `{"upload":1000}`))
+	require.Equal(t, http.StatusNoContent, putFile(t, srv,
+		"/"+libfs.BandwidthLimitsFileName, `{"download":2000}`))
+	code, body = getFile(t, srv, "/public/"+libfs.BandwidthLimitsFileName)
+	require.Equal(t, http.StatusOK, code)
+	var limits libkbfs.BandwidthLimits
+	require.NoError(t, json.Unmarshal([]byte(body), &limits))
+	require.Equal(t, libkbfs.BandwidthLimits{
+		UploadBytesPerSec:   1000,
+		DownloadBytesPerSec: 2000,
+	}, limits)
+	require.Equal(t, limits, config.BandwidthLimiter().Limits())
+}
+
+func TestAliasesAndAccess(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe", "janedoe", "bob")
+	defer shutdownTestServer(t, config, srv)
+
+	// The preferred name puts the current user first, but the
+	// canonical name works too.
+	require.Equal(t, http.StatusCreated,
+		putFile(t, srv, "/private/jdoe,janedoe/myfile", "hello"))
+	code, body := getFile(t, srv, "/private/janedoe,jdoe/myfile")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "hello", body)
+
+	code, _ = getFile(t, srv, "/private/janedoe,bob/myfile")
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = getFile(t, srv, "/private/nosuchuser/myfile")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// Other users' public folders can't be written.
+	require.Equal(t, http.StatusForbidden,
+		putFile(t, srv, "/public/janedoe/myfile", "hello"))
+	// And TLFs can't be created directly in the folder lists.
+	code, _ = doRequest(t, srv, "MKCOL", "/private/newdir", nil, nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestSymlinks(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	require.Equal(t, http.StatusCreated,
+		putFile(t, srv, "/private/jdoe/a/../target", "hello"))
+	code, _ := doRequest(t, srv, "MKCOL", "/private/jdoe/d", nil, nil)
+	require.Equal(t, http.StatusCreated, code)
+
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, config.KBPKI(), "jdoe", false)
+	require.NoError(t, err)
+	root, _, err := config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	require.NoError(t, err)
+	d, _, err := config.KBFSOps().Lookup(ctx, root, "d")
+	require.NoError(t, err)
+	_, err = config.KBFSOps().CreateLink(ctx, d, "link", "../target")
+	require.NoError(t, err)
+	_, err = config.KBFSOps().CreateLink(ctx, root, "dirlink", "d")
+	require.NoError(t, err)
+
+	code, body := getFile(t, srv, "/private/jdoe/dirlink/link")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "hello", body)
+
+	// Deleting a symlink doesn't touch its target.
+	code, _ = doRequest(t, srv, "DELETE", "/private/jdoe/dirlink", nil, nil)
+	require.Equal(t, http.StatusNoContent, code)
+	code, body = getFile(t, srv, "/private/jdoe/d/link")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "hello", body)
+}
+
+func TestNonLocalHost(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	req, err := http.NewRequest("GET", srv.URL+"/private/jdoe", nil)
+	require.NoError(t, err)
+	req.Host = "evil.example.com"
+	req.SetBasicAuth("", testSecret)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// failingReader returns some data and then an error, like a
+// request body that's cut short.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestPutInterrupted(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	require.Equal(t, http.StatusCreated,
+		putFile(t, srv, "/private/jdoe/a", "old contents"))
+
+	f := NewFS(config, false, testSecret)
+	ctx := f.WithContext(context.Background())
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	dir, err := f.resolve(ctx, "/private/jdoe", true, false)
+	require.NoError(t, err)
+	err = f.writeFileAtomically(ctx, dir.node, "a", false,
+		&failingReader{[]byte("new")})
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// The old contents are untouched, and the temporary file is
+	// gone.
+	code, body := getFile(t, srv, "/private/jdoe/a")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "old contents", body)
+	hrefs, _ := propfind(t, srv, "/private/jdoe", "1")
+	require.Equal(t, []string{"/private/jdoe/", "/private/jdoe/a"}, hrefs)
+}
+
+func TestUnauthenticated(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	// Without a password.
+	req, err := http.NewRequest("GET", srv.URL+"/private/jdoe", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+	// With the wrong password.
+	req, err = http.NewRequest("PUT", srv.URL+"/private/jdoe/a",
+		strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.SetBasicAuth("", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	code, _ := getFile(t, srv, "/private/jdoe/a")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestWriteSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdav_secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "sub", "secret")
+	secret, err := writeSecretFile(secretFile)
+	require.NoError(t, err)
+	require.NotEmpty(t, secret)
+	fi, err := os.Stat(secretFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	buf, err := ioutil.ReadFile(secretFile)
+	require.NoError(t, err)
+	require.Equal(t, secret, string(buf))
+
+	// Each launch gets a new secret.
+	secret2, err := writeSecretFile(secretFile)
+	require.NoError(t, err)
+	require.NotEqual(t, secret, secret2)
+}
+
+func TestLock(t *testing.T) {
+	config, srv := makeTestServer(t, "jdoe")
+	defer shutdownTestServer(t, config, srv)
+
+	code, _ := doRequest(t, srv, "OPTIONS", "/", nil, nil)
+	require.Equal(t, http.StatusOK, code)
+
+	// Locking a missing file creates it.
+	code, body := doRequest(t, srv, "LOCK", "/private/jdoe/myfile", nil, nil)
+	require.Equal(t, http.StatusCreated, code)
+	require.Contains(t, body, "opaquelocktoken:")
+	code, body = getFile(t, srv, "/private/jdoe/myfile")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "", body)
+
+	code, _ = doRequest(t, srv, "LOCK", "/private/jdoe/myfile", nil, nil)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, srv, "UNLOCK", "/private/jdoe/myfile", nil, nil)
+	require.Equal(t, http.StatusNoContent, code)
+}
+
+func TestErrToHTTPStatus(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{nil, http.StatusOK},
+		{libkbfs.NoSuchNameError{Name: "a"}, http.StatusNotFound},
+		{libkbfs.NoSuchUserError{Input: "a"}, http.StatusNotFound},
+		{libkbfs.WriteAccessError{}, http.StatusForbidden},
+		{libkbfs.DirNotEmptyError{Name: "a"}, http.StatusConflict},
+		{libkbfs.NameTooLongError{}, http.StatusBadRequest},
+		{libkbfs.BServerErrorOverQuota{}, http.StatusInsufficientStorage},
+		{newStatusError(http.StatusTeapot, "a"), http.StatusTeapot},
+		{errors.New("other"), http.StatusInternalServerError},
+	} {
+		require.Equal(t, test.code, errToHTTPStatus(test.err),
+			"error %v", test.err)
+	}
+}
@@ -557,7 +557,8 @@ func (e *fsEngine) InitTest(t testing.TB, blockSize int64,
 		for i, c := range cfgs {
 			c.EnableJournaling(
 				filepath.Join(jdir, users[i].String()),
-				libkbfs.TLFJournalBackgroundWorkEnabled)
+				libkbfs.TLFJournalBackgroundWorkEnabled,
+				libkbfs.DefaultJournalDiskLimitBytes)
 		}
 	}
 
@@ -88,7 +88,8 @@ func (k *LibKBFS) InitTest(t testing.TB, blockSize int64, blockChangeSize int64,
 		for name, c := range userMap {
 			c.(*libkbfs.ConfigLocal).EnableJournaling(
 				filepath.Join(jdir, name.String()),
-				libkbfs.TLFJournalBackgroundWorkEnabled)
+				libkbfs.TLFJournalBackgroundWorkEnabled,
+				libkbfs.DefaultJournalDiskLimitBytes)
 		}
 	}
 